@@ -16,12 +16,14 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net/http"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
 	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcscaching"
 	"github.com/jacobsa/ratelimit"
 	"github.com/jacobsa/timeutil"
 )
@@ -79,18 +81,125 @@ func setUpRateLimiting(
 	return
 }
 
+// Wrap the supplied bucket in a gcsproxy.PublicReadBucket, probing
+// anonymously to find out whether the bucket is publicly readable.
+func setUpPublicReadFallback(
+	ctx context.Context,
+	flags *flagStorage,
+	name string,
+	in gcs.Bucket) (out gcsproxy.PublicReadBucket, err error) {
+	anonConn, err := getConn(flags, nil)
+	if err != nil {
+		err = fmt.Errorf("getConn: %v", err)
+		return
+	}
+
+	// OpenBucket lists the bucket, which serves as the probe. Objects can be
+	// publicly readable without the bucket being publicly listable, so a
+	// refusal to list proves nothing; in that case the fallback stays enabled,
+	// and disables itself for a while whenever an anonymous read fails. Any
+	// other failure means that anonymous requests can't reach the bucket.
+	anon, probeErr := anonConn.OpenBucket(ctx, name)
+	_, listForbidden := probeErr.(*gcs.ListForbiddenError)
+	public := probeErr == nil || listForbidden
+	if !public {
+		log.Printf(
+			"Warning: ignoring --public-read-fallback, because bucket %q isn't "+
+				"publicly readable: %v",
+			name,
+			probeErr)
+	}
+
+	const disablePeriod = time.Minute
+	out = gcsproxy.NewPublicReadBucket(
+		anon,
+		public,
+		disablePeriod,
+		timeutil.RealClock(),
+		in)
+
+	return
+}
+
+// Return a bucket set up according to the supplied flags. If small files are
+// to be prefetched, or the cache warmed up, prefetcher is the layer
+// responsible. costs counts the
+// operations that reach GCS. publicRead is nil unless --public-read-fallback is
+// set. forgetObject discards whatever the bucket's layers have cached about the
+// named object, such as its record or a failure to read it; it is nil if they
+// cache nothing.
 func setUpBucket(
 	ctx context.Context,
 	flags *flagStorage,
 	conn gcs.Conn,
-	name string) (b gcs.Bucket, err error) {
-	// Extract the appropriate bucket.
+	name string) (
+	b gcs.Bucket,
+	prefetcher gcsproxy.PrefetchBucket,
+	costs gcsproxy.CostBucket,
+	publicRead gcsproxy.PublicReadBucket,
+	forgetObject func(name string),
+	listingDenied bool,
+	err error) {
+	// Extract the appropriate bucket. If we may not list it, carry on without
+	// listing in the hope that we may read objects. There's no telling: GCS
+	// refuses to stat missing objects for such credentials, and we don't know
+	// the name of one that exists.
 	b, err = conn.OpenBucket(ctx, name)
+	if _, ok := err.(*gcs.ListForbiddenError); ok {
+		err = nil
+		listingDenied = true
+		log.Printf(
+			"WARNING: these credentials may not list bucket %q. Directories can't "+
+				"be listed, and files and directories can be reached only by their "+
+				"exact paths. If the credentials may not read objects either, "+
+				"every path will appear not to exist.",
+			name)
+	}
+
 	if err != nil {
 		err = fmt.Errorf("OpenBucket: %v", err)
 		return
 	}
 
+	// Explain what to do about a requester-pays bucket, rather than failing
+	// every request once mounted.
+	if flags.BillingProject == "" && !listingDenied {
+		err = checkRequesterPays(ctx, b)
+		if err != nil {
+			return
+		}
+	}
+
+	// Read public objects anonymously when our credentials fail, if requested.
+	if flags.PublicReadFallback {
+		publicRead, err = setUpPublicReadFallback(ctx, flags, name, b)
+		if err != nil {
+			err = fmt.Errorf("setUpPublicReadFallback: %v", err)
+			return
+		}
+
+		b = publicRead
+	}
+
+	// Count operations by billing class. This must see every request that
+	// reaches GCS, and only those, so it goes innermost.
+	costs = gcsproxy.NewCostBucket(flags.CostLabels, b)
+	b = costs
+
+	// Likewise record request counts and latencies for /metrics.
+	b = gcsproxy.NewMetricsBucket(timeutil.RealClock(), metricsRegistry, b)
+
+	// Limit the number of requests in flight, if requested. This goes inside
+	// rate limiting, so that requests waiting to be throttled don't hold slots.
+	if flags.MaxConcurrentRequests < 0 {
+		err = fmt.Errorf(
+			"--max-concurrent-requests must be non-negative (got %d)",
+			flags.MaxConcurrentRequests)
+		return
+	}
+
+	b = gcsproxy.NewConcurrencyLimitedBucket(flags.MaxConcurrentRequests, b)
+
 	// Enable rate limiting, if requested.
 	b, err = setUpRateLimiting(
 		b,
@@ -102,15 +211,119 @@ func setUpBucket(
 		return
 	}
 
-	// Enable cached StatObject results, if appropriate.
-	if flags.StatCacheTTL != 0 {
-		const cacheCapacity = 4096
-		b = gcscaching.NewFastStatBucket(
-			flags.StatCacheTTL,
-			gcscaching.NewStatCache(cacheCapacity),
+	// Fail doomed reads quickly, if appropriate.
+	var forgetters []func(string)
+	if flags.FailedReadCacheTTL != 0 {
+		const cacheCapacity = 1024
+		failedReads := gcsproxy.NewFailedReadBucket(
+			flags.FailedReadCacheTTL,
+			cacheCapacity,
 			timeutil.RealClock(),
 			b)
+
+		publishFailedReadMetrics(failedReads)
+		forgetters = append(forgetters, failedReads.Invalidate)
+		b = failedReads
+	}
+
+	// Enable cached StatObject results, if appropriate.
+	ttls, err := gcsproxy.ParseStatTTLs(
+		flags.StatCacheTTL,
+		flags.StatCachePrefixTTL)
+
+	if err != nil {
+		err = fmt.Errorf("ParseStatTTLs: %v", err)
+		return
+	}
+
+	if !ttls.Disabled() {
+		const cacheCapacity = 4096
+		statCache := gcsproxy.NewRecordCache(
+			cacheCapacity,
+			ttls,
+			timeutil.RealClock())
+
+		forgetters = append(forgetters, statCache.Erase)
+		b = gcsproxy.NewRecordCachingBucket(statCache, timeutil.RealClock(), b)
+	}
+
+	if len(forgetters) != 0 {
+		forgetObject = func(name string) {
+			for _, f := range forgetters {
+				f(name)
+			}
+		}
+	}
+
+	// Prefetch small files or warm up the cache, if requested. This must see
+	// every lookup, so it goes outside the stat cache.
+	smallFileThreshold := flags.SmallFileThreshold
+	if smallFileThreshold > 0 && listingDenied {
+		log.Println(
+			"Warning: ignoring --small-file-threshold, because prefetching " +
+				"requires listing the bucket.")
+
+		smallFileThreshold = 0
+	}
+
+	if smallFileThreshold > 0 || flags.WarmupFrom != "" {
+		if flags.PrefetchBudget <= 0 {
+			err = fmt.Errorf(
+				"--prefetch-budget must be positive (got %d)",
+				flags.PrefetchBudget)
+			return
+		}
+
+		cfg := gcsproxy.PrefetchConfig{
+			SmallObjectThreshold: smallFileThreshold,
+			Budget:               flags.PrefetchBudget,
+			Trigger:              4,
+			Window:               2 * time.Second,
+			Concurrency:          16,
+			TTL:                  time.Minute,
+		}
+
+		prefetcher = gcsproxy.NewPrefetchBucket(cfg, timeutil.RealClock(), b)
+		b = prefetcher
 	}
 
 	return
 }
+
+// Export the counters of the supplied bucket to /metrics, replacing those of
+// any bucket previously published.
+func publishFailedReadMetrics(b gcsproxy.FailedReadBucket) {
+	metricsRegistry.CounterFunc(
+		"gcsfuse_failed_reads_recorded_total",
+		"Read failures remembered by --failed-read-cache-ttl.",
+		func() uint64 { return b.Stats().Recorded })
+
+	metricsRegistry.CounterFunc(
+		"gcsfuse_failed_reads_suppressed_total",
+		"Reads failed from the --failed-read-cache-ttl cache without "+
+			"contacting GCS.",
+		func() uint64 { return b.Stats().Suppressed })
+}
+
+// Serve a summary of the prefetcher's effectiveness.
+func servePrefetchStats(b gcsproxy.PrefetchBucket) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := b.Stats()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "triggered: %d\n", s.Triggered)
+		fmt.Fprintf(w, "fetched: %d (%d bytes)\n", s.Fetched, s.FetchedBytes)
+		fmt.Fprintf(w, "fetch_failed: %d\n", s.FetchFailed)
+		fmt.Fprintf(w, "hits: %d (%d bytes)\n", s.Hits, s.HitBytes)
+		fmt.Fprintf(w, "wasted: %d (%d bytes)\n", s.Wasted, s.WastedBytes)
+	}
+}
+
+// Serve counters describing the public read fallback.
+func servePublicReadStats(b gcsproxy.PublicReadBucket) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := b.Stats()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "fallbacks: %d\n", s.Fallbacks)
+		fmt.Fprintf(w, "disabled: %d\n", s.Disabled)
+	}
+}
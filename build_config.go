@@ -0,0 +1,219 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/oauth2"
+)
+
+// The parts of the file system's configuration that come from setting up the
+// mount rather than from flags.
+type serverConfigDeps struct {
+	Clock  timeutil.Clock
+	Bucket gcs.Bucket
+
+	// The owner of inodes unless overridden by --uid and --gid, normally the
+	// user running gcsfuse.
+	Uid uint32
+	Gid uint32
+
+	// Whether the bucket turned out not to be listable.
+	ListingDenied bool
+
+	// See fs.ServerConfig.
+	ForgetObject func(name string)
+	Metrics      *metrics.Registry
+	Counters     *fs.Counters
+}
+
+// Parse the value of --unlistable-dirs, returning true if directories that
+// can't be listed should fail with EACCES.
+func parseUnlistableDirs(s string) (eacces bool, err error) {
+	switch s {
+	case "notice":
+	case "eacces":
+		eacces = true
+
+	default:
+		err = fmt.Errorf(
+			"--unlistable-dirs must be \"notice\" or \"eacces\" (got %q)",
+			s)
+	}
+
+	return
+}
+
+// Translate flags into the file system's configuration, applying defaults and
+// checking the result. Everything in the config that depends on a flag is set
+// here and nowhere else.
+func BuildServerConfig(
+	flags *flagStorage,
+	deps serverConfigDeps) (cfg fs.ServerConfig, err error) {
+	unlistableEACCES, err := parseUnlistableDirs(flags.UnlistableDirs)
+	if err != nil {
+		return
+	}
+
+	atimeMode, err := fs.ParseAtimeMode(flags.AtimeMode)
+	if err != nil {
+		err = fmt.Errorf("--atime-mode: %v", err)
+		return
+	}
+
+	cfg = fs.ServerConfig{
+		Clock:                    deps.Clock,
+		Bucket:                   deps.Bucket,
+		OnlyDir:                  flags.OnlyDir,
+		TempDir:                  flags.TempDir,
+		TempDirLimitNumFiles:     flags.TempDirLimitFiles,
+		TempDirLimitBytes:        flags.TempDirLimit,
+		TempDirMaxFreeFraction:   flags.TempDirMaxFree,
+		TempDirLimitBytesPerFile: flags.MaxCachedFileSize,
+		GCSChunkSize:             flags.GCSChunkSize,
+		ReadaheadChunks:          flags.ReadaheadChunks,
+		ImplicitDirectories:      flags.ImplicitDirs,
+		DirTypeCacheTTL:          flags.TypeCacheTTL,
+		TombstoneTTL:             flags.TombstoneTTL,
+		DirCacheTTL:              flags.DirCacheTTL,
+		NegativeTTL:              flags.NegativeTTL,
+		Uid:                      deps.Uid,
+		Gid:                      deps.Gid,
+		FilePerms:                os.FileMode(flags.FileMode),
+		DirPerms:                 os.FileMode(flags.DirMode),
+
+		AppendThreshold:          flags.AppendThreshold,
+		TmpObjectPrefix:          flags.TmpObjectPrefix,
+		ResumableUploadThreshold: flags.ResumableUploadThreshold,
+
+		DisableChecksumValidation: flags.DisableChecksumValidation,
+
+		TranscodeGzipSuffixes:    flags.TranscodeGzipSuffixes,
+		DropTranscodedGzipSuffix: flags.TranscodeGzipDropSuffix,
+		RejectSparseWritesOver:   flags.RejectSparseWritesOver,
+		StableIdentity:           flags.StableIdentity,
+		DefaultMetadata:          flags.DefaultMetadata,
+		MtimeLayouts:             flags.MtimeLayouts,
+		ReadOnly:                 flags.ReadOnly,
+		CheckPermissions:         !flags.NoPermissionsCheck,
+		MaxOpenHandles:           flags.MaxOpenHandles,
+		MaxPathDepth:             flags.MaxPathDepth,
+		MaxChildrenPerDir:        flags.MaxChildrenPerDir,
+		RenameDirLimit:           flags.RenameDirLimit,
+		HandleIdleTimeout:        flags.HandleIdleTimeout,
+		DirtySyncInterval:        flags.DirtySyncInterval,
+		IgnoreFlushErrors:        flags.IgnoreFlushErrors,
+		StreamingReadThreshold:   flags.StreamReadsOver,
+		AtimeMode:                atimeMode,
+		AtimePersistInterval:     flags.AtimePersistInterval,
+
+		ListingDenied:       deps.ListingDenied,
+		ListingDeniedEACCES: deps.ListingDenied && unlistableEACCES,
+		ForgetObject:        deps.ForgetObject,
+		Metrics:             deps.Metrics,
+		Counters:            deps.Counters,
+	}
+
+	// Zero means to choose based on the process's limit on open files.
+	if flags.TempDirLimitFiles == 0 {
+		cfg.TempDirLimitNumFiles = fs.ChooseTempDirLimitNumFiles()
+	}
+
+	if flags.Uid >= 0 {
+		cfg.Uid = uint32(flags.Uid)
+		cfg.FixedOwner = true
+	}
+
+	if flags.Gid >= 0 {
+		cfg.Gid = uint32(flags.Gid)
+		cfg.FixedOwner = true
+	}
+
+	err = fs.ValidateServerConfig(&cfg)
+	if err != nil {
+		err = fmt.Errorf("Checking flags: %v", err)
+		return
+	}
+
+	return
+}
+
+// Translate flags into the configuration of the HTTP transport used to talk to
+// GCS.
+func buildTransportConfig(flags *flagStorage) (tc transportConfig, err error) {
+	tc = transportConfig{
+		TCPKeepAlive:          flags.TCPKeepAlive,
+		IdleConnTimeout:       flags.HTTPIdleConnTimeout,
+		ResponseHeaderTimeout: flags.HTTPResponseHeaderTimeout,
+		HTTPProxy:             flags.HTTPProxy,
+		BillingProject:        flags.BillingProject,
+	}
+
+	// Ask for only the object fields that the file system will use, unless
+	// told otherwise.
+	if !flags.DebugFullObjects {
+		tc.ObjectFields, err = gcsproxy.ObjectFields.Fields(
+			fs.ObjectFieldFeatures(flags.ReadOnly))
+
+		if err != nil {
+			err = fmt.Errorf("ObjectFields: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Translate flags into the configuration of the connection to GCS. If
+// tokenSrc is nil, the connection sends no credentials.
+func BuildConnConfig(
+	flags *flagStorage,
+	tokenSrc oauth2.TokenSource) (cfg gcs.ConnConfig, err error) {
+	tc, err := buildTransportConfig(flags)
+	if err != nil {
+		return
+	}
+
+	// Anonymous requests can't be billed to anyone, and GCS refuses them if
+	// they name a project.
+	if tokenSrc == nil {
+		tc.BillingProject = ""
+	}
+
+	cfg = gcs.ConnConfig{
+		TokenSource: tokenSrc,
+		Anonymous:   tokenSrc == nil,
+		UserAgent:   getUserAgent(flags.AppName),
+		Transport:   newTransport(tc),
+	}
+
+	if flags.DebugHTTP {
+		cfg.HTTPDebugLogger = log.New(log.Writer(), "http: ", 0)
+	}
+
+	if flags.DebugGCS {
+		cfg.GCSDebugLogger = log.New(log.Writer(), "gcs: ", 0)
+	}
+
+	return
+}
@@ -0,0 +1,342 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestBuildConfig(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Fields of flagStorage that are deliberately not consumed by
+// BuildServerConfig, BuildConnConfig, or fuseMountConfig, and where they are
+// used instead. Anything else that none of those look at is a flag that does
+// nothing.
+var flagsPlumbedElsewhere = map[string]string{
+	"EgressBandwidthLimitBytesPerSecond": "setUpBucket",
+	"OpRateLimitHz":                      "setUpBucket",
+	"MaxConcurrentRequests":              "setUpBucket",
+	"PublicReadFallback":                 "setUpBucket",
+	"CostLabels":                         "setUpBucket",
+	"StatCacheTTL":                       "setUpBucket",
+	"StatCachePrefixTTL":                 "setUpBucket",
+	"FailedReadCacheTTL":                 "setUpBucket",
+	"SmallFileThreshold":                 "setUpBucket",
+	"PrefetchBudget":                     "setUpBucket",
+	"WarmupFrom":                         "setUpBucket",
+
+	"AllowMountOver":      "mount",
+	"CostSummaryInterval": "mount",
+	"OpPrices":            "mount",
+	"PrintStatsInterval":  "mount",
+	"DebugEndpoint":       "mount",
+
+	"KeyFile":         "getTokenSource",
+	"DebugInvariants": "mountWithFlags",
+	"ExplainPaths":    "explain",
+
+	"AutoRemount":         "run",
+	"UnmountRetryTimeout": "run",
+	"Foreground":          "run",
+	"LogFile":             "run",
+	"LogToSyslog":         "run",
+	"DebugCPUProfile":     "run",
+	"DebugMemProfile":     "run",
+	"ProfileDir":          "run",
+	"Explain":             "run",
+}
+
+// Everything built from flags by the functions meant to consume them, in a
+// form that can be compared.
+type plumbing struct {
+	server    fs.ServerConfig
+	serverErr string
+
+	conn      gcs.ConnConfig
+	transport transportConfig
+	connErr   string
+
+	mount    fuse.MountConfig
+	mountErr string
+
+	// Loggers can't be compared either, so record which were set.
+	loggers []bool
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// Return a value of the same type as v that differs from it.
+func perturb(v reflect.Value) (p reflect.Value) {
+	p = reflect.New(v.Type()).Elem()
+
+	switch v.Kind() {
+	case reflect.Bool:
+		p.SetBool(!v.Bool())
+
+	case reflect.Int, reflect.Int64:
+		p.SetInt(v.Int() + 7)
+
+	case reflect.Uint32, reflect.Uint64:
+		p.SetUint(v.Uint() + 7)
+
+	case reflect.Float64:
+		p.SetFloat(v.Float() + 1.5)
+
+	case reflect.String:
+		p.SetString(v.String() + "x")
+
+	case reflect.Slice:
+		p.Set(reflect.Append(v, reflect.ValueOf("x")))
+
+	case reflect.Map:
+		p.Set(reflect.MakeMap(v.Type()))
+		for _, k := range v.MapKeys() {
+			p.SetMapIndex(k, v.MapIndex(k))
+		}
+
+		p.SetMapIndex(reflect.ValueOf("x"), reflect.ValueOf("y"))
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			p = reflect.New(v.Type().Elem())
+		}
+
+	default:
+		AddFailure("Don't know how to perturb a %v", v.Type())
+		AbortTest()
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type BuildConfigTest struct {
+	deps serverConfigDeps
+}
+
+var _ SetUpInterface = &BuildConfigTest{}
+
+func init() { RegisterTestSuite(&BuildConfigTest{}) }
+
+func (t *BuildConfigTest) SetUp(ti *TestInfo) {
+	clock := timeutil.RealClock()
+	t.deps = serverConfigDeps{
+		Clock:  clock,
+		Bucket: gcsfake.NewFakeBucket(clock, "some_bucket"),
+		Uid:    17,
+		Gid:    19,
+	}
+}
+
+func (t *BuildConfigTest) plumb(flags *flagStorage) (p plumbing) {
+	var err error
+
+	p.server, err = BuildServerConfig(flags, t.deps)
+	p.serverErr = errString(err)
+
+	// Transports can't be compared, so look at what they were built from.
+	p.conn, err = BuildConnConfig(flags, nil)
+	p.connErr = errString(err)
+	p.conn.Transport = nil
+	p.transport, _ = buildTransportConfig(flags)
+
+	mountCfg, err := fuseMountConfig("some_bucket", flags)
+	p.mountErr = errString(err)
+	if mountCfg != nil {
+		p.mount = *mountCfg
+	}
+
+	p.loggers = []bool{
+		p.conn.HTTPDebugLogger != nil,
+		p.conn.GCSDebugLogger != nil,
+		p.mount.ErrorLogger != nil,
+		p.mount.DebugLogger != nil,
+	}
+
+	p.conn.HTTPDebugLogger = nil
+	p.conn.GCSDebugLogger = nil
+	p.mount.ErrorLogger = nil
+	p.mount.DebugLogger = nil
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *BuildConfigTest) EveryFlagIsPlumbed() {
+	base := parseArgs([]string{})
+	expected := t.plumb(base)
+	AssertEq("", expected.serverErr)
+	AssertTrue(
+		reflect.DeepEqual(expected, t.plumb(base)),
+		"Building configs from the same flags gives different results")
+
+	// Changing any flag that isn't used elsewhere should change something.
+	typ := reflect.TypeOf(*base)
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+
+		flags := *base
+		v := reflect.ValueOf(&flags).Elem().Field(i)
+		v.Set(perturb(v))
+
+		consumed := !reflect.DeepEqual(expected, t.plumb(&flags))
+		where, listed := flagsPlumbedElsewhere[name]
+
+		switch {
+		case !consumed && !listed:
+			AddFailure(
+				"flagStorage.%s does nothing. Consume it in BuildServerConfig, "+
+					"BuildConnConfig, or fuseMountConfig, or add it to "+
+					"flagsPlumbedElsewhere.",
+				name)
+
+		case consumed && listed:
+			AddFailure(
+				"flagStorage.%s is consumed when building configs, but is listed as "+
+					"used by %s.",
+				name,
+				where)
+		}
+	}
+}
+
+func (t *BuildConfigTest) AllowlistNamesRealFields() {
+	typ := reflect.TypeOf(flagStorage{})
+	for name := range flagsPlumbedElsewhere {
+		_, ok := typ.FieldByName(name)
+		ExpectTrue(ok, "%s", name)
+	}
+}
+
+func (t *BuildConfigTest) OwnerFromDeps() {
+	cfg, err := BuildServerConfig(parseArgs([]string{}), t.deps)
+	AssertEq(nil, err)
+
+	ExpectEq(17, cfg.Uid)
+	ExpectEq(19, cfg.Gid)
+	ExpectFalse(cfg.FixedOwner)
+}
+
+func (t *BuildConfigTest) OwnerFromFlags() {
+	flags := parseArgs([]string{"--uid=23", "--gid=0"})
+	cfg, err := BuildServerConfig(flags, t.deps)
+	AssertEq(nil, err)
+
+	ExpectEq(23, cfg.Uid)
+	ExpectEq(0, cfg.Gid)
+	ExpectTrue(cfg.FixedOwner)
+}
+
+func (t *BuildConfigTest) PermissionsCheck() {
+	cfg, err := BuildServerConfig(parseArgs([]string{}), t.deps)
+	AssertEq(nil, err)
+	ExpectTrue(cfg.CheckPermissions)
+
+	flags := parseArgs([]string{"--no-permissions-check"})
+	cfg, err = BuildServerConfig(flags, t.deps)
+	AssertEq(nil, err)
+	ExpectFalse(cfg.CheckPermissions)
+}
+
+func (t *BuildConfigTest) UnlistableDirs() {
+	flags := parseArgs([]string{"--unlistable-dirs=eacces"})
+
+	// Only relevant if the bucket turns out not to be listable.
+	cfg, err := BuildServerConfig(flags, t.deps)
+	AssertEq(nil, err)
+	ExpectFalse(cfg.ListingDenied)
+	ExpectFalse(cfg.ListingDeniedEACCES)
+
+	t.deps.ListingDenied = true
+	cfg, err = BuildServerConfig(flags, t.deps)
+	AssertEq(nil, err)
+	ExpectTrue(cfg.ListingDenied)
+	ExpectTrue(cfg.ListingDeniedEACCES)
+
+	flags.UnlistableDirs = "taco"
+	_, err = BuildServerConfig(flags, t.deps)
+	ExpectThat(err, Error(HasSubstr("--unlistable-dirs")))
+}
+
+func (t *BuildConfigTest) AtimeMode() {
+	cfg, err := BuildServerConfig(parseArgs(nil), t.deps)
+	AssertEq(nil, err)
+	ExpectEq(fs.AtimeOff, cfg.AtimeMode)
+
+	flags := parseArgs([]string{
+		"--atime-mode=persist-relatime",
+		"--atime-persist-interval=1h",
+	})
+
+	cfg, err = BuildServerConfig(flags, t.deps)
+	AssertEq(nil, err)
+	ExpectEq(fs.AtimePersistRelatime, cfg.AtimeMode)
+	ExpectEq(time.Hour, cfg.AtimePersistInterval)
+
+	// Persisting needs a writable file system.
+	flags.ReadOnly = true
+	_, err = BuildServerConfig(flags, t.deps)
+	ExpectThat(err, Error(HasSubstr("ReadOnly")))
+
+	flags = parseArgs([]string{"--atime-mode=strict"})
+	_, err = BuildServerConfig(flags, t.deps)
+	ExpectThat(err, Error(HasSubstr("--atime-mode")))
+	ExpectThat(err, Error(HasSubstr("strict")))
+}
+
+func (t *BuildConfigTest) InvalidCombination() {
+	flags := parseArgs([]string{"--transcode-gzip-drop-suffix"})
+	_, err := BuildServerConfig(flags, t.deps)
+	ExpectThat(err, Error(HasSubstr("Checking flags")))
+}
+
+func (t *BuildConfigTest) ConnConfig() {
+	flags := parseArgs([]string{"--app-name=taco", "--debug_gcs"})
+	cfg, err := BuildConnConfig(flags, nil)
+	AssertEq(nil, err)
+
+	ExpectTrue(cfg.Anonymous)
+	ExpectThat(cfg.UserAgent, HasSubstr("gcsfuse/"))
+	ExpectThat(cfg.UserAgent, HasSubstr("(taco)"))
+	ExpectNe(nil, cfg.Transport)
+	ExpectNe(nil, cfg.GCSDebugLogger)
+	ExpectEq(nil, cfg.HTTPDebugLogger)
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+// The base URL of the GCS JSON API, used for fetching bucket metadata that
+// the gcs package doesn't expose.
+const storageAPIBaseURL = "https://www.googleapis.com/storage/v1"
+
+// Something that a bucket may or may not support, which some features depend
+// upon.
+type bucketCapability int
+
+const (
+	// Per-object ACLs exist. They don't for buckets with uniform bucket-level
+	// access enabled.
+	capObjectACLs bucketCapability = iota
+)
+
+func (c bucketCapability) String() string {
+	switch c {
+	case capObjectACLs:
+		return "object ACLs"
+
+	default:
+		return fmt.Sprintf("bucketCapability(%d)", int(c))
+	}
+}
+
+// The set of capabilities supported by a bucket, along with the reason for
+// each one that is missing.
+type bucketCapabilities struct {
+	missing map[bucketCapability]string
+}
+
+// Return the capabilities of a bucket with the given metadata, as returned by
+// the GCS JSON API.
+func capabilitiesFromMetadata(md *bucketMetadata) (caps bucketCapabilities) {
+	caps.missing = make(map[bucketCapability]string)
+
+	iam := md.IAMConfiguration
+	if iam.UniformBucketLevelAccess.Enabled || iam.BucketPolicyOnly.Enabled {
+		caps.missing[capObjectACLs] = "the bucket uses uniform bucket-level access"
+	}
+
+	return
+}
+
+// Return the reason that the capability is missing, or the empty string if it
+// is present.
+func (caps bucketCapabilities) whyMissing(c bucketCapability) string {
+	return caps.missing[c]
+}
+
+// The parts of the GCS JSON API's bucket resource that we care about.
+type bucketMetadata struct {
+	IAMConfiguration struct {
+		UniformBucketLevelAccess struct {
+			Enabled bool `json:"enabled"`
+		} `json:"uniformBucketLevelAccess"`
+
+		// The older name for uniform bucket-level access.
+		BucketPolicyOnly struct {
+			Enabled bool `json:"enabled"`
+		} `json:"bucketPolicyOnly"`
+	} `json:"iamConfiguration"`
+}
+
+// Fetch the capabilities of the named bucket using the supplied HTTP client,
+// which must be authorized to read the bucket's metadata.
+func fetchBucketCapabilities(
+	ctx context.Context,
+	client *http.Client,
+	baseURL string,
+	bucketName string) (caps bucketCapabilities, err error) {
+	u := fmt.Sprintf(
+		"%s/b/%s?fields=iamConfiguration",
+		baseURL,
+		url.QueryEscape(bucketName))
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		err = fmt.Errorf("NewRequest: %v", err)
+		return
+	}
+
+	req.Cancel = ctx.Done()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("Do: %v", err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+		return
+	}
+
+	var md bucketMetadata
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&md)
+	if err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	caps = capabilitiesFromMetadata(&md)
+	return
+}
+
+// A feature, enabled by a flag, that works only on buckets with certain
+// capabilities.
+type gatedFeature struct {
+	// The name of the flag that enables the feature.
+	Flag string
+
+	// The capabilities that the bucket must have.
+	Requires []bucketCapability
+
+	// Return true if the feature is enabled in the supplied flags.
+	Requested func(flags *flagStorage) bool
+
+	// Disable the feature in the supplied flags.
+	Disable func(flags *flagStorage)
+}
+
+// Features that depend on bucket capabilities. None of the features that
+// currently exist do; features such as inferring permissions from ACLs should
+// be added here, so that they are turned off with a single warning on buckets
+// that can't support them rather than failing on every operation.
+var gatedFeatures = []gatedFeature{}
+
+// The outcome of gating a feature.
+type featureState struct {
+	Flag      string
+	Requested bool
+	Active    bool
+
+	// Why a requested feature is not active. Empty otherwise.
+	Reason string
+}
+
+// For each of the supplied features that is requested in the flags, check that
+// the bucket has the capabilities it requires, disabling it with a warning if
+// not. getCaps is called at most once, and only if some feature is requested.
+// If it fails, features are left as requested.
+func gateFeatures(
+	features []gatedFeature,
+	flags *flagStorage,
+	getCaps func() (bucketCapabilities, error)) (states []featureState) {
+	// Find out what the bucket supports, the first time we need to.
+	var caps *bucketCapabilities
+	var capsErr error
+	whyUnsupported := func(f gatedFeature) string {
+		if caps == nil && capsErr == nil {
+			var c bucketCapabilities
+			if c, capsErr = getCaps(); capsErr != nil {
+				log.Printf(
+					"Warning: couldn't determine bucket capabilities; "+
+						"assuming all features are supported: %v",
+					capsErr)
+			} else {
+				caps = &c
+			}
+		}
+
+		if caps == nil {
+			return ""
+		}
+
+		for _, c := range f.Requires {
+			if why := caps.whyMissing(c); why != "" {
+				return fmt.Sprintf("requires %v, but %s", c, why)
+			}
+		}
+
+		return ""
+	}
+
+	for _, f := range features {
+		s := featureState{
+			Flag:      f.Flag,
+			Requested: f.Requested(flags),
+		}
+
+		s.Active = s.Requested
+
+		// Disable the feature if the bucket can't support it.
+		if s.Requested {
+			if s.Reason = whyUnsupported(f); s.Reason != "" {
+				log.Printf("Warning: disabling --%s: %s.", f.Flag, s.Reason)
+				s.Active = false
+				f.Disable(flags)
+			}
+		}
+
+		states = append(states, s)
+	}
+
+	return
+}
+
+// Serve a plain text listing of the supplied feature states.
+func serveFeatures(states []featureState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, s := range states {
+			fmt.Fprintf(
+				w,
+				"--%s: requested=%v active=%v",
+				s.Flag,
+				s.Requested,
+				s.Active)
+
+			if s.Reason != "" {
+				fmt.Fprintf(w, " (%s)", s.Reason)
+			}
+
+			fmt.Fprintln(w)
+		}
+	}
+}
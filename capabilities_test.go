@@ -0,0 +1,248 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestCapabilities(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CapabilitiesTest struct {
+	flags flagStorage
+
+	// Features that stand in for real ones, enabled by the ImplicitDirs and
+	// AllowMountOver flags respectively.
+	needsACLs    gatedFeature
+	needsNothing gatedFeature
+
+	// The number of times getCaps has been called.
+	getCapsCalls int
+}
+
+func init() { RegisterTestSuite(&CapabilitiesTest{}) }
+
+func (t *CapabilitiesTest) SetUp(ti *TestInfo) {
+	t.needsACLs = gatedFeature{
+		Flag:      "needs-acls",
+		Requires:  []bucketCapability{capObjectACLs},
+		Requested: func(f *flagStorage) bool { return f.ImplicitDirs },
+		Disable:   func(f *flagStorage) { f.ImplicitDirs = false },
+	}
+
+	t.needsNothing = gatedFeature{
+		Flag:      "needs-nothing",
+		Requested: func(f *flagStorage) bool { return f.AllowMountOver },
+		Disable:   func(f *flagStorage) { f.AllowMountOver = false },
+	}
+}
+
+func (t *CapabilitiesTest) gate(
+	caps bucketCapabilities,
+	err error) []featureState {
+	getCaps := func() (bucketCapabilities, error) {
+		t.getCapsCalls++
+		return caps, err
+	}
+
+	return gateFeatures(
+		[]gatedFeature{t.needsACLs, t.needsNothing},
+		&t.flags,
+		getCaps)
+}
+
+func uniformAccessCaps() bucketCapabilities {
+	md := &bucketMetadata{}
+	md.IAMConfiguration.UniformBucketLevelAccess.Enabled = true
+	return capabilitiesFromMetadata(md)
+}
+
+func fineGrainedAccessCaps() bucketCapabilities {
+	return capabilitiesFromMetadata(&bucketMetadata{})
+}
+
+// Serve the supplied bucket metadata JSON for any request, recording the
+// request URL.
+func serveMetadata(json string, urls *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*urls = append(*urls, r.URL.String())
+			fmt.Fprint(w, json)
+		}))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CapabilitiesTest) NothingRequested() {
+	states := t.gate(uniformAccessCaps(), nil)
+
+	// We shouldn't have bothered looking at the bucket.
+	ExpectEq(0, t.getCapsCalls)
+
+	AssertEq(2, len(states))
+	ExpectThat(states[0], DeepEquals(featureState{Flag: "needs-acls"}))
+	ExpectThat(states[1], DeepEquals(featureState{Flag: "needs-nothing"}))
+}
+
+func (t *CapabilitiesTest) RequestedAndSupported() {
+	t.flags.ImplicitDirs = true
+	t.flags.AllowMountOver = true
+
+	states := t.gate(fineGrainedAccessCaps(), nil)
+
+	ExpectEq(1, t.getCapsCalls)
+	ExpectTrue(t.flags.ImplicitDirs)
+	ExpectTrue(t.flags.AllowMountOver)
+
+	AssertEq(2, len(states))
+	ExpectTrue(states[0].Active)
+	ExpectEq("", states[0].Reason)
+	ExpectTrue(states[1].Active)
+}
+
+func (t *CapabilitiesTest) RequestedButUnsupported() {
+	t.flags.ImplicitDirs = true
+
+	states := t.gate(uniformAccessCaps(), nil)
+
+	ExpectEq(1, t.getCapsCalls)
+	ExpectFalse(t.flags.ImplicitDirs)
+
+	AssertEq(2, len(states))
+	ExpectTrue(states[0].Requested)
+	ExpectFalse(states[0].Active)
+	ExpectThat(states[0].Reason, HasSubstr("object ACLs"))
+	ExpectThat(states[0].Reason, HasSubstr("uniform bucket-level access"))
+
+	ExpectFalse(states[1].Requested)
+	ExpectFalse(states[1].Active)
+}
+
+func (t *CapabilitiesTest) UnconstrainedFeatureOnRestrictedBucket() {
+	t.flags.AllowMountOver = true
+
+	states := t.gate(uniformAccessCaps(), nil)
+
+	ExpectTrue(t.flags.AllowMountOver)
+
+	AssertEq(2, len(states))
+	ExpectTrue(states[1].Requested)
+	ExpectTrue(states[1].Active)
+}
+
+func (t *CapabilitiesTest) CapabilitiesUnavailable() {
+	t.flags.ImplicitDirs = true
+	t.flags.AllowMountOver = true
+
+	states := t.gate(bucketCapabilities{}, errors.New("taco"))
+
+	// We should have tried only once, and left everything as requested.
+	ExpectEq(1, t.getCapsCalls)
+	ExpectTrue(t.flags.ImplicitDirs)
+	ExpectTrue(t.flags.AllowMountOver)
+
+	AssertEq(2, len(states))
+	ExpectTrue(states[0].Active)
+	ExpectTrue(states[1].Active)
+}
+
+func (t *CapabilitiesTest) FetchUniformAccessBucket() {
+	var urls []string
+	server := serveMetadata(
+		`{"iamConfiguration": {"uniformBucketLevelAccess": {"enabled": true}}}`,
+		&urls)
+	defer server.Close()
+
+	// Fetch the capabilities.
+	caps, err := fetchBucketCapabilities(
+		context.Background(),
+		http.DefaultClient,
+		server.URL,
+		"some bucket")
+
+	AssertEq(nil, err)
+	ExpectThat(urls, ElementsAre("/b/some+bucket?fields=iamConfiguration"))
+	ExpectNe("", caps.whyMissing(capObjectACLs))
+
+	// A requested feature needing ACLs should be turned off.
+	t.flags.ImplicitDirs = true
+	states := t.gate(caps, nil)
+
+	ExpectFalse(t.flags.ImplicitDirs)
+	ExpectFalse(states[0].Active)
+}
+
+func (t *CapabilitiesTest) FetchBucketPolicyOnlyBucket() {
+	var urls []string
+	server := serveMetadata(
+		`{"iamConfiguration": {"bucketPolicyOnly": {"enabled": true}}}`,
+		&urls)
+	defer server.Close()
+
+	caps, err := fetchBucketCapabilities(
+		context.Background(),
+		http.DefaultClient,
+		server.URL,
+		"foo")
+
+	AssertEq(nil, err)
+	ExpectNe("", caps.whyMissing(capObjectACLs))
+}
+
+func (t *CapabilitiesTest) FetchFineGrainedAccessBucket() {
+	var urls []string
+	server := serveMetadata(`{}`, &urls)
+	defer server.Close()
+
+	caps, err := fetchBucketCapabilities(
+		context.Background(),
+		http.DefaultClient,
+		server.URL,
+		"foo")
+
+	AssertEq(nil, err)
+	ExpectEq("", caps.whyMissing(capObjectACLs))
+}
+
+func (t *CapabilitiesTest) FetchFails() {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", http.StatusForbidden)
+		}))
+	defer server.Close()
+
+	_, err := fetchBucketCapabilities(
+		context.Background(),
+		http.DefaultClient,
+		server.URL,
+		"foo")
+
+	ExpectThat(err, Error(HasSubstr("403")))
+}
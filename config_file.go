@@ -0,0 +1,419 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgeewax/cli"
+)
+
+// Load a config file for the supplied flags. The file contains a JSON object
+// mapping flag names, as given on the command line without dashes, to values:
+//
+//     {
+//       "implicit-dirs": true,
+//       "stat-cache-ttl": "5m",
+//       "dir-mode": "0750",
+//       "o": ["allow_other"]
+//     }
+//
+// Integer flags accept numbers or strings in any base understood by the
+// command line, durations accept strings like "1h30m", and repeated flags
+// accept arrays of strings. Modes accept octal strings, as on the command
+// line, or numbers, as they did when they were integer flags.
+//
+// The result maps flag names to values of the type that cli.Context returns
+// for the flag. Unknown names and values of the wrong type are errors that
+// name the line of the file on which they appear.
+func loadConfigFile(
+	path string,
+	flags []cli.Flag) (values map[string]interface{}, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	values, err = parseConfigFile(path, contents, flags)
+	return
+}
+
+// The implementation of loadConfigFile, after reading the file.
+func parseConfigFile(
+	path string,
+	contents []byte,
+	flags []cli.Flag) (values map[string]interface{}, err error) {
+	values = make(map[string]interface{})
+
+	// Index the flags by name.
+	byName := make(map[string]cli.Flag)
+	for _, f := range flags {
+		for _, name := range flagNames(f) {
+			byName[name] = f
+		}
+	}
+
+	// Report errors with the line at the given offset.
+	wrapErr := func(offset int64, format string, v ...interface{}) error {
+		line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+		return fmt.Errorf("%s:%d: %s", path, line, fmt.Sprintf(format, v...))
+	}
+
+	// We walk the top-level object ourselves, in order to know where each
+	// value appears.
+	d := json.NewDecoder(bytes.NewReader(contents))
+	d.UseNumber()
+
+	tok, err := d.Token()
+	if err != nil {
+		err = wrapErr(d.InputOffset(), "%v", err)
+		return
+	}
+
+	if tok != json.Delim('{') {
+		err = wrapErr(0, "expected a JSON object")
+		return
+	}
+
+	for d.More() {
+		// Read the name, noting where it ends for use in errors.
+		tok, err = d.Token()
+		if err != nil {
+			err = wrapErr(d.InputOffset(), "%v", err)
+			return
+		}
+
+		name := tok.(string)
+		offset := d.InputOffset()
+
+		// Read the value.
+		var raw interface{}
+		err = d.Decode(&raw)
+		if err != nil {
+			err = wrapErr(d.InputOffset(), "%v", err)
+			return
+		}
+
+		// Convert it according to the flag.
+		f, ok := byName[name]
+		switch {
+		case !ok:
+			err = wrapErr(offset, "unknown flag %q", name)
+			return
+
+		case name == "help" || name == "h" ||
+			name == "version" || name == "v" ||
+			name == "config-file":
+			err = wrapErr(offset, "flag %q may not be set in a config file", name)
+			return
+		}
+
+		if _, ok := values[flagNames(f)[0]]; ok {
+			err = wrapErr(offset, "flag %q given twice", name)
+			return
+		}
+
+		var v interface{}
+		v, err = convertConfigValue(f, raw)
+		if err != nil {
+			err = wrapErr(offset, "bad value for flag %q: %v", name, err)
+			return
+		}
+
+		values[flagNames(f)[0]] = v
+	}
+
+	// Make sure that's everything.
+	_, err = d.Token()
+	if err != nil {
+		err = wrapErr(d.InputOffset(), "%v", err)
+		return
+	}
+
+	if _, err = d.Token(); err == nil {
+		err = wrapErr(d.InputOffset(), "unexpected data after JSON object")
+		return
+	}
+
+	err = nil
+	return
+}
+
+// Return the names of a flag, with the primary name first.
+func flagNames(f cli.Flag) (names []string) {
+	var spec string
+	switch f := f.(type) {
+	case cli.BoolFlag:
+		spec = f.Name
+	case cli.IntFlag:
+		spec = f.Name
+	case cli.Float64Flag:
+		spec = f.Name
+	case cli.DurationFlag:
+		spec = f.Name
+	case cli.StringFlag:
+		spec = f.Name
+	case cli.StringSliceFlag:
+		spec = f.Name
+	}
+
+	for _, name := range strings.Split(spec, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+
+	return
+}
+
+// Flags whose values are permission bits. See convertModeValue.
+var modeFlags = map[string]bool{
+	"dir-mode":  true,
+	"file-mode": true,
+}
+
+// Convert a value decoded from JSON (with UseNumber) to the type of value that
+// cli.Context returns for the supplied flag.
+func convertConfigValue(
+	f cli.Flag,
+	raw interface{}) (v interface{}, err error) {
+	if modeFlags[flagNames(f)[0]] {
+		v, err = convertModeValue(raw)
+		return
+	}
+
+	switch f.(type) {
+	case cli.BoolFlag:
+		b, ok := raw.(bool)
+		if !ok {
+			err = fmt.Errorf("expected true or false")
+			return
+		}
+
+		v = b
+
+	case cli.IntFlag:
+		var s string
+		switch raw := raw.(type) {
+		case json.Number:
+			s = raw.String()
+		case string:
+			s = raw
+		default:
+			err = fmt.Errorf("expected an integer")
+			return
+		}
+
+		var i int64
+		i, err = strconv.ParseInt(s, 0, strconv.IntSize)
+		if err != nil {
+			err = fmt.Errorf("expected an integer, got %q", s)
+			return
+		}
+
+		v = int(i)
+
+	case cli.Float64Flag:
+		var s string
+		switch raw := raw.(type) {
+		case json.Number:
+			s = raw.String()
+		case string:
+			s = raw
+		default:
+			err = fmt.Errorf("expected a number")
+			return
+		}
+
+		var x float64
+		x, err = strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(x) {
+			err = fmt.Errorf("expected a number, got %q", s)
+			return
+		}
+
+		v = x
+
+	case cli.DurationFlag:
+		s, ok := raw.(string)
+		if !ok {
+			err = fmt.Errorf("expected a duration string like \"1m\"")
+			return
+		}
+
+		v, err = time.ParseDuration(s)
+		if err != nil {
+			return
+		}
+
+	case cli.StringFlag:
+		s, ok := raw.(string)
+		if !ok {
+			err = fmt.Errorf("expected a string")
+			return
+		}
+
+		v = s
+
+	case cli.StringSliceFlag:
+		elems, ok := raw.([]interface{})
+		if !ok {
+			err = fmt.Errorf("expected an array of strings")
+			return
+		}
+
+		var ss []string
+		for _, e := range elems {
+			s, ok := e.(string)
+			if !ok {
+				err = fmt.Errorf("expected an array of strings")
+				return
+			}
+
+			ss = append(ss, s)
+		}
+
+		v = ss
+
+	default:
+		err = fmt.Errorf("unsupported flag type %T", f)
+		return
+	}
+
+	return
+}
+
+// Convert the value of a mode flag to the octal string that parseMode
+// expects. A number is taken as the value of the mode itself, so that 420
+// means 0644, as it did when the modes were integer flags.
+func convertModeValue(raw interface{}) (v interface{}, err error) {
+	var s string
+	switch raw := raw.(type) {
+	case json.Number:
+		var i int64
+		i, err = strconv.ParseInt(raw.String(), 10, 64)
+		if err != nil || i < 0 {
+			err = fmt.Errorf("expected permission bits, got %s", raw)
+			return
+		}
+
+		s = strconv.FormatInt(i, 8)
+
+	case string:
+		s = raw
+
+	default:
+		err = fmt.Errorf("expected permission bits as an octal string")
+		return
+	}
+
+	if _, err = parseMode(s); err != nil {
+		return
+	}
+
+	v = s
+	return
+}
+
+// Flag values taken from the command line, falling back to a config file, and
+// then to the flags' defaults. A flag given on the command line replaces any
+// value in the file entirely, even for repeated flags like -o.
+type flagValues struct {
+	c    *cli.Context
+	file map[string]interface{}
+}
+
+// Load the config file named by --config-file, if any.
+func newFlagValues(c *cli.Context) (v *flagValues, err error) {
+	v = &flagValues{c: c}
+
+	path := c.String("config-file")
+	if path == "" {
+		return
+	}
+
+	v.file, err = loadConfigFile(path, c.App.Flags)
+	if err != nil {
+		err = fmt.Errorf("Loading config file: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the value from the config file for the named flag, if it wasn't set
+// on the command line.
+func (v *flagValues) fromFile(name string) (val interface{}, ok bool) {
+	if v.c.IsSet(name) {
+		return
+	}
+
+	val, ok = v.file[name]
+	return
+}
+
+func (v *flagValues) Bool(name string) bool {
+	if val, ok := v.fromFile(name); ok {
+		return val.(bool)
+	}
+
+	return v.c.Bool(name)
+}
+
+func (v *flagValues) Int(name string) int {
+	if val, ok := v.fromFile(name); ok {
+		return val.(int)
+	}
+
+	return v.c.Int(name)
+}
+
+func (v *flagValues) Float64(name string) float64 {
+	if val, ok := v.fromFile(name); ok {
+		return val.(float64)
+	}
+
+	return v.c.Float64(name)
+}
+
+func (v *flagValues) Duration(name string) time.Duration {
+	if val, ok := v.fromFile(name); ok {
+		return val.(time.Duration)
+	}
+
+	return v.c.Duration(name)
+}
+
+func (v *flagValues) String(name string) string {
+	if val, ok := v.fromFile(name); ok {
+		return val.(string)
+	}
+
+	return v.c.String(name)
+}
+
+func (v *flagValues) StringSlice(name string) []string {
+	if val, ok := v.fromFile(name); ok {
+		return val.([]string)
+	}
+
+	return v.c.StringSlice(name)
+}
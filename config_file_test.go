@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ConfigFileTest struct {
+	dir string
+}
+
+var _ SetUpInterface = &ConfigFileTest{}
+var _ TearDownInterface = &ConfigFileTest{}
+
+func init() { RegisterTestSuite(&ConfigFileTest{}) }
+
+func (t *ConfigFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "config_file_test")
+	AssertEq(nil, err)
+}
+
+func (t *ConfigFileTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+// Write a config file with the given contents, returning its path.
+func (t *ConfigFileTest) write(contents string) (p string) {
+	p = path.Join(t.dir, "config.json")
+	err := ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	return
+}
+
+func (t *ConfigFileTest) parse(contents string) (err error) {
+	_, err = parseConfigFile("config.json", []byte(contents), newApp().Flags)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ConfigFileTest) ValuesOfEachType() {
+	p := t.write(`{
+		"implicit-dirs": true,
+		"dir-mode": "0750",
+		"uid": 17,
+		"limit-ops-per-sec": 2.5,
+		"stat-cache-ttl": "5m",
+		"temp-dir": "/some/dir",
+		"o": ["allow_other", "ro"]
+	}`)
+
+	f := parseArgs([]string{"--config-file", p})
+
+	ExpectTrue(f.ImplicitDirs)
+	ExpectEq(os.FileMode(0750), f.DirMode)
+	ExpectEq(17, f.Uid)
+	ExpectEq(2.5, f.OpRateLimitHz)
+	ExpectEq(5*time.Minute, f.StatCacheTTL)
+	ExpectEq("/some/dir", f.TempDir)
+	ExpectTrue(f.ReadOnly)
+
+	_, ok := f.MountOptions["allow_other"]
+	ExpectTrue(ok)
+
+	// Other flags should have their defaults.
+	ExpectEq(os.FileMode(0644), f.FileMode)
+	ExpectEq(-1, f.Gid)
+}
+
+func (t *ConfigFileTest) CommandLineTakesPrecedence() {
+	p := t.write(`{
+		"implicit-dirs": true,
+		"uid": 17,
+		"gid": 19,
+		"temp-dir": "/some/dir",
+		"o": ["allow_other"]
+	}`)
+
+	args := []string{
+		"--implicit-dirs=false",
+		"--uid=23",
+		"--config-file", p,
+		"-o", "nodev",
+	}
+
+	f := parseArgs(args)
+
+	ExpectFalse(f.ImplicitDirs)
+	ExpectEq(23, f.Uid)
+	ExpectEq(19, f.Gid)
+	ExpectEq("/some/dir", f.TempDir)
+
+	// Repeated flags replace the file's values entirely.
+	_, ok := f.MountOptions["allow_other"]
+	ExpectFalse(ok)
+	_, ok = f.MountOptions["nodev"]
+	ExpectTrue(ok)
+}
+
+func (t *ConfigFileTest) MissingFile() {
+	_, err := parseArgsOrError(
+		[]string{"--config-file", path.Join(t.dir, "missing.json")})
+
+	ExpectThat(err, Error(HasSubstr("Loading config file")))
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
+
+func (t *ConfigFileTest) UnknownFlag() {
+	err := t.parse("{\n  \"uid\": 17,\n  \"implicit-dir\": true\n}")
+	ExpectThat(err, Error(HasSubstr("config.json:3:")))
+	ExpectThat(err, Error(HasSubstr("unknown flag \"implicit-dir\"")))
+}
+
+func (t *ConfigFileTest) ForbiddenFlags() {
+	testCases := []string{
+		`{"help": true}`,
+		`{"version": true}`,
+		`{"config-file": "foo"}`,
+	}
+
+	for _, tc := range testCases {
+		err := t.parse(tc)
+		ExpectThat(err, Error(HasSubstr("may not be set")), "Input: %s", tc)
+	}
+}
+
+func (t *ConfigFileTest) BadValues() {
+	testCases := []struct {
+		contents string
+		expected string
+	}{
+		{`{"implicit-dirs": "yes"}`, "true or false"},
+		{`{"uid": 1.5}`, "expected an integer"},
+		{`{"uid": "taco"}`, "expected an integer"},
+		{`{"uid": [17]}`, "expected an integer"},
+		{`{"dir-mode": 1.5}`, "permission bits"},
+		{`{"dir-mode": 644}`, "permission bits"},
+		{`{"dir-mode": "rwx"}`, "permission bits"},
+		{`{"dir-mode": true}`, "permission bits"},
+		{`{"limit-ops-per-sec": true}`, "expected a number"},
+		{`{"stat-cache-ttl": 60}`, "duration"},
+		{`{"stat-cache-ttl": "soon"}`, "duration"},
+		{`{"temp-dir": 17}`, "expected a string"},
+		{`{"o": "ro"}`, "array of strings"},
+		{`{"o": ["ro", 17]}`, "array of strings"},
+	}
+
+	for _, tc := range testCases {
+		err := t.parse(tc.contents)
+		ExpectThat(err, Error(HasSubstr("config.json:1: bad value")), "%s", tc.contents)
+		ExpectThat(err, Error(HasSubstr(tc.expected)), "%s", tc.contents)
+	}
+}
+
+func (t *ConfigFileTest) NumericModes() {
+	p := t.write(`{"file-mode": 420, "dir-mode": 488}`)
+
+	f := parseArgs([]string{"--config-file", p})
+	ExpectEq(os.FileMode(0644), f.FileMode)
+	ExpectEq(os.FileMode(0750), f.DirMode)
+}
+
+func (t *ConfigFileTest) LineOfBadValue() {
+	contents := `{
+  "uid": 17,
+
+  "gid": 19,
+  "dir-mode": "rwx"
+}`
+
+	err := t.parse(contents)
+	ExpectThat(err, Error(HasSubstr("config.json:5: bad value for flag \"dir-mode\"")))
+}
+
+func (t *ConfigFileTest) DuplicateFlag() {
+	err := t.parse("{\"uid\": 17,\n\"uid\": 19}")
+	ExpectThat(err, Error(HasSubstr("config.json:2: flag \"uid\" given twice")))
+}
+
+func (t *ConfigFileTest) MalformedJSON() {
+	testCases := []string{
+		``,
+		`[]`,
+		`{"uid": 17`,
+		`{"uid": 17,}`,
+		`{"uid": 17} {}`,
+	}
+
+	for _, tc := range testCases {
+		err := t.parse(tc)
+		ExpectThat(err, Error(HasSubstr("config.json:")), "Input: %q", tc)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/timeutil"
+)
+
+// Prometheus label names.
+var costLabelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Parse --cost-labels values of the form "k=v", each of which may hold several
+// comma-separated pairs.
+func parseCostLabels(specs []string) (labels map[string]string, err error) {
+	labels = make(map[string]string)
+	for _, spec := range specs {
+		for _, pair := range strings.Split(spec, ",") {
+			i := strings.Index(pair, "=")
+			if i < 0 || !costLabelNameRegexp.MatchString(pair[:i]) {
+				err = fmt.Errorf("Illegal --cost-labels value: %q", pair)
+				return
+			}
+
+			labels[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	return
+}
+
+// Parse an --op-prices value of the form "class_a=0.000005,class_b=0.0000004".
+// Return nil if the value is empty. Classes not mentioned are free.
+func parseOpPrices(s string) (p *gcsproxy.OpPrices, err error) {
+	if s == "" {
+		return
+	}
+
+	p = &gcsproxy.OpPrices{}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			err = fmt.Errorf("Illegal --op-prices value: %q", pair)
+			return
+		}
+
+		var price float64
+		price, err = strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil || price < 0 {
+			err = fmt.Errorf("Illegal --op-prices value: %q", pair)
+			return
+		}
+
+		switch pair[:i] {
+		case "class_a":
+			p.ClassA = price
+
+		case "class_b":
+			p.ClassB = price
+
+		default:
+			err = fmt.Errorf("Unknown --op-prices class: %q", pair[:i])
+			return
+		}
+	}
+
+	return
+}
+
+// Produces summaries of the operations sent through a cost bucket since the
+// previous summary.
+type costSummarizer struct {
+	clock  timeutil.Clock
+	bucket gcsproxy.CostBucket
+
+	// Nil if no prices were given, in which case no cost is estimated.
+	prices *gcsproxy.OpPrices
+
+	lastStats gcsproxy.CostStats
+	lastTime  time.Time
+}
+
+func newCostSummarizer(
+	clock timeutil.Clock,
+	bucket gcsproxy.CostBucket,
+	prices *gcsproxy.OpPrices) (s *costSummarizer) {
+	s = &costSummarizer{
+		clock:     clock,
+		bucket:    bucket,
+		prices:    prices,
+		lastStats: bucket.Stats(),
+		lastTime:  clock.Now(),
+	}
+
+	return
+}
+
+// Return a one-line summary of the operations since the last call (or since
+// creation), and start a new period.
+func (s *costSummarizer) Summarize() (msg string) {
+	stats := s.bucket.Stats()
+	now := s.clock.Now()
+
+	d := stats.Since(s.lastStats)
+	elapsed := now.Sub(s.lastTime)
+	s.lastStats = stats
+	s.lastTime = now
+
+	var methods []string
+	for m, n := range d.ByMethod {
+		if n != 0 {
+			methods = append(methods, fmt.Sprintf("%s: %d", m, n))
+		}
+	}
+
+	sort.Strings(methods)
+
+	msg = fmt.Sprintf(
+		"GCS operations in the last %v: %d class A, %d class B, %d free",
+		elapsed,
+		d.ClassA,
+		d.ClassB,
+		d.Free)
+
+	if len(methods) != 0 {
+		msg += fmt.Sprintf(" (%s)", strings.Join(methods, ", "))
+	}
+
+	if s.prices != nil {
+		msg += fmt.Sprintf("; estimated cost %.6f", d.EstimatedCost(*s.prices))
+	}
+
+	if labels := s.bucket.Labels(); len(labels) != 0 {
+		var pairs []string
+		for k, v := range labels {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+		}
+
+		sort.Strings(pairs)
+		msg += fmt.Sprintf(" [%s]", strings.Join(pairs, " "))
+	}
+
+	return
+}
+
+// Log a summary every interval, forever.
+func logCostSummaries(s *costSummarizer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		log.Println(s.Summarize())
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CostTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+}
+
+var _ SetUpInterface = &CostTest{}
+
+func init() { RegisterTestSuite(&CostTest{}) }
+
+func (t *CostTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+}
+
+// Create a cost bucket configured by the supplied flags, as setUpBucket would.
+func (t *CostTest) newBucket(args []string) (
+	b gcsproxy.CostBucket,
+	flags *flagStorage) {
+	flags = parseArgs(args)
+	b = gcsproxy.NewCostBucket(
+		flags.CostLabels,
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CostTest) Defaults() {
+	f := parseArgs([]string{})
+	ExpectEq(0, len(f.CostLabels))
+	ExpectEq(nil, f.OpPrices)
+	ExpectEq(time.Hour, f.CostSummaryInterval)
+}
+
+func (t *CostTest) Flags() {
+	f := parseArgs([]string{
+		"--cost-labels=team=search",
+		"--cost-labels=env=prod,cost_center=1234",
+		"--op-prices=class_a=0.5,class_b=0.25",
+		"--cost-summary-interval=10m",
+	})
+
+	ExpectEq(3, len(f.CostLabels))
+	ExpectEq("search", f.CostLabels["team"])
+	ExpectEq("prod", f.CostLabels["env"])
+	ExpectEq("1234", f.CostLabels["cost_center"])
+
+	AssertNe(nil, f.OpPrices)
+	ExpectEq(0.5, f.OpPrices.ClassA)
+	ExpectEq(0.25, f.OpPrices.ClassB)
+
+	ExpectEq(10*time.Minute, f.CostSummaryInterval)
+}
+
+func (t *CostTest) IllegalFlags() {
+	testCases := []string{
+		"--cost-labels=team",
+		"--cost-labels=1team=search",
+		"--cost-labels=te-am=search",
+		"--op-prices=class_a",
+		"--op-prices=class_a=cheap",
+		"--op-prices=class_a=-1",
+		"--op-prices=class_c=0.1",
+	}
+
+	for _, tc := range testCases {
+		_, err := parseArgsOrError([]string{tc})
+		ExpectThat(err, Error(HasSubstr("--")), "Flag: %s", tc)
+	}
+}
+
+func (t *CostTest) Summary() {
+	b, flags := t.newBucket([]string{
+		"--cost-labels=team=search,env=prod",
+		"--op-prices=class_a=0.5,class_b=0.25",
+	})
+
+	// Operations before the summarizer is created don't count.
+	_, err := b.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	s := newCostSummarizer(&t.clock, b, flags.OpPrices)
+
+	// Two class A operations, three class B, and one free.
+	err = gcsutil.CreateObjects(t.ctx, b, map[string]string{"foo": "taco"})
+	AssertEq(nil, err)
+
+	_, err = b.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+		AssertEq(nil, err)
+	}
+
+	err = b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(10 * time.Minute)
+	ExpectEq(
+		"GCS operations in the last 10m0s: 2 class A, 3 class B, 1 free "+
+			"(CreateObject: 1, DeleteObject: 1, ListObjects: 1, StatObject: 3); "+
+			"estimated cost 1.750000 [env=prod team=search]",
+		s.Summarize())
+
+	// The next summary starts afresh.
+	t.clock.AdvanceTime(time.Minute)
+	ExpectEq(
+		"GCS operations in the last 1m0s: 0 class A, 0 class B, 0 free; "+
+			"estimated cost 0.000000 [env=prod team=search]",
+		s.Summarize())
+}
+
+func (t *CostTest) SummaryWithoutPricesOrLabels() {
+	b, flags := t.newBucket([]string{})
+	s := newCostSummarizer(&t.clock, b, flags.OpPrices)
+
+	_, err := b.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Hour)
+	ExpectEq(
+		"GCS operations in the last 1h0m0s: 1 class A, 0 class B, 0 free "+
+			"(ListObjects: 1)",
+		s.Summarize())
+}
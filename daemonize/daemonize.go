@@ -0,0 +1,278 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Support for running a process in the background once it has successfully
+// started, reporting the outcome of its start-up to the original foreground
+// process.
+//
+// The foreground process calls Run, which re-executes a binary as a new
+// session leader with no terminal and waits for it to call SignalOutcome.
+// Until then, anything the child writes to StatusWriter is copied to the
+// foreground process's status writer.
+package daemonize
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// The environment variable used to tell the child which file descriptor it
+// should use to communicate with its parent.
+const envVar = "GCSFUSE_DAEMONIZE_STATUS_FD"
+
+// A message sent from the child to the parent over the status pipe.
+type message struct {
+	// Output that the child wrote to StatusWriter.
+	Log []byte
+
+	// Set if this message reports the outcome of start-up, in which case
+	// Outcome is the text of the error or empty for success. (Note that gob
+	// doesn't transmit zero values, so a nil *string can't be told apart from a
+	// pointer to the empty string.)
+	Done    bool
+	Outcome string
+}
+
+var (
+	// Set if this process was started by Run.
+	gChild bool
+
+	gMu sync.Mutex
+
+	// The encoder for the status pipe. Nil if we're not a child, or if we have
+	// already signalled an outcome.
+	//
+	// GUARDED_BY(gMu)
+	gEncoder *gob.Encoder
+
+	// The status pipe itself.
+	//
+	// GUARDED_BY(gMu)
+	gPipe *os.File
+)
+
+func init() {
+	s := os.Getenv(envVar)
+	if s == "" {
+		return
+	}
+
+	// Don't pass the variable on to our own children.
+	os.Unsetenv(envVar)
+
+	fd, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		panic(fmt.Sprintf("Illegal %s: %q", envVar, s))
+	}
+
+	gChild = true
+	gPipe = os.NewFile(uintptr(fd), "status pipe")
+	gEncoder = gob.NewEncoder(gPipe)
+	StatusWriter = statusWriter{}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Child
+////////////////////////////////////////////////////////////////////////
+
+// Return true if this process was started by Run.
+func Child() bool {
+	return gChild
+}
+
+type statusWriter struct{}
+
+func (w statusWriter) Write(p []byte) (n int, err error) {
+	gMu.Lock()
+	defer gMu.Unlock()
+
+	// Once the outcome has been signalled there is nobody listening, and no
+	// terminal to write to. Drop the output on the floor.
+	if gEncoder == nil {
+		n = len(p)
+		return
+	}
+
+	err = gEncoder.Encode(&message{Log: p})
+	if err != nil {
+		err = fmt.Errorf("Encode: %v", err)
+		return
+	}
+
+	n = len(p)
+	return
+}
+
+// A writer for status output, e.g. logging. In a child started by Run, output
+// is sent to the parent until SignalOutcome is called, and discarded
+// afterward. Otherwise it writes to stderr.
+var StatusWriter io.Writer = os.Stderr
+
+// Report the outcome of start-up to the parent process, which will exit
+// non-zero with the error's text if it is non-nil and zero otherwise. Must be
+// called at most once, and only in a child started by Run.
+func SignalOutcome(outcome error) (err error) {
+	gMu.Lock()
+	defer gMu.Unlock()
+
+	if gEncoder == nil {
+		err = errors.New("Not a daemon child, or outcome already signalled")
+		return
+	}
+
+	m := &message{Done: true}
+	if outcome != nil {
+		m.Outcome = outcome.Error()
+		if m.Outcome == "" {
+			m.Outcome = "Unknown error"
+		}
+	}
+
+	// Send the message, then close the pipe so the parent doesn't wait for
+	// anything else.
+	err = gEncoder.Encode(m)
+	gEncoder = nil
+
+	closeErr := gPipe.Close()
+	gPipe = nil
+
+	if err != nil {
+		err = fmt.Errorf("Encode: %v", err)
+		return
+	}
+
+	if closeErr != nil {
+		err = fmt.Errorf("Close: %v", closeErr)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Parent
+////////////////////////////////////////////////////////////////////////
+
+// Start the binary at the given path with the given arguments and additional
+// environment variables, detached from our terminal and session. Wait for it
+// to call SignalOutcome, copying its status output to the supplied writer in
+// the meantime.
+//
+// If the child reports failure, the returned error has the same text as the
+// one it reported. If it exits without reporting anything, an error
+// describing that is returned. On success the child is left running.
+func Run(
+	path string,
+	args []string,
+	env []string,
+	status io.Writer) (err error) {
+	// Create the pipe over which the child will talk to us.
+	pipeR, pipeW, err := os.Pipe()
+	if err != nil {
+		err = fmt.Errorf("Pipe: %v", err)
+		return
+	}
+
+	defer pipeR.Close()
+
+	// Set up the child. The pipe will be its first file descriptor after stdin,
+	// stdout, and stderr, which are all /dev/null.
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(
+		append([]string{}, env...),
+		fmt.Sprintf("%s=3", envVar))
+
+	cmd.ExtraFiles = []*os.File{pipeW}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+
+	// Start it, then close our copy of the write end so that we see EOF if the
+	// child goes away.
+	err = cmd.Start()
+	pipeW.Close()
+
+	if err != nil {
+		err = fmt.Errorf("Start: %v", err)
+		return
+	}
+
+	// Process messages until we get an outcome.
+	outcome, readErr := readOutcome(pipeR, status)
+	if readErr != nil {
+		// The child is broken. Don't leave it hanging around, and find out why
+		// it went away if it did.
+		cmd.Process.Kill()
+		waitErr := cmd.Wait()
+
+		err = fmt.Errorf(
+			"Child process didn't report its outcome (%v): %v",
+			readErr,
+			waitErr)
+
+		return
+	}
+
+	if outcome != "" {
+		// The child is responsible for exiting after reporting failure; reap it
+		// so that it doesn't linger as a zombie while we exit.
+		cmd.Wait()
+		err = errors.New(outcome)
+		return
+	}
+
+	// Success. The child will outlive us.
+	err = cmd.Process.Release()
+	if err != nil {
+		err = fmt.Errorf("Release: %v", err)
+		return
+	}
+
+	return
+}
+
+// Read messages from the child until it reports an outcome.
+func readOutcome(r io.Reader, status io.Writer) (outcome string, err error) {
+	decoder := gob.NewDecoder(r)
+	for {
+		var m message
+		err = decoder.Decode(&m)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Decode: %v", err)
+			return
+		}
+
+		if m.Done {
+			outcome = m.Outcome
+			return
+		}
+
+		// Status output is best-effort; the child's fate matters more.
+		if _, werr := status.Write(m.Log); werr != nil {
+			status = ioutil.Discard
+		}
+	}
+}
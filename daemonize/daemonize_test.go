@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemonize_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/daemonize"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestDaemonize(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Child behavior
+////////////////////////////////////////////////////////////////////////
+
+// The test binary re-executes itself as the child, with this environment
+// variable telling it what to do instead of running tests.
+const behaviorEnvVar = "DAEMONIZE_TEST_BEHAVIOR"
+
+func init() {
+	behavior := os.Getenv(behaviorEnvVar)
+	if behavior == "" {
+		return
+	}
+
+	if !daemonize.Child() {
+		panic("Expected to be a daemon child")
+	}
+
+	fmt.Fprintf(daemonize.StatusWriter, "behavior: %s\n", behavior)
+
+	switch behavior {
+	case "success":
+		daemonize.SignalOutcome(nil)
+
+		// Output after the outcome should be swallowed without complaint.
+		_, err := fmt.Fprintln(daemonize.StatusWriter, "after")
+		if err != nil {
+			os.Exit(2)
+		}
+
+		os.Exit(0)
+
+	case "failure":
+		daemonize.SignalOutcome(errors.New("taco burrito"))
+		os.Exit(1)
+
+	case "silent_exit":
+		os.Exit(17)
+
+	default:
+		panic(fmt.Sprintf("Unknown behavior: %q", behavior))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DaemonizeTest struct {
+	status bytes.Buffer
+}
+
+func init() { RegisterTestSuite(&DaemonizeTest{}) }
+
+func (t *DaemonizeTest) run(behavior string) (err error) {
+	err = daemonize.Run(
+		os.Args[0],
+		nil,
+		append(os.Environ(), fmt.Sprintf("%s=%s", behaviorEnvVar, behavior)),
+		&t.status)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DaemonizeTest) NotAChild() {
+	ExpectFalse(daemonize.Child())
+	ExpectEq(os.Stderr, daemonize.StatusWriter)
+
+	err := daemonize.SignalOutcome(nil)
+	ExpectThat(err, Error(HasSubstr("Not a daemon child")))
+}
+
+func (t *DaemonizeTest) NonExistentBinary() {
+	err := daemonize.Run("/no/such/binary", nil, nil, &t.status)
+	ExpectThat(err, Error(HasSubstr("Start")))
+}
+
+func (t *DaemonizeTest) ChildSucceeds() {
+	err := t.run("success")
+	AssertEq(nil, err)
+
+	ExpectEq("behavior: success\n", t.status.String())
+}
+
+func (t *DaemonizeTest) ChildFails() {
+	err := t.run("failure")
+
+	ExpectThat(err, Error(Equals("taco burrito")))
+	ExpectEq("behavior: failure\n", t.status.String())
+}
+
+func (t *DaemonizeTest) ChildExitsWithoutOutcome() {
+	err := t.run("silent_exit")
+
+	ExpectThat(err, Error(HasSubstr("didn't report its outcome")))
+	ExpectThat(err, Error(HasSubstr("exit status 17")))
+	ExpectEq("behavior: silent_exit\n", t.status.String())
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+)
+
+// Counters and histograms for GCS requests and file system ops, served in the
+// Prometheus text format at /metrics on the debug endpoint.
+var metricsRegistry = metrics.NewRegistry()
+
+// Create a mux for --debug_endpoint serving /metrics and pprof profiles under
+// /debug/pprof/. The caller adds the handlers specific to the mount.
+func newDebugMux() (mux *http.ServeMux) {
+	mux = http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return
+}
+
+// An http.Handler that forwards to another that may be replaced, so that the
+// debug handlers of a remounted file system server take over from those of
+// the server it replaces.
+type replaceableHandler struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	h http.Handler
+}
+
+// Forward later requests to h.
+func (rh *replaceableHandler) Set(h http.Handler) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	rh.h = h
+}
+
+func (rh *replaceableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.mu.Lock()
+	h := rh.h
+	rh.mu.Unlock()
+
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h.ServeHTTP(w, r)
+}
+
+// A server for the debug endpoint.
+type debugHTTPServer struct {
+	srv http.Server
+	l   net.Listener
+}
+
+// Start serving the supplied handler at the given address in the background.
+// The mount leaves it running for the life of the process.
+func startDebugHTTPServer(
+	addr string,
+	h http.Handler) (s *debugHTTPServer, err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	s = &debugHTTPServer{
+		srv: http.Server{Handler: h},
+		l:   l,
+	}
+
+	go func() {
+		err := s.srv.Serve(l)
+		if err != http.ErrServerClosed {
+			logger.Errorf("Debug endpoint stopped: %v", err)
+		}
+	}()
+
+	return
+}
+
+// Stop serving and free the port.
+func (s *debugHTTPServer) Close() (err error) {
+	err = s.srv.Close()
+
+	// Serve may not have got as far as tracking the listener, in which case
+	// the server didn't close it.
+	s.l.Close()
+
+	return
+}
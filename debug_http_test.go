@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DebugHTTPTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+	port  int
+	srv   *debugHTTPServer
+}
+
+var _ SetUpInterface = &DebugHTTPTest{}
+var _ TearDownInterface = &DebugHTTPTest{}
+
+func init() { RegisterTestSuite(&DebugHTTPTest{}) }
+
+func (t *DebugHTTPTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	// Find a free port.
+	l, err := net.Listen("tcp", "localhost:0")
+	AssertEq(nil, err)
+
+	t.port = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	t.srv, err = startDebugHTTPServer(
+		fmt.Sprintf("localhost:%d", t.port),
+		newDebugMux())
+
+	AssertEq(nil, err)
+}
+
+func (t *DebugHTTPTest) TearDown() {
+	t.srv.Close()
+}
+
+func (t *DebugHTTPTest) get(path string) (body string, err error) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", t.port, path))
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Status: %s", resp.Status)
+		return
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	body = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DebugHTTPTest) Pprof() {
+	body, err := t.get("/debug/pprof/")
+	AssertEq(nil, err)
+	ExpectThat(body, HasSubstr("goroutine"))
+}
+
+func (t *DebugHTTPTest) CostMetrics() {
+	costs := gcsproxy.NewCostBucket(
+		nil,
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+
+	costs.RegisterMetrics(metricsRegistry)
+
+	err := gcsutil.CreateObjects(t.ctx, costs, map[string]string{"foo": "taco"})
+	AssertEq(nil, err)
+
+	_, err = costs.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	body, err := t.get("/metrics")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		body,
+		HasSubstr(`gcsfuse_gcs_ops_total{class="A",method="CreateObject"} 1`))
+
+	ExpectThat(
+		body,
+		HasSubstr(`gcsfuse_gcs_ops_total{class="A",method="ListObjects"} 1`))
+
+	ExpectThat(body, HasSubstr("gcsfuse_gcs_class_a_ops_total 2\n"))
+}
+
+func (t *DebugHTTPTest) Metrics() {
+	metricsRegistry.Counter("gcsfuse_test_total", "A test counter.").Inc()
+
+	body, err := t.get("/metrics")
+	AssertEq(nil, err)
+
+	ExpectThat(body, HasSubstr("# TYPE gcsfuse_test_total counter"))
+	ExpectThat(body, HasSubstr("gcsfuse_test_total 1"))
+}
+
+func (t *DebugHTTPTest) FailedReadMetrics() {
+	failedReads := gcsproxy.NewFailedReadBucket(
+		time.Minute,
+		16,
+		&t.clock,
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+
+	publishFailedReadMetrics(failedReads)
+
+	// Read a generation that doesn't exist, twice.
+	req := &gcs.ReadObjectRequest{Name: "foo", Generation: 17}
+	for i := 0; i < 2; i++ {
+		_, err := failedReads.NewReader(t.ctx, req)
+		AssertNe(nil, err)
+	}
+
+	body, err := t.get("/metrics")
+	AssertEq(nil, err)
+
+	ExpectThat(body, HasSubstr("gcsfuse_failed_reads_recorded_total 1\n"))
+	ExpectThat(body, HasSubstr("gcsfuse_failed_reads_suppressed_total 1\n"))
+}
+
+func (t *DebugHTTPTest) ClosedCleanly() {
+	err := t.srv.Close()
+	AssertEq(nil, err)
+
+	// The port is free again.
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", t.port))
+	AssertEq(nil, err)
+	l.Close()
+
+	_, err = t.get("/metrics")
+	ExpectNe(nil, err)
+}
+
+func (t *DebugHTTPTest) ReplaceableHandler() {
+	var rh replaceableHandler
+	mux := newDebugMux()
+	mux.Handle("/", &rh)
+
+	srv, err := startDebugHTTPServer("localhost:0", mux)
+	AssertEq(nil, err)
+	defer srv.Close()
+
+	get := func(path string) (status int, body string) {
+		resp, err := http.Get("http://" + srv.l.Addr().String() + path)
+		AssertEq(nil, err)
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		AssertEq(nil, err)
+
+		status = resp.StatusCode
+		body = string(b)
+		return
+	}
+
+	// Nothing is forwarded until a handler is set.
+	status, _ := get("/residency")
+	ExpectEq(http.StatusNotFound, status)
+
+	// A remount replaces the old server's handlers with the new one's.
+	for _, s := range []string{"taco", "burrito"} {
+		s := s
+		fsMux := http.NewServeMux()
+		fsMux.HandleFunc("/residency", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, s)
+		})
+
+		rh.Set(fsMux)
+
+		_, body := get("/residency")
+		ExpectEq(s, body)
+	}
+
+	// The endpoint's own handlers are unaffected.
+	status, _ = get("/metrics")
+	ExpectEq(http.StatusOK, status)
+}
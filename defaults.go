@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+)
+
+// Defaults, gathered here rather than scattered across the flag definitions
+// and the code that consumes them.
+const (
+	// The product token that begins the User-Agent header sent to GCS. See
+	// getUserAgent.
+	userAgentProduct = "gcsfuse"
+
+	// Caching.
+	defaultStatCacheTTL       = time.Minute
+	defaultFailedReadCacheTTL = 10 * time.Second
+	defaultTypeCacheTTL       = time.Minute
+	defaultTombstoneTTL       = inode.DefaultTombstoneTTL
+
+	// The temporary directory, and the objects read into it. The limit on the
+	// number of files is derived from the process's rlimit, and we warn when
+	// that is below reasonableFileRlimit; see fs.ChooseTempDirLimitNumFiles.
+	defaultTempDirBytes  = 1 << 31
+	defaultGCSChunkSize  = 1 << 24
+	reasonableFileRlimit = 4096
+
+	// Temporary objects in the bucket.
+	defaultTmpObjectPrefix = ".gcsfuse_tmp/"
+
+	// Connections to GCS. See newTransport.
+	dialTimeout                      = 30 * time.Second
+	defaultTCPKeepAlive              = 30 * time.Second
+	defaultHTTPIdleConnTimeout       = time.Minute
+	defaultHTTPResponseHeaderTimeout = time.Minute
+
+	// Unmounting.
+	defaultUnmountRetryTimeout = 30 * time.Second
+)
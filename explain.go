@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/timeutil"
+)
+
+// Check the flags as mounting would, then write to w a description of how
+// the file system would treat each of flags.ExplainPaths, without contacting
+// GCS. See fs.ExplainPath.
+func explain(w io.Writer, bucketName string, flags *flagStorage) (err error) {
+	// The bucket isn't consulted, but a config isn't valid without one.
+	clock := timeutil.RealClock()
+	cfg, err := BuildServerConfig(
+		flags,
+		serverConfigDeps{
+			Clock:  clock,
+			Bucket: gcsfake.NewFakeBucket(clock, bucketName),
+		})
+
+	if err != nil {
+		return
+	}
+
+	if len(flags.ExplainPaths) == 0 {
+		fmt.Fprintln(w, "Flags are valid. Use --explain-path to describe paths.")
+		return
+	}
+
+	ttls, err := gcsproxy.ParseStatTTLs(
+		flags.StatCacheTTL,
+		flags.StatCachePrefixTTL)
+
+	if err != nil {
+		err = fmt.Errorf("ParseStatTTLs: %v", err)
+		return
+	}
+
+	for _, p := range flags.ExplainPaths {
+		var lines []string
+		lines, err = fs.ExplainPath(&cfg, p)
+		if err != nil {
+			err = fmt.Errorf("--explain-path %q: %v", p, err)
+			return
+		}
+
+		// Lookups go through the stat cache, which lives outside the file
+		// system and so sees full object names.
+		fullName := strings.TrimPrefix(p, "/")
+		if d := strings.Trim(flags.OnlyDir, "/"); d != "" {
+			fullName = d + "/" + fullName
+		}
+
+		if ttl := ttls.TTL(fullName); ttl == 0 {
+			lines = append(lines, "stat cache TTL: disabled")
+		} else {
+			lines = append(lines, fmt.Sprintf("stat cache TTL: %v", ttl))
+		}
+
+		fmt.Fprintf(w, "%s:\n", p)
+		for _, l := range lines {
+			fmt.Fprintf(w, "  %s\n", l)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jgeewax/cli"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestExplain(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ExplainTest struct {
+}
+
+func init() { RegisterTestSuite(&ExplainTest{}) }
+
+// Run the app with the supplied arguments as if --explain had been given,
+// returning what it prints.
+func (t *ExplainTest) run(args ...string) (output string, err error) {
+	var buf bytes.Buffer
+
+	app := newApp()
+	app.Action = func(c *cli.Context) {
+		var flags *flagStorage
+		flags, err = populateFlags(c)
+		if err != nil {
+			return
+		}
+
+		AssertTrue(flags.Explain)
+		err = explain(&buf, c.Args()[0], flags)
+	}
+
+	fullArgs := append([]string{"gcsfuse", "--explain"}, args...)
+	fullArgs = append(fullArgs, "some_bucket", "/mnt/point")
+	AssertEq(nil, app.Run(fullArgs))
+
+	output = buf.String()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ExplainTest) NoPaths() {
+	output, err := t.run()
+	AssertEq(nil, err)
+	ExpectThat(output, HasSubstr("Flags are valid"))
+}
+
+func (t *ExplainTest) Paths() {
+	output, err := t.run(
+		"--only-dir=data",
+		"--read-only",
+		"--stat-cache-ttl=0",
+		"--default-metadata=logs/:cache_control=no-cache",
+		"--explain-path=logs/a.txt",
+		"--explain-path", "logs/")
+
+	AssertEq(nil, err)
+	ExpectEq(
+		"logs/a.txt:\n"+
+			"  object: \"data/logs/a.txt\"\n"+
+			"  visible: yes\n"+
+			"  decompressed view: no\n"+
+			"  writable: no (read-only file system)\n"+
+			"  default metadata: none\n"+
+			"  type cache TTL: 1m0s\n"+
+			"  tombstone TTL: 1m0s\n"+
+			"  stat cache TTL: disabled\n"+
+			"logs/:\n"+
+			"  object: \"data/logs/\"\n"+
+			"  visible: yes\n"+
+			"  writable: no (read-only file system)\n"+
+			"  default metadata: none (directory)\n"+
+			"  type cache TTL: 1m0s\n"+
+			"  tombstone TTL: 1m0s\n"+
+			"  stat cache TTL: disabled\n",
+		output)
+}
+
+func (t *ExplainTest) StatCachePrefixTTL() {
+	output, err := t.run(
+		"--only-dir=data",
+		"--stat-cache-ttl=1m",
+		"--stat-cache-prefix-ttl=data/logs/:5s",
+		"--stat-cache-prefix-ttl=data/tmp/:0s",
+		"--explain-path=logs/a.txt",
+		"--explain-path=tmp/b",
+		"--explain-path=c")
+
+	AssertEq(nil, err)
+
+	// The stat cache TTL is the last line for each path.
+	ExpectThat(output, HasSubstr("  stat cache TTL: 5s\ntmp/b:\n"))
+	ExpectThat(output, HasSubstr("  stat cache TTL: disabled\nc:\n"))
+	ExpectTrue(
+		strings.HasSuffix(output, "  stat cache TTL: 1m0s\n"),
+		"output: %q", output)
+}
+
+func (t *ExplainTest) PolicyErrorHasPosition() {
+	_, err := t.run("--default-metadata=logs/:cache_contrl=no-cache")
+	ExpectThat(err, Error(HasSubstr("--default-metadata")))
+	ExpectThat(err, Error(HasSubstr("column 7: Unknown field")))
+}
+
+func (t *ExplainTest) InvalidConfig() {
+	_, err := t.run("--transcode-gzip-drop-suffix")
+	ExpectThat(err, Error(HasSubstr("Checking flags")))
+	ExpectThat(err, Error(HasSubstr("DropTranscodedGzipSuffix")))
+}
+
+func (t *ExplainTest) IllegalPath() {
+	_, err := t.run("--explain-path=a//b")
+	ExpectThat(err, Error(HasSubstr("--explain-path \"a//b\"")))
+	ExpectThat(err, Error(HasSubstr("Illegal path")))
+}
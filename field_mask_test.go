@@ -0,0 +1,457 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A fake of the parts of the GCS JSON API that list, stat, and read objects,
+// serving canned object resources as full as the real ones and honoring the
+// fields parameter.
+type fakeJSONAPI struct {
+	server  *httptest.Server
+	objects []map[string]interface{}
+
+	mu sync.Mutex
+
+	// The fields parameter of each request, and the total size of the response
+	// bodies written.
+	//
+	// GUARDED_BY(mu)
+	fields        []string
+	responseBytes int64
+}
+
+func newFakeJSONAPI(names ...string) (f *fakeJSONAPI) {
+	f = &fakeJSONAPI{}
+	for i, name := range names {
+		f.objects = append(f.objects, fullObjectResource(name, int64(i+1)))
+	}
+
+	f.server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	return
+}
+
+// Return an object resource with every field that a real one has, including
+// the ACL that projection=full brings in.
+func fullObjectResource(name string, generation int64) map[string]interface{} {
+	self := "https://www.googleapis.com/storage/v1/b/some_bucket/o/" +
+		url.PathEscape(name)
+
+	var acl []interface{}
+	for _, entity := range []string{"project-owners-1", "project-editors-1",
+		"project-viewers-1", "user-someone@example.com"} {
+		acl = append(acl, map[string]interface{}{
+			"kind":       "storage#objectAccessControl",
+			"id":         fmt.Sprintf("some_bucket/%s/%d/%s", name, generation, entity),
+			"selfLink":   self + "/acl/" + entity,
+			"bucket":     "some_bucket",
+			"object":     name,
+			"generation": fmt.Sprint(generation),
+			"entity":     entity,
+			"role":       "OWNER",
+			"etag":       "CKih16GjycICEAE=",
+		})
+	}
+
+	return map[string]interface{}{
+		"kind":                    "storage#object",
+		"id":                      fmt.Sprintf("some_bucket/%s/%d", name, generation),
+		"selfLink":                self,
+		"mediaLink":               self + "?generation=1&alt=media",
+		"name":                    name,
+		"bucket":                  "some_bucket",
+		"generation":              fmt.Sprint(generation),
+		"metageneration":          "1",
+		"contentType":             "text/plain",
+		"storageClass":            "STANDARD",
+		"size":                    "4",
+		"md5Hash":                 "SxbMhvdlUN8FOaJgzGBlzQ==",
+		"crc32c":                  "pcKcrg==",
+		"etag":                    "CKih16GjycICEAE=",
+		"timeCreated":             "2015-04-05T02:15:00.000Z",
+		"updated":                 "2015-04-05T02:15:00.000Z",
+		"timeStorageClassUpdated": "2015-04-05T02:15:00.000Z",
+		"metadata": map[string]interface{}{
+			"gcsfuse_mtime": "2015-04-05T02:14:00Z",
+			"color":         "blue",
+		},
+		"acl": acl,
+		"owner": map[string]interface{}{
+			"entity":   "user-someone@example.com",
+			"entityId": "00b4903a97d0cd2e7a8d8c1e4f8e7c3a2f6d4b1a9e8c7d6f5e4a3b2c1d0e9f8a",
+		},
+	}
+}
+
+// Split a fields parameter at the commas that aren't within parentheses.
+func splitFields(s string) (fields []string) {
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if s != "" {
+		fields = append(fields, s[start:])
+	}
+
+	return
+}
+
+// Return the parts of the supplied resource selected by a fields parameter,
+// which may name fields of sub-objects ("a/b") and fields of the elements of
+// arrays ("a(b,c)").
+func selectFields(
+	r map[string]interface{},
+	fields string) (selected map[string]interface{}) {
+	selected = make(map[string]interface{})
+	for _, f := range splitFields(fields) {
+		switch {
+		case strings.HasSuffix(f, ")"):
+			i := strings.Index(f, "(")
+			items, _ := r[f[:i]].([]interface{})
+			var out []interface{}
+			for _, item := range items {
+				out = append(
+					out,
+					selectFields(item.(map[string]interface{}), f[i+1:len(f)-1]))
+			}
+
+			if out != nil {
+				selected[f[:i]] = out
+			}
+
+		case strings.Contains(f, "/"):
+			i := strings.Index(f, "/")
+			sub, ok := r[f[:i]].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			inner, _ := selected[f[:i]].(map[string]interface{})
+			if inner == nil {
+				inner = make(map[string]interface{})
+				selected[f[:i]] = inner
+			}
+
+			for k, v := range selectFields(sub, f[i+1:]) {
+				inner[k] = v
+			}
+
+		default:
+			if v, ok := r[f]; ok {
+				selected[f] = v
+			}
+		}
+	}
+
+	return
+}
+
+func (f *fakeJSONAPI) serve(w http.ResponseWriter, r *http.Request) {
+	fields := r.URL.Query().Get("fields")
+	f.mu.Lock()
+	f.fields = append(f.fields, fields)
+	f.mu.Unlock()
+
+	var resource map[string]interface{}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/download/"):
+		f.write(w, []byte("taco"))
+		return
+
+	case strings.HasSuffix(r.URL.Path, "/o"):
+		var items []interface{}
+		for _, o := range f.objects {
+			items = append(items, o)
+		}
+
+		resource = map[string]interface{}{
+			"kind":     "storage#objects",
+			"items":    items,
+			"prefixes": []interface{}{"dir/"},
+		}
+
+	default:
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		for _, o := range f.objects {
+			if o["name"] == name {
+				resource = o
+			}
+		}
+	}
+
+	if resource == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if fields != "" {
+		resource = selectFields(resource, fields)
+	}
+
+	b, err := json.Marshal(resource)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	f.write(w, b)
+}
+
+func (f *fakeJSONAPI) write(w http.ResponseWriter, b []byte) {
+	w.Write(b)
+
+	f.mu.Lock()
+	f.responseBytes += int64(len(b))
+	f.mu.Unlock()
+}
+
+// Open a bucket whose requests go to the fake, asking for only the supplied
+// object fields if non-nil.
+func (f *fakeJSONAPI) openBucket(fields []string) (b gcs.Bucket, err error) {
+	addr := f.server.Listener.Addr().String()
+	var rt httputil.CancellableRoundTripper = &http.Transport{
+		Dial: func(network string, _ string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	if fields != nil {
+		rt = newFieldMaskTransport(fields, rt)
+	}
+
+	conn, err := gcs.NewConn(&gcs.ConnConfig{
+		Anonymous: true,
+		Transport: rt,
+	})
+
+	if err != nil {
+		return
+	}
+
+	b, err = conn.OpenBucket(context.Background(), "some_bucket")
+	return
+}
+
+func (f *fakeJSONAPI) lastFields() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.fields[len(f.fields)-1]
+}
+
+type FieldMaskTest struct {
+	ctx    context.Context
+	api    *fakeJSONAPI
+	fields []string
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &FieldMaskTest{}
+var _ TearDownInterface = &FieldMaskTest{}
+
+func init() { RegisterTestSuite(&FieldMaskTest{}) }
+
+func (t *FieldMaskTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.api = newFakeJSONAPI("bar", "foo")
+
+	t.fields, err = gcsproxy.ObjectFields.Fields(fs.ObjectFieldFeatures(false))
+	AssertEq(nil, err)
+
+	t.bucket, err = t.api.openBucket(t.fields)
+	AssertEq(nil, err)
+}
+
+func (t *FieldMaskTest) TearDown() {
+	t.api.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FieldMaskTest) Listing() {
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Delimiter: "/"})
+
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.ListingFieldMask(t.fields), t.api.lastFields())
+
+	ExpectThat(listing.CollapsedRuns, ElementsAre("dir/"))
+	AssertEq(2, len(listing.Objects))
+
+	o := listing.Objects[1]
+	ExpectEq("foo", o.Name)
+	ExpectEq(4, o.Size)
+	ExpectEq(2, o.Generation)
+	ExpectEq(1, o.MetaGeneration)
+	ExpectEq("2015-04-05T02:14:00Z", o.Metadata["gcsfuse_mtime"])
+	ExpectEq("", o.MediaLink)
+	ExpectEq("", o.Owner)
+}
+
+func (t *FieldMaskTest) Stat() {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.ObjectFieldMask(t.fields), t.api.lastFields())
+
+	ExpectEq("foo", o.Name)
+	ExpectEq(4, o.Size)
+	ExpectEq(0xa5c29cae, o.CRC32C)
+	ExpectNe(nil, o.MD5)
+	ExpectEq("text/plain", o.ContentType)
+	ExpectEq("blue", o.Metadata["color"])
+	ExpectEq("", o.MediaLink)
+	ExpectEq("", o.StorageClass)
+}
+
+func (t *FieldMaskTest) ReadOnlyMaskKeepsMetadataForXattrs() {
+	fields, err := gcsproxy.ObjectFields.Fields(fs.ObjectFieldFeatures(true))
+	AssertEq(nil, err)
+
+	t.bucket, err = t.api.openBucket(fields)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("2015-04-05T02:14:00Z", o.Metadata["gcsfuse_mtime"])
+	ExpectEq("blue", o.Metadata["color"])
+	ExpectEq("text/plain", o.ContentType)
+	ExpectEq("", o.MediaLink)
+}
+
+func (t *FieldMaskTest) ReadsAreUntouched() {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(b))
+	ExpectEq("", t.api.lastFields())
+}
+
+func (t *FieldMaskTest) FullObjects() {
+	var err error
+	t.bucket, err = t.api.openBucket(nil)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("", t.api.lastFields())
+	ExpectThat(o.MediaLink, HasSubstr("alt=media"))
+	ExpectEq("STANDARD", o.StorageClass)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Benchmarks
+////////////////////////////////////////////////////////////////////////
+
+// List a page of a thousand objects, with and without the field mask for a
+// read-write mount, reporting the size of each response. Most of the time
+// goes to decoding the response.
+func BenchmarkListObjects(b *testing.B) {
+	fields, err := gcsproxy.ObjectFields.Fields(fs.ObjectFieldFeatures(false))
+	if err != nil {
+		b.Fatalf("Fields: %v", err)
+	}
+
+	var names []string
+	for i := 0; i < 1000; i++ {
+		names = append(names, fmt.Sprintf("dir/object_%04d", i))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		fields []string
+	}{
+		{"full", nil},
+		{"masked", fields},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			api := newFakeJSONAPI(names...)
+			defer api.server.Close()
+
+			bucket, err := api.openBucket(tc.fields)
+			if err != nil {
+				b.Fatalf("openBucket: %v", err)
+			}
+
+			ctx := context.Background()
+			req := &gcs.ListObjectsRequest{Prefix: "dir/"}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := bucket.ListObjects(ctx, req); err != nil {
+					b.Fatalf("ListObjects: %v", err)
+				}
+			}
+
+			b.StopTimer()
+			b.ReportMetric(float64(api.responseBytes)/float64(b.N), "resp-B/op")
+		})
+	}
+}
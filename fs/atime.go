@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"golang.org/x/net/context"
+)
+
+// How files' access times are reported and kept. See ServerConfig.AtimeMode.
+type AtimeMode int
+
+const (
+	// Report each file's modification time as its access time. Explicitly
+	// setting an access time is not supported.
+	AtimeOff AtimeMode = iota
+
+	// Keep access times in memory only, advancing them on every read, so that
+	// they are visible for the lifetime of the mount without writing to GCS.
+	AtimeLocal
+
+	// As with AtimeLocal, but also write access times to object metadata in
+	// the background, following relatime(8) and at most once per
+	// ServerConfig.AtimePersistInterval for each file. Reads never wait for
+	// GCS on this account. See inode.FileInode.PersistAtime.
+	AtimePersistRelatime
+)
+
+var atimeModeNames = map[AtimeMode]string{
+	AtimeOff:             "off",
+	AtimeLocal:           "local",
+	AtimePersistRelatime: "persist-relatime",
+}
+
+func (m AtimeMode) String() string {
+	if s, ok := atimeModeNames[m]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("AtimeMode(%d)", int(m))
+}
+
+// Parse the name of an atime mode, as returned by AtimeMode.String.
+func ParseAtimeMode(s string) (m AtimeMode, err error) {
+	for m, name := range atimeModeNames {
+		if s == name {
+			return m, nil
+		}
+	}
+
+	err = fmt.Errorf(
+		"atime mode must be \"off\", \"local\", or \"persist-relatime\" (got %q)",
+		s)
+
+	return
+}
+
+// How often to look for access times to persist, unless the persist interval
+// is shorter.
+const atimePersistPeriod = time.Minute
+
+// Record that the supplied file was read, if we track access times.
+//
+// LOCKS_REQUIRED(f)
+func (fs *fileSystem) noteAccess(f *inode.FileInode) {
+	if fs.atimeMode != AtimeOff {
+		f.NoteAccess(fs.clock.Now())
+	}
+}
+
+// Write access times to object metadata where FileInode.PersistAtime calls
+// for it, carrying on past failures. Return the number written and the first
+// error.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) persistAtimes(ctx context.Context) (n int, err error) {
+	// Find the file inodes.
+	var files []*inode.FileInode
+
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok {
+			files = append(files, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	// Persist each.
+	for _, f := range files {
+		f.Lock()
+		persisted, persistErr := f.PersistAtime(ctx, fs.atimePersistInterval)
+		f.Unlock()
+
+		if persisted {
+			n++
+		}
+
+		if persistErr != nil {
+			logger.Errorf("Persisting atime of %q: %v", f.Name(), persistErr)
+			if err == nil {
+				err = fmt.Errorf("%q: %v", f.Name(), persistErr)
+			}
+		}
+	}
+
+	return
+}
+
+// Call persistAtimes periodically until the context is cancelled.
+func (fs *fileSystem) persistAtimesPeriodically(ctx context.Context) {
+	period := atimePersistPeriod
+	if fs.atimePersistInterval < period {
+		period = fs.atimePersistInterval
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			fs.persistAtimes(ctx)
+		}
+	}
+}
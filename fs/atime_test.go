@@ -0,0 +1,358 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestAtime(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose metadata updates block until release is closed, closing
+// started first.
+type gatedUpdatesBucket struct {
+	gcs.Bucket
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *gatedUpdatesBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	close(b.started)
+	<-b.release
+
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const atimeTestInterval = time.Hour
+
+// Tests for ServerConfig.AtimeMode. The file system talks to the fake bucket
+// through a cost bucket, so that we can count metadata updates. Each test
+// creates the file system with the mode it wants.
+type AtimeTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	cost   gcsproxy.CostBucket
+	fs     *fileSystem
+
+	// The object "foo", and the inode and handle from opening it.
+	o  *gcs.Object
+	id fuseops.InodeID
+	h  fuseops.HandleID
+}
+
+func init() { RegisterTestSuite(&AtimeTest{}) }
+
+func (t *AtimeTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.cost = gcsproxy.NewCostBucket(nil, t.bucket)
+
+	t.o, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+}
+
+func (t *AtimeTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+// Create the file system with the given mode, and open "foo".
+func (t *AtimeTest) mount(mode AtimeMode) {
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.cost,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+		AtimeMode:            mode,
+		AtimePersistInterval: atimeTestInterval,
+	})
+
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	t.id = child.ID()
+
+	op := &fuseops.OpenFileOp{Inode: t.id}
+	AssertEq(nil, t.fs.OpenFile(op))
+	t.h = op.Handle
+}
+
+func (t *AtimeTest) read() {
+	op := &fuseops.ReadFileOp{Inode: t.id, Handle: t.h, Size: 4}
+	AssertEq(nil, t.fs.ReadFile(op))
+	AssertEq("taco", string(op.Data))
+}
+
+func (t *AtimeTest) attributes() fuseops.InodeAttributes {
+	op := &fuseops.GetInodeAttributesOp{Inode: t.id}
+	AssertEq(nil, t.fs.GetInodeAttributes(op))
+	return op.Attributes
+}
+
+func (t *AtimeTest) setAtime(atime time.Time) error {
+	return t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: t.id,
+		Atime: &atime,
+	})
+}
+
+func (t *AtimeTest) updates() uint64 {
+	return t.cost.Stats().ByMethod["UpdateObject"]
+}
+
+func (t *AtimeTest) atimeMetadata() string {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	return o.Metadata[inode.AtimeMetadataKey]
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AtimeTest) Off() {
+	t.mount(AtimeOff)
+
+	t.clock.AdvanceTime(time.Minute)
+	t.read()
+
+	attrs := t.attributes()
+	ExpectThat(attrs.Atime, timeutil.TimeEq(t.o.Updated))
+	ExpectThat(attrs.Atime, timeutil.TimeEq(attrs.Mtime))
+
+	// Access times can't be set.
+	ExpectEq(fuse.ENOSYS, t.setAtime(t.clock.Now()))
+
+	_, err := t.fs.persistAtimes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, t.updates())
+}
+
+func (t *AtimeTest) Off_Utimes() {
+	t.mount(AtimeOff)
+
+	// utimes(2) sets both times. The access time is ignored.
+	atime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+	err := t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: t.id,
+		Atime: &atime,
+		Mtime: &mtime,
+	})
+
+	AssertEq(nil, err)
+
+	attrs := t.attributes()
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime))
+	ExpectThat(attrs.Atime, timeutil.TimeEq(mtime))
+
+	// The generation is unchanged; only the metadata was updated.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(t.o.Generation, o.Generation)
+	ExpectEq("2002-03-04T05:06:07Z", o.Metadata[inode.MtimeMetadataKey])
+	ExpectEq(1, t.updates())
+}
+
+func (t *AtimeTest) Local() {
+	t.mount(AtimeLocal)
+
+	// Before any reads, the atime is the mtime.
+	ExpectThat(t.attributes().Atime, timeutil.TimeEq(t.o.Updated))
+
+	// Each read advances it.
+	for i := 0; i < 3; i++ {
+		t.clock.AdvanceTime(time.Minute)
+		t.read()
+		ExpectThat(t.attributes().Atime, timeutil.TimeEq(t.clock.Now()))
+	}
+
+	// Nothing is written to GCS.
+	ExpectEq(0, t.updates())
+	ExpectEq("", t.atimeMetadata())
+}
+
+func (t *AtimeTest) Local_Utimes() {
+	t.mount(AtimeLocal)
+
+	set := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	AssertEq(nil, t.setAtime(set))
+	ExpectThat(t.attributes().Atime, timeutil.TimeEq(set))
+
+	// The mtime may be set along with it, and is written straight to GCS.
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+	err := t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: t.id,
+		Atime: &set,
+		Mtime: &mtime,
+	})
+
+	AssertEq(nil, err)
+	ExpectThat(t.attributes().Mtime, timeutil.TimeEq(mtime))
+	ExpectEq(1, t.updates())
+	ExpectEq("", t.atimeMetadata())
+
+	// A later read moves the access time on again.
+	t.read()
+	ExpectThat(t.attributes().Atime, timeutil.TimeEq(t.clock.Now()))
+}
+
+func (t *AtimeTest) PersistRelatime_WriteRateBounded() {
+	t.mount(AtimePersistRelatime)
+
+	// Read once a minute for three intervals, persisting as the background
+	// goroutine would.
+	var persisted []int
+	for i := 1; i <= 3*60; i++ {
+		t.clock.AdvanceTime(time.Minute)
+
+		// Reads never write.
+		before := t.updates()
+		t.read()
+		AssertEq(before, t.updates())
+
+		n, err := t.fs.persistAtimes(t.ctx)
+		AssertEq(nil, err)
+		if n != 0 {
+			persisted = append(persisted, i)
+		}
+	}
+
+	// The first access after the modification is written at once, and then
+	// one per interval.
+	ExpectThat(persisted, ElementsAre(1, 61, 121))
+	ExpectEq(3, t.updates())
+
+	// The reported atime is always the latest.
+	ExpectThat(t.attributes().Atime, timeutil.TimeEq(t.clock.Now()))
+	ExpectEq(
+		t.o.Updated.Add(121*time.Minute).UTC().Format(time.RFC3339Nano),
+		t.atimeMetadata())
+}
+
+func (t *AtimeTest) PersistRelatime_Utimes() {
+	t.mount(AtimePersistRelatime)
+
+	set := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	AssertEq(nil, t.setAtime(set))
+	ExpectThat(t.attributes().Atime, timeutil.TimeEq(set))
+
+	// Setting doesn't write synchronously either.
+	ExpectEq(0, t.updates())
+
+	n, err := t.fs.persistAtimes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, n)
+	ExpectEq("2001-02-03T04:05:06Z", t.atimeMetadata())
+}
+
+func (t *AtimeTest) PersistRelatime_ReadsDontWait() {
+	gated := &gatedUpdatesBucket{
+		Bucket:  t.bucket,
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	t.cost = gcsproxy.NewCostBucket(nil, gated)
+	t.mount(AtimePersistRelatime)
+
+	t.clock.AdvanceTime(time.Minute)
+	t.read()
+
+	done := make(chan error)
+	go func() {
+		_, err := t.fs.persistAtimes(t.ctx)
+		done <- err
+	}()
+
+	// While the update is in flight, the file can still be read.
+	<-gated.started
+	readErr := make(chan error, 1)
+	go func() {
+		op := &fuseops.ReadFileOp{Inode: t.id, Handle: t.h, Size: 4}
+		readErr <- t.fs.ReadFile(op)
+	}()
+
+	select {
+	case err := <-readErr:
+		ExpectEq(nil, err)
+
+	case <-time.After(5 * time.Second):
+		close(gated.release)
+		AddFailure("Read blocked behind atime update")
+		AbortTest()
+	}
+
+	close(gated.release)
+	AssertEq(nil, <-done)
+	ExpectNe("", t.atimeMetadata())
+}
+
+func (t *AtimeTest) PersistedAtimeSeenByNewInodes() {
+	t.mount(AtimePersistRelatime)
+
+	t.clock.AdvanceTime(time.Minute)
+	t.read()
+	accessed := t.clock.Now()
+
+	_, err := t.fs.persistAtimes(t.ctx)
+	AssertEq(nil, err)
+	t.fs.Destroy()
+
+	// A new mount reports the persisted access time.
+	t.clock.AdvanceTime(time.Minute)
+	t.mount(AtimeLocal)
+	ExpectThat(t.attributes().Atime, timeutil.TimeEq(accessed))
+}
@@ -21,9 +21,9 @@ import (
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
 	"github.com/jacobsa/fuse/fusetesting"
 	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/gcloud/gcs/gcscaching"
 	"github.com/jacobsa/gcloud/gcs/gcsfake"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	. "github.com/jacobsa/oglematchers"
@@ -47,10 +47,11 @@ func (t *cachingTestCommon) SetUp(ti *TestInfo) {
 	t.uncachedBucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
 
 	const statCacheCapacity = 1000
-	statCache := gcscaching.NewStatCache(statCacheCapacity)
-	t.bucket = gcscaching.NewFastStatBucket(
-		ttl,
-		statCache,
+	policy, err := gcsproxy.ParseStatTTLs(ttl, nil)
+	AssertEq(nil, err)
+
+	t.bucket = gcsproxy.NewRecordCachingBucket(
+		gcsproxy.NewRecordCache(statCacheCapacity, policy, &t.clock),
 		&t.clock,
 		t.uncachedBucket)
 
@@ -161,6 +162,47 @@ func (t *CachingTest) FileChangedRemotely() {
 	ExpectEq("burrito", string(b))
 }
 
+func (t *CachingTest) SyncObservesRemoteChange() {
+	const name = "foo"
+	var fi os.FileInfo
+	var err error
+
+	// Create a file via the file system, then open it and read its contents so
+	// that they are available locally.
+	err = ioutil.WriteFile(path.Join(t.Dir, name), []byte("taco"), 0500)
+	AssertEq(nil, err)
+
+	f, err := os.OpenFile(path.Join(t.Dir, name), os.O_RDWR, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	AssertEq(nil, err)
+	AssertEq("taco", string(b))
+
+	// Overwrite the object in GCS.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.uncachedBucket,
+		name,
+		"burrito")
+
+	AssertEq(nil, err)
+
+	// Modify and sync the file. The sync should discover that the object has
+	// been clobbered, throwing away the cached record for it.
+	_, err = f.Write([]byte("s"))
+	AssertEq(nil, err)
+
+	err = f.Sync()
+	AssertEq(nil, err)
+
+	// So we should see the new version without waiting for the TTL.
+	fi, err = os.Stat(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), fi.Size())
+}
+
 func (t *CachingTest) DirectoryRemovedRemotely() {
 	const name = "foo"
 	var fi os.FileInfo
@@ -0,0 +1,163 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/bazilfuse"
+)
+
+// The error returned for creations in directories that appear to already have
+// ServerConfig.MaxChildrenPerDir children.
+var errTooManyChildren = bazilfuse.Errno(syscall.EDQUOT)
+
+// Cheap estimates of the number of children of each directory, used to
+// enforce ServerConfig.MaxChildrenPerDir without ever listing for the purpose.
+//
+// A directory's estimate is the number of entries in the last complete listing
+// of it, adjusted by the children created and deleted locally since then. Each
+// fresh listing replaces the estimate, so errors never outlive it. Between
+// listings, children created by other mounts aren't counted, so the estimate
+// may fall short of the truth; this only delays enforcement. Children deleted
+// by other mounts aren't subtracted, so the estimate may exceed the truth, but
+// by no more than the number of such deletions since the last listing.
+// Renames into a directory aren't counted either, since they may replace an
+// existing child.
+//
+// Directories that have never been listed start from zero. Estimates are
+// dropped when their directory's inode is destroyed.
+//
+// A nil *childCounts tracks nothing, and is used when there is no limit. Safe
+// for concurrent access. Adjustments should be made while holding the
+// directory's inode lock, so that they are ordered with respect to listings.
+type childCounts struct {
+	mu sync.Mutex
+
+	// Estimates, keyed by directory object name ("" for the root).
+	//
+	// INVARIANT: For each v, v >= 0
+	//
+	// GUARDED_BY(mu)
+	estimates map[string]int
+}
+
+func newChildCounts() (cc *childCounts) {
+	cc = &childCounts{
+		estimates: make(map[string]int),
+	}
+
+	return
+}
+
+// Return the current estimate for the named directory.
+func (cc *childCounts) Estimate(dir string) (n int) {
+	if cc == nil {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	n = cc.estimates[dir]
+	return
+}
+
+// Replace the estimate for the named directory with the size of a complete,
+// fresh listing.
+func (cc *childCounts) Listed(dir string, n int) {
+	if cc == nil {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.estimates[dir] = n
+}
+
+// Record that a child of the named directory was created locally.
+func (cc *childCounts) Created(dir string) {
+	if cc == nil {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.estimates[dir]++
+}
+
+// Record that a child of the named directory was deleted locally.
+func (cc *childCounts) Deleted(dir string) {
+	if cc == nil {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.estimates[dir] > 0 {
+		cc.estimates[dir]--
+	}
+}
+
+// Discard the estimate for the named directory.
+func (cc *childCounts) Forget(dir string) {
+	if cc == nil {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	delete(cc.estimates, dir)
+}
+
+// Would creating another child of the named directory take it over the
+// supplied limit, according to the estimate? Zero means no limit. Return the
+// estimate too, for logging.
+func (cc *childCounts) Full(dir string, max int) (full bool, n int) {
+	if cc == nil || max <= 0 {
+		return
+	}
+
+	n = cc.Estimate(dir)
+	full = n >= max
+	return
+}
+
+// Fail with errTooManyChildren if the supplied directory appears to already
+// have as many children as ServerConfig.MaxChildrenPerDir allows.
+func (fs *fileSystem) checkChildQuota(parent inode.DirInode) (err error) {
+	full, n := fs.childCounts.Full(parent.Name(), fs.maxChildrenPerDir)
+	if !full {
+		return
+	}
+
+	fs.counters.recordChildQuotaCreationRejected()
+	log.Printf(
+		"Refusing to create a child of %q, which appears to have %d children "+
+			"(limit %d).",
+		parent.Name(),
+		n,
+		fs.maxChildrenPerDir)
+
+	err = errTooManyChildren
+	return
+}
@@ -0,0 +1,294 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestChildQuota(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const childQuotaTestMax = 4
+
+// Tests for ServerConfig.MaxChildrenPerDir. The file system talks to the fake
+// bucket through a cost bucket, so that we can see what requests the guard
+// costs. Changes made directly to the fake bucket stand in for another mount.
+type ChildQuotaTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	cost   gcsproxy.CostBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&ChildQuotaTest{}) }
+
+func (t *ChildQuotaTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.cost = gcsproxy.NewCostBucket(nil, t.bucket)
+
+	t.createFS(childQuotaTestMax)
+}
+
+func (t *ChildQuotaTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+func (t *ChildQuotaTest) createFS(maxChildren int) {
+	var err error
+
+	if t.fs != nil {
+		t.fs.Destroy()
+		t.fs = nil
+	}
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.cost,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+		MaxChildrenPerDir:    maxChildren,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *ChildQuotaTest) createFile(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	err = t.fs.CreateFile(&fuseops.CreateFileOp{Parent: parent, Name: name})
+	return
+}
+
+func (t *ChildQuotaTest) unlink(name string) (err error) {
+	err = t.fs.Unlink(&fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: name})
+	return
+}
+
+// Create files named "0", "1", ... in the root directory.
+func (t *ChildQuotaTest) createFiles(n int) {
+	for i := 0; i < n; i++ {
+		AssertEq(nil, t.createFile(fuseops.RootInodeID, fmt.Sprint(i)))
+	}
+}
+
+// List the root directory in full, returning the number of bytes of entries.
+func (t *ChildQuotaTest) listRoot() (n int) {
+	openOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	AssertEq(nil, t.fs.OpenDir(openOp))
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  fuseops.RootInodeID,
+		Handle: openOp.Handle,
+		Size:   1 << 12,
+	}
+
+	AssertEq(nil, t.fs.ReadDir(readOp))
+	n = len(readOp.Data)
+
+	return
+}
+
+func (t *ChildQuotaTest) rootEstimate() int {
+	return t.fs.childCounts.Estimate("")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ChildQuotaTest) CreationsAreCounted() {
+	for i := 0; i < childQuotaTestMax; i++ {
+		ExpectEq(i, t.rootEstimate())
+		AssertEq(nil, t.createFile(fuseops.RootInodeID, fmt.Sprint(i)))
+	}
+
+	ExpectEq(childQuotaTestMax, t.rootEstimate())
+}
+
+func (t *ChildQuotaTest) CreationsRefusedAtLimit() {
+	t.createFiles(childQuotaTestMax - 1)
+
+	// One more is allowed.
+	err := t.fs.MkDir(
+		&fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir"})
+
+	AssertEq(nil, err)
+
+	// But then no file, directory, or symlink may be created.
+	before := t.fs.counters.Stats().ChildQuotaCreationsRejected
+
+	err = t.createFile(fuseops.RootInodeID, "taco")
+	ExpectEq(errTooManyChildren, err)
+
+	err = t.fs.MkDir(
+		&fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "burrito"})
+
+	ExpectEq(errTooManyChildren, err)
+
+	err = t.fs.CreateSymlink(
+		&fuseops.CreateSymlinkOp{
+			Parent: fuseops.RootInodeID,
+			Name:   "enchilada",
+			Target: "0",
+		})
+
+	ExpectEq(errTooManyChildren, err)
+	ExpectEq(before+3, t.fs.counters.Stats().ChildQuotaCreationsRejected)
+
+	// Nothing was created.
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "taco")
+	ExpectNe(nil, err)
+	ExpectEq(childQuotaTestMax, t.rootEstimate())
+}
+
+func (t *ChildQuotaTest) LimitIsPerDirectory() {
+	t.createFiles(childQuotaTestMax - 1)
+
+	mkDirOp := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	AssertEq(nil, t.fs.MkDir(mkDirOp))
+	AssertEq(errTooManyChildren, t.createFile(fuseops.RootInodeID, "taco"))
+
+	// The new directory has room of its own.
+	err := t.createFile(mkDirOp.Entry.Child, "taco")
+	ExpectEq(nil, err)
+}
+
+func (t *ChildQuotaTest) DeletionsAndReadsNeverRefused() {
+	t.createFiles(childQuotaTestMax)
+	AssertEq(errTooManyChildren, t.createFile(fuseops.RootInodeID, "taco"))
+
+	// Reading works.
+	lookUpOp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "0"}
+	ExpectEq(nil, t.fs.LookUpInode(lookUpOp))
+	ExpectNe(0, t.listRoot())
+
+	// As does deleting, which makes room.
+	AssertEq(nil, t.unlink("0"))
+	ExpectEq(childQuotaTestMax-1, t.rootEstimate())
+	ExpectEq(nil, t.createFile(fuseops.RootInodeID, "taco"))
+}
+
+func (t *ChildQuotaTest) ListingCorrectsUnderestimate() {
+	// Another mount creates children that we know nothing about, so enforcement
+	// is delayed.
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"a": "",
+			"b": "",
+			"c": "",
+			"d": "",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(0, t.rootEstimate())
+	AssertEq(nil, t.createFile(fuseops.RootInodeID, "taco"))
+
+	// Listing reveals the truth, which is over the limit.
+	t.listRoot()
+	ExpectEq(5, t.rootEstimate())
+	ExpectEq(errTooManyChildren, t.createFile(fuseops.RootInodeID, "burrito"))
+}
+
+func (t *ChildQuotaTest) ListingCorrectsOverestimate() {
+	t.createFiles(childQuotaTestMax)
+
+	// Another mount deletes two children, which we don't notice yet.
+	for _, name := range []string{"0", "1"} {
+		err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+		AssertEq(nil, err)
+	}
+
+	ExpectEq(childQuotaTestMax, t.rootEstimate())
+	ExpectEq(errTooManyChildren, t.createFile(fuseops.RootInodeID, "taco"))
+
+	// Once our own creations are too old to be merged into listings, listing
+	// shows that there is room for two more.
+	t.clock.AdvanceTime(time.Hour)
+	t.listRoot()
+	ExpectEq(childQuotaTestMax-2, t.rootEstimate())
+
+	AssertEq(nil, t.createFile(fuseops.RootInodeID, "taco"))
+	AssertEq(nil, t.createFile(fuseops.RootInodeID, "burrito"))
+	ExpectEq(errTooManyChildren, t.createFile(fuseops.RootInodeID, "queso"))
+}
+
+func (t *ChildQuotaTest) FailedCreationsNotCounted() {
+	t.createFiles(1)
+
+	// The name already exists.
+	err := t.createFile(fuseops.RootInodeID, "0")
+	AssertEq(fuse.EEXIST, err)
+	ExpectEq(1, t.rootEstimate())
+}
+
+func (t *ChildQuotaTest) GuardSendsNoRequests() {
+	const n = childQuotaTestMax
+
+	// Measure creating and deleting some files without a limit.
+	t.createFS(0)
+	AssertEq(nil, t.fs.childCounts)
+
+	before := t.cost.Stats()
+	t.createFiles(n)
+	for i := 0; i < n; i++ {
+		AssertEq(nil, t.unlink(fmt.Sprint(i)))
+	}
+
+	unguarded := t.cost.Stats().Since(before)
+
+	// And again with one.
+	t.createFS(n)
+
+	before = t.cost.Stats()
+	t.createFiles(n)
+	for i := 0; i < n; i++ {
+		AssertEq(nil, t.unlink(fmt.Sprint(i)))
+	}
+
+	guarded := t.cost.Stats().Since(before)
+
+	for m, count := range unguarded.ByMethod {
+		ExpectEq(count, guarded.ByMethod[m], "Method: %s", m)
+	}
+
+	ExpectEq(0, guarded.ByMethod["ListObjects"])
+}
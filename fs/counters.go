@@ -0,0 +1,211 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/lease"
+)
+
+// Counters of the work done by a file system, for summarizing a mount. Safe
+// for concurrent use; the zero value is ready to use.
+type Counters struct {
+	// Accessed atomically.
+	readOps            uint64
+	writeOps           uint64
+	bytesRead          uint64
+	bytesWritten       uint64
+	lookUpRetries      uint64
+	streamedBytes      uint64
+	streamingFallbacks uint64
+
+	pathDepthLookupsRejected    uint64
+	pathDepthEntriesSkipped     uint64
+	childQuotaCreationsRejected uint64
+	dirCacheHits                uint64
+	dirCacheNegativeLookups     uint64
+	negativeLookupHits          uint64
+	staleFilesRefreshed         uint64
+
+	mu sync.Mutex
+
+	// The file leaser and eviction tracker of the file system most recently
+	// created with these counters, or nil if none.
+	//
+	// GUARDED_BY(mu)
+	leaser    lease.FileLeaser
+	evictions *gcsproxy.EvictionTracker
+}
+
+// A snapshot of Counters.
+type Stats struct {
+	// ReadFile and WriteFile ops that succeeded, and the bytes they returned
+	// to or accepted from the kernel.
+	ReadOps      uint64
+	WriteOps     uint64
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// The number of times that looking up an inode had to start again because
+	// a concurrent change to GCS got in the way.
+	LookUpRetries uint64
+
+	// Bytes returned by ReadFile ops that were streamed from GCS rather than
+	// cached, and the number of handles that stopped streaming part way. See
+	// ServerConfig.StreamingReadThreshold.
+	StreamedBytes      uint64
+	StreamingFallbacks uint64
+
+	// Lookups refused and directory entries left out because of
+	// ServerConfig.MaxPathDepth.
+	PathDepthLookupsRejected uint64
+	PathDepthEntriesSkipped  uint64
+
+	// Creations refused because of ServerConfig.MaxChildrenPerDir.
+	ChildQuotaCreationsRejected uint64
+
+	// Directory reads served from listings kept for ServerConfig.DirCacheTTL,
+	// and lookups those listings answered negatively.
+	DirCacheHits            uint64
+	DirCacheNegativeLookups uint64
+
+	// Lookups answered from names remembered for ServerConfig.NegativeTTL.
+	NegativeLookupHits uint64
+
+	// File inodes brought up to date with an object overwritten by another
+	// client. See fileSystem.refreshStaleFile.
+	StaleFilesRefreshed uint64
+
+	// The number of temporary files currently holding file contents, and an
+	// estimate of the bytes they occupy. See ServerConfig.TempDir.
+	TempFiles int
+	TempBytes int64
+
+	// The limits on those, from ServerConfig.TempDirLimitNumFiles and
+	// TempDirLimitBytes, and the number of times cached contents have been
+	// evicted to stay within them.
+	TempLimitFiles int
+	TempLimitBytes int64
+	TempEvictions  uint64
+
+	// The number of times cached contents have been thrown away for other
+	// reasons, such as the object changing, and the number of times evicted
+	// contents have had to be downloaded again.
+	TempRevocations    uint64
+	TempEvictionMisses uint64
+}
+
+// Return a snapshot of the counters.
+func (c *Counters) Stats() (s Stats) {
+	s = Stats{
+		ReadOps:       atomic.LoadUint64(&c.readOps),
+		WriteOps:      atomic.LoadUint64(&c.writeOps),
+		BytesRead:     atomic.LoadUint64(&c.bytesRead),
+		BytesWritten:  atomic.LoadUint64(&c.bytesWritten),
+		LookUpRetries: atomic.LoadUint64(&c.lookUpRetries),
+
+		StreamedBytes:      atomic.LoadUint64(&c.streamedBytes),
+		StreamingFallbacks: atomic.LoadUint64(&c.streamingFallbacks),
+
+		PathDepthLookupsRejected:    atomic.LoadUint64(&c.pathDepthLookupsRejected),
+		PathDepthEntriesSkipped:     atomic.LoadUint64(&c.pathDepthEntriesSkipped),
+		ChildQuotaCreationsRejected: atomic.LoadUint64(&c.childQuotaCreationsRejected),
+		DirCacheHits:                atomic.LoadUint64(&c.dirCacheHits),
+		DirCacheNegativeLookups:     atomic.LoadUint64(&c.dirCacheNegativeLookups),
+		NegativeLookupHits:          atomic.LoadUint64(&c.negativeLookupHits),
+		StaleFilesRefreshed:         atomic.LoadUint64(&c.staleFilesRefreshed),
+	}
+
+	c.mu.Lock()
+	if c.leaser != nil {
+		ls := c.leaser.Stats()
+		s.TempFiles = ls.NumFiles
+		s.TempBytes = ls.Bytes
+		s.TempLimitFiles = ls.LimitNumFiles
+		s.TempLimitBytes = ls.LimitBytes
+		s.TempEvictions = ls.CapacityRevocations
+		s.TempRevocations = ls.VoluntaryRevocations
+	}
+
+	if c.evictions != nil {
+		s.TempEvictionMisses = c.evictions.Misses()
+	}
+	c.mu.Unlock()
+
+	return
+}
+
+func (c *Counters) recordRead(n int) {
+	atomic.AddUint64(&c.readOps, 1)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+}
+
+func (c *Counters) recordWrite(n int) {
+	atomic.AddUint64(&c.writeOps, 1)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+}
+
+func (c *Counters) setLeaser(
+	fl lease.FileLeaser,
+	evictions *gcsproxy.EvictionTracker) {
+	c.mu.Lock()
+	c.leaser = fl
+	c.evictions = evictions
+	c.mu.Unlock()
+}
+
+func (c *Counters) recordLookUpRetry() {
+	atomic.AddUint64(&c.lookUpRetries, 1)
+}
+
+func (c *Counters) recordStreamedRead(n int) {
+	c.recordRead(n)
+	atomic.AddUint64(&c.streamedBytes, uint64(n))
+}
+
+func (c *Counters) recordStreamingFallback() {
+	atomic.AddUint64(&c.streamingFallbacks, 1)
+}
+
+func (c *Counters) recordPathDepthLookupRejected() {
+	atomic.AddUint64(&c.pathDepthLookupsRejected, 1)
+}
+
+func (c *Counters) recordPathDepthEntriesSkipped(n int) {
+	atomic.AddUint64(&c.pathDepthEntriesSkipped, uint64(n))
+}
+
+func (c *Counters) recordChildQuotaCreationRejected() {
+	atomic.AddUint64(&c.childQuotaCreationsRejected, 1)
+}
+
+func (c *Counters) recordDirCacheHit() {
+	atomic.AddUint64(&c.dirCacheHits, 1)
+}
+
+func (c *Counters) recordDirCacheNegativeLookup() {
+	atomic.AddUint64(&c.dirCacheNegativeLookups, 1)
+}
+
+func (c *Counters) recordNegativeLookupHit() {
+	atomic.AddUint64(&c.negativeLookupHits, 1)
+}
+
+func (c *Counters) recordStaleFileRefreshed() {
+	atomic.AddUint64(&c.staleFilesRefreshed, 1)
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestCounters(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CountersTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	counters Counters
+	fs       *fileSystem
+}
+
+func init() { RegisterTestSuite(&CountersTest{}) }
+
+func (t *CountersTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	bucket := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err = gcsutil.CreateObject(t.ctx, bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+		Counters:             &t.counters,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *CountersTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up and open a child of the root.
+func (t *CountersTest) open(name string) (id fuseops.InodeID, h fuseops.HandleID) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	id = child.ID()
+
+	op := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(op))
+	h = op.Handle
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CountersTest) ZeroValue() {
+	var c Counters
+	ExpectTrue(c.Stats() == Stats{})
+}
+
+func (t *CountersTest) ReadsAndWrites() {
+	id, h := t.open("foo")
+
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte("burrito"),
+	})
+
+	AssertEq(nil, err)
+
+	for i := 0; i < 2; i++ {
+		op := &fuseops.ReadFileOp{Inode: id, Handle: h, Size: 5}
+		AssertEq(nil, t.fs.ReadFile(op))
+		AssertEq("burri", string(op.Data))
+	}
+
+	s := t.counters.Stats()
+	ExpectEq(2, s.ReadOps)
+	ExpectEq(10, s.BytesRead)
+	ExpectEq(1, s.WriteOps)
+	ExpectEq(7, s.BytesWritten)
+	ExpectEq(0, s.LookUpRetries)
+}
+
+func (t *CountersTest) TempDirUsage() {
+	s := t.counters.Stats()
+	ExpectEq(0, s.TempFiles)
+	ExpectEq(0, s.TempBytes)
+
+	// Dirtying a file gives it a temporary file.
+	id, h := t.open("foo")
+
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte("burrito"),
+	})
+
+	AssertEq(nil, err)
+
+	s = t.counters.Stats()
+	ExpectEq(1, s.TempFiles)
+	ExpectEq(7, s.TempBytes)
+}
+
+func (t *CountersTest) TempDirLimits() {
+	s := t.counters.Stats()
+	ExpectEq(16, s.TempLimitFiles)
+	ExpectEq(1<<22, s.TempLimitBytes)
+	ExpectEq(0, s.TempEvictions)
+}
+
+func (t *CountersTest) EvictionMisses() {
+	_, err := gcsutil.CreateObject(t.ctx, t.fs.bucket, "bar", "enchilada")
+	AssertEq(nil, err)
+
+	// Leave room for only one of the files.
+	t.fs.leaser.SetLimits(16, 10)
+
+	// Release each handle after reading, so that its contents aren't pinned.
+	read := func(name string) {
+		id, h := t.open(name)
+		op := &fuseops.ReadFileOp{Inode: id, Handle: h, Size: 1}
+		AssertEq(nil, t.fs.ReadFile(op))
+		AssertEq(nil, t.fs.ReleaseFileHandle(
+			&fuseops.ReleaseFileHandleOp{Handle: h}))
+	}
+
+	// Reading the second file evicts the first, and reading the first again
+	// has to download it again.
+	read("foo")
+	read("bar")
+
+	s := t.counters.Stats()
+	ExpectEq(1, s.TempEvictions)
+	ExpectEq(0, s.TempEvictionMisses)
+
+	read("foo")
+
+	s = t.counters.Stats()
+	ExpectEq(2, s.TempEvictions)
+	ExpectEq(1, s.TempEvictionMisses)
+	ExpectEq(0, s.TempRevocations)
+
+	// The same counts are exported as metrics.
+	registry := metrics.NewRegistry()
+	registerLeaserMetrics(registry, t.fs.leaser, t.fs.evictions)
+
+	var buf bytes.Buffer
+	AssertEq(nil, registry.WriteText(&buf))
+
+	text := buf.String()
+	ExpectThat(text, HasSubstr(`gcsfuse_temp_dir_revocations_total{reason="capacity"} 2`+"\n"))
+	ExpectThat(text, HasSubstr(`gcsfuse_temp_dir_revocations_total{reason="voluntary"} 0`+"\n"))
+	ExpectThat(text, HasSubstr("gcsfuse_eviction_misses_total 1\n"))
+}
+
+func (t *CountersTest) ExportedAsMetrics() {
+	t.counters.recordChildQuotaCreationRejected()
+	t.counters.recordNegativeLookupHit()
+	t.counters.recordNegativeLookupHit()
+
+	registry := metrics.NewRegistry()
+	registerCounterMetrics(registry, &t.counters)
+
+	var buf bytes.Buffer
+	AssertEq(nil, registry.WriteText(&buf))
+
+	text := buf.String()
+	ExpectThat(text, HasSubstr("gcsfuse_fs_child_quota_creations_rejected_total 1\n"))
+	ExpectThat(text, HasSubstr("gcsfuse_fs_negative_lookup_hits_total 2\n"))
+	ExpectThat(text, HasSubstr("gcsfuse_fs_stale_files_refreshed_total 0\n"))
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDefaultMetadata(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose metadata updates fail while failUpdates is set.
+type failingUpdatesBucket struct {
+	gcs.Bucket
+	failUpdates bool
+}
+
+func (b *failingUpdatesBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	if b.failUpdates {
+		err = errors.New("taco")
+		return
+	}
+
+	o, err = b.Bucket.UpdateObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for default metadata applied to objects written by appending, which
+// GCS composes rather than creates. The bucket starts out with the file
+// "public/foo" containing "taco".
+type DefaultMetadataTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket *failingUpdatesBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&DefaultMetadataTest{}) }
+
+func (t *DefaultMetadataTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = &failingUpdatesBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+	}
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"public/":    "",
+			"public/foo": "taco",
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		AppendThreshold:      1,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		DefaultMetadata:      []string{"public/:cache_control=no-cache"},
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *DefaultMetadataTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Append to public/foo through the file system and flush it.
+func (t *DefaultMetadataTest) appendAndFlush(s string) (err error) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	dir, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "public")
+	AssertEq(nil, err)
+	dir.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(
+		t.ctx,
+		dir.(inode.DirInode),
+		"foo")
+
+	AssertEq(nil, err)
+	child.Unlock()
+
+	openOp := &fuseops.OpenFileOp{Inode: child.ID()}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	writeOp := &fuseops.WriteFileOp{
+		Inode:  child.ID(),
+		Handle: openOp.Handle,
+		Offset: int64(len("taco")),
+		Data:   []byte(s),
+	}
+
+	AssertEq(nil, t.fs.WriteFile(writeOp))
+
+	err = t.fs.FlushFile(
+		&fuseops.FlushFileOp{Inode: child.ID(), Handle: openOp.Handle})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DefaultMetadataTest) AppendedObjectGetsDefaults() {
+	AssertEq(nil, t.appendAndFlush("burrito"))
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "public/foo"})
+
+	AssertEq(nil, err)
+	ExpectEq(2, o.ComponentCount)
+	ExpectEq("no-cache", o.CacheControl)
+}
+
+func (t *DefaultMetadataTest) FailingToApplyDefaultsDoesntFailFlush() {
+	t.bucket.failUpdates = true
+	AssertEq(nil, t.appendAndFlush("burrito"))
+
+	// The contents were written, without the defaults.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "public/foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "public/foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("", o.CacheControl)
+}
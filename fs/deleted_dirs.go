@@ -0,0 +1,187 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Directories found to no longer exist in GCS, for example because another
+// client deleted everything under their prefix, are handled as follows:
+//
+//  *  The directory inode is marked (see inode.DirInode.DeletedRemotely),
+//     after which reading it or looking up children in it fails with ENOENT
+//     without consulting GCS.
+//
+//  *  The kernel is told to forget the directory's entry in its parent, so
+//     that the next use of the path looks it up afresh.
+//
+//  *  Directory inodes beneath it that the kernel still holds, e.g. as the
+//     working directory of a shell, are marked in turn the next time they
+//     are used, rather than by walking every inode up front.
+//
+// Open files beneath the directory are left alone, as for files that are
+// unlinked while open.
+
+// Return the name of the directory containing the supplied file or directory
+// name, e.g. "a/" for "a/b" or "a/b/". The parent of a top-level name is the
+// root directory, "".
+func parentDirName(name string) string {
+	name = strings.TrimSuffix(name, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i+1]
+	}
+
+	return ""
+}
+
+// Schedule the kernel's entry for the supplied name in its parent directory
+// to be thrown away, if we are able to do so and know the parent. Never
+// blocks.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) invalidateEntry(name string) {
+	if fs.invalidations == nil {
+		return
+	}
+
+	// The kernel can't have cached an entry in a directory it has forgotten.
+	parent := fs.dirInodeByName(parentDirName(name))
+	if parent == nil {
+		return
+	}
+
+	fs.invalidations.InvalidateEntry(parent.ID(), path.Base(name))
+}
+
+// Return the directory inode that the kernel knows for the given directory
+// name, or nil if none.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) dirInodeByName(name string) (d inode.DirInode) {
+	if name == "" {
+		d = fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+		return
+	}
+
+	if d, _ = fs.generationBackedInodes[name].(inode.DirInode); d != nil {
+		return
+	}
+
+	d = fs.implicitDirInodes[name]
+	return
+}
+
+// Record that the supplied directory inode, already marked with
+// SetDeletedRemotely, no longer exists in GCS.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) noteDirDeleted(d inode.DirInode) {
+	// Has the inode been forgotten in the meantime?
+	if fs.inodes[d.ID()] != d {
+		return
+	}
+
+	fs.deletedDirs[d.Name()] = d
+	fs.invalidateEntry(d.Name())
+}
+
+// Record that the supplied directory has been found in GCS, superseding any
+// earlier finding that it had been deleted.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(d)
+func (fs *fileSystem) noteDirFound(d inode.DirInode) {
+	d.SetDeletedRemotely(false)
+
+	fs.mu.Lock()
+	delete(fs.deletedDirs, d.Name())
+	fs.mu.Unlock()
+}
+
+// Is the supplied name beneath a directory recorded by noteDirDeleted?
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) beneathDeletedDir(name string) bool {
+	if len(fs.deletedDirs) == 0 {
+		return false
+	}
+
+	for name = parentDirName(name); name != ""; name = parentDirName(name) {
+		if _, ok := fs.deletedDirs[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return ENOENT if the supplied directory is known to no longer exist in GCS,
+// because it has been marked so or because a directory above it has been
+// found deleted. In the latter case, mark it too.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(d)
+func (fs *fileSystem) checkDirExists(d inode.DirInode) (err error) {
+	if !d.DeletedRemotely() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		if !fs.beneathDeletedDir(d.Name()) {
+			return
+		}
+
+		d.SetDeletedRemotely(true)
+		fs.noteDirDeleted(d)
+	}
+
+	err = fuse.ENOENT
+	return
+}
+
+// Handle a lookup of the named child of the supplied directory having found
+// nothing: if we have an inode for a directory of that name, it no longer
+// exists in GCS.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(parent)
+func (fs *fileSystem) noteChildNotFound(parent inode.DirInode, name string) {
+	dirName := parent.Name() + name + "/"
+
+	fs.mu.Lock()
+	d, _ := fs.generationBackedInodes[dirName].(inode.DirInode)
+	if d == nil {
+		d = fs.implicitDirInodes[dirName]
+	}
+	fs.mu.Unlock()
+
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.SetDeletedRemotely(true)
+
+	fs.mu.Lock()
+	fs.noteDirDeleted(d)
+	fs.mu.Unlock()
+}
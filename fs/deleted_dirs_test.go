@@ -0,0 +1,354 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// An invalidator that records the inodes and the entries within the root
+// directory that it is asked to invalidate.
+type entryRecorder struct {
+	mu      sync.Mutex
+	inodes  []fuseops.InodeID
+	entries []string
+}
+
+func (r *entryRecorder) InvalidateInode(id fuseops.InodeID) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inodes = append(r.inodes, id)
+	return
+}
+
+func (r *entryRecorder) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if parent == fuseops.RootInodeID {
+		r.entries = append(r.entries, name)
+	}
+
+	return
+}
+
+// Tests for directories whose contents are deleted by another client, driving
+// the file system directly through its op methods like HandlesTest.
+type RemoteDeletionTest struct {
+	ctx         context.Context
+	clock       timeutil.SimulatedClock
+	bucket      gcs.Bucket
+	invalidator entryRecorder
+	fs          *fileSystem
+}
+
+func init() { RegisterTestSuite(&RemoteDeletionTest{}) }
+
+func (t *RemoteDeletionTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"dir/":        "",
+			"dir/a":       "taco",
+			"dir/sub/b":   "burrito",
+			"implicit/c":  "enchilada",
+			"unrelated/":  "",
+			"unrelated/d": "queso",
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		ImplicitDirectories:  true,
+		DirTypeCacheTTL:      time.Minute,
+		Invalidator:          &t.invalidator,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *RemoteDeletionTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up a child of the given directory inode as the kernel would.
+func (t *RemoteDeletionTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (id fuseops.InodeID, err error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent: parent,
+		Name:   name,
+	}
+
+	err = t.fs.LookUpInode(op)
+	id = op.Entry.Child
+	return
+}
+
+// Open the given directory inode and read it from the start.
+func (t *RemoteDeletionTest) readDir(id fuseops.InodeID) (err error) {
+	openOp := &fuseops.OpenDirOp{Inode: id}
+	AssertEq(nil, t.fs.OpenDir(openOp))
+
+	err = t.fs.ReadDir(&fuseops.ReadDirOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Size:   1 << 12,
+	})
+
+	return
+}
+
+// Read from the start of an open file.
+func (t *RemoteDeletionTest) readFile(
+	id fuseops.InodeID,
+	h fuseops.HandleID) (s string, err error) {
+	op := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: h,
+		Size:   1 << 10,
+	}
+
+	err = t.fs.ReadFile(op)
+	s = string(op.Data)
+	return
+}
+
+// Delete every object whose name begins with the given prefix, as another
+// client might, and wait for the file system's caches to expire.
+func (t *RemoteDeletionTest) deleteAll(prefix string) {
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: prefix})
+
+	AssertEq(nil, err)
+	AssertEq("", listing.ContinuationToken)
+
+	for _, o := range listing.Objects {
+		err = t.bucket.DeleteObject(
+			t.ctx,
+			&gcs.DeleteObjectRequest{Name: o.Name})
+
+		AssertEq(nil, err)
+	}
+
+	t.clock.AdvanceTime(2 * time.Minute)
+}
+
+// Has the file system marked the given directory inode as deleted?
+func (t *RemoteDeletionTest) deletedRemotely(id fuseops.InodeID) bool {
+	t.fs.mu.Lock()
+	in := t.fs.inodes[id].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	in.Lock()
+	defer in.Unlock()
+
+	return in.DeletedRemotely()
+}
+
+// Return the names of the root's entries invalidated so far.
+func (t *RemoteDeletionTest) invalidatedEntries() []string {
+	t.fs.invalidations.Stop()
+
+	t.invalidator.mu.Lock()
+	defer t.invalidator.mu.Unlock()
+
+	return t.invalidator.entries
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RemoteDeletionTest) ReadDirFindsDirectoryGone() {
+	dir, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	t.deleteAll("dir/")
+
+	// Reading the directory should notice that it is gone.
+	err = t.readDir(dir)
+	ExpectEq(fuse.ENOENT, err)
+	ExpectTrue(t.deletedRemotely(dir))
+
+	// From then on, nothing should be found or created in it.
+	_, err = t.lookUp(dir, "a")
+	ExpectEq(fuse.ENOENT, err)
+
+	err = t.fs.CreateFile(&fuseops.CreateFileOp{
+		Parent: dir,
+		Name:   "foo",
+		Mode:   0644,
+	})
+
+	ExpectEq(fuse.ENOENT, err)
+
+	err = t.fs.MkDir(&fuseops.MkDirOp{
+		Parent: dir,
+		Name:   "foo",
+		Mode:   0755,
+	})
+
+	ExpectEq(fuse.ENOENT, err)
+
+	// The kernel should have been told to forget the directory's entry.
+	ExpectThat(t.invalidatedEntries(), ElementsAre("dir"))
+}
+
+func (t *RemoteDeletionTest) LookUpFindsDirectoryGone() {
+	dir, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	t.deleteAll("dir/")
+
+	// Looking the directory up again should mark the inode we already have.
+	_, err = t.lookUp(fuseops.RootInodeID, "dir")
+	ExpectEq(fuse.ENOENT, err)
+	ExpectTrue(t.deletedRemotely(dir))
+
+	err = t.readDir(dir)
+	ExpectEq(fuse.ENOENT, err)
+
+	ExpectThat(t.invalidatedEntries(), ElementsAre("dir"))
+}
+
+func (t *RemoteDeletionTest) DescendantsMarkedOnUse() {
+	dir, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	sub, err := t.lookUp(dir, "sub")
+	AssertEq(nil, err)
+
+	t.deleteAll("dir/")
+
+	err = t.readDir(dir)
+	AssertEq(fuse.ENOENT, err)
+
+	// The subdirectory isn't touched until it is used.
+	ExpectFalse(t.deletedRemotely(sub))
+
+	_, err = t.lookUp(sub, "b")
+	ExpectEq(fuse.ENOENT, err)
+	ExpectTrue(t.deletedRemotely(sub))
+
+	err = t.readDir(sub)
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *RemoteDeletionTest) OtherDirectoriesUnaffected() {
+	dir, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	unrelated, err := t.lookUp(fuseops.RootInodeID, "unrelated")
+	AssertEq(nil, err)
+
+	t.deleteAll("dir/")
+
+	err = t.readDir(dir)
+	AssertEq(fuse.ENOENT, err)
+
+	err = t.readDir(unrelated)
+	ExpectEq(nil, err)
+
+	_, err = t.lookUp(unrelated, "d")
+	ExpectEq(nil, err)
+
+	ExpectFalse(t.deletedRemotely(fuseops.RootInodeID))
+	ExpectEq(nil, t.readDir(fuseops.RootInodeID))
+}
+
+func (t *RemoteDeletionTest) OpenFileStillReadable() {
+	dir, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	a, err := t.lookUp(dir, "a")
+	AssertEq(nil, err)
+
+	openOp := &fuseops.OpenFileOp{Inode: a}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	s, err := t.readFile(a, openOp.Handle)
+	AssertEq(nil, err)
+	AssertEq("taco", s)
+
+	t.deleteAll("dir/")
+
+	err = t.readDir(dir)
+	AssertEq(fuse.ENOENT, err)
+
+	// The contents we already have should still be served.
+	s, err = t.readFile(a, openOp.Handle)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+}
+
+func (t *RemoteDeletionTest) RecreatedDirectoryRevived() {
+	implicit, err := t.lookUp(fuseops.RootInodeID, "implicit")
+	AssertEq(nil, err)
+
+	t.deleteAll("implicit/")
+
+	err = t.readDir(implicit)
+	AssertEq(fuse.ENOENT, err)
+
+	// Have another client put something back.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "implicit/e", "")
+	AssertEq(nil, err)
+
+	// Looking the directory up should find the same inode, which should work
+	// again.
+	id, err := t.lookUp(fuseops.RootInodeID, "implicit")
+	AssertEq(nil, err)
+	ExpectEq(implicit, id)
+	ExpectFalse(t.deletedRemotely(implicit))
+
+	err = t.readDir(implicit)
+	ExpectEq(nil, err)
+
+	_, err = t.lookUp(implicit, "e")
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Where an entry in a directory listing came from.
+type entrySource int
+
+const (
+	// An object or collapsed run in a listing of the bucket.
+	entrySourceListing entrySource = iota
+
+	// A child recently created through the directory inode. See
+	// inode.DirInode.RecentChanges.
+	entrySourceLocal
+)
+
+// An entry in a directory listing, annotated with where it came from.
+type childEntry struct {
+	fuseutil.Dirent
+	Source entrySource
+}
+
+// Entries for files and symlinks can't share a name, but either can share a
+// name with a directory.
+type childKey struct {
+	name string
+	dir  bool
+}
+
+func keyForDirent(e fuseutil.Dirent) childKey {
+	return childKey{e.Name, e.Type == fuseutil.DT_Directory}
+}
+
+// Entries sorted by name, with directories before files and symlinks of the
+// same name.
+type sortedChildEntries []childEntry
+
+func (p sortedChildEntries) Len() int      { return len(p) }
+func (p sortedChildEntries) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p sortedChildEntries) Less(i, j int) bool {
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+
+	return p[i].Type == fuseutil.DT_Directory &&
+		p[j].Type != fuseutil.DT_Directory
+}
+
+// Assemble the set of children of a directory from the entries returned by
+// one or more calls to inode.DirInode.ReadEntries and the directory's recent
+// changes, which the listing may not reflect. The rules, in order:
+//
+//  *  Duplicate entries in the listing (for example a collapsed run repeated
+//     on two pages) are collapsed into the first.
+//
+//  *  A local deletion hides a listed entry of the same name and kind
+//     (directory, or file/symlink).
+//
+//  *  A local creation replaces a listed entry of the same name and kind, or
+//     is added if there is none.
+//
+//  *  A file or symlink and a directory with the same name are both kept, and
+//     the former's name is given inode.ConflictingFileNameSuffix.
+//
+// The result is sorted by name, and does not depend on the order of the
+// input. Offset and Inode fields are left as zero.
+func assembleEntries(
+	listed []fuseutil.Dirent,
+	local []inode.LocalChild) (entries []childEntry, err error) {
+	byKey := make(map[childKey]childEntry)
+
+	// Start with the listing, ignoring duplicates.
+	for _, e := range listed {
+		k := keyForDirent(e)
+		if _, ok := byKey[k]; ok {
+			continue
+		}
+
+		e.Offset = 0
+		e.Inode = 0
+		byKey[k] = childEntry{Dirent: e, Source: entrySourceListing}
+	}
+
+	// Apply local changes.
+	for _, c := range local {
+		k := childKey{c.Name, c.Type == fuseutil.DT_Directory}
+		if c.Deleted {
+			delete(byKey, k)
+			continue
+		}
+
+		byKey[k] = childEntry{
+			Dirent: fuseutil.Dirent{Name: c.Name, Type: c.Type},
+			Source: entrySourceLocal,
+		}
+	}
+
+	// Sort the survivors.
+	for _, e := range byKey {
+		entries = append(entries, e)
+	}
+
+	sort.Sort(sortedChildEntries(entries))
+
+	// Resolve conflicts between files and directories. Renaming may have
+	// disturbed the order, so restore it.
+	dirents := make([]fuseutil.Dirent, len(entries))
+	for i, e := range entries {
+		dirents[i] = e.Dirent
+	}
+
+	err = fixConflictingNames(dirents)
+	if err != nil {
+		err = fmt.Errorf("fixConflictingNames: %v", err)
+		return
+	}
+
+	for i := range entries {
+		entries[i].Dirent = dirents[i]
+	}
+
+	sort.Sort(sortedChildEntries(entries))
+
+	return
+}
@@ -0,0 +1,641 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDirEntries(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// assembleEntries
+////////////////////////////////////////////////////////////////////////
+
+type DirEntriesTest struct {
+}
+
+func init() { RegisterTestSuite(&DirEntriesTest{}) }
+
+// Abbreviations for the table below.
+const (
+	dtFile = fuseutil.DT_File
+	dtLink = fuseutil.DT_Link
+	dtDir  = fuseutil.DT_Directory
+)
+
+func listed(name string, t fuseutil.DirentType) fuseutil.Dirent {
+	return fuseutil.Dirent{Name: name, Type: t}
+}
+
+func created(name string, t fuseutil.DirentType) inode.LocalChild {
+	return inode.LocalChild{Name: name, Type: t}
+}
+
+func deleted(name string, t fuseutil.DirentType) inode.LocalChild {
+	return inode.LocalChild{Name: name, Type: t, Deleted: true}
+}
+
+// Format entries as "name/type/source" for easy comparison.
+func formatChildEntries(entries []childEntry) (s []string) {
+	sources := map[entrySource]string{
+		entrySourceListing: "listing",
+		entrySourceLocal:   "local",
+	}
+
+	types := map[fuseutil.DirentType]string{
+		dtFile: "file",
+		dtLink: "link",
+		dtDir:  "dir",
+	}
+
+	for _, e := range entries {
+		s = append(
+			s,
+			fmt.Sprintf("%q/%s/%s", e.Name, types[e.Type], sources[e.Source]))
+	}
+
+	return
+}
+
+func (t *DirEntriesTest) PrecedenceMatrix() {
+	testCases := []struct {
+		listed   []fuseutil.Dirent
+		local    []inode.LocalChild
+		expected []string
+	}{
+		// Nothing at all.
+		{
+			expected: nil,
+		},
+
+		// Listing only, out of order.
+		{
+			listed: []fuseutil.Dirent{
+				listed("b", dtFile),
+				listed("c", dtDir),
+				listed("a", dtLink),
+			},
+			expected: []string{
+				`"a"/link/listing`,
+				`"b"/file/listing`,
+				`"c"/dir/listing`,
+			},
+		},
+
+		// Duplicates in the listing.
+		{
+			listed: []fuseutil.Dirent{
+				listed("a", dtDir),
+				listed("b", dtFile),
+				listed("a", dtDir),
+				listed("b", dtFile),
+			},
+			expected: []string{
+				`"a"/dir/listing`,
+				`"b"/file/listing`,
+			},
+		},
+
+		// Local creations missing from the listing.
+		{
+			listed: []fuseutil.Dirent{
+				listed("b", dtFile),
+			},
+			local: []inode.LocalChild{
+				created("a", dtFile),
+				created("c", dtDir),
+			},
+			expected: []string{
+				`"a"/file/local`,
+				`"b"/file/listing`,
+				`"c"/dir/local`,
+			},
+		},
+
+		// Local creations already in the listing.
+		{
+			listed: []fuseutil.Dirent{
+				listed("a", dtFile),
+				listed("b", dtDir),
+			},
+			local: []inode.LocalChild{
+				created("a", dtFile),
+				created("b", dtDir),
+			},
+			expected: []string{
+				`"a"/file/local`,
+				`"b"/dir/local`,
+			},
+		},
+
+		// A local creation replaces a listed child of the other non-directory
+		// type.
+		{
+			listed: []fuseutil.Dirent{
+				listed("a", dtFile),
+			},
+			local: []inode.LocalChild{
+				created("a", dtLink),
+			},
+			expected: []string{
+				`"a"/link/local`,
+			},
+		},
+
+		// Local deletions still in the listing.
+		{
+			listed: []fuseutil.Dirent{
+				listed("a", dtFile),
+				listed("b", dtLink),
+				listed("c", dtDir),
+				listed("d", dtFile),
+			},
+			local: []inode.LocalChild{
+				deleted("a", dtFile),
+				deleted("b", dtFile),
+				deleted("c", dtDir),
+			},
+			expected: []string{
+				`"d"/file/listing`,
+			},
+		},
+
+		// Local deletions already gone from the listing.
+		{
+			listed: []fuseutil.Dirent{
+				listed("b", dtFile),
+			},
+			local: []inode.LocalChild{
+				deleted("a", dtFile),
+				deleted("c", dtDir),
+			},
+			expected: []string{
+				`"b"/file/listing`,
+			},
+		},
+
+		// A deletion hides only the same kind of child.
+		{
+			listed: []fuseutil.Dirent{
+				listed("a", dtFile),
+				listed("a", dtDir),
+				listed("b", dtFile),
+				listed("b", dtDir),
+			},
+			local: []inode.LocalChild{
+				deleted("a", dtDir),
+				deleted("b", dtFile),
+			},
+			expected: []string{
+				`"a"/file/listing`,
+				`"b"/dir/listing`,
+			},
+		},
+
+		// Conflicts between files and directories from the listing.
+		{
+			listed: []fuseutil.Dirent{
+				listed("a", dtFile),
+				listed("a", dtDir),
+			},
+			expected: []string{
+				`"a"/dir/listing`,
+				`"a\n"/file/listing`,
+			},
+		},
+
+		// Conflicts between local and listed children.
+		{
+			listed: []fuseutil.Dirent{
+				listed("a", dtDir),
+				listed("b", dtLink),
+			},
+			local: []inode.LocalChild{
+				created("a", dtFile),
+				created("b", dtDir),
+			},
+			expected: []string{
+				`"a"/dir/listing`,
+				`"a\n"/file/local`,
+				`"b"/dir/local`,
+				`"b\n"/link/listing`,
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		entries, err := assembleEntries(tc.listed, tc.local)
+		AssertEq(nil, err, "Test case %d", i)
+		ExpectThat(
+			formatChildEntries(entries),
+			ElementsAre(toInterfaces(tc.expected)...),
+			"Test case %d", i)
+	}
+}
+
+func (t *DirEntriesTest) OrderIndependent() {
+	listedEntries := []fuseutil.Dirent{
+		listed("a", dtFile),
+		listed("a", dtDir),
+		listed("b", dtDir),
+		listed("c", dtLink),
+		listed("b", dtDir),
+	}
+
+	local := []inode.LocalChild{
+		created("d", dtFile),
+		deleted("c", dtFile),
+	}
+
+	expected, err := assembleEntries(listedEntries, local)
+	AssertEq(nil, err)
+
+	// Try every rotation of the listing.
+	for i := range listedEntries {
+		rotated := append(
+			append([]fuseutil.Dirent{}, listedEntries[i:]...),
+			listedEntries[:i]...)
+
+		entries, err := assembleEntries(rotated, local)
+		AssertEq(nil, err)
+		ExpectThat(
+			formatChildEntries(entries),
+			ElementsAre(toInterfaces(formatChildEntries(expected))...),
+			"Rotation %d", i)
+	}
+}
+
+func toInterfaces(s []string) (is []interface{}) {
+	for _, v := range s {
+		is = append(is, v)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Listings that lag behind
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose listings are stale: they omit objects named in hidden, show
+// objects named in ghosts as if they still existed, and repeat each collapsed
+// run, as may happen across the pages of a real listing. Stats of the ghosts
+// are stale too, as they may be when served from a cache.
+type staleListingBucket struct {
+	gcs.Bucket
+	hidden map[string]bool
+	ghosts []*gcs.Object
+}
+
+func (b *staleListingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	for _, g := range b.ghosts {
+		if g.Name == req.Name {
+			o = g
+			return
+		}
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *staleListingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	var objects []*gcs.Object
+	for _, o := range listing.Objects {
+		if !b.hidden[o.Name] {
+			objects = append(objects, o)
+		}
+	}
+
+	for _, o := range b.ghosts {
+		if strings.HasPrefix(o.Name, req.Prefix) {
+			objects = append(objects, o)
+		}
+	}
+
+	listing.Objects = objects
+	listing.CollapsedRuns = append(listing.CollapsedRuns, listing.CollapsedRuns...)
+
+	return
+}
+
+const staleListingTombstoneTTL = 10 * time.Second
+
+// Tests of reading directories whose listings lag behind changes made through
+// the file system.
+type StaleListingTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket staleListingBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&StaleListingTest{}) }
+
+func (t *StaleListingTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket.hidden = make(map[string]bool)
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket.Bucket,
+		map[string]string{
+			"foo":  "taco",
+			"dir/": "",
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		DirTypeCacheTTL:      time.Minute,
+		TombstoneTTL:         staleListingTombstoneTTL,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *StaleListingTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *StaleListingTest) root() (in inode.DirInode) {
+	t.fs.mu.Lock()
+	in = t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	return
+}
+
+// Look up a child of the root directory as the kernel would, returning
+// whether it exists.
+func (t *StaleListingTest) lookUp(name string) bool {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	err := t.fs.LookUpInode(op)
+	if err == fuse.ENOENT {
+		return false
+	}
+
+	AssertEq(nil, err)
+	t.fs.ForgetInode(&fuseops.ForgetInodeOp{Inode: op.Entry.Child, N: 1})
+	return true
+}
+
+// Make a ghost of the named object, so that listings and stats continue to
+// show this generation of it after it is deleted.
+func (t *StaleListingTest) haunt(name string) {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+	t.bucket.ghosts = append(t.bucket.ghosts, o)
+}
+
+// List the root directory as ReadDir would, returning names.
+func (t *StaleListingTest) readRoot() (names []string) {
+	in := t.root()
+	in.Lock()
+	entries, err := readAllEntries(t.ctx, in)
+	in.Unlock()
+
+	AssertEq(nil, err)
+	for i, e := range entries {
+		AssertEq(fuseops.DirOffset(i+1), e.Offset)
+		names = append(names, e.Name)
+	}
+
+	return
+}
+
+func (t *StaleListingTest) RepeatedCollapsedRuns() {
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+}
+
+func (t *StaleListingTest) CreatedFileNotYetListed() {
+	var err error
+
+	// Create a file through the file system. Pretend that the listing hasn't
+	// caught up yet.
+	t.bucket.hidden["bar"] = true
+
+	createOp := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "bar",
+		Mode:   0644,
+	}
+
+	err = t.fs.CreateFile(createOp)
+	AssertEq(nil, err)
+
+	// It should be listed anyway, exactly once.
+	ExpectThat(t.readRoot(), ElementsAre("bar", "dir", "foo"))
+
+	// The same goes once the listing does catch up, as it does after a sync.
+	delete(t.bucket.hidden, "bar")
+	ExpectThat(t.readRoot(), ElementsAre("bar", "dir", "foo"))
+}
+
+func (t *StaleListingTest) DeletedFileStillListed() {
+	var err error
+
+	// Delete a file through the file system, but have the listing continue to
+	// show it.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	t.bucket.ghosts = append(t.bucket.ghosts, o)
+
+	err = t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	})
+
+	AssertEq(nil, err)
+
+	// It shouldn't be listed.
+	ExpectThat(t.readRoot(), ElementsAre("dir"))
+
+	// Once the change is old enough, we trust the listing again.
+	t.clock.AdvanceTime(2 * time.Minute)
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+}
+
+func (t *StaleListingTest) DeleteInterleavedWithStaleListings() {
+	var err error
+
+	// Have listings and stats continue to show "foo" after it is deleted.
+	t.haunt("foo")
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+
+	err = t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	})
+
+	AssertEq(nil, err)
+
+	// However the listings and lookups are interleaved, the name shouldn't
+	// reappear while the tombstone lasts.
+	for i := 0; i < 9; i++ {
+		ExpectThat(t.readRoot(), ElementsAre("dir"))
+		ExpectFalse(t.lookUp("foo"))
+		t.clock.AdvanceTime(time.Second)
+	}
+
+	// Once it has expired, we trust GCS again.
+	t.clock.AdvanceTime(staleListingTombstoneTTL)
+	ExpectTrue(t.lookUp("foo"))
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+}
+
+func (t *StaleListingTest) RenamedFileStillListed() {
+	var err error
+
+	t.haunt("foo")
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "bar",
+	})
+
+	AssertEq(nil, err)
+
+	ExpectThat(t.readRoot(), ElementsAre("bar", "dir"))
+	ExpectFalse(t.lookUp("foo"))
+	ExpectTrue(t.lookUp("bar"))
+}
+
+func (t *StaleListingTest) DeletedDirStillStatted() {
+	var err error
+
+	t.haunt("dir/")
+	err = t.fs.RmDir(&fuseops.RmDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir",
+	})
+
+	AssertEq(nil, err)
+	ExpectFalse(t.lookUp("dir"))
+
+	t.clock.AdvanceTime(2 * staleListingTombstoneTTL)
+	ExpectTrue(t.lookUp("dir"))
+}
+
+func (t *StaleListingTest) LocalRecreationClearsTombstone() {
+	var err error
+
+	t.haunt("foo")
+	err = t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	})
+
+	AssertEq(nil, err)
+	AssertFalse(t.lookUp("foo"))
+
+	// Create the name again. Creating the object replaces any stale copy in a
+	// stat cache, but listings may still show the ghost.
+	t.bucket.ghosts = nil
+	t.bucket.hidden["foo"] = true
+
+	err = t.fs.CreateFile(&fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Mode:   0644,
+	})
+
+	AssertEq(nil, err)
+
+	ExpectTrue(t.lookUp("foo"))
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+}
+
+func (t *StaleListingTest) RemoteRecreationIsVisible() {
+	var err error
+
+	t.haunt("foo")
+	err = t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	})
+
+	AssertEq(nil, err)
+	AssertFalse(t.lookUp("foo"))
+
+	// Another client creates the name again. The new generation is newer than
+	// the deletion, so it isn't mistaken for the ghost.
+	t.bucket.ghosts = nil
+	t.clock.AdvanceTime(time.Second)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	ExpectTrue(t.lookUp("foo"))
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+	ExpectEq(0, len(t.root().RecentChanges()))
+}
+
+func (t *StaleListingTest) FresherListingConfirmsDeletion() {
+	var err error
+
+	err = t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(t.root().RecentChanges()))
+
+	// A listing made after the deletion that doesn't contain the name makes
+	// the tombstone unnecessary.
+	t.clock.AdvanceTime(time.Second)
+	ExpectThat(t.readRoot(), ElementsAre("dir"))
+	ExpectEq(0, len(t.root().RecentChanges()))
+}
@@ -16,9 +16,12 @@ package fs
 
 import (
 	"fmt"
+	"log"
 	"sort"
+	"syscall"
 
 	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/bazilfuse"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -26,6 +29,31 @@ import (
 	"golang.org/x/net/context"
 )
 
+// How directory handles behave given whether the bucket may be listed. See
+// ServerConfig.ListingDenied.
+type listingMode int
+
+const (
+	// Directories are listed by listing objects in the bucket.
+	listingAllowed listingMode = iota
+
+	// Each directory appears to contain a single entry named
+	// ListingDeniedEntryName, without consulting the bucket.
+	listingDeniedNotice
+
+	// Reading a directory fails with EACCES, without consulting the bucket.
+	listingDeniedEACCES
+)
+
+// The name of the single entry that each directory appears to contain when
+// ServerConfig.ListingDenied is set, unless ListingDeniedEACCES is too. The
+// entry can't be looked up; its name is the message.
+const ListingDeniedEntryName = "GCSFUSE_CANNOT_LIST_THIS_BUCKET"
+
+// The error returned for attempts to read directories in listingDeniedEACCES
+// mode.
+var errListingDenied = bazilfuse.Errno(syscall.EACCES)
+
 // State required for reading from directories.
 type dirHandle struct {
 	/////////////////////////
@@ -34,6 +62,12 @@ type dirHandle struct {
 
 	in           inode.DirInode
 	implicitDirs bool
+	listing      listingMode
+	maxPathDepth int
+	childCounts  *childCounts
+	listings     *dirListings
+	negatives    *negativeLookups
+	counters     *Counters
 
 	/////////////////////////
 	// Mutable state
@@ -41,12 +75,12 @@ type dirHandle struct {
 
 	Mu syncutil.InvariantMutex
 
-	// All entries in the directory. Populated the first time we need one.
-	//
-	// INVARIANT: For each i, entries[i+1].Offset == entries[i].Offset + 1
+	// A snapshot of all entries in the directory, taken in full by a read at
+	// offset zero and served from by reads at later offsets until the next
+	// read at offset zero. The entry at index i has offset i+1.
 	//
 	// GUARDED_BY(Mu)
-	entries []fuseutil.Dirent
+	entries []bufferedEntry
 
 	// Has entries yet been populated?
 	//
@@ -54,16 +88,36 @@ type dirHandle struct {
 	//
 	// GUARDED_BY(Mu)
 	entriesValid bool
+
+	// See handleLifecycle. Guarded by the file system's lock, not Mu.
+	lifecycle handleLifecycle
 }
 
-// Create a directory handle that obtains listings from the supplied inode.
+// Create a directory handle that obtains listings from the supplied inode,
+// unless the listing mode says not to. Entries deeper than maxPathDepth (see
+// ServerConfig.MaxPathDepth) are left out. The size of each complete listing
+// is reported to childCounts, which may be nil. Listings are shared with other
+// handles through listings, and the names in them erased from negatives; both
+// may also be nil.
 func newDirHandle(
 	in inode.DirInode,
-	implicitDirs bool) (dh *dirHandle) {
+	implicitDirs bool,
+	listing listingMode,
+	maxPathDepth int,
+	childCounts *childCounts,
+	listings *dirListings,
+	negatives *negativeLookups,
+	counters *Counters) (dh *dirHandle) {
 	// Set up the basic struct.
 	dh = &dirHandle{
 		in:           in,
 		implicitDirs: implicitDirs,
+		listing:      listing,
+		maxPathDepth: maxPathDepth,
+		childCounts:  childCounts,
+		listings:     listings,
+		negatives:    negatives,
+		counters:     counters,
 	}
 
 	// Set up invariant checking.
@@ -76,6 +130,14 @@ func newDirHandle(
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// A directory entry as buffered by a dirHandle. Only what can't be derived
+// from its position in the listing is kept, to limit the memory used for huge
+// directories.
+type bufferedEntry struct {
+	Name string
+	Type fuseutil.DirentType
+}
+
 // Dirents, sorted by name.
 type sortedDirents []fuseutil.Dirent
 
@@ -84,17 +146,6 @@ func (p sortedDirents) Less(i, j int) bool { return p[i].Name < p[j].Name }
 func (p sortedDirents) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 func (dh *dirHandle) checkInvariants() {
-	// INVARIANT: For each i, entries[i+1].Offset == entries[i].Offset + 1
-	for i := 0; i < len(dh.entries)-1; i++ {
-		if !(dh.entries[i+1].Offset == dh.entries[i].Offset+1) {
-			panic(
-				fmt.Sprintf(
-					"Unexpected offset sequence: %v, %v",
-					dh.entries[i].Offset,
-					dh.entries[i+1].Offset))
-		}
-	}
-
 	// INVARIANT: If !entriesValid, then len(entries) == 0
 	if !dh.entriesValid && len(dh.entries) != 0 {
 		panic("Unexpected non-empty entries slice")
@@ -154,14 +205,15 @@ func fixConflictingNames(entries []fuseutil.Dirent) (err error) {
 	return
 }
 
-// Read all entries for the directory, fix up conflicting names, and fill in
-// offset fields.
+// Read all entries for the directory, merge in its recent changes with
+// assembleEntries, and fill in offset fields.
 //
 // LOCKS_REQUIRED(in)
 func readAllEntries(
 	ctx context.Context,
 	in inode.DirInode) (entries []fuseutil.Dirent, err error) {
 	// Read one batch at a time.
+	var listed []fuseutil.Dirent
 	var tok string
 	for {
 		// Read a batch.
@@ -174,7 +226,7 @@ func readAllEntries(
 		}
 
 		// Accumulate.
-		entries = append(entries, batch...)
+		listed = append(listed, batch...)
 
 		// Are we done?
 		if tok == "" {
@@ -182,17 +234,17 @@ func readAllEntries(
 		}
 	}
 
-	// Ensure that the entries are sorted, for use in fixConflictingNames
-	// below.
-	sort.Sort(sortedDirents(entries))
-
-	// Fix name conflicts.
-	err = fixConflictingNames(entries)
+	// Merge with what we know locally.
+	children, err := assembleEntries(listed, in.RecentChanges())
 	if err != nil {
-		err = fmt.Errorf("fixConflictingNames: %v", err)
+		err = fmt.Errorf("assembleEntries: %v", err)
 		return
 	}
 
+	for _, c := range children {
+		entries = append(entries, c.Dirent)
+	}
+
 	// Fix up offset fields.
 	for i := 0; i < len(entries); i++ {
 		entries[i].Offset = fuseops.DirOffset(i) + 1
@@ -221,20 +273,83 @@ func readAllEntries(
 // LOCKS_REQUIRED(dh.Mu)
 // LOCKS_EXCLUDED(dh.in)
 func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
+	// Don't bother the bucket if we know that we're not allowed to list it.
+	switch dh.listing {
+	case listingDeniedEACCES:
+		err = errListingDenied
+		return
+
+	case listingDeniedNotice:
+		dh.entries = []bufferedEntry{
+			bufferedEntry{
+				Name: ListingDeniedEntryName,
+				Type: fuseutil.DT_File,
+			},
+		}
+
+		dh.entriesValid = true
+		return
+	}
+
 	dh.in.Lock()
 	defer dh.in.Unlock()
 
+	// Use a recent listing made for any handle, if there is one.
+	if entries, ok := dh.listings.Get(dh.in.Name()); ok {
+		dh.entries = entries
+		dh.entriesValid = true
+		return
+	}
+
+	epoch := dh.listings.Begin()
+
 	// Read entries.
-	var entries []fuseutil.Dirent
-	entries, err = readAllEntries(ctx, dh.in)
+	entries, err := readAllEntries(ctx, dh.in)
 	if err != nil {
 		err = fmt.Errorf("readAllEntries: %v", err)
 		return
 	}
 
-	// Update state.
-	dh.entries = entries
+	// Has listing shown that the directory no longer exists?
+	if dh.in.DeletedRemotely() {
+		err = fuse.ENOENT
+		return
+	}
+
+	// Correct the estimate of the number of children while we still hold the
+	// inode lock, so that no local creation can slip in between.
+	dh.childCounts.Listed(dh.in.Name(), len(entries))
+
+	// Names in the listing certainly exist.
+	if dh.negatives != nil {
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = dh.in.Name() + e.Name
+		}
+
+		dh.negatives.Erase(names...)
+	}
+
+	// Leave out what can't be looked up anyway.
+	entries, skipped := skipTooDeep(dh.in, dh.maxPathDepth, entries)
+	if skipped != 0 {
+		dh.counters.recordPathDepthEntriesSkipped(skipped)
+		log.Printf(
+			"Leaving %d entries of %q out of its listing, because they are deeper "+
+				"than the maximum path depth of %d.",
+			skipped,
+			dh.in.Name(),
+			dh.maxPathDepth)
+	}
+
+	// Update state, keeping just names and types.
+	dh.entries = make([]bufferedEntry, len(entries))
+	for i, e := range entries {
+		dh.entries[i] = bufferedEntry{Name: e.Name, Type: e.Type}
+	}
+
 	dh.entriesValid = true
+	dh.listings.Insert(dh.in.Name(), epoch, dh.entries)
 
 	return
 }
@@ -247,7 +362,9 @@ func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
 //
 // Special case: we assume that a zero offset indicates that rewinddir has been
 // called (since fuse gives us no way to intercept and know for sure), and
-// start the listing process over again.
+// start the listing process over again. Otherwise entries are served from the
+// snapshot taken then, so that changes to the directory part way through
+// can't cause entries to be repeated or skipped.
 //
 // LOCKS_REQUIRED(dh.Mu)
 // LOCKS_EXCLUDED(du.in)
@@ -276,9 +393,17 @@ func (dh *dirHandle) ReadDir(
 		return
 	}
 
-	// We copy out entries until we run out of entries or space.
+	// We copy out entries until we run out of entries or space. Each gets the
+	// same bogus inode ID; see readAllEntries.
 	for i := index; i < len(dh.entries); i++ {
-		op.Data = fuseutil.AppendDirent(op.Data, dh.entries[i])
+		e := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i) + 1,
+			Inode:  fuseops.RootInodeID + 1,
+			Name:   dh.entries[i].Name,
+			Type:   dh.entries[i].Type,
+		}
+
+		op.Data = fuseutil.AppendDirent(op.Data, e)
 		if len(op.Data) > op.Size {
 			op.Data = op.Data[:op.Size]
 			break
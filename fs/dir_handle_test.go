@@ -0,0 +1,271 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDirHandle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for reading directories a page at a time while they change. The
+// bucket starts out with files "a" through "f".
+type DirHandleTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+}
+
+// Enough room for two entries with one-character names.
+const dirHandleTestPageSize = 2 * 32
+
+func init() { RegisterTestSuite(&DirHandleTest{}) }
+
+func (t *DirHandleTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"a": "",
+			"b": "",
+			"c": "",
+			"d": "",
+			"e": "",
+			"f": "",
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *DirHandleTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Parse the entries wholly contained in data returned by ReadDir, in the
+// layout written by fuseutil.AppendDirent, returning their names and the
+// offset of the last.
+func parseDirents(data []byte) (names []string, last fuseops.DirOffset) {
+	const nameOffset = 8 + 8 + 4 + 4
+
+	for len(data) >= nameOffset {
+		off := binary.LittleEndian.Uint64(data[8:])
+		namelen := int(binary.LittleEndian.Uint32(data[16:]))
+
+		reclen := (nameOffset + namelen + 7) &^ 7
+		if reclen > len(data) {
+			break
+		}
+
+		names = append(names, string(data[nameOffset:nameOffset+namelen]))
+		last = fuseops.DirOffset(off)
+		data = data[reclen:]
+	}
+
+	return
+}
+
+func (t *DirHandleTest) openRoot() fuseops.HandleID {
+	op := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	AssertEq(nil, t.fs.OpenDir(op))
+	return op.Handle
+}
+
+// Read a page of the root directory, starting at the supplied offset.
+// Return the names read and the offset to continue from.
+func (t *DirHandleTest) readPage(
+	h fuseops.HandleID,
+	offset fuseops.DirOffset) (names []string, next fuseops.DirOffset) {
+	op := &fuseops.ReadDirOp{
+		Inode:  fuseops.RootInodeID,
+		Handle: h,
+		Offset: offset,
+		Size:   dirHandleTestPageSize,
+	}
+
+	AssertEq(nil, t.fs.ReadDir(op))
+
+	names, next = parseDirents(op.Data)
+	if len(names) == 0 {
+		next = offset
+	}
+
+	return
+}
+
+// Read the rest of the root directory a page at a time, starting at the
+// supplied offset, calling f between pages.
+func (t *DirHandleTest) readRest(
+	h fuseops.HandleID,
+	offset fuseops.DirOffset,
+	f func()) (names []string) {
+	for {
+		page, next := t.readPage(h, offset)
+		if len(page) == 0 {
+			return
+		}
+
+		names = append(names, page...)
+		offset = next
+		f()
+	}
+}
+
+func (t *DirHandleTest) deleteObject(name string) {
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirHandleTest) RemoteChangesBetweenPages() {
+	h := t.openRoot()
+
+	// Between each page, someone else adds a name that sorts into the part
+	// already read and deletes one from the part not yet read.
+	changes := []func(){
+		func() {
+			_, err := gcsutil.CreateObject(t.ctx, t.bucket, "a2", "")
+			AssertEq(nil, err)
+			t.deleteObject("e")
+		},
+		func() {
+			_, err := gcsutil.CreateObject(t.ctx, t.bucket, "c2", "")
+			AssertEq(nil, err)
+			t.deleteObject("f")
+		},
+	}
+
+	names := t.readRest(h, 0, func() {
+		if len(changes) > 0 {
+			changes[0]()
+			changes = changes[1:]
+		}
+	})
+
+	// What was there when we started, with nothing repeated or skipped.
+	ExpectThat(names, ElementsAre("a", "b", "c", "d", "e", "f"))
+}
+
+func (t *DirHandleTest) LocalChangesBetweenPages() {
+	h := t.openRoot()
+
+	page, next := t.readPage(h, 0)
+	AssertThat(page, ElementsAre("a", "b"))
+
+	// Create and unlink through the file system.
+	createOp := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "b2",
+		Mode:   0600,
+	}
+
+	AssertEq(nil, t.fs.CreateFile(createOp))
+
+	err := t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "d",
+	})
+
+	AssertEq(nil, err)
+
+	names := t.readRest(h, next, func() {})
+	ExpectThat(names, ElementsAre("c", "d", "e", "f"))
+}
+
+func (t *DirHandleTest) RewindTakesNewSnapshot() {
+	h := t.openRoot()
+
+	page, next := t.readPage(h, 0)
+	AssertThat(page, ElementsAre("a", "b"))
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "b2", "")
+	AssertEq(nil, err)
+	t.deleteObject("d")
+
+	// Carrying on sees the old snapshot.
+	page, _ = t.readPage(h, next)
+	ExpectThat(page, ElementsAre("c", "d"))
+
+	// Starting again from zero sees the changes.
+	names := t.readRest(h, 0, func() {})
+	ExpectThat(names, ElementsAre("a", "b", "b2", "c", "e", "f"))
+}
+
+func (t *DirHandleTest) SeekWithinSnapshot() {
+	h := t.openRoot()
+
+	_, next := t.readPage(h, 0)
+	t.deleteObject("a")
+
+	// Going back to an earlier non-zero offset reads from the same snapshot.
+	page, _ := t.readPage(h, next-1)
+	ExpectThat(page, ElementsAre("b", "c"))
+}
+
+func (t *DirHandleTest) ReleaseDropsSnapshot() {
+	h := t.openRoot()
+	t.readPage(h, 0)
+
+	t.fs.mu.Lock()
+	dh := t.fs.handles[h].(*dirHandle)
+	t.fs.mu.Unlock()
+
+	err := t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: h})
+	AssertEq(nil, err)
+
+	dh.Mu.Lock()
+	ExpectEq(0, len(dh.entries))
+	dh.Mu.Unlock()
+
+	t.fs.mu.Lock()
+	_, ok := t.fs.handles[h]
+	t.fs.mu.Unlock()
+
+	ExpectFalse(ok)
+}
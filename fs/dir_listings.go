@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// Complete listings of directories, shared by all handles that read them and
+// kept for ServerConfig.DirCacheTTL, so that reading a directory again soon
+// doesn't list it again.
+//
+// Each local change to a directory's children (creation, deletion, or rename
+// in or out) drops its listing, so that the file system never fails to show
+// its own changes, as does a notification of a change by another client (see
+// fileSystem.applyNotification). Other changes by other clients go unseen
+// until the listing expires.
+//
+// A listing is only stored if nothing was dropped while it was being made,
+// since it may predate the change. This is cruder than tracking each
+// directory, but needs no locks to be held and remembers nothing about
+// directories that have no listing.
+//
+// A nil *dirListings stores nothing, and is used when the TTL is zero. Safe for
+// concurrent access.
+type dirListings struct {
+	clock    timeutil.Clock
+	ttl      time.Duration
+	counters *Counters
+
+	mu sync.Mutex
+
+	// Listings, keyed by directory object name ("" for the root). Entries are
+	// sorted by name, and never modified once stored.
+	//
+	// GUARDED_BY(mu)
+	listings map[string]dirListing
+
+	// Incremented each time a listing is dropped.
+	//
+	// GUARDED_BY(mu)
+	epoch uint64
+}
+
+type dirListing struct {
+	entries    []bufferedEntry
+	expiration time.Time
+}
+
+func newDirListings(
+	clock timeutil.Clock,
+	ttl time.Duration,
+	counters *Counters) (dl *dirListings) {
+	dl = &dirListings{
+		clock:    clock,
+		ttl:      ttl,
+		counters: counters,
+		listings: make(map[string]dirListing),
+	}
+
+	return
+}
+
+// Return a token to pass to Insert with a listing made after this call.
+func (dl *dirListings) Begin() (epoch uint64) {
+	if dl == nil {
+		return
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	epoch = dl.epoch
+	return
+}
+
+// Store a complete listing of the named directory, sorted by name, unless a
+// listing has been dropped since the call to Begin that returned epoch. The
+// caller must not modify entries afterward.
+func (dl *dirListings) Insert(
+	dir string,
+	epoch uint64,
+	entries []bufferedEntry) {
+	if dl == nil {
+		return
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if epoch != dl.epoch {
+		return
+	}
+
+	// Take the opportunity to forget expired listings.
+	now := dl.clock.Now()
+	for name, l := range dl.listings {
+		if !now.Before(l.expiration) {
+			delete(dl.listings, name)
+		}
+	}
+
+	dl.listings[dir] = dirListing{
+		entries:    entries,
+		expiration: now.Add(dl.ttl),
+	}
+}
+
+// Return the unexpired listing of the named directory, if any. The caller must
+// not modify the result.
+func (dl *dirListings) Get(dir string) (entries []bufferedEntry, ok bool) {
+	if dl == nil {
+		return
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	l, ok := dl.listings[dir]
+	if !ok {
+		return
+	}
+
+	if !dl.clock.Now().Before(l.expiration) {
+		delete(dl.listings, dir)
+		ok = false
+		return
+	}
+
+	dl.counters.recordDirCacheHit()
+	entries = l.entries
+	return
+}
+
+// Does the unexpired listing of the named directory, if any, show that it has
+// no child with the given name?
+func (dl *dirListings) Missing(dir string, name string) (missing bool) {
+	entries, ok := dl.Get(dir)
+	if !ok {
+		return
+	}
+
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Name >= name
+	})
+
+	missing = i == len(entries) || entries[i].Name != name
+	if missing {
+		dl.counters.recordDirCacheNegativeLookup()
+	}
+
+	return
+}
+
+// Drop the listings of the named directories, which have changed.
+func (dl *dirListings) Invalidate(dirs ...string) {
+	if dl == nil {
+		return
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	dl.epoch++
+	for _, dir := range dirs {
+		delete(dl.listings, dir)
+	}
+}
+
+// Drop the listings of the named directories and of every directory beneath
+// them, all of which have changed.
+func (dl *dirListings) InvalidateTrees(dirs ...string) {
+	if dl == nil {
+		return
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	dl.epoch++
+	for name := range dl.listings {
+		for _, dir := range dirs {
+			if strings.HasPrefix(name, dir) {
+				delete(dl.listings, name)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDirListings(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the listings made through it.
+type countingListsBucket struct {
+	gcs.Bucket
+
+	// The number of calls to ListObjects. Accessed atomically.
+	listCalls uint64
+}
+
+func (b *countingListsBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	atomic.AddUint64(&b.listCalls, 1)
+	listing, err = b.Bucket.ListObjects(ctx, req)
+	return
+}
+
+// Tests for ServerConfig.DirCacheTTL, with a TTL of dirListingsTestTTL unless
+// a test says otherwise. The bucket starts out with files "foo" and "dir/bar".
+type DirListingsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket countingListsBucket
+	fs     *fileSystem
+}
+
+const dirListingsTestTTL = time.Minute
+
+func init() { RegisterTestSuite(&DirListingsTest{}) }
+
+func (t *DirListingsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket.Bucket,
+		map[string]string{
+			"foo":     "",
+			"dir/":    "",
+			"dir/bar": "",
+		})
+
+	AssertEq(nil, err)
+
+	t.mount(dirListingsTestTTL)
+}
+
+func (t *DirListingsTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Create the file system afresh, with the supplied TTL.
+func (t *DirListingsTest) mount(ttl time.Duration) {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		DirCacheTTL:          ttl,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *DirListingsTest) listCalls() uint64 {
+	return atomic.LoadUint64(&t.bucket.listCalls)
+}
+
+// Look up the named child of the supplied directory.
+func (t *DirListingsTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (id fuseops.InodeID, err error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent: parent,
+		Name:   name,
+	}
+
+	err = t.fs.LookUpInode(op)
+	id = op.Entry.Child
+	return
+}
+
+// Read the whole of the supplied directory through a new handle, returning
+// the names in it.
+func (t *DirListingsTest) readDir(id fuseops.InodeID) (names []string) {
+	openOp := &fuseops.OpenDirOp{Inode: id}
+	AssertEq(nil, t.fs.OpenDir(openOp))
+
+	defer func() {
+		err := t.fs.ReleaseDirHandle(
+			&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+		AssertEq(nil, err)
+	}()
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Size:   1 << 16,
+	}
+
+	AssertEq(nil, t.fs.ReadDir(readOp))
+
+	names, _ = parseDirents(readOp.Data)
+	return
+}
+
+func (t *DirListingsTest) readRoot() []string {
+	return t.readDir(fuseops.RootInodeID)
+}
+
+func (t *DirListingsTest) createRemotely(name string) {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, name, "")
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirListingsTest) ListingShared() {
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+	n := t.listCalls()
+
+	// Reading again through another handle shouldn't list again, and so
+	// shouldn't see the remote change.
+	t.createRemotely("baz")
+	ExpectThat(t.readRoot(), ElementsAre("dir", "foo"))
+	ExpectEq(n, t.listCalls())
+}
+
+func (t *DirListingsTest) ListingExpires() {
+	t.readRoot()
+	n := t.listCalls()
+
+	t.createRemotely("baz")
+	t.clock.AdvanceTime(dirListingsTestTTL)
+
+	ExpectThat(t.readRoot(), ElementsAre("baz", "dir", "foo"))
+	ExpectLt(n, t.listCalls())
+}
+
+func (t *DirListingsTest) Disabled() {
+	t.mount(0)
+
+	t.readRoot()
+	n := t.listCalls()
+
+	t.createRemotely("baz")
+	ExpectThat(t.readRoot(), ElementsAre("baz", "dir", "foo"))
+	ExpectLt(n, t.listCalls())
+
+	// Lookups aren't answered from listings either.
+	t.createRemotely("qux")
+	_, err := t.lookUp(fuseops.RootInodeID, "qux")
+	ExpectEq(nil, err)
+}
+
+func (t *DirListingsTest) NegativeLookups() {
+	t.readRoot()
+	t.createRemotely("baz")
+
+	// The listing says the name doesn't exist.
+	_, err := t.lookUp(fuseops.RootInodeID, "baz")
+	ExpectEq(fuse.ENOENT, err)
+
+	// Names in the listing are still looked up.
+	_, err = t.lookUp(fuseops.RootInodeID, "foo")
+	ExpectEq(nil, err)
+
+	// Until it expires.
+	t.clock.AdvanceTime(dirListingsTestTTL)
+
+	_, err = t.lookUp(fuseops.RootInodeID, "baz")
+	ExpectEq(nil, err)
+}
+
+func (t *DirListingsTest) ListingsArePerDirectory() {
+	dirID, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	ExpectThat(t.readDir(dirID), ElementsAre("bar"))
+
+	// The listing of dir says nothing about the root.
+	t.createRemotely("baz")
+
+	_, err = t.lookUp(fuseops.RootInodeID, "baz")
+	ExpectEq(nil, err)
+}
+
+func (t *DirListingsTest) LocalCreations() {
+	t.readRoot()
+
+	createOp := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "file",
+		Mode:   0600,
+	}
+
+	AssertEq(nil, t.fs.CreateFile(createOp))
+
+	err := t.fs.MkDir(&fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "subdir",
+		Mode:   0700,
+	})
+
+	AssertEq(nil, err)
+
+	err = t.fs.CreateSymlink(&fuseops.CreateSymlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "link",
+		Target: "foo",
+	})
+
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.readRoot(),
+		ElementsAre("dir", "file", "foo", "link", "subdir"))
+
+	for _, name := range []string{"file", "subdir", "link"} {
+		_, err = t.lookUp(fuseops.RootInodeID, name)
+		ExpectEq(nil, err, "name: %s", name)
+	}
+}
+
+func (t *DirListingsTest) LocalDeletions() {
+	err := t.fs.MkDir(&fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "empty",
+		Mode:   0700,
+	})
+
+	AssertEq(nil, err)
+	AssertThat(t.readRoot(), ElementsAre("dir", "empty", "foo"))
+
+	err = t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	})
+
+	AssertEq(nil, err)
+	ExpectThat(t.readRoot(), ElementsAre("dir", "empty"))
+
+	err = t.fs.RmDir(&fuseops.RmDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "empty",
+	})
+
+	AssertEq(nil, err)
+
+	ExpectThat(t.readRoot(), ElementsAre("dir"))
+}
+
+func (t *DirListingsTest) LocalRename() {
+	dirID, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	AssertThat(t.readRoot(), ElementsAre("dir", "foo"))
+	AssertThat(t.readDir(dirID), ElementsAre("bar"))
+
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo",
+		NewParent: dirID,
+		NewName:   "baz",
+	})
+
+	AssertEq(nil, err)
+
+	ExpectThat(t.readRoot(), ElementsAre("dir"))
+	ExpectThat(t.readDir(dirID), ElementsAre("bar", "baz"))
+
+	_, err = t.lookUp(dirID, "baz")
+	ExpectEq(nil, err)
+}
+
+func (t *DirListingsTest) DirectoryRenameDropsNestedListings() {
+	t.fs.renameDirLimit = 5
+	t.createRemotely("dir/sub/")
+	t.createRemotely("dir/sub/qux")
+
+	dirID, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	subID, err := t.lookUp(dirID, "sub")
+	AssertEq(nil, err)
+
+	AssertThat(t.readDir(subID), ElementsAre("qux"))
+
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "dir",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "moved",
+	})
+
+	AssertEq(nil, err)
+
+	// Recreating the subdirectory where it was shouldn't bring back its
+	// listing.
+	err = t.fs.MkDir(&fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir",
+		Mode:   0700,
+	})
+
+	AssertEq(nil, err)
+
+	dirID, err = t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	err = t.fs.MkDir(&fuseops.MkDirOp{
+		Parent: dirID,
+		Name:   "sub",
+		Mode:   0700,
+	})
+
+	AssertEq(nil, err)
+
+	subID, err = t.lookUp(dirID, "sub")
+	AssertEq(nil, err)
+
+	ExpectThat(t.readDir(subID), ElementsAre())
+}
+
+func (t *DirListingsTest) ChangeDuringListingNotStored() {
+	dl := newDirListings(&t.clock, dirListingsTestTTL, new(Counters))
+
+	// A listing that may predate a change isn't kept.
+	epoch := dl.Begin()
+	dl.Invalidate("dir/")
+	dl.Insert("", epoch, []bufferedEntry{{Name: "foo"}})
+
+	_, ok := dl.Get("")
+	ExpectFalse(ok)
+
+	// But one made afterward is.
+	epoch = dl.Begin()
+	dl.Insert("", epoch, []bufferedEntry{{Name: "foo"}})
+
+	_, ok = dl.Get("")
+	ExpectTrue(ok)
+	ExpectTrue(dl.Missing("", "bar"))
+	ExpectFalse(dl.Missing("", "foo"))
+
+	// Listings of other directories are unaffected by invalidation.
+	dl.Invalidate("dir/")
+
+	_, ok = dl.Get("")
+	ExpectTrue(ok)
+}
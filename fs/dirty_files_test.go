@@ -0,0 +1,408 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDirtyFiles(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose first object creation after a call to gate blocks until
+// released.
+type gatedWritesBucket struct {
+	gcs.Bucket
+
+	mu      sync.Mutex
+	started chan struct{} // GUARDED_BY(mu)
+	release chan struct{} // GUARDED_BY(mu)
+}
+
+// Return channels closed when the next object creation starts, and to be
+// closed to let it proceed.
+func (b *gatedWritesBucket) gate() (started, release chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.started = make(chan struct{})
+	b.release = make(chan struct{})
+	return b.started, b.release
+}
+
+func (b *gatedWritesBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	started, release := b.started, b.release
+	b.started = nil
+	b.release = nil
+	b.mu.Unlock()
+
+	if started != nil {
+		close(started)
+		<-release
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+// A simulated clock whose After channels fire once AdvanceTime takes it to
+// their deadlines. Each call to After is announced on waits, so that tests can
+// tell when background work has finished a pass and is waiting for the next.
+type simulatedTimerClock struct {
+	timeutil.SimulatedClock
+	waits chan time.Duration
+
+	mu     sync.Mutex
+	timers []simulatedTimer // GUARDED_BY(mu)
+}
+
+type simulatedTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newSimulatedTimerClock(t time.Time) (c *simulatedTimerClock) {
+	c = &simulatedTimerClock{waits: make(chan time.Duration, 16)}
+	c.SetTime(t)
+	return
+}
+
+func (c *simulatedTimerClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := simulatedTimer{
+		deadline: c.Now().Add(d),
+		c:        make(chan time.Time, 1),
+	}
+
+	c.timers = append(c.timers, timer)
+	c.waits <- d
+	return timer.c
+}
+
+// Wait for the next call to After, returning its argument.
+func (c *simulatedTimerClock) awaitWait() (d time.Duration) {
+	select {
+	case d = <-c.waits:
+	case <-time.After(5 * time.Second):
+		AddFailure("Background work never waited on the clock.")
+		AbortTest()
+	}
+
+	return
+}
+
+func (c *simulatedTimerClock) AdvanceTime(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.SimulatedClock.AdvanceTime(d)
+	now := c.Now()
+
+	var pending []simulatedTimer
+	for _, timer := range c.timers {
+		if now.Before(timer.deadline) {
+			pending = append(pending, timer)
+			continue
+		}
+
+		timer.c <- now
+	}
+
+	c.timers = pending
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for rescuing files whose modifications were never flushed, as after
+// the kernel connection dies.
+type DirtyFilesTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket *gatedWritesBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&DirtyFilesTest{}) }
+
+func (t *DirtyFilesTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = &gatedWritesBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+	}
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"foo": "taco",
+			"bar": "burrito",
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *DirtyFilesTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up, open, and write to a child of the root, without flushing.
+func (t *DirtyFilesTest) write(name string, data string) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	openOp := &fuseops.OpenFileOp{Inode: child.ID()}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	err = t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  child.ID(),
+		Handle: openOp.Handle,
+		Data:   []byte(data),
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *DirtyFilesTest) read(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirtyFilesTest) NothingDirty() {
+	n, err := t.fs.syncDirtyFiles(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+}
+
+func (t *DirtyFilesTest) WritesBackOnlyDirtyFiles() {
+	t.write("foo", "enchilada")
+
+	// Look up bar without modifying it.
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	bar, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "bar")
+	AssertEq(nil, err)
+	bar.Unlock()
+
+	AssertEq("taco", t.read("foo"))
+
+	n, err := t.fs.syncDirtyFiles(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, n)
+
+	ExpectEq("enchilada", t.read("foo"))
+	ExpectEq("burrito", t.read("bar"))
+
+	// Now there's nothing left to do.
+	n, err = t.fs.syncDirtyFiles(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+}
+
+func (t *DirtyFilesTest) SyncsOnlyFilesDirtiedBeforeCutoff() {
+	t.write("foo", "enchilada")
+	t.clock.AdvanceTime(time.Minute)
+	cutoff := t.clock.Now()
+
+	t.clock.AdvanceTime(time.Second)
+	t.write("bar", "queso")
+
+	n, err := t.fs.syncFilesDirtiedBefore(t.ctx, cutoff)
+	AssertEq(nil, err)
+	ExpectEq(1, n)
+
+	ExpectEq("enchilada", t.read("foo"))
+	ExpectEq("burrito", t.read("bar"))
+
+	// bar is still dirty, and is picked up once the cutoff passes it.
+	n, err = t.fs.syncFilesDirtiedBefore(t.ctx, t.clock.Now())
+	AssertEq(nil, err)
+	ExpectEq(1, n)
+
+	ExpectEq("enchilada", t.read("foo"))
+	ExpectEq("quesoto", t.read("bar"))
+}
+
+func (t *DirtyFilesTest) WritesAfterSyncDirtyNewGeneration() {
+	t.write("foo", "enchilada")
+
+	n, err := t.fs.syncFilesDirtiedBefore(t.ctx, t.clock.Now())
+	AssertEq(nil, err)
+	AssertEq(1, n)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	// The inode now reflects the generation that was written.
+	t.fs.mu.Lock()
+	f := t.fs.generationBackedInodes["foo"].(*inode.FileInode)
+	t.fs.mu.Unlock()
+
+	f.Lock()
+	ExpectEq(o.Generation, f.SourceGeneration())
+	f.Unlock()
+
+	// A later write dirties the new generation and isn't lost.
+	t.write("foo", "taco")
+
+	n, err = t.fs.syncDirtyFiles(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, n)
+
+	ExpectEq("tacoilada", t.read("foo"))
+}
+
+func (t *DirtyFilesTest) FileUsableDuringWriteBack() {
+	t.write("foo", "enchilada")
+
+	started, release := t.bucket.gate()
+	done := make(chan error)
+	go func() {
+		_, err := t.fs.syncDirtyFiles(t.ctx)
+		done <- err
+	}()
+
+	// While the upload is in flight, the file can still be looked up and
+	// written.
+	<-started
+	t.write("foo", "T")
+
+	close(release)
+	AssertEq(nil, <-done)
+	ExpectEq("enchilada", t.read("foo"))
+
+	// The write made in the meantime is carried over, and written out next
+	// time.
+	n, err := t.fs.syncDirtyFiles(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, n)
+
+	ExpectEq("Tnchilada", t.read("foo"))
+}
+
+func (t *DirtyFilesTest) ClobberedFilesSkipped() {
+	t.write("foo", "enchilada")
+
+	// Overwrite the object remotely, and have a lookup notice.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "queso")
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	// The old inode isn't written out, which could only fail.
+	started, release := t.bucket.gate()
+	close(release)
+
+	n, err := t.fs.syncDirtyFiles(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+
+	select {
+	case <-started:
+		AddFailure("Unexpected upload")
+	default:
+	}
+
+	ExpectEq("queso", t.read("foo"))
+}
+
+func (t *DirtyFilesTest) SyncedPeriodically() {
+	var err error
+
+	// Recreate the file system with background syncing, timed by a clock that
+	// we control.
+	clock := newSimulatedTimerClock(t.clock.Now())
+	t.fs.Destroy()
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+		DirtySyncInterval:    time.Minute,
+	})
+
+	AssertEq(nil, err)
+
+	// Passes come every half interval.
+	ExpectEq(30*time.Second, clock.awaitWait())
+
+	// A pass before the file has gone unmodified for the interval leaves it
+	// alone.
+	t.write("foo", "enchilada")
+	clock.AdvanceTime(30 * time.Second)
+	clock.awaitWait()
+	ExpectEq("taco", t.read("foo"))
+
+	// The next one writes it out.
+	clock.AdvanceTime(30 * time.Second)
+	clock.awaitWait()
+	ExpectEq("enchilada", t.read("foo"))
+}
@@ -0,0 +1,326 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestEncryption(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+const encryptionTestKey = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+// A bucket that reports the objects named in csek as encrypted with
+// customer-supplied keys, records the Cloud KMS keys that writes ask for, and
+// ignores them while ignoreKeys is set, as a bucket that can't honor them
+// would.
+type encryptionBucket struct {
+	gcs.Bucket
+	csek map[string]bool
+
+	mu         sync.Mutex
+	ignoreKeys bool
+	keys       []string
+}
+
+func (b *encryptionBucket) note(key *string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.keys = append(b.keys, *key)
+	if b.ignoreKeys {
+		*key = ""
+	}
+}
+
+func (b *encryptionBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	reqCopy := *req
+	b.note(&reqCopy.KmsKeyName)
+	o, err = b.Bucket.CreateObject(ctx, &reqCopy)
+	return
+}
+
+func (b *encryptionBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	reqCopy := *req
+	b.note(&reqCopy.KmsKeyName)
+	o, err = b.Bucket.ComposeObjects(ctx, &reqCopy)
+	return
+}
+
+func (b *encryptionBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	reqCopy := *req
+	b.note(&reqCopy.DstKmsKeyName)
+	o, err = b.Bucket.CopyObject(ctx, &reqCopy)
+	return
+}
+
+func (b *encryptionBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if err == nil && b.csek[o.Name] {
+		o.CustomerEncryption = &gcs.CustomerEncryption{
+			EncryptionAlgorithm: "AES256",
+			KeySHA256:           "H4rBDyPFtbwRZ72oS4M+XAV6d9J1cBzDk9WnQhIvMWI=",
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The bucket starts out with "kms", encrypted with encryptionTestKey, and
+// "csek", encrypted with a customer-supplied key. Both contain "taco".
+type EncryptionTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket *encryptionBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&EncryptionTest{}) }
+
+func (t *EncryptionTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = &encryptionBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+		csek:   map[string]bool{"csek": true},
+	}
+
+	_, err = t.bucket.Bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:       "kms",
+			Contents:   strings.NewReader("taco"),
+			KmsKeyName: encryptionTestKey,
+		})
+
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "csek", "taco")
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		AppendThreshold:      1,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *EncryptionTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up a child of the root.
+func (t *EncryptionTest) lookUp(name string) (id fuseops.InodeID) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	id = child.ID()
+	return
+}
+
+// Open the file with the given ID, write s at the given offset through the
+// resulting handle, and flush it, returning the result of the flush.
+func (t *EncryptionTest) writeAndFlush(
+	id fuseops.InodeID,
+	flags bazilfuse.OpenFlags,
+	offset int64,
+	s string) (err error) {
+	openOp := &fuseops.OpenFileOp{Inode: id, Flags: flags}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	writeOp := &fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Offset: offset,
+		Data:   []byte(s),
+	}
+
+	AssertEq(nil, t.fs.WriteFile(writeOp))
+
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: openOp.Handle})
+	return
+}
+
+// Return the current record for the named object.
+func (t *EncryptionTest) stat(name string) *gcs.Object {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+	return o
+}
+
+func (t *EncryptionTest) getXattr(
+	id fuseops.InodeID,
+	name string) (value string, err error) {
+	op := &fuseops.GetXattrOp{Inode: id, Name: name}
+	err = t.fs.GetXattr(op)
+	value = string(op.Value)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *EncryptionTest) Xattrs() {
+	id := t.lookUp("kms")
+	value, err := t.getXattr(id, "user.gcs.kms_key_name")
+	AssertEq(nil, err)
+	ExpectEq(encryptionTestKey+"/cryptoKeyVersions/1", value)
+
+	_, err = t.getXattr(id, "user.gcs.customer_encryption")
+	ExpectEq(fuse.ENOATTR, err)
+
+	id = t.lookUp("csek")
+	value, err = t.getXattr(id, "user.gcs.customer_encryption")
+	AssertEq(nil, err)
+	ExpectEq(
+		"algorithm=AES256 key_sha256=H4rBDyPFtbwRZ72oS4M+XAV6d9J1cBzDk9WnQhIvMWI=",
+		value)
+}
+
+func (t *EncryptionTest) KmsKeyKeptOnRewrite() {
+	id := t.lookUp("kms")
+	AssertEq(nil, t.writeAndFlush(id, bazilfuse.OpenReadWrite, 0, "burrito"))
+
+	ExpectThat(t.bucket.keys, ElementsAre(encryptionTestKey))
+	ExpectEq(encryptionTestKey+"/cryptoKeyVersions/1", t.stat("kms").KmsKeyName)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "kms")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *EncryptionTest) KmsKeyKeptOnAppend() {
+	id := t.lookUp("kms")
+	AssertEq(nil, t.writeAndFlush(id, bazilfuse.OpenReadWrite, 4, "burrito"))
+
+	// Both the temporary object and the composed one ask for the key.
+	ExpectThat(t.bucket.keys, ElementsAre(encryptionTestKey, encryptionTestKey))
+	ExpectEq(encryptionTestKey+"/cryptoKeyVersions/1", t.stat("kms").KmsKeyName)
+}
+
+func (t *EncryptionTest) KmsKeyNotHonored() {
+	t.bucket.ignoreKeys = true
+
+	id := t.lookUp("kms")
+	err := t.writeAndFlush(id, bazilfuse.OpenReadWrite, 0, "burrito")
+	ExpectEq(errEncrypted, err)
+
+	// The new generation was written all the same, and the inode presents it.
+	o := t.stat("kms")
+	ExpectEq("", o.KmsKeyName)
+
+	t.fs.mu.Lock()
+	in := t.fs.inodes[id].(*inode.FileInode)
+	t.fs.mu.Unlock()
+
+	in.Lock()
+	ExpectEq(o.Generation, in.SourceGeneration())
+	in.Unlock()
+}
+
+func (t *EncryptionTest) KmsKeyKeptOnRename() {
+	t.lookUp("kms")
+	err := t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "kms",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "renamed",
+	})
+
+	AssertEq(nil, err)
+
+	ExpectThat(t.bucket.keys, ElementsAre(encryptionTestKey))
+	ExpectEq(
+		encryptionTestKey+"/cryptoKeyVersions/1",
+		t.stat("renamed").KmsKeyName)
+}
+
+func (t *EncryptionTest) CustomerEncrypted_OpenForWriteRefused() {
+	id := t.lookUp("csek")
+
+	for _, flags := range []bazilfuse.OpenFlags{
+		bazilfuse.OpenWriteOnly,
+		bazilfuse.OpenReadWrite,
+		bazilfuse.OpenReadOnly | bazilfuse.OpenTruncate,
+	} {
+		err := t.fs.OpenFile(&fuseops.OpenFileOp{Inode: id, Flags: flags})
+		ExpectEq(errEncrypted, err, "flags: %v", flags)
+	}
+
+	// Reading is fine.
+	err := t.fs.OpenFile(
+		&fuseops.OpenFileOp{Inode: id, Flags: bazilfuse.OpenReadOnly})
+
+	ExpectEq(nil, err)
+}
+
+func (t *EncryptionTest) CustomerEncrypted_SyncRefused() {
+	// Modify the file through a handle opened for reading, as the kernel could
+	// by way of a handle it shares.
+	id := t.lookUp("csek")
+	err := t.writeAndFlush(id, bazilfuse.OpenReadOnly, 0, "burrito")
+	ExpectEq(errEncrypted, err)
+
+	// Nothing was written.
+	ExpectThat(t.bucket.keys, ElementsAre())
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "csek")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
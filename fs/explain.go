@@ -0,0 +1,108 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+)
+
+// Describe, one line per entry, how a file system with the supplied config
+// would treat the file at the given path relative to its root, or the
+// directory if the path ends with a slash: the object backing it, whether it
+// would be visible and writable, the defaults it would be created with, and so
+// on. Nothing is read from the bucket, so the description is of an object
+// with that name as if it existed.
+//
+// The config must have been checked with ValidateServerConfig.
+func ExplainPath(cfg *ServerConfig, p string) (lines []string, err error) {
+	add := func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	}
+
+	// Find the name of the object, relative to OnlyDir.
+	name := strings.TrimPrefix(p, "/")
+	isDir := name == "" || strings.HasSuffix(name, "/")
+	if name != "" && !isCleanDirName(strings.TrimSuffix(name, "/")+"/") {
+		err = fmt.Errorf("Illegal path: %q", p)
+		return
+	}
+
+	fullName := onlyDirPrefix(cfg.OnlyDir) + name
+	add("object: %q", fullName)
+
+	// Visibility.
+	tmp := cfg.TmpObjectPrefix
+	switch {
+	case tmp != "" && strings.HasPrefix(name, tmp):
+		add("visible: no (temporary objects under %q aren't listed)", tmp)
+
+	case cfg.MaxPathDepth > 0 && pathDepth(name) > cfg.MaxPathDepth:
+		add("visible: no (deeper than %d components)", cfg.MaxPathDepth)
+
+	default:
+		add("visible: yes")
+	}
+
+	// Decompressed views.
+	gzipViews := inode.GzipViewConfig{
+		Suffixes:   cfg.TranscodeGzipSuffixes,
+		DropSuffix: cfg.DropTranscodedGzipSuffix,
+	}
+
+	if !isDir {
+		lines = append(lines, gzipViews.Explain(name)...)
+	}
+
+	// Writability.
+	switch {
+	case cfg.ReadOnly:
+		add("writable: no (read-only file system)")
+
+	case !isDir && gzipViews.IsView(name):
+		add("writable: no (decompressed view)")
+
+	default:
+		add("writable: yes")
+	}
+
+	// Default metadata, which is matched against full object names.
+	policy, err := gcsproxy.ParseDefaultMetadata(cfg.DefaultMetadata)
+	if err != nil {
+		err = fmt.Errorf("ParseDefaultMetadata: %v", err)
+		return
+	}
+
+	lines = append(lines, policy.Explain(fullName)...)
+
+	// Caching of names by the parent directory.
+	tombstoneTTL := cfg.TombstoneTTL
+	if tombstoneTTL == 0 {
+		tombstoneTTL = inode.DefaultTombstoneTTL
+	}
+
+	if cfg.DirTypeCacheTTL == 0 {
+		add("type cache TTL: disabled")
+	} else {
+		add("type cache TTL: %v", cfg.DirTypeCacheTTL)
+	}
+
+	add("tombstone TTL: %v", tombstoneTTL)
+
+	return
+}
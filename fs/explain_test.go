@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestExplain(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ExplainTest struct {
+	cfg fs.ServerConfig
+}
+
+func init() { RegisterTestSuite(&ExplainTest{}) }
+
+func (t *ExplainTest) SetUp(ti *TestInfo) {
+	var clock timeutil.SimulatedClock
+	t.cfg = fs.ServerConfig{
+		Clock:                &clock,
+		Bucket:               gcsfake.NewFakeBucket(&clock, "some_bucket"),
+		OnlyDir:              "data",
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		DirTypeCacheTTL:      time.Minute,
+		MaxPathDepth:         3,
+		FilePerms:            0644,
+		DirPerms:             0755,
+
+		TranscodeGzipSuffixes:    []string{".gz"},
+		DropTranscodedGzipSuffix: true,
+
+		// Default metadata prefixes are relative to the bucket, not OnlyDir.
+		DefaultMetadata: []string{
+			":content_language=en",
+			"data/logs/:cache_control=no-cache",
+			"logs/:cache_control=public",
+		},
+	}
+}
+
+func (t *ExplainTest) explain(p string) []string {
+	AssertEq(nil, fs.ValidateServerConfig(&t.cfg))
+
+	lines, err := fs.ExplainPath(&t.cfg, p)
+	AssertEq(nil, err)
+	return lines
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ExplainTest) OrdinaryFile() {
+	ExpectThat(
+		t.explain("/notes.txt"),
+		ElementsAre(
+			`object: "data/notes.txt"`,
+			"visible: yes",
+			"decompressed view: no",
+			"writable: yes",
+			`default metadata: from prefix ""`,
+			`  content_language="en"`,
+			"type cache TTL: 1m0s",
+			"tombstone TTL: 1m0s"))
+}
+
+func (t *ExplainTest) OverlappingPolicies() {
+	ExpectThat(
+		t.explain("logs/today.log.gz"),
+		ElementsAre(
+			`object: "data/logs/today.log.gz"`,
+			"visible: yes",
+			`decompressed view: yes, read-only (suffix ".gz")`,
+			`  listed as "today.log" unless that name is in use`,
+			"writable: no (decompressed view)",
+			`default metadata: from prefix "data/logs/"`,
+			`  cache_control="no-cache"`,
+			`  overrides prefix ""`,
+			"type cache TTL: 1m0s",
+			"tombstone TTL: 1m0s"))
+}
+
+func (t *ExplainTest) Directory() {
+	ExpectThat(
+		t.explain("logs/"),
+		ElementsAre(
+			`object: "data/logs/"`,
+			"visible: yes",
+			"writable: yes",
+			"default metadata: none (directory)",
+			"type cache TTL: 1m0s",
+			"tombstone TTL: 1m0s"))
+}
+
+func (t *ExplainTest) TemporaryObject() {
+	lines := t.explain(".gcsfuse_tmp/foo")
+	ExpectThat(
+		lines,
+		Contains(`visible: no (temporary objects under ".gcsfuse_tmp/" aren't listed)`))
+}
+
+func (t *ExplainTest) TooDeep() {
+	ExpectThat(t.explain("a/b/c"), Contains("visible: yes"))
+	ExpectThat(
+		t.explain("a/b/c/d"),
+		Contains("visible: no (deeper than 3 components)"))
+}
+
+func (t *ExplainTest) ReadOnlyTakesPrecedence() {
+	t.cfg.ReadOnly = true
+	ExpectThat(
+		t.explain("logs/today.log.gz"),
+		Contains("writable: no (read-only file system)"))
+}
+
+func (t *ExplainTest) DefaultTTLs() {
+	t.cfg.DirTypeCacheTTL = 0
+	lines := t.explain("foo")
+	ExpectThat(lines, Contains("type cache TTL: disabled"))
+	ExpectThat(lines, Contains("tombstone TTL: 1m0s"))
+}
+
+func (t *ExplainTest) IllegalPaths() {
+	AssertEq(nil, fs.ValidateServerConfig(&t.cfg))
+
+	for _, p := range []string{"a//b", "./a", "a/../b", "a/./"} {
+		_, err := fs.ExplainPath(&t.cfg, p)
+		ExpectThat(err, Error(HasSubstr("Illegal path")), "path: %q", p)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestFlatten(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for flattening files by setting xattrFlatten, driving the file system
+// directly through its op methods.
+type FlattenTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// An open handle for the file "foo", which after SetUp is a composite
+	// object containing "tacoburrito".
+	foo       fuseops.InodeID
+	fooHandle fuseops.HandleID
+}
+
+func init() { RegisterTestSuite(&FlattenTest{}) }
+
+func (t *FlattenTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create the file.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	// Create the file system, with appends always composed.
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		AppendThreshold:      1,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	AssertEq(nil, err)
+
+	// Look up and open the file.
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+	t.foo = child.ID()
+
+	openOp := &fuseops.OpenFileOp{Inode: t.foo}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+	t.fooHandle = openOp.Handle
+
+	// Append to it, making a composite object.
+	AssertEq(
+		nil,
+		t.fs.WriteFile(&fuseops.WriteFileOp{
+			Inode:  t.foo,
+			Handle: t.fooHandle,
+			Offset: 4,
+			Data:   []byte("burrito"),
+		}))
+
+	AssertEq(
+		nil,
+		t.fs.FlushFile(&fuseops.FlushFileOp{Inode: t.foo, Handle: t.fooHandle}))
+
+	o := t.stat()
+	AssertEq(2, o.ComponentCount)
+	AssertEq(nil, o.MD5)
+}
+
+func (t *FlattenTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *FlattenTest) stat() (o *gcs.Object) {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	return
+}
+
+func (t *FlattenTest) flatten(value string) (err error) {
+	err = t.fs.SetXattr(&fuseops.SetXattrOp{
+		Inode: t.foo,
+		Name:  xattrFlatten,
+		Value: []byte(value),
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FlattenTest) CleanFile() {
+	AssertEq(nil, t.flatten("1"))
+
+	o := t.stat()
+	ExpectEq(1, o.ComponentCount)
+	ExpectNe(nil, o.MD5)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *FlattenTest) DirtyFile() {
+	AssertEq(
+		nil,
+		t.fs.WriteFile(&fuseops.WriteFileOp{
+			Inode:  t.foo,
+			Handle: t.fooHandle,
+			Offset: 11,
+			Data:   []byte("enchilada"),
+		}))
+
+	// Nothing happens until the file is flushed, and then the append
+	// optimization is not used.
+	AssertEq(nil, t.flatten("1"))
+	ExpectEq(2, t.stat().ComponentCount)
+
+	AssertEq(
+		nil,
+		t.fs.FlushFile(&fuseops.FlushFileOp{Inode: t.foo, Handle: t.fooHandle}))
+
+	o := t.stat()
+	ExpectEq(1, o.ComponentCount)
+	ExpectNe(nil, o.MD5)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburritoenchilada", string(contents))
+}
+
+func (t *FlattenTest) ModifiedRemotely() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "queso")
+	AssertEq(nil, err)
+
+	ExpectEq(errXattrStale, t.flatten("1"))
+
+	// The other client's object should be untouched.
+	ExpectEq(o.Generation, t.stat().Generation)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("queso", string(contents))
+}
+
+func (t *FlattenTest) BadValue() {
+	ExpectEq(errXattrInvalid, t.flatten("0"))
+	ExpectEq(errXattrInvalid, t.flatten("true"))
+	ExpectEq(2, t.stat().ComponentCount)
+}
+
+func (t *FlattenTest) Directory() {
+	err := t.fs.SetXattr(&fuseops.SetXattrOp{
+		Inode: fuseops.RootInodeID,
+		Name:  xattrFlatten,
+		Value: []byte("1"),
+	})
+
+	ExpectThat(err, Equals(errXattrUnsupported))
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestFlushErrors(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose writes fail while fail is set.
+type failingWritesBucket struct {
+	gcs.Bucket
+	fail bool
+}
+
+func (b *failingWritesBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if b.fail {
+		err = errors.New("taco")
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *failingWritesBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if b.fail {
+		err = errors.New("taco")
+		return
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FlushErrorsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket *failingWritesBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&FlushErrorsTest{}) }
+
+func (t *FlushErrorsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = &failingWritesBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+	}
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+}
+
+func (t *FlushErrorsTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+// Create the file system, ignoring flush errors or not.
+func (t *FlushErrorsTest) mount(ignoreFlushErrors bool) {
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+		IgnoreFlushErrors:    ignoreFlushErrors,
+	})
+
+	AssertEq(nil, err)
+}
+
+// Look up, open, and write to foo, returning the inode and handle.
+func (t *FlushErrorsTest) writeFoo(
+	data string) (id fuseops.InodeID, h fuseops.HandleID) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	id = child.ID()
+
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+	h = openOp.Handle
+
+	err = t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte(data),
+	})
+
+	AssertEq(nil, err)
+	return
+}
+
+func (t *FlushErrorsTest) dirty(id fuseops.InodeID) bool {
+	t.fs.mu.Lock()
+	f := t.fs.inodes[id].(*inode.FileInode)
+	t.fs.mu.Unlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	dirty, _, err := f.Dirty(t.ctx)
+	AssertEq(nil, err)
+	return dirty
+}
+
+func (t *FlushErrorsTest) readFoo() string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FlushErrorsTest) FlushReportsErrorsByDefault() {
+	t.mount(false)
+	id, h := t.writeFoo("burrito")
+
+	t.bucket.fail = true
+	err := t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	ExpectThat(err, Error(HasSubstr("taco")))
+	ExpectTrue(t.dirty(id))
+}
+
+func (t *FlushErrorsTest) FlushErrorsIgnored() {
+	t.mount(true)
+	id, h := t.writeFoo("burrito")
+
+	// The flush appears to succeed, but the file is left dirty.
+	t.bucket.fail = true
+	err := t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	AssertEq(nil, err)
+
+	ExpectTrue(t.dirty(id))
+	ExpectEq("taco", t.readFoo())
+
+	// The next flush writes it out.
+	t.bucket.fail = false
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	AssertEq(nil, err)
+
+	ExpectFalse(t.dirty(id))
+	ExpectEq("burrito", t.readFoo())
+}
+
+func (t *FlushErrorsTest) SyncStillReportsErrors() {
+	t.mount(true)
+	id, h := t.writeFoo("burrito")
+
+	t.bucket.fail = true
+	err := t.fs.SyncFile(&fuseops.SyncFileOp{Inode: id, Handle: h})
+	ExpectThat(err, Error(HasSubstr("taco")))
+	ExpectTrue(t.dirty(id))
+}
+
+func (t *FlushErrorsTest) ClobberedFlushStillFails() {
+	t.mount(true)
+	id, h := t.writeFoo("burrito")
+
+	// Someone else replaces the object. No later sync could write the file out,
+	// so the flush fails all the same.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "enchilada")
+	AssertEq(nil, err)
+
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	ExpectEq(errStale, err)
+	ExpectEq("enchilada", t.readFoo())
+}
+
+func (t *FlushErrorsTest) WrittenOutWhenForgotten() {
+	t.mount(true)
+	id, h := t.writeFoo("burrito")
+
+	t.bucket.fail = true
+	err := t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	AssertEq(nil, err)
+
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h})
+	AssertEq(nil, err)
+
+	// When the kernel forgets the file, a last attempt is made to write it out.
+	t.bucket.fail = false
+	err = t.fs.ForgetInode(&fuseops.ForgetInodeOp{Inode: id, N: 1})
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", t.readFoo())
+}
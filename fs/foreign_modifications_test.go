@@ -20,6 +20,7 @@ package fs_test
 
 import (
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -767,3 +768,67 @@ func (t *ForeignModsTest) Symlink() {
 	AssertEq(nil, err)
 	ExpectEq("bar/baz", target)
 }
+
+func (t *ForeignModsTest) MtimeMetadata() {
+	var err error
+
+	// Create objects with mtime metadata, some of it malformed.
+	testCases := []struct {
+		value    string
+		expected time.Time
+	}{
+		{
+			"2011-01-02T03:04:05.678-08:00",
+			time.Date(2011, 1, 2, 11, 4, 5, 678000000, time.UTC),
+		},
+
+		// No time zone
+		{
+			"2011-01-02 03:04:05",
+			time.Date(2011, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+
+		// Garbage and implausible values fall back to the update time.
+		{"last tuesday", time.Time{}},
+		{"1970-01-01T00:00:00Z", time.Time{}},
+	}
+
+	for i, tc := range testCases {
+		req := &gcs.CreateObjectRequest{
+			Name: fmt.Sprintf("%d", i),
+			Metadata: map[string]string{
+				inode.MtimeMetadataKey: tc.value,
+			},
+			Contents: strings.NewReader(""),
+		}
+
+		o, err := t.bucket.CreateObject(t.ctx, req)
+		AssertEq(nil, err)
+
+		if tc.expected.IsZero() {
+			testCases[i].expected = o.Updated
+		}
+	}
+
+	// Stat each.
+	for i, tc := range testCases {
+		fi, err := os.Stat(path.Join(t.Dir, fmt.Sprintf("%d", i)))
+		AssertEq(nil, err)
+		ExpectThat(
+			fi.ModTime(),
+			timeutil.TimeEq(tc.expected),
+			"Test case %d: %q", i, tc.value)
+	}
+
+	// ReadDir should agree.
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(len(testCases), len(entries))
+
+	for i, e := range entries {
+		ExpectThat(
+			e.ModTime(),
+			timeutil.TimeEq(testCases[i].expected),
+			"Test case %d", i)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestFreeSpace(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FreeSpaceTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// The size of the pretend file system holding the temporary directory, of
+	// which dirty files may use half. Space not used by the leaser is free.
+	capacity int64
+}
+
+var _ SetUpInterface = &FreeSpaceTest{}
+var _ TearDownInterface = &FreeSpaceTest{}
+
+func init() { RegisterTestSuite(&FreeSpaceTest{}) }
+
+func (t *FreeSpaceTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.capacity = 100
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                  &t.clock,
+		Bucket:                 t.bucket,
+		TempDirLimitNumFiles:   16,
+		TempDirLimitBytes:      1 << 22,
+		TempDirMaxFreeFraction: 0.5,
+		TempDirFreeSpace:       t.freeSpace,
+		TmpObjectPrefix:        ".gcsfuse_tmp/",
+		FilePerms:              0644,
+		DirPerms:               0755,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *FreeSpaceTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *FreeSpaceTest) freeSpace(dir string) (free int64, err error) {
+	_, used := t.fs.leaser.Usage()
+	free = t.capacity - used
+	return
+}
+
+// Look up and open foo, returning the inode and handle.
+func (t *FreeSpaceTest) openFoo() (id fuseops.InodeID, h fuseops.HandleID) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	id = child.ID()
+
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+	h = openOp.Handle
+
+	return
+}
+
+func (t *FreeSpaceTest) write(
+	id fuseops.InodeID,
+	h fuseops.HandleID,
+	n int) (err error) {
+	err = t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   bytes.Repeat([]byte("a"), n),
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FreeSpaceTest) Write() {
+	id, h := t.openFoo()
+
+	AssertEq(nil, t.write(id, h, 50))
+	ExpectEq(errNoSpace, t.write(id, h, 51))
+}
+
+func (t *FreeSpaceTest) TruncateCantFetchContents() {
+	// There's no room for the four bytes of the existing contents, but writing
+	// doesn't need them.
+	t.capacity = 7
+	id, h := t.openFoo()
+
+	AssertEq(nil, t.write(id, h, 1))
+
+	// Truncating does.
+	size := uint64(2)
+	err := t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: id,
+		Size:  &size,
+	})
+
+	ExpectEq(errNoSpace, err)
+}
+
+func (t *FreeSpaceTest) Truncate() {
+	id, _ := t.openFoo()
+
+	size := uint64(51)
+	err := t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: id,
+		Size:  &size,
+	})
+
+	ExpectEq(errNoSpace, err)
+
+	size = 50
+	err = t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: id,
+		Size:  &size,
+	})
+
+	ExpectEq(nil, err)
+}
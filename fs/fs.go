@@ -19,13 +19,21 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net/http"
 	"os"
 	"reflect"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/fs/invalidation"
+	"github.com/googlecloudplatform/gcsfuse/fs/notification"
 	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
 	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/bazilfuse"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
@@ -36,13 +44,66 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// The error returned for attempts to modify decompressed views.
+var errViewReadOnly = bazilfuse.Errno(syscall.EPERM)
+
+// The error returned for attempts to modify a read-only file system.
+var errReadOnlyFS = bazilfuse.Errno(syscall.EROFS)
+
+// The error returned for attempts to change the owner of an inode when
+// ServerConfig.FixedOwner is set.
+var errChownFixedOwner = bazilfuse.Errno(syscall.EPERM)
+
+// The error returned for renames whose source was modified by someone else
+// after we copied it, which we therefore decline to delete.
+var errRenameStale = bazilfuse.Errno(syscall.ESTALE)
+
+// The error returned for files whose local modifications can't be written out
+// because someone else overwrote or deleted the object first, both by the sync
+// that finds out and by later writes and syncs. See inode.ClobberedError.
+var errStale = bazilfuse.Errno(syscall.ESTALE)
+
+// The error returned for attempts to modify files whose objects are encrypted
+// with customer-supplied keys, and for syncs that didn't keep an object's
+// Cloud KMS key. See gcsproxy.EncryptionError.
+var errEncrypted = bazilfuse.Errno(syscall.EPERM)
+
+// The error returned for writes that would make a file too large, or that are
+// rejected because of RejectSparseWritesOver.
+var errFileTooLarge = bazilfuse.Errno(syscall.EFBIG)
+
+// The error returned for writes and truncations that would take dirty files
+// over ServerConfig.TempDirMaxFreeFraction.
+var errNoSpace = bazilfuse.Errno(syscall.ENOSPC)
+
+// The errors returned by SeekFile when there is no hole or data to be found,
+// and for whence values other than those for holes and data.
+var (
+	errSeekNotFound = bazilfuse.Errno(syscall.ENXIO)
+	errSeekWhence   = bazilfuse.Errno(syscall.EINVAL)
+)
+
+// The errors returned for symlink targets that GCS can't store as custom
+// metadata. See inode.CheckCustomMetadata.
+var (
+	errTargetInvalid  = bazilfuse.Errno(syscall.EINVAL)
+	errTargetTooLarge = bazilfuse.Errno(syscall.ENAMETOOLONG)
+)
+
 type ServerConfig struct {
-	// A clock used for modification times and cache expiration.
+	// A clock used for modification times and cache expiration. If it has an
+	// After method like time.After, it also times background work.
 	Clock timeutil.Clock
 
 	// The bucket that the file system is to export.
 	Bucket gcs.Bucket
 
+	// If set, only the part of the bucket under this directory is exported:
+	// the object "foo/bar/baz" appears as "bar/baz" when OnlyDir is "foo", and
+	// objects outside of "foo/" are invisible. Leading and trailing slashes
+	// are ignored, so the empty string and "/" export the whole bucket.
+	OnlyDir string
+
 	// The temporary directory to use for local caching, or the empty string to
 	// use the system default.
 	TempDir string
@@ -59,6 +120,22 @@ type ServerConfig struct {
 	// closed.
 	TempDirLimitBytes int64
 
+	// If positive, keep no more than this many bytes of a single file's
+	// contents cached once they're no longer dirty, so that one huge file can't
+	// push everything else out of the temporary directory. Of a file read a
+	// chunk at a time, the least recently used chunks are thrown away.
+	TempDirLimitBytesPerFile int64
+
+	// If positive, refuse to let dirty files occupy more than this fraction of
+	// the space free in TempDir's file system, failing writes and truncations
+	// that would take them over it with ENOSPC before anything is written.
+	// Space used by cached content that could be evicted counts as free.
+	TempDirMaxFreeFraction float64
+
+	// How to find the space free in TempDir's file system, for
+	// TempDirMaxFreeFraction. If nil, lease.StatFreeSpace is used.
+	TempDirFreeSpace lease.FreeSpaceFunc
+
 	// If set to a non-zero value N, the file system will read objects from GCS a
 	// chunk at a time with a maximum read size of N, caching each chunk
 	// independently. The part about separate caching does not apply to dirty
@@ -66,6 +143,17 @@ type ServerConfig struct {
 	// regardless of this setting.
 	GCSChunkSize uint64
 
+	// When reading an unmodified file a chunk at a time, the number of chunks
+	// past the one being read to fetch in the background once reads look
+	// sequential. Zero disables this. See lease.NewMultiReadProxy.
+	ReadaheadChunks int
+
+	// By default, contents read from GCS are checked against the object's
+	// CRC32C checksum (or, when read a chunk at a time, each chunk's size) and
+	// fetched once more if they don't match, failing with EIO if they still
+	// don't. Setting this disables the checks.
+	DisableChecksumValidation bool
+
 	// By default, if a bucket contains the object "foo/bar" but no object named
 	// "foo/", it's as if the directory doesn't exist. This allows us to have
 	// non-flaky name resolution code.
@@ -86,10 +174,42 @@ type ServerConfig struct {
 	// before the expiration, we may fail to find it.
 	DirTypeCacheTTL time.Duration
 
+	// How long each directory remembers the children deleted or renamed away
+	// through this file system, hiding them from lookups and listings whose
+	// data predates the deletion. If zero, inode.DefaultTombstoneTTL is used.
+	// See inode.NewDirInode.
+	TombstoneTTL time.Duration
+
+	// If non-zero, the complete listing of each directory is kept for this long
+	// and shared by all handles that read it, and lookups of names missing from
+	// it fail without consulting GCS. Changes made through the file system are
+	// seen straight away; those made by others may go unseen until the
+	// expiration. See dirListings.
+	DirCacheTTL time.Duration
+
+	// If non-zero, names that lookups find not to exist are remembered for this
+	// long, both by the file system and by the kernel, so that looking them up
+	// again doesn't consult GCS. Names created through the file system are seen
+	// straight away; those created by others may go unseen until the
+	// expiration. See negativeLookups.
+	NegativeTTL time.Duration
+
 	// The UID and GID that owns all inodes in the file system.
 	Uid uint32
 	Gid uint32
 
+	// Set when Uid and Gid were chosen by the user rather than taken from the
+	// process, for example so that another user can own a mount shared with
+	// allow_other. Attempts to give an inode a different owner then fail with
+	// EPERM rather than being silently ignored.
+	FixedOwner bool
+
+	// If set, check the credentials of the caller of each open, create, and
+	// unlink against Uid, Gid, FilePerms, and DirPerms, failing with EACCES as
+	// a local file system would. This matters when the mount is shared with
+	// other users by allow_other.
+	CheckPermissions bool
+
 	// Permissions bits to use for files and directories. No bits outside of
 	// os.ModePerm may be set.
 	FilePerms os.FileMode
@@ -101,7 +221,9 @@ type ServerConfig struct {
 	// process:
 	//
 	// 1. Write out a temporary object containing the appended contents whose
-	//    name begins with TmpObjectPrefix.
+	//    name begins with TmpObjectPrefix. Names and metadata identify the
+	//    mount and target object (see gcsproxy.TmpMountIDMetadataKey), so many
+	//    mounts can safely share a prefix.
 	//
 	// 2. Compose the original object and the temporary object on top of the
 	//    original object.
@@ -113,63 +235,432 @@ type ServerConfig struct {
 	// periodically garbage collected.
 	AppendThreshold int64
 	TmpObjectPrefix string
+
+	// Modified files at least this large that can't be appended to are
+	// uploaded in pieces, composed together in GCS by way of temporary objects
+	// under TmpObjectPrefix. Should an upload fail, the pieces already
+	// uploaded are reused by the next attempt to sync the same file; they are
+	// left behind for garbage collection if there is none. Zero disables this.
+	ResumableUploadThreshold int64
+
+	// If non-nil, used to tell the kernel to drop its cached state for inodes
+	// that the file system discovers to be stale. Invalidations are queued and
+	// delivered from a separate goroutine, never from within an op handler, and
+	// may be dropped under heavy churn (in which case the kernel's cache
+	// entries simply expire as usual). Use a *KernelInvalidator to reach the
+	// kernel over the connection that the server serves.
+	Invalidator invalidation.Invalidator
+
+	// If non-nil, called with the name of each object that another client is
+	// reported to have changed (see "/notifications" under DebugMux), so that
+	// caches within Bucket such as a stat cache can forget it. Must be safe
+	// for concurrent use.
+	ForgetObject func(name string)
+
+	// Files whose names end in one of these suffixes (e.g. ".gz") are presented
+	// as read-only views of their gzip-decompressed contents. Attempts to open
+	// them for writing, truncate them, remove them, or rename them fail with
+	// EPERM. Until a view is first opened its size is reported as the size of
+	// the compressed object.
+	TranscodeGzipSuffixes []string
+
+	// If set, decompressed views are listed with their suffix dropped (so
+	// "foo.csv.gz" appears as "foo.csv"), unless that would collide with the
+	// name of another file or directory.
+	DropTranscodedGzipSuffix bool
+
+	// Layouts, in the syntax of package time, to try when a file's mtime
+	// metadata isn't in RFC 3339 format (see inode.ParseMtime). If nil,
+	// inode.DefaultMtimeLayouts is used.
+	MtimeLayouts []string
+
+	// Specs of the form "prefix:field=value,..." for default metadata to give
+	// new objects, as parsed by gcsproxy.ParseDefaultMetadata. Objects created,
+	// copied or renamed to a name under a prefix get that prefix's defaults for
+	// any field they don't already set; where several prefixes match, the
+	// longest wins. Prefixes are relative to the root of the bucket, not to
+	// OnlyDir.
+	DefaultMetadata []string
+
+	// If positive, writes that begin more than this many bytes beyond the
+	// current end of a file, and truncations that extend a file by more than
+	// this, fail with EFBIG instead of leaving a hole in the file. This guards
+	// against buggy applications that write at a bogus offset, which would
+	// otherwise cause the file's entire (mostly zero) logical size to be
+	// uploaded when it is synced.
+	//
+	// Regardless of this setting, writes and truncations that would make a
+	// file larger than GCS's maximum object size always fail with EFBIG.
+	RejectSparseWritesOver int64
+
+	// If set, inode IDs are chosen by hashing object names rather than
+	// sequentially, and the change time of each file is derived from its GCS
+	// generation. Together these keep st_ino and the attributes NFS uses to
+	// detect changes the same across restarts of gcsfuse (for example when
+	// re-exporting the file system over NFS), while still changing them when
+	// an object is overwritten. See docs/semantics.md for the exceptions.
+	StableIdentity bool
+
+	// If set, every op that would modify the file system or the bucket fails
+	// with EROFS, files may be opened only for reading, and temporary objects
+	// left behind by other mounts are not garbage collected.
+	ReadOnly bool
+
+	// If positive, opening a file or directory fails with EMFILE when this many
+	// handles are already open (not counting reaped handles; see below). This
+	// bounds the resources that a leaky application can pin.
+	MaxOpenHandles int
+
+	// If positive, names with more than this many components beneath the root
+	// can't be looked up or created (ENAMETOOLONG), and are left out of
+	// directory listings. This protects memory and the kernel from
+	// pathologically deep object names.
+	MaxPathDepth int
+
+	// If positive, creating a file, directory, or symlink fails with EDQUOT
+	// when its parent appears to already have this many children. This makes
+	// applications that create unbounded numbers of files in one directory fail
+	// fast. The count is a cheap estimate that may lag changes made by other
+	// mounts until the directory is next listed; see childCounts. Deletions and
+	// reads are never refused.
+	MaxChildrenPerDir int
+
+	// If positive, a directory can be renamed if it has no more than this many
+	// objects beneath it, counting its own placeholder object. Each is copied
+	// to the new name and then deleted, so the limit bounds the cost of a
+	// rename. Renaming a larger directory, or any if the limit is zero, fails
+	// with EXDEV, as for a rename across file systems.
+	RenameDirLimit int
+
+	// If positive, handles that haven't been used for this long have their
+	// resources released: buffered directory listings, streams, and cached file
+	// contents that no other handle is using. A reaped handle no longer counts
+	// toward MaxOpenHandles. It remains allocated until the kernel releases it,
+	// and is revived by the next op on it, which may have to fetch again what
+	// was released. Handles for files with unflushed modifications are never
+	// reaped. Must be zero or at least a second.
+	HandleIdleTimeout time.Duration
+
+	// If positive, files whose modifications haven't been written to GCS are
+	// synced in the background once their latest modification is this old,
+	// without waiting for them to be flushed. This bounds what a crash can lose
+	// and the temporary space used by files that are kept open for a long time,
+	// such as logs. Failures are logged and retried later; they are never
+	// reported to the application. Must be zero or at least a second.
+	DirtySyncInterval time.Duration
+
+	// If set, a failure to write out a file's modifications when it is flushed
+	// (as by close(2)) is logged rather than returned, and the file remains
+	// dirty so that a later flush, fsync(2), or background sync can try again.
+	// A last attempt is made when the kernel forgets the file, and the loss of
+	// the modifications is logged if that fails too. Explicit syncs (SyncFileOp)
+	// still report errors, as do flushes of files that have been clobbered
+	// (ESTALE) or can't be rewritten with their encryption (EPERM), which no
+	// later attempt could write out.
+	IgnoreFlushErrors bool
+
+	// If positive, files at least this large that are opened read-only and
+	// then read from the start, through no other handle and without being
+	// modified, have their contents streamed from GCS rather than cached in
+	// temporary files. Handles opened with O_DIRECT stream whatever the size
+	// and wherever they start. A handle falls back to the usual path for good
+	// when it reads further back than streamingWindow or any of those
+	// conditions stops holding. See gcsproxy.StreamingReader.
+	StreamingReadThreshold int64
+
+	// How files' access times are reported and kept, by default AtimeOff.
+	// Explicitly set access times (as with utimes(2)) are honored except with
+	// AtimeOff. With AtimePersistRelatime, AtimePersistInterval must be
+	// positive, and bounds how often each file's access time is written to
+	// GCS.
+	AtimeMode            AtimeMode
+	AtimePersistInterval time.Duration
+
+	// Set if our credentials may read objects but not list them, as is common
+	// for public datasets. We then never list the bucket: implicit directories
+	// are disabled (so directories are found only by statting their
+	// placeholder objects), temporary objects aren't garbage collected, and
+	// each directory appears to contain a single entry explaining the problem,
+	// or if ListingDeniedEACCES is also set, fails to be read with EACCES.
+	// Files and directories can still be reached by their exact paths. GCS
+	// refuses to stat missing objects for such credentials with HTTP 403, which
+	// is taken to mean that the object doesn't exist.
+	ListingDenied       bool
+	ListingDeniedEACCES bool
+
+	// If non-nil, debugging handlers are registered here: "/residency", which
+	// lists the files with the most content cached locally; "/handles", which
+	// lists open handles and the resources they hold; "/sync_plan", which
+	// reports what syncing a given file would write to GCS without doing it;
+	// and "/notifications", which accepts POSTed events describing changes
+	// made to objects by other clients (see package notification) and throws
+	// away what is cached about them.
+	DebugMux *http.ServeMux
+
+	// If non-nil, the count, errors, and latency of each op type are recorded
+	// here, along with the temporary directory's revocations and the downloads
+	// that its evictions cause.
+	Metrics *metrics.Registry
+
+	// If non-nil, file reads and writes and lookup retries are counted here.
+	Counters *Counters
+}
+
+// The number of objects whose evicted contents are remembered, for counting
+// the downloads that evictions cause.
+const evictionTrackerCapacity = 1 << 14
+
+// A fuse server for a file system backed by GCS.
+type Server interface {
+	fuse.Server
+
+	// Write to GCS every file with modifications that haven't been, returning
+	// the number of files written. Failures are logged by object name. For
+	// rescuing what we can when the kernel connection dies, since no more ops
+	// will arrive to flush the files, and for flushing before unmounting in
+	// response to a signal. May be called concurrently with ServeOps.
+	SyncDirtyFiles(ctx context.Context) (n int, err error)
+
+	// Stop the server's background work, such as reaping idle handles and
+	// writing back dirty files periodically, once its connection has ended
+	// and it is to be replaced. Safe to call more than once.
+	StopBackgroundWork()
 }
 
 // Create a fuse file system server according to the supplied configuration.
-func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
-	// Check permissions bits.
-	if cfg.FilePerms&^os.ModePerm != 0 {
-		err = fmt.Errorf("Illegal file perms: %v", cfg.FilePerms)
+// The configuration is first checked and defaulted using ValidateServerConfig.
+func NewServer(cfg *ServerConfig) (server Server, err error) {
+	fs, err := newFileSystem(cfg)
+	if err != nil {
 		return
 	}
 
-	if cfg.DirPerms&^os.ModePerm != 0 {
-		err = fmt.Errorf("Illegal dir perms: %v", cfg.FilePerms)
+	var wrapped fuseutil.FileSystem = fs
+	if cfg.Metrics != nil {
+		wrapped = newMonitoredFileSystem(cfg.Clock, cfg.Metrics, fs)
+	}
+
+	fsServer := &fsServer{
+		Server: fuseutil.NewFileSystemServer(wrapped),
+		fs:     fs,
+	}
+
+	fsServer.kernel, _ = cfg.Invalidator.(*KernelInvalidator)
+	server = fsServer
+
+	return
+}
+
+type fsServer struct {
+	fuse.Server
+	fs *fileSystem
+
+	// The configured invalidator, if it is to be attached to the connection.
+	kernel *KernelInvalidator
+}
+
+func (s *fsServer) ServeOps(c *fuse.Connection) {
+	if s.kernel != nil {
+		s.kernel.attach(c)
+	}
+
+	s.Server.ServeOps(c)
+}
+
+func (s *fsServer) SyncDirtyFiles(ctx context.Context) (n int, err error) {
+	n, err = s.fs.syncDirtyFiles(ctx)
+	return
+}
+
+func (s *fsServer) StopBackgroundWork() {
+	s.fs.stopGarbageCollecting()
+}
+
+func newFileSystem(cfg *ServerConfig) (fs *fileSystem, err error) {
+	// Check the config.
+	err = ValidateServerConfig(cfg)
+	if err != nil {
 		return
 	}
 
+	// Count into a private set of counters if none were supplied.
+	counters := cfg.Counters
+	if counters == nil {
+		counters = new(Counters)
+	}
+
 	// Disable chunking if set to zero.
 	gcsChunkSize := cfg.GCSChunkSize
 	if gcsChunkSize == 0 {
 		gcsChunkSize = math.MaxUint64
 	}
 
+	// Decompressed views are cached in blocks of the chunk size, where possible.
+	gzipViews := inode.GzipViewConfig{
+		Suffixes:   cfg.TranscodeGzipSuffixes,
+		DropSuffix: cfg.DropTranscodedGzipSuffix,
+	}
+
+	gzipBlockSize := int64(math.MaxInt64)
+	if gcsChunkSize < math.MaxInt64 {
+		gzipBlockSize = int64(gcsChunkSize)
+	}
+
+	// Apply default metadata, if requested. This happens before restricting to
+	// OnlyDir so that the policy sees full object names.
+	bucket := cfg.Bucket
+	if len(cfg.DefaultMetadata) != 0 {
+		var policy *gcsproxy.DefaultMetadataPolicy
+		policy, err = gcsproxy.ParseDefaultMetadata(cfg.DefaultMetadata)
+		if err != nil {
+			err = fmt.Errorf("ParseDefaultMetadata: %v", err)
+			return
+		}
+
+		bucket = gcsproxy.NewDefaultMetadataBucket(policy, bucket)
+	}
+
+	// Restrict ourselves to a single directory, if requested.
+	if prefix := onlyDirPrefix(cfg.OnlyDir); prefix != "" {
+		bucket = gcsproxy.NewPrefixBucket(prefix, bucket)
+	}
+
+	mtimeLayouts := cfg.MtimeLayouts
+	if mtimeLayouts == nil {
+		mtimeLayouts = inode.DefaultMtimeLayouts
+	}
+
 	// Create the file leaser.
-	leaser := lease.NewFileLeaser(
-		cfg.TempDir,
-		cfg.TempDirLimitNumFiles,
-		cfg.TempDirLimitBytes)
+	freeSpace := cfg.TempDirFreeSpace
+	if freeSpace == nil {
+		freeSpace = lease.StatFreeSpace
+	}
 
-	// Create the object syncer.
-	// Check TmpObjectPrefix.
-	if cfg.TmpObjectPrefix == "" {
-		err = errors.New("You must set TmpObjectPrefix.")
-		return
+	// Tell the eviction tracker what the leaser evicts, so that read proxies
+	// can count the downloads that follow.
+	evictions := gcsproxy.NewEvictionTracker(evictionTrackerCapacity)
+	leaser := lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		Dir:                cfg.TempDir,
+		LimitNumFiles:      cfg.TempDirLimitNumFiles,
+		LimitBytes:         cfg.TempDirLimitBytes,
+		LimitBytesPerLease: cfg.TempDirLimitBytesPerFile,
+		MaxFreeFraction:    cfg.TempDirMaxFreeFraction,
+		FreeSpace:          freeSpace,
+		OnEviction:         evictions.NoteEviction,
+		Clock:              cfg.Clock,
+	})
+
+	counters.setLeaser(leaser, evictions)
+	if cfg.Metrics != nil {
+		registerLeaserMetrics(cfg.Metrics, leaser, evictions)
+		registerCounterMetrics(cfg.Metrics, counters)
 	}
 
+	// Create the object syncer.
 	objectSyncer := gcsproxy.NewObjectSyncer(
 		cfg.AppendThreshold,
+		cfg.ResumableUploadThreshold,
 		cfg.TmpObjectPrefix,
-		cfg.Bucket)
+		bucket)
+
+	// Keep temporary objects out of the file system's listings, while the
+	// object syncer and the garbage collector see them as usual.
+	tmpBucket := bucket
+	bucket = gcsproxy.NewHiddenPrefixBucket(cfg.TmpObjectPrefix, bucket)
+
+	// Don't use listings if we're not allowed to.
+	implicitDirs := cfg.ImplicitDirectories
+	listing := listingAllowed
+	if cfg.ListingDenied {
+		if implicitDirs {
+			log.Println(
+				"Warning: ignoring ImplicitDirectories, because the bucket can't be " +
+					"listed.")
+		}
+
+		implicitDirs = false
+		listing = listingDeniedNotice
+		if cfg.ListingDeniedEACCES {
+			listing = listingDeniedEACCES
+		}
+
+		bucket = &listingDeniedBucket{bucket}
+	}
 
 	// Set up the basic struct.
-	fs := &fileSystem{
+	fs = &fileSystem{
 		clock:                  cfg.Clock,
-		bucket:                 cfg.Bucket,
+		bucket:                 bucket,
 		leaser:                 leaser,
+		evictions:              evictions,
 		objectSyncer:           objectSyncer,
 		gcsChunkSize:           gcsChunkSize,
-		implicitDirs:           cfg.ImplicitDirectories,
+		readaheadChunks:        cfg.ReadaheadChunks,
+		validateChecksums:      !cfg.DisableChecksumValidation,
+		objectNamePrefix:       onlyDirPrefix(cfg.OnlyDir),
+		implicitDirs:           implicitDirs,
+		listing:                listing,
 		dirTypeCacheTTL:        cfg.DirTypeCacheTTL,
+		tombstoneTTL:           cfg.TombstoneTTL,
+		gzipViews:              gzipViews,
+		gzipBlockSize:          gzipBlockSize,
+		mtimeLayouts:           mtimeLayouts,
+		rejectSparseWritesOver: cfg.RejectSparseWritesOver,
+		stableIdentity:         cfg.StableIdentity,
+		readOnly:               cfg.ReadOnly,
+		maxOpenHandles:         cfg.MaxOpenHandles,
+		handleIdleTimeout:      cfg.HandleIdleTimeout,
+		dirtySyncInterval:      cfg.DirtySyncInterval,
+		ignoreFlushErrors:      cfg.IgnoreFlushErrors,
+		maxPathDepth:           cfg.MaxPathDepth,
+		maxChildrenPerDir:      cfg.MaxChildrenPerDir,
+		renameDirLimit:         cfg.RenameDirLimit,
+		streamingReadThreshold: cfg.StreamingReadThreshold,
+		streamingWindow:        streamingWindow,
+		atimeMode:              cfg.AtimeMode,
+		atimePersistInterval:   cfg.AtimePersistInterval,
+		counters:               counters,
+		forgetObject:           cfg.ForgetObject,
+		notifications:          notification.NewFilter(notificationFilterCapacity),
 		uid:                    cfg.Uid,
 		gid:                    cfg.Gid,
+		fixedOwner:             cfg.FixedOwner,
+		checkPermissions:       cfg.CheckPermissions,
 		fileMode:               cfg.FilePerms,
 		dirMode:                cfg.DirPerms | os.ModeDir,
 		inodes:                 make(map[fuseops.InodeID]inode.Inode),
 		nextInodeID:            fuseops.RootInodeID + 1,
 		generationBackedInodes: make(map[string]GenerationBackedInode),
 		implicitDirInodes:      make(map[string]inode.DirInode),
+		deletedDirs:            make(map[string]inode.DirInode),
 		handles:                make(map[fuseops.HandleID]interface{}),
+		fileHandleCounts:       make(map[fuseops.InodeID]int),
+	}
+
+	// Set up asynchronous kernel invalidation, if requested.
+	if cfg.Invalidator != nil {
+		const invalidationQueueCapacity = 1 << 12
+		fs.invalidations = invalidation.NewDispatcher(
+			cfg.Invalidator,
+			invalidationQueueCapacity)
+	}
+
+	if cfg.MaxChildrenPerDir > 0 {
+		fs.childCounts = newChildCounts()
+	}
+
+	if cfg.DirCacheTTL > 0 {
+		fs.dirListings = newDirListings(
+			fs.clock,
+			cfg.DirCacheTTL,
+			fs.counters)
+	}
+
+	if cfg.NegativeTTL > 0 {
+		fs.negativeLookups = newNegativeLookups(
+			fs.clock,
+			cfg.NegativeTTL,
+			fs.counters)
 	}
 
 	// Set up the root inode.
@@ -183,7 +674,9 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		},
 		fs.implicitDirs,
 		fs.dirTypeCacheTTL,
-		cfg.Bucket,
+		fs.tombstoneTTL,
+		fs.gzipViews,
+		fs.bucket,
 		fs.clock)
 
 	root.Lock()
@@ -195,12 +688,342 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	// Periodically garbage collect temporary objects.
+	// Export debugging information, if requested.
+	if cfg.DebugMux != nil {
+		cfg.DebugMux.HandleFunc("/residency", fs.serveResidency)
+		cfg.DebugMux.HandleFunc("/handles", fs.serveHandles)
+		cfg.DebugMux.HandleFunc("/sync_plan", fs.serveSyncPlan)
+		cfg.DebugMux.HandleFunc("/notifications", fs.serveNotifications)
+		cfg.DebugMux.HandleFunc("/limits", fs.serveLimits)
+	}
+
+	// Periodically garbage collect temporary objects, unless we mustn't touch
+	// the bucket or can't list it to find them.
 	var gcCtx context.Context
 	gcCtx, fs.stopGarbageCollecting = context.WithCancel(context.Background())
-	go garbageCollect(gcCtx, cfg.TmpObjectPrefix, fs.bucket)
+	if !fs.readOnly && fs.listing == listingAllowed {
+		go garbageCollect(gcCtx, cfg.TmpObjectPrefix, tmpBucket)
+	}
+
+	// And reap idle handles, if requested.
+	if fs.handleIdleTimeout > 0 {
+		go fs.reapIdleHandlesPeriodically(gcCtx)
+	}
+
+	// And write back files that have been dirty for too long, if requested.
+	if fs.dirtySyncInterval > 0 {
+		go fs.syncDirtyFilesPeriodically(gcCtx)
+	}
+
+	// And write back access times, if requested.
+	if fs.atimeMode == AtimePersistRelatime {
+		go fs.persistAtimesPeriodically(gcCtx)
+	}
+
+	return
+}
+
+// An error returned by ValidateServerConfig, listing every problem found.
+type ServerConfigError struct {
+	Problems []string
+}
+
+func (e *ServerConfigError) Error() string {
+	return "Invalid ServerConfig: " + strings.Join(e.Problems, "; ")
+}
+
+// Check the supplied config for problems that would otherwise show up only
+// once the file system is in use, filling in defaults (and logging that we've
+// done so) for fields that have been left unset:
+//
+//  *  A nil Clock becomes the real clock.
+//  *  Zero FilePerms and DirPerms become 0644 and 0755.
+//
+// If there are any problems, the returned error is a *ServerConfigError
+// describing all of them. NewServer calls this function itself; it is exported
+// so that callers can check a config before doing expensive setup work.
+func ValidateServerConfig(cfg *ServerConfig) (err error) {
+	var problems []string
+	problem := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	// Defaults.
+	if cfg.Clock == nil {
+		log.Println("ServerConfig: Clock not set; using the real clock.")
+		cfg.Clock = timeutil.RealClock()
+	}
+
+	if cfg.FilePerms == 0 {
+		const defaultFilePerms = 0644
+		log.Printf(
+			"ServerConfig: FilePerms not set; using %#o.",
+			defaultFilePerms)
+
+		cfg.FilePerms = defaultFilePerms
+	}
+
+	if cfg.DirPerms == 0 {
+		const defaultDirPerms = 0755
+		log.Printf(
+			"ServerConfig: DirPerms not set; using %#o.",
+			defaultDirPerms)
+
+		cfg.DirPerms = defaultDirPerms
+	}
+
+	// Required fields.
+	if cfg.Bucket == nil {
+		problem("Bucket must be set")
+	}
+
+	if prefix := onlyDirPrefix(cfg.OnlyDir); prefix != "" &&
+		!isCleanDirName(prefix) {
+		problem("Illegal OnlyDir: %q", cfg.OnlyDir)
+	}
+
+	// Permissions bits.
+	if cfg.FilePerms&^os.ModePerm != 0 {
+		problem("Illegal FilePerms: %v", cfg.FilePerms)
+	}
+
+	if cfg.DirPerms&^os.ModePerm != 0 {
+		problem("Illegal DirPerms: %v", cfg.DirPerms)
+	}
+
+	// Limits.
+	if cfg.TempDirLimitNumFiles <= 0 {
+		problem(
+			"TempDirLimitNumFiles must be positive (got %d)",
+			cfg.TempDirLimitNumFiles)
+	}
+
+	if cfg.TempDirLimitBytes <= 0 {
+		problem(
+			"TempDirLimitBytes must be positive (got %d)",
+			cfg.TempDirLimitBytes)
+	}
+
+	if cfg.TempDirLimitBytesPerFile < 0 {
+		problem(
+			"TempDirLimitBytesPerFile must be non-negative (got %d)",
+			cfg.TempDirLimitBytesPerFile)
+	}
+
+	if cfg.TempDirMaxFreeFraction < 0 || cfg.TempDirMaxFreeFraction > 1 {
+		problem(
+			"TempDirMaxFreeFraction must be between 0 and 1 (got %v)",
+			cfg.TempDirMaxFreeFraction)
+	}
 
-	server = fuseutil.NewFileSystemServer(fs)
+	if cfg.ReadaheadChunks < 0 {
+		problem(
+			"ReadaheadChunks must be non-negative (got %d)",
+			cfg.ReadaheadChunks)
+	}
+
+	if cfg.DirTypeCacheTTL < 0 {
+		problem(
+			"DirTypeCacheTTL must be non-negative (got %v)",
+			cfg.DirTypeCacheTTL)
+	}
+
+	if cfg.TombstoneTTL < 0 {
+		problem(
+			"TombstoneTTL must be non-negative (got %v)",
+			cfg.TombstoneTTL)
+	}
+
+	if cfg.DirCacheTTL < 0 {
+		problem(
+			"DirCacheTTL must be non-negative (got %v)",
+			cfg.DirCacheTTL)
+	}
+
+	if cfg.NegativeTTL < 0 {
+		problem(
+			"NegativeTTL must be non-negative (got %v)",
+			cfg.NegativeTTL)
+	}
+
+	// The append optimization.
+	if cfg.AppendThreshold < 0 {
+		problem(
+			"AppendThreshold must be non-negative (got %d)",
+			cfg.AppendThreshold)
+	}
+
+	if cfg.ResumableUploadThreshold < 0 {
+		problem(
+			"ResumableUploadThreshold must be non-negative (got %d)",
+			cfg.ResumableUploadThreshold)
+	}
+
+	switch {
+	case cfg.TmpObjectPrefix == "":
+		problem("TmpObjectPrefix must be set")
+
+	case !strings.HasSuffix(cfg.TmpObjectPrefix, "/"):
+		problem(
+			"TmpObjectPrefix must end with '/' (got %q)",
+			cfg.TmpObjectPrefix)
+
+	// The prefix must name a directory that listings can leave out.
+	case !isCleanDirName(cfg.TmpObjectPrefix):
+		problem("Illegal TmpObjectPrefix: %q", cfg.TmpObjectPrefix)
+
+	// The prefix is relative to OnlyDir. Repeating OnlyDir is almost certainly
+	// a mistake, and would nest the temporary objects a level deeper than
+	// intended.
+	case onlyDirPrefix(cfg.OnlyDir) != "" &&
+		strings.HasPrefix(cfg.TmpObjectPrefix, onlyDirPrefix(cfg.OnlyDir)):
+		problem(
+			"TmpObjectPrefix is relative to OnlyDir, and must not repeat it "+
+				"(got %q with OnlyDir %q)",
+			cfg.TmpObjectPrefix,
+			cfg.OnlyDir)
+	}
+
+	if cfg.RejectSparseWritesOver < 0 {
+		problem(
+			"RejectSparseWritesOver must be non-negative (got %d)",
+			cfg.RejectSparseWritesOver)
+	}
+
+	if cfg.MaxPathDepth < 0 {
+		problem(
+			"MaxPathDepth must be non-negative (got %d)",
+			cfg.MaxPathDepth)
+	}
+
+	if cfg.MaxChildrenPerDir < 0 {
+		problem(
+			"MaxChildrenPerDir must be non-negative (got %d)",
+			cfg.MaxChildrenPerDir)
+	}
+
+	if cfg.RenameDirLimit < 0 {
+		problem(
+			"RenameDirLimit must be non-negative (got %d)",
+			cfg.RenameDirLimit)
+	}
+
+	if cfg.StreamingReadThreshold < 0 {
+		problem(
+			"StreamingReadThreshold must be non-negative (got %d)",
+			cfg.StreamingReadThreshold)
+	}
+
+	// Handles.
+	if cfg.MaxOpenHandles < 0 {
+		problem(
+			"MaxOpenHandles must be non-negative (got %d)",
+			cfg.MaxOpenHandles)
+	}
+
+	if cfg.HandleIdleTimeout < 0 {
+		problem(
+			"HandleIdleTimeout must be non-negative (got %v)",
+			cfg.HandleIdleTimeout)
+	} else if cfg.HandleIdleTimeout > 0 &&
+		cfg.HandleIdleTimeout < minBackgroundInterval {
+		problem(
+			"HandleIdleTimeout must be zero or at least %v (got %v)",
+			minBackgroundInterval,
+			cfg.HandleIdleTimeout)
+	}
+
+	if cfg.DirtySyncInterval < 0 {
+		problem(
+			"DirtySyncInterval must be non-negative (got %v)",
+			cfg.DirtySyncInterval)
+	} else if cfg.DirtySyncInterval > 0 &&
+		cfg.DirtySyncInterval < minBackgroundInterval {
+		problem(
+			"DirtySyncInterval must be zero or at least %v (got %v)",
+			minBackgroundInterval,
+			cfg.DirtySyncInterval)
+	}
+
+	// Access times.
+	if _, ok := atimeModeNames[cfg.AtimeMode]; !ok {
+		problem("Unknown AtimeMode: %v", cfg.AtimeMode)
+	}
+
+	if cfg.AtimeMode == AtimePersistRelatime {
+		if cfg.AtimePersistInterval <= 0 {
+			problem(
+				"AtimePersistInterval must be positive with AtimePersistRelatime "+
+					"(got %v)",
+				cfg.AtimePersistInterval)
+		}
+
+		if cfg.ReadOnly {
+			problem("AtimePersistRelatime can't be used with ReadOnly")
+		}
+	}
+
+	// Decompressed views.
+	for _, suffix := range cfg.TranscodeGzipSuffixes {
+		if suffix == "" || strings.Contains(suffix, "/") {
+			problem("Illegal TranscodeGzipSuffixes entry: %q", suffix)
+		}
+	}
+
+	if cfg.DropTranscodedGzipSuffix && len(cfg.TranscodeGzipSuffixes) == 0 {
+		problem("DropTranscodedGzipSuffix requires TranscodeGzipSuffixes")
+	}
+
+	// Listing.
+	if cfg.ListingDeniedEACCES && !cfg.ListingDenied {
+		problem("ListingDeniedEACCES requires ListingDenied")
+	}
+
+	// Mtime metadata.
+	for _, layout := range cfg.MtimeLayouts {
+		if layout == "" {
+			problem("Illegal MtimeLayouts entry: %q", layout)
+		}
+	}
+
+	// Default metadata.
+	if _, err := gcsproxy.ParseDefaultMetadata(cfg.DefaultMetadata); err != nil {
+		problem("Illegal DefaultMetadata: %v", err)
+	}
+
+	if len(problems) != 0 {
+		err = &ServerConfigError{Problems: problems}
+		return
+	}
+
+	return
+}
+
+// Return true if the supplied name ends with a slash and consists of
+// components that are neither empty nor "." or "..".
+func isCleanDirName(name string) bool {
+	if !strings.HasSuffix(name, "/") {
+		return false
+	}
+
+	for _, c := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if c == "" || c == "." || c == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Return the object name prefix corresponding to ServerConfig.OnlyDir, ending
+// in a slash, or the empty string if the whole bucket is to be exported.
+func onlyDirPrefix(dir string) (prefix string) {
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return
+	}
+
+	prefix = dir + "/"
 	return
 }
 
@@ -212,7 +1035,7 @@ func ChooseTempDirLimitNumFiles() (limit int) {
 	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit)
 	if err != nil {
 		const defaultLimit = 512
-		log.Println(
+		log.Printf(
 			"Warning: failed to query RLIMIT_NOFILE. Using default "+
 				"file count limit of %d",
 			defaultLimit)
@@ -273,26 +1096,109 @@ type fileSystem struct {
 	bucket       gcs.Bucket
 	objectSyncer gcsproxy.ObjectSyncer
 	leaser       lease.FileLeaser
+	evictions    *gcsproxy.EvictionTracker
 
 	/////////////////////////
 	// Constant data
 	/////////////////////////
 
-	gcsChunkSize    uint64
-	implicitDirs    bool
-	dirTypeCacheTTL time.Duration
+	gcsChunkSize      uint64
+	readaheadChunks   int
+	validateChecksums bool
+	implicitDirs      bool
+	dirTypeCacheTTL   time.Duration
+	tombstoneTTL      time.Duration
+
+	// The prefix that ServerConfig.OnlyDir adds to inode names to make the
+	// names of objects in ServerConfig.Bucket.
+	objectNamePrefix string
+
+	// Whether directory handles may list the bucket. See
+	// ServerConfig.ListingDenied.
+	listing listingMode
+
+	// Which files are presented as decompressed views, and the size of the
+	// blocks in which their contents are cached.
+	gzipViews     inode.GzipViewConfig
+	gzipBlockSize int64
+
+	// Layouts for parsing mtime metadata. See ServerConfig.MtimeLayouts.
+	mtimeLayouts []string
+
+	// See ServerConfig.RejectSparseWritesOver.
+	rejectSparseWritesOver int64
+
+	// See ServerConfig.StableIdentity.
+	stableIdentity bool
+
+	// See ServerConfig.ReadOnly.
+	readOnly bool
+
+	// See ServerConfig.MaxOpenHandles and ServerConfig.HandleIdleTimeout.
+	maxOpenHandles    int
+	handleIdleTimeout time.Duration
+
+	// See ServerConfig.DirtySyncInterval.
+	dirtySyncInterval time.Duration
+
+	// See ServerConfig.IgnoreFlushErrors.
+	ignoreFlushErrors bool
+
+	// See ServerConfig.MaxPathDepth.
+	maxPathDepth int
+
+	// See ServerConfig.MaxChildrenPerDir. childCounts is nil if there is no
+	// limit.
+	maxChildrenPerDir int
+	childCounts       *childCounts
 
-	// The user and group owning everything in the file system.
-	uid uint32
-	gid uint32
+	// See ServerConfig.RenameDirLimit.
+	renameDirLimit int
+
+	// See ServerConfig.DirCacheTTL. Nil if the TTL is zero.
+	dirListings *dirListings
+
+	// See ServerConfig.NegativeTTL. Nil if the TTL is zero.
+	negativeLookups *negativeLookups
+
+	// See ServerConfig.StreamingReadThreshold. streamingWindow is the constant
+	// of the same name, except in tests.
+	streamingReadThreshold int64
+	streamingWindow        int
+
+	// See ServerConfig.AtimeMode and ServerConfig.AtimePersistInterval.
+	atimeMode            AtimeMode
+	atimePersistInterval time.Duration
+
+	// See ServerConfig.Counters. Never nil.
+	counters *Counters
+
+	// The user and group owning everything in the file system, and whether
+	// attempts to change them should fail. See ServerConfig.FixedOwner.
+	uid        uint32
+	gid        uint32
+	fixedOwner bool
+
+	// See ServerConfig.CheckPermissions.
+	checkPermissions bool
 
 	// Mode bits for all inodes.
 	fileMode os.FileMode
 	dirMode  os.FileMode
 
-	// A function that shuts down the garbage collector.
+	// A function that shuts down the garbage collector and the idle handle
+	// reaper.
 	stopGarbageCollecting func()
 
+	// A queue of kernel invalidations, or nil if we have no way to invalidate.
+	invalidations invalidation.Dispatcher
+
+	// See ServerConfig.ForgetObject. May be nil.
+	forgetObject func(name string)
+
+	// Passes only notifications that tell us something new.
+	notifications *notification.Filter
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -301,9 +1207,9 @@ type fileSystem struct {
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
 	mu syncutil.InvariantMutex
 
-	// The next inode ID to hand out. We assume that this will never overflow,
-	// since even if we were handing out inode IDs at 4 GHz, it would still take
-	// over a century to do so.
+	// The next inode ID to hand out, unless stableIdentity is set. We assume
+	// that this will never overflow, since even if we were handing out inode
+	// IDs at 4 GHz, it would still take over a century to do so.
 	//
 	// GUARDED_BY(mu)
 	nextInodeID fuseops.InodeID
@@ -311,7 +1217,8 @@ type fileSystem struct {
 	// The collection of live inodes, keyed by inode ID. No ID less than
 	// fuseops.RootInodeID is ever used.
 	//
-	// INVARIANT: For all keys k, fuseops.RootInodeID <= k < nextInodeID
+	// INVARIANT: For all keys k, fuseops.RootInodeID <= k
+	// INVARIANT: If !stableIdentity, for all keys k, k < nextInodeID
 	// INVARIANT: For all keys k, inodes[k].ID() == k
 	// INVARIANT: inodes[fuseops.RootInodeID] is missing or of type inode.DirInode
 	// INVARIANT: For all v, if IsDirName(v.Name()) then v is inode.DirInode
@@ -365,13 +1272,66 @@ type fileSystem struct {
 	// GUARDED_BY(mu)
 	implicitDirInodes map[string]inode.DirInode
 
+	// Directory inodes found to no longer exist in GCS, keyed by name, whose
+	// descendants are to be treated likewise when next used. An entry is
+	// removed when its inode is forgotten or a directory of the same name is
+	// found again. See deleted_dirs.go.
+	//
+	// INVARIANT: For each k/v, v.Name() == k
+	// INVARIANT: For each value v, inodes[v.ID()] == v
+	//
+	// GUARDED_BY(mu)
+	deletedDirs map[string]inode.DirInode
+
 	// The collection of live handles, keyed by handle ID.
 	//
-	// INVARIANT: All values are of type *dirHandle
+	// INVARIANT: All values are of type *dirHandle or *fileHandle
 	//
 	// GUARDED_BY(mu)
 	handles map[fuseops.HandleID]interface{}
 
+	// The number of handles that have not been reaped.
+	//
+	// INVARIANT: liveHandles >= 0
+	// INVARIANT: liveHandles == number of values h in handles such that
+	//            !lifecycleOf(h).reaped
+	//
+	// GUARDED_BY(mu)
+	liveHandles int
+
+	// The number of handles that opens in progress have reserved room for with
+	// reserveHandle, but not yet allocated.
+	//
+	// INVARIANT: reservedHandles >= 0
+	//
+	// GUARDED_BY(mu)
+	reservedHandles int
+
+	// The number of file handles in handles for each inode.
+	//
+	// INVARIANT: For each key k, the number of values in handles of type
+	//            *fileHandle whose inode has ID k
+	// INVARIANT: All values are positive
+	//
+	// GUARDED_BY(mu)
+	fileHandleCounts map[fuseops.InodeID]int
+
+	// The number of opens that have failed because of maxOpenHandles.
+	//
+	// GUARDED_BY(mu)
+	handleLimitRejections uint64
+
+	// The number of steps in releasing handles that have failed. See
+	// runReleaseSteps.
+	//
+	// GUARDED_BY(mu)
+	releaseFailures uint64
+
+	// If non-nil, called before each step in releasing a handle with the name
+	// of the step. If it returns an error, the step is treated as having failed
+	// with that error. For testing only.
+	releaseStepHook func(step string) error
+
 	// The next handle ID to hand out. We assume that this will never overflow.
 	//
 	// INVARIANT: For all keys k in handles, k < nextHandleID
@@ -396,9 +1356,14 @@ func (fs *fileSystem) checkInvariants() {
 	// inodes
 	//////////////////////////////////
 
-	// INVARIANT: For all keys k, fuseops.RootInodeID <= k < nextInodeID
+	// INVARIANT: For all keys k, fuseops.RootInodeID <= k
+	// INVARIANT: If !stableIdentity, for all keys k, k < nextInodeID
 	for id, _ := range fs.inodes {
-		if id < fuseops.RootInodeID || id >= fs.nextInodeID {
+		if id < fuseops.RootInodeID {
+			panic(fmt.Sprintf("Illegal inode ID: %v", id))
+		}
+
+		if !fs.stableIdentity && id >= fs.nextInodeID {
 			panic(fmt.Sprintf("Illegal inode ID: %v", id))
 		}
 	}
@@ -512,34 +1477,119 @@ func (fs *fileSystem) checkInvariants() {
 	}
 
 	//////////////////////////////////
-	// handles
+	// deletedDirs
 	//////////////////////////////////
 
-	// INVARIANT: All values are of type *dirHandle
-	for _, h := range fs.handles {
-		_ = h.(*dirHandle)
+	for k, v := range fs.deletedDirs {
+		// INVARIANT: For each k/v, v.Name() == k
+		if v.Name() != k {
+			panic(fmt.Sprintf("Unexpected name: %q vs. %q", v.Name(), k))
+		}
+
+		// INVARIANT: For each value v, inodes[v.ID()] == v
+		if fs.inodes[v.ID()] != v {
+			panic(fmt.Sprintf("Deleted dir %q has been forgotten", k))
+		}
 	}
 
 	//////////////////////////////////
-	// nextHandleID
+	// handles
 	//////////////////////////////////
 
-	// INVARIANT: For all keys k in handles, k < nextHandleID
-	for k, _ := range fs.handles {
+	// INVARIANT: All values are of type *dirHandle or *fileHandle
+	for _, h := range fs.handles {
+		switch h.(type) {
+		case *dirHandle:
+		case *fileHandle:
+		default:
+			panic(fmt.Sprintf("Unexpected handle type: %T", h))
+		}
+	}
+
+	//////////////////////////////////
+	// liveHandles
+	//////////////////////////////////
+
+	// INVARIANT: liveHandles >= 0
+	if fs.liveHandles < 0 {
+		panic(fmt.Sprintf("Negative live handle count: %d", fs.liveHandles))
+	}
+
+	// INVARIANT: reservedHandles >= 0
+	if fs.reservedHandles < 0 {
+		panic(fmt.Sprintf("Negative reserved handle count: %d", fs.reservedHandles))
+	}
+
+	// INVARIANT: liveHandles == number of values h in handles such that
+	//            !lifecycleOf(h).reaped
+	{
+		var live int
+		for _, h := range fs.handles {
+			if !lifecycleOf(h).reaped {
+				live++
+			}
+		}
+
+		if live != fs.liveHandles {
+			panic(fmt.Sprintf(
+				"Live handle mismatch: %d vs. %d",
+				live,
+				fs.liveHandles))
+		}
+	}
+
+	//////////////////////////////////
+	// fileHandleCounts
+	//////////////////////////////////
+
+	// INVARIANT: For each key k, the number of values in handles of type
+	//            *fileHandle whose inode has ID k
+	// INVARIANT: All values are positive
+	{
+		counts := make(map[fuseops.InodeID]int)
+		for _, h := range fs.handles {
+			if fh, ok := h.(*fileHandle); ok {
+				counts[fh.in.ID()]++
+			}
+		}
+
+		if !reflect.DeepEqual(counts, fs.fileHandleCounts) {
+			panic(fmt.Sprintf(
+				"File handle count mismatch: %v vs. %v",
+				counts,
+				fs.fileHandleCounts))
+		}
+	}
+
+	//////////////////////////////////
+	// nextHandleID
+	//////////////////////////////////
+
+	// INVARIANT: For all keys k in handles, k < nextHandleID
+	for k, _ := range fs.handles {
 		if k >= fs.nextHandleID {
 			panic(fmt.Sprintf("Illegal handle ID: %v", k))
 		}
 	}
 }
 
+// Schedule the kernel's cached state for the supplied inode to be thrown
+// away, if we are able to do so. Never blocks.
+func (fs *fileSystem) invalidateInode(id fuseops.InodeID) {
+	if fs.invalidations == nil {
+		return
+	}
+
+	fs.invalidations.Invalidate(id)
+}
+
 // Implementation detail of lookUpOrCreateInodeIfNotStale; do not use outside
 // of that function.
 //
 // LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 	// Choose an ID.
-	id := fs.nextInodeID
-	fs.nextInodeID++
+	id := fs.chooseInodeID(name)
 
 	// Create the inode.
 	switch {
@@ -555,6 +1605,8 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 			},
 			fs.implicitDirs,
 			fs.dirTypeCacheTTL,
+			fs.tombstoneTTL,
+			fs.gzipViews,
 			fs.bucket,
 			fs.clock)
 
@@ -570,6 +1622,8 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 			},
 			fs.implicitDirs,
 			fs.dirTypeCacheTTL,
+			fs.tombstoneTTL,
+			fs.gzipViews,
 			fs.bucket,
 			fs.clock)
 
@@ -583,6 +1637,21 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mode: fs.fileMode | os.ModeSymlink,
 			})
 
+	case fs.gzipViews.IsView(o.Name):
+		in = inode.NewDecompressedFileInode(
+			id,
+			o,
+			fuseops.InodeAttributes{
+				Uid:  fs.uid,
+				Gid:  fs.gid,
+				Mode: fs.fileMode,
+			},
+			fs.gzipBlockSize,
+			fs.mtimeLayouts,
+			fs.bucket,
+			fs.leaser,
+			fs.clock)
+
 	default:
 		in = inode.NewFileInode(
 			id,
@@ -593,8 +1662,12 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mode: fs.fileMode,
 			},
 			fs.gcsChunkSize,
+			fs.readaheadChunks,
+			fs.validateChecksums,
+			fs.mtimeLayouts,
 			fs.bucket,
 			fs.leaser,
+			fs.evictions,
 			fs.objectSyncer,
 			fs.clock)
 	}
@@ -678,6 +1751,13 @@ func (fs *fileSystem) lookUpOrCreateInodeIfNotStale(
 		fs.mu.Unlock()
 		existingInode.Lock()
 
+		// A newer generation may be the one that a write-back in progress is
+		// creating. Wait to find out.
+		if f, ok := existingInode.(*inode.FileInode); ok &&
+			o.Generation > f.SourceGeneration() {
+			f.WaitForWriteBack()
+		}
+
 		// Have we found the correct inode?
 		if o.Generation == existingInode.SourceGeneration() {
 			in = existingInode
@@ -704,7 +1784,17 @@ func (fs *fileSystem) lookUpOrCreateInodeIfNotStale(
 			in = fs.mintInode(o.Name, o)
 			fs.generationBackedInodes[in.Name()] = in.(GenerationBackedInode)
 
+			// The kernel may have cached attributes or content for the old inode
+			// that no longer reflect what's in GCS.
+			fs.invalidateInode(existingInode.ID())
+
 			fs.mu.Unlock()
+
+			// Nor is there any point in us keeping the contents of older
+			// generations around at the expense of other objects.
+			fs.leaser.RevokeReadLeasesMatching(
+				gcsproxy.GenerationsBefore(o.Name, o.Generation))
+
 			existingInode.Unlock()
 			in.Lock()
 
@@ -757,6 +1847,7 @@ func (fs *fileSystem) lookUpOrCreateChildInode(
 		}
 
 		if !result.Exists() {
+			fs.noteChildNotFound(parent, childName)
 			err = fuse.ENOENT
 			return
 		}
@@ -765,8 +1856,14 @@ func (fs *fileSystem) lookUpOrCreateChildInode(
 		fs.mu.Lock()
 		child = fs.lookUpOrCreateInodeIfNotStale(result.FullName, result.Object)
 		if child != nil {
+			if d, ok := child.(inode.DirInode); ok {
+				fs.noteDirFound(d)
+			}
+
 			return
 		}
+
+		fs.counters.recordLookUpRetry()
 	}
 
 	err = fmt.Errorf("Did not converge after %v tries", maxTries)
@@ -783,6 +1880,24 @@ func (fs *fileSystem) syncFile(
 	f *inode.FileInode) (err error) {
 	// Sync the inode.
 	err = f.Sync(ctx)
+	if ce, ok := err.(*inode.ClobberedError); ok {
+		logger.Errorf(
+			"Sync abandoned: clobbered name=%q expected_generation=%d "+
+				"observed_generation=%d",
+			ce.Name,
+			ce.Expected,
+			ce.Observed)
+
+		err = errStale
+		return
+	}
+
+	if ee, ok := err.(*gcsproxy.EncryptionError); ok {
+		logger.Errorf("Sync refused: %v", ee)
+		err = errEncrypted
+		return
+	}
+
 	if err != nil {
 		err = fmt.Errorf("FileInode.Sync: %v", err)
 		return
@@ -801,6 +1916,97 @@ func (fs *fileSystem) syncFile(
 	return
 }
 
+// Sync every file inode with local modifications, carrying on past failures.
+// Return the number synced and the first error.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) syncDirtyFiles(ctx context.Context) (n int, err error) {
+	n, err = fs.syncFilesDirtiedBefore(ctx, time.Time{})
+	return
+}
+
+// Like syncDirtyFiles, but leave alone files modified after the cutoff. A zero
+// cutoff matches every dirty file.
+//
+// Files are written back without holding their inode locks while uploading,
+// so they remain usable in the meantime. Writes that race with the upload are
+// carried over onto the newly written generation, rather than being lost. See
+// inode.FileInode.WriteBack.
+//
+// Files known to have been clobbered are skipped, since writing them out can
+// only fail: those for which a sync has found so, and those that a lookup has
+// replaced with an inode for a newer generation.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) syncFilesDirtiedBefore(
+	ctx context.Context,
+	cutoff time.Time) (n int, err error) {
+	// Find the file inodes.
+	var files []*inode.FileInode
+
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok {
+			files = append(files, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	// Sync those that are dirty.
+	for _, f := range files {
+		f.Lock()
+
+		mtime, dirty, dirtyErr := f.DirtyMtime(ctx)
+		if !cutoff.IsZero() && mtime.After(cutoff) {
+			dirty = false
+		}
+
+		// Files that can never be synced have already said so.
+		if f.Stale() != nil {
+			dirty = false
+		}
+
+		fs.mu.Lock()
+		if fs.generationBackedInodes[f.Name()] != f {
+			dirty = false
+		}
+		fs.mu.Unlock()
+
+		var syncErr error
+		if dirtyErr == nil && dirty {
+			syncErr = f.WriteBack(ctx)
+			if syncErr == nil {
+				n++
+			}
+		}
+
+		f.Unlock()
+
+		for _, e := range []error{dirtyErr, syncErr} {
+			if e == nil {
+				continue
+			}
+
+			logger.Errorf("Syncing %q: %v", f.Name(), e)
+			if err == nil {
+				err = fmt.Errorf("%q: %v", f.Name(), e)
+			}
+		}
+	}
+
+	return
+}
+
+// Sync files that have been dirty for longer than dirtySyncInterval
+// periodically until the context is cancelled. Failures have already been
+// logged by syncFilesDirtiedBefore, and the files remain dirty to be tried
+// again next time.
+func (fs *fileSystem) syncDirtyFilesPeriodically(ctx context.Context) {
+	fs.runPeriodically(ctx, fs.dirtySyncInterval/2, func() {
+		fs.syncFilesDirtiedBefore(ctx, fs.clock.Now().Add(-fs.dirtySyncInterval))
+	})
+}
+
 // Decrement the supplied inode's lookup count, destroying it if the inode says
 // that it has hit zero.
 //
@@ -819,8 +2025,10 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 
 	// Update file system state, orphaning the inode if we're going to destroy it
 	// below.
+	var indexed bool
 	if shouldDestroy {
 		delete(fs.inodes, in.ID())
+		indexed = fs.generationBackedInodes[name] == in
 
 		// Update indexes if necessary.
 		if fs.generationBackedInodes[name] == in {
@@ -830,6 +2038,14 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 		if fs.implicitDirInodes[name] == in {
 			delete(fs.implicitDirInodes, name)
 		}
+
+		if fs.deletedDirs[name] == in {
+			delete(fs.deletedDirs, name)
+		}
+
+		if inode.IsDirName(name) {
+			fs.childCounts.Forget(name)
+		}
 	}
 
 	// We are done with the file system.
@@ -837,15 +2053,51 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 
 	// Now we can destroy the inode if necessary.
 	if shouldDestroy {
+		if f, ok := in.(*inode.FileInode); ok && indexed {
+			fs.writeOutBeforeDestroying(f)
+		}
+
 		destroyErr := in.Destroy()
 		if destroyErr != nil {
-			log.Printf("Error destroying inode %q: %v", name, destroyErr)
+			logger.Errorf("Error destroying inode %q: %v", name, destroyErr)
 		}
 	}
 
 	in.Unlock()
 }
 
+// Make a last attempt to write out the modifications to a file inode that is
+// about to be destroyed, which a flush whose error was ignored may have left
+// dirty. If this fails too, the modifications are lost, which is logged. The
+// inode must still have been the one for its name; if not, it has been
+// unlinked or replaced, and writing it out would clobber the object.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(f)
+func (fs *fileSystem) writeOutBeforeDestroying(f *inode.FileInode) {
+	if !fs.ignoreFlushErrors {
+		return
+	}
+
+	ctx := context.Background()
+	dirty, _, err := f.Dirty(ctx)
+	if err == nil && !dirty {
+		return
+	}
+
+	if err == nil {
+		err = fs.syncFile(ctx, f)
+	}
+
+	if err != nil {
+		logger.Errorf(
+			"LOST modifications to %q, which could not be written to GCS before "+
+				"the kernel forgot the file: %v",
+			f.Name(),
+			err)
+	}
+}
+
 // A helper function for use after incrementing an inode's lookup count.
 // Ensures that the lookup count is decremented again if the caller is going to
 // return in error (in which case the kernel and gcsfuse would otherwise
@@ -888,6 +2140,10 @@ func (fs *fileSystem) unlockAndMaybeDisposeOfInode(
 
 func (fs *fileSystem) Destroy() {
 	fs.stopGarbageCollecting()
+
+	if fs.invalidations != nil {
+		fs.invalidations.Stop()
+	}
 }
 
 // LOCKS_EXCLUDED(fs.mu)
@@ -898,8 +2154,53 @@ func (fs *fileSystem) LookUpInode(
 	parent := fs.inodes[op.Parent].(inode.DirInode)
 	fs.mu.Unlock()
 
+	// Refuse to go deeper than allowed.
+	if childrenTooDeep(parent, fs.maxPathDepth) {
+		fs.counters.recordPathDepthLookupRejected()
+		err = errPathTooDeep
+		return
+	}
+
+	// Fail fast if the parent has gone away.
+	parent.Lock()
+	err = fs.checkDirExists(parent)
+	parent.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	// Fail fast if a recent listing of the parent doesn't have the name. Views
+	// listed without their suffix may be looked up by either name, so the
+	// listing can't be trusted for suffixed names.
+	if !(fs.gzipViews.DropSuffix && fs.gzipViews.IsView(op.Name)) &&
+		fs.dirListings.Missing(parent.Name(), op.Name) {
+		err = fuse.ENOENT
+		return
+	}
+
+	// Fail fast if the name was recently found not to exist. A zero child ID
+	// tells the kernel that the name doesn't exist, and to remember that until
+	// the entry expires.
+	childName := parent.Name() + op.Name
+	if expiration := fs.negativeLookups.Missing(childName); !expiration.IsZero() {
+		op.Entry.EntryExpiration = expiration
+		return
+	}
+
+	epoch := fs.negativeLookups.Begin()
+
 	// Find or create the child inode.
 	child, err := fs.lookUpOrCreateChildInode(op.Context(), parent, op.Name)
+	if err == fuse.ENOENT {
+		if expiration := fs.negativeLookups.Insert(childName, epoch); !expiration.IsZero() {
+			op.Entry.EntryExpiration = expiration
+			err = nil
+		}
+
+		return
+	}
+
 	if err != nil {
 		return
 	}
@@ -908,7 +2209,8 @@ func (fs *fileSystem) LookUpInode(
 
 	// Fill out the response.
 	op.Entry.Child = child.ID()
-	if op.Entry.Attributes, err = child.Attributes(op.Context()); err != nil {
+	op.Entry.Attributes, err = fs.getAttributes(op.Context(), child)
+	if err != nil {
 		return
 	}
 
@@ -927,7 +2229,7 @@ func (fs *fileSystem) GetInodeAttributes(
 	defer in.Unlock()
 
 	// Grab its attributes.
-	op.Attributes, err = in.Attributes(op.Context())
+	op.Attributes, err = fs.getAttributes(op.Context(), in)
 	if err != nil {
 		return
 	}
@@ -938,6 +2240,22 @@ func (fs *fileSystem) GetInodeAttributes(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) SetInodeAttributes(
 	op *fuseops.SetInodeAttributesOp) (err error) {
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly &&
+		(op.Size != nil || op.Mode != nil || op.Atime != nil || op.Mtime != nil) {
+		err = errReadOnlyFS
+		return
+	}
+
+	// Refuse to change the owner if the user chose it. Changing it to what it
+	// already is, as cp -p and friends do, is harmless.
+	if fs.fixedOwner &&
+		((op.Uid != nil && *op.Uid != fs.uid) ||
+			(op.Gid != nil && *op.Gid != fs.gid)) {
+		err = errChownFixedOwner
+		return
+	}
+
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.inodes[op.Inode]
@@ -946,12 +2264,24 @@ func (fs *fileSystem) SetInodeAttributes(
 	in.Lock()
 	defer in.Unlock()
 
-	// The only thing we support changing is size, and then only for directories.
-	if op.Mode != nil || op.Atime != nil || op.Mtime != nil {
+	// The only things we support changing are size, modification time and, if
+	// we track them, access times, and then only for files. utimes(2) sets both
+	// times at once, so when we don't track access times we ignore them if the
+	// modification time is being set too.
+	if op.Mode != nil {
 		err = fuse.ENOSYS
 		return
 	}
 
+	if op.Atime != nil && fs.atimeMode == AtimeOff {
+		if op.Mtime == nil {
+			err = fuse.ENOSYS
+			return
+		}
+
+		op.Atime = nil
+	}
+
 	file, ok := in.(*inode.FileInode)
 	if !ok {
 		err = fuse.ENOSYS
@@ -960,14 +2290,38 @@ func (fs *fileSystem) SetInodeAttributes(
 
 	// Set the size, if specified.
 	if op.Size != nil {
-		if err = file.Truncate(op.Context(), int64(*op.Size)); err != nil {
-			err = fmt.Errorf("Truncate: %v", err)
+		if file.IsDecompressedView() {
+			err = errViewReadOnly
+			return
+		}
+
+		err = fs.truncateFile(op.Context(), file, *op.Size)
+		if err != nil {
+			return
+		}
+	}
+
+	// Set the modification time, if specified.
+	if op.Mtime != nil {
+		if file.IsDecompressedView() {
+			err = errViewReadOnly
+			return
+		}
+
+		err = file.SetMtime(op.Context(), *op.Mtime)
+		if err != nil {
+			err = fmt.Errorf("SetMtime: %v", err)
 			return
 		}
 	}
 
+	// Set the access time, if specified.
+	if op.Atime != nil {
+		file.SetAtime(*op.Atime)
+	}
+
 	// Fill in the response.
-	op.Attributes, err = in.Attributes(op.Context())
+	op.Attributes, err = fs.getAttributes(op.Context(), in)
 	if err != nil {
 		return
 	}
@@ -996,15 +2350,45 @@ func (fs *fileSystem) ForgetInode(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) MkDir(
 	op *fuseops.MkDirOp) (err error) {
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
 	// Find the parent.
 	fs.mu.Lock()
 	parent := fs.inodes[op.Parent].(inode.DirInode)
 	fs.mu.Unlock()
 
+	if childrenTooDeep(parent, fs.maxPathDepth) {
+		err = errPathTooDeep
+		return
+	}
+
+	err = fs.checkChildQuota(parent)
+	if err != nil {
+		return
+	}
+
+	// Nothing may be created in a directory that has gone away.
+	parent.Lock()
+	err = fs.checkDirExists(parent)
+	parent.Unlock()
+
+	if err != nil {
+		return
+	}
+
 	// Create an empty backing object for the child, failing if it already
 	// exists.
 	parent.Lock()
 	o, err := parent.CreateChildDir(op.Context(), op.Name)
+	if err == nil {
+		fs.childCounts.Created(parent.Name())
+	}
+	fs.dirListings.Invalidate(parent.Name())
+	fs.negativeLookups.Erase(parent.Name() + op.Name)
 	parent.Unlock()
 
 	// Special case: *gcs.PreconditionError means the name already exists.
@@ -1033,7 +2417,7 @@ func (fs *fileSystem) MkDir(
 
 	// Fill out the response.
 	op.Entry.Child = child.ID()
-	op.Entry.Attributes, err = child.Attributes(op.Context())
+	op.Entry.Attributes, err = fs.getAttributes(op.Context(), child)
 
 	if err != nil {
 		err = fmt.Errorf("Attributes: %v", err)
@@ -1046,15 +2430,65 @@ func (fs *fileSystem) MkDir(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) CreateFile(
 	op *fuseops.CreateFileOp) (err error) {
-	// Find the parent.
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
+	err = fs.checkAccess(op.Header(), fs.dirMode, accessModifyDir)
+	if err != nil {
+		return
+	}
+
+	// Find the parent, and make sure we'll be able to open the child before
+	// creating it.
 	fs.mu.Lock()
 	parent := fs.inodes[op.Parent].(inode.DirInode)
+	err = fs.reserveHandle()
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
+	reserved := true
+	defer func() {
+		if reserved {
+			fs.mu.Lock()
+			fs.unreserveHandle()
+			fs.mu.Unlock()
+		}
+	}()
+
+	if childrenTooDeep(parent, fs.maxPathDepth) {
+		err = errPathTooDeep
+		return
+	}
+
+	err = fs.checkChildQuota(parent)
+	if err != nil {
+		return
+	}
+
+	// Nothing may be created in a directory that has gone away.
+	parent.Lock()
+	err = fs.checkDirExists(parent)
+	parent.Unlock()
+
+	if err != nil {
+		return
+	}
+
 	// Create an empty backing object for the child, failing if it already
-	// exists.
+	// exists. So there is nothing for O_TRUNC in op.Flags to do.
 	parent.Lock()
 	o, err := parent.CreateChildFile(op.Context(), op.Name)
+	if err == nil {
+		fs.childCounts.Created(parent.Name())
+	}
+	fs.dirListings.Invalidate(parent.Name())
+	fs.negativeLookups.Erase(parent.Name() + op.Name)
 	parent.Unlock()
 
 	// Special case: *gcs.PreconditionError means the name already exists.
@@ -1083,27 +2517,77 @@ func (fs *fileSystem) CreateFile(
 
 	// Fill out the response.
 	op.Entry.Child = child.ID()
-	op.Entry.Attributes, err = child.Attributes(op.Context())
+	op.Entry.Attributes, err = fs.getAttributes(op.Context(), child)
 
 	if err != nil {
 		err = fmt.Errorf("Attributes: %v", err)
 		return
 	}
 
+	// Allocate the handle we reserved room for.
+	fs.mu.Lock()
+	op.Handle = fs.allocateReservedHandle(
+		&fileHandle{in: child.(*inode.FileInode)})
+	reserved = false
+	fs.mu.Unlock()
+
 	return
 }
 
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) CreateSymlink(
 	op *fuseops.CreateSymlinkOp) (err error) {
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
+	// The target is stored in custom metadata, which GCS would reject with an
+	// opaque error if it's malformed or too large. Say so now instead.
+	metadata := map[string]string{inode.SymlinkMetadataKey: op.Target}
+	switch inode.CheckCustomMetadata(metadata) {
+	case inode.ErrMetadataInvalid:
+		err = errTargetInvalid
+		return
+
+	case inode.ErrMetadataTooLarge:
+		err = errTargetTooLarge
+		return
+	}
+
 	// Find the parent.
 	fs.mu.Lock()
 	parent := fs.inodes[op.Parent].(inode.DirInode)
 	fs.mu.Unlock()
 
+	if childrenTooDeep(parent, fs.maxPathDepth) {
+		err = errPathTooDeep
+		return
+	}
+
+	err = fs.checkChildQuota(parent)
+	if err != nil {
+		return
+	}
+
+	// Nothing may be created in a directory that has gone away.
+	parent.Lock()
+	err = fs.checkDirExists(parent)
+	parent.Unlock()
+
+	if err != nil {
+		return
+	}
+
 	// Create the object in GCS, failing if it already exists.
 	parent.Lock()
 	o, err := parent.CreateChildSymlink(op.Context(), op.Name, op.Target)
+	if err == nil {
+		fs.childCounts.Created(parent.Name())
+	}
+	fs.dirListings.Invalidate(parent.Name())
+	fs.negativeLookups.Erase(parent.Name() + op.Name)
 	parent.Unlock()
 
 	// Special case: *gcs.PreconditionError means the name already exists.
@@ -1132,7 +2616,7 @@ func (fs *fileSystem) CreateSymlink(
 
 	// Fill out the response.
 	op.Entry.Child = child.ID()
-	op.Entry.Attributes, err = child.Attributes(op.Context())
+	op.Entry.Attributes, err = fs.getAttributes(op.Context(), child)
 
 	if err != nil {
 		err = fmt.Errorf("Attributes: %v", err)
@@ -1145,7 +2629,13 @@ func (fs *fileSystem) CreateSymlink(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) RmDir(
 	op *fuseops.RmDirOp) (err error) {
-	// Find the parent. We assume that it exists because otherwise the kernel has
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
+	// Find the parent. We assume that it exists because otherwise the kernel has
 	// done something mildly concerning.
 	fs.mu.Lock()
 	parent := fs.inodes[op.Parent].(inode.DirInode)
@@ -1213,6 +2703,10 @@ func (fs *fileSystem) RmDir(
 	// Delete the backing object.
 	parent.Lock()
 	err = parent.DeleteChildDir(op.Context(), op.Name)
+	if err == nil {
+		fs.childCounts.Deleted(parent.Name())
+	}
+	fs.dirListings.Invalidate(parent.Name(), childDir.Name())
 	parent.Unlock()
 
 	if err != nil {
@@ -1226,12 +2720,28 @@ func (fs *fileSystem) RmDir(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) Rename(
 	op *fuseops.RenameOp) (err error) {
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
 	// Find the old and new parents.
 	fs.mu.Lock()
 	oldParent := fs.inodes[op.OldParent].(inode.DirInode)
 	newParent := fs.inodes[op.NewParent].(inode.DirInode)
 	fs.mu.Unlock()
 
+	// Whatever happens, don't keep listings from before, or think the new name
+	// is missing.
+	defer fs.dirListings.Invalidate(oldParent.Name(), newParent.Name())
+	defer fs.negativeLookups.Erase(newParent.Name() + op.NewName)
+
+	if childrenTooDeep(newParent, fs.maxPathDepth) {
+		err = errPathTooDeep
+		return
+	}
+
 	// Find the object in the old location.
 	oldParent.Lock()
 	lr, err := oldParent.LookUpChild(op.Context(), op.OldName)
@@ -1247,34 +2757,91 @@ func (fs *fileSystem) Rename(
 		return
 	}
 
-	// We don't support renaming directories.
+	// Directories are handled separately.
 	if inode.IsDirName(lr.FullName) {
-		err = fuse.ENOSYS
+		err = fs.renameDir(op, oldParent, newParent, lr.FullName)
+		return
+	}
+
+	// Nor decompressed views, which would silently change the contents seen
+	// under the new name.
+	if fs.gzipViews.IsView(lr.FullName) {
+		err = errViewReadOnly
 		return
 	}
 
-	// Clone into the new location.
+	// If the source is open with local modifications, write them out first so
+	// that they go along with the rename rather than being lost.
+	src, err := fs.syncRenameSource(op.Context(), lr.Object)
+	if err != nil {
+		err = fmt.Errorf("syncRenameSource: %v", err)
+		return
+	}
+
+	// Clone into the new location. This replaces any existing object there in
+	// one step, so readers of the new name see either the old or new contents.
 	newParent.Lock()
 	_, err = newParent.CloneToChildFile(
 		op.Context(),
 		op.NewName,
-		lr.Object)
+		src)
 	newParent.Unlock()
 
+	// The generation we looked up may have vanished in the meantime, for
+	// example because an earlier attempt at this same rename, whose reply the
+	// kernel didn't wait for, has since moved it. If so the result the
+	// application asked for may already be in place.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		var done bool
+		done, err = fs.renameAlreadyDone(op, newParent, src)
+		if err != nil {
+			err = fmt.Errorf("renameAlreadyDone: %v", err)
+			return
+		}
+
+		if done {
+			op.Logf(
+				"Rename: %q generation %d already moved to %q; treating as success",
+				src.Name,
+				src.Generation,
+				op.NewName)
+
+			return
+		}
+
+		err = fuse.ENOENT
+		return
+	}
+
 	if err != nil {
 		err = fmt.Errorf("CloneToChildFile: %v", err)
 		return
 	}
 
-	// Delete behind. Make sure to delete exactly the generation we cloned, in
-	// case the referent of the name has changed in the meantime.
+	// Delete behind. Make sure to delete only the generation we cloned, in case
+	// the referent of the name has changed in the meantime. If it has, the
+	// destination holds stale contents and the source must be left alone.
 	oldParent.Lock()
 	err = oldParent.DeleteChildFile(
 		op.Context(),
 		op.OldName,
-		lr.Object.Generation)
+		src.Generation)
+	if err == nil {
+		fs.childCounts.Deleted(oldParent.Name())
+	}
 	oldParent.Unlock()
 
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		op.Logf(
+			"Rename: %q changed from generation %d while being copied to %q",
+			src.Name,
+			src.Generation,
+			op.NewName)
+
+		err = errRenameStale
+		return
+	}
+
 	if err != nil {
 		err = fmt.Errorf("DeleteChildFile: %v", err)
 		return
@@ -1283,9 +2850,102 @@ func (fs *fileSystem) Rename(
 	return
 }
 
+// If the file inode for the supplied source object of a rename has local
+// modifications, sync it and return the object it now reflects. Otherwise
+// return o.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) syncRenameSource(
+	ctx context.Context,
+	o *gcs.Object) (src *gcs.Object, err error) {
+	src = o
+
+	fs.mu.Lock()
+	f, _ := fs.generationBackedInodes[o.Name].(*inode.FileInode)
+	fs.mu.Unlock()
+
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.WaitForWriteBack()
+
+	// If the inode is for some other generation, it's not what we're renaming.
+	if f.SourceGeneration() != o.Generation {
+		return
+	}
+
+	dirty, _, err := f.Dirty(ctx)
+	if err != nil {
+		err = fmt.Errorf("Dirty: %v", err)
+		return
+	}
+
+	if !dirty {
+		return
+	}
+
+	err = fs.syncFile(ctx, f)
+	if err != nil {
+		return
+	}
+
+	synced := f.Source()
+	src = &synced
+
+	return
+}
+
+// Having failed to clone src for the supplied rename op because it no longer
+// exists, find out whether the destination already holds a later copy of it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(newParent)
+func (fs *fileSystem) renameAlreadyDone(
+	op *fuseops.RenameOp,
+	newParent inode.DirInode,
+	src *gcs.Object) (done bool, err error) {
+	newParent.Lock()
+	lr, err := newParent.LookUpChild(op.Context(), op.NewName)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %v", err)
+		return
+	}
+
+	dst := lr.Object
+	if dst == nil || dst.Generation <= src.Generation {
+		return
+	}
+
+	// Copying preserves contents and metadata.
+	done = dst.Size == src.Size &&
+		dst.CRC32C == src.CRC32C &&
+		(dst.MD5 == nil || src.MD5 == nil || *dst.MD5 == *src.MD5) &&
+		dst.ContentType == src.ContentType &&
+		reflect.DeepEqual(dst.Metadata, src.Metadata)
+
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) Unlink(
 	op *fuseops.UnlinkOp) (err error) {
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
+	err = fs.checkAccess(op.Header(), fs.dirMode, accessModifyDir)
+	if err != nil {
+		return
+	}
+
 	// Find the parent.
 	fs.mu.Lock()
 	parent := fs.inodes[op.Parent].(inode.DirInode)
@@ -1294,17 +2954,36 @@ func (fs *fileSystem) Unlink(
 	parent.Lock()
 	defer parent.Unlock()
 
+	// Decompressed views may not be removed. Their names may have been listed
+	// with the suffix dropped, so we must look them up to find out.
+	if len(fs.gzipViews.Suffixes) != 0 {
+		var lr inode.LookUpResult
+		lr, err = parent.LookUpChild(op.Context(), op.Name)
+		if err != nil {
+			err = fmt.Errorf("LookUpChild: %v", err)
+			return
+		}
+
+		if lr.Object != nil && fs.gzipViews.IsView(lr.FullName) {
+			err = errViewReadOnly
+			return
+		}
+	}
+
 	// Delete the backing object.
 	err = parent.DeleteChildFile(
 		op.Context(),
 		op.Name,
 		0) // Latest generation
 
+	fs.dirListings.Invalidate(parent.Name())
 	if err != nil {
 		err = fmt.Errorf("DeleteChildFile: %v", err)
 		return
 	}
 
+	fs.childCounts.Deleted(parent.Name())
+
 	return
 }
 
@@ -1320,11 +2999,20 @@ func (fs *fileSystem) OpenDir(
 	in := fs.inodes[op.Inode].(inode.DirInode)
 
 	// Allocate a handle.
-	handleID := fs.nextHandleID
-	fs.nextHandleID++
-
-	fs.handles[handleID] = newDirHandle(in, fs.implicitDirs)
-	op.Handle = handleID
+	dh := newDirHandle(
+		in,
+		fs.implicitDirs,
+		fs.listing,
+		fs.maxPathDepth,
+		fs.childCounts,
+		fs.dirListings,
+		fs.negativeLookups,
+		fs.counters)
+
+	op.Handle, err = fs.allocateHandle(dh)
+	if err != nil {
+		return
+	}
 
 	return
 }
@@ -1334,14 +3022,39 @@ func (fs *fileSystem) ReadDir(
 	op *fuseops.ReadDirOp) (err error) {
 	// Find the handle.
 	fs.mu.Lock()
-	dh := fs.handles[op.Handle].(*dirHandle)
+	h, err := fs.useHandle(op.Handle)
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
+	dh := h.(*dirHandle)
+
 	dh.Mu.Lock()
 	defer dh.Mu.Unlock()
 
-	// Serve the request.
+	// Fail fast if the directory has gone away.
+	dh.in.Lock()
+	err = fs.checkDirExists(dh.in)
+	dh.in.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	// Serve the request. If listing showed that the directory has gone away,
+	// make sure that everybody finds out.
 	err = dh.ReadDir(op)
+	if err == fuse.ENOENT {
+		dh.in.Lock()
+		if dh.in.DeletedRemotely() {
+			fs.mu.Lock()
+			fs.noteDirDeleted(dh.in)
+			fs.mu.Unlock()
+		}
+		dh.in.Unlock()
+	}
 
 	return
 }
@@ -1349,14 +3062,35 @@ func (fs *fileSystem) ReadDir(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) ReleaseDirHandle(
 	op *fuseops.ReleaseDirHandleOp) (err error) {
+	desc := fmt.Sprintf("ReleaseDirHandle(handle=%d)", op.Handle)
+
+	// Find the handle.
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	dh, ok := fs.handles[op.Handle].(*dirHandle)
+	fs.mu.Unlock()
 
-	// Sanity check that this handle exists and is of the correct type.
-	_ = fs.handles[op.Handle].(*dirHandle)
+	if !ok {
+		fs.reportReleaseFailure(desc, "look up", errors.New("No such dir handle"))
+		return
+	}
 
-	// Clear the entry from the map.
-	delete(fs.handles, op.Handle)
+	// Throw away the buffered listing even if the handle can't be removed, so
+	// that it can't leak.
+	fs.runReleaseSteps(desc, []releaseStep{
+		{
+			name: "drop listing",
+			run: func() (err error) {
+				dh.Mu.Lock()
+				defer dh.Mu.Unlock()
+
+				dh.entries = nil
+				dh.entriesValid = false
+				return
+			},
+		},
+
+		fs.removeHandleStep(op.Handle, dh),
+	})
 
 	return
 }
@@ -1364,29 +3098,203 @@ func (fs *fileSystem) ReleaseDirHandle(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) OpenFile(
 	op *fuseops.OpenFileOp) (err error) {
+	truncate := op.Flags&bazilfuse.OpenTruncate != 0
+
+	// Only reading is allowed in a read-only file system.
+	if fs.readOnly && (!op.Flags.IsReadOnly() || truncate) {
+		err = errReadOnlyFS
+		return
+	}
+
+	err = fs.checkAccess(op.Header(), fs.fileMode, openAccess(op.Flags))
+	if err != nil {
+		return
+	}
+
+	// Sanity check that this inode exists and is of the correct type, and make
+	// sure we'll be able to allocate the handle before truncating.
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	in := fs.inodes[op.Inode].(*inode.FileInode)
+	err = fs.reserveHandle()
+	fs.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	reserved := true
+	defer func() {
+		if reserved {
+			fs.mu.Lock()
+			fs.unreserveHandle()
+			fs.mu.Unlock()
+		}
+	}()
+
+	// Don't serve the contents of a generation that has since been replaced.
+	err = fs.refreshStaleFile(op.Context(), in)
+	if err != nil {
+		return
+	}
+
+	// Without the customer-supplied key with which an object is encrypted we
+	// can't replace it, so refuse up front to modify it.
+	if !op.Flags.IsReadOnly() || truncate {
+		in.Lock()
+		src := in.Source()
+		in.Unlock()
+
+		if src.CustomerEncryption != nil {
+			err = errEncrypted
+			return
+		}
+	}
+
+	if in.IsDecompressedView() {
+		// Decompressed views are read-only.
+		if !op.Flags.IsReadOnly() || truncate {
+			err = errViewReadOnly
+			return
+		}
+
+		// Find out the decompressed size now, so that the kernel doesn't
+		// truncate reads at the compressed size it may have been told about
+		// earlier. Decompressing takes a while, so don't hold the inode's lock
+		// meanwhile.
+		in.Lock()
+		view := in.UnindexedView()
+		in.Unlock()
+
+		if view != nil {
+			var idx *gcsproxy.GzipIndex
+			idx, err = view.BuildIndex(op.Context())
+			if err != nil {
+				err = fmt.Errorf("BuildIndex: %v", err)
+				return
+			}
+
+			in.Lock()
+			resized := in.SetDecompressedIndex(view, idx)
+			in.Unlock()
+
+			if resized {
+				fs.invalidateInode(in.ID())
+			}
+		}
+	}
 
-	// Sanity check that this inode exists and is of the correct type.
-	_ = fs.inodes[op.Inode].(*inode.FileInode)
+	// The mount asks for atomic O_TRUNC, so the kernel leaves truncation on
+	// open to us. Truncating to zero throws away the object's contents
+	// without reading them, and the sync that follows is still conditional on
+	// the generation we started from.
+	if truncate {
+		in.Lock()
+		err = fs.truncateFile(op.Context(), in, 0)
+		in.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+
+	// Allocate the handle we reserved room for, streaming reads if
+	// appropriate. A truncated file has nothing in GCS worth streaming.
+	fh := &fileHandle{in: in}
+	if !truncate {
+		fh.stream = fs.newStreamingRead(in, op.Flags)
+	}
+
+	fs.mu.Lock()
+	op.Handle = fs.allocateReservedHandle(fh)
+	reserved = false
+	fs.mu.Unlock()
+
+	// Keep what the handle reads from being evicted while it's open. Streaming
+	// handles don't read through the inode's contents.
+	if fh.stream == nil {
+		in.Lock()
+		fh.pin()
+		in.Unlock()
+	}
 
 	return
 }
 
+// The number of times ReadFile waits for content to be fetched before reading
+// with the inode lock held.
+const maxReadFaultAttempts = 4
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) ReadFile(
 	op *fuseops.ReadFileOp) (err error) {
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.inodes[op.Inode].(*inode.FileInode)
+	h, err := fs.useHandle(op.Handle)
+	shared := fs.fileHandleCounts[op.Inode] > 1
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
+	// Stream the contents, if the handle is doing so.
+	if s := h.(*fileHandle).stream; s != nil {
+		var streamed bool
+		streamed, err = fs.readStreaming(op, in, s, shared)
+		if streamed || err != nil {
+			return
+		}
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
-	// Serve the request.
-	op.Data, err = in.Read(op.Context(), op.Offset, op.Size)
+	// Re-pin the contents if the handle was reaped and has been revived. See
+	// OpenFile.
+	if fh := h.(*fileHandle); fh.stream == nil {
+		fh.pin()
+	}
+
+	// Serve the request. If that requires fetching content, wait for the fetch
+	// without holding the inode lock so that reads of content we already have
+	// aren't stuck behind it, then try again.
+	//
+	// Content fetched in the meantime may be evicted again before we get to
+	// it, for example when the temporary directory is under pressure, so after
+	// a few attempts give up and read while holding the lock. That waits on
+	// GCS with the lock held, but is sure to finish.
+	for attempt := 0; ; attempt++ {
+		if attempt == maxReadFaultAttempts {
+			op.Data, err = in.Read(op.Context(), op.Offset, op.Size)
+			if err != nil {
+				return
+			}
+
+			break
+		}
+
+		var fault *lease.Fault
+		op.Data, fault, err = in.TryRead(op.Context(), op.Offset, op.Size)
+		if err != nil {
+			return
+		}
+
+		if fault == nil {
+			break
+		}
 
+		in.Unlock()
+		err = fault.Wait(op.Context())
+		in.Lock()
+
+		if err != nil {
+			return
+		}
+	}
+
+	fs.noteAccess(in)
+	fs.counters.recordRead(len(op.Data))
 	return
 }
 
@@ -1410,16 +3318,157 @@ func (fs *fileSystem) ReadSymlink(
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) WriteFile(
 	op *fuseops.WriteFileOp) (err error) {
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.inodes[op.Inode].(*inode.FileInode)
+	_, err = fs.useHandle(op.Handle)
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
+	// Refuse pathological writes before touching the content.
+	err = fs.checkWrite(op.Context(), in, op.Offset, len(op.Data))
+	if err != nil {
+		return
+	}
+
 	// Serve the request.
 	err = in.Write(op.Context(), op.Data, op.Offset)
+	if lease.IsNoSpaceError(err) {
+		err = errNoSpace
+		return
+	}
+
+	if _, ok := err.(*inode.ClobberedError); ok {
+		err = errStale
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	fs.counters.recordWrite(len(op.Data))
+	return
+}
+
+// Return an error if a write of the given size at the given offset would make
+// the file larger than GCS allows or, if so configured, leave too large a
+// hole after its current end.
+//
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) checkWrite(
+	ctx context.Context,
+	in *inode.FileInode,
+	offset int64,
+	size int) (err error) {
+	if offset+int64(size) > inode.MaxFileSize {
+		err = errFileTooLarge
+		return
+	}
+
+	if fs.rejectSparseWritesOver <= 0 {
+		return
+	}
+
+	attrs, err := in.Attributes(ctx)
+	if err != nil {
+		err = fmt.Errorf("Attributes: %v", err)
+		return
+	}
+
+	gap := offset - int64(attrs.Size)
+	if gap > fs.rejectSparseWritesOver {
+		log.Printf(
+			"Rejecting write to %q at offset %d, %d bytes beyond its end.",
+			in.Name(),
+			offset,
+			gap)
+
+		err = errFileTooLarge
+		return
+	}
+
+	return
+}
+
+// Truncate the file to the given size, as for SetInodeAttributes or opening
+// with O_TRUNC, translating errors for the kernel.
+//
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) truncateFile(
+	ctx context.Context,
+	in *inode.FileInode,
+	size uint64) (err error) {
+	err = fs.checkTruncate(ctx, in, size)
+	if err != nil {
+		return
+	}
+
+	err = in.Truncate(ctx, int64(size))
+	if lease.IsNoSpaceError(err) {
+		err = errNoSpace
+		return
+	}
+
+	if _, ok := err.(*inode.ClobberedError); ok {
+		err = errStale
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Truncate: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return an error if truncating the file to the given size would make it
+// larger than GCS allows or, if so configured, extend it by too large a hole.
+//
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) checkTruncate(
+	ctx context.Context,
+	in *inode.FileInode,
+	size uint64) (err error) {
+	if size > inode.MaxFileSize {
+		err = errFileTooLarge
+		return
+	}
+
+	if fs.rejectSparseWritesOver <= 0 {
+		return
+	}
+
+	attrs, err := in.Attributes(ctx)
+	if err != nil {
+		err = fmt.Errorf("Attributes: %v", err)
+		return
+	}
+
+	gap := int64(size) - int64(attrs.Size)
+	if gap > fs.rejectSparseWritesOver {
+		log.Printf(
+			"Rejecting truncation of %q to %d bytes, %d bytes beyond its end.",
+			in.Name(),
+			size,
+			gap)
+
+		err = errFileTooLarge
+		return
+	}
 
 	return
 }
@@ -1430,8 +3479,13 @@ func (fs *fileSystem) SyncFile(
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.inodes[op.Inode].(*inode.FileInode)
+	_, err = fs.useHandle(op.Handle)
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
@@ -1447,21 +3501,112 @@ func (fs *fileSystem) FlushFile(
 	// Find the inode.
 	fs.mu.Lock()
 	in := fs.inodes[op.Inode].(*inode.FileInode)
+	_, err = fs.useHandle(op.Handle)
 	fs.mu.Unlock()
 
+	if err != nil {
+		return
+	}
+
 	in.Lock()
 	defer in.Unlock()
 
 	// Sync it.
 	err = fs.syncFile(op.Context(), in)
 
+	// If asked to, swallow the error. Nothing has changed since the failure, so
+	// the file is still dirty and will be written out by a later sync, or at the
+	// latest when the kernel forgets the inode. Errors that no later sync can
+	// get past, because the object has been clobbered or can't be rewritten
+	// with its encryption, are always returned.
+	if err != nil &&
+		fs.ignoreFlushErrors &&
+		err != errStale &&
+		err != errEncrypted {
+		logger.Errorf(
+			"Ignoring error flushing %q; its modifications are not yet in GCS: %v",
+			in.Name(),
+			err)
+
+		err = nil
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SeekFile(
+	op *fuseops.SeekFileOp) (err error) {
+	var hole bool
+	switch op.Whence {
+	case fuseops.WhenceData:
+	case fuseops.WhenceHole:
+		hole = true
+
+	default:
+		err = errSeekWhence
+		return
+	}
+
+	// Find the inode.
+	fs.mu.Lock()
+	in := fs.inodes[op.Inode].(*inode.FileInode)
+	_, err = fs.useHandle(op.Handle)
+	fs.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	in.Lock()
+	defer in.Unlock()
+
+	// Search the contents.
+	n, ok, err := in.Seek(op.Context(), op.Offset, hole)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	if !ok {
+		err = errSeekNotFound
+		return
+	}
+
+	op.ResultOffset = n
 	return
 }
 
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) ReleaseFileHandle(
 	op *fuseops.ReleaseFileHandleOp) (err error) {
-	// We implement this only to keep it from appearing in the log of fuse
-	// errors. There's nothing we need to actually do.
+	desc := fmt.Sprintf("ReleaseFileHandle(handle=%d)", op.Handle)
+
+	// Find the handle.
+	fs.mu.Lock()
+	fh, ok := fs.handles[op.Handle].(*fileHandle)
+	fs.mu.Unlock()
+
+	if !ok {
+		fs.reportReleaseFailure(desc, "look up", errors.New("No such file handle"))
+		return
+	}
+
+	// Drop the handle's pin on the inode's contents. That's bookkeeping that
+	// can't fail, so it isn't a release step.
+	fh.in.Lock()
+	fh.unpin()
+	fh.in.Unlock()
+
+	// File contents, dirty or not, belong to the inode and are written out by
+	// FlushFile, so there is nothing else to clean up besides any stream.
+	var steps []releaseStep
+	if fh.stream != nil {
+		steps = append(steps, closeStreamStep(fh.stream))
+	}
+
+	steps = append(steps, fs.removeHandleStep(op.Handle, fh))
+	fs.runReleaseSteps(desc, steps)
+
 	return
 }
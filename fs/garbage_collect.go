@@ -22,6 +22,7 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/googlecloudplatform/gcsfuse/logger"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/jacobsa/syncutil"
@@ -117,7 +118,7 @@ func garbageCollect(
 		objectsDeleted, err := garbageCollectOnce(ctx, tmpObjectPrefix, bucket)
 
 		if err != nil {
-			log.Printf(
+			logger.Errorf(
 				"Garbage collection failed after deleting %d objects in %v, "+
 					"with error: %v",
 				objectsDeleted,
@@ -0,0 +1,522 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// The error returned for opens beyond ServerConfig.MaxOpenHandles.
+var errTooManyHandles = bazilfuse.Errno(syscall.EMFILE)
+
+// The error returned for ops on handles that aren't open.
+var errBadHandle = bazilfuse.Errno(syscall.EBADF)
+
+// Bookkeeping common to all handles.
+type handleLifecycle struct {
+	// The last time an op used the handle.
+	//
+	// GUARDED_BY(fs.mu)
+	lastUsed time.Time
+
+	// Set when the handle has been idle for too long and its resources have
+	// been released. The handle ID remains allocated until the kernel releases
+	// it, and the next op on it revives it.
+	//
+	// GUARDED_BY(fs.mu)
+	reaped bool
+}
+
+// State for an open file. File contents are held by the inode, so there is
+// nothing here but bookkeeping, and the state of streaming if the handle may
+// stream (see ServerConfig.StreamingReadThreshold).
+type fileHandle struct {
+	in        *inode.FileInode
+	stream    *streamingRead
+	lifecycle handleLifecycle
+
+	// Set while the handle holds a pin on the inode's contents. See
+	// inode.FileInode.PinContents.
+	//
+	// GUARDED_BY(in)
+	pinned bool
+}
+
+// Pin the inode's contents on behalf of the handle, unless it already has.
+//
+// LOCKS_REQUIRED(fh.in)
+func (fh *fileHandle) pin() {
+	if !fh.pinned {
+		fh.in.PinContents()
+		fh.pinned = true
+	}
+}
+
+// Undo pin, if the handle holds a pin.
+//
+// LOCKS_REQUIRED(fh.in)
+func (fh *fileHandle) unpin() {
+	if fh.pinned {
+		fh.in.UnpinContents()
+		fh.pinned = false
+	}
+}
+
+// Return the lifecycle bookkeeping for a value in fs.handles.
+func lifecycleOf(h interface{}) *handleLifecycle {
+	switch h := h.(type) {
+	case *dirHandle:
+		return &h.lifecycle
+
+	case *fileHandle:
+		return &h.lifecycle
+
+	default:
+		panic(fmt.Sprintf("Unexpected handle type: %T", h))
+	}
+}
+
+// Return errTooManyHandles if no more handles may be opened.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) checkHandleLimit() (err error) {
+	open := fs.liveHandles + fs.reservedHandles
+	if fs.maxOpenHandles > 0 && open >= fs.maxOpenHandles {
+		fs.handleLimitRejections++
+		err = errTooManyHandles
+		return
+	}
+
+	return
+}
+
+// Reserve room for a handle to be allocated with allocateReservedHandle,
+// failing with errTooManyHandles if we are at the limit. Opens that must do
+// something irreversible before allocating their handle reserve room first, so
+// that they can't fail afterward because of concurrent opens. If the handle
+// isn't allocated after all, the reservation must be undone with
+// unreserveHandle.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) reserveHandle() (err error) {
+	if err = fs.checkHandleLimit(); err != nil {
+		return
+	}
+
+	fs.reservedHandles++
+	return
+}
+
+// Undo a call to reserveHandle.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) unreserveHandle() {
+	fs.reservedHandles--
+}
+
+// Allocate an ID for the supplied new handle, failing with errTooManyHandles
+// if we are at the limit.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) allocateHandle(
+	h interface{}) (id fuseops.HandleID, err error) {
+	if err = fs.reserveHandle(); err != nil {
+		return
+	}
+
+	id = fs.allocateReservedHandle(h)
+	return
+}
+
+// Allocate an ID for the supplied new handle, using room reserved with
+// reserveHandle.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) allocateReservedHandle(
+	h interface{}) (id fuseops.HandleID) {
+	fs.reservedHandles--
+	lifecycleOf(h).lastUsed = fs.clock.Now()
+
+	id = fs.nextHandleID
+	fs.nextHandleID++
+
+	fs.handles[id] = h
+	fs.liveHandles++
+
+	if fh, ok := h.(*fileHandle); ok {
+		fs.fileHandleCounts[fh.in.ID()]++
+	}
+
+	return
+}
+
+// Find the handle with the given ID and record that it has been used, reviving
+// it if it has been reaped. Return errBadHandle if there is no such handle.
+//
+// A revived handle counts toward the limit on open handles again, even if
+// that takes us beyond it, since failing ops on a handle that the kernel
+// considers open would be worse. What reaping released is acquired again as
+// needed: directory handles list afresh, and file handles pin contents on
+// their next read.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) useHandle(
+	id fuseops.HandleID) (h interface{}, err error) {
+	h, ok := fs.handles[id]
+	if !ok {
+		err = errBadHandle
+		return
+	}
+
+	lc := lifecycleOf(h)
+	if lc.reaped {
+		lc.reaped = false
+		fs.liveHandles++
+	}
+
+	lc.lastUsed = fs.clock.Now()
+	return
+}
+
+// Forget the handle with the given ID.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) releaseHandle(id fuseops.HandleID) {
+	h := fs.handles[id]
+	if !lifecycleOf(h).reaped {
+		fs.liveHandles--
+	}
+
+	if fh, ok := h.(*fileHandle); ok {
+		inodeID := fh.in.ID()
+		fs.fileHandleCounts[inodeID]--
+		if fs.fileHandleCounts[inodeID] == 0 {
+			delete(fs.fileHandleCounts, inodeID)
+		}
+	}
+
+	delete(fs.handles, id)
+}
+
+// One step in releasing a handle. See runReleaseSteps.
+type releaseStep struct {
+	name string
+	run  func() error
+}
+
+// Run each of the supplied steps in order, carrying on even if some of them
+// fail. The kernel ignores errors from release ops, so failures are logged
+// along with desc, which identifies the op, and counted in fs.releaseFailures
+// rather than returned.
+//
+// Panics are not recovered. A panicking step may have left fs.mu locked or
+// the file system's invariants broken, and carrying on would only hide that.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) runReleaseSteps(desc string, steps []releaseStep) {
+	for _, s := range steps {
+		if err := fs.runReleaseStep(s); err != nil {
+			fs.reportReleaseFailure(desc, s.name, err)
+		}
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) runReleaseStep(s releaseStep) (err error) {
+	if fs.releaseStepHook != nil {
+		if err = fs.releaseStepHook(s.name); err != nil {
+			return
+		}
+	}
+
+	err = s.run()
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) reportReleaseFailure(desc string, step string, err error) {
+	logger.Errorf("%s: %s: %v", desc, step, err)
+
+	fs.mu.Lock()
+	fs.releaseFailures++
+	fs.mu.Unlock()
+}
+
+// A release step that removes the given handle from the handle table.
+func (fs *fileSystem) removeHandleStep(
+	id fuseops.HandleID,
+	h interface{}) releaseStep {
+	return releaseStep{
+		name: "remove from handle table",
+		run: func() (err error) {
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+
+			if fs.handles[id] != h {
+				err = fmt.Errorf("Handle %d changed under us", id)
+				return
+			}
+
+			fs.releaseHandle(id)
+			return
+		},
+	}
+}
+
+// Release the resources of handles that have not been used for
+// fs.handleIdleTimeout, returning the number reaped. Directory handles drop
+// their buffered listings. File handles close their streams and drop their
+// pins, and the cached contents of inodes that no other handle pins are
+// evicted. File handles for inodes with modifications that haven't been
+// written to GCS are left alone, since the kernel will want to flush them when
+// the handle is closed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) reapIdleHandles(ctx context.Context) (reaped int) {
+	type candidate struct {
+		id       fuseops.HandleID
+		fh       *fileHandle
+		lastUsed time.Time
+	}
+
+	now := fs.clock.Now()
+
+	// Find idle handles. Directory handles can be reaped immediately; file
+	// handles must be checked for dirtiness, which requires the inode lock.
+	var dirs []*dirHandle
+	var files []candidate
+
+	fs.mu.Lock()
+	for id, h := range fs.handles {
+		lc := lifecycleOf(h)
+		if lc.reaped || now.Sub(lc.lastUsed) < fs.handleIdleTimeout {
+			continue
+		}
+
+		switch h := h.(type) {
+		case *dirHandle:
+			lc.reaped = true
+			fs.liveHandles--
+			dirs = append(dirs, h)
+
+		case *fileHandle:
+			files = append(files, candidate{id, h, lc.lastUsed})
+		}
+	}
+	fs.mu.Unlock()
+
+	// Throw away buffered listings.
+	for _, dh := range dirs {
+		dh.Mu.Lock()
+		dh.entries = nil
+		dh.entriesValid = false
+		dh.Mu.Unlock()
+	}
+
+	reaped += len(dirs)
+
+	// Reap clean file handles that are still idle, holding the inode lock so
+	// that the inode can't be dirtied in the meantime.
+	for _, c := range files {
+		c.fh.in.Lock()
+
+		dirty, _, err := c.fh.in.Dirty(ctx)
+		if err != nil {
+			logger.Errorf("Dirty(%q): %v", c.fh.in.Name(), err)
+		}
+
+		var reapedThis bool
+		if err == nil && !dirty {
+			fs.mu.Lock()
+			lc := &c.fh.lifecycle
+			stillIdle := !lc.reaped && lc.lastUsed == c.lastUsed
+			if fs.handles[c.id] == c.fh && stillIdle {
+				lc.reaped = true
+				fs.liveHandles--
+				reaped++
+				reapedThis = true
+			}
+			fs.mu.Unlock()
+		}
+
+		// Nobody may be about to read the contents, so make room for others.
+		if reapedThis {
+			c.fh.unpin()
+			if !c.fh.in.ContentsPinned() {
+				fs.evictContents(c.fh.in)
+			}
+		}
+
+		c.fh.in.Unlock()
+
+		// Release any GCS read the handle is streaming from.
+		if reapedThis && c.fh.stream != nil {
+			if err := c.fh.stream.close(); err != nil {
+				logger.Errorf("Closing stream for %q: %v", c.fh.in.Name(), err)
+			}
+		}
+	}
+
+	return
+}
+
+// Revoke the read leases holding the cached contents of the supplied clean
+// inode's generation.
+//
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) evictContents(in *inode.FileInode) {
+	o := in.Source()
+	tag := gcsproxy.LeaseTag(o.Name, o.Generation)
+	fs.leaser.RevokeReadLeasesMatching(func(t string) bool { return t == tag })
+}
+
+// Reap idle handles periodically until the context is cancelled.
+func (fs *fileSystem) reapIdleHandlesPeriodically(ctx context.Context) {
+	fs.runPeriodically(ctx, fs.handleIdleTimeout/2, func() {
+		if n := fs.reapIdleHandles(ctx); n != 0 {
+			log.Printf(
+				"Reaped %d handles idle for over %v.",
+				n,
+				fs.handleIdleTimeout)
+		}
+	})
+}
+
+// Information about an open handle, for diagnostics.
+type handleInfo struct {
+	ID       fuseops.HandleID
+	Kind     string
+	Name     string
+	Idle     time.Duration
+	Reaped   bool
+	Resource string
+}
+
+// Return information about each open handle, including the resources it
+// holds, sorted by ID.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) handleSummary(ctx context.Context) (infos []handleInfo) {
+	now := fs.clock.Now()
+
+	// Snapshot the handle table.
+	handles := make(map[fuseops.HandleID]interface{})
+
+	fs.mu.Lock()
+	for id, h := range fs.handles {
+		lc := lifecycleOf(h)
+		handles[id] = h
+		infos = append(infos, handleInfo{
+			ID:     id,
+			Idle:   now.Sub(lc.lastUsed),
+			Reaped: lc.reaped,
+		})
+	}
+	fs.mu.Unlock()
+
+	// Fill in the resources held by each.
+	for i := range infos {
+		hi := &infos[i]
+		switch h := handles[hi.ID].(type) {
+		case *dirHandle:
+			hi.Kind = "dir"
+			hi.Name = h.in.Name()
+
+			h.Mu.Lock()
+			hi.Resource = fmt.Sprintf("%d buffered entries", len(h.entries))
+			h.Mu.Unlock()
+
+		case *fileHandle:
+			hi.Kind = "file"
+			hi.Name = h.in.Name()
+
+			h.in.Lock()
+			_, n, err := h.in.Dirty(ctx)
+			h.in.Unlock()
+
+			if err != nil {
+				hi.Resource = fmt.Sprintf("error: %v", err)
+			} else {
+				hi.Resource = fmt.Sprintf("%d dirty bytes buffered", n)
+			}
+
+			if h.stream != nil {
+				hi.Resource += ", " + h.stream.describe()
+			}
+		}
+	}
+
+	sort.Sort(handleInfosByID(infos))
+	return
+}
+
+type handleInfosByID []handleInfo
+
+func (s handleInfosByID) Len() int           { return len(s) }
+func (s handleInfosByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s handleInfosByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Serve a plain text summary of open handles and the resources they hold.
+func (fs *fileSystem) serveHandles(
+	w http.ResponseWriter,
+	r *http.Request) {
+	infos := fs.handleSummary(context.Background())
+
+	fs.mu.Lock()
+	live := fs.liveHandles
+	rejections := fs.handleLimitRejections
+	releaseFailures := fs.releaseFailures
+	fs.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(
+		w,
+		"live handles: %d (limit %d), total: %d, opens rejected: %d, "+
+			"release failures: %d\n",
+		live,
+		fs.maxOpenHandles,
+		len(infos),
+		rejections,
+		releaseFailures)
+
+	for _, hi := range infos {
+		state := "live"
+		if hi.Reaped {
+			state = "reaped"
+		}
+
+		fmt.Fprintf(
+			w,
+			"%8d %4s %6s idle %-12v %-28s %s\n",
+			hi.ID,
+			hi.Kind,
+			state,
+			hi.Idle,
+			hi.Resource,
+			hi.Name)
+	}
+}
@@ -0,0 +1,824 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestHandles(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	handlesTestMaxOpen     = 3
+	handlesTestIdleTimeout = time.Minute
+)
+
+// Tests for handle limits and reaping, driving the file system directly
+// through its op methods as if the kernel had abandoned handles.
+type HandlesTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&HandlesTest{}) }
+
+func (t *HandlesTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create some contents.
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"foo":  "taco",
+			"bar":  "burrito",
+			"dir/": "",
+		})
+
+	AssertEq(nil, err)
+
+	// Create the file system.
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		MaxOpenHandles:       handlesTestMaxOpen,
+		HandleIdleTimeout:    handlesTestIdleTimeout,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *HandlesTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up a child of the root, as the kernel would before opening it. Ops
+// created outside of the fuse package carry no context, so we can only use
+// those that don't need one.
+func (t *HandlesTest) lookUp(name string) fuseops.InodeID {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	return child.ID()
+}
+
+func (t *HandlesTest) openDir(id fuseops.InodeID) (h fuseops.HandleID, err error) {
+	op := &fuseops.OpenDirOp{Inode: id}
+	err = t.fs.OpenDir(op)
+	h = op.Handle
+	return
+}
+
+func (t *HandlesTest) readDir(h fuseops.HandleID) (err error) {
+	op := &fuseops.ReadDirOp{
+		Inode:  fuseops.RootInodeID,
+		Handle: h,
+		Offset: 1,
+		Size:   1 << 12,
+	}
+
+	err = t.fs.ReadDir(op)
+	return
+}
+
+// Fill the listing buffered by the given directory handle.
+func (t *HandlesTest) bufferListing(h fuseops.HandleID) {
+	t.fs.mu.Lock()
+	dh := t.fs.handles[h].(*dirHandle)
+	t.fs.mu.Unlock()
+
+	dh.Mu.Lock()
+	defer dh.Mu.Unlock()
+
+	AssertEq(nil, dh.ensureEntries(t.ctx))
+}
+
+func (t *HandlesTest) openFile(id fuseops.InodeID) (h fuseops.HandleID, err error) {
+	op := &fuseops.OpenFileOp{Inode: id}
+	err = t.fs.OpenFile(op)
+	h = op.Handle
+	return
+}
+
+func (t *HandlesTest) readFile(
+	id fuseops.InodeID,
+	h fuseops.HandleID) (s string, err error) {
+	op := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: h,
+		Size:   1 << 10,
+	}
+
+	err = t.fs.ReadFile(op)
+	s = string(op.Data)
+	return
+}
+
+func (t *HandlesTest) writeFile(
+	id fuseops.InodeID,
+	h fuseops.HandleID,
+	s string) (err error) {
+	op := &fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte(s),
+	}
+
+	err = t.fs.WriteFile(op)
+	return
+}
+
+func (t *HandlesTest) flushFile(
+	id fuseops.InodeID,
+	h fuseops.HandleID) (err error) {
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	return
+}
+
+// Return the number of buffered entries in the given directory handle.
+func (t *HandlesTest) bufferedEntries(h fuseops.HandleID) int {
+	t.fs.mu.Lock()
+	dh := t.fs.handles[h].(*dirHandle)
+	t.fs.mu.Unlock()
+
+	dh.Mu.Lock()
+	defer dh.Mu.Unlock()
+
+	return len(dh.entries)
+}
+
+// Has the given handle been reaped?
+func (t *HandlesTest) reaped(h fuseops.HandleID) bool {
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	return lifecycleOf(t.fs.handles[h]).reaped
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *HandlesTest) OpenLimit() {
+	var err error
+	foo := t.lookUp("foo")
+
+	// Fill up the limit with a mix of handles.
+	d0, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	_, err = t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	_, err = t.openFile(foo)
+	AssertEq(nil, err)
+
+	// Further opens should fail.
+	_, err = t.openDir(fuseops.RootInodeID)
+	ExpectEq(errTooManyHandles, err)
+
+	_, err = t.openFile(foo)
+	ExpectEq(errTooManyHandles, err)
+
+	ExpectEq(2, t.fs.handleLimitRejections)
+
+	// Releasing a handle should make room.
+	err = t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: d0})
+	AssertEq(nil, err)
+
+	_, err = t.openFile(foo)
+	ExpectEq(nil, err)
+}
+
+func (t *HandlesTest) CreateFileAtLimit() {
+	var err error
+
+	for i := 0; i < handlesTestMaxOpen; i++ {
+		_, err = t.openDir(fuseops.RootInodeID)
+		AssertEq(nil, err)
+	}
+
+	// Creating a file should fail without creating the object.
+	op := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "baz",
+	}
+
+	err = t.fs.CreateFile(op)
+	ExpectEq(errTooManyHandles, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "baz"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *HandlesTest) ReservationsCountTowardLimit() {
+	var err error
+
+	// Reserve all but one handle, as opens in progress would.
+	t.fs.mu.Lock()
+	for i := 0; i < handlesTestMaxOpen-1; i++ {
+		AssertEq(nil, t.fs.reserveHandle())
+	}
+	t.fs.mu.Unlock()
+
+	// Creating a file takes the last one. Nothing else fits.
+	op := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "baz",
+	}
+
+	err = t.fs.CreateFile(op)
+	AssertEq(nil, err)
+
+	_, err = t.openDir(fuseops.RootInodeID)
+	ExpectEq(errTooManyHandles, err)
+
+	// Undoing the reservations makes room again.
+	t.fs.mu.Lock()
+	for i := 0; i < handlesTestMaxOpen-1; i++ {
+		t.fs.unreserveHandle()
+	}
+
+	t.fs.checkInvariants()
+	ExpectEq(1, t.fs.liveHandles)
+	ExpectEq(0, t.fs.reservedHandles)
+	t.fs.mu.Unlock()
+
+	_, err = t.openDir(fuseops.RootInodeID)
+	ExpectEq(nil, err)
+}
+
+func (t *HandlesTest) CreateFileFailureUndoesReservation() {
+	// Creating a file that already exists should fail, without using up room
+	// for handles.
+	op := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	err := t.fs.CreateFile(op)
+	ExpectEq(fuse.EEXIST, err)
+
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	t.fs.checkInvariants()
+	ExpectEq(0, t.fs.liveHandles)
+	ExpectEq(0, t.fs.reservedHandles)
+}
+
+func (t *HandlesTest) UnknownHandle() {
+	foo := t.lookUp("foo")
+
+	_, err := t.readFile(foo, 17)
+	ExpectEq(errBadHandle, err)
+
+	err = t.flushFile(foo, 17)
+	ExpectEq(errBadHandle, err)
+
+	err = t.readDir(17)
+	ExpectEq(errBadHandle, err)
+}
+
+func (t *HandlesTest) ReapIdleDirHandle() {
+	var err error
+
+	// Open a directory and read from it, buffering its listing.
+	h, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	t.bufferListing(h)
+	ExpectEq(3, t.bufferedEntries(h))
+
+	err = t.readDir(h)
+	AssertEq(nil, err)
+
+	// Not long enough.
+	t.clock.AdvanceTime(handlesTestIdleTimeout - time.Second)
+	ExpectEq(0, t.fs.reapIdleHandles(t.ctx))
+	ExpectEq(3, t.bufferedEntries(h))
+
+	// Long enough.
+	t.clock.AdvanceTime(time.Second)
+	ExpectEq(1, t.fs.reapIdleHandles(t.ctx))
+	ExpectEq(0, t.bufferedEntries(h))
+	ExpectEq(0, t.fs.liveHandles)
+
+	// Reaping again should do nothing.
+	ExpectEq(0, t.fs.reapIdleHandles(t.ctx))
+
+	// A later read should revive the handle, listing afresh.
+	err = t.readDir(h)
+	AssertEq(nil, err)
+	ExpectFalse(t.reaped(h))
+	ExpectEq(3, t.bufferedEntries(h))
+	ExpectEq(1, t.fs.liveHandles)
+
+	// Releasing should work as usual.
+	err = t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: h})
+	AssertEq(nil, err)
+	ExpectEq(0, len(t.fs.handles))
+}
+
+func (t *HandlesTest) ReapedHandlesDontCountTowardLimit() {
+	var err error
+
+	for i := 0; i < handlesTestMaxOpen; i++ {
+		_, err = t.openDir(fuseops.RootInodeID)
+		AssertEq(nil, err)
+	}
+
+	_, err = t.openDir(fuseops.RootInodeID)
+	ExpectEq(errTooManyHandles, err)
+
+	// Reap them all.
+	t.clock.AdvanceTime(handlesTestIdleTimeout)
+	ExpectEq(handlesTestMaxOpen, t.fs.reapIdleHandles(t.ctx))
+
+	_, err = t.openDir(fuseops.RootInodeID)
+	ExpectEq(nil, err)
+}
+
+func (t *HandlesTest) ReapedPeriodically() {
+	var err error
+
+	// Recreate the file system with a clock that times reaping.
+	clock := newSimulatedTimerClock(t.clock.Now())
+	t.fs.Destroy()
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		MaxOpenHandles:       handlesTestMaxOpen,
+		HandleIdleTimeout:    handlesTestIdleTimeout,
+	})
+
+	AssertEq(nil, err)
+
+	// Passes come every half timeout.
+	ExpectEq(handlesTestIdleTimeout/2, clock.awaitWait())
+
+	h, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	// A pass before the handle has been idle for the timeout leaves it alone.
+	clock.AdvanceTime(handlesTestIdleTimeout / 2)
+	clock.awaitWait()
+	ExpectFalse(t.reaped(h))
+
+	// The next one reaps it.
+	clock.AdvanceTime(handlesTestIdleTimeout / 2)
+	clock.awaitWait()
+	ExpectTrue(t.reaped(h))
+}
+
+func (t *HandlesTest) RecentlyUsedHandlesNotReaped() {
+	var err error
+	foo := t.lookUp("foo")
+
+	h, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	// Use the handle part way through the timeout.
+	t.clock.AdvanceTime(handlesTestIdleTimeout / 2)
+
+	s, err := t.readFile(foo, h)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	// Nothing should be reaped when the original timeout expires.
+	t.clock.AdvanceTime(handlesTestIdleTimeout / 2)
+	ExpectEq(0, t.fs.reapIdleHandles(t.ctx))
+
+	s, err = t.readFile(foo, h)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+}
+
+func (t *HandlesTest) ReapIdleFileHandle() {
+	var err error
+	foo := t.lookUp("foo")
+
+	h, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	_, err = t.readFile(foo, h)
+	AssertEq(nil, err)
+	AssertEq(1, t.fs.leaser.Stats().NumFiles)
+
+	t.clock.AdvanceTime(handlesTestIdleTimeout)
+	ExpectEq(1, t.fs.reapIdleHandles(t.ctx))
+	ExpectEq(0, t.fs.liveHandles)
+
+	// The contents should have been evicted.
+	ExpectEq(0, t.fs.leaser.Stats().NumFiles)
+
+	// Ops on the handle should revive it, fetching the contents again.
+	s, err := t.readFile(foo, h)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+	ExpectFalse(t.reaped(h))
+	ExpectEq(1, t.fs.liveHandles)
+
+	st := t.fs.leaser.Stats()
+	ExpectEq(1, st.NumFiles)
+	ExpectEq(1, st.PinnedNumFiles)
+
+	err = t.writeFile(foo, h, "burrito")
+	ExpectEq(nil, err)
+
+	err = t.flushFile(foo, h)
+	ExpectEq(nil, err)
+
+	// Releasing the handle should work as usual.
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h})
+	AssertEq(nil, err)
+	ExpectEq(0, len(t.fs.handles))
+	ExpectEq(0, t.fs.liveHandles)
+}
+
+func (t *HandlesTest) ReapingKeepsContentsPinnedByOthers() {
+	var err error
+	foo := t.lookUp("foo")
+
+	// Two handles read foo. Only the first goes idle.
+	h1, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	h2, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	_, err = t.readFile(foo, h1)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(handlesTestIdleTimeout / 2)
+	_, err = t.readFile(foo, h2)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(handlesTestIdleTimeout / 2)
+	ExpectEq(1, t.fs.reapIdleHandles(t.ctx))
+	ExpectTrue(t.reaped(h1))
+
+	// The contents are still in use by the second handle.
+	st := t.fs.leaser.Stats()
+	ExpectEq(1, st.NumFiles)
+	ExpectEq(1, st.PinnedNumFiles)
+}
+
+func (t *HandlesTest) DirtyFileHandlesNotReaped() {
+	var err error
+	foo := t.lookUp("foo")
+	bar := t.lookUp("bar")
+
+	// Dirty foo through one handle, and open another on it that is only read.
+	writer, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	reader, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	err = t.writeFile(foo, writer, "enchilada")
+	AssertEq(nil, err)
+
+	// Open a clean file too.
+	clean, err := t.openFile(bar)
+	AssertEq(nil, err)
+
+	// Only the clean file's handle should be reaped.
+	t.clock.AdvanceTime(handlesTestIdleTimeout)
+	ExpectEq(1, t.fs.reapIdleHandles(t.ctx))
+
+	ExpectTrue(t.reaped(clean))
+	ExpectFalse(t.reaped(writer))
+	ExpectFalse(t.reaped(reader))
+
+	s, err := t.readFile(foo, reader)
+	AssertEq(nil, err)
+	ExpectEq("enchilada", s)
+
+	// Once flushed, the dirty file's handles may be reaped too.
+	err = t.flushFile(foo, writer)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(handlesTestIdleTimeout)
+	ExpectEq(2, t.fs.reapIdleHandles(t.ctx))
+	ExpectTrue(t.reaped(writer))
+	ExpectTrue(t.reaped(reader))
+}
+
+func (t *HandlesTest) HandleSummary() {
+	var err error
+	foo := t.lookUp("foo")
+
+	d, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	t.bufferListing(d)
+
+	f, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	err = t.writeFile(foo, f, "burrito")
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Second)
+
+	infos := t.fs.handleSummary(t.ctx)
+	AssertEq(2, len(infos))
+
+	ExpectEq(d, infos[0].ID)
+	ExpectEq("dir", infos[0].Kind)
+	ExpectEq("", infos[0].Name)
+	ExpectEq(time.Second, infos[0].Idle)
+	ExpectFalse(infos[0].Reaped)
+	ExpectEq("3 buffered entries", infos[0].Resource)
+
+	ExpectEq(f, infos[1].ID)
+	ExpectEq("file", infos[1].Kind)
+	ExpectEq("foo", infos[1].Name)
+	ExpectThat(infos[1].Resource, HasSubstr("dirty bytes buffered"))
+	ExpectThat(infos[1].Resource, Not(HasSubstr(" 0 dirty")))
+}
+
+func (t *HandlesTest) ReleaseDirHandle_ListingStepFails() {
+	d, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	t.bufferListing(d)
+
+	t.fs.releaseStepHook = func(step string) (err error) {
+		if step == "drop listing" {
+			err = errors.New("taco")
+		}
+
+		return
+	}
+
+	err = t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: d})
+	AssertEq(nil, err)
+
+	// The handle should nevertheless have been removed.
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	t.fs.checkInvariants()
+	ExpectEq(nil, t.fs.handles[d])
+	ExpectEq(0, t.fs.liveHandles)
+	ExpectEq(1, t.fs.releaseFailures)
+}
+
+func (t *HandlesTest) ReleaseDirHandle_RemoveStepFails() {
+	d, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	t.bufferListing(d)
+
+	t.fs.releaseStepHook = func(step string) (err error) {
+		if step == "remove from handle table" {
+			err = errors.New("taco")
+		}
+
+		return
+	}
+
+	err = t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: d})
+	AssertEq(nil, err)
+
+	// The listing should nevertheless have been dropped, and the accounting
+	// should still be consistent.
+	ExpectEq(0, t.bufferedEntries(d))
+
+	t.fs.mu.Lock()
+	t.fs.checkInvariants()
+	ExpectEq(1, t.fs.liveHandles)
+	ExpectEq(1, t.fs.releaseFailures)
+	t.fs.mu.Unlock()
+
+	// Releasing again should work.
+	t.fs.releaseStepHook = nil
+	err = t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: d})
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	t.fs.checkInvariants()
+	ExpectEq(nil, t.fs.handles[d])
+	ExpectEq(0, t.fs.liveHandles)
+}
+
+func (t *HandlesTest) ReleaseDirHandle_StepPanics() {
+	d, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	t.bufferListing(d)
+
+	t.fs.releaseStepHook = func(step string) (err error) {
+		if step == "drop listing" {
+			panic("taco")
+		}
+
+		return
+	}
+
+	// The panic should escape rather than being logged as a failure, and
+	// shouldn't leave the file system locked.
+	release := func() {
+		t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: d})
+	}
+
+	ExpectThat(release, Panics(HasSubstr("taco")))
+
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	t.fs.checkInvariants()
+	ExpectEq(0, t.fs.releaseFailures)
+}
+
+func (t *HandlesTest) ReleaseFileHandle_RemoveStepFails() {
+	foo := t.lookUp("foo")
+
+	f, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	t.fs.releaseStepHook = func(step string) (err error) {
+		err = errors.New("taco")
+		return
+	}
+
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: f})
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	t.fs.checkInvariants()
+	ExpectEq(1, t.fs.liveHandles)
+	ExpectEq(1, t.fs.releaseFailures)
+	t.fs.mu.Unlock()
+
+	// Releasing again should work.
+	t.fs.releaseStepHook = nil
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: f})
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	t.fs.checkInvariants()
+	ExpectEq(nil, t.fs.handles[f])
+	ExpectEq(0, t.fs.liveHandles)
+}
+
+func (t *HandlesTest) ReleaseUnknownHandles() {
+	d, err := t.openDir(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	// Releasing handles that don't exist, or with the wrong op, shouldn't
+	// crash, and shouldn't disturb the handles that do exist.
+	err = t.fs.ReleaseDirHandle(&fuseops.ReleaseDirHandleOp{Handle: d + 1})
+	AssertEq(nil, err)
+
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: d})
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	t.fs.checkInvariants()
+	ExpectNe(nil, t.fs.handles[d])
+	ExpectEq(1, t.fs.liveHandles)
+	ExpectEq(2, t.fs.releaseFailures)
+}
+
+func (t *HandlesTest) OpenFileHandlesPinContents() {
+	var err error
+	foo := t.lookUp("foo")
+
+	// Open foo twice and read it.
+	h1, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	h2, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	for _, h := range []fuseops.HandleID{h1, h2} {
+		s, err := t.readFile(foo, h)
+		AssertEq(nil, err)
+		ExpectEq("taco", s)
+	}
+
+	s := t.fs.leaser.Stats()
+	ExpectEq(1, s.PinnedNumFiles)
+	ExpectEq(len("taco"), s.PinnedBytes)
+
+	// The contents stay pinned until the last handle is released, and remain
+	// cached afterward.
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h1})
+	AssertEq(nil, err)
+	ExpectEq(1, t.fs.leaser.Stats().PinnedNumFiles)
+
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h2})
+	AssertEq(nil, err)
+
+	s = t.fs.leaser.Stats()
+	ExpectEq(0, s.PinnedNumFiles)
+	ExpectEq(1, s.NumFiles)
+}
+
+func (t *HandlesTest) PinnedContentsSurviveEviction() {
+	var err error
+	foo := t.lookUp("foo")
+	bar := t.lookUp("bar")
+
+	// Read foo through a handle that stays open, and bar through one that is
+	// released.
+	h, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	_, err = t.readFile(foo, h)
+	AssertEq(nil, err)
+
+	h2, err := t.openFile(bar)
+	AssertEq(nil, err)
+
+	_, err = t.readFile(bar, h2)
+	AssertEq(nil, err)
+
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h2})
+	AssertEq(nil, err)
+
+	// Shrink the limit so that only one of them fits. bar's contents should be
+	// evicted, despite foo's being less recently used.
+	t.fs.leaser.SetLimits(16, int64(len("taco")))
+
+	s := t.fs.leaser.Stats()
+	ExpectEq(1, s.NumFiles)
+	ExpectEq(len("taco"), s.PinnedBytes)
+	ExpectEq(1, s.CapacityRevocations)
+}
+
+func (t *HandlesTest) ReapingUnpinsContents() {
+	var err error
+	foo := t.lookUp("foo")
+
+	h, err := t.openFile(foo)
+	AssertEq(nil, err)
+
+	_, err = t.readFile(foo, h)
+	AssertEq(nil, err)
+	AssertEq(1, t.fs.leaser.Stats().PinnedNumFiles)
+
+	t.clock.AdvanceTime(handlesTestIdleTimeout)
+	AssertEq(1, t.fs.reapIdleHandles(t.ctx))
+	ExpectEq(0, t.fs.leaser.Stats().PinnedNumFiles)
+
+	// Releasing the reaped handle mustn't unpin again.
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h})
+	AssertEq(nil, err)
+	ExpectEq(0, t.fs.releaseFailures)
+}
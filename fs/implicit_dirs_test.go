@@ -103,12 +103,15 @@ func (t *ImplicitDirsTest) DirectoryObjectPresent() {
 				"foo/": "",
 			}))
 
-	// Statting the name should return an entry for the directory.
+	// Statting the name should return an entry for the directory, with
+	// synthesized attributes.
 	fi, err = os.Stat(path.Join(t.mfs.Dir(), "foo"))
 	AssertEq(nil, err)
 
 	ExpectEq("foo", fi.Name())
 	ExpectTrue(fi.IsDir())
+	ExpectEq(dirPerms|os.ModeDir, fi.Mode())
+	ExpectEq(0, fi.Size())
 
 	// ReadDir should show the directory.
 	entries, err = fusetesting.ReadDirPicky(t.mfs.Dir())
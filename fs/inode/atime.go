@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// The object metadata key under which a file's access time may be recorded,
+// in RFC 3339 format. See FileInode.PersistAtime.
+const AtimeMetadataKey = "gcsfuse_atime"
+
+// The feature under which the object fields that atimes need are registered
+// with gcsproxy.ObjectFields.
+const AtimeObjectFields = "atimes"
+
+func init() {
+	gcsproxy.ObjectFields.Register(
+		AtimeObjectFields,
+		"metadata/"+AtimeMetadataKey)
+}
+
+// Return the access time recorded in the supplied object's metadata, or the
+// zero time if there is none that we can parse. Unlike mtimes, atimes are
+// only ever written by us, so there is no need to be lenient.
+func objectAtime(o *gcs.Object) (atime time.Time) {
+	value, ok := o.Metadata[AtimeMetadataKey]
+	if !ok {
+		return
+	}
+
+	atime, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		atime = time.Time{}
+		return
+	}
+
+	return
+}
@@ -17,10 +17,12 @@ package inode
 import (
 	"fmt"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/gcloud/gcs"
@@ -130,9 +132,18 @@ type DirInode interface {
 		ctx context.Context,
 		name string) (o *gcs.Object, err error)
 
+	// Like CreateChildDir, except clone the supplied placeholder object of
+	// another directory. As with CreateChildDir, fail with
+	// *gcs.PreconditionError if a backing object already exists.
+	CloneToChildDir(
+		ctx context.Context,
+		name string,
+		src *gcs.Object) (o *gcs.Object, err error)
+
 	// Delete the backing object for the child file or symlink with the given
-	// (relative) name and generation, where zero means the latest generation. If
-	// the object/generation doesn't exist, no error is returned.
+	// (relative) name. If generation is non-zero, the object is deleted only if
+	// that is still its latest generation, failing with *gcs.PreconditionError
+	// otherwise. If the object doesn't exist, no error is returned.
 	DeleteChildFile(
 		ctx context.Context,
 		name string,
@@ -143,6 +154,33 @@ type DirInode interface {
 	DeleteChildDir(
 		ctx context.Context,
 		name string) (err error)
+
+	// Return the children recently created or deleted through the methods
+	// above, which results from ReadEntries may not yet reflect. Sorted by name,
+	// with directories before files and symlinks of the same name.
+	//
+	// Deleted children are also hidden from LookUpChild and ReadEntries
+	// while their tombstones last, unless GCS shows that they have since been
+	// re-created; see NewDirInode.
+	RecentChanges() (children []LocalChild)
+
+	// Return true if the directory is known to no longer exist in GCS, because
+	// a complete listing by ReadEntries found neither its backing object nor
+	// anything beneath it, with nothing recently created in it through this
+	// inode, or because of a call to SetDeletedRemotely. While true,
+	// LookUpChild finds nothing and ReadEntries returns no entries, both
+	// without consulting GCS. The root directory is never considered deleted.
+	DeletedRemotely() bool
+
+	// Record whether the directory is known to no longer exist in GCS, for
+	// example because looking it up in its parent found nothing, or found it
+	// again. See DeletedRemotely.
+	SetDeletedRemotely(deleted bool)
+
+	// Throw away any cached knowledge of the type of the child with the given
+	// (relative) name, e.g. because another client is known to have changed
+	// it, so that the next lookup asks GCS.
+	ForgetChildType(name string)
 }
 
 type dirInode struct {
@@ -159,6 +197,7 @@ type dirInode struct {
 
 	id           fuseops.InodeID
 	implicitDirs bool
+	gzipViews    GzipViewConfig
 
 	// INVARIANT: name == "" || name[len(name)-1] == '/'
 	name string
@@ -180,6 +219,21 @@ type dirInode struct {
 	//
 	// GUARDED_BY(mu)
 	cache typeCache
+
+	// Children created and deleted through this inode that listings may not yet
+	// reflect.
+	//
+	// recent.CheckInvariants() does not panic.
+	//
+	// GUARDED_BY(mu)
+	recent recentChanges
+
+	// See DeletedRemotely.
+	//
+	// INVARIANT: If deletedRemotely, name != ""
+	//
+	// GUARDED_BY(mu)
+	deletedRemotely bool
 }
 
 var _ DirInode = &dirInode{}
@@ -200,6 +254,16 @@ var _ DirInode = &dirInode{}
 // child is removed and recreated with a different type before the expiration,
 // we may fail to find it.
 //
+// Children deleted through the inode are remembered for tombstoneTTL (or
+// DefaultTombstoneTTL if zero), during which copies of them in listings or
+// stat caches that predate the deletion are hidden from ReadEntries and
+// LookUpChild. A tombstone is dropped early if the name is re-created through
+// the inode, if a listing made after the deletion doesn't contain it, or if a
+// listing shows a generation newer than the deletion.
+//
+// gzipViews controls the names under which decompressed views of
+// gzip-compressed children are listed and looked up.
+//
 // The initial lookup count is zero.
 //
 // REQUIRES: IsDirName(name)
@@ -209,6 +273,8 @@ func NewDirInode(
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
 	typeCacheTTL time.Duration,
+	tombstoneTTL time.Duration,
+	gzipViews GzipViewConfig,
 	bucket gcs.Bucket,
 	clock timeutil.Clock) (d DirInode) {
 	if !IsDirName(name) {
@@ -222,9 +288,11 @@ func NewDirInode(
 		clock:        clock,
 		id:           id,
 		implicitDirs: implicitDirs,
+		gzipViews:    gzipViews,
 		name:         name,
 		attrs:        attrs,
 		cache:        newTypeCache(typeCacheCapacity/2, typeCacheTTL),
+		recent:       recentChanges{tombstoneTTL: tombstoneTTL},
 	}
 
 	typed.lc.Init(id)
@@ -248,6 +316,40 @@ func (d *dirInode) checkInvariants() {
 
 	// cache.CheckInvariants() does not panic.
 	d.cache.CheckInvariants()
+
+	// recent.CheckInvariants() does not panic.
+	d.recent.CheckInvariants()
+
+	// INVARIANT: If deletedRemotely, name != ""
+	if d.deletedRemotely && d.name == "" {
+		panic("Root directory marked deleted")
+	}
+}
+
+// Return true if the supplied listing, made from the start, shows that the
+// directory no longer exists in GCS. See DirInode.DeletedRemotely.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) listingShowsDeleted(
+	now time.Time,
+	tok string,
+	listing *gcs.Listing) bool {
+	if d.name == "" || tok != "" || listing.ContinuationToken != "" {
+		return false
+	}
+
+	if len(listing.Objects) != 0 || len(listing.CollapsedRuns) != 0 {
+		return false
+	}
+
+	// The listing may not yet reflect children created through this inode.
+	for _, c := range d.recent.List(now) {
+		if !c.Deleted {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (d *dirInode) lookUpChildFile(
@@ -260,6 +362,12 @@ func (d *dirInode) lookUpChildFile(
 		return
 	}
 
+	// Don't resurrect a file we deleted from a stale stat.
+	if result.Object != nil &&
+		d.recent.Hides(d.clock.Now(), name, false, result.Object) {
+		result.Object = nil
+	}
+
 	return
 }
 
@@ -304,6 +412,16 @@ func (d *dirInode) lookUpChildDir(
 		return
 	}
 
+	// Don't resurrect a directory we deleted from a stale stat or listing.
+	now := d.clock.Now()
+	if result.Object != nil && d.recent.Hides(now, name, true, result.Object) {
+		result.Object = nil
+	}
+
+	if result.ImplicitDir && d.recent.Hides(now, name, true, nil) {
+		result.ImplicitDir = false
+	}
+
 	return
 }
 
@@ -340,6 +458,132 @@ func (d *dirInode) lookUpConflicting(
 	return
 }
 
+// Look for a decompressed view that would be listed under the supplied name
+// with its suffix dropped. Return a result with !result.Exists() if there is
+// none.
+func (d *dirInode) lookUpSuffixedView(
+	ctx context.Context,
+	name string) (result LookUpResult, err error) {
+	for _, s := range d.gzipViews.Suffixes {
+		result, err = d.lookUpChildFile(ctx, name+s)
+		if err != nil || result.Exists() {
+			return
+		}
+	}
+
+	return
+}
+
+// Rename the decompressed views among the supplied directory entries to drop
+// their suffixes, except where the stripped name is in use by another child.
+// Such a child may not be among the entries (it may be on another page of the
+// listing), so if necessary we go looking for it.
+func (d *dirInode) dropViewSuffixes(
+	ctx context.Context,
+	entries []fuseutil.Dirent) (err error) {
+	taken := make(map[string]bool)
+	for _, e := range entries {
+		taken[e.Name] = true
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		if e.Type != fuseutil.DT_File {
+			continue
+		}
+
+		suffix := d.gzipViews.MatchSuffix(e.Name)
+		if suffix == "" {
+			continue
+		}
+
+		stripped := strings.TrimSuffix(e.Name, suffix)
+		if taken[stripped] {
+			continue
+		}
+
+		var fileResult LookUpResult
+		fileResult, err = d.lookUpChildFile(ctx, stripped)
+		if err != nil {
+			return
+		}
+
+		var dirResult LookUpResult
+		dirResult, err = d.lookUpChildDir(ctx, stripped)
+		if err != nil {
+			return
+		}
+
+		if fileResult.Exists() || dirResult.Exists() {
+			continue
+		}
+
+		taken[stripped] = true
+		e.Name = stripped
+	}
+
+	return
+}
+
+// Reconcile our tombstones with a page of listing results requested at
+// listedAt using the continuation token tok. A tombstone is dropped if the
+// page shows a generation of the child newer than the deletion, or if the
+// page was requested after the deletion and covers the child's name without
+// containing it.
+func (d *dirInode) reconcileTombstones(
+	listedAt time.Time,
+	tok string,
+	listing *gcs.Listing) {
+	// Find what the page contains, and the range of names it covers: from the
+	// start if it's the first page, and to the end if it's the last.
+	files := make(map[string]*gcs.Object)
+	dirs := make(map[string]bool)
+	var names []string
+
+	for _, o := range listing.Objects {
+		if o.Name != d.Name() {
+			files[path.Base(o.Name)] = o
+			names = append(names, o.Name)
+		}
+	}
+
+	for _, p := range listing.CollapsedRuns {
+		dirs[path.Base(p)] = true
+		names = append(names, p)
+	}
+
+	sort.Strings(names)
+
+	first := tok == ""
+	last := listing.ContinuationToken == ""
+	covers := func(fullName string) bool {
+		if len(names) == 0 {
+			return first && last
+		}
+
+		return (first || fullName >= names[0]) &&
+			(last || fullName <= names[len(names)-1])
+	}
+
+	// Listed files newer than a deletion have been re-created elsewhere.
+	now := d.clock.Now()
+	for name, o := range files {
+		if !d.recent.Hides(now, name, false, o) {
+			d.recent.ForgetDeletion(name, false)
+		}
+	}
+
+	d.recent.ConfirmAbsent(
+		listedAt,
+		func(name string, dir bool) bool {
+			if dir {
+				return !dirs[name] && covers(d.Name()+name+"/")
+			}
+
+			return files[name] == nil && covers(d.Name()+name)
+		})
+}
+
 // List the supplied object name prefix to find out whether it is non-empty.
 func objectNamePrefixNonEmpty(
 	ctx context.Context,
@@ -602,6 +846,11 @@ const ConflictingFileNameSuffix = "\n"
 func (d *dirInode) LookUpChild(
 	ctx context.Context,
 	name string) (result LookUpResult, err error) {
+	// Nothing can be found in a directory that no longer exists.
+	if d.deletedRemotely {
+		return
+	}
+
 	// Consult the cache about the type of the child. This may save us work
 	// below.
 	now := d.clock.Now()
@@ -650,6 +899,16 @@ func (d *dirInode) LookUpChild(
 		result = fileResult
 	}
 
+	// Failing both, the name may be a decompressed view listed without its
+	// suffix.
+	if !result.Exists() && d.gzipViews.DropSuffix {
+		result, err = d.lookUpSuffixedView(ctx, name)
+		if err != nil {
+			err = fmt.Errorf("lookUpSuffixedView: %v", err)
+			return
+		}
+	}
+
 	// Update the cache.
 	now = d.clock.Now()
 	if fileResult.Exists() {
@@ -667,6 +926,11 @@ func (d *dirInode) LookUpChild(
 func (d *dirInode) ReadEntries(
 	ctx context.Context,
 	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
+	// Nothing can be listed in a directory that no longer exists.
+	if d.deletedRemotely {
+		return
+	}
+
 	// Ask the bucket to list some objects.
 	req := &gcs.ListObjectsRequest{
 		Delimiter:         "/",
@@ -674,13 +938,24 @@ func (d *dirInode) ReadEntries(
 		ContinuationToken: tok,
 	}
 
+	listedAt := d.clock.Now()
 	listing, err := d.bucket.ListObjects(ctx, req)
 	if err != nil {
 		err = fmt.Errorf("ListObjects: %v", err)
 		return
 	}
 
+	// Drop the tombstones that this page shows to be unnecessary.
+	d.reconcileTombstones(listedAt, tok, listing)
+
+	// Has the directory gone away?
+	if d.listingShowsDeleted(d.clock.Now(), tok, listing) {
+		d.deletedRemotely = true
+		return
+	}
+
 	// Convert objects to entries for files or symlinks.
+	now := d.clock.Now()
 	for _, o := range listing.Objects {
 		// Skip the entry for the backing object itself, which of course has its
 		// own name as a prefix but which we don't wan to appear to contain itself.
@@ -688,6 +963,11 @@ func (d *dirInode) ReadEntries(
 			continue
 		}
 
+		// Skip stale entries for files we've deleted.
+		if d.recent.Hides(now, path.Base(o.Name), false, o) {
+			continue
+		}
+
 		e := fuseutil.Dirent{
 			Name: path.Base(o.Name),
 			Type: fuseutil.DT_File,
@@ -700,10 +980,16 @@ func (d *dirInode) ReadEntries(
 		entries = append(entries, e)
 	}
 
-	// Extract directory names from the collapsed runs.
+	// Extract directory names from the collapsed runs, skipping directories
+	// we've deleted.
 	var dirNames []string
 	for _, p := range listing.CollapsedRuns {
-		dirNames = append(dirNames, path.Base(p))
+		name := path.Base(p)
+		if d.recent.Hides(now, name, true, nil) {
+			continue
+		}
+
+		dirNames = append(dirNames, name)
 	}
 
 	// Filter the directory names according to our implicit directory settings.
@@ -723,11 +1009,20 @@ func (d *dirInode) ReadEntries(
 		entries = append(entries, e)
 	}
 
+	// Rename decompressed views, if requested.
+	if d.gzipViews.DropSuffix {
+		err = d.dropViewSuffixes(ctx, entries)
+		if err != nil {
+			err = fmt.Errorf("dropViewSuffixes: %v", err)
+			return
+		}
+	}
+
 	// Return an appropriate continuation token, if any.
 	newTok = listing.ContinuationToken
 
 	// Update the type cache with everything we learned.
-	now := d.clock.Now()
+	now = d.clock.Now()
 	for _, e := range entries {
 		switch e.Type {
 		case fuseutil.DT_File:
@@ -750,7 +1045,9 @@ func (d *dirInode) CreateChildFile(
 		return
 	}
 
-	d.cache.NoteFile(d.clock.Now(), name)
+	now := d.clock.Now()
+	d.cache.NoteFile(now, name)
+	d.recent.Note(now, LocalChild{Name: name, Type: fuseutil.DT_File})
 
 	return
 }
@@ -770,6 +1067,7 @@ func (d *dirInode) CloneToChildFile(
 			SrcName:       src.Name,
 			SrcGeneration: src.Generation,
 			DstName:       path.Join(d.Name(), name),
+			DstKmsKeyName: gcsproxy.KmsKeyName(src),
 		})
 
 	if err != nil {
@@ -777,7 +1075,9 @@ func (d *dirInode) CloneToChildFile(
 	}
 
 	// Update the type cache.
-	d.cache.NoteFile(d.clock.Now(), name)
+	now := d.clock.Now()
+	d.cache.NoteFile(now, name)
+	d.recent.Note(now, LocalChild{Name: name, Type: fuseutil.DT_File})
 
 	return
 }
@@ -796,7 +1096,9 @@ func (d *dirInode) CreateChildSymlink(
 		return
 	}
 
-	d.cache.NoteFile(d.clock.Now(), name)
+	now := d.clock.Now()
+	d.cache.NoteFile(now, name)
+	d.recent.Note(now, LocalChild{Name: name, Type: fuseutil.DT_Link})
 
 	return
 }
@@ -810,30 +1112,74 @@ func (d *dirInode) CreateChildDir(
 		return
 	}
 
-	d.cache.NoteDir(d.clock.Now(), name)
+	now := d.clock.Now()
+	d.cache.NoteDir(now, name)
+	d.recent.Note(now, LocalChild{Name: name, Type: fuseutil.DT_Directory})
 
 	return
 }
 
 // LOCKS_REQUIRED(d)
-func (d *dirInode) DeleteChildFile(
+func (d *dirInode) CloneToChildDir(
 	ctx context.Context,
 	name string,
-	generation int64) (err error) {
+	src *gcs.Object) (o *gcs.Object, err error) {
 	d.cache.Erase(name)
 
-	err = d.bucket.DeleteObject(
+	var precond int64
+	o, err = d.bucket.CopyObject(
 		ctx,
-		&gcs.DeleteObjectRequest{
-			Name:       path.Join(d.Name(), name),
-			Generation: generation,
+		&gcs.CopyObjectRequest{
+			SrcName:                   src.Name,
+			SrcGeneration:             src.Generation,
+			DstName:                   path.Join(d.Name(), name) + "/",
+			DstGenerationPrecondition: &precond,
+			DstKmsKeyName:             gcsproxy.KmsKeyName(src),
 		})
 
+	if err != nil {
+		return
+	}
+
+	now := d.clock.Now()
+	d.cache.NoteDir(now, name)
+	d.recent.Note(now, LocalChild{Name: name, Type: fuseutil.DT_Directory})
+
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) DeleteChildFile(
+	ctx context.Context,
+	name string,
+	generation int64) (err error) {
+	d.cache.Erase(name)
+
+	req := &gcs.DeleteObjectRequest{
+		Name: path.Join(d.Name(), name),
+	}
+
+	if generation != 0 {
+		req.GenerationPrecondition = &generation
+	}
+
+	err = d.bucket.DeleteObject(ctx, req)
+
+	// Special case: don't mess with precondition errors.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		return
+	}
+
 	if err != nil {
 		err = fmt.Errorf("DeleteObject: %v", err)
 		return
 	}
 
+	d.recent.NoteDeletion(
+		d.clock.Now(),
+		LocalChild{Name: name, Type: fuseutil.DT_File, Deleted: true},
+		generation)
+
 	return
 }
 
@@ -856,5 +1202,31 @@ func (d *dirInode) DeleteChildDir(
 		return
 	}
 
+	d.recent.NoteDeletion(
+		d.clock.Now(),
+		LocalChild{Name: name, Type: fuseutil.DT_Directory, Deleted: true},
+		0) // Latest generation
+
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) RecentChanges() (children []LocalChild) {
+	children = d.recent.List(d.clock.Now())
 	return
 }
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) DeletedRemotely() bool {
+	return d.deletedRemotely
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) SetDeletedRemotely(deleted bool) {
+	d.deletedRemotely = deleted && d.name != ""
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) ForgetChildType(name string) {
+	d.cache.Erase(name)
+}
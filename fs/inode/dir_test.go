@@ -18,6 +18,7 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,12 +45,16 @@ const dirInodeID = 17
 const dirInodeName = "foo/bar/"
 const dirMode os.FileMode = 0712 | os.ModeDir
 const typeCacheTTL = time.Second
+const tombstoneTTL = 30 * time.Second
 
 type DirTest struct {
 	ctx    context.Context
 	bucket gcs.Bucket
 	clock  timeutil.SimulatedClock
 
+	// Used by resetInode. Empty by default.
+	gzipViews inode.GzipViewConfig
+
 	in inode.DirInode
 }
 
@@ -96,6 +101,8 @@ func (t *DirTest) resetInode(implicitDirs bool) {
 		},
 		implicitDirs,
 		typeCacheTTL,
+		tombstoneTTL,
+		t.gzipViews,
 		t.bucket,
 		&t.clock)
 
@@ -649,6 +656,148 @@ func (t *DirTest) ReadEntries_TypeCaching() {
 	ExpectEq(dirObjName, o.Name)
 }
 
+func (t *DirTest) ReadEntries_GzipViews_KeepSuffix() {
+	var err error
+
+	t.gzipViews = inode.GzipViewConfig{Suffixes: []string{".gz"}}
+	t.resetInode(false)
+
+	// Set up contents.
+	objs := []string{
+		dirInodeName + "foo.gz",
+		dirInodeName + "bar.gz/",
+	}
+
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
+	AssertEq(nil, err)
+
+	// Names should be untouched.
+	entries, err := t.readAllEntries()
+
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("bar.gz", entries[0].Name)
+	ExpectEq("foo.gz", entries[1].Name)
+}
+
+func (t *DirTest) ReadEntries_GzipViews_DropSuffix() {
+	var err error
+	var entry fuseutil.Dirent
+
+	t.gzipViews = inode.GzipViewConfig{
+		Suffixes:   []string{".gz", ".gzip"},
+		DropSuffix: true,
+	}
+
+	t.resetInode(false)
+
+	// Set up contents.
+	objs := []string{
+		// No collision.
+		dirInodeName + "a.gz",
+		dirInodeName + "b.gzip",
+
+		// Collision with a file.
+		dirInodeName + "c",
+		dirInodeName + "c.gz",
+
+		// Collision with a directory.
+		dirInodeName + "d.gz",
+		dirInodeName + "d/",
+
+		// A directory with a matching name.
+		dirInodeName + "e.gz/",
+
+		// A file consisting solely of the suffix.
+		dirInodeName + ".gz",
+	}
+
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
+	AssertEq(nil, err)
+
+	// Read entries.
+	entries, err := t.readAllEntries()
+
+	AssertEq(nil, err)
+	AssertEq(8, len(entries))
+
+	entry = entries[0]
+	ExpectEq(".gz", entry.Name)
+	ExpectEq(fuseutil.DT_File, entry.Type)
+
+	entry = entries[1]
+	ExpectEq("a", entry.Name)
+	ExpectEq(fuseutil.DT_File, entry.Type)
+
+	entry = entries[2]
+	ExpectEq("b", entry.Name)
+	ExpectEq(fuseutil.DT_File, entry.Type)
+
+	entry = entries[3]
+	ExpectEq("c", entry.Name)
+	ExpectEq(fuseutil.DT_File, entry.Type)
+
+	entry = entries[4]
+	ExpectEq("c.gz", entry.Name)
+	ExpectEq(fuseutil.DT_File, entry.Type)
+
+	entry = entries[5]
+	ExpectEq("d", entry.Name)
+	ExpectEq(fuseutil.DT_Directory, entry.Type)
+
+	entry = entries[6]
+	ExpectEq("d.gz", entry.Name)
+	ExpectEq(fuseutil.DT_File, entry.Type)
+
+	entry = entries[7]
+	ExpectEq("e.gz", entry.Name)
+	ExpectEq(fuseutil.DT_Directory, entry.Type)
+}
+
+func (t *DirTest) LookUpChild_GzipViews_DropSuffix() {
+	var result inode.LookUpResult
+	var err error
+
+	t.gzipViews = inode.GzipViewConfig{
+		Suffixes:   []string{".gz"},
+		DropSuffix: true,
+	}
+
+	t.resetInode(false)
+
+	// Set up contents.
+	objs := []string{
+		dirInodeName + "a.gz",
+		dirInodeName + "c",
+		dirInodeName + "c.gz",
+	}
+
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
+	AssertEq(nil, err)
+
+	// A view can be found under either name.
+	result, err = t.in.LookUpChild(t.ctx, "a")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"a.gz", result.FullName)
+
+	result, err = t.in.LookUpChild(t.ctx, "a.gz")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"a.gz", result.FullName)
+
+	// A real file takes precedence.
+	result, err = t.in.LookUpChild(t.ctx, "c")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"c", result.FullName)
+
+	// Names that don't exist either way still don't.
+	result, err = t.in.LookUpChild(t.ctx, "b")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
 func (t *DirTest) CreateChildFile_DoesntExist() {
 	const name = "qux"
 	objName := path.Join(dirInodeName, name)
@@ -942,6 +1091,101 @@ func (t *DirTest) CreateChildDir_Exists() {
 	ExpectThat(err, Error(HasSubstr("exists")))
 }
 
+func (t *DirTest) CreateChildDir_TypeCaching() {
+	const name = "qux"
+	fileObjName := path.Join(dirInodeName, name)
+	dirObjName := path.Join(dirInodeName, name) + "/"
+
+	var o *gcs.Object
+	var err error
+
+	// Create the name.
+	_, err = t.in.CreateChildDir(t.ctx, name)
+	AssertEq(nil, err)
+
+	// Replace the directory with a file behind the inode's back.
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: dirObjName})
+
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, "taco")
+	AssertEq(nil, err)
+
+	// Because we've cached that the name is a directory, we shouldn't go
+	// looking for the file.
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectEq(nil, result.Object)
+
+	// But after the TTL expires, we should find it.
+	t.clock.AdvanceTime(typeCacheTTL + time.Millisecond)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	o = result.Object
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(fileObjName, o.Name)
+}
+
+func (t *DirTest) CloneToChildDir() {
+	const srcName = "blah/baz/"
+	dstName := path.Join(dirInodeName, "qux") + "/"
+
+	var o *gcs.Object
+	var err error
+
+	// Create the source, with some metadata.
+	src, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     srcName,
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{"color": "blue"},
+		})
+
+	AssertEq(nil, err)
+
+	// Call the inode.
+	o, err = t.in.CloneToChildDir(t.ctx, "qux", src)
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(dstName, o.Name)
+	ExpectEq("blue", o.Metadata["color"])
+
+	// Looking up the name should find the directory.
+	result, err := t.in.LookUpChild(t.ctx, "qux")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+
+	ExpectEq(dstName, result.FullName)
+}
+
+func (t *DirTest) CloneToChildDir_Exists() {
+	const srcName = "blah/baz/"
+	dstName := path.Join(dirInodeName, "qux") + "/"
+
+	// Create the source and an existing backing object.
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, srcName, "")
+	AssertEq(nil, err)
+
+	existing, err := gcsutil.CreateObject(t.ctx, t.bucket, dstName, "")
+	AssertEq(nil, err)
+
+	// Call the inode.
+	_, err = t.in.CloneToChildDir(t.ctx, "qux", src)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	// The existing object should be untouched.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: dstName})
+	AssertEq(nil, err)
+	ExpectEq(existing.Generation, o.Generation)
+}
+
 func (t *DirTest) DeleteChildFile_DoesntExist() {
 	const name = "qux"
 
@@ -959,9 +1203,9 @@ func (t *DirTest) DeleteChildFile_WrongGeneration() {
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, "taco")
 	AssertEq(nil, err)
 
-	// Call the inode with the wrong generation. No error should be returned.
+	// Call the inode with the wrong generation. It should refuse.
 	err = t.in.DeleteChildFile(t.ctx, name, o.Generation+1)
-	AssertEq(nil, err)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
 
 	// The original generation should still be there.
 	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, objName)
@@ -1070,3 +1314,80 @@ func (t *DirTest) DeleteChildDir_Exists() {
 	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
+
+func (t *DirTest) DeleteChildDir_TypeCaching() {
+	const name = "qux"
+	fileObjName := path.Join(dirInodeName, name)
+
+	var o *gcs.Object
+	var err error
+
+	// Create the name, priming the type cache.
+	_, err = t.in.CreateChildDir(t.ctx, name)
+	AssertEq(nil, err)
+
+	// Create a backing object for a file. Because of the cache it should not
+	// be found.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, "taco")
+	AssertEq(nil, err)
+
+	// After deleting the directory via the inode, the file should be revealed
+	// without waiting for the TTL.
+	err = t.in.DeleteChildDir(t.ctx, name)
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, name)
+	o = result.Object
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(fileObjName, o.Name)
+}
+
+func (t *DirTest) RecentChanges() {
+	var err error
+
+	// Initially there are none.
+	ExpectEq(0, len(t.in.RecentChanges()))
+
+	// Create and delete some children.
+	_, err = t.in.CreateChildFile(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	_, err = t.in.CreateChildSymlink(t.ctx, "bar", "target")
+	AssertEq(nil, err)
+
+	_, err = t.in.CreateChildDir(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	_, err = t.in.CreateChildDir(t.ctx, "baz")
+	AssertEq(nil, err)
+
+	err = t.in.DeleteChildDir(t.ctx, "baz")
+	AssertEq(nil, err)
+
+	// The later change for "baz" should replace the earlier one.
+	children := t.in.RecentChanges()
+	AssertEq(4, len(children))
+
+	ExpectEq("bar", children[0].Name)
+	ExpectEq(fuseutil.DT_Link, children[0].Type)
+	ExpectFalse(children[0].Deleted)
+
+	ExpectEq("baz", children[1].Name)
+	ExpectEq(fuseutil.DT_Directory, children[1].Type)
+	ExpectTrue(children[1].Deleted)
+
+	ExpectEq("foo", children[2].Name)
+	ExpectEq(fuseutil.DT_Directory, children[2].Type)
+	ExpectFalse(children[2].Deleted)
+
+	ExpectEq("foo", children[3].Name)
+	ExpectEq(fuseutil.DT_File, children[3].Type)
+	ExpectFalse(children[3].Deleted)
+
+	// After a while, they are forgotten.
+	t.clock.AdvanceTime(2 * time.Minute)
+	ExpectEq(0, len(t.in.RecentChanges()))
+}
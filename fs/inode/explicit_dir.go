@@ -39,6 +39,8 @@ func NewExplicitDirInode(
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
 	typeCacheTTL time.Duration,
+	tombstoneTTL time.Duration,
+	gzipViews GzipViewConfig,
 	bucket gcs.Bucket,
 	clock timeutil.Clock) (d ExplicitDirInode) {
 	wrapped := NewDirInode(
@@ -47,6 +49,8 @@ func NewExplicitDirInode(
 		attrs,
 		implicitDirs,
 		typeCacheTTL,
+		tombstoneTTL,
+		gzipViews,
 		bucket,
 		clock)
 
@@ -15,8 +15,11 @@
 package inode
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
 	"github.com/googlecloudplatform/gcsfuse/lease"
@@ -28,6 +31,39 @@ import (
 	"golang.org/x/net/context"
 )
 
+var errReadOnlyView = errors.New("Decompressed views are read-only")
+
+// The largest object GCS will store, and therefore the largest size to which a
+// file may grow.
+const MaxFileSize = 5 << 40
+
+// Returned by FileInode.Write and Truncate when the file would grow beyond
+// MaxFileSize.
+var ErrFileTooLarge = errors.New("File would exceed the maximum object size")
+
+// Returned by FileInode.Sync when local modifications can't be written out
+// because the object in GCS has been overwritten or deleted since the
+// generation they derive from, and thereafter by any call that would modify
+// the inode or write it out. See FileInode.Stale.
+type ClobberedError struct {
+	Name string
+
+	// The generation from which the inode's contents derive.
+	Expected int64
+
+	// The generation found in GCS instead, or zero if the object has been
+	// deleted or the generation is unknown.
+	Observed int64
+}
+
+func (ce *ClobberedError) Error() string {
+	return fmt.Sprintf(
+		"%q has been clobbered: expected generation %d, observed %d",
+		ce.Name,
+		ce.Expected,
+		ce.Observed)
+}
+
 type FileInode struct {
 	/////////////////////////
 	// Dependencies
@@ -35,6 +71,7 @@ type FileInode struct {
 
 	bucket       gcs.Bucket
 	leaser       lease.FileLeaser
+	evictions    *gcsproxy.EvictionTracker
 	objectSyncer gcsproxy.ObjectSyncer
 	clock        timeutil.Clock
 
@@ -42,10 +79,13 @@ type FileInode struct {
 	// Constant data
 	/////////////////////////
 
-	id           fuseops.InodeID
-	name         string
-	attrs        fuseops.InodeAttributes
-	gcsChunkSize uint64
+	id                fuseops.InodeID
+	name              string
+	attrs             fuseops.InodeAttributes
+	gcsChunkSize      uint64
+	readaheadChunks   int
+	validateChecksums bool
+	mtimeLayouts      []string
 
 	/////////////////////////
 	// Mutable state
@@ -65,6 +105,11 @@ type FileInode struct {
 	// GUARDED_BY(mu)
 	src gcs.Object
 
+	// The modification time of the source object. See objectMtime.
+	//
+	// GUARDED_BY(mu)
+	srcMtime time.Time
+
 	// The current content of this inode, branched from the source object.
 	//
 	// INVARIANT: content.CheckInvariants() does not panic
@@ -72,6 +117,64 @@ type FileInode struct {
 	// GUARDED_BY(mu)
 	content mutable.Content
 
+	// If non-nil, the inode presents the decompressed contents of the source
+	// object through this view, and content is unused. See
+	// NewDecompressedFileInode.
+	//
+	// GUARDED_BY(mu)
+	gzip gcsproxy.GzipView
+
+	// Set when the next sync should rewrite the object in full. See Flatten.
+	//
+	// GUARDED_BY(mu)
+	flattenRequested bool
+
+	// Set when a sync has found that the local modifications can never be
+	// written out. See Stale.
+	//
+	// GUARDED_BY(mu)
+	stale *ClobberedError
+
+	// The file's access time as far as we know, or zero if we know nothing, in
+	// which case the modification time is reported instead. See NoteAccess and
+	// SetAtime.
+	//
+	// GUARDED_BY(mu)
+	atime time.Time
+
+	// The access time recorded in the source object's metadata, or zero if
+	// none, whether atime was last set explicitly, when PersistAtime last wrote
+	// to GCS, and whether it is writing now. See PersistAtime.
+	//
+	// GUARDED_BY(mu)
+	srcAtime         time.Time
+	atimeExplicit    bool
+	atimePersistedAt time.Time
+	persistingAtime  bool
+
+	// The number of calls to PinContents not yet matched by UnpinContents.
+	// While positive, content is pinned.
+	//
+	// INVARIANT: pins >= 0
+	//
+	// GUARDED_BY(mu)
+	pins int
+
+	// Set while WriteBack is uploading a copy of the content without holding
+	// mu, along with the ranges written since the copy was taken and whether
+	// the content has been truncated since. See WriteBack.
+	//
+	// INVARIANT: writingBack || (writtenDuringWriteBack == nil &&
+	//                            !truncatedDuringWriteBack)
+	//
+	// GUARDED_BY(mu)
+	writingBack              bool
+	writtenDuringWriteBack   []lease.ByteRange
+	truncatedDuringWriteBack bool
+
+	// Signalled when writingBack is cleared.
+	writeBackDone *sync.Cond
+
 	// Has Destroy been called?
 	//
 	// GUARDED_BY(mu)
@@ -84,7 +187,10 @@ var _ Inode = &FileInode{}
 // zero.
 //
 // gcsChunkSize controls the maximum size of each individual read request made
-// to GCS.
+// to GCS, and readaheadChunks how many chunks to fetch ahead of sequential
+// reads. validateChecksums controls whether what is read is checked against
+// the object's checksum (see gcsproxy.NewReadProxy). mtimeLayouts are passed to ParseMtime when interpreting the object's
+// mtime metadata. evictions may be nil.
 //
 // REQUIRES: o != nil
 // REQUIRES: o.Generation > 0
@@ -95,35 +201,90 @@ func NewFileInode(
 	o *gcs.Object,
 	attrs fuseops.InodeAttributes,
 	gcsChunkSize uint64,
+	readaheadChunks int,
+	validateChecksums bool,
+	mtimeLayouts []string,
 	bucket gcs.Bucket,
 	leaser lease.FileLeaser,
+	evictions *gcsproxy.EvictionTracker,
 	objectSyncer gcsproxy.ObjectSyncer,
 	clock timeutil.Clock) (f *FileInode) {
 	// Set up the basic struct.
 	f = &FileInode{
-		bucket:       bucket,
-		leaser:       leaser,
-		objectSyncer: objectSyncer,
-		clock:        clock,
-		id:           id,
-		name:         o.Name,
-		attrs:        attrs,
-		gcsChunkSize: gcsChunkSize,
-		src:          *o,
+		bucket:            bucket,
+		leaser:            leaser,
+		evictions:         evictions,
+		objectSyncer:      objectSyncer,
+		clock:             clock,
+		id:                id,
+		name:              o.Name,
+		attrs:             attrs,
+		gcsChunkSize:      gcsChunkSize,
+		readaheadChunks:   readaheadChunks,
+		validateChecksums: validateChecksums,
+		mtimeLayouts:      mtimeLayouts,
+		src:               *o,
+		srcMtime:          objectMtime(o, mtimeLayouts, clock.Now()),
+		srcAtime:          objectAtime(o),
 		content: mutable.NewContent(
 			gcsproxy.NewReadProxy(
 				o,
 				nil, // Initial read lease
 				gcsChunkSize,
+				readaheadChunks,
+				validateChecksums,
 				leaser,
+				evictions,
 				bucket),
 			clock),
 	}
 
+	f.atime = f.srcAtime
 	f.lc.Init(id)
 
 	// Set up invariant checking.
 	f.mu = syncutil.NewInvariantMutex(f.checkInvariants)
+	f.writeBackDone = sync.NewCond(&f.mu)
+
+	return
+}
+
+// Create a read-only file inode that presents the decompressed contents of the
+// given gzip-compressed object, as if it had been passed through gunzip(1).
+// The decompressed size is not known until the contents are first needed (see
+// SetDecompressedIndex), and until then the compressed size is reported.
+//
+// blockSize controls the granularity with which decompressed contents are
+// cached; see gcsproxy.NewGzipView.
+//
+// REQUIRES: The same as NewFileInode
+func NewDecompressedFileInode(
+	id fuseops.InodeID,
+	o *gcs.Object,
+	attrs fuseops.InodeAttributes,
+	blockSize int64,
+	mtimeLayouts []string,
+	bucket gcs.Bucket,
+	leaser lease.FileLeaser,
+	clock timeutil.Clock) (f *FileInode) {
+	// Writes are never allowed.
+	attrs.Mode &^= 0222
+
+	f = NewFileInode(
+		id,
+		o,
+		attrs,
+		uint64(blockSize),
+		0,     // Readahead chunks
+		false, // Validate checksums; reads go through the gzip view
+		mtimeLayouts,
+		bucket,
+		leaser,
+		nil, // Evictions
+		nil, // Object syncer
+		clock)
+
+	f.gzip = gcsproxy.NewGzipView(o, blockSize, leaser, bucket)
 
 	return
 }
@@ -151,18 +312,55 @@ func (f *FileInode) checkInvariants() {
 
 	// INVARIANT: content.CheckInvariants() does not panic
 	f.content.CheckInvariants()
+
+	// INVARIANT: pins >= 0
+	if f.pins < 0 {
+		panic(fmt.Sprintf("Negative pin count: %d", f.pins))
+	}
+
+	// INVARIANT: writingBack || (writtenDuringWriteBack == nil &&
+	//                            !truncatedDuringWriteBack)
+	if !f.writingBack &&
+		(f.writtenDuringWriteBack != nil || f.truncatedDuringWriteBack) {
+		panic("Writes recorded outside of a write-back")
+	}
+
+	if f.gzip != nil {
+		f.gzip.CheckInvariants()
+	}
+}
+
+// Return unmodified content for the supplied generation, whose contents are
+// held by the supplied read lease if non-nil.
+func (f *FileInode) newContent(
+	o *gcs.Object,
+	rl lease.ReadLease) (mc mutable.Content) {
+	mc = mutable.NewContent(
+		gcsproxy.NewReadProxy(
+			o,
+			rl,
+			f.gcsChunkSize,
+			f.readaheadChunks,
+			f.validateChecksums,
+			f.leaser,
+			f.evictions,
+			f.bucket),
+		f.clock)
+
+	return
 }
 
+// Return the generation of the object in GCS, or zero if it doesn't exist.
+//
 // LOCKS_REQUIRED(f.mu)
-func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
+func (f *FileInode) currentGeneration(ctx context.Context) (gen int64, err error) {
 	// Stat the object in GCS.
 	req := &gcs.StatObjectRequest{Name: f.name}
 	o, err := f.bucket.StatObject(ctx, req)
 
-	// Special case: "not found" means we have been clobbered.
+	// Special case: "not found" means there is no generation.
 	if _, ok := err.(*gcs.NotFoundError); ok {
 		err = nil
-		b = true
 		return
 	}
 
@@ -172,8 +370,47 @@ func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
 		return
 	}
 
+	gen = o.Generation
+	return
+}
+
+// Does reading the source generation fail with *gcs.NotFoundError, because
+// the object has since been deleted or overwritten?
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) sourceGenerationGone(
+	ctx context.Context) (gone bool, err error) {
+	req := &gcs.ReadObjectRequest{
+		Name:       f.name,
+		Generation: f.src.Generation,
+		Range:      &gcs.ByteRange{Limit: 1},
+	}
+
+	rc, err := f.bucket.NewReader(ctx, req)
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		gone = true
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	rc.Close()
+	return
+}
+
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
+	gen, err := f.currentGeneration(ctx)
+	if err != nil {
+		return
+	}
+
 	// We are clobbered iff the generation doesn't match our source generation.
-	b = (o.Generation != f.src.Generation)
+	b = (gen != f.src.Generation)
 
 	return
 }
@@ -205,6 +442,14 @@ func (f *FileInode) SourceGeneration() int64 {
 	return f.src.Generation
 }
 
+// Return a copy of the object record from which this inode was branched.
+//
+// LOCKS_REQUIRED(f)
+func (f *FileInode) Source() (o gcs.Object) {
+	o = f.src
+	return
+}
+
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) IncrementLookupCount() {
 	f.lc.Inc()
@@ -216,11 +461,93 @@ func (f *FileInode) DecrementLookupCount(n uint64) (destroy bool) {
 	return
 }
 
+// Keep the most recently read of the contents held locally from being evicted
+// by the file leaser until a matching call to UnpinContents. Calls nest. The
+// file system pins contents on behalf of each open file handle, so that they
+// aren't thrown away just before the kernel asks for them again. See
+// lease.ReadProxy.SetPinned.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) PinContents() {
+	f.pins++
+	if f.pins == 1 && !f.destroyed {
+		f.content.SetPinned(true)
+	}
+}
+
+// Undo a call to PinContents.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) UnpinContents() {
+	f.pins--
+	if f.pins == 0 && !f.destroyed {
+		f.content.SetPinned(false)
+	}
+}
+
+// Is there a call to PinContents that hasn't yet been undone?
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) ContentsPinned() bool {
+	return f.pins > 0
+}
+
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Destroy() (err error) {
 	f.destroyed = true
 
 	f.content.Destroy()
+	if f.gzip != nil {
+		f.gzip.Destroy()
+	}
+
+	return
+}
+
+// Does this inode present the decompressed contents of its source object? If
+// so, it is read-only. See NewDecompressedFileInode.
+func (f *FileInode) IsDecompressedView() bool {
+	return f.gzip != nil
+}
+
+// For a decompressed view whose contents have yet to be decompressed, return
+// the view, so that the caller can build its index by calling BuildIndex
+// without holding the inode's lock, and then pass it to
+// SetDecompressedIndex. Otherwise return nil.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) UnindexedView() (v gcsproxy.GzipView) {
+	if f.gzip == nil || f.destroyed {
+		return
+	}
+
+	if _, exact := f.gzip.Size(); exact {
+		return
+	}
+
+	v = f.gzip
+	return
+}
+
+// Use an index built for the view returned by UnindexedView, so that the
+// inode's size becomes exact. Return true if the size reported by Attributes
+// changed as a result. If the inode has since moved on to another view, or
+// been destroyed, the index is thrown away.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetDecompressedIndex(
+	v gcsproxy.GzipView,
+	idx *gcsproxy.GzipIndex) (resized bool) {
+	if f.destroyed || f.gzip != v {
+		idx.Destroy()
+		return
+	}
+
+	oldSize, _ := f.gzip.Size()
+	f.gzip.SetIndex(idx)
+	newSize, _ := f.gzip.Size()
+	resized = newSize != oldSize
+
 	return
 }
 
@@ -238,10 +565,20 @@ func (f *FileInode) Attributes(
 	attrs = f.attrs
 	attrs.Size = uint64(sr.Size)
 
+	if f.gzip != nil {
+		size, _ := f.gzip.Size()
+		attrs.Size = uint64(size)
+	}
+
 	if sr.Mtime != nil {
 		attrs.Mtime = *sr.Mtime
 	} else {
-		attrs.Mtime = f.src.Updated
+		attrs.Mtime = f.srcMtime
+	}
+
+	attrs.Atime = f.atime
+	if attrs.Atime.IsZero() {
+		attrs.Atime = attrs.Mtime
 	}
 
 	// If the object has been clobbered, we reflect that as the inode being
@@ -259,6 +596,142 @@ func (f *FileInode) Attributes(
 	return
 }
 
+// Report whether the file has modifications that have not yet been written to
+// GCS and, if so, how many bytes of local storage its contents occupy.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Dirty(
+	ctx context.Context) (dirty bool, bufferedBytes int64, err error) {
+	if f.destroyed {
+		return
+	}
+
+	sr, err := f.content.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	// The content records a modification time exactly when it has been
+	// modified since it was created from an object generation.
+	if sr.Mtime == nil {
+		return
+	}
+
+	dirty = true
+	bufferedBytes, err = f.content.AllocatedBytes(ctx)
+	if err != nil {
+		err = fmt.Errorf("AllocatedBytes: %v", err)
+		return
+	}
+
+	return
+}
+
+// If the file has modifications that have not yet been written to GCS,
+// return the time of the latest one.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) DirtyMtime(
+	ctx context.Context) (mtime time.Time, dirty bool, err error) {
+	if f.destroyed {
+		return
+	}
+
+	sr, err := f.content.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	if sr.Mtime == nil {
+		return
+	}
+
+	mtime = *sr.Mtime
+	dirty = true
+	return
+}
+
+// Report what the next call to Sync would write to GCS, without writing
+// anything or otherwise changing the file's state. Destroyed inodes and
+// decompressed views never have anything to write.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SyncPlan(
+	ctx context.Context) (plan gcsproxy.SyncPlan, err error) {
+	if f.destroyed || f.gzip != nil {
+		plan.Strategy = gcsproxy.SyncStrategyNone
+		return
+	}
+
+	plan, err = f.objectSyncer.PlanSync(
+		ctx,
+		&f.src,
+		f.content,
+		f.flattenRequested)
+
+	if err != nil {
+		err = fmt.Errorf("PlanSync: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the number of bytes of the file's contents that are held locally and
+// could be read without going to GCS, along with the file's current size.
+// This is cheap: it inspects only the state of the file's leases, and never
+// fetches anything. A destroyed inode reports zero for both.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Residency(
+	ctx context.Context) (resident int64, size int64, err error) {
+	// A destroyed inode holds nothing.
+	if f.destroyed {
+		return
+	}
+
+	if f.gzip != nil {
+		resident = f.gzip.Residency()
+		size, _ = f.gzip.Size()
+		return
+	}
+
+	sr, err := f.content.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	size = sr.Size
+
+	resident, err = f.content.Residency()
+	if err != nil {
+		err = fmt.Errorf("Residency: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the ranges of the file's contents that are held locally, as for
+// lease.ReadProxy.ResidentRanges, along with the generation they belong to.
+// Files with local modifications and decompressed views report no ranges,
+// since their contents don't match any generation in GCS. Never fetches
+// anything.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) ResidentRanges() (gen int64, ranges []lease.ByteRange) {
+	gen = f.src.Generation
+	if f.destroyed || f.gzip != nil {
+		return
+	}
+
+	ranges = f.content.ResidentRanges()
+	return
+}
+
 // Serve a read for this file with semantics matching fuseops.ReadFileOp.
 //
 // LOCKS_REQUIRED(f.mu)
@@ -266,9 +739,16 @@ func (f *FileInode) Read(
 	ctx context.Context,
 	offset int64,
 	size int) (data []byte, err error) {
-	// Read from the mutable content.
+	// Read from the decompressed view or the mutable content, as appropriate.
 	data = make([]byte, size)
-	n, err := f.content.ReadAt(ctx, data, offset)
+
+	var n int
+	if f.gzip != nil {
+		n, err = f.gzip.ReadAt(ctx, data, offset)
+	} else {
+		n, err = f.content.ReadAt(ctx, data, offset)
+	}
+
 	data = data[:n]
 
 	// We don't return errors for EOF. Otherwise, propagate errors.
@@ -282,6 +762,79 @@ func (f *FileInode) Read(
 	return
 }
 
+// Like Read, but if serving the read requires fetching content from GCS,
+// return a non-nil fault rather than blocking on it. The caller may release
+// f.mu while waiting for the fault and then try again, so that reads of
+// content already held locally aren't held up in the meantime. Reads of
+// decompressed views are served inline.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) TryRead(
+	ctx context.Context,
+	offset int64,
+	size int) (data []byte, fault *lease.Fault, err error) {
+	if f.gzip != nil {
+		data, err = f.Read(ctx, offset, size)
+		return
+	}
+
+	data = make([]byte, size)
+
+	var n int
+	n, fault, err = f.content.TryReadAt(data, offset)
+	data = data[:n]
+
+	// We don't return errors for EOF. Otherwise, propagate errors.
+	if err == io.EOF {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("TryReadAt: %v", err)
+		return
+	}
+
+	return
+}
+
+// Find the next hole (or data, if hole is false) at or after the given
+// offset, with semantics matching fuseops.SeekFileOp. ok is false if there is
+// none, for which lseek(2) returns ENXIO.
+//
+// Dirty content may have holes where it was written sparsely. Clean content
+// and decompressed views are all data, since GCS objects have no holes.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Seek(
+	ctx context.Context,
+	offset int64,
+	hole bool) (n int64, ok bool, err error) {
+	var size int64
+	var extents []lease.ByteRange
+
+	if f.gzip != nil {
+		size, _ = f.gzip.Size()
+		if size > 0 {
+			extents = []lease.ByteRange{{Start: 0, Limit: size}}
+		}
+	} else {
+		var sr mutable.StatResult
+		sr, err = f.content.Stat(ctx)
+		if err != nil {
+			err = fmt.Errorf("Stat: %v", err)
+			return
+		}
+
+		size = sr.Size
+		extents, err = f.content.Extents(ctx)
+		if err != nil {
+			err = fmt.Errorf("Extents: %v", err)
+			return
+		}
+	}
+
+	n, ok = lease.SeekExtents(extents, size, offset, hole)
+	return
+}
+
 // Serve a write for this file with semantics matching fuseops.WriteFileOp.
 //
 // LOCKS_REQUIRED(f.mu)
@@ -289,32 +842,281 @@ func (f *FileInode) Write(
 	ctx context.Context,
 	data []byte,
 	offset int64) (err error) {
+	if f.gzip != nil {
+		err = errReadOnlyView
+		return
+	}
+
+	// Check the size implied by the write before doing anything, so that e.g. a
+	// one-byte write at a huge offset doesn't leave behind a dirty file that
+	// can never be synced.
+	if offset+int64(len(data)) > MaxFileSize {
+		err = ErrFileTooLarge
+		return
+	}
+
+	// There's no point in modifying what can't be written out.
+	if f.stale != nil {
+		err = f.stale
+		return
+	}
+
 	// Write to the mutable content. Note that the mutable content guarantees
 	// that it returns an error for short writes.
 	_, err = f.content.WriteAt(ctx, data, offset)
 
+	if f.writingBack && len(data) != 0 {
+		f.writtenDuringWriteBack = append(
+			f.writtenDuringWriteBack,
+			lease.ByteRange{Start: offset, Limit: offset + int64(len(data))})
+	}
+
 	return
 }
 
-// Write out contents to GCS. If this fails due to the generation having been
-// clobbered, treat it as a non-error (simulating the inode having been
-// unlinked).
+// Write out contents to GCS. If this fails because the object has been
+// overwritten or deleted since the source generation, return *ClobberedError
+// and mark the inode stale, so that it and any later attempt to modify the
+// inode fail the same way without trying.
 //
 // After this method succeeds, SourceGeneration will return the new generation
 // by which this inode should be known (which may be the same as before). If it
-// fails, the generation will not change.
+// fails, the generation will not change, except that a
+// *gcsproxy.EncryptionError may report a new generation written out with the
+// wrong key, which the inode now presents.
+//
+// A write-back in progress is waited for first, during which the lock is
+// released. See WriteBack.
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Sync(ctx context.Context) (err error) {
-	// Write out the contents if they are dirty.
-	rl, newObj, err := f.objectSyncer.SyncObject(
-		ctx,
-		&f.src,
-		f.content)
+	// Decompressed views can't be modified, so there is never anything to do.
+	if f.gzip != nil {
+		return
+	}
+
+	f.WaitForWriteBack()
+
+	if f.stale != nil {
+		err = f.stale
+		return
+	}
+
+	err = f.syncObject(ctx)
+	err = f.checkClobbered(ctx, err)
+	return
+}
+
+// Given the error with which writing out the content failed, if any, find out
+// whether that was because the object has been clobbered. If so, mark the
+// inode stale and return *ClobberedError; otherwise return the error as it is.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) checkClobbered(
+	ctx context.Context,
+	syncErr error) (err error) {
+	err = syncErr
+	if err == nil {
+		return
+	}
+
+	if _, ok := err.(*gcsproxy.EncryptionError); ok {
+		return
+	}
+
+	// A precondition error means we were clobbered. So does failing to fetch
+	// contents we had not yet read because the source generation has gone.
+	// Anything else may have nothing to do with the object being overwritten
+	// meanwhile, and a later sync may succeed.
+	if _, ok := err.(*gcs.PreconditionError); !ok {
+		gone, probeErr := f.sourceGenerationGone(ctx)
+		if probeErr != nil || !gone {
+			return
+		}
+	}
+
+	// Find out what replaced the source generation, for the logs. Stats may be
+	// cached, so we can't expect them to show the change.
+	gen, statErr := f.currentGeneration(ctx)
+	if statErr != nil || gen == f.src.Generation {
+		gen = 0
+	}
+
+	f.stale = &ClobberedError{
+		Name:     f.name,
+		Expected: f.src.Generation,
+		Observed: gen,
+	}
+
+	err = f.stale
+	return
+}
+
+// Has a sync found that the inode's local modifications can never be written
+// out? If so, return the error it found. See Sync.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Stale() (err *ClobberedError) {
+	err = f.stale
+	return
+}
+
+// Arrange for the next sync to write out the file's full contents as a new
+// single-component object, even if it would otherwise use the append
+// optimization or not need to write anything at all. This is useful for
+// flattening composite objects, which lack MD5 hashes.
+//
+// If the file is not dirty, the rewrite happens immediately. It is
+// preconditioned on the source generation, so if the object has been modified
+// remotely this returns *ClobberedError or *gcs.PreconditionError and leaves
+// GCS untouched.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Flatten(ctx context.Context) (err error) {
+	if f.gzip != nil {
+		err = errReadOnlyView
+		return
+	}
+
+	f.WaitForWriteBack()
+
+	f.flattenRequested = true
+
+	// If the content is dirty, the next sync will take care of it.
+	sr, err := f.content.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	srcSize := int64(f.src.Size)
+	if sr.Size != srcSize || sr.DirtyThreshold != srcSize {
+		return
+	}
+
+	// Otherwise, do it now. If that fails because the object has been
+	// modified remotely, give up on flattening so that the inode may be
+	// refreshed to present the new generation.
+	err = f.syncObject(ctx)
+	if err == nil {
+		return
+	}
 
-	// Special case: a precondition error means we were clobbered, which we treat
-	// as being unlinked. There's no reason to return an error in that case.
 	if _, ok := err.(*gcs.PreconditionError); ok {
+		f.flattenRequested = false
+		return
+	}
+
+	// Other errors may also be caused by the modification, for example failing
+	// to fetch contents we had not yet read from a generation that has been
+	// deleted.
+	gen, statErr := f.currentGeneration(ctx)
+	if statErr == nil && gen != f.src.Generation {
+		f.flattenRequested = false
+		err = &ClobberedError{
+			Name:     f.name,
+			Expected: f.src.Generation,
+			Observed: gen,
+		}
+	}
+
+	return
+}
+
+// If o, a record for the inode's object fetched by the caller, is for a newer
+// generation than the source object, and the inode has no local
+// modifications, start presenting that generation instead, throwing away the
+// contents of the old. Return true if so.
+//
+// The caller fetches the record so that it needn't hold the lock while waiting
+// for GCS. A record that is older than the source object, as one served from a
+// cache may be, is ignored. Local modifications win until the next sync, which
+// will then find the file clobbered.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Refresh(
+	ctx context.Context,
+	o *gcs.Object) (refreshed bool, err error) {
+	if f.destroyed || f.flattenRequested || f.stale != nil {
+		return
+	}
+
+	if o.Generation <= f.src.Generation {
+		return
+	}
+
+	dirty, _, err := f.Dirty(ctx)
+	if err != nil {
+		err = fmt.Errorf("Dirty: %v", err)
+		return
+	}
+
+	if dirty {
+		return
+	}
+
+	// Replace the contents.
+	f.content.Destroy()
+	f.src = *o
+	f.srcMtime = objectMtime(o, f.mtimeLayouts, f.clock.Now())
+	f.srcAtime = objectAtime(o)
+	f.content = f.newContent(o, nil)
+
+	if f.pins > 0 {
+		f.content.SetPinned(true)
+	}
+
+	if f.gzip != nil {
+		f.gzip.Destroy()
+		f.gzip = gcsproxy.NewGzipView(o, int64(f.gcsChunkSize), f.leaser, f.bucket)
+	}
+
+	refreshed = true
+	return
+}
+
+// Write out contents to GCS if they are dirty or a flatten has been
+// requested, updating our state if we created a new generation. Precondition
+// and encryption errors are returned unmodified.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) syncObject(ctx context.Context) (err error) {
+	syncFunc := f.objectSyncer.SyncObject
+	if f.flattenRequested {
+		syncFunc = f.objectSyncer.FlattenObject
+	}
+
+	rl, newObj, err := syncFunc(ctx, &f.src, f.content)
+	err = f.adoptSyncResult(rl, newObj, err)
+	return
+}
+
+// Update our state to reflect the result of syncing our content, which
+// SyncObject or FlattenObject has returned: if a new generation was written
+// out, present it, with contents held by the supplied read lease if non-nil.
+// Precondition and encryption errors are returned unmodified.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) adoptSyncResult(
+	rl lease.ReadLease,
+	newObj *gcs.Object,
+	syncErr error) (err error) {
+	err = syncErr
+
+	// Don't mangle precondition errors.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		return
+	}
+
+	// Nor encryption errors. If a new generation was written out with the wrong
+	// key, it exists all the same, so take it on before reporting that.
+	var keyErr error
+	if _, ok := err.(*gcsproxy.EncryptionError); ok {
+		if newObj == nil {
+			return
+		}
+
+		keyErr = err
 		err = nil
 	}
 
@@ -324,19 +1126,236 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 		return
 	}
 
+	f.flattenRequested = false
+
 	// If we wrote out a new object, we need to update our state.
 	if newObj != nil {
 		f.src = *newObj
-		f.content = mutable.NewContent(
-			gcsproxy.NewReadProxy(
-				newObj,
-				rl,
-				f.gcsChunkSize,
-				f.leaser,
-				f.bucket),
-			f.clock)
+		f.srcMtime = objectMtime(newObj, f.mtimeLayouts, f.clock.Now())
+		f.srcAtime = objectAtime(newObj)
+		f.content = f.newContent(newObj, rl)
+
+		if f.pins > 0 {
+			f.content.SetPinned(true)
+		}
 	}
 
+	err = keyErr
+	return
+}
+
+// Record that the file was read at the given time, advancing its access time
+// if that is later.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) NoteAccess(t time.Time) {
+	if t.After(f.atime) {
+		f.atime = t
+		f.atimeExplicit = false
+	}
+}
+
+// Set the file's access time, as with utimes(2). Unlike NoteAccess, this may
+// move it backward.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetAtime(t time.Time) {
+	f.atime = t
+	f.atimeExplicit = true
+}
+
+// Write the file's access time to its object's metadata under
+// AtimeMetadataKey, if that is called for. Following relatime(8), an access
+// time noted by reading is written only if the recorded one is no later than
+// the modification time or is at least interval old. Explicitly set access
+// times are always written. Either way, nothing is written if this inode
+// wrote within the last interval, or while the file is dirty, since syncing
+// it will create a new generation.
+//
+// The update is made only if the object is still at the generation the inode
+// is based on, and the lock is released while it is in flight, so that reads
+// needn't wait for GCS.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) PersistAtime(
+	ctx context.Context,
+	interval time.Duration) (persisted bool, err error) {
+	if f.destroyed || f.persistingAtime {
+		return
+	}
+
+	if f.atime.IsZero() || f.atime.Equal(f.srcAtime) {
+		return
+	}
+
+	now := f.clock.Now()
+	if !f.atimePersistedAt.IsZero() && now.Sub(f.atimePersistedAt) < interval {
+		return
+	}
+
+	if !f.atimeExplicit {
+		if f.atime.Before(f.srcAtime) {
+			return
+		}
+
+		if f.srcAtime.After(f.srcMtime) && f.atime.Sub(f.srcAtime) < interval {
+			return
+		}
+	}
+
+	dirty, _, err := f.Dirty(ctx)
+	if err != nil || dirty {
+		return
+	}
+
+	// Update without the lock.
+	atime := f.atime
+	gen := f.src.Generation
+	value := atime.UTC().Format(time.RFC3339Nano)
+
+	f.persistingAtime = true
+	f.mu.Unlock()
+	o, err := f.bucket.UpdateObject(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                   f.name,
+			GenerationPrecondition: &gen,
+			Metadata:               map[string]*string{AtimeMetadataKey: &value},
+		})
+	f.mu.Lock()
+	f.persistingAtime = false
+
+	// If the object is gone or has been replaced, we have been clobbered and
+	// there is nowhere to record anything.
+	switch err.(type) {
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("UpdateObject: %v", err)
+		return
+	}
+
+	// Nothing more to do if the inode moved on to another generation in the
+	// meantime.
+	if f.destroyed || f.src.Generation != gen {
+		return
+	}
+
+	if o.MetaGeneration > f.src.MetaGeneration {
+		f.src = *o
+	}
+
+	f.srcAtime = atime
+	if f.atime.Equal(atime) {
+		f.atimeExplicit = false
+	}
+
+	f.atimePersistedAt = now
+	persisted = true
+
+	return
+}
+
+// Set the file's modification time, as with utimes(2). If the file is dirty
+// this takes effect when it is synced. Otherwise the time is written straight
+// to its object's metadata under MtimeMetadataKey, without creating a new
+// generation. The update is made only if the object is still at the
+// generation the inode is based on.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetMtime(
+	ctx context.Context,
+	mtime time.Time) (err error) {
+	if f.gzip != nil {
+		err = errReadOnlyView
+		return
+	}
+
+	// A write-back would otherwise lose the time along with the content it
+	// uploads.
+	f.WaitForWriteBack()
+
+	dirty, _, err := f.Dirty(ctx)
+	if err != nil {
+		return
+	}
+
+	if dirty {
+		f.content.SetMtime(mtime)
+		return
+	}
+
+	value := gcsproxy.FormatMtime(mtime)
+	o, err := f.bucket.UpdateObject(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                   f.name,
+			GenerationPrecondition: &f.src.Generation,
+			Metadata:               map[string]*string{MtimeMetadataKey: &value},
+		})
+
+	// If the object is gone or has been replaced, we have been clobbered and
+	// there is nowhere to record anything.
+	switch err.(type) {
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("UpdateObject: %v", err)
+		return
+	}
+
+	f.src = *o
+	f.srcMtime = objectMtime(o, f.mtimeLayouts, f.clock.Now())
+
+	return
+}
+
+// Set the custom metadata key of the file's object to the supplied value, or
+// remove it if value is nil, without creating a new generation. The update is
+// made only if the object is still at the generation the inode is based on;
+// otherwise it fails with *gcs.PreconditionError, or *gcs.NotFoundError if the
+// object is gone.
+//
+// Later generations written out by syncs carry the metadata over.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) UpdateMetadata(
+	ctx context.Context,
+	key string,
+	value *string) (err error) {
+	if f.gzip != nil {
+		err = errReadOnlyView
+		return
+	}
+
+	f.WaitForWriteBack()
+
+	o, err := f.bucket.UpdateObject(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                   f.name,
+			Metadata:               map[string]*string{key: value},
+			GenerationPrecondition: &f.src.Generation,
+		})
+
+	// Don't mangle precondition and not found errors.
+	switch err.(type) {
+	case nil:
+	case *gcs.PreconditionError, *gcs.NotFoundError:
+		return
+
+	default:
+		err = fmt.Errorf("UpdateObject: %v", err)
+		return
+	}
+
+	f.src = *o
 	return
 }
 
@@ -346,6 +1365,26 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 func (f *FileInode) Truncate(
 	ctx context.Context,
 	size int64) (err error) {
+	if f.gzip != nil {
+		err = errReadOnlyView
+		return
+	}
+
+	if size > MaxFileSize {
+		err = ErrFileTooLarge
+		return
+	}
+
+	if f.stale != nil {
+		err = f.stale
+		return
+	}
+
 	err = f.content.Truncate(ctx, size)
+
+	if f.writingBack {
+		f.truncatedDuringWriteBack = true
+	}
+
 	return
 }
@@ -15,9 +15,15 @@
 package inode_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,6 +36,7 @@ import (
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsfake"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
 )
@@ -40,6 +47,24 @@ func TestFile(t *testing.T) { RunTests(t) }
 // Boilerplate
 ////////////////////////////////////////////////////////////////////////
 
+// A bucket whose object reads fail while failReads is set.
+type failingReadsBucket struct {
+	gcs.Bucket
+	failReads bool
+}
+
+func (b *failingReadsBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if b.failReads {
+		err = errors.New("taco")
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
 const uid = 123
 const gid = 456
 
@@ -47,11 +72,13 @@ const fileInodeID = 17
 const fileInodeName = "foo/bar"
 const fileMode os.FileMode = 0641
 
+// The inode sees the bucket through failingReads.
 type FileTest struct {
-	ctx    context.Context
-	bucket gcs.Bucket
-	leaser lease.FileLeaser
-	clock  timeutil.SimulatedClock
+	ctx          context.Context
+	bucket       gcs.Bucket
+	failingReads failingReadsBucket
+	leaser       lease.FileLeaser
+	clock        timeutil.SimulatedClock
 
 	initialContents string
 	backingObj      *gcs.Object
@@ -69,6 +96,7 @@ func (t *FileTest) SetUp(ti *TestInfo) {
 	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
 	t.leaser = lease.NewFileLeaser("", math.MaxInt32, math.MaxInt64)
 	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.failingReads.Bucket = t.bucket
 
 	// Set up the backing object.
 	var err error
@@ -92,12 +120,17 @@ func (t *FileTest) SetUp(ti *TestInfo) {
 			Mode: fileMode,
 		},
 		math.MaxUint64, // GCS chunk size
-		t.bucket,
+		0,              // Readahead chunks
+		true,           // Validate checksums
+		inode.DefaultMtimeLayouts,
+		&t.failingReads,
 		t.leaser,
+		nil, // Evictions
 		gcsproxy.NewObjectSyncer(
 			1, // Append threshold
+			0, // Resumable upload threshold
 			".gcsfuse_tmp/",
-			t.bucket),
+			&t.failingReads),
 		&t.clock)
 
 	t.in.Lock()
@@ -135,6 +168,360 @@ func (t *FileTest) InitialAttributes() {
 	ExpectThat(attrs.Mtime, timeutil.TimeEq(t.backingObj.Updated))
 }
 
+// Create an inode for a new object with the given mtime metadata, capturing
+// anything logged while doing so and while reading its attributes twice.
+func (t *FileTest) mtimeFromMetadata(
+	value string) (mtime time.Time, o *gcs.Object, logged string) {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "mtime",
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{inode.MtimeMetadataKey: value},
+		})
+
+	AssertEq(nil, err)
+
+	mtime, logged = t.mtimeFromObject(o)
+	return
+}
+
+// Create an inode for the supplied object, capturing anything logged while
+// doing so and while reading its attributes twice.
+func (t *FileTest) mtimeFromObject(
+	o *gcs.Object) (mtime time.Time, logged string) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	in := inode.NewFileInode(
+		fileInodeID+1,
+		o,
+		fuseops.InodeAttributes{},
+		math.MaxUint64, // GCS chunk size
+		0,              // Readahead chunks
+		true,           // Validate checksums
+		inode.DefaultMtimeLayouts,
+		t.bucket,
+		t.leaser,
+		nil, // Evictions
+		gcsproxy.NewObjectSyncer(1, 0, ".gcsfuse_tmp/", t.bucket),
+		&t.clock)
+
+	in.Lock()
+	defer in.Unlock()
+	defer in.Destroy()
+
+	for i := 0; i < 2; i++ {
+		attrs, err := in.Attributes(t.ctx)
+		AssertEq(nil, err)
+		mtime = attrs.Mtime
+	}
+
+	logged = logs.String()
+	return
+}
+
+func (t *FileTest) MtimeMetadata_WarnedOncePerGeneration() {
+	_, o, logged := t.mtimeFromMetadata("the other day")
+	ExpectEq(1, strings.Count(logged, "Warning"), "logged: %q", logged)
+
+	// Another inode for the same generation shouldn't warn again.
+	_, logged = t.mtimeFromObject(o)
+	ExpectEq("", logged)
+
+	// A new generation should.
+	_, _, logged = t.mtimeFromMetadata("the other day")
+	ExpectEq(1, strings.Count(logged, "Warning"), "logged: %q", logged)
+}
+
+func (t *FileTest) MtimeMetadata_Valid() {
+	mtime, _, logged := t.mtimeFromMetadata("2011-01-02T03:04:05.678-08:00")
+
+	ExpectThat(
+		mtime,
+		timeutil.TimeEq(time.Date(2011, 1, 2, 11, 4, 5, 678000000, time.UTC)))
+
+	ExpectEq("", logged)
+}
+
+func (t *FileTest) MtimeMetadata_NoZone() {
+	mtime, _, logged := t.mtimeFromMetadata("2011-01-02 03:04:05")
+
+	ExpectThat(
+		mtime,
+		timeutil.TimeEq(time.Date(2011, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	// There should have been exactly one warning.
+	ExpectEq(1, strings.Count(logged, "Warning"), "logged: %q", logged)
+	ExpectThat(logged, HasSubstr("no time zone"))
+	ExpectThat(logged, HasSubstr(`"mtime"`))
+}
+
+func (t *FileTest) MtimeMetadata_Malformed() {
+	mtime, o, logged := t.mtimeFromMetadata("last tuesday")
+
+	ExpectThat(mtime, timeutil.TimeEq(o.Updated))
+	ExpectFalse(mtime.IsZero())
+
+	ExpectEq(1, strings.Count(logged, "Warning"), "logged: %q", logged)
+	ExpectThat(logged, HasSubstr("unrecognized"))
+	ExpectThat(logged, HasSubstr("last tuesday"))
+}
+
+func (t *FileTest) MtimeMetadata_Implausible() {
+	mtime, o, logged := t.mtimeFromMetadata("1970-01-01T00:00:00Z")
+
+	ExpectThat(mtime, timeutil.TimeEq(o.Updated))
+
+	ExpectEq(1, strings.Count(logged, "Warning"), "logged: %q", logged)
+	ExpectThat(logged, HasSubstr("implausible"))
+}
+
+// Return the atime reported by the inode.
+func (t *FileTest) atime() time.Time {
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	return attrs.Atime
+}
+
+// Return the atime metadata of the backing object in the bucket, or the empty
+// string if none.
+func (t *FileTest) atimeMetadata() string {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: fileInodeName})
+
+	AssertEq(nil, err)
+	return o.Metadata[inode.AtimeMetadataKey]
+}
+
+func (t *FileTest) Atime_DefaultsToMtime() {
+	ExpectThat(t.atime(), timeutil.TimeEq(t.backingObj.Updated))
+}
+
+func (t *FileTest) Atime_NoteAccess() {
+	t.clock.AdvanceTime(time.Minute)
+	accessed := t.clock.Now()
+	t.in.NoteAccess(accessed)
+	ExpectThat(t.atime(), timeutil.TimeEq(accessed))
+
+	// Access times never go backward by reading.
+	t.in.NoteAccess(accessed.Add(-time.Second))
+	ExpectThat(t.atime(), timeutil.TimeEq(accessed))
+
+	// But they can be set explicitly.
+	set := accessed.Add(-time.Hour)
+	t.in.SetAtime(set)
+	ExpectThat(t.atime(), timeutil.TimeEq(set))
+}
+
+func (t *FileTest) Atime_FromMetadata() {
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "atime",
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{
+				inode.AtimeMetadataKey: "2015-04-05T02:15:00.5Z",
+			},
+		})
+
+	AssertEq(nil, err)
+
+	in := inode.NewFileInode(
+		fileInodeID+1,
+		o,
+		fuseops.InodeAttributes{},
+		math.MaxUint64, // GCS chunk size
+		0,              // Readahead chunks
+		true,           // Validate checksums
+		nil,            // Mtime layouts
+		t.bucket,
+		t.leaser,
+		nil, // Evictions
+		nil, // Object syncer
+		&t.clock)
+
+	in.Lock()
+	defer in.Unlock()
+	defer in.Destroy()
+
+	attrs, err := in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(
+		attrs.Atime,
+		timeutil.TimeEq(time.Date(2015, 4, 5, 2, 15, 0, 5e8, time.UTC)))
+}
+
+func (t *FileTest) PersistAtime_Relatime() {
+	const interval = time.Hour
+
+	// Nothing to write at first.
+	persisted, err := t.in.PersistAtime(t.ctx, interval)
+	AssertEq(nil, err)
+	ExpectFalse(persisted)
+	ExpectEq("", t.atimeMetadata())
+
+	// The first access after the modification is written.
+	t.clock.AdvanceTime(time.Minute)
+	first := t.clock.Now()
+	t.in.NoteAccess(first)
+
+	persisted, err = t.in.PersistAtime(t.ctx, interval)
+	AssertEq(nil, err)
+	ExpectTrue(persisted)
+	ExpectEq(first.UTC().Format(time.RFC3339Nano), t.atimeMetadata())
+
+	// Updating metadata doesn't change the generation.
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
+	ExpectEq(t.backingObj.MetaGeneration+1, t.in.Source().MetaGeneration)
+
+	// Later accesses aren't, until the recorded one is an interval old.
+	t.clock.AdvanceTime(interval / 2)
+	t.in.NoteAccess(t.clock.Now())
+
+	persisted, err = t.in.PersistAtime(t.ctx, interval)
+	AssertEq(nil, err)
+	ExpectFalse(persisted)
+
+	t.clock.AdvanceTime(interval / 2)
+	last := t.clock.Now()
+	t.in.NoteAccess(last)
+
+	persisted, err = t.in.PersistAtime(t.ctx, interval)
+	AssertEq(nil, err)
+	ExpectTrue(persisted)
+	ExpectEq(last.UTC().Format(time.RFC3339Nano), t.atimeMetadata())
+}
+
+func (t *FileTest) PersistAtime_Explicit() {
+	const interval = time.Hour
+
+	t.clock.AdvanceTime(time.Minute)
+	t.in.NoteAccess(t.clock.Now())
+	_, err := t.in.PersistAtime(t.ctx, interval)
+	AssertEq(nil, err)
+
+	// An explicitly set access time is written even though it goes backward,
+	// but no sooner than an interval after the last write.
+	set := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	t.in.SetAtime(set)
+
+	persisted, err := t.in.PersistAtime(t.ctx, interval)
+	AssertEq(nil, err)
+	ExpectFalse(persisted)
+
+	t.clock.AdvanceTime(interval)
+	persisted, err = t.in.PersistAtime(t.ctx, interval)
+	AssertEq(nil, err)
+	ExpectTrue(persisted)
+	ExpectEq("2001-02-03T04:05:06Z", t.atimeMetadata())
+}
+
+func (t *FileTest) PersistAtime_Dirty() {
+	err := t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Minute)
+	t.in.NoteAccess(t.clock.Now())
+
+	// The next sync will create a new generation, so there's no point.
+	persisted, err := t.in.PersistAtime(t.ctx, time.Hour)
+	AssertEq(nil, err)
+	ExpectFalse(persisted)
+	ExpectEq("", t.atimeMetadata())
+}
+
+func (t *FileTest) PersistAtime_Clobbered() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, fileInodeName, "burrito")
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Minute)
+	t.in.NoteAccess(t.clock.Now())
+
+	// The new generation isn't ours to record anything on.
+	persisted, err := t.in.PersistAtime(t.ctx, time.Hour)
+	AssertEq(nil, err)
+	ExpectFalse(persisted)
+	ExpectEq("", t.atimeMetadata())
+}
+
+// Return the mtime metadata of the backing object in the bucket, or the empty
+// string if none.
+func (t *FileTest) mtimeMetadata() string {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: fileInodeName})
+
+	AssertEq(nil, err)
+	return o.Metadata[inode.MtimeMetadataKey]
+}
+
+func (t *FileTest) SetMtime_Clean() {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	err := t.in.SetMtime(t.ctx, mtime)
+	AssertEq(nil, err)
+
+	// Only the metadata should have been updated.
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
+	ExpectEq("2001-02-03T04:05:06Z", t.mtimeMetadata())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime))
+}
+
+func (t *FileTest) SetMtime_Dirty() {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	err := t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.SetMtime(t.ctx, mtime)
+	AssertEq(nil, err)
+
+	// Nothing should be written until the file is synced.
+	ExpectEq("", t.mtimeMetadata())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime))
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectLt(t.backingObj.Generation, t.in.SourceGeneration())
+	ExpectEq("2001-02-03T04:05:06Z", t.mtimeMetadata())
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime))
+}
+
+func (t *FileTest) SetMtime_Clobbered() {
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: fileInodeName})
+
+	AssertEq(nil, err)
+
+	// There is nowhere to record the time, but that isn't an error.
+	err = t.in.SetMtime(t.ctx, time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC))
+	ExpectEq(nil, err)
+}
+
+func (t *FileTest) SetMtime_Replaced() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, fileInodeName, "burrito")
+	AssertEq(nil, err)
+
+	// The time isn't recorded on someone else's generation.
+	err = t.in.SetMtime(t.ctx, time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC))
+	ExpectEq(nil, err)
+	ExpectEq("", t.mtimeMetadata())
+}
+
 func (t *FileTest) Read() {
 	AssertEq("taco", t.initialContents)
 
@@ -249,6 +636,7 @@ func (t *FileTest) WriteThenSync() {
 	err = t.in.Write(t.ctx, []byte("p"), 0)
 	AssertEq(nil, err)
 
+	modified := t.clock.Now()
 	t.clock.AdvanceTime(time.Second)
 
 	// Sync.
@@ -277,7 +665,10 @@ func (t *FileTest) WriteThenSync() {
 	AssertEq(nil, err)
 
 	ExpectEq(len("paco"), attrs.Size)
-	ExpectThat(attrs.Mtime, timeutil.TimeEq(o.Updated))
+	// The modification time should be the one recorded in the new generation,
+	// not when it was created.
+	ExpectEq(gcsproxy.FormatMtime(modified), o.Metadata[inode.MtimeMetadataKey])
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(modified))
 }
 
 func (t *FileTest) AppendThenSync() {
@@ -290,6 +681,7 @@ func (t *FileTest) AppendThenSync() {
 	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
 	AssertEq(nil, err)
 
+	modified := t.clock.Now()
 	t.clock.AdvanceTime(time.Second)
 
 	// Sync.
@@ -318,7 +710,10 @@ func (t *FileTest) AppendThenSync() {
 	AssertEq(nil, err)
 
 	ExpectEq(len("tacoburrito"), attrs.Size)
-	ExpectThat(attrs.Mtime, timeutil.TimeEq(o.Updated))
+	// The modification time should be the one recorded in the new generation,
+	// not when it was created.
+	ExpectEq(gcsproxy.FormatMtime(modified), o.Metadata[inode.MtimeMetadataKey])
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(modified))
 }
 
 func (t *FileTest) TruncateDownwardThenSync() {
@@ -329,6 +724,7 @@ func (t *FileTest) TruncateDownwardThenSync() {
 	err = t.in.Truncate(t.ctx, 2)
 	AssertEq(nil, err)
 
+	modified := t.clock.Now()
 	t.clock.AdvanceTime(time.Second)
 
 	// Sync.
@@ -351,7 +747,10 @@ func (t *FileTest) TruncateDownwardThenSync() {
 	AssertEq(nil, err)
 
 	ExpectEq(2, attrs.Size)
-	ExpectThat(attrs.Mtime, timeutil.TimeEq(o.Updated))
+	// The modification time should be the one recorded in the new generation,
+	// not when it was created.
+	ExpectEq(gcsproxy.FormatMtime(modified), o.Metadata[inode.MtimeMetadataKey])
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(modified))
 }
 
 func (t *FileTest) TruncateUpwardThenSync() {
@@ -364,6 +763,7 @@ func (t *FileTest) TruncateUpwardThenSync() {
 	err = t.in.Truncate(t.ctx, 6)
 	AssertEq(nil, err)
 
+	modified := t.clock.Now()
 	t.clock.AdvanceTime(time.Second)
 
 	// Sync.
@@ -386,7 +786,10 @@ func (t *FileTest) TruncateUpwardThenSync() {
 	AssertEq(nil, err)
 
 	ExpectEq(6, attrs.Size)
-	ExpectThat(attrs.Mtime, timeutil.TimeEq(o.Updated))
+	// The modification time should be the one recorded in the new generation,
+	// not when it was created.
+	ExpectEq(gcsproxy.FormatMtime(modified), o.Metadata[inode.MtimeMetadataKey])
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(modified))
 }
 
 func (t *FileTest) Sync_Clobbered() {
@@ -400,10 +803,15 @@ func (t *FileTest) Sync_Clobbered() {
 	newObj, err := gcsutil.CreateObject(t.ctx, t.bucket, t.in.Name(), "burrito")
 	AssertEq(nil, err)
 
-	// Sync. The call should succeed, but nothing should change.
+	// Sync. The call should report the clobbering, and nothing should change.
 	err = t.in.Sync(t.ctx)
 
-	AssertEq(nil, err)
+	ce, ok := err.(*inode.ClobberedError)
+	AssertTrue(ok, "Error: %v", err)
+	ExpectEq(t.in.Name(), ce.Name)
+	ExpectEq(t.backingObj.Generation, ce.Expected)
+	ExpectEq(newObj.Generation, ce.Observed)
+	ExpectEq(ce, t.in.Stale())
 	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
 
 	// The object in the bucket should not have been changed.
@@ -413,4 +821,633 @@ func (t *FileTest) Sync_Clobbered() {
 	AssertEq(nil, err)
 	ExpectEq(newObj.Generation, o.Generation)
 	ExpectEq(newObj.Size, o.Size)
+
+	// Further modifications and syncs should fail straight away.
+	ExpectEq(ce, t.in.Write(t.ctx, []byte("a"), 0))
+	ExpectEq(ce, t.in.Truncate(t.ctx, 0))
+	ExpectEq(ce, t.in.Sync(t.ctx))
+}
+
+func (t *FileTest) Sync_Deleted_AfterReading() {
+	var err error
+
+	// Fault in the contents and modify them.
+	_, err = t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Delete the backing object.
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	// Sync should report the clobbering, without recreating the object.
+	err = t.in.Sync(t.ctx)
+
+	ce, ok := err.(*inode.ClobberedError)
+	AssertTrue(ok, "Error: %v", err)
+	ExpectEq(t.backingObj.Generation, ce.Expected)
+	ExpectEq(0, ce.Observed)
+	ExpectEq(ce, t.in.Stale())
+
+	_, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	_, ok = err.(*gcs.NotFoundError)
+	ExpectTrue(ok, "Error: %v", err)
+}
+
+func (t *FileTest) Sync_Deleted_BeforeReading() {
+	var err error
+
+	// Modify the contents without faulting in the rest.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Delete the backing object. Writing out the contents now fails to read
+	// the rest of them, rather than with a precondition error.
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+
+	ce, ok := err.(*inode.ClobberedError)
+	AssertTrue(ok, "Error: %v", err)
+	ExpectEq(t.backingObj.Generation, ce.Expected)
+	ExpectEq(0, ce.Observed)
+	ExpectEq(ce, t.in.Stale())
+}
+
+func (t *FileTest) Sync_ReadFailsWhileOverwritten() {
+	var err error
+
+	// Modify the contents without faulting in the rest.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Overwrite the backing object, and have reads fail for some other reason,
+	// as they would in a versioned bucket that keeps the source generation.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, t.in.Name(), "burrito")
+	AssertEq(nil, err)
+
+	t.failingReads.failReads = true
+
+	// The sync fails, but the failure doesn't show that the inode has been
+	// clobbered.
+	err = t.in.Sync(t.ctx)
+
+	ExpectThat(err, Error(HasSubstr("taco")))
+	_, ok := err.(*inode.ClobberedError)
+	ExpectFalse(ok, "Error: %v", err)
+	ExpectEq(nil, t.in.Stale())
+
+	// Once reads work, the sync finds the source generation gone.
+	t.failingReads.failReads = false
+	err = t.in.Sync(t.ctx)
+
+	_, ok = err.(*inode.ClobberedError)
+	ExpectTrue(ok, "Error: %v", err)
+}
+
+func (t *FileTest) Flatten_Clean() {
+	var err error
+
+	// Create a composite object by appending.
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	composite, err := t.bucket.StatObject(t.ctx, statReq)
+
+	AssertEq(nil, err)
+	AssertEq(2, composite.ComponentCount)
+	AssertEq(nil, composite.MD5)
+
+	// Appending didn't fetch the original contents, and the fake bucket can't
+	// serve a read while creating an object. Read them first so that
+	// flattening doesn't need to.
+	_, err = t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+
+	// Flatten. Since the file is clean, this should happen immediately.
+	err = t.in.Flatten(t.ctx)
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+	AssertEq(nil, err)
+
+	ExpectLt(composite.Generation, o.Generation)
+	ExpectEq(o.Generation, t.in.SourceGeneration())
+	ExpectEq(1, o.ComponentCount)
+	ExpectNe(nil, o.MD5)
+
+	// The contents should be unchanged.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+
+	data, err := t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(data))
+
+	// A further sync should be a no-op.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, t.in.SourceGeneration())
+}
+
+func (t *FileTest) Flatten_Dirty() {
+	var err error
+
+	// Append some data, then ask for a flatten. Nothing should happen yet.
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	err = t.in.Flatten(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
+
+	// The next sync should rewrite the object in full, rather than composing.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+
+	AssertEq(nil, err)
+	ExpectEq(o.Generation, t.in.SourceGeneration())
+	ExpectEq(1, o.ComponentCount)
+	ExpectNe(nil, o.MD5)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *FileTest) Flatten_Clobbered() {
+	var err error
+
+	// Fault in the contents, so that the flatten below doesn't need to read
+	// the (about to be deleted) backing object generation.
+	_, err = t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+
+	// Clobber the backing object.
+	newObj, err := gcsutil.CreateObject(t.ctx, t.bucket, t.in.Name(), "burrito")
+	AssertEq(nil, err)
+
+	// Flattening should fail without touching the new object.
+	err = t.in.Flatten(t.ctx)
+
+	_, ok := err.(*gcs.PreconditionError)
+	ExpectTrue(ok, "Error: %v", err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
+
+	statReq := &gcs.StatObjectRequest{Name: t.in.Name()}
+	o, err := t.bucket.StatObject(t.ctx, statReq)
+
+	AssertEq(nil, err)
+	ExpectEq(newObj.Generation, o.Generation)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *FileTest) Refresh_Unchanged() {
+	refreshed, err := t.in.Refresh(t.ctx, t.backingObj)
+
+	AssertEq(nil, err)
+	ExpectFalse(refreshed)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
+}
+
+func (t *FileTest) Refresh_Clobbered() {
+	var err error
+
+	// Fault in the old contents.
+	data, err := t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+	AssertEq("taco", string(data))
+
+	// Clobber the backing object.
+	newObj, err := gcsutil.CreateObject(t.ctx, t.bucket, t.in.Name(), "burrito")
+	AssertEq(nil, err)
+
+	// Refreshing should pick up the new generation and its contents.
+	refreshed, err := t.in.Refresh(t.ctx, newObj)
+
+	AssertEq(nil, err)
+	ExpectTrue(refreshed)
+	ExpectEq(newObj.Generation, t.in.SourceGeneration())
+
+	data, err = t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(data))
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), attrs.Size)
+	ExpectEq(1, attrs.Nlink)
+}
+
+func (t *FileTest) Refresh_Dirty() {
+	var err error
+
+	// Modify the contents, faulting them all in so that reading below doesn't
+	// need the (about to be clobbered) backing object generation.
+	_, err = t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	newObj, err := gcsutil.CreateObject(t.ctx, t.bucket, t.in.Name(), "burrito")
+	AssertEq(nil, err)
+
+	// Local modifications win.
+	refreshed, err := t.in.Refresh(t.ctx, newObj)
+
+	AssertEq(nil, err)
+	ExpectFalse(refreshed)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
+
+	data, err := t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+	ExpectEq("paco", string(data))
+}
+
+func (t *FileTest) Refresh_OutOfDateRecord() {
+	var err error
+
+	// Write out a new generation, then refresh with a record for the old one,
+	// as a cache might serve.
+	AssertEq(nil, t.in.Write(t.ctx, []byte("p"), 0))
+	AssertEq(nil, t.in.Sync(t.ctx))
+	AssertNe(t.backingObj.Generation, t.in.SourceGeneration())
+
+	gen := t.in.SourceGeneration()
+	refreshed, err := t.in.Refresh(t.ctx, t.backingObj)
+
+	AssertEq(nil, err)
+	ExpectFalse(refreshed)
+	ExpectEq(gen, t.in.SourceGeneration())
+
+	data, err := t.in.Read(t.ctx, 0, 1024)
+	AssertEq(nil, err)
+	ExpectEq("paco", string(data))
+}
+
+func (t *FileTest) WritePastMaxFileSize() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("a"), inode.MaxFileSize)
+	ExpectEq(inode.ErrFileTooLarge, err)
+
+	err = t.in.Truncate(t.ctx, inode.MaxFileSize+1)
+	ExpectEq(inode.ErrFileTooLarge, err)
+
+	// The file shouldn't have been dirtied.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len(t.initialContents), attrs.Size)
+}
+
+func (t *FileTest) Dirty() {
+	var err error
+
+	// Initially clean.
+	dirty, n, err := t.in.Dirty(t.ctx)
+	AssertEq(nil, err)
+	ExpectFalse(dirty)
+	ExpectEq(0, n)
+
+	// Write.
+	err = t.in.Write(t.ctx, []byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	dirty, n, err = t.in.Dirty(t.ctx)
+	AssertEq(nil, err)
+	ExpectTrue(dirty)
+	ExpectGt(n, 0)
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	dirty, n, err = t.in.Dirty(t.ctx)
+	AssertEq(nil, err)
+	ExpectFalse(dirty)
+	ExpectEq(0, n)
+
+	// Truncating to zero leaves nothing buffered, but is still a modification.
+	err = t.in.Truncate(t.ctx, 0)
+	AssertEq(nil, err)
+
+	dirty, _, err = t.in.Dirty(t.ctx)
+	AssertEq(nil, err)
+	ExpectTrue(dirty)
+}
+
+func (t *FileTest) SyncPlan() {
+	var err error
+	var plan gcsproxy.SyncPlan
+
+	// Initially there is nothing to do.
+	plan, err = t.in.SyncPlan(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyNone, plan.Strategy)
+
+	// Appending should result in a compose.
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len(t.initialContents)))
+	AssertEq(nil, err)
+
+	plan, err = t.in.SyncPlan(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyAppend, plan.Strategy)
+	ExpectEq(len("burrito"), plan.UploadBytes)
+	ExpectEq(t.backingObj.Generation, plan.GenerationPrecondition)
+
+	// Overwriting the start should result in a full rewrite.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	plan, err = t.in.SyncPlan(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyRewrite, plan.Strategy)
+	ExpectEq(len(t.initialContents)+len("burrito"), plan.UploadBytes)
+
+	// Planning shouldn't have written anything.
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq(t.initialContents, string(contents))
+
+	// After syncing there's nothing to do again.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	plan, err = t.in.SyncPlan(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyNone, plan.Strategy)
+}
+
+func (t *FileTest) Residency() {
+	var err error
+
+	// Create a file that is read in several chunks.
+	const chunkSize = 4
+	o, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		"chunky",
+		"tacoburritoenchiladasopa")
+
+	AssertEq(nil, err)
+	AssertEq(24, o.Size)
+
+	in := inode.NewFileInode(
+		fileInodeID+1,
+		o,
+		fuseops.InodeAttributes{},
+		chunkSize,
+		0,    // Readahead chunks
+		true, // Validate checksums
+		nil,  // Mtime layouts
+		t.bucket,
+		t.leaser,
+		nil, // Evictions
+		gcsproxy.NewObjectSyncer(1, 0, ".gcsfuse_tmp/", t.bucket),
+		&t.clock)
+
+	in.Lock()
+	defer in.Unlock()
+	defer in.Destroy()
+
+	// Nothing has been read yet.
+	resident, size, err := in.Residency(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, resident)
+	ExpectEq(24, size)
+
+	// Read the first half.
+	data, err := in.Read(t.ctx, 0, 12)
+	AssertEq(nil, err)
+	ExpectEq("tacoburritoe", string(data))
+
+	resident, size, err = in.Residency(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(12, resident)
+	ExpectEq(24, size)
+
+	// Evict everything. Asking again shouldn't fault anything in.
+	t.leaser.RevokeReadLeases()
+
+	resident, _, err = in.Residency(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, resident)
+
+	resident, _, err = in.Residency(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, resident)
+
+	// Writing doesn't fetch anything, so only what was written is local.
+	err = in.Write(t.ctx, []byte("a"), 0)
+	AssertEq(nil, err)
+
+	resident, size, err = in.Residency(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, resident)
+	ExpectEq(24, size)
+
+	// Once the contents have been fetched, they are entirely local.
+	err = in.Truncate(t.ctx, 24)
+	AssertEq(nil, err)
+
+	resident, size, err = in.Residency(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(24, resident)
+	ExpectEq(24, size)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Decompressed views
+////////////////////////////////////////////////////////////////////////
+
+const decompressedBlockSize = 16
+
+type DecompressedFileTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	leaser lease.FileLeaser
+	clock  timeutil.SimulatedClock
+
+	contents   string
+	backingObj *gcs.Object
+
+	in *inode.FileInode
+}
+
+var _ SetUpInterface = &DecompressedFileTest{}
+var _ TearDownInterface = &DecompressedFileTest{}
+
+func init() { RegisterTestSuite(&DecompressedFileTest{}) }
+
+func (t *DecompressedFileTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.leaser = lease.NewFileLeaser("", math.MaxInt32, math.MaxInt64)
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Set up a backing object consisting of several gzip members, enough to
+	// span several blocks.
+	var err error
+	var buf bytes.Buffer
+	for i := 0; i < 10; i++ {
+		member := strings.Repeat(fmt.Sprintf("line %d\n", i), i+1)
+		t.contents += member
+
+		w := gzip.NewWriter(&buf)
+		_, err = w.Write([]byte(member))
+		AssertEq(nil, err)
+
+		err = w.Close()
+		AssertEq(nil, err)
+	}
+
+	t.backingObj, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		fileInodeName+".gz",
+		buf.String())
+
+	AssertEq(nil, err)
+
+	// Create the inode.
+	t.in = inode.NewDecompressedFileInode(
+		fileInodeID,
+		t.backingObj,
+		fuseops.InodeAttributes{
+			Uid:  uid,
+			Gid:  gid,
+			Mode: fileMode,
+		},
+		decompressedBlockSize,
+		inode.DefaultMtimeLayouts,
+		t.bucket,
+		t.leaser,
+		&t.clock)
+
+	t.in.Lock()
+}
+
+func (t *DecompressedFileTest) TearDown() {
+	t.in.Unlock()
+}
+
+func (t *DecompressedFileTest) IsDecompressedView() {
+	ExpectTrue(t.in.IsDecompressedView())
+}
+
+func (t *DecompressedFileTest) ModeIsReadOnly() {
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(fileMode&^0222, attrs.Mode)
+}
+
+func (t *DecompressedFileTest) SizeCorrection() {
+	// Before indexing, the compressed size is reported.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Size, attrs.Size)
+
+	// Indexing corrects it.
+	view := t.in.UnindexedView()
+	AssertNe(nil, view)
+
+	idx, err := view.BuildIndex(t.ctx)
+	AssertEq(nil, err)
+	ExpectTrue(t.in.SetDecompressedIndex(view, idx))
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len(t.contents), attrs.Size)
+
+	// There is nothing more to do.
+	ExpectEq(nil, t.in.UnindexedView())
+}
+
+func (t *DecompressedFileTest) IndexForReplacedView() {
+	view := t.in.UnindexedView()
+	AssertNe(nil, view)
+
+	idx, err := view.BuildIndex(t.ctx)
+	AssertEq(nil, err)
+
+	// Overwrite the object, and have the inode pick up the new generation
+	// while the index was being built.
+	newObj, err := gcsutil.CreateObject(t.ctx, t.bucket, t.in.Name(), "burrito")
+	AssertEq(nil, err)
+
+	refreshed, err := t.in.Refresh(t.ctx, newObj)
+	AssertEq(nil, err)
+	AssertTrue(refreshed)
+
+	// The stale index should be ignored.
+	ExpectFalse(t.in.SetDecompressedIndex(view, idx))
+	ExpectNe(nil, t.in.UnindexedView())
+}
+
+func (t *DecompressedFileTest) Read() {
+	// Read everything.
+	data, err := t.in.Read(t.ctx, 0, len(t.contents)+10)
+	AssertEq(nil, err)
+	ExpectEq(t.contents, string(data))
+
+	// Read a range spanning several blocks, starting partway into one.
+	off := len(t.contents) / 3
+	data, err = t.in.Read(t.ctx, int64(off), 3*decompressedBlockSize)
+	AssertEq(nil, err)
+	ExpectEq(t.contents[off:off+3*decompressedBlockSize], string(data))
+
+	// Read past the end.
+	data, err = t.in.Read(t.ctx, int64(len(t.contents)), 10)
+	AssertEq(nil, err)
+	ExpectEq("", string(data))
+}
+
+func (t *DecompressedFileTest) WriteAndTruncateFail() {
+	var err error
+
+	err = t.in.Write(t.ctx, []byte("taco"), 0)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = t.in.Truncate(t.ctx, 0)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	err = t.in.Flatten(t.ctx)
+	ExpectThat(err, Error(HasSubstr("read-only")))
+
+	// The contents should be untouched.
+	data, err := t.in.Read(t.ctx, 0, len(t.contents))
+	AssertEq(nil, err)
+	ExpectEq(t.contents, string(data))
+}
+
+func (t *DecompressedFileTest) SyncDoesNothing() {
+	err := t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration())
 }
@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Controls which objects are presented as read-only views of their
+// gzip-decompressed contents (see NewDecompressedFileInode), and how they are
+// named. The zero value disables the feature.
+type GzipViewConfig struct {
+	// Object name suffixes, e.g. ".gz", that mark an object as gzip-compressed.
+	Suffixes []string
+
+	// If set, directories list a decompressed view without its suffix, unless
+	// the resulting name is already in use by another file or directory. Such
+	// views may be looked up by either name.
+	DropSuffix bool
+}
+
+// Return the suffix that marks the supplied object name as a decompressed
+// view, or the empty string if it isn't one. A file whose entire base name is
+// the suffix doesn't count.
+func (c *GzipViewConfig) MatchSuffix(name string) (suffix string) {
+	if IsDirName(name) {
+		return
+	}
+
+	base := path.Base(name)
+	for _, s := range c.Suffixes {
+		if len(base) > len(s) && strings.HasSuffix(base, s) {
+			suffix = s
+			return
+		}
+	}
+
+	return
+}
+
+// Is the object with the supplied name presented as a decompressed view?
+func (c *GzipViewConfig) IsView(name string) bool {
+	return c.MatchSuffix(name) != ""
+}
+
+// Describe, one line per entry, how the object with the supplied name is
+// presented.
+func (c *GzipViewConfig) Explain(name string) (lines []string) {
+	suffix := c.MatchSuffix(name)
+	if suffix == "" {
+		lines = append(lines, "decompressed view: no")
+		return
+	}
+
+	lines = append(
+		lines,
+		fmt.Sprintf("decompressed view: yes, read-only (suffix %q)", suffix))
+
+	if c.DropSuffix {
+		lines = append(
+			lines,
+			fmt.Sprintf(
+				"  listed as %q unless that name is in use",
+				strings.TrimSuffix(path.Base(name), suffix)))
+	}
+
+	return
+}
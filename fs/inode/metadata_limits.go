@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"errors"
+	"unicode"
+	"unicode/utf8"
+)
+
+// GCS limits the custom metadata of an object to this many bytes, counting
+// both keys and values.
+const MaxCustomMetadataBytes = 8 * 1024
+
+// Errors returned by CheckCustomMetadata.
+var (
+	ErrMetadataTooLarge = errors.New("Custom metadata exceeds the GCS limit")
+	ErrMetadataInvalid  = errors.New(
+		"Custom metadata must be UTF-8 without control characters")
+)
+
+// Return the number of bytes that the supplied custom metadata counts against
+// MaxCustomMetadataBytes.
+func CustomMetadataSize(m map[string]string) (n int) {
+	for k, v := range m {
+		n += len(k) + len(v)
+	}
+
+	return
+}
+
+// Check that GCS will accept the supplied custom metadata, so that callers can
+// fail with a meaningful error before sending a request that is bound to be
+// rejected with an opaque one. Returns ErrMetadataInvalid or
+// ErrMetadataTooLarge if not.
+func CheckCustomMetadata(m map[string]string) (err error) {
+	for k, v := range m {
+		if !validMetadataString(k) || !validMetadataString(v) {
+			err = ErrMetadataInvalid
+			return
+		}
+	}
+
+	if CustomMetadataSize(m) > MaxCustomMetadataBytes {
+		err = ErrMetadataTooLarge
+		return
+	}
+
+	return
+}
+
+func validMetadataString(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMetadataLimits(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MetadataLimitsTest struct {
+}
+
+func init() { RegisterTestSuite(&MetadataLimitsTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MetadataLimitsTest) Empty() {
+	ExpectEq(0, inode.CustomMetadataSize(nil))
+	ExpectEq(nil, inode.CheckCustomMetadata(nil))
+}
+
+func (t *MetadataLimitsTest) SizeCountsKeysAndValues() {
+	m := map[string]string{
+		"foo":     "taco",
+		"bar_baz": "",
+	}
+
+	ExpectEq(14, inode.CustomMetadataSize(m))
+}
+
+func (t *MetadataLimitsTest) Boundary() {
+	key := inode.SymlinkMetadataKey
+	n := inode.MaxCustomMetadataBytes - len(key)
+
+	m := map[string]string{key: strings.Repeat("a", n)}
+	ExpectEq(nil, inode.CheckCustomMetadata(m))
+
+	m = map[string]string{key: strings.Repeat("a", n+1)}
+	ExpectEq(inode.ErrMetadataTooLarge, inode.CheckCustomMetadata(m))
+}
+
+func (t *MetadataLimitsTest) AggregateAcrossKeys() {
+	half := inode.MaxCustomMetadataBytes / 2
+	m := map[string]string{
+		"a": strings.Repeat("a", half-1),
+		"b": strings.Repeat("b", half-1),
+	}
+
+	ExpectEq(nil, inode.CheckCustomMetadata(m))
+
+	m["c"] = "c"
+	ExpectEq(inode.ErrMetadataTooLarge, inode.CheckCustomMetadata(m))
+}
+
+func (t *MetadataLimitsTest) InvalidStrings() {
+	testCases := []map[string]string{
+		{"foo": "\xff"},
+		{"\xfe": "foo"},
+		{"foo": "a\nb"},
+		{"foo": "a\x00b"},
+		{"foo": "a\u0085b"},
+	}
+
+	for _, m := range testCases {
+		ExpectEq(inode.ErrMetadataInvalid, inode.CheckCustomMetadata(m), "%q", m)
+	}
+}
+
+func (t *MetadataLimitsTest) NonASCIIIsFine() {
+	m := map[string]string{"foo": "crème brûlée/タコ"}
+	ExpectEq(nil, inode.CheckCustomMetadata(m))
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// The object metadata key under which a file's modification time may be
+// recorded, in RFC 3339 format. Objects without it use their Updated time.
+// Objects written by gcsproxy.ObjectSyncer always have it.
+const MtimeMetadataKey = gcsproxy.MtimeMetadataKey
+
+// The feature under which the object fields that mtimes need are registered
+// with gcsproxy.ObjectFields.
+const MtimeObjectFields = "mtimes"
+
+func init() {
+	gcsproxy.ObjectFields.Register(
+		MtimeObjectFields,
+		"metadata/"+MtimeMetadataKey)
+}
+
+// Layouts, in the syntax of package time, that ParseMtime tries by default
+// after RFC 3339. They cover what we have seen written by other tools. Values
+// parsed with a layout lacking a zone are interpreted as UTC.
+var DefaultMtimeLayouts = []string{
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// Mtimes before this are assumed to be garbage.
+var minPlausibleMtime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Mtimes more than this far past the current time are assumed to be garbage.
+const maxPlausibleMtimeYears = 10
+
+// Does the supplied layout specify a time zone?
+func layoutHasZone(layout string) bool {
+	return strings.Contains(layout, "Z07") ||
+		strings.Contains(layout, "-07") ||
+		strings.Contains(layout, "MST")
+}
+
+// Parse the value of an object's MtimeMetadataKey metadata, trying RFC 3339
+// (with and without fractional seconds) and then each of the supplied layouts
+// in order.
+//
+// The result is never the zero time. If the value can't be parsed, or is
+// before 1980 or more than ten years after now, fallback (normally the
+// object's Updated time) is returned instead. In those cases, and when the
+// value is accepted but had no time zone and so was assumed to be UTC, problem
+// describes what went wrong. Otherwise it is empty.
+//
+// This is a pure function of its arguments.
+func ParseMtime(
+	value string,
+	layouts []string,
+	fallback time.Time,
+	now time.Time) (mtime time.Time, problem string) {
+	value = strings.TrimSpace(value)
+
+	// Try each layout in turn.
+	candidates := append([]string{time.RFC3339Nano, time.RFC3339}, layouts...)
+
+	var parsed bool
+	for _, layout := range candidates {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+
+		parsed = true
+		mtime = t
+		if !layoutHasZone(layout) {
+			problem = "no time zone; assuming UTC"
+		}
+
+		break
+	}
+
+	// Fall back if there's nothing we recognize.
+	if !parsed {
+		mtime = fallback
+		problem = "unrecognized format; using the object's update time"
+		return
+	}
+
+	// Reject absurd values.
+	maxMtime := now.AddDate(maxPlausibleMtimeYears, 0, 0)
+	if mtime.Before(minPlausibleMtime) || mtime.After(maxMtime) {
+		problem = fmt.Sprintf(
+			"implausible time %v; using the object's update time",
+			mtime)
+
+		mtime = fallback
+		return
+	}
+
+	return
+}
+
+// The mtime metadata values of object generations that objectMtime has warned
+// about, so that each is warned about once rather than whenever an inode is
+// minted for it. Once the set reaches mtimeWarningsCapacity it is emptied, so
+// a generation may be warned about again after many others have been.
+const mtimeWarningsCapacity = 1024
+
+var mtimeWarnings struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	warned map[string]struct{}
+}
+
+// Return true the first time the given object generation and mtime metadata
+// value are passed.
+func firstMtimeWarning(o *gcs.Object, value string) bool {
+	key := gcsproxy.LeaseTag(o.Name, o.Generation) + "\n" + value
+
+	mtimeWarnings.mu.Lock()
+	defer mtimeWarnings.mu.Unlock()
+
+	if _, ok := mtimeWarnings.warned[key]; ok {
+		return false
+	}
+
+	if len(mtimeWarnings.warned) >= mtimeWarningsCapacity {
+		mtimeWarnings.warned = nil
+	}
+
+	if mtimeWarnings.warned == nil {
+		mtimeWarnings.warned = make(map[string]struct{})
+	}
+
+	mtimeWarnings.warned[key] = struct{}{}
+	return true
+}
+
+// Return the modification time to report for the supplied object, logging a
+// warning the first time an object generation has mtime metadata that
+// couldn't be used as is.
+func objectMtime(
+	o *gcs.Object,
+	layouts []string,
+	now time.Time) (mtime time.Time) {
+	value, ok := o.Metadata[MtimeMetadataKey]
+	if !ok {
+		mtime = o.Updated
+		return
+	}
+
+	mtime, problem := ParseMtime(value, layouts, o.Updated, now)
+	if problem != "" && firstMtimeWarning(o, value) {
+		log.Printf(
+			"Warning: object %q (generation %d) has %s metadata %q: %s",
+			o.Name,
+			o.Generation,
+			MtimeMetadataKey,
+			value,
+			problem)
+	}
+
+	return
+}
@@ -0,0 +1,248 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMtime(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MtimeTest struct {
+}
+
+func init() { RegisterTestSuite(&MtimeTest{}) }
+
+var mtimeTestFallback = time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)
+var mtimeTestNow = time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MtimeTest) DefaultLayouts() {
+	pdt := time.FixedZone("PDT", -7*3600)
+	cet := time.FixedZone("CET", 3600)
+
+	testCases := []struct {
+		value           string
+		expected        time.Time
+		expectedProblem string
+	}{
+		/////////////////////////
+		// Accepted silently
+		/////////////////////////
+
+		// RFC 3339
+		{
+			"2014-03-09T01:59:59Z",
+			time.Date(2014, 3, 9, 1, 59, 59, 0, time.UTC),
+			"",
+		},
+
+		{
+			"2014-03-09T01:59:59-07:00",
+			time.Date(2014, 3, 9, 1, 59, 59, 0, pdt),
+			"",
+		},
+
+		{
+			"2014-03-09T01:59:59.123456789+01:00",
+			time.Date(2014, 3, 9, 1, 59, 59, 123456789, cet),
+			"",
+		},
+
+		{
+			"  2014-03-09T01:59:59.5Z\n",
+			time.Date(2014, 3, 9, 1, 59, 59, 500000000, time.UTC),
+			"",
+		},
+
+		// ISO 8601 basic zone offset
+		{
+			"2014-03-09T01:59:59-0700",
+			time.Date(2014, 3, 9, 1, 59, 59, 0, pdt),
+			"",
+		},
+
+		// Space separated, with zone
+		{
+			"2014-03-09 01:59:59+01:00",
+			time.Date(2014, 3, 9, 1, 59, 59, 0, cet),
+			"",
+		},
+
+		{
+			"2014-03-09 01:59:59.25 -0700",
+			time.Date(2014, 3, 9, 1, 59, 59, 250000000, pdt),
+			"",
+		},
+
+		// RFC 1123
+		{
+			"Sun, 09 Mar 2014 01:59:59 -0700",
+			time.Date(2014, 3, 9, 1, 59, 59, 0, pdt),
+			"",
+		},
+
+		{
+			"Sun, 09 Mar 2014 01:59:59 GMT",
+			time.Date(2014, 3, 9, 1, 59, 59, 0, time.UTC),
+			"",
+		},
+
+		/////////////////////////
+		// Accepted as UTC
+		/////////////////////////
+
+		{
+			"2014-03-09T02:30:00",
+			time.Date(2014, 3, 9, 2, 30, 0, 0, time.UTC),
+			"no time zone",
+		},
+
+		{
+			"2014-03-09T02:30:00.123",
+			time.Date(2014, 3, 9, 2, 30, 0, 123000000, time.UTC),
+			"no time zone",
+		},
+
+		{
+			"2014-11-02 01:30:00",
+			time.Date(2014, 11, 2, 1, 30, 0, 0, time.UTC),
+			"no time zone",
+		},
+
+		/////////////////////////
+		// Unparseable
+		/////////////////////////
+
+		{"", mtimeTestFallback, "unrecognized"},
+		{"taco", mtimeTestFallback, "unrecognized"},
+		{"1425522900", mtimeTestFallback, "unrecognized"},
+		{"2014-03-09", mtimeTestFallback, "unrecognized"},
+		{"2014-13-09T01:59:59Z", mtimeTestFallback, "unrecognized"},
+		{"2014-03-09T25:59:59Z", mtimeTestFallback, "unrecognized"},
+		{"09/03/2014 01:59:59", mtimeTestFallback, "unrecognized"},
+
+		/////////////////////////
+		// Implausible
+		/////////////////////////
+
+		{"0001-01-01T00:00:00Z", mtimeTestFallback, "implausible"},
+		{"1970-01-01T00:00:00Z", mtimeTestFallback, "implausible"},
+		{"1979-12-31T23:59:59Z", mtimeTestFallback, "implausible"},
+		{"2025-06-01T00:00:01Z", mtimeTestFallback, "implausible"},
+		{"9999-12-31T23:59:59Z", mtimeTestFallback, "implausible"},
+		{"1969-07-20 20:17:40", mtimeTestFallback, "implausible"},
+
+		/////////////////////////
+		// Just plausible
+		/////////////////////////
+
+		{
+			"1980-01-01T00:00:00Z",
+			time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+			"",
+		},
+
+		{
+			"2025-06-01T00:00:00Z",
+			time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+			"",
+		},
+	}
+
+	for i, tc := range testCases {
+		mtime, problem := inode.ParseMtime(
+			tc.value,
+			inode.DefaultMtimeLayouts,
+			mtimeTestFallback,
+			mtimeTestNow)
+
+		ExpectThat(mtime, timeutil.TimeEq(tc.expected), "Test case %d: %q", i, tc.value)
+		ExpectFalse(mtime.IsZero(), "Test case %d: %q", i, tc.value)
+
+		if tc.expectedProblem == "" {
+			ExpectEq("", problem, "Test case %d: %q", i, tc.value)
+		} else {
+			ExpectThat(problem, HasSubstr(tc.expectedProblem), "Test case %d: %q", i, tc.value)
+		}
+	}
+}
+
+func (t *MtimeTest) CustomLayouts() {
+	layouts := []string{"02/01/2006 15:04:05"}
+
+	// The custom layout is used, and is zone-less.
+	mtime, problem := inode.ParseMtime(
+		"09/03/2014 01:59:59",
+		layouts,
+		mtimeTestFallback,
+		mtimeTestNow)
+
+	ExpectThat(mtime, timeutil.TimeEq(time.Date(2014, 3, 9, 1, 59, 59, 0, time.UTC)))
+	ExpectThat(problem, HasSubstr("no time zone"))
+
+	// RFC 3339 is still tried first.
+	mtime, problem = inode.ParseMtime(
+		"2014-03-09T01:59:59Z",
+		layouts,
+		mtimeTestFallback,
+		mtimeTestNow)
+
+	ExpectThat(mtime, timeutil.TimeEq(time.Date(2014, 3, 9, 1, 59, 59, 0, time.UTC)))
+	ExpectEq("", problem)
+
+	// The default layouts are not.
+	mtime, problem = inode.ParseMtime(
+		"2014-03-09 01:59:59",
+		layouts,
+		mtimeTestFallback,
+		mtimeTestNow)
+
+	ExpectThat(mtime, timeutil.TimeEq(mtimeTestFallback))
+	ExpectThat(problem, HasSubstr("unrecognized"))
+}
+
+func (t *MtimeTest) FirstMatchingLayoutWins() {
+	layouts := []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04:05 -0700",
+	}
+
+	// The zone-less layout doesn't match the whole value, so the second is used.
+	mtime, problem := inode.ParseMtime(
+		"2014-03-09 01:59:59 -0700",
+		layouts,
+		mtimeTestFallback,
+		mtimeTestNow)
+
+	ExpectThat(
+		mtime,
+		timeutil.TimeEq(time.Date(2014, 3, 9, 8, 59, 59, 0, time.UTC)))
+
+	ExpectEq("", problem)
+}
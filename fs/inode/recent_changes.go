@@ -0,0 +1,249 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// A child of a directory that was recently created or deleted through the
+// directory's inode. Object listings in GCS are only eventually consistent, so
+// a listing may not yet reflect such a change; see DirInode.RecentChanges.
+type LocalChild struct {
+	Name string
+
+	// fuseutil.DT_Directory for a directory, and fuseutil.DT_File or
+	// fuseutil.DT_Link otherwise. For deletions of files and symlinks, which
+	// are indistinguishable by name, always fuseutil.DT_File.
+	Type fuseutil.DirentType
+
+	// Set if the child was deleted rather than created.
+	Deleted bool
+}
+
+// How long after a creation we continue to assume that listings may not
+// reflect it.
+const recentChangeWindow = time.Minute
+
+// How long deletions are remembered by default. See NewDirInode.
+const DefaultTombstoneTTL = time.Minute
+
+// The maximum number of changes remembered for a single directory. Beyond
+// this, further changes are forgotten until older ones expire.
+const recentChangeCapacity = 1 << 12
+
+// A record of LocalChild structs. Creations are forgotten after
+// recentChangeWindow, and deletions (tombstones) after tombstoneTTL or once a
+// listing made after the deletion confirms it. For a given name, at most one
+// file or symlink change and at most one directory change is recorded; a later
+// change replaces an earlier one.
+//
+// The zero value is empty and ready to use, with a tombstoneTTL of
+// DefaultTombstoneTTL. External synchronization is required.
+type recentChanges struct {
+	tombstoneTTL time.Duration
+
+	// INVARIANT: For each k/v, k.name == v.child.Name
+	// INVARIANT: For each k/v, k.dir == (v.child.Type == fuseutil.DT_Directory)
+	// INVARIANT: len(changes) <= recentChangeCapacity
+	changes map[recentChangeKey]recentChange
+}
+
+type recentChangeKey struct {
+	name string
+	dir  bool
+}
+
+type recentChange struct {
+	child      LocalChild
+	expiration time.Time
+
+	// For deletions, when the child was deleted and the generation of its
+	// backing object that was deleted, or zero if that is unknown.
+	deletedAt  time.Time
+	generation int64
+}
+
+func (rc *recentChanges) CheckInvariants() {
+	for k, v := range rc.changes {
+		// INVARIANT: For each k/v, k.name == v.child.Name
+		if k.name != v.child.Name {
+			panic("Mismatched recent change name: " + k.name)
+		}
+
+		// INVARIANT: For each k/v, k.dir == (v.child.Type == fuseutil.DT_Directory)
+		if k.dir != (v.child.Type == fuseutil.DT_Directory) {
+			panic("Mismatched recent change type: " + k.name)
+		}
+	}
+
+	// INVARIANT: len(changes) <= recentChangeCapacity
+	if len(rc.changes) > recentChangeCapacity {
+		panic("Too many recent changes")
+	}
+}
+
+// Drop expired changes.
+func (rc *recentChanges) prune(now time.Time) {
+	for k, v := range rc.changes {
+		if v.expiration.Before(now) {
+			delete(rc.changes, k)
+		}
+	}
+}
+
+// Record a creation, replacing any earlier change of the same kind of child
+// with the same name.
+func (rc *recentChanges) Note(now time.Time, c LocalChild) {
+	rc.add(now, recentChange{
+		child:      c,
+		expiration: now.Add(recentChangeWindow),
+	})
+}
+
+// Record the deletion of the supplied generation of a child's backing object,
+// where zero means it is unknown. Like Note, except that the change is
+// remembered for tombstoneTTL and hides stale copies of the child from
+// lookups; see Hides.
+//
+// REQUIRES: c.Deleted
+func (rc *recentChanges) NoteDeletion(
+	now time.Time,
+	c LocalChild,
+	generation int64) {
+	ttl := rc.tombstoneTTL
+	if ttl == 0 {
+		ttl = DefaultTombstoneTTL
+	}
+
+	rc.add(now, recentChange{
+		child:      c,
+		expiration: now.Add(ttl),
+		deletedAt:  now,
+		generation: generation,
+	})
+}
+
+func (rc *recentChanges) add(now time.Time, v recentChange) {
+	if rc.changes == nil {
+		rc.changes = make(map[recentChangeKey]recentChange)
+	}
+
+	k := recentChangeKey{v.child.Name, v.child.Type == fuseutil.DT_Directory}
+
+	// Make room if necessary, giving up if we can't.
+	if _, ok := rc.changes[k]; !ok && len(rc.changes) >= recentChangeCapacity {
+		rc.prune(now)
+		if len(rc.changes) >= recentChangeCapacity {
+			return
+		}
+	}
+
+	rc.changes[k] = v
+}
+
+// Return the unexpired tombstone for the named child, if any.
+func (rc *recentChanges) tombstone(
+	now time.Time,
+	name string,
+	dir bool) (v recentChange, ok bool) {
+	v, ok = rc.changes[recentChangeKey{name, dir}]
+	ok = ok && v.child.Deleted && !v.expiration.Before(now)
+	return
+}
+
+// Report whether the supplied object, found under the name of a child by a
+// lookup or listing, is a stale copy of something we deleted and should be
+// hidden. That is the case if the child has an unexpired tombstone and the
+// object is no newer than the deletion: no later generation if we know which
+// one we deleted, and otherwise not updated after we deleted it. A nil object
+// stands for an implicit directory, for which we have nothing to compare, and
+// is hidden if there is a tombstone at all.
+//
+// Does not modify the receiver, so may be called concurrently with itself.
+func (rc *recentChanges) Hides(
+	now time.Time,
+	name string,
+	dir bool,
+	o *gcs.Object) bool {
+	v, ok := rc.tombstone(now, name, dir)
+	switch {
+	case !ok:
+		return false
+
+	case o == nil:
+		return true
+
+	case v.generation != 0:
+		return o.Generation <= v.generation
+
+	default:
+		return !o.Updated.After(v.deletedAt)
+	}
+}
+
+// Forget the tombstone for the named child, if any, for example because a
+// listing shows that it has since been re-created elsewhere.
+func (rc *recentChanges) ForgetDeletion(name string, dir bool) {
+	k := recentChangeKey{name, dir}
+	if v, ok := rc.changes[k]; ok && v.child.Deleted {
+		delete(rc.changes, k)
+	}
+}
+
+// Forget the tombstones for children deleted before listedAt for which
+// absent returns true, meaning that a listing made at that time doesn't
+// contain them. Listings have evidently caught up with such deletions.
+func (rc *recentChanges) ConfirmAbsent(
+	listedAt time.Time,
+	absent func(name string, dir bool) bool) {
+	for k, v := range rc.changes {
+		if !v.child.Deleted || !listedAt.After(v.deletedAt) {
+			continue
+		}
+
+		if absent(k.name, k.dir) {
+			delete(rc.changes, k)
+		}
+	}
+}
+
+// Return the unexpired changes, sorted by name with directories first.
+func (rc *recentChanges) List(now time.Time) (children []LocalChild) {
+	rc.prune(now)
+	for _, v := range rc.changes {
+		children = append(children, v.child)
+	}
+
+	sort.Sort(sortedLocalChildren(children))
+	return
+}
+
+type sortedLocalChildren []LocalChild
+
+func (p sortedLocalChildren) Len() int      { return len(p) }
+func (p sortedLocalChildren) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p sortedLocalChildren) Less(i, j int) bool {
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+
+	return p[i].Type == fuseutil.DT_Directory && p[j].Type != fuseutil.DT_Directory
+}
@@ -17,6 +17,7 @@ package inode
 import (
 	"sync"
 
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
@@ -27,6 +28,16 @@ import (
 // this with IsSymlink.
 const SymlinkMetadataKey = "gcsfuse_symlink_target"
 
+// The feature under which the object fields that symlinks need are registered
+// with gcsproxy.ObjectFields.
+const SymlinkObjectFields = "symlinks"
+
+func init() {
+	gcsproxy.ObjectFields.Register(
+		SymlinkObjectFields,
+		"metadata/"+SymlinkMetadataKey)
+}
+
 // Does the supplied object represent a symlink inode?
 func IsSymlink(o *gcs.Object) bool {
 	_, ok := o.Metadata[SymlinkMetadataKey]
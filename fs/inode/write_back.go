@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"fmt"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/googlecloudplatform/gcsfuse/mutable"
+	"golang.org/x/net/context"
+)
+
+// The size of the buffer through which replayContent copies.
+const replayBufferSize = 1 << 20
+
+// Like Sync, but without holding the inode lock while uploading, so that the
+// file may be read, written, and statted in the meantime. The modified parts
+// of the content are first copied, and the copy is written out. Writes made
+// during the upload are then carried over onto the new generation, which the
+// inode presents from then on, leaving the file dirty again.
+//
+// Does nothing if the file is clean, or if a write-back is already in
+// progress. Other syncs, and anything else that depends on which generation
+// the inode presents, wait for the upload with WaitForWriteBack.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) WriteBack(ctx context.Context) (err error) {
+	if f.gzip != nil || f.writingBack || f.destroyed {
+		return
+	}
+
+	if f.stale != nil {
+		err = f.stale
+		return
+	}
+
+	sr, err := f.content.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	if sr.Mtime == nil {
+		return
+	}
+
+	// Copy what we will upload. Outside of the dirty ranges the copy reads from
+	// the source generation, as the content itself does.
+	src := f.src
+	snapshot := f.newContent(&src, nil)
+	err = replayContent(ctx, f.content, snapshot, sr, sr.DirtyRanges)
+	if err != nil {
+		snapshot.Destroy()
+		err = fmt.Errorf("replayContent: %v", err)
+		return
+	}
+
+	syncFunc := f.objectSyncer.SyncObject
+	if f.flattenRequested {
+		syncFunc = f.objectSyncer.FlattenObject
+	}
+
+	// Upload without the lock.
+	f.writingBack = true
+	f.mu.Unlock()
+	rl, newObj, err := syncFunc(ctx, &src, snapshot)
+	f.mu.Lock()
+
+	written := f.writtenDuringWriteBack
+	truncated := f.truncatedDuringWriteBack
+	f.writingBack = false
+	f.writtenDuringWriteBack = nil
+	f.truncatedDuringWriteBack = false
+	f.writeBackDone.Broadcast()
+
+	// The syncer destroys the copy only if it wrote it out.
+	if newObj == nil {
+		snapshot.Destroy()
+	}
+
+	if f.destroyed {
+		if rl != nil {
+			rl.Revoke()
+		}
+
+		return
+	}
+
+	// Present the new generation, if any, and carry over what was written in
+	// the meantime.
+	live := f.content
+	liveSR, statErr := live.Stat(ctx)
+
+	err = f.adoptSyncResult(rl, newObj, err)
+	err = f.checkClobbered(ctx, err)
+	if f.content == live {
+		return
+	}
+
+	if statErr == nil && (truncated || len(written) != 0) {
+		ranges := written
+		if truncated {
+			ranges = liveSR.DirtyRanges
+		}
+
+		statErr = replayContent(ctx, live, f.content, liveSR, ranges)
+	}
+
+	// Should that fail, keep the content as it is, and have the next sync
+	// write out all of it over the new generation.
+	if statErr != nil {
+		f.content.Destroy()
+		f.content = live
+		f.flattenRequested = true
+
+		if err == nil {
+			err = fmt.Errorf("Carrying over writes: %v", statErr)
+		}
+
+		return
+	}
+
+	live.Destroy()
+	return
+}
+
+// Wait until no write-back is in progress, releasing the lock meanwhile. See
+// WriteBack.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) WaitForWriteBack() {
+	for f.writingBack {
+		f.writeBackDone.Wait()
+	}
+}
+
+// Make dst, which agrees with src outside of the supplied ranges, hold the
+// same content as src, whose state is described by sr: copy the ranges,
+// match its size, and take on its modification time.
+func replayContent(
+	ctx context.Context,
+	src mutable.Content,
+	dst mutable.Content,
+	sr mutable.StatResult,
+	ranges []lease.ByteRange) (err error) {
+	dstSR, err := dst.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	if sr.Size < dstSR.Size {
+		err = dst.Truncate(ctx, sr.Size)
+		if err != nil {
+			err = fmt.Errorf("Truncate: %v", err)
+			return
+		}
+	}
+
+	buf := make([]byte, replayBufferSize)
+	for _, r := range ranges {
+		if r.Limit > sr.Size {
+			r.Limit = sr.Size
+		}
+
+		for off := r.Start; off < r.Limit; {
+			p := buf
+			if int64(len(p)) > r.Limit-off {
+				p = p[:r.Limit-off]
+			}
+
+			var n int
+			n, err = src.ReadAt(ctx, p, off)
+			if n != len(p) {
+				err = fmt.Errorf("ReadAt: %v", err)
+				return
+			}
+
+			_, err = dst.WriteAt(ctx, p, off)
+			if err != nil {
+				err = fmt.Errorf("WriteAt: %v", err)
+				return
+			}
+
+			off += int64(n)
+		}
+	}
+
+	// Writes beyond the end have extended dst with zeroes, as they did src,
+	// but src may have been extended by truncating too.
+	dstSR, err = dst.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	if dstSR.Size < sr.Size {
+		err = dst.Truncate(ctx, sr.Size)
+		if err != nil {
+			err = fmt.Errorf("Truncate: %v", err)
+			return
+		}
+	}
+
+	if sr.Mtime != nil {
+		dst.SetMtime(*sr.Mtime)
+	}
+
+	return
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"hash/fnv"
+	"math"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// Return the preferred inode ID for the given object name when the file system
+// is configured for stable identity. This depends only on the name, so is the
+// same across processes and machines. It is never fuseops.RootInodeID or
+// anything below it.
+func stableInodeID(name string) fuseops.InodeID {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	const firstID = uint64(fuseops.RootInodeID) + 1
+	return fuseops.InodeID(firstID + h.Sum64()%(math.MaxUint64-firstID+1))
+}
+
+// Choose an ID for a new inode with the given name.
+//
+// Normally IDs are handed out sequentially. With stable identity, we use the
+// hash of the name, probing upward from there if that ID is already in use by
+// a live inode. A probe is needed when two names hash to the same ID, or when
+// an object is overwritten remotely while the kernel still holds the inode for
+// the old generation (see lookUpOrCreateInodeIfNotStale). In either case the
+// inode that arrives second gets an ID that depends on what else is live, and
+// so is not stable across restarts. This is the only case in which stable
+// identity is not honored; it never causes two live inodes to share an ID.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) chooseInodeID(name string) (id fuseops.InodeID) {
+	if !fs.stableIdentity {
+		id = fs.nextInodeID
+		fs.nextInodeID++
+		return
+	}
+
+	id = stableInodeID(name)
+	for {
+		if _, ok := fs.inodes[id]; !ok {
+			return
+		}
+
+		id++
+		if id <= fuseops.RootInodeID {
+			id = fuseops.RootInodeID + 1
+		}
+	}
+}
+
+// Return the change time to report for an object generation with stable
+// identity. GCS mints generations as microseconds since the epoch, so this is
+// also roughly the time of the change, but all that matters to NFS is that it
+// changes exactly when the generation does.
+func changeTimeForGeneration(generation int64) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(generation) * time.Microsecond)
+}
+
+// Return the attributes of the supplied inode, adjusted for our configuration.
+//
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) getAttributes(
+	ctx context.Context,
+	in inode.Inode) (attrs fuseops.InodeAttributes, err error) {
+	attrs, err = in.Attributes(ctx)
+	if err != nil {
+		return
+	}
+
+	// Only file inodes keep access times.
+	if _, ok := in.(*inode.FileInode); !ok || fs.atimeMode == AtimeOff {
+		attrs.Atime = attrs.Mtime
+	}
+
+	// With stable identity, pin the change time to the source generation, so
+	// that it survives restarts but not overwrites.
+	if fs.stableIdentity {
+		if gb, ok := in.(GenerationBackedInode); ok {
+			attrs.Ctime = changeTimeForGeneration(gb.SourceGeneration())
+		}
+	}
+
+	return
+}
@@ -0,0 +1,360 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package invalidation contains a dispatcher that delivers kernel cache
+// invalidations asynchronously, off of the path of file system ops.
+package invalidation
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/syncutil"
+)
+
+// A type that knows how to tell the kernel to drop its cached state for an
+// inode, e.g. by sending a FUSE notify message.
+//
+// Calls are made from a single goroutine that is never servicing a file system
+// op, so implementations may block without risking deadlock against in-flight
+// ops.
+type Invalidator interface {
+	InvalidateInode(id fuseops.InodeID) (err error)
+}
+
+// An Invalidator that can also tell the kernel to forget a name within a
+// directory, so that the next use of the name looks it up afresh.
+type EntryInvalidator interface {
+	Invalidator
+	InvalidateEntry(parent fuseops.InodeID, name string) (err error)
+}
+
+// Counters describing a dispatcher's history. See Dispatcher.Stats.
+type Stats struct {
+	// The number of invalidations handed to the Invalidator, successfully or
+	// not.
+	Dispatched uint64
+
+	// The number of dispatched invalidations for which the Invalidator returned
+	// an error.
+	Failed uint64
+
+	// The number of requests that were folded into an invalidation already
+	// pending for the same inode.
+	Coalesced uint64
+
+	// The number of requests thrown away because the queue was full or the
+	// dispatcher had been stopped. The kernel's view of these inodes will be
+	// corrected only when its own cache entries expire.
+	Dropped uint64
+}
+
+// A bounded queue of pending invalidations drained by a single goroutine.
+// Multiple pending requests for the same inode or entry are collapsed into
+// one.
+//
+// Safe for concurrent access.
+type Dispatcher interface {
+	// Schedule an invalidation for the supplied inode. Never blocks and never
+	// calls the Invalidator directly, so it is safe to call from op handlers
+	// while holding locks. Return false if the request was dropped.
+	Invalidate(id fuseops.InodeID) (queued bool)
+
+	// Like Invalidate, but for the kernel's entry for the named child of the
+	// supplied directory inode. If the Invalidator is not an EntryInvalidator,
+	// the directory inode is invalidated instead.
+	InvalidateEntry(parent fuseops.InodeID, name string) (queued bool)
+
+	// Return a snapshot of the dispatcher's counters.
+	Stats() (s Stats)
+
+	// Deliver any invalidations still pending, then stop the draining
+	// goroutine. Requests made after Stop is called are dropped. Blocks until
+	// the goroutine has exited.
+	Stop()
+}
+
+// Create a dispatcher that delivers invalidations to the supplied invalidator,
+// holding at most capacity distinct requests pending at any given time.
+//
+// REQUIRES: capacity > 0
+func NewDispatcher(
+	invalidator Invalidator,
+	capacity int) (d Dispatcher) {
+	if capacity <= 0 {
+		panic(fmt.Sprintf("Illegal capacity: %d", capacity))
+	}
+
+	typed := &dispatcher{
+		invalidator: invalidator,
+		capacity:    capacity,
+		pending:     make(map[request]struct{}),
+		wakeUp:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	typed.mu = syncutil.NewInvariantMutex(typed.checkInvariants)
+
+	go typed.drain()
+
+	d = typed
+	return
+}
+
+type dispatcher struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	invalidator Invalidator
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	capacity int
+
+	// Signalled (without blocking) whenever there may be new work for the
+	// draining goroutine.
+	wakeUp chan struct{}
+
+	// Closed when the draining goroutine exits.
+	done chan struct{}
+
+	/////////////////////////
+	// Counters
+	/////////////////////////
+
+	// Accessed atomically.
+	dispatched uint64
+	failed     uint64
+	coalesced  uint64
+	dropped    uint64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu syncutil.InvariantMutex
+
+	// Invalidations awaiting delivery, in FIFO order.
+	//
+	// INVARIANT: len(queue) <= capacity
+	// INVARIANT: Contains no duplicates
+	//
+	// GUARDED_BY(mu)
+	queue []request
+
+	// The set of requests in queue.
+	//
+	// INVARIANT: Contains exactly the elements of queue
+	//
+	// GUARDED_BY(mu)
+	pending map[request]struct{}
+
+	// Set when Stop is called.
+	//
+	// GUARDED_BY(mu)
+	stopped bool
+
+	// Ensures that only the first call to Stop does any work.
+	stopOnce sync.Once
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A pending invalidation: of the inode's cached state if name is empty, and
+// otherwise of the entry for the named child of the inode.
+type request struct {
+	inode fuseops.InodeID
+	name  string
+}
+
+func (r request) String() string {
+	if r.name == "" {
+		return fmt.Sprintf("inode %v", r.inode)
+	}
+
+	return fmt.Sprintf("entry %q in inode %v", r.name, r.inode)
+}
+
+// LOCKS_REQUIRED(d.mu)
+func (d *dispatcher) checkInvariants() {
+	// INVARIANT: len(queue) <= capacity
+	if len(d.queue) > d.capacity {
+		panic(fmt.Sprintf("Queue overflow: %d > %d", len(d.queue), d.capacity))
+	}
+
+	// INVARIANT: Contains exactly the elements of queue
+	if len(d.pending) != len(d.queue) {
+		panic(fmt.Sprintf(
+			"Pending set size mismatch: %d vs. %d",
+			len(d.pending),
+			len(d.queue)))
+	}
+
+	for _, r := range d.queue {
+		if _, ok := d.pending[r]; !ok {
+			panic(fmt.Sprintf("Request for %v missing from pending set", r))
+		}
+	}
+}
+
+// Remove and return the next batch of pending invalidations. Return ok ==
+// false when there is nothing left to do and the dispatcher has been stopped.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *dispatcher) takeBatch() (batch []request, ok bool) {
+	for {
+		d.mu.Lock()
+		batch = d.queue
+		stopped := d.stopped
+
+		d.queue = nil
+		for _, r := range batch {
+			delete(d.pending, r)
+		}
+
+		d.mu.Unlock()
+
+		if len(batch) != 0 {
+			ok = true
+			return
+		}
+
+		if stopped {
+			return
+		}
+
+		<-d.wakeUp
+	}
+}
+
+// The body of the draining goroutine.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *dispatcher) drain() {
+	defer close(d.done)
+
+	for {
+		batch, ok := d.takeBatch()
+		if !ok {
+			return
+		}
+
+		for _, r := range batch {
+			atomic.AddUint64(&d.dispatched, 1)
+			if err := d.deliver(r); err != nil {
+				atomic.AddUint64(&d.failed, 1)
+				logger.Errorf("Error invalidating %v: %v", r, err)
+			}
+		}
+	}
+}
+
+func (d *dispatcher) deliver(r request) (err error) {
+	if r.name == "" {
+		err = d.invalidator.InvalidateInode(r.inode)
+		return
+	}
+
+	err = d.invalidator.(EntryInvalidator).InvalidateEntry(r.inode, r.name)
+	return
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *dispatcher) enqueue(r request) (queued bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Is there already a request pending for the same thing?
+	if _, ok := d.pending[r]; ok {
+		atomic.AddUint64(&d.coalesced, 1)
+		queued = true
+		return
+	}
+
+	// Are we unable to accept the request?
+	if d.stopped || len(d.queue) >= d.capacity {
+		atomic.AddUint64(&d.dropped, 1)
+		return
+	}
+
+	d.queue = append(d.queue, r)
+	d.pending[r] = struct{}{}
+	queued = true
+
+	// Poke the draining goroutine, unless it has already been poked.
+	select {
+	case d.wakeUp <- struct{}{}:
+	default:
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *dispatcher) Invalidate(id fuseops.InodeID) (queued bool) {
+	queued = d.enqueue(request{inode: id})
+	return
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *dispatcher) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (queued bool) {
+	r := request{inode: parent, name: name}
+	if _, ok := d.invalidator.(EntryInvalidator); !ok {
+		r.name = ""
+	}
+
+	queued = d.enqueue(r)
+	return
+}
+
+func (d *dispatcher) Stats() (s Stats) {
+	s = Stats{
+		Dispatched: atomic.LoadUint64(&d.dispatched),
+		Failed:     atomic.LoadUint64(&d.failed),
+		Coalesced:  atomic.LoadUint64(&d.coalesced),
+		Dropped:    atomic.LoadUint64(&d.dropped),
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *dispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		d.mu.Lock()
+		d.stopped = true
+		d.mu.Unlock()
+
+		select {
+		case d.wakeUp <- struct{}{}:
+		default:
+		}
+	})
+
+	<-d.done
+}
@@ -0,0 +1,297 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package invalidation_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/invalidation"
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestDispatcher(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// An invalidator that records the inodes it is asked to invalidate. If gate is
+// non-nil, each call blocks until it can receive from gate.
+type recordingInvalidator struct {
+	gate    chan struct{}
+	started chan fuseops.InodeID
+	err     error
+
+	mu  sync.Mutex
+	ids []fuseops.InodeID
+}
+
+func (ri *recordingInvalidator) InvalidateInode(
+	id fuseops.InodeID) (err error) {
+	if ri.started != nil {
+		ri.started <- id
+	}
+
+	if ri.gate != nil {
+		<-ri.gate
+	}
+
+	ri.mu.Lock()
+	ri.ids = append(ri.ids, id)
+	ri.mu.Unlock()
+
+	err = ri.err
+	return
+}
+
+func (ri *recordingInvalidator) IDs() (ids []fuseops.InodeID) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	ids = append(ids, ri.ids...)
+	return
+}
+
+// A recordingInvalidator that can also invalidate entries, which it records
+// as "parent/name" without blocking.
+type entryRecordingInvalidator struct {
+	recordingInvalidator
+
+	entriesMu sync.Mutex
+	entries   []string
+}
+
+func (ri *entryRecordingInvalidator) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	ri.entriesMu.Lock()
+	ri.entries = append(ri.entries, fmt.Sprintf("%v/%s", parent, name))
+	ri.entriesMu.Unlock()
+
+	return
+}
+
+func (ri *entryRecordingInvalidator) Entries() (entries []string) {
+	ri.entriesMu.Lock()
+	defer ri.entriesMu.Unlock()
+
+	entries = append(entries, ri.entries...)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const capacity = 4
+
+type DispatcherTest struct {
+	invalidator recordingInvalidator
+	d           invalidation.Dispatcher
+}
+
+var _ SetUpInterface = &DispatcherTest{}
+var _ TearDownInterface = &DispatcherTest{}
+
+func init() { RegisterTestSuite(&DispatcherTest{}) }
+
+func (t *DispatcherTest) SetUp(ti *TestInfo) {
+	// Start with the invalidator blocked on its first call, so that tests can
+	// control when draining happens.
+	t.invalidator.gate = make(chan struct{})
+	t.invalidator.started = make(chan fuseops.InodeID, 100)
+
+	t.d = invalidation.NewDispatcher(&t.invalidator, capacity)
+}
+
+func (t *DispatcherTest) TearDown() {
+	close(t.invalidator.gate)
+	t.d.Stop()
+}
+
+// Queue an invalidation for an inode that the test doesn't otherwise care
+// about, and wait for the draining goroutine to get stuck delivering it.
+func (t *DispatcherTest) plugDrain() {
+	const plugID = 1000
+	AssertTrue(t.d.Invalidate(plugID))
+	AssertEq(plugID, <-t.invalidator.started)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DispatcherTest) DeliversInOrder() {
+	t.plugDrain()
+
+	ExpectTrue(t.d.Invalidate(17))
+	ExpectTrue(t.d.Invalidate(19))
+	ExpectTrue(t.d.Invalidate(23))
+
+	// Unblock and shut down, which waits for everything to be delivered.
+	close(t.invalidator.gate)
+	t.d.Stop()
+	t.invalidator.gate = make(chan struct{})
+
+	ExpectThat(
+		t.invalidator.IDs(),
+		ElementsAre(1000, 17, 19, 23))
+
+	s := t.d.Stats()
+	ExpectEq(4, s.Dispatched)
+	ExpectEq(0, s.Coalesced)
+	ExpectEq(0, s.Dropped)
+	ExpectEq(0, s.Failed)
+}
+
+func (t *DispatcherTest) CoalescesPendingRequests() {
+	t.plugDrain()
+
+	ExpectTrue(t.d.Invalidate(17))
+	ExpectTrue(t.d.Invalidate(19))
+	ExpectTrue(t.d.Invalidate(17))
+	ExpectTrue(t.d.Invalidate(17))
+	ExpectTrue(t.d.Invalidate(19))
+
+	close(t.invalidator.gate)
+	t.d.Stop()
+	t.invalidator.gate = make(chan struct{})
+
+	ExpectThat(t.invalidator.IDs(), ElementsAre(1000, 17, 19))
+	ExpectEq(3, t.d.Stats().Coalesced)
+}
+
+func (t *DispatcherTest) RequestsDuringDeliveryAreNotCoalesced() {
+	// The plug inode is being delivered, not pending, so a new request for it
+	// must result in a second delivery.
+	t.plugDrain()
+	ExpectTrue(t.d.Invalidate(1000))
+
+	close(t.invalidator.gate)
+	t.d.Stop()
+	t.invalidator.gate = make(chan struct{})
+
+	ExpectThat(t.invalidator.IDs(), ElementsAre(1000, 1000))
+	ExpectEq(0, t.d.Stats().Coalesced)
+}
+
+func (t *DispatcherTest) DropsOnOverflow() {
+	t.plugDrain()
+
+	// Fill the queue.
+	for i := 0; i < capacity; i++ {
+		AssertTrue(t.d.Invalidate(fuseops.InodeID(i + 1)))
+	}
+
+	// Further distinct inodes should be dropped without blocking.
+	ExpectFalse(t.d.Invalidate(100))
+	ExpectFalse(t.d.Invalidate(101))
+
+	// But requests for inodes already pending are still coalesced.
+	ExpectTrue(t.d.Invalidate(1))
+
+	close(t.invalidator.gate)
+	t.d.Stop()
+	t.invalidator.gate = make(chan struct{})
+
+	ExpectThat(t.invalidator.IDs(), ElementsAre(1000, 1, 2, 3, 4))
+
+	s := t.d.Stats()
+	ExpectEq(2, s.Dropped)
+	ExpectEq(1, s.Coalesced)
+	ExpectEq(5, s.Dispatched)
+}
+
+func (t *DispatcherTest) StopDrainsPendingRequests() {
+	t.plugDrain()
+
+	ExpectTrue(t.d.Invalidate(17))
+	ExpectTrue(t.d.Invalidate(19))
+
+	// Stop in the background; it shouldn't return until the pending requests
+	// have been delivered.
+	stopped := make(chan struct{})
+	go func() {
+		t.d.Stop()
+		close(stopped)
+	}()
+
+	close(t.invalidator.gate)
+	<-stopped
+	t.invalidator.gate = make(chan struct{})
+
+	ExpectThat(t.invalidator.IDs(), ElementsAre(1000, 17, 19))
+}
+
+func (t *DispatcherTest) RequestsAfterStopAreDropped() {
+	close(t.invalidator.gate)
+	t.d.Stop()
+	t.invalidator.gate = make(chan struct{})
+
+	ExpectFalse(t.d.Invalidate(17))
+	ExpectEq(1, t.d.Stats().Dropped)
+	ExpectThat(t.invalidator.IDs(), ElementsAre())
+}
+
+func (t *DispatcherTest) InvalidatorErrorsAreCounted() {
+	t.invalidator.err = errors.New("taco")
+	t.plugDrain()
+
+	ExpectTrue(t.d.Invalidate(17))
+
+	close(t.invalidator.gate)
+	t.d.Stop()
+	t.invalidator.gate = make(chan struct{})
+
+	s := t.d.Stats()
+	ExpectEq(2, s.Dispatched)
+	ExpectEq(2, s.Failed)
+}
+
+func (t *DispatcherTest) EntriesFallBackToParentInode() {
+	t.plugDrain()
+
+	// The invalidator can't invalidate entries, so the parent is invalidated
+	// instead, coalescing with requests for the parent itself.
+	ExpectTrue(t.d.InvalidateEntry(17, "foo"))
+	ExpectTrue(t.d.Invalidate(17))
+	ExpectTrue(t.d.InvalidateEntry(17, "bar"))
+
+	close(t.invalidator.gate)
+	t.d.Stop()
+	t.invalidator.gate = make(chan struct{})
+
+	ExpectThat(t.invalidator.IDs(), ElementsAre(1000, 17))
+	ExpectEq(2, t.d.Stats().Coalesced)
+}
+
+func (t *DispatcherTest) DeliversEntries() {
+	invalidator := &entryRecordingInvalidator{}
+	d := invalidation.NewDispatcher(invalidator, capacity)
+
+	ExpectTrue(d.InvalidateEntry(17, "foo"))
+	ExpectTrue(d.InvalidateEntry(19, "bar"))
+	ExpectTrue(d.Invalidate(17))
+	d.Stop()
+
+	ExpectThat(invalidator.Entries(), ElementsAre("17/foo", "19/bar"))
+	ExpectThat(invalidator.IDs(), ElementsAre(17))
+	ExpectEq(3, d.Stats().Dispatched)
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/invalidation"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Something that can send invalidation messages to the kernel, such as a
+// *fuse.Connection.
+type kernelNotifier interface {
+	InvalidateNode(id fuseops.InodeID) (err error)
+	InvalidateEntry(parent fuseops.InodeID, name string) (err error)
+}
+
+// An invalidation.EntryInvalidator that sends FUSE notify messages over the
+// connection served by the server whose ServerConfig.Invalidator it is. Each
+// server needs its own. Invalidations requested before the server starts
+// serving fail.
+//
+// Safe for concurrent access.
+type KernelInvalidator struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	notifier kernelNotifier
+}
+
+var _ invalidation.EntryInvalidator = &KernelInvalidator{}
+
+var errNotServing = errors.New("The file system is not yet being served")
+
+// Create an invalidator for a server that has yet to be created.
+func NewKernelInvalidator() *KernelInvalidator {
+	return &KernelInvalidator{}
+}
+
+// Send later invalidations to the supplied notifier.
+func (ki *KernelInvalidator) attach(n kernelNotifier) {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+
+	ki.notifier = n
+}
+
+func (ki *KernelInvalidator) getNotifier() (n kernelNotifier, err error) {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+
+	n = ki.notifier
+	if n == nil {
+		err = errNotServing
+	}
+
+	return
+}
+
+func (ki *KernelInvalidator) InvalidateInode(id fuseops.InodeID) (err error) {
+	n, err := ki.getNotifier()
+	if err != nil {
+		return
+	}
+
+	err = n.InvalidateNode(id)
+	return
+}
+
+func (ki *KernelInvalidator) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	n, err := ki.getNotifier()
+	if err != nil {
+		return
+	}
+
+	err = n.InvalidateEntry(parent, name)
+	return
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestKernelInvalidator(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A kernelNotifier that records the messages it is asked to send, as the
+// kernel would receive them.
+type recordingNotifier struct {
+	mu      sync.Mutex
+	nodes   []fuseops.InodeID
+	entries []string
+}
+
+func (n *recordingNotifier) InvalidateNode(id fuseops.InodeID) (err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nodes = append(n.nodes, id)
+	return
+}
+
+func (n *recordingNotifier) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.entries = append(n.entries, name)
+	return
+}
+
+// The bucket starts out with a file "foo" containing "taco".
+type KernelInvalidatorTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	bucket   gcs.Bucket
+	kernel   *KernelInvalidator
+	notifier recordingNotifier
+	cfg      ServerConfig
+}
+
+func init() { RegisterTestSuite(&KernelInvalidatorTest{}) }
+
+func (t *KernelInvalidatorTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.kernel = NewKernelInvalidator()
+	t.cfg = ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		Invalidator:          t.kernel,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *KernelInvalidatorTest) FailsUntilServing() {
+	ExpectEq(errNotServing, t.kernel.InvalidateInode(17))
+	ExpectEq(errNotServing, t.kernel.InvalidateEntry(17, "foo"))
+
+	t.kernel.attach(&t.notifier)
+	ExpectEq(nil, t.kernel.InvalidateInode(17))
+	ExpectEq(nil, t.kernel.InvalidateEntry(17, "foo"))
+
+	ExpectThat(t.notifier.nodes, ElementsAre(17))
+	ExpectThat(t.notifier.entries, ElementsAre("foo"))
+}
+
+func (t *KernelInvalidatorTest) ServerAttachesItsInvalidator() {
+	server, err := NewServer(&t.cfg)
+	AssertEq(nil, err)
+
+	s := server.(*fsServer)
+	defer s.fs.Destroy()
+
+	ExpectEq(t.kernel, s.kernel)
+}
+
+func (t *KernelInvalidatorTest) StaleFileReachesKernel() {
+	fs, err := newFileSystem(&t.cfg)
+	AssertEq(nil, err)
+	defer fs.Destroy()
+
+	t.kernel.attach(&t.notifier)
+
+	// Look up and open the file, then overwrite it as another client would.
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	AssertEq(nil, fs.LookUpInode(lookUpOp))
+	id := lookUpOp.Entry.Child
+
+	AssertEq(nil, fs.OpenFile(&fuseops.OpenFileOp{Inode: id}))
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	// Opening it again should tell the kernel to drop what it has cached.
+	AssertEq(nil, fs.OpenFile(&fuseops.OpenFileOp{Inode: id}))
+	fs.invalidations.Stop()
+
+	t.notifier.mu.Lock()
+	defer t.notifier.mu.Unlock()
+
+	ExpectThat(t.notifier.nodes, ElementsAre(id))
+}
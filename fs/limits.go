@@ -0,0 +1,72 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Report the limits on the temporary directory in force, after changing them
+// with lease.FileLeaser.SetLimits if the request is a POST. The form values
+// "files" and "bytes" give new limits, each left alone if missing. Any read
+// leases that no longer fit have been revoked by the time we respond.
+func (fs *fileSystem) serveLimits(
+	w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Limits must be read with GET or set with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == "POST" {
+		s := fs.leaser.Stats()
+		numFiles := int64(s.LimitNumFiles)
+		bytes := s.LimitBytes
+
+		for _, f := range []struct {
+			name string
+			v    *int64
+		}{
+			{"files", &numFiles},
+			{"bytes", &bytes},
+		} {
+			str := r.FormValue(f.name)
+			if str == "" {
+				continue
+			}
+
+			n, err := strconv.ParseInt(str, 10, 0)
+			if err != nil || n <= 0 {
+				http.Error(
+					w,
+					fmt.Sprintf("Illegal %s limit: %q", f.name, str),
+					http.StatusBadRequest)
+				return
+			}
+
+			*f.v = n
+		}
+
+		fs.leaser.SetLimits(int(numFiles), bytes)
+	}
+
+	s := fs.leaser.Stats()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "files: %d\n", s.LimitNumFiles)
+	fmt.Fprintf(w, "bytes: %d\n", s.LimitBytes)
+}
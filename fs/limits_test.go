@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestLimits(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for the /limits debugging handler, driving the file system directly
+// through its op methods.
+type LimitsTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+	mux   *http.ServeMux
+	fs    *fileSystem
+}
+
+func init() { RegisterTestSuite(&LimitsTest{}) }
+
+func (t *LimitsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	bucket := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err = gcsutil.CreateObject(t.ctx, bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.mux = http.NewServeMux()
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		DebugMux:             t.mux,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *LimitsTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Make a request to the handler with the given method and form values,
+// returning the response.
+func (t *LimitsTest) do(
+	method string,
+	form url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/limits", strings.NewReader(form.Encode()))
+	AssertEq(nil, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	t.mux.ServeHTTP(w, req)
+
+	return w
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LimitsTest) Get() {
+	w := t.do("GET", nil)
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectEq("files: 16\nbytes: 4194304\n", w.Body.String())
+}
+
+func (t *LimitsTest) MethodNotAllowed() {
+	w := t.do("PUT", nil)
+
+	ExpectEq(http.StatusMethodNotAllowed, w.Code)
+	ExpectEq("GET, POST", w.Header().Get("Allow"))
+}
+
+func (t *LimitsTest) SetBoth() {
+	w := t.do("POST", url.Values{"files": {"3"}, "bytes": {"1024"}})
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectEq("files: 3\nbytes: 1024\n", w.Body.String())
+
+	s := t.fs.leaser.Stats()
+	ExpectEq(3, s.LimitNumFiles)
+	ExpectEq(1024, s.LimitBytes)
+}
+
+func (t *LimitsTest) SetOne() {
+	w := t.do("POST", url.Values{"bytes": {"1024"}})
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectEq("files: 16\nbytes: 1024\n", w.Body.String())
+}
+
+func (t *LimitsTest) IllegalValues() {
+	for _, v := range []string{"0", "-1", "taco", "1.5"} {
+		w := t.do("POST", url.Values{"files": {"3"}, "bytes": {v}})
+		ExpectEq(http.StatusBadRequest, w.Code, "value: %q", v)
+	}
+
+	// Nothing was changed.
+	ExpectEq("files: 16\nbytes: 4194304\n", t.do("GET", nil).Body.String())
+}
+
+func (t *LimitsTest) ShrinkingRevokesCachedContents() {
+	// Read foo, leaving its contents in the temporary directory.
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(lookUpOp))
+	id := lookUpOp.Entry.Child
+
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Size:   1 << 10,
+	}
+
+	AssertEq(nil, t.fs.ReadFile(readOp))
+	ExpectEq("taco", string(readOp.Data))
+	AssertEq(4, t.fs.leaser.Stats().Bytes)
+
+	// Release the handle, which would otherwise keep the contents pinned.
+	AssertEq(nil, t.fs.ReleaseFileHandle(
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle}))
+
+	// Once the limit is too small for them, they are gone by the time the
+	// handler responds.
+	w := t.do("POST", url.Values{"bytes": {"1"}})
+	AssertEq(http.StatusOK, w.Code)
+
+	ExpectEq(0, t.fs.leaser.Stats().Bytes)
+
+	// Given room again, the file can still be read.
+	w = t.do("POST", url.Values{"bytes": {"1024"}})
+	AssertEq(http.StatusOK, w.Code)
+
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	readOp.Handle = openOp.Handle
+	readOp.Data = nil
+	AssertEq(nil, t.fs.ReadFile(readOp))
+	ExpectEq("taco", string(readOp.Data))
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"net/http"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// A bucket for credentials that may read objects but not list them. GCS
+// won't tell such credentials whether an object exists, so statting a missing
+// object fails with HTTP 403 rather than 404. This bucket reports such
+// failures as *gcs.NotFoundError, so that looking up a missing name fails
+// with ENOENT rather than EIO.
+//
+// The cost is that credentials that may not even read objects make every
+// name appear to be missing, rather than unreadable.
+type listingDeniedBucket struct {
+	gcs.Bucket
+}
+
+func (b *listingDeniedBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if typed, ok := err.(*googleapi.Error); ok &&
+		typed.Code == http.StatusForbidden {
+		err = &gcs.NotFoundError{Err: err}
+	}
+
+	return
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that refuses to list objects, as GCS does for credentials that may
+// read objects but not list them. Like GCS, it refuses to say whether missing
+// objects exist, too.
+type listDeniedBucket struct {
+	gcs.Bucket
+
+	// The number of calls to ListObjects. Accessed atomically.
+	listCalls uint64
+}
+
+func (b *listDeniedBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	atomic.AddUint64(&b.listCalls, 1)
+	err = &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "Forbidden",
+	}
+
+	return
+}
+
+func (b *listDeniedBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = &googleapi.Error{
+			Code:    http.StatusForbidden,
+			Message: "Forbidden",
+		}
+	}
+
+	return
+}
+
+// Tests for ServerConfig.ListingDenied, driving the file system directly
+// through its op methods like HandlesTest.
+type ListingDeniedTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket listDeniedBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&ListingDeniedTest{}) }
+
+func (t *ListingDeniedTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create some contents, including a directory with no placeholder object.
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket.Bucket,
+		map[string]string{
+			"foo":          "taco",
+			"dir/":         "",
+			"dir/bar":      "burrito",
+			"implicit/baz": "enchilada",
+		})
+
+	AssertEq(nil, err)
+
+	t.createFileSystem(false)
+}
+
+func (t *ListingDeniedTest) TearDown() {
+	t.fs.Destroy()
+
+	// However the test went, we should never have tried to list.
+	ExpectEq(0, atomic.LoadUint64(&t.bucket.listCalls))
+}
+
+func (t *ListingDeniedTest) createFileSystem(eacces bool) {
+	var err error
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		ImplicitDirectories:  true,
+		ListingDenied:        true,
+		ListingDeniedEACCES:  eacces,
+	})
+
+	AssertEq(nil, err)
+}
+
+// Look up a child of the given directory inode.
+func (t *ListingDeniedTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (id fuseops.InodeID, err error) {
+	t.fs.mu.Lock()
+	in := t.fs.inodes[parent].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, in, name)
+	if err != nil {
+		return
+	}
+
+	id = child.ID()
+	child.Unlock()
+
+	return
+}
+
+// Open and read the whole of the given file inode.
+func (t *ListingDeniedTest) readFile(id fuseops.InodeID) (s string) {
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Size:   1 << 10,
+	}
+
+	AssertEq(nil, t.fs.ReadFile(readOp))
+	s = string(readOp.Data)
+
+	return
+}
+
+// Open the root directory and read it from the start.
+func (t *ListingDeniedTest) readRoot() (dh *dirHandle, err error) {
+	openOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	AssertEq(nil, t.fs.OpenDir(openOp))
+
+	t.fs.mu.Lock()
+	dh = t.fs.handles[openOp.Handle].(*dirHandle)
+	t.fs.mu.Unlock()
+
+	err = t.fs.ReadDir(&fuseops.ReadDirOp{
+		Inode:  fuseops.RootInodeID,
+		Handle: openOp.Handle,
+		Size:   1 << 12,
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ListingDeniedTest) FileByExactPath() {
+	foo, err := t.lookUp(fuseops.RootInodeID, "foo")
+	AssertEq(nil, err)
+
+	ExpectEq("taco", t.readFile(foo))
+}
+
+func (t *ListingDeniedTest) FileInPlaceholderDirectory() {
+	dir, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	bar, err := t.lookUp(dir, "bar")
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", t.readFile(bar))
+}
+
+func (t *ListingDeniedTest) ImplicitDirectoriesDisabled() {
+	ExpectFalse(t.fs.implicitDirs)
+
+	_, err := t.lookUp(fuseops.RootInodeID, "implicit")
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *ListingDeniedTest) UnknownName() {
+	_, err := t.lookUp(fuseops.RootInodeID, "taco")
+	ExpectEq(fuse.ENOENT, err)
+
+	dir, err := t.lookUp(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	_, err = t.lookUp(dir, "taco")
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *ListingDeniedTest) ReadDir_Notice() {
+	// Read several times, as a directory-walking program might.
+	for i := 0; i < 3; i++ {
+		dh, err := t.readRoot()
+		AssertEq(nil, err)
+
+		dh.Mu.Lock()
+		AssertEq(1, len(dh.entries))
+		ExpectEq(ListingDeniedEntryName, dh.entries[0].Name)
+		dh.Mu.Unlock()
+	}
+
+	// The notice isn't a real file.
+	_, err := t.lookUp(fuseops.RootInodeID, ListingDeniedEntryName)
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *ListingDeniedTest) ReadDir_EACCES() {
+	t.createFileSystem(true)
+
+	for i := 0; i < 3; i++ {
+		_, err := t.readRoot()
+		ExpectEq(errListingDenied, err)
+	}
+
+	// Exact paths still work.
+	foo, err := t.lookUp(fuseops.RootInodeID, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", t.readFile(foo))
+}
@@ -1702,11 +1702,15 @@ func (t *FileTest) Chtimes() {
 	err = ioutil.WriteFile(fileName, []byte(""), 0700)
 	AssertEq(nil, err)
 
-	// Attempt to change its atime and mtime. We don't support doing so.
-	err = os.Chtimes(fileName, time.Now(), time.Now())
+	// Change its atime and mtime.
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.Local)
+	err = os.Chtimes(fileName, time.Now(), mtime)
+	AssertEq(nil, err)
 
-	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("not implemented")))
+	// The mtime should be reflected by stat.
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+	ExpectThat(fi.ModTime(), timeutil.TimeEq(mtime))
 }
 
 func (t *FileTest) Sync_Dirty() {
@@ -1780,10 +1784,18 @@ func (t *FileTest) Sync_Clobbered() {
 		"foo",
 		"foobar")
 
-	// Sync the file. This should not result in an error, but the new generation
-	// should not be replaced.
+	// Sync the file. This should fail, and the new generation should not be
+	// replaced.
 	err = t.f1.Sync()
-	AssertEq(nil, err)
+	ExpectThat(err, Error(HasSubstr("stale")))
+
+	// Further writes should fail straight away, as should closing.
+	_, err = t.f1.Write([]byte("burrito"))
+	ExpectThat(err, Error(HasSubstr("stale")))
+
+	err = t.f1.Close()
+	t.f1 = nil
+	ExpectThat(err, Error(HasSubstr("stale")))
 
 	// Check that the new generation was not replaced.
 	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
@@ -1863,11 +1875,11 @@ func (t *FileTest) Close_Clobbered() {
 		"foo",
 		"foobar")
 
-	// Close the file. This should not result in an error, but the new generation
-	// should not be replaced.
+	// Close the file. This should fail, and the new generation should not be
+	// replaced.
 	err = t.f1.Close()
 	t.f1 = nil
-	AssertEq(nil, err)
+	ExpectThat(err, Error(HasSubstr("stale")))
 
 	// Check that the new generation was not replaced.
 	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
@@ -2005,11 +2017,11 @@ func (t *RenameTest) Directory() {
 	err = os.Mkdir(oldPath, 0700)
 	AssertEq(nil, err)
 
-	// Attempt to rename it.
+	// Attempt to rename it. Directory renames are disabled by default.
 	newPath := path.Join(t.Dir, "bar")
 
 	err = os.Rename(oldPath, newPath)
-	ExpectThat(err, Error(HasSubstr("not implemented")))
+	ExpectThat(err, Error(HasSubstr("cross-device")))
 }
 
 func (t *RenameTest) WithinDir() {
@@ -2206,3 +2218,95 @@ func (t *RenameTest) NonExistentFile() {
 	err = os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
 	ExpectThat(err, Error(HasSubstr("no such file")))
 }
+
+////////////////////////////////////////////////////////////////////////
+// Sparse writes
+////////////////////////////////////////////////////////////////////////
+
+type SparseWritesTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&SparseWritesTest{}) }
+
+func (t *SparseWritesTest) SetUp(ti *TestInfo) {
+	t.serverCfg.RejectSparseWritesOver = 1 << 20
+	t.fsTest.SetUp(ti)
+}
+
+func (t *SparseWritesTest) PastMaxObjectSize() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	// Writing or truncating beyond the largest object GCS will accept should
+	// fail up front.
+	_, err = t.f1.WriteAt([]byte("a"), 5<<40)
+	ExpectThat(err, Error(HasSubstr("too large")))
+
+	err = t.f1.Truncate(5<<40 + 1)
+	ExpectThat(err, Error(HasSubstr("too large")))
+}
+
+func (t *SparseWritesTest) SmallHole() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	// A hole up to the limit is fine.
+	_, err = t.f1.WriteAt([]byte("taco"), 1<<20)
+	AssertEq(nil, err)
+
+	fi, err := t.f1.Stat()
+	AssertEq(nil, err)
+	ExpectEq(1<<20+4, fi.Size())
+}
+
+func (t *SparseWritesTest) LargeHole() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// A write leaving a larger hole should be rejected, leaving the file alone.
+	_, err = t.f1.WriteAt([]byte("a"), 4+1<<20+1)
+	ExpectThat(err, Error(HasSubstr("too large")))
+
+	err = t.f1.Sync()
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *SparseWritesTest) TruncateExtends() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// Extending by up to the limit is fine.
+	err = t.f1.Truncate(4 + 1<<20)
+	AssertEq(nil, err)
+
+	// Extending by more should be rejected, leaving the file alone.
+	err = t.f1.Truncate(4 + 2<<20 + 1)
+	ExpectThat(err, Error(HasSubstr("too large")))
+
+	fi, err := t.f1.Stat()
+	AssertEq(nil, err)
+	ExpectEq(4+1<<20, fi.Size())
+
+	// Shrinking is always fine.
+	err = t.f1.Truncate(2)
+	AssertEq(nil, err)
+}
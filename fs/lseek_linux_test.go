@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for lseek(2) with SEEK_DATA and SEEK_HOLE on a mounted file system.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+type LseekTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&LseekTest{}) }
+
+func (t *LseekTest) seek(offset int64, whence int) (n int64, err error) {
+	n, err = syscall.Seek(int(t.f1.Fd()), offset, whence)
+	return
+}
+
+func (t *LseekTest) CleanFile() {
+	var n int64
+	var err error
+
+	// Create an object and open it without modifying it.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.f1, err = os.Open(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	// The whole thing is data.
+	n, err = t.seek(1, seekData)
+	AssertEq(nil, err)
+	ExpectEq(1, n)
+
+	n, err = t.seek(0, seekHole)
+	AssertEq(nil, err)
+	ExpectEq(4, n)
+
+	_, err = t.seek(4, seekData)
+	ExpectEq(syscall.ENXIO, err)
+}
+
+func (t *LseekTest) SparseDirtyFile() {
+	const offset = 1 << 22
+
+	var n int64
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	// Write at the start, and far beyond it.
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = t.f1.WriteAt([]byte("burrito"), offset)
+	AssertEq(nil, err)
+
+	// The hole in between should be visible, though the temporary file's file
+	// system may round the extents to blocks.
+	n, err = t.seek(0, seekHole)
+	AssertEq(nil, err)
+	ExpectGe(n, 4)
+	ExpectLt(n, offset)
+
+	n, err = t.seek(n, seekData)
+	AssertEq(nil, err)
+	ExpectGt(n, 4)
+	ExpectLe(n, offset)
+
+	// There is an implicit hole at the end.
+	n, err = t.seek(offset, seekHole)
+	AssertEq(nil, err)
+	ExpectEq(offset+len("burrito"), n)
+
+	_, err = t.seek(offset+int64(len("burrito")), seekData)
+	ExpectEq(syscall.ENXIO, err)
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestMaxCachedFileSize(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Files are read four bytes at a time, and no more than eight bytes of any one
+// file are kept. The bucket contains "small", which fits, and "big", which is
+// three chunks long.
+type MaxCachedFileSizeTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+	fs    *fileSystem
+}
+
+func init() { RegisterTestSuite(&MaxCachedFileSizeTest{}) }
+
+func (t *MaxCachedFileSizeTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	bucket := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		bucket,
+		map[string]string{
+			"small": "taco",
+			"big":   "burritoenchi",
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                    &t.clock,
+		Bucket:                   bucket,
+		TempDirLimitNumFiles:     16,
+		TempDirLimitBytes:        1 << 22,
+		TempDirLimitBytesPerFile: 8,
+		GCSChunkSize:             4,
+		TmpObjectPrefix:          ".gcsfuse_tmp/",
+		FilePerms:                0644,
+		DirPerms:                 0755,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *MaxCachedFileSizeTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up, open, and read the whole of a child of the root, a chunk at a time.
+func (t *MaxCachedFileSizeTest) read(name string) (contents string) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	openOp := &fuseops.OpenFileOp{Inode: child.ID()}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	for {
+		op := &fuseops.ReadFileOp{
+			Inode:  child.ID(),
+			Handle: openOp.Handle,
+			Offset: int64(len(contents)),
+			Size:   4,
+		}
+
+		AssertEq(nil, t.fs.ReadFile(op))
+		if len(op.Data) == 0 {
+			return
+		}
+
+		contents += string(op.Data)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MaxCachedFileSizeTest) ChunksOfOneFileShareLimit() {
+	ExpectEq("taco", t.read("small"))
+	ExpectEq("burritoenchi", t.read("big"))
+
+	// Only the last two chunks of the big file are kept, alongside the small
+	// file.
+	files, bytes := t.fs.leaser.Usage()
+	ExpectEq(3, files)
+	ExpectEq(4+8, bytes)
+}
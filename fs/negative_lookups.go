@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+)
+
+// Names recently looked up and found not to exist, so that looking them up
+// again within ServerConfig.NegativeTTL doesn't cost any requests to GCS. This
+// is common in builds, where compilers probe many paths for each header.
+//
+// Names are erased when created locally (including by renaming something to
+// them) or seen in a fresh listing of their directory. Creations by other
+// clients go unseen until the entry expires.
+//
+// As with dirListings, a miss is only recorded if nothing was erased while it
+// was being looked up, since the lookup may predate the creation.
+//
+// A nil *negativeLookups records nothing, and is used when the TTL is zero.
+// Safe for concurrent access.
+type negativeLookups struct {
+	clock    timeutil.Clock
+	ttl      time.Duration
+	counters *Counters
+
+	mu sync.Mutex
+
+	// A cache mapping the full names of missing children (e.g. "foo/bar") to
+	// the time at which the entry should expire.
+	//
+	// INVARIANT: missing.CheckInvariants() does not panic
+	// INVARIANT: Each value is of type time.Time
+	//
+	// GUARDED_BY(mu)
+	missing lrucache.Cache
+
+	// Incremented each time names are erased.
+	//
+	// GUARDED_BY(mu)
+	epoch uint64
+}
+
+// The number of names remembered at once, beyond which the least recently
+// used are forgotten.
+const negativeLookupsCapacity = 1 << 16
+
+func newNegativeLookups(
+	clock timeutil.Clock,
+	ttl time.Duration,
+	counters *Counters) (nl *negativeLookups) {
+	nl = &negativeLookups{
+		clock:    clock,
+		ttl:      ttl,
+		counters: counters,
+		missing:  lrucache.New(negativeLookupsCapacity),
+	}
+
+	return
+}
+
+// Return a token to pass to Insert with the result of a lookup started after
+// this call.
+func (nl *negativeLookups) Begin() (epoch uint64) {
+	if nl == nil {
+		return
+	}
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	epoch = nl.epoch
+	return
+}
+
+// Record that the named child doesn't exist, unless names have been erased
+// since the call to Begin that returned epoch. Return the time until which
+// the kernel may remember the same, or the zero time if it may not.
+func (nl *negativeLookups) Insert(
+	name string,
+	epoch uint64) (expiration time.Time) {
+	if nl == nil {
+		return
+	}
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	if epoch != nl.epoch {
+		return
+	}
+
+	expiration = nl.clock.Now().Add(nl.ttl)
+	nl.missing.Insert(name, expiration)
+
+	return
+}
+
+// If the named child is recorded as not existing, return the time until which
+// that holds. Otherwise return the zero time.
+func (nl *negativeLookups) Missing(name string) (expiration time.Time) {
+	if nl == nil {
+		return
+	}
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	val := nl.missing.LookUp(name)
+	if val == nil {
+		return
+	}
+
+	// Has the entry expired?
+	if !nl.clock.Now().Before(val.(time.Time)) {
+		nl.missing.Erase(name)
+		return
+	}
+
+	nl.counters.recordNegativeLookupHit()
+	expiration = val.(time.Time)
+	return
+}
+
+// Forget the supplied children, which may now exist.
+func (nl *negativeLookups) Erase(names ...string) {
+	if nl == nil {
+		return
+	}
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	nl.epoch++
+	for _, name := range names {
+		nl.missing.Erase(name)
+	}
+}
+
+// Forget everything, for changes such as directory renames that may create
+// any number of names.
+func (nl *negativeLookups) EraseAll() {
+	if nl == nil {
+		return
+	}
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	nl.epoch++
+	nl.missing = lrucache.New(negativeLookupsCapacity)
+}
@@ -0,0 +1,333 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestNegativeLookups(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the stats made through it.
+type countingStatsBucket struct {
+	gcs.Bucket
+
+	// The number of calls to StatObject. Accessed atomically.
+	statCalls uint64
+}
+
+func (b *countingStatsBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	atomic.AddUint64(&b.statCalls, 1)
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+// Tests for ServerConfig.NegativeTTL, with a TTL of negativeLookupsTestTTL
+// unless a test says otherwise. The bucket starts out with a directory "dir".
+type NegativeLookupsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket countingStatsBucket
+	fs     *fileSystem
+}
+
+const negativeLookupsTestTTL = 5 * time.Second
+
+func init() { RegisterTestSuite(&NegativeLookupsTest{}) }
+
+func (t *NegativeLookupsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "dir/", "")
+	AssertEq(nil, err)
+
+	t.mount(negativeLookupsTestTTL)
+}
+
+func (t *NegativeLookupsTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Create the file system afresh, with the supplied TTL.
+func (t *NegativeLookupsTest) mount(ttl time.Duration) {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		NegativeTTL:          ttl,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *NegativeLookupsTest) statCalls() uint64 {
+	return atomic.LoadUint64(&t.bucket.statCalls)
+}
+
+// Look up the named child of the root, returning the resulting entry.
+func (t *NegativeLookupsTest) lookUp(
+	name string) (entry fuseops.ChildInodeEntry, err error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	err = t.fs.LookUpInode(op)
+	entry = op.Entry
+	return
+}
+
+// Look up each of the supplied names the given number of times, as a build
+// probing include paths would, and return the number of stats it cost. Each
+// lookup must find nothing, either cacheably or with ENOENT.
+func (t *NegativeLookupsTest) probe(names []string, rounds int) uint64 {
+	before := t.statCalls()
+	for i := 0; i < rounds; i++ {
+		for _, name := range names {
+			entry, err := t.lookUp(name)
+			if err == fuse.ENOENT {
+				continue
+			}
+
+			AssertEq(nil, err, "name: %s", name)
+			AssertEq(0, entry.Child, "name: %s", name)
+		}
+	}
+
+	return t.statCalls() - before
+}
+
+// Look up the named child of the root, expecting it to exist.
+func (t *NegativeLookupsTest) expectExists(name string) {
+	entry, err := t.lookUp(name)
+	AssertEq(nil, err)
+	ExpectNe(0, entry.Child)
+}
+
+func (t *NegativeLookupsTest) createRemotely(name string) {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, name, "")
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *NegativeLookupsTest) KernelToldToCache() {
+	entry, err := t.lookUp("foo")
+
+	AssertEq(nil, err)
+	ExpectEq(0, entry.Child)
+	ExpectThat(
+		entry.EntryExpiration,
+		timeutil.TimeEq(t.clock.Now().Add(negativeLookupsTestTTL)))
+
+	// A lookup answered from the cache tells the kernel the same expiration.
+	t.clock.AdvanceTime(time.Second)
+
+	entry, err = t.lookUp("foo")
+
+	AssertEq(nil, err)
+	ExpectEq(0, entry.Child)
+	ExpectThat(
+		entry.EntryExpiration,
+		timeutil.TimeEq(t.clock.Now().Add(negativeLookupsTestTTL-time.Second)))
+}
+
+func (t *NegativeLookupsTest) StatsSaved() {
+	// Ten missing names, each probed ten times.
+	var names []string
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("missing%d", i))
+	}
+
+	cached := t.probe(names, 10)
+
+	t.mount(0)
+	uncached := t.probe(names, 10)
+
+	// Without the cache, every lookup stats both the file and directory
+	// objects. With it, only the first lookup of each name does, a tenfold
+	// reduction.
+	ExpectEq(2*10*10, uncached)
+	ExpectEq(2*10, cached)
+}
+
+func (t *NegativeLookupsTest) Disabled() {
+	t.mount(0)
+
+	_, err := t.lookUp("foo")
+	ExpectEq(fuse.ENOENT, err)
+
+	t.createRemotely("foo")
+	t.expectExists("foo")
+}
+
+func (t *NegativeLookupsTest) Expires() {
+	t.probe([]string{"foo"}, 1)
+	t.createRemotely("foo")
+
+	// Remote creations go unseen until the entry expires.
+	t.probe([]string{"foo"}, 1)
+
+	t.clock.AdvanceTime(negativeLookupsTestTTL)
+	t.expectExists("foo")
+}
+
+func (t *NegativeLookupsTest) LocalCreations() {
+	names := []string{"file", "subdir", "link"}
+	t.probe(names, 1)
+
+	createOp := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "file",
+		Mode:   0600,
+	}
+
+	AssertEq(nil, t.fs.CreateFile(createOp))
+
+	err := t.fs.MkDir(&fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "subdir",
+		Mode:   0700,
+	})
+
+	AssertEq(nil, err)
+
+	err = t.fs.CreateSymlink(&fuseops.CreateSymlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "link",
+		Target: "dir",
+	})
+
+	AssertEq(nil, err)
+
+	for _, name := range names {
+		t.expectExists(name)
+	}
+}
+
+func (t *NegativeLookupsTest) LocalRename() {
+	t.probe([]string{"foo", "bar"}, 1)
+
+	createOp := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Mode:   0600,
+	}
+
+	AssertEq(nil, t.fs.CreateFile(createOp))
+
+	err := t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "bar",
+	})
+
+	AssertEq(nil, err)
+	t.expectExists("bar")
+}
+
+func (t *NegativeLookupsTest) FreshListing() {
+	t.probe([]string{"foo"}, 1)
+	t.createRemotely("foo")
+
+	// Listing the directory shows that the name now exists.
+	openOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	AssertEq(nil, t.fs.OpenDir(openOp))
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  fuseops.RootInodeID,
+		Handle: openOp.Handle,
+		Size:   1 << 16,
+	}
+
+	AssertEq(nil, t.fs.ReadDir(readOp))
+
+	names, _ := parseDirents(readOp.Data)
+	AssertThat(names, Contains("foo"))
+
+	t.expectExists("foo")
+}
+
+func (t *NegativeLookupsTest) NamesArePerDirectory() {
+	t.probe([]string{"foo"}, 1)
+
+	// A miss in the root says nothing about dir.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "dir/foo", "")
+	AssertEq(nil, err)
+
+	dirEntry, err := t.lookUp("dir")
+	AssertEq(nil, err)
+
+	op := &fuseops.LookUpInodeOp{
+		Parent: dirEntry.Child,
+		Name:   "foo",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(op))
+	ExpectNe(0, op.Entry.Child)
+}
+
+func (t *NegativeLookupsTest) ChangeDuringLookupNotStored() {
+	nl := newNegativeLookups(&t.clock, negativeLookupsTestTTL, new(Counters))
+
+	// A miss that may predate a creation isn't kept.
+	epoch := nl.Begin()
+	nl.Erase("bar")
+
+	ExpectTrue(nl.Insert("foo", epoch).IsZero())
+	ExpectTrue(nl.Missing("foo").IsZero())
+
+	// But one made afterward is.
+	epoch = nl.Begin()
+
+	ExpectFalse(nl.Insert("foo", epoch).IsZero())
+	ExpectFalse(nl.Missing("foo").IsZero())
+
+	// Until everything is forgotten.
+	nl.EraseAll()
+	ExpectTrue(nl.Missing("foo").IsZero())
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notification parses feeds of events describing changes made to
+// objects by other clients, such as those published by GCS to Cloud Pub/Sub,
+// and decides which of them tell us something new.
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The kinds of change described by an event, named as in GCS's Pub/Sub
+// notifications.
+const (
+	// A new generation of the object was created.
+	ObjectFinalize = "OBJECT_FINALIZE"
+
+	// The metadata of an existing generation was changed.
+	ObjectMetadataUpdate = "OBJECT_METADATA_UPDATE"
+
+	// The generation was deleted.
+	ObjectDelete = "OBJECT_DELETE"
+
+	// The generation stopped being the live version of the object, in a bucket
+	// with versioning enabled.
+	ObjectArchive = "OBJECT_ARCHIVE"
+)
+
+// A change to a particular generation of an object.
+type Event struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	EventType  string `json:"eventType"`
+}
+
+// Return the order in which changes of the given type happen to a single
+// generation, or -1 if the type is unknown.
+func rank(eventType string) int {
+	switch eventType {
+	case ObjectFinalize:
+		return 0
+
+	case ObjectMetadataUpdate:
+		return 1
+
+	case ObjectDelete, ObjectArchive:
+		return 2
+	}
+
+	return -1
+}
+
+// Return an error if the event is missing information we need.
+func (e Event) validate() (err error) {
+	if e.Name == "" {
+		err = fmt.Errorf("Missing name")
+		return
+	}
+
+	if e.Generation <= 0 {
+		err = fmt.Errorf("Invalid generation for %q: %d", e.Name, e.Generation)
+		return
+	}
+
+	if rank(e.EventType) < 0 {
+		err = fmt.Errorf("Unknown event type for %q: %q", e.Name, e.EventType)
+		return
+	}
+
+	return
+}
+
+// Does e describe a change to the object later than the one described by
+// prev? Changes to newer generations are later, as are deletions of the same
+// generation after its creation or metadata updates. Because events don't say
+// which metadata generation they concern, a metadata update is considered
+// later than another for the same generation.
+//
+// REQUIRES: e.Name == prev.Name
+func (e Event) Supersedes(prev Event) bool {
+	if e.Generation != prev.Generation {
+		return e.Generation > prev.Generation
+	}
+
+	r := rank(e.EventType)
+	prevRank := rank(prev.EventType)
+	if r == prevRank {
+		return e.EventType == ObjectMetadataUpdate
+	}
+
+	return r > prevRank
+}
+
+// Read a sequence of JSON-encoded events, each of the form
+//
+//	{"name": "foo/bar", "generation": 1234, "eventType": "OBJECT_FINALIZE"}
+//
+// separated by optional whitespace, until EOF. An error is returned if any
+// event is malformed, in which case none are returned.
+func ParseEvents(r io.Reader) (events []Event, err error) {
+	d := json.NewDecoder(r)
+	for {
+		var e Event
+		err = d.Decode(&e)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Decode event %d: %v", len(events), err)
+			return
+		}
+
+		err = e.validate()
+		if err != nil {
+			err = fmt.Errorf("Event %d: %v", len(events), err)
+			return
+		}
+
+		events = append(events, e)
+	}
+
+	return
+}
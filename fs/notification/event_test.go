@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notification_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/notification"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestEvent(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type EventTest struct {
+}
+
+func init() { RegisterTestSuite(&EventTest{}) }
+
+func event(
+	name string,
+	generation int64,
+	eventType string) notification.Event {
+	return notification.Event{
+		Name:       name,
+		Generation: generation,
+		EventType:  eventType,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *EventTest) ParseNothing() {
+	events, err := notification.ParseEvents(strings.NewReader(" \n"))
+
+	AssertEq(nil, err)
+	ExpectEq(0, len(events))
+}
+
+func (t *EventTest) ParseSeveral() {
+	const input = `
+{"name": "foo", "generation": 17, "eventType": "OBJECT_FINALIZE"}
+{"name": "bar/", "generation": 19, "eventType": "OBJECT_DELETE"}
+{"eventType": "OBJECT_METADATA_UPDATE", "name": "baz", "generation": 23,
+ "bucket": "ignored"}`
+
+	events, err := notification.ParseEvents(strings.NewReader(input))
+
+	AssertEq(nil, err)
+	ExpectThat(
+		events,
+		ElementsAre(
+			DeepEquals(event("foo", 17, notification.ObjectFinalize)),
+			DeepEquals(event("bar/", 19, notification.ObjectDelete)),
+			DeepEquals(event("baz", 23, notification.ObjectMetadataUpdate)),
+		))
+}
+
+func (t *EventTest) ParseMalformedJSON() {
+	const input = `{"name": "foo", "generation": 17, "eventType": "OBJECT_FINALIZE"}
+{"name": "bar", `
+
+	_, err := notification.ParseEvents(strings.NewReader(input))
+	ExpectThat(err, Error(HasSubstr("event 1")))
+}
+
+func (t *EventTest) ParseMissingName() {
+	const input = `{"generation": 17, "eventType": "OBJECT_FINALIZE"}`
+
+	_, err := notification.ParseEvents(strings.NewReader(input))
+	ExpectThat(err, Error(HasSubstr("Missing name")))
+}
+
+func (t *EventTest) ParseMissingGeneration() {
+	const input = `{"name": "foo", "eventType": "OBJECT_FINALIZE"}`
+
+	_, err := notification.ParseEvents(strings.NewReader(input))
+	ExpectThat(err, Error(HasSubstr("generation")))
+}
+
+func (t *EventTest) ParseUnknownEventType() {
+	const input = `{"name": "foo", "generation": 17, "eventType": "taco"}`
+
+	_, err := notification.ParseEvents(strings.NewReader(input))
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *EventTest) SupersedesByGeneration() {
+	older := event("foo", 17, notification.ObjectDelete)
+	newer := event("foo", 19, notification.ObjectFinalize)
+
+	ExpectTrue(newer.Supersedes(older))
+	ExpectFalse(older.Supersedes(newer))
+}
+
+func (t *EventTest) SupersedesWithinGeneration() {
+	finalize := event("foo", 17, notification.ObjectFinalize)
+	update := event("foo", 17, notification.ObjectMetadataUpdate)
+	del := event("foo", 17, notification.ObjectDelete)
+	archive := event("foo", 17, notification.ObjectArchive)
+
+	ExpectTrue(update.Supersedes(finalize))
+	ExpectTrue(del.Supersedes(finalize))
+	ExpectTrue(del.Supersedes(update))
+	ExpectTrue(archive.Supersedes(update))
+
+	ExpectFalse(finalize.Supersedes(update))
+	ExpectFalse(update.Supersedes(del))
+	ExpectFalse(finalize.Supersedes(archive))
+}
+
+func (t *EventTest) Duplicates() {
+	finalize := event("foo", 17, notification.ObjectFinalize)
+	update := event("foo", 17, notification.ObjectMetadataUpdate)
+	del := event("foo", 17, notification.ObjectDelete)
+	archive := event("foo", 17, notification.ObjectArchive)
+
+	ExpectFalse(finalize.Supersedes(finalize))
+	ExpectFalse(del.Supersedes(del))
+	ExpectFalse(del.Supersedes(archive))
+
+	// We can't tell metadata updates apart.
+	ExpectTrue(update.Supersedes(update))
+}
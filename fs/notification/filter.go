@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notification
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jacobsa/util/lrucache"
+)
+
+// A filter that passes only events describing changes later than any already
+// seen for the same object, dropping duplicates and events delivered out of
+// order. Safe for concurrent access.
+//
+// Only a bounded number of objects are remembered; an event for one that has
+// been forgotten is passed unless it is older than the generation supplied by
+// the caller.
+type Filter struct {
+	mu sync.Mutex
+
+	// The latest event passed for each recently seen object name.
+	//
+	// GUARDED_BY(mu)
+	latest lrucache.Cache
+}
+
+// Create a filter that remembers the latest event for at most capacity
+// objects.
+//
+// REQUIRES: capacity > 0
+func NewFilter(capacity int) (f *Filter) {
+	if capacity <= 0 {
+		panic(fmt.Sprintf("Illegal capacity: %d", capacity))
+	}
+
+	f = &Filter{
+		latest: lrucache.New(capacity),
+	}
+
+	return
+}
+
+// Decide whether to act on the supplied event, recording it if so. If known
+// is non-zero, it is a generation of the object that the caller already
+// knows of, e.g. by having statted it, and events for older generations or
+// for the creation of that generation are dropped.
+func (f *Filter) Admit(e Event, known int64) bool {
+	if known != 0 {
+		knownEvent := Event{
+			Name:       e.Name,
+			Generation: known,
+			EventType:  ObjectFinalize,
+		}
+
+		if !e.Supersedes(knownEvent) {
+			return false
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if prev, ok := f.latest.LookUp(e.Name).(Event); ok && !e.Supersedes(prev) {
+		return false
+	}
+
+	f.latest.Insert(e.Name, e)
+	return true
+}
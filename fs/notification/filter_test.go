@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notification_test
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/notification"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFilter(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const filterCapacity = 2
+
+type FilterTest struct {
+	f *notification.Filter
+}
+
+func init() { RegisterTestSuite(&FilterTest{}) }
+
+func (t *FilterTest) SetUp(ti *TestInfo) {
+	t.f = notification.NewFilter(filterCapacity)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FilterTest) FirstEventAdmitted() {
+	ExpectTrue(t.f.Admit(event("foo", 17, notification.ObjectFinalize), 0))
+}
+
+func (t *FilterTest) DuplicateDropped() {
+	e := event("foo", 17, notification.ObjectFinalize)
+
+	AssertTrue(t.f.Admit(e, 0))
+	ExpectFalse(t.f.Admit(e, 0))
+}
+
+func (t *FilterTest) OutOfOrderDropped() {
+	AssertTrue(t.f.Admit(event("foo", 19, notification.ObjectFinalize), 0))
+
+	// The deletion of the overwritten generation arrives late.
+	ExpectFalse(t.f.Admit(event("foo", 17, notification.ObjectDelete), 0))
+	ExpectFalse(t.f.Admit(event("foo", 17, notification.ObjectFinalize), 0))
+
+	// Later changes still get through.
+	ExpectTrue(t.f.Admit(event("foo", 19, notification.ObjectDelete), 0))
+	ExpectFalse(t.f.Admit(event("foo", 19, notification.ObjectFinalize), 0))
+	ExpectTrue(t.f.Admit(event("foo", 23, notification.ObjectFinalize), 0))
+}
+
+func (t *FilterTest) NamesIndependent() {
+	AssertTrue(t.f.Admit(event("foo", 19, notification.ObjectFinalize), 0))
+	ExpectTrue(t.f.Admit(event("bar", 17, notification.ObjectFinalize), 0))
+	ExpectTrue(t.f.Admit(event("foo/", 17, notification.ObjectFinalize), 0))
+}
+
+func (t *FilterTest) KnownGeneration() {
+	const known = 19
+
+	// Events about what we already know, or older, are dropped.
+	ExpectFalse(t.f.Admit(event("foo", 17, notification.ObjectDelete), known))
+	ExpectFalse(t.f.Admit(event("foo", 19, notification.ObjectFinalize), known))
+
+	// Changes to it or to newer generations aren't.
+	update := event("foo", 19, notification.ObjectMetadataUpdate)
+	ExpectTrue(t.f.Admit(update, known))
+	ExpectTrue(t.f.Admit(event("foo", 23, notification.ObjectFinalize), known))
+}
+
+func (t *FilterTest) ForgottenNamesAdmitted() {
+	AssertTrue(t.f.Admit(event("foo", 19, notification.ObjectFinalize), 0))
+
+	// Push foo out of the filter's memory.
+	for _, name := range []string{"bar", "baz"} {
+		AssertTrue(t.f.Admit(event(name, 1, notification.ObjectFinalize), 0))
+	}
+
+	// A stale event for it now gets through, unless the caller knows better.
+	ExpectFalse(t.f.Admit(event("foo", 17, notification.ObjectFinalize), 19))
+	ExpectTrue(t.f.Admit(event("foo", 17, notification.ObjectFinalize), 0))
+}
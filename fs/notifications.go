@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/fs/notification"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+)
+
+// The number of objects for which the latest notification is remembered, in
+// order to recognize duplicates and notifications delivered out of order.
+const notificationFilterCapacity = 1 << 14
+
+// Throw away what is cached about the object named by the supplied
+// notification and about its parent directory, unless the notification is a
+// duplicate or tells us nothing newer than we already know. Return true if
+// the notification was acted upon.
+//
+// Specifically, we forget the entries for the object and its parent in caches
+// within the bucket (via ServerConfig.ForgetObject), the types recorded for
+// them by the directory inodes containing them, the listings of those
+// directories (see ServerConfig.DirCacheTTL), any record that they don't
+// exist (see ServerConfig.NegativeTTL), the contents we hold for generations
+// of the object that the notification makes obsolete, and if we have an
+// Invalidator, the kernel's entry for the object, its attributes
+// if we have an inode for it, and its parent's contents.
+//
+// File inodes already compare their generation against GCS when asked for
+// their attributes, so with the stat cache entry gone they notice that they
+// have been clobbered.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) applyNotification(e notification.Event) (applied bool) {
+	// Object names in notifications are relative to the bucket, but those of
+	// our inodes are relative to OnlyDir.
+	name := strings.TrimPrefix(e.Name, fs.objectNamePrefix)
+	inScope := name != e.Name || fs.objectNamePrefix == ""
+	if name == "" {
+		inScope = false
+	}
+
+	// Find the generation we already know of, if any.
+	var known int64
+	var in GenerationBackedInode
+	if inScope {
+		fs.mu.Lock()
+		in = fs.generationBackedInodes[name]
+		fs.mu.Unlock()
+	}
+
+	if in != nil {
+		in.Lock()
+		if f, ok := in.(*inode.FileInode); ok {
+			f.WaitForWriteBack()
+		}
+
+		known = in.SourceGeneration()
+		in.Unlock()
+	}
+
+	if !fs.notifications.Admit(e, known) {
+		return
+	}
+
+	applied = true
+
+	// Caches within the bucket see full object names.
+	if fs.forgetObject != nil {
+		fs.forgetObject(e.Name)
+		if parent := parentDirName(e.Name); parent != "" {
+			fs.forgetObject(parent)
+		}
+	}
+
+	if !inScope {
+		return
+	}
+
+	// Throw away the contents of generations that have been replaced or
+	// deleted, but not those of other objects.
+	switch e.EventType {
+	case notification.ObjectFinalize:
+		fs.leaser.RevokeReadLeasesMatching(
+			gcsproxy.GenerationsBefore(name, e.Generation))
+
+	case notification.ObjectDelete, notification.ObjectArchive:
+		fs.leaser.RevokeReadLeasesMatching(
+			gcsproxy.GenerationsBefore(name, e.Generation+1))
+	}
+
+	// Forget the types of the object and of its parent directory, which may
+	// have appeared or disappeared along with it, and the listings that show
+	// them.
+	parentName := parentDirName(name)
+	fs.forgetChildType(parentName, path.Base(name))
+	fs.dirListings.Invalidate(parentName)
+	if parentName != "" {
+		fs.forgetChildType(parentDirName(parentName), path.Base(parentName))
+		fs.dirListings.Invalidate(parentDirName(parentName))
+	}
+
+	// Likewise any record that they don't exist.
+	fs.negativeLookups.Erase(
+		strings.TrimSuffix(name, "/"),
+		strings.TrimSuffix(parentName, "/"))
+
+	// Tell the kernel.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.invalidateEntry(name)
+	if in != nil && fs.inodes[in.ID()] == in {
+		fs.invalidateInode(in.ID())
+	}
+
+	if parent := fs.dirInodeByName(parentName); parent != nil {
+		fs.invalidateInode(parent.ID())
+	}
+
+	return
+}
+
+// Forget what the named directory, if we have an inode for it, has cached
+// about the type of the named child.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) forgetChildType(dirName string, childName string) {
+	fs.mu.Lock()
+	d := fs.dirInodeByName(dirName)
+	fs.mu.Unlock()
+
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	d.ForgetChildType(childName)
+	d.Unlock()
+}
+
+// Accept a POSTed sequence of notification.Event values in JSON, acting on
+// each with applyNotification, and report how many were acted upon and how
+// many ignored.
+func (fs *fileSystem) serveNotifications(
+	w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Events must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	events, err := notification.ParseEvents(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("ParseEvents: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var applied, ignored int
+	for _, e := range events {
+		if fs.applyNotification(e) {
+			applied++
+		} else {
+			ignored++
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "applied: %d\n", applied)
+	fmt.Fprintf(w, "ignored: %d\n", ignored)
+}
@@ -0,0 +1,434 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for events POSTed to /notifications, with caches whose TTLs never
+// expire during a test, driving the file system directly through its op
+// methods like HandlesTest.
+type NotificationsTest struct {
+	ctx         context.Context
+	clock       timeutil.SimulatedClock
+	bucket      gcs.Bucket
+	mux         *http.ServeMux
+	invalidator entryRecorder
+	fs          *fileSystem
+}
+
+func init() { RegisterTestSuite(&NotificationsTest{}) }
+
+func (t *NotificationsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	// Cache stats in front of the bucket, as --stat-cache-ttl does.
+	policy, err := gcsproxy.ParseStatTTLs(time.Hour, nil)
+	AssertEq(nil, err)
+
+	statCache := gcsproxy.NewRecordCache(64, policy, &t.clock)
+	cachingBucket := gcsproxy.NewRecordCachingBucket(
+		statCache,
+		&t.clock,
+		t.bucket)
+
+	t.mux = http.NewServeMux()
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               cachingBucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		DirTypeCacheTTL:      time.Hour,
+		Invalidator:          &t.invalidator,
+		ForgetObject:         statCache.Erase,
+		DebugMux:             t.mux,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *NotificationsTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up a child of the root directory as the kernel would.
+func (t *NotificationsTest) lookUp(
+	name string) (entry fuseops.ChildInodeEntry, err error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	err = t.fs.LookUpInode(op)
+	entry = op.Entry
+	return
+}
+
+// Open and read the whole of the given file inode.
+func (t *NotificationsTest) readFile(id fuseops.InodeID) (s string) {
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Size:   1 << 10,
+	}
+
+	AssertEq(nil, t.fs.ReadFile(readOp))
+	s = string(readOp.Data)
+
+	return
+}
+
+// Overwrite an object as another client would, returning its new generation.
+func (t *NotificationsTest) overwrite(name string, contents string) int64 {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, contents)
+	AssertEq(nil, err)
+
+	return o.Generation
+}
+
+// POST the given events to the handler, returning the response.
+func (t *NotificationsTest) post(body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/notifications", strings.NewReader(body))
+	AssertEq(nil, err)
+
+	w := httptest.NewRecorder()
+	t.mux.ServeHTTP(w, req)
+
+	return w
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *NotificationsTest) OverwriteVisibleImmediately() {
+	entry, err := t.lookUp("foo")
+	AssertEq(nil, err)
+	AssertEq("taco", t.readFile(entry.Child))
+
+	// Another client overwrites the object. Without a notification, our caches
+	// hide that.
+	gen := t.overwrite("foo", "burrito")
+
+	stale, err := t.lookUp("foo")
+	AssertEq(nil, err)
+	AssertEq(entry.Child, stale.Child)
+
+	// Once told, we should see the new contents straight away.
+	w := t.post(fmt.Sprintf(
+		`{"name": "foo", "generation": %d, "eventType": "OBJECT_FINALIZE"}`,
+		gen))
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectEq("applied: 1\nignored: 0\n", w.Body.String())
+
+	fresh, err := t.lookUp("foo")
+	AssertEq(nil, err)
+	ExpectNe(entry.Child, fresh.Child)
+	ExpectEq(len("burrito"), fresh.Attributes.Size)
+	ExpectEq("burrito", t.readFile(fresh.Child))
+}
+
+func (t *NotificationsTest) CreationVisibleImmediately() {
+	// Looking up a missing name caches its absence.
+	_, err := t.lookUp("bar")
+	AssertEq(fuse.ENOENT, err)
+
+	gen := t.overwrite("bar", "burrito")
+
+	_, err = t.lookUp("bar")
+	AssertEq(fuse.ENOENT, err)
+
+	// Tell the file system.
+	w := t.post(fmt.Sprintf(
+		`{"name": "bar", "generation": %d, "eventType": "OBJECT_FINALIZE"}`,
+		gen))
+
+	AssertEq(http.StatusOK, w.Code)
+
+	entry, err := t.lookUp("bar")
+	AssertEq(nil, err)
+	ExpectEq("burrito", t.readFile(entry.Child))
+}
+
+func (t *NotificationsTest) NegativeLookupForgotten() {
+	t.fs.negativeLookups = newNegativeLookups(&t.clock, time.Hour, t.fs.counters)
+
+	entry, err := t.lookUp("bar")
+	AssertEq(nil, err)
+	AssertEq(0, entry.Child)
+
+	gen := t.overwrite("bar", "burrito")
+
+	w := t.post(fmt.Sprintf(
+		`{"name": "bar", "generation": %d, "eventType": "OBJECT_FINALIZE"}`,
+		gen))
+
+	AssertEq(http.StatusOK, w.Code)
+
+	entry, err = t.lookUp("bar")
+	AssertEq(nil, err)
+	ExpectNe(0, entry.Child)
+}
+
+func (t *NotificationsTest) ListingsForgotten() {
+	t.fs.dirListings = newDirListings(&t.clock, time.Hour, t.fs.counters)
+
+	// List the root, and have another client create a file in it.
+	readRoot := func() (names []string) {
+		openOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+		AssertEq(nil, t.fs.OpenDir(openOp))
+
+		readOp := &fuseops.ReadDirOp{
+			Inode:  fuseops.RootInodeID,
+			Handle: openOp.Handle,
+			Size:   1 << 16,
+		}
+
+		AssertEq(nil, t.fs.ReadDir(readOp))
+		names, _ = parseDirents(readOp.Data)
+
+		err := t.fs.ReleaseDirHandle(
+			&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+		AssertEq(nil, err)
+		return
+	}
+
+	AssertThat(readRoot(), ElementsAre("foo"))
+
+	gen := t.overwrite("bar", "burrito")
+	AssertThat(readRoot(), ElementsAre("foo"))
+
+	// Once told, we should list the root again.
+	w := t.post(fmt.Sprintf(
+		`{"name": "bar", "generation": %d, "eventType": "OBJECT_FINALIZE"}`,
+		gen))
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectThat(readRoot(), ElementsAre("bar", "foo"))
+}
+
+func (t *NotificationsTest) KernelToldToForget() {
+	entry, err := t.lookUp("foo")
+	AssertEq(nil, err)
+
+	gen := t.overwrite("foo", "burrito")
+	w := t.post(fmt.Sprintf(
+		`{"name": "foo", "generation": %d, "eventType": "OBJECT_FINALIZE"}`,
+		gen))
+
+	AssertEq(http.StatusOK, w.Code)
+
+	// The kernel should forget the name, the old inode's attributes, and the
+	// root's contents.
+	t.fs.invalidations.Stop()
+
+	t.invalidator.mu.Lock()
+	defer t.invalidator.mu.Unlock()
+
+	ExpectThat(t.invalidator.entries, ElementsAre("foo"))
+	ExpectThat(
+		t.invalidator.inodes,
+		ElementsAre(entry.Child, fuseops.RootInodeID))
+}
+
+func (t *NotificationsTest) StaleAndDuplicateEventsIgnored() {
+	entry, err := t.lookUp("foo")
+	AssertEq(nil, err)
+
+	// Events for the generation we already have change nothing.
+	stat, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+	old := stat.Generation
+
+	w := t.post(fmt.Sprintf(
+		`{"name": "foo", "generation": %d, "eventType": "OBJECT_FINALIZE"}`,
+		old))
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectEq("applied: 0\nignored: 1\n", w.Body.String())
+
+	// A newer generation is acted on once, and events describing what it
+	// replaced are then ignored even if delivered late.
+	gen := t.overwrite("foo", "burrito")
+	events := fmt.Sprintf(
+		`{"name": "foo", "generation": %d, "eventType": "OBJECT_FINALIZE"}
+{"name": "foo", "generation": %d, "eventType": "OBJECT_FINALIZE"}
+{"name": "foo", "generation": %d, "eventType": "OBJECT_DELETE"}`,
+		gen,
+		gen,
+		old)
+
+	w = t.post(events)
+	AssertEq(http.StatusOK, w.Code)
+	ExpectEq("applied: 1\nignored: 2\n", w.Body.String())
+
+	fresh, err := t.lookUp("foo")
+	AssertEq(nil, err)
+	ExpectNe(entry.Child, fresh.Child)
+}
+
+func (t *NotificationsTest) DeletionVisibleImmediately() {
+	_, err := t.lookUp("foo")
+	AssertEq(nil, err)
+
+	stat, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	w := t.post(fmt.Sprintf(
+		`{"name": "foo", "generation": %d, "eventType": "OBJECT_DELETE"}`,
+		stat.Generation))
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectEq("applied: 1\nignored: 0\n", w.Body.String())
+
+	_, err = t.lookUp("foo")
+	ExpectEq(fuse.ENOENT, err)
+}
+
+// Return the names of the files whose contents are held locally, in
+// decreasing order of bytes held.
+func (t *NotificationsTest) residentFiles() (names []string) {
+	for _, fr := range t.fs.residencySummary(t.ctx, 100) {
+		names = append(names, fr.Name)
+	}
+
+	return
+}
+
+func (t *NotificationsTest) OnlyOverwrittenContentsDropped() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", "enchilada")
+	AssertEq(nil, err)
+
+	// Read both files, so that their contents are held locally.
+	foo, err := t.lookUp("foo")
+	AssertEq(nil, err)
+	AssertEq("taco", t.readFile(foo.Child))
+
+	bar, err := t.lookUp("bar")
+	AssertEq(nil, err)
+	AssertEq("enchilada", t.readFile(bar.Child))
+
+	AssertThat(t.residentFiles(), ElementsAre("bar", "foo"))
+
+	// Overwrite one and say so. Its old contents should be thrown away, but not
+	// those of the other.
+	gen := t.overwrite("foo", "burrito")
+
+	w := t.post(fmt.Sprintf(
+		`{"name": "foo", "generation": %d, "eventType": "OBJECT_FINALIZE"}`,
+		gen))
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectThat(t.residentFiles(), ElementsAre("bar"))
+
+	// The new contents are read as usual, and held alongside the other's.
+	fresh, err := t.lookUp("foo")
+	AssertEq(nil, err)
+	AssertEq("burrito", t.readFile(fresh.Child))
+
+	ExpectThat(t.residentFiles(), ElementsAre("bar", "foo"))
+}
+
+func (t *NotificationsTest) OnlyDeletedContentsDropped() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", "enchilada")
+	AssertEq(nil, err)
+
+	foo, err := t.lookUp("foo")
+	AssertEq(nil, err)
+	AssertEq("taco", t.readFile(foo.Child))
+
+	bar, err := t.lookUp("bar")
+	AssertEq(nil, err)
+	AssertEq("enchilada", t.readFile(bar.Child))
+
+	AssertThat(t.residentFiles(), ElementsAre("bar", "foo"))
+
+	// Delete one and say so.
+	stat, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	w := t.post(fmt.Sprintf(
+		`{"name": "foo", "generation": %d, "eventType": "OBJECT_DELETE"}`,
+		stat.Generation))
+
+	AssertEq(http.StatusOK, w.Code)
+	ExpectThat(t.residentFiles(), ElementsAre("bar"))
+}
+
+func (t *NotificationsTest) MalformedEvents() {
+	w := t.post(`{"name": "foo", "eventType": "OBJECT_FINALIZE"}`)
+
+	ExpectEq(http.StatusBadRequest, w.Code)
+	ExpectThat(w.Body.String(), HasSubstr("generation"))
+}
+
+func (t *NotificationsTest) MethodNotAllowed() {
+	req, err := http.NewRequest("GET", "/notifications", nil)
+	AssertEq(nil, err)
+
+	w := httptest.NewRecorder()
+	t.mux.ServeHTTP(w, req)
+
+	ExpectEq(http.StatusMethodNotAllowed, w.Code)
+	ExpectEq("POST", w.Header().Get("Allow"))
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+)
+
+// The feature under which the object fields that renames need are registered
+// with gcsproxy.ObjectFields. To tell whether a rename interrupted by a
+// failure already happened, renameAlreadyDone compares the checksums, content
+// type, and complete metadata of the source and destination.
+const renameObjectFields = "renames"
+
+func init() {
+	gcsproxy.ObjectFields.Register(
+		renameObjectFields,
+		"contentType",
+		"md5Hash",
+		"metadata")
+}
+
+// Return the features, as registered with gcsproxy.ObjectFields, whose object
+// fields a file system consumes from listings and stats. Read-only file
+// systems don't rename or write files, and so need less.
+func ObjectFieldFeatures(readOnly bool) (features []string) {
+	features = []string{
+		inode.AtimeObjectFields,
+		inode.MtimeObjectFields,
+		inode.SymlinkObjectFields,
+		xattrObjectFields,
+	}
+
+	if !readOnly {
+		features = append(
+			features,
+			gcsproxy.AppendObjectFields,
+			gcsproxy.EncryptionObjectFields,
+			renameObjectFields)
+	}
+
+	return
+}
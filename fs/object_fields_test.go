@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ObjectFieldsTest struct {
+}
+
+func init() { RegisterTestSuite(&ObjectFieldsTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ObjectFieldsTest) ReadWrite() {
+	fields, err := gcsproxy.ObjectFields.Fields(fs.ObjectFieldFeatures(false))
+	AssertEq(nil, err)
+
+	ExpectThat(
+		fields,
+		ElementsAre(
+			"componentCount",
+			"contentType",
+			"crc32c",
+			"customerEncryption",
+			"generation",
+			"kmsKeyName",
+			"md5Hash",
+			"metadata",
+			"metageneration",
+			"name",
+			"size",
+			"updated",
+		))
+}
+
+func (t *ObjectFieldsTest) ReadOnly() {
+	fields, err := gcsproxy.ObjectFields.Fields(fs.ObjectFieldFeatures(true))
+	AssertEq(nil, err)
+
+	ExpectThat(
+		fields,
+		ElementsAre(
+			"contentType",
+			"crc32c",
+			"customerEncryption",
+			"generation",
+			"kmsKeyName",
+			"md5Hash",
+			"metadata",
+			"metageneration",
+			"name",
+			"size",
+			"updated",
+		))
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for a file system that exports only a single directory of its
+// bucket.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type OnlyDirTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&OnlyDirTest{}) }
+
+func (t *OnlyDirTest) SetUp(ti *TestInfo) {
+	t.serverCfg.OnlyDir = "/team/"
+	t.fsTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OnlyDirTest) ReadDirShowsOnlyDirContents() {
+	AssertEq(
+		nil,
+		t.createEmptyObjects([]string{
+			"foo",
+			"team",
+			"team/",
+			"team/bar",
+			"team/baz/",
+			"teammate/",
+			"teammate/qux",
+		}))
+
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	ExpectThat(getFileNames(entries), ElementsAre("bar", "baz"))
+
+	// Names outside of the directory shouldn't be reachable.
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *OnlyDirTest) ReadFile() {
+	AssertEq(nil, t.createWithContents("team/foo", "taco"))
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *OnlyDirTest) CreateFileAndDir() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "dir/foo"), []byte("taco"), 0400)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "team/dir/foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "team/dir/"})
+	ExpectEq(nil, err)
+
+	// Nothing should have been created outside of the directory.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OnlyDirTest) Rename() {
+	AssertEq(nil, t.createWithContents("team/foo", "taco"))
+
+	err := os.Rename(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "team/bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "team/foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OnlyDirTest) Unlink() {
+	AssertEq(nil, t.createEmptyObjects([]string{"foo", "team/foo"}))
+
+	err := os.Remove(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	// Only the object within the directory should be gone.
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "team/foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,414 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// The names of the ops recorded by monitoredFileSystem.
+var monitoredOps = []string{
+	"LookUpInode",
+	"GetInodeAttributes",
+	"SetInodeAttributes",
+	"ForgetInode",
+	"MkDir",
+	"CreateFile",
+	"CreateSymlink",
+	"CreateLink",
+	"MkNode",
+	"Rename",
+	"RmDir",
+	"Unlink",
+	"OpenDir",
+	"ReadDir",
+	"ReleaseDirHandle",
+	"OpenFile",
+	"ReadFile",
+	"WriteFile",
+	"SyncFile",
+	"FlushFile",
+	"SeekFile",
+	"Fallocate",
+	"ReleaseFileHandle",
+	"ReadSymlink",
+	"GetXattr",
+	"ListXattr",
+	"SetXattr",
+	"RemoveXattr",
+}
+
+// Export the leaser's revocations, by whether they were needed to stay within
+// its limits, and the number of downloads that evictions have caused.
+func registerLeaserMetrics(
+	registry *metrics.Registry,
+	leaser lease.FileLeaser,
+	evictions *gcsproxy.EvictionTracker) {
+	const revocationsHelp = "Cached contents revoked from the temporary " +
+		"directory, by reason."
+
+	registry.CounterFunc(
+		"gcsfuse_temp_dir_revocations_total",
+		revocationsHelp,
+		func() uint64 { return leaser.Stats().CapacityRevocations },
+		"reason", "capacity")
+
+	registry.CounterFunc(
+		"gcsfuse_temp_dir_revocations_total",
+		revocationsHelp,
+		func() uint64 { return leaser.Stats().VoluntaryRevocations },
+		"reason", "voluntary")
+
+	registry.CounterFunc(
+		"gcsfuse_eviction_misses_total",
+		"Downloads of object contents that were evicted from the temporary "+
+			"directory to make room.",
+		evictions.Misses)
+}
+
+// Export the file system's counters. The temporary directory's are exported by
+// registerLeaserMetrics.
+func registerCounterMetrics(registry *metrics.Registry, c *Counters) {
+	counter := func(name string, help string, f func(s Stats) uint64) {
+		registry.CounterFunc(
+			name,
+			help,
+			func() uint64 { return f(c.Stats()) })
+	}
+
+	counter(
+		"gcsfuse_fs_look_up_retries_total",
+		"Lookups started again because of a concurrent change to GCS.",
+		func(s Stats) uint64 { return s.LookUpRetries })
+
+	counter(
+		"gcsfuse_fs_streamed_bytes_total",
+		"Bytes read from GCS by streaming rather than through the temporary "+
+			"directory.",
+		func(s Stats) uint64 { return s.StreamedBytes })
+
+	counter(
+		"gcsfuse_fs_streaming_fallbacks_total",
+		"File handles that stopped streaming part way.",
+		func(s Stats) uint64 { return s.StreamingFallbacks })
+
+	counter(
+		"gcsfuse_fs_path_depth_lookups_rejected_total",
+		"Lookups refused by --max-path-depth.",
+		func(s Stats) uint64 { return s.PathDepthLookupsRejected })
+
+	counter(
+		"gcsfuse_fs_path_depth_entries_skipped_total",
+		"Directory entries left out of listings by --max-path-depth.",
+		func(s Stats) uint64 { return s.PathDepthEntriesSkipped })
+
+	counter(
+		"gcsfuse_fs_child_quota_creations_rejected_total",
+		"Creations refused by --max-children-per-dir.",
+		func(s Stats) uint64 { return s.ChildQuotaCreationsRejected })
+
+	counter(
+		"gcsfuse_fs_dir_cache_hits_total",
+		"Directory listings served from the --dir-cache-ttl cache.",
+		func(s Stats) uint64 { return s.DirCacheHits })
+
+	counter(
+		"gcsfuse_fs_dir_cache_negative_lookups_total",
+		"Lookups answered negatively by listings in the --dir-cache-ttl cache.",
+		func(s Stats) uint64 { return s.DirCacheNegativeLookups })
+
+	counter(
+		"gcsfuse_fs_negative_lookup_hits_total",
+		"Lookups answered from names remembered by --negative-ttl.",
+		func(s Stats) uint64 { return s.NegativeLookupHits })
+
+	counter(
+		"gcsfuse_fs_stale_files_refreshed_total",
+		"File inodes brought up to date with an object overwritten by "+
+			"another client.",
+		func(s Stats) uint64 { return s.StaleFilesRefreshed })
+}
+
+// Metrics for a single op type.
+type opMetrics struct {
+	count   *metrics.Counter
+	errors  *metrics.Counter
+	latency *metrics.Histogram
+}
+
+// Create a file system that records the count, errors, and latency of each
+// op handled by the wrapped file system in the supplied registry.
+func newMonitoredFileSystem(
+	clock timeutil.Clock,
+	registry *metrics.Registry,
+	wrapped fuseutil.FileSystem) fuseutil.FileSystem {
+	fs := &monitoredFileSystem{
+		clock:   clock,
+		wrapped: wrapped,
+		ops:     make(map[string]*opMetrics),
+	}
+
+	for _, op := range monitoredOps {
+		fs.ops[op] = &opMetrics{
+			count: registry.Counter(
+				"gcsfuse_fs_ops_total",
+				"File system ops handled, by op type.",
+				"op", op),
+
+			errors: registry.Counter(
+				"gcsfuse_fs_op_errors_total",
+				"File system ops that returned an error, by op type.",
+				"op", op),
+
+			latency: registry.Histogram(
+				"gcsfuse_fs_op_latency_seconds",
+				"Time taken to handle file system ops, by op type.",
+				metrics.LatencyBuckets,
+				"op", op),
+		}
+	}
+
+	return fs
+}
+
+type monitoredFileSystem struct {
+	clock   timeutil.Clock
+	wrapped fuseutil.FileSystem
+
+	// Metrics for each of monitoredOps. Not modified after creation.
+	ops map[string]*opMetrics
+}
+
+// Record an op that started at the given time and returned *err. For use
+// with defer.
+func (fs *monitoredFileSystem) record(
+	op string,
+	start time.Time,
+	err *error) {
+	m := fs.ops[op]
+	m.count.Inc()
+	if *err != nil {
+		m.errors.Inc()
+	}
+
+	m.latency.Observe(fs.clock.Now().Sub(start).Seconds())
+}
+
+func (fs *monitoredFileSystem) LookUpInode(
+	op *fuseops.LookUpInodeOp) (err error) {
+	defer fs.record("LookUpInode", fs.clock.Now(), &err)
+	err = fs.wrapped.LookUpInode(op)
+	return
+}
+
+func (fs *monitoredFileSystem) GetInodeAttributes(
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	defer fs.record("GetInodeAttributes", fs.clock.Now(), &err)
+	err = fs.wrapped.GetInodeAttributes(op)
+	return
+}
+
+func (fs *monitoredFileSystem) SetInodeAttributes(
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	defer fs.record("SetInodeAttributes", fs.clock.Now(), &err)
+	err = fs.wrapped.SetInodeAttributes(op)
+	return
+}
+
+func (fs *monitoredFileSystem) ForgetInode(
+	op *fuseops.ForgetInodeOp) (err error) {
+	defer fs.record("ForgetInode", fs.clock.Now(), &err)
+	err = fs.wrapped.ForgetInode(op)
+	return
+}
+
+func (fs *monitoredFileSystem) MkDir(
+	op *fuseops.MkDirOp) (err error) {
+	defer fs.record("MkDir", fs.clock.Now(), &err)
+	err = fs.wrapped.MkDir(op)
+	return
+}
+
+func (fs *monitoredFileSystem) CreateFile(
+	op *fuseops.CreateFileOp) (err error) {
+	defer fs.record("CreateFile", fs.clock.Now(), &err)
+	err = fs.wrapped.CreateFile(op)
+	return
+}
+
+func (fs *monitoredFileSystem) CreateSymlink(
+	op *fuseops.CreateSymlinkOp) (err error) {
+	defer fs.record("CreateSymlink", fs.clock.Now(), &err)
+	err = fs.wrapped.CreateSymlink(op)
+	return
+}
+
+func (fs *monitoredFileSystem) CreateLink(
+	op *fuseops.CreateLinkOp) (err error) {
+	defer fs.record("CreateLink", fs.clock.Now(), &err)
+	err = fs.wrapped.CreateLink(op)
+	return
+}
+
+func (fs *monitoredFileSystem) MkNode(
+	op *fuseops.MkNodeOp) (err error) {
+	defer fs.record("MkNode", fs.clock.Now(), &err)
+	err = fs.wrapped.MkNode(op)
+	return
+}
+
+func (fs *monitoredFileSystem) Rename(
+	op *fuseops.RenameOp) (err error) {
+	defer fs.record("Rename", fs.clock.Now(), &err)
+	err = fs.wrapped.Rename(op)
+	return
+}
+
+func (fs *monitoredFileSystem) RmDir(
+	op *fuseops.RmDirOp) (err error) {
+	defer fs.record("RmDir", fs.clock.Now(), &err)
+	err = fs.wrapped.RmDir(op)
+	return
+}
+
+func (fs *monitoredFileSystem) Unlink(
+	op *fuseops.UnlinkOp) (err error) {
+	defer fs.record("Unlink", fs.clock.Now(), &err)
+	err = fs.wrapped.Unlink(op)
+	return
+}
+
+func (fs *monitoredFileSystem) OpenDir(
+	op *fuseops.OpenDirOp) (err error) {
+	defer fs.record("OpenDir", fs.clock.Now(), &err)
+	err = fs.wrapped.OpenDir(op)
+	return
+}
+
+func (fs *monitoredFileSystem) ReadDir(
+	op *fuseops.ReadDirOp) (err error) {
+	defer fs.record("ReadDir", fs.clock.Now(), &err)
+	err = fs.wrapped.ReadDir(op)
+	return
+}
+
+func (fs *monitoredFileSystem) ReleaseDirHandle(
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	defer fs.record("ReleaseDirHandle", fs.clock.Now(), &err)
+	err = fs.wrapped.ReleaseDirHandle(op)
+	return
+}
+
+func (fs *monitoredFileSystem) OpenFile(
+	op *fuseops.OpenFileOp) (err error) {
+	defer fs.record("OpenFile", fs.clock.Now(), &err)
+	err = fs.wrapped.OpenFile(op)
+	return
+}
+
+func (fs *monitoredFileSystem) ReadFile(
+	op *fuseops.ReadFileOp) (err error) {
+	defer fs.record("ReadFile", fs.clock.Now(), &err)
+	err = fs.wrapped.ReadFile(op)
+	return
+}
+
+func (fs *monitoredFileSystem) WriteFile(
+	op *fuseops.WriteFileOp) (err error) {
+	defer fs.record("WriteFile", fs.clock.Now(), &err)
+	err = fs.wrapped.WriteFile(op)
+	return
+}
+
+func (fs *monitoredFileSystem) SyncFile(
+	op *fuseops.SyncFileOp) (err error) {
+	defer fs.record("SyncFile", fs.clock.Now(), &err)
+	err = fs.wrapped.SyncFile(op)
+	return
+}
+
+func (fs *monitoredFileSystem) FlushFile(
+	op *fuseops.FlushFileOp) (err error) {
+	defer fs.record("FlushFile", fs.clock.Now(), &err)
+	err = fs.wrapped.FlushFile(op)
+	return
+}
+
+func (fs *monitoredFileSystem) SeekFile(
+	op *fuseops.SeekFileOp) (err error) {
+	defer fs.record("SeekFile", fs.clock.Now(), &err)
+	err = fs.wrapped.SeekFile(op)
+	return
+}
+
+func (fs *monitoredFileSystem) Fallocate(
+	op *fuseops.FallocateOp) (err error) {
+	defer fs.record("Fallocate", fs.clock.Now(), &err)
+	err = fs.wrapped.Fallocate(op)
+	return
+}
+
+func (fs *monitoredFileSystem) ReleaseFileHandle(
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	defer fs.record("ReleaseFileHandle", fs.clock.Now(), &err)
+	err = fs.wrapped.ReleaseFileHandle(op)
+	return
+}
+
+func (fs *monitoredFileSystem) ReadSymlink(
+	op *fuseops.ReadSymlinkOp) (err error) {
+	defer fs.record("ReadSymlink", fs.clock.Now(), &err)
+	err = fs.wrapped.ReadSymlink(op)
+	return
+}
+
+func (fs *monitoredFileSystem) GetXattr(
+	op *fuseops.GetXattrOp) (err error) {
+	defer fs.record("GetXattr", fs.clock.Now(), &err)
+	err = fs.wrapped.GetXattr(op)
+	return
+}
+
+func (fs *monitoredFileSystem) ListXattr(
+	op *fuseops.ListXattrOp) (err error) {
+	defer fs.record("ListXattr", fs.clock.Now(), &err)
+	err = fs.wrapped.ListXattr(op)
+	return
+}
+
+func (fs *monitoredFileSystem) SetXattr(
+	op *fuseops.SetXattrOp) (err error) {
+	defer fs.record("SetXattr", fs.clock.Now(), &err)
+	err = fs.wrapped.SetXattr(op)
+	return
+}
+
+func (fs *monitoredFileSystem) RemoveXattr(
+	op *fuseops.RemoveXattrOp) (err error) {
+	defer fs.record("RemoveXattr", fs.clock.Now(), &err)
+	err = fs.wrapped.RemoveXattr(op)
+	return
+}
+
+func (fs *monitoredFileSystem) Destroy() {
+	fs.wrapped.Destroy()
+}
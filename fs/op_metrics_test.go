@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestOpMetrics(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A file system whose ReadFile takes a configurable amount of simulated time
+// and returns a configurable error.
+type slowFileSystem struct {
+	fuseutil.NotImplementedFileSystem
+	clock *timeutil.SimulatedClock
+	delay time.Duration
+	err   error
+}
+
+func (fs *slowFileSystem) ReadFile(op *fuseops.ReadFileOp) (err error) {
+	fs.clock.AdvanceTime(fs.delay)
+	err = fs.err
+	return
+}
+
+type OpMetricsTest struct {
+	clock    timeutil.SimulatedClock
+	wrapped  slowFileSystem
+	registry *metrics.Registry
+	fs       fuseutil.FileSystem
+}
+
+func init() { RegisterTestSuite(&OpMetricsTest{}) }
+
+func (t *OpMetricsTest) SetUp(ti *TestInfo) {
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.clock = &t.clock
+	t.registry = metrics.NewRegistry()
+	t.fs = newMonitoredFileSystem(&t.clock, t.registry, &t.wrapped)
+}
+
+func (t *OpMetricsTest) counter(name string, op string) uint64 {
+	return t.registry.Counter(name, "", "op", op).Value()
+}
+
+func (t *OpMetricsTest) latency(op string) *metrics.Histogram {
+	return t.registry.Histogram(
+		"gcsfuse_fs_op_latency_seconds",
+		"",
+		metrics.LatencyBuckets,
+		"op", op)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OpMetricsTest) CountsAndLatency() {
+	t.wrapped.delay = 250 * time.Millisecond
+
+	AssertEq(nil, t.fs.ReadFile(&fuseops.ReadFileOp{}))
+	AssertEq(nil, t.fs.ReadFile(&fuseops.ReadFileOp{}))
+
+	ExpectEq(2, t.counter("gcsfuse_fs_ops_total", "ReadFile"))
+	ExpectEq(0, t.counter("gcsfuse_fs_op_errors_total", "ReadFile"))
+	ExpectEq(2, t.latency("ReadFile").Count())
+	ExpectEq(0.5, t.latency("ReadFile").Sum())
+
+	ExpectEq(0, t.counter("gcsfuse_fs_ops_total", "WriteFile"))
+}
+
+func (t *OpMetricsTest) Errors() {
+	t.wrapped.err = errors.New("taco")
+
+	err := t.fs.ReadFile(&fuseops.ReadFileOp{})
+	ExpectEq(t.wrapped.err, err)
+
+	// The not-implemented methods fail too.
+	err = t.fs.MkDir(&fuseops.MkDirOp{})
+	ExpectEq(fuse.ENOSYS, err)
+
+	ExpectEq(1, t.counter("gcsfuse_fs_ops_total", "ReadFile"))
+	ExpectEq(1, t.counter("gcsfuse_fs_op_errors_total", "ReadFile"))
+	ExpectEq(1, t.counter("gcsfuse_fs_op_errors_total", "MkDir"))
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the object reads made through it. If gateStatOf is
+// set, stats of the named object close statStarted and then wait for
+// statRelease to be closed.
+type countingReadsBucket struct {
+	gcs.Bucket
+
+	// The number of calls to NewReader. Accessed atomically.
+	readCalls uint64
+
+	gateStatOf  string
+	statStarted chan struct{}
+	statRelease chan struct{}
+}
+
+func (b *countingReadsBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	atomic.AddUint64(&b.readCalls, 1)
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *countingReadsBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if b.gateStatOf != "" && req.Name == b.gateStatOf {
+		close(b.statStarted)
+		<-b.statRelease
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+// Tests for opening existing files with O_TRUNC, driving the file system
+// directly through its op methods. The bucket starts out with a large object
+// named "foo".
+type OpenTruncateTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket countingReadsBucket
+	fs     *fileSystem
+}
+
+const openTruncateTestSize = 1 << 21
+
+func init() { RegisterTestSuite(&OpenTruncateTest{}) }
+
+func (t *OpenTruncateTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo",
+		strings.Repeat("a", openTruncateTestSize))
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *OpenTruncateTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up and open foo with the supplied flags, returning its inode ID and the
+// handle.
+func (t *OpenTruncateTest) openFoo(
+	flags bazilfuse.OpenFlags) (id fuseops.InodeID, h fuseops.HandleID) {
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(lookUpOp))
+	id = lookUpOp.Entry.Child
+
+	openOp := &fuseops.OpenFileOp{
+		Inode: id,
+		Flags: flags,
+	}
+
+	AssertEq(nil, t.fs.OpenFile(openOp))
+	h = openOp.Handle
+
+	return
+}
+
+// Write the supplied contents at the start of foo and flush them.
+func (t *OpenTruncateTest) writeAndFlush(
+	id fuseops.InodeID,
+	h fuseops.HandleID,
+	contents string) {
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte(contents),
+	})
+
+	AssertEq(nil, err)
+
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{
+		Inode:  id,
+		Handle: h,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *OpenTruncateTest) read(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, name)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OpenTruncateTest) RewriteWithoutReading() {
+	id, h := t.openFoo(bazilfuse.OpenWriteOnly | bazilfuse.OpenTruncate)
+
+	// The inode should be empty straight away.
+	attrsOp := &fuseops.GetInodeAttributesOp{Inode: id}
+	AssertEq(nil, t.fs.GetInodeAttributes(attrsOp))
+	ExpectEq(0, attrsOp.Attributes.Size)
+
+	t.writeAndFlush(id, h, "taco")
+
+	ExpectEq("taco", t.read("foo"))
+	ExpectEq(0, atomic.LoadUint64(&t.bucket.readCalls))
+}
+
+func (t *OpenTruncateTest) WithoutTruncateFlag() {
+	// Writing without O_TRUNC must read the rest of the object, to keep it.
+	id, h := t.openFoo(bazilfuse.OpenWriteOnly)
+	t.writeAndFlush(id, h, "taco")
+
+	ExpectEq("taco"+strings.Repeat("a", openTruncateTestSize-4), t.read("foo"))
+	ExpectNe(0, atomic.LoadUint64(&t.bucket.readCalls))
+}
+
+func (t *OpenTruncateTest) ClobberedAfterOpen() {
+	id, h := t.openFoo(bazilfuse.OpenWriteOnly | bazilfuse.OpenTruncate)
+
+	// Someone else overwrites the object after we've truncated it.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	// Our sync is conditional on the generation we opened, so it shouldn't
+	// stomp on their contents.
+	err = t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte("taco"),
+	})
+
+	AssertEq(nil, err)
+
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{
+		Inode:  id,
+		Handle: h,
+	})
+
+	ExpectEq(errStale, err)
+	ExpectEq("burrito", t.read("foo"))
+}
+
+func (t *OpenTruncateTest) ReadOnlyFileSystem() {
+	t.fs.readOnly = true
+
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(lookUpOp))
+
+	err := t.fs.OpenFile(&fuseops.OpenFileOp{
+		Inode: lookUpOp.Entry.Child,
+		Flags: bazilfuse.OpenReadOnly | bazilfuse.OpenTruncate,
+	})
+
+	ExpectEq(syscall.EROFS, err)
+	ExpectEq(openTruncateTestSize, len(t.read("foo")))
+}
+
+func (t *OpenTruncateTest) LastHandleTakenDuringOpen() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "bar", "burrito")
+	AssertEq(nil, err)
+
+	var ids []fuseops.InodeID
+	for _, name := range []string{"foo", "bar"} {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		AssertEq(nil, t.fs.LookUpInode(op))
+		ids = append(ids, op.Entry.Child)
+	}
+
+	// Open foo with O_TRUNC while only one handle may be open, stopping it
+	// partway through.
+	t.fs.maxOpenHandles = 1
+	t.bucket.statStarted = make(chan struct{})
+	t.bucket.statRelease = make(chan struct{})
+	t.bucket.gateStatOf = "foo"
+
+	truncErr := make(chan error)
+	go func() {
+		truncErr <- t.fs.OpenFile(&fuseops.OpenFileOp{
+			Inode: ids[0],
+			Flags: bazilfuse.OpenWriteOnly | bazilfuse.OpenTruncate,
+		})
+	}()
+
+	// Another open can't take the handle that the first is counting on, which
+	// could otherwise leave foo truncated without a handle through which the
+	// truncation was asked for.
+	<-t.bucket.statStarted
+	err = t.fs.OpenFile(&fuseops.OpenFileOp{
+		Inode: ids[1],
+		Flags: bazilfuse.OpenReadOnly,
+	})
+
+	ExpectEq(errTooManyHandles, err)
+
+	close(t.bucket.statRelease)
+	AssertEq(nil, <-truncErr)
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestOwner(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for attempts to change the owner of inodes. Each test creates the
+// file system, with or without ServerConfig.FixedOwner, and looks up "foo".
+type OwnerTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// The inode for "foo".
+	id fuseops.InodeID
+}
+
+func init() { RegisterTestSuite(&OwnerTest{}) }
+
+func (t *OwnerTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+}
+
+func (t *OwnerTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+// Create the file system and look up "foo".
+func (t *OwnerTest) mount(fixedOwner bool) {
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		Uid:                  17,
+		Gid:                  19,
+		FixedOwner:           fixedOwner,
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	t.id = child.ID()
+}
+
+func (t *OwnerTest) chown(uid *uint32, gid *uint32) (err error) {
+	op := &fuseops.SetInodeAttributesOp{
+		Inode: t.id,
+		Uid:   uid,
+		Gid:   gid,
+	}
+
+	err = t.fs.SetInodeAttributes(op)
+	if err != nil {
+		return
+	}
+
+	// The owner never changes.
+	ExpectEq(17, op.Attributes.Uid)
+	ExpectEq(19, op.Attributes.Gid)
+
+	return
+}
+
+func ownerID(v uint32) *uint32 {
+	return &v
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OwnerTest) NotFixed() {
+	t.mount(false)
+
+	ExpectEq(nil, t.chown(ownerID(0), ownerID(0)))
+	ExpectEq(nil, t.chown(nil, ownerID(23)))
+}
+
+func (t *OwnerTest) Fixed_Changes() {
+	t.mount(true)
+
+	ExpectEq(errChownFixedOwner, t.chown(ownerID(0), nil))
+	ExpectEq(errChownFixedOwner, t.chown(nil, ownerID(0)))
+	ExpectEq(errChownFixedOwner, t.chown(ownerID(17), ownerID(0)))
+}
+
+func (t *OwnerTest) Fixed_NoOps() {
+	t.mount(true)
+
+	ExpectEq(nil, t.chown(ownerID(17), nil))
+	ExpectEq(nil, t.chown(nil, ownerID(19)))
+	ExpectEq(nil, t.chown(ownerID(17), ownerID(19)))
+}
+
+func (t *OwnerTest) Fixed_Directory() {
+	t.mount(true)
+
+	err := t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: fuseops.RootInodeID,
+		Uid:   ownerID(0),
+	})
+
+	ExpectEq(errChownFixedOwner, err)
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The error returned for names deeper than ServerConfig.MaxPathDepth.
+var errPathTooDeep = bazilfuse.Errno(syscall.ENAMETOOLONG)
+
+// Return the number of components in the supplied object name, which may name
+// a file ("a/b") or a directory ("a/b/"). The root directory ("") has depth
+// zero.
+func pathDepth(name string) int {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" {
+		return 0
+	}
+
+	return strings.Count(name, "/") + 1
+}
+
+// Would the children of the supplied directory be deeper than maxDepth allows?
+// Zero means no limit.
+func childrenTooDeep(parent inode.DirInode, maxDepth int) bool {
+	return maxDepth > 0 && pathDepth(parent.Name())+1 > maxDepth
+}
+
+// Leave out of a directory's entries any that are too deep.
+// Return the entries to keep and the number skipped.
+func skipTooDeep(
+	parent inode.DirInode,
+	maxDepth int,
+	entries []fuseutil.Dirent) (kept []fuseutil.Dirent, skipped int) {
+	// All children of a directory are at the same depth.
+	if !childrenTooDeep(parent, maxDepth) {
+		kept = entries
+		return
+	}
+
+	skipped = len(entries)
+	return
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPathDepth(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// GCS limits object names to 1024 bytes, so 500 single-character components
+// is about as deep as a real bucket can go.
+const (
+	pathDepthTestMax        = 100
+	pathDepthTestDeepLevels = 500
+)
+
+// Tests for ServerConfig.MaxPathDepth, using a bucket containing an object
+// whose name is far deeper than the limit.
+type PathDepthTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// The RenameDirLimit with which createFS creates the file system.
+	renameDirLimit int
+}
+
+func init() { RegisterTestSuite(&PathDepthTest{}) }
+
+func (t *PathDepthTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create a very deep object, and a shallower one within the limit.
+	deep := strings.Repeat("a/", pathDepthTestDeepLevels) + "file"
+	shallow := strings.Repeat("b/", pathDepthTestMax/2) + "file"
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			deep:    "taco",
+			shallow: "burrito",
+		})
+
+	AssertEq(nil, err)
+
+	t.createFS(pathDepthTestMax)
+}
+
+func (t *PathDepthTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+func (t *PathDepthTest) createFS(maxDepth int) {
+	var err error
+
+	if t.fs != nil {
+		t.fs.Destroy()
+		t.fs = nil
+	}
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		ImplicitDirectories:  true,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		MaxPathDepth:         maxDepth,
+		RenameDirLimit:       t.renameDirLimit,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *PathDepthTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (child fuseops.InodeID, err error) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err = t.fs.LookUpInode(op)
+	child = op.Entry.Child
+	return
+}
+
+// Look up the given name repeatedly starting at the root, returning the
+// number of successful lookups, the last inode found, and the first error.
+func (t *PathDepthTest) walk(
+	name string,
+	levels int) (n int, last fuseops.InodeID, err error) {
+	last = fuseops.RootInodeID
+	for n = 0; n < levels; n++ {
+		var child fuseops.InodeID
+		child, err = t.lookUp(last, name)
+		if err != nil {
+			return
+		}
+
+		last = child
+	}
+
+	return
+}
+
+func (t *PathDepthTest) inodeCount() int {
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	return len(t.fs.inodes)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PathDepthTest) PathDepth() {
+	ExpectEq(0, pathDepth(""))
+	ExpectEq(1, pathDepth("foo"))
+	ExpectEq(1, pathDepth("foo/"))
+	ExpectEq(3, pathDepth("foo/bar/baz"))
+	ExpectEq(3, pathDepth("foo/bar/baz/"))
+	ExpectEq(1000, pathDepth(strings.Repeat("a/", 1000)))
+}
+
+func (t *PathDepthTest) LookUpStopsAtLimit() {
+	before := t.fs.counters.Stats().PathDepthLookupsRejected
+
+	n, _, err := t.walk("a", pathDepthTestDeepLevels)
+	ExpectEq(pathDepthTestMax, n)
+	ExpectEq(errPathTooDeep, err)
+	ExpectEq(before+1, t.fs.counters.Stats().PathDepthLookupsRejected)
+
+	// The root, plus one inode per level.
+	ExpectLe(t.inodeCount(), pathDepthTestMax+1)
+}
+
+func (t *PathDepthTest) ShallowNamesUnaffected() {
+	n, dir, err := t.walk("b", pathDepthTestMax/2)
+	AssertEq(nil, err)
+	ExpectEq(pathDepthTestMax/2, n)
+
+	_, err = t.lookUp(dir, "file")
+	ExpectEq(nil, err)
+}
+
+func (t *PathDepthTest) ListingSkipsTooDeepEntries() {
+	_, dir, err := t.walk("a", pathDepthTestMax)
+	AssertEq(nil, err)
+
+	before := t.fs.counters.Stats().PathDepthEntriesSkipped
+
+	openOp := &fuseops.OpenDirOp{Inode: dir}
+	AssertEq(nil, t.fs.OpenDir(openOp))
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  dir,
+		Handle: openOp.Handle,
+		Size:   1 << 12,
+	}
+
+	AssertEq(nil, t.fs.ReadDir(readOp))
+	ExpectEq(0, len(readOp.Data))
+	ExpectEq(before+1, t.fs.counters.Stats().PathDepthEntriesSkipped)
+}
+
+func (t *PathDepthTest) CreationRefusedBeyondLimit() {
+	_, dir, err := t.walk("a", pathDepthTestMax)
+	AssertEq(nil, err)
+
+	err = t.fs.MkDir(&fuseops.MkDirOp{Parent: dir, Name: "taco"})
+	ExpectEq(errPathTooDeep, err)
+
+	err = t.fs.CreateSymlink(&fuseops.CreateSymlinkOp{
+		Parent: dir,
+		Name:   "taco",
+		Target: "burrito",
+	})
+
+	ExpectEq(errPathTooDeep, err)
+}
+
+func (t *PathDepthTest) DirectoryRenameRefusedBeyondLimit() {
+	t.renameDirLimit = 16
+	t.createFS(pathDepthTestMax)
+
+	// "b" holds a file pathDepthTestMax/2 levels beneath it.
+	_, err := t.lookUp(fuseops.RootInodeID, "b")
+	AssertEq(nil, err)
+
+	// Moving it beneath a directory deep enough that the file would end up
+	// beyond the limit is refused, though "b" itself would be within it.
+	_, deep, err := t.walk("a", pathDepthTestMax-pathDepthTestMax/4)
+	AssertEq(nil, err)
+
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "b",
+		NewParent: deep,
+		NewName:   "b",
+	})
+
+	ExpectEq(errPathTooDeep, err)
+
+	// Nothing was moved.
+	shallowName := strings.Repeat("b/", pathDepthTestMax/2) + "file"
+	_, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: shallowName})
+
+	ExpectEq(nil, err)
+
+	// Somewhere shallower is fine.
+	_, shallow, err := t.walk("a", pathDepthTestMax/4)
+	AssertEq(nil, err)
+
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "b",
+		NewParent: shallow,
+		NewName:   "b",
+	})
+
+	ExpectEq(nil, err)
+}
+
+func (t *PathDepthTest) NoLimit() {
+	t.createFS(0)
+
+	n, dir, err := t.walk("a", pathDepthTestDeepLevels)
+	AssertEq(nil, err)
+	ExpectEq(pathDepthTestDeepLevels, n)
+
+	_, err = t.lookUp(dir, "file")
+	ExpectEq(nil, err)
+}
+
+func (t *PathDepthTest) NegativeLimitRejected() {
+	err := ValidateServerConfig(&ServerConfig{MaxPathDepth: -1})
+	ExpectThat(err, Error(HasSubstr("MaxPathDepth")))
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The shortest interval that ServerConfig accepts for background work run
+// periodically, such as syncing dirty files. Shorter ones would have us spin.
+const minBackgroundInterval = time.Second
+
+// A clock that can also tell us when a given time has passed, as time.After
+// does for real time. If ServerConfig.Clock implements this, background work
+// is timed by it, so that tests can drive that work with a simulated clock.
+type timerClock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// Call f every period, as measured by fs.clock, until the context is
+// cancelled.
+func (fs *fileSystem) runPeriodically(
+	ctx context.Context,
+	period time.Duration,
+	f func()) {
+	after := time.After
+	if tc, ok := fs.clock.(timerClock); ok {
+		after = tc.After
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-after(period):
+			f()
+		}
+	}
+}
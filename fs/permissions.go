@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The error returned when ServerConfig.CheckPermissions is set and the
+// caller's credentials don't allow an op.
+var errPermission = bazilfuse.Errno(syscall.EACCES)
+
+// The kinds of access that may be checked, as in the rwx bits of a mode.
+const (
+	accessRead    os.FileMode = 04
+	accessWrite   os.FileMode = 02
+	accessExecute os.FileMode = 01
+)
+
+// Return errPermission if ServerConfig.CheckPermissions is set and the caller
+// described by the supplied header doesn't have the wanted access to an inode
+// with the supplied mode. Every inode is owned by fs.uid and fs.gid.
+//
+// Only the caller's primary group is known, so membership of fs.gid by way of
+// a supplementary group doesn't count. Root may do anything.
+func (fs *fileSystem) checkAccess(
+	h fuseops.OpHeader,
+	mode os.FileMode,
+	want os.FileMode) (err error) {
+	if !fs.checkPermissions || h.Uid == 0 {
+		return
+	}
+
+	// Choose the class of the caller, as in the usual UNIX check.
+	var granted os.FileMode
+	switch {
+	case h.Uid == fs.uid:
+		granted = (mode >> 6) & 07
+
+	case h.Gid == fs.gid:
+		granted = (mode >> 3) & 07
+
+	default:
+		granted = mode & 07
+	}
+
+	if granted&want != want {
+		err = errPermission
+		return
+	}
+
+	return
+}
+
+// Return the access that opening a file with the supplied flags needs.
+func openAccess(flags bazilfuse.OpenFlags) (want os.FileMode) {
+	switch {
+	case flags.IsReadOnly():
+		want = accessRead
+
+	case flags.IsWriteOnly():
+		want = accessWrite
+
+	default:
+		want = accessRead | accessWrite
+	}
+
+	// Truncating is writing, whatever the access mode.
+	if flags&bazilfuse.OpenTruncate != 0 {
+		want |= accessWrite
+	}
+
+	return
+}
+
+// Adding and removing children of a directory requires writing to it and
+// searching it.
+const accessModifyDir = accessWrite | accessExecute
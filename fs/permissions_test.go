@@ -0,0 +1,189 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPermissions(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The credentials of callers in each class, given that everything is owned by
+// uid 17 and gid 19.
+var (
+	permsOwner = fuseops.OpHeader{Uid: 17, Gid: 1000}
+	permsGroup = fuseops.OpHeader{Uid: 1000, Gid: 19}
+	permsOther = fuseops.OpHeader{Uid: 1000, Gid: 1000}
+	permsRoot  = fuseops.OpHeader{Uid: 0, Gid: 0}
+)
+
+// Tests for ServerConfig.CheckPermissions, issuing ops as if from various
+// users. Files have mode 0640 and directories 0755.
+type PermissionsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// The inode for "foo".
+	id fuseops.InodeID
+}
+
+func init() { RegisterTestSuite(&PermissionsTest{}) }
+
+func (t *PermissionsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, []string{"foo"})
+	AssertEq(nil, err)
+}
+
+func (t *PermissionsTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+// Create the file system and look up "foo".
+func (t *PermissionsTest) mount(check bool) {
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		Uid:                  17,
+		Gid:                  19,
+		FilePerms:            0640,
+		DirPerms:             0755,
+		CheckPermissions:     check,
+	})
+
+	AssertEq(nil, err)
+
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(op))
+	t.id = op.Entry.Child
+}
+
+func (t *PermissionsTest) open(
+	h fuseops.OpHeader,
+	flags bazilfuse.OpenFlags) error {
+	op := &fuseops.OpenFileOp{
+		Inode: t.id,
+		Flags: flags,
+	}
+
+	op.SetHeader(h)
+	return t.fs.OpenFile(op)
+}
+
+func (t *PermissionsTest) create(h fuseops.OpHeader, name string) error {
+	op := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+		Mode:   0644,
+		Flags:  bazilfuse.OpenReadWrite,
+	}
+
+	op.SetHeader(h)
+	return t.fs.CreateFile(op)
+}
+
+func (t *PermissionsTest) unlink(h fuseops.OpHeader) error {
+	op := &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	op.SetHeader(h)
+	return t.fs.Unlink(op)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PermissionsTest) Open() {
+	t.mount(true)
+
+	ExpectEq(nil, t.open(permsOwner, bazilfuse.OpenReadWrite))
+
+	ExpectEq(nil, t.open(permsGroup, bazilfuse.OpenReadOnly))
+	ExpectEq(errPermission, t.open(permsGroup, bazilfuse.OpenWriteOnly))
+	ExpectEq(errPermission, t.open(permsGroup, bazilfuse.OpenReadWrite))
+
+	ExpectEq(errPermission, t.open(permsOther, bazilfuse.OpenReadOnly))
+
+	ExpectEq(nil, t.open(permsRoot, bazilfuse.OpenReadWrite))
+}
+
+func (t *PermissionsTest) Create() {
+	t.mount(true)
+
+	ExpectEq(errPermission, t.create(permsGroup, "bar"))
+	ExpectEq(errPermission, t.create(permsOther, "bar"))
+
+	// Nothing should have been created for the callers turned away.
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	ExpectEq(nil, t.create(permsOwner, "bar"))
+	ExpectEq(nil, t.create(permsRoot, "baz"))
+}
+
+func (t *PermissionsTest) Unlink() {
+	t.mount(true)
+
+	ExpectEq(errPermission, t.unlink(permsGroup))
+	ExpectEq(errPermission, t.unlink(permsOther))
+
+	// The object should still be there.
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	ExpectEq(nil, t.unlink(permsOwner))
+}
+
+func (t *PermissionsTest) CheckDisabled() {
+	t.mount(false)
+
+	ExpectEq(nil, t.open(permsOther, bazilfuse.OpenReadWrite))
+	ExpectEq(nil, t.create(permsOther, "bar"))
+	ExpectEq(nil, t.unlink(permsOther))
+}
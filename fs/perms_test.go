@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPerms(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests that ServerConfig.FilePerms and DirPerms apply to every kind of
+// inode, as ls -l would show them.
+type PermsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&PermsTest{}) }
+
+func (t *PermsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// A file, an explicit directory, a file within an implicit directory, and
+	// a symlink.
+	err = gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{"foo", "dir/", "implicit/bar"})
+
+	AssertEq(nil, err)
+
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "link",
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{inode.SymlinkMetadataKey: "foo"},
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		ImplicitDirectories:  true,
+		FilePerms:            0640,
+		DirPerms:             0710,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *PermsTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Return the mode of the named child of the root.
+func (t *PermsTest) mode(name string) os.FileMode {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(op))
+	return op.Entry.Attributes.Mode
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PermsTest) Root() {
+	op := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	AssertEq(nil, t.fs.GetInodeAttributes(op))
+
+	ExpectEq(os.ModeDir|0710, op.Attributes.Mode)
+}
+
+func (t *PermsTest) File() {
+	ExpectEq(os.FileMode(0640), t.mode("foo"))
+}
+
+func (t *PermsTest) ExplicitDirectory() {
+	ExpectEq(os.ModeDir|0710, t.mode("dir"))
+}
+
+func (t *PermsTest) ImplicitDirectory() {
+	ExpectEq(os.ModeDir|0710, t.mode("implicit"))
+}
+
+func (t *PermsTest) Symlink() {
+	ExpectEq(os.ModeSymlink|0640, t.mode("link"))
+}
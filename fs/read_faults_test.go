@@ -0,0 +1,217 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestReadFaults(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose reads of ranges starting at or beyond a given offset block
+// until released.
+type gatedBucket struct {
+	gcs.Bucket
+	gateOffset uint64
+
+	// Receives a value when a gated read starts.
+	started chan struct{}
+
+	// Closed to release gated reads.
+	release chan struct{}
+}
+
+func (b *gatedBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if req.Range != nil && req.Range.Start >= b.gateOffset {
+		b.started <- struct{}{}
+		<-b.release
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReadFaultsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket *gatedBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&ReadFaultsTest{}) }
+
+func (t *ReadFaultsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = &gatedBucket{
+		Bucket:     gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+		gateOffset: 4,
+		started:    make(chan struct{}, 1),
+		release:    make(chan struct{}),
+	}
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "tacoburrito")
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		GCSChunkSize:         4,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *ReadFaultsTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up and open a child of the root.
+func (t *ReadFaultsTest) open(
+	name string) (id fuseops.InodeID, h fuseops.HandleID) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	id = child.ID()
+
+	op := &fuseops.OpenFileOp{Inode: id}
+	AssertEq(nil, t.fs.OpenFile(op))
+	h = op.Handle
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadFaultsTest) ResidentReadNotBlockedByColdRead() {
+	id, h := t.open("foo")
+
+	// Fault in the first chunk.
+	warm := &fuseops.ReadFileOp{Inode: id, Handle: h, Size: 4}
+	AssertEq(nil, t.fs.ReadFile(warm))
+	AssertEq("taco", string(warm.Data))
+
+	// Start a read of the second chunk, which blocks in GCS.
+	cold := &fuseops.ReadFileOp{Inode: id, Handle: h, Offset: 4, Size: 4}
+	coldErr := make(chan error, 1)
+	go func() {
+		coldErr <- t.fs.ReadFile(cold)
+	}()
+
+	<-t.bucket.started
+
+	// A read of the first chunk is served while the cold read is outstanding.
+	hit := &fuseops.ReadFileOp{Inode: id, Handle: h, Offset: 1, Size: 2}
+	hitErr := make(chan error, 1)
+	go func() {
+		hitErr <- t.fs.ReadFile(hit)
+	}()
+
+	select {
+	case err := <-hitErr:
+		AssertEq(nil, err)
+		ExpectEq("ac", string(hit.Data))
+
+	case <-time.After(5 * time.Second):
+		close(t.bucket.release)
+		AddFailure("Resident read blocked behind cold read")
+		AbortTest()
+	}
+
+	// Release the cold read, which should now complete.
+	close(t.bucket.release)
+	AssertEq(nil, <-coldErr)
+	ExpectEq("burr", string(cold.Data))
+}
+
+func (t *ReadFaultsTest) ContentEvictedAsSoonAsFetched() {
+	// Allow less than a chunk per file, so that each chunk is evicted as soon
+	// as its fault's result is collected.
+	var err error
+	t.fs.Destroy()
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                    &t.clock,
+		Bucket:                   t.bucket,
+		TempDirLimitNumFiles:     16,
+		TempDirLimitBytes:        1 << 22,
+		TempDirLimitBytesPerFile: 2,
+		GCSChunkSize:             4,
+		TmpObjectPrefix:          ".gcsfuse_tmp/",
+		FilePerms:                0644,
+		DirPerms:                 0755,
+	})
+
+	AssertEq(nil, err)
+
+	close(t.bucket.release)
+	go func() {
+		for range t.bucket.started {
+		}
+	}()
+
+	// The read should still complete.
+	id, h := t.open("foo")
+
+	op := &fuseops.ReadFileOp{Inode: id, Handle: h, Offset: 2, Size: 4}
+	opErr := make(chan error, 1)
+	go func() {
+		opErr <- t.fs.ReadFile(op)
+	}()
+
+	select {
+	case err := <-opErr:
+		AssertEq(nil, err)
+		ExpectEq("cobu", string(op.Data))
+
+	case <-time.After(5 * time.Second):
+		AddFailure("Read never completed")
+		AbortTest()
+	}
+}
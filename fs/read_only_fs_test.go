@@ -0,0 +1,310 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestReadOnlyFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for ServerConfig.ReadOnly, driving the file system directly through
+// its op methods. See also ReadOnlyTest, which covers read-only mounts
+// enforced by the kernel.
+type ReadOnlyFSTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	foo fuseops.InodeID
+	dir fuseops.InodeID
+}
+
+func init() { RegisterTestSuite(&ReadOnlyFSTest{}) }
+
+func (t *ReadOnlyFSTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create some contents.
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"foo":  "taco",
+			"dir/": "",
+		})
+
+	AssertEq(nil, err)
+
+	// Create the file system.
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		ReadOnly:             true,
+	})
+
+	AssertEq(nil, err)
+
+	// Look up the contents, as the kernel would.
+	t.foo = t.lookUp("foo")
+	t.dir = t.lookUp("dir")
+}
+
+func (t *ReadOnlyFSTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *ReadOnlyFSTest) lookUp(name string) fuseops.InodeID {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	return child.ID()
+}
+
+// Return the names and contents of all objects in the bucket.
+func (t *ReadOnlyFSTest) bucketContents() (m map[string]string) {
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+
+	m = make(map[string]string)
+	for _, o := range objects {
+		contents, err := gcsutil.ReadObject(t.ctx, t.bucket, o.Name)
+		AssertEq(nil, err)
+		m[o.Name] = string(contents)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadOnlyFSTest) MutationsFail() {
+	size := uint64(0)
+	mtime := t.clock.Now()
+	mode := os.FileMode(0600)
+
+	testCases := []struct {
+		desc string
+		f    func() error
+	}{
+		{
+			"MkDir",
+			func() error {
+				return t.fs.MkDir(&fuseops.MkDirOp{
+					Parent: fuseops.RootInodeID,
+					Name:   "bar",
+					Mode:   0700,
+				})
+			},
+		},
+
+		{
+			"CreateFile",
+			func() error {
+				return t.fs.CreateFile(&fuseops.CreateFileOp{
+					Parent: fuseops.RootInodeID,
+					Name:   "bar",
+					Mode:   0600,
+				})
+			},
+		},
+
+		{
+			"CreateSymlink",
+			func() error {
+				return t.fs.CreateSymlink(&fuseops.CreateSymlinkOp{
+					Parent: fuseops.RootInodeID,
+					Name:   "bar",
+					Target: "foo",
+				})
+			},
+		},
+
+		{
+			"RmDir",
+			func() error {
+				return t.fs.RmDir(&fuseops.RmDirOp{
+					Parent: fuseops.RootInodeID,
+					Name:   "dir",
+				})
+			},
+		},
+
+		{
+			"Unlink",
+			func() error {
+				return t.fs.Unlink(&fuseops.UnlinkOp{
+					Parent: fuseops.RootInodeID,
+					Name:   "foo",
+				})
+			},
+		},
+
+		{
+			"Rename",
+			func() error {
+				return t.fs.Rename(&fuseops.RenameOp{
+					OldParent: fuseops.RootInodeID,
+					OldName:   "foo",
+					NewParent: fuseops.RootInodeID,
+					NewName:   "bar",
+				})
+			},
+		},
+
+		{
+			"WriteFile",
+			func() error {
+				return t.fs.WriteFile(&fuseops.WriteFileOp{
+					Inode: t.foo,
+					Data:  []byte("burrito"),
+				})
+			},
+		},
+
+		{
+			"SetInodeAttributes(size)",
+			func() error {
+				return t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+					Inode: t.foo,
+					Size:  &size,
+				})
+			},
+		},
+
+		{
+			"SetInodeAttributes(mtime)",
+			func() error {
+				return t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+					Inode: t.foo,
+					Mtime: &mtime,
+				})
+			},
+		},
+
+		{
+			"SetInodeAttributes(mode)",
+			func() error {
+				return t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+					Inode: t.foo,
+					Mode:  &mode,
+				})
+			},
+		},
+
+		{
+			"OpenFile(O_RDWR)",
+			func() error {
+				return t.fs.OpenFile(&fuseops.OpenFileOp{
+					Inode: t.foo,
+					Flags: bazilfuse.OpenReadWrite,
+				})
+			},
+		},
+
+		{
+			"OpenFile(O_WRONLY)",
+			func() error {
+				return t.fs.OpenFile(&fuseops.OpenFileOp{
+					Inode: t.foo,
+					Flags: bazilfuse.OpenWriteOnly,
+				})
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		ExpectEq(errReadOnlyFS, tc.f(), "%s", tc.desc)
+	}
+
+	// The bucket should be untouched.
+	m := t.bucketContents()
+	ExpectEq(2, len(m), "%v", m)
+	ExpectEq("taco", m["foo"])
+	ExpectEq("", m["dir/"])
+}
+
+func (t *ReadOnlyFSTest) ReadingWorks() {
+	var err error
+
+	// Open for reading.
+	openOp := &fuseops.OpenFileOp{
+		Inode: t.foo,
+		Flags: bazilfuse.OpenReadOnly,
+	}
+
+	err = t.fs.OpenFile(openOp)
+	AssertEq(nil, err)
+
+	// Read.
+	readOp := &fuseops.ReadFileOp{
+		Inode:  t.foo,
+		Handle: openOp.Handle,
+		Size:   1 << 10,
+	}
+
+	err = t.fs.ReadFile(readOp)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(readOp.Data))
+
+	// Flush and release, which have nothing to do.
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{
+		Inode:  t.foo,
+		Handle: openOp.Handle,
+	})
+
+	AssertEq(nil, err)
+
+	err = t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{
+		Handle: openOp.Handle,
+	})
+
+	AssertEq(nil, err)
+}
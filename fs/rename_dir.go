@@ -0,0 +1,426 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// GCS has no way to rename a prefix, so a directory is renamed as follows:
+//
+//  *  Dirty files beneath it are synced, so that GCS has their contents.
+//
+//  *  The objects beneath it are listed, failing if there are more than
+//     ServerConfig.RenameDirLimit.
+//
+//  *  A placeholder object for the new name is made, by copying the old one
+//     if there is one, and marked with renameDirMetadataKey.
+//
+//  *  Each other object is copied to the new prefix, and then each is deleted,
+//     but only if it is still the generation that was copied.
+//
+//  *  Finally the old placeholder is deleted and the new one unmarked.
+//
+// Objects created beneath the old name after the listing are left where they
+// are. If an object is modified or deleted by someone else part way through,
+// the old placeholder is left in place and the rename fails with ESTALE.
+//
+// A destination directory must normally be empty, but one whose placeholder
+// is marked as the target of a rename from the same source is not checked.
+// So retrying a rename that failed part way finishes the job.
+
+// The custom metadata key used to mark the placeholder of a directory being
+// renamed, with the name of the source directory as the value.
+const renameDirMetadataKey = "gcsfuse_rename_from"
+
+// The error returned for directory renames that would move more objects than
+// ServerConfig.RenameDirLimit allows. As for a rename across file systems,
+// tools like mv(1) then fall back to copying and deleting.
+var errRenameDirTooLarge = bazilfuse.Errno(syscall.EXDEV)
+
+// The error returned for attempts to rename a directory beneath itself.
+var errRenameIntoSelf = bazilfuse.Errno(syscall.EINVAL)
+
+// Rename the directory with the supplied full name, as described above.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(oldParent)
+// LOCKS_EXCLUDED(newParent)
+func (fs *fileSystem) renameDir(
+	op *fuseops.RenameOp,
+	oldParent inode.DirInode,
+	newParent inode.DirInode,
+	oldPrefix string) (err error) {
+	ctx := op.Context()
+
+	if fs.renameDirLimit == 0 {
+		err = errRenameDirTooLarge
+		return
+	}
+
+	newPrefix := path.Join(newParent.Name(), op.NewName) + "/"
+	if newPrefix == oldPrefix {
+		return
+	}
+
+	if strings.HasPrefix(newPrefix, oldPrefix) {
+		err = errRenameIntoSelf
+		return
+	}
+
+	// The contents of both directories, and of every directory beneath them,
+	// may change. (Rename drops the parents' listings.) Any number of names
+	// beneath the new one may be created.
+	defer fs.dirListings.InvalidateTrees(oldPrefix, newPrefix)
+	defer fs.negativeLookups.EraseAll()
+
+	// The destination may be a directory, but not a file.
+	newParent.Lock()
+	dst, err := newParent.LookUpChild(ctx, op.NewName)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %v", err)
+		return
+	}
+
+	if dst.Exists() && !inode.IsDirName(dst.FullName) {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Make sure GCS has the latest contents of everything we're moving.
+	err = fs.syncFilesBeneath(ctx, oldPrefix)
+	if err != nil {
+		err = fmt.Errorf("syncFilesBeneath: %v", err)
+		return
+	}
+
+	// Find what there is to move.
+	srcs, tooMany, err := fs.listBeneath(ctx, oldPrefix, fs.renameDirLimit)
+	if err != nil {
+		err = fmt.Errorf("listBeneath: %v", err)
+		return
+	}
+
+	if tooMany {
+		op.Logf(
+			"Rename: %q has more than %d objects; refusing",
+			oldPrefix,
+			fs.renameDirLimit)
+
+		err = errRenameDirTooLarge
+		return
+	}
+
+	if len(srcs) == 0 {
+		err = fuse.ENOENT
+		return
+	}
+
+	// Nothing may end up deeper than MaxPathDepth allows. Rename has checked
+	// the new name itself, but not what lies beneath it.
+	if fs.maxPathDepth > 0 {
+		deepest := 0
+		for _, o := range srcs {
+			if d := pathDepth(strings.TrimPrefix(o.Name, oldPrefix)); d > deepest {
+				deepest = d
+			}
+		}
+
+		if pathDepth(newPrefix)+deepest > fs.maxPathDepth {
+			err = errPathTooDeep
+			return
+		}
+	}
+
+	// Check that the destination is empty, unless it's left over from an
+	// earlier attempt at this same rename.
+	if dst.Exists() &&
+		(dst.Object == nil || dst.Object.Metadata[renameDirMetadataKey] != oldPrefix) {
+		err = fs.checkEmptyBeneath(ctx, newPrefix)
+		if err != nil {
+			return
+		}
+	}
+
+	var placeholder *gcs.Object
+	for _, o := range srcs {
+		if o.Name == oldPrefix {
+			placeholder = o
+		}
+	}
+
+	// Make the new placeholder and mark it.
+	stale, err := fs.markRenameDirDest(op, newParent, oldPrefix, placeholder)
+	if err != nil {
+		err = fmt.Errorf("markRenameDirDest: %v", err)
+		return
+	}
+
+	// Copy everything else. Objects that have vanished in the meantime have
+	// been deleted or replaced by someone else.
+	var copied []*gcs.Object
+	for _, o := range srcs {
+		if o == placeholder {
+			continue
+		}
+
+		_, err = fs.bucket.CopyObject(
+			ctx,
+			&gcs.CopyObjectRequest{
+				SrcName:       o.Name,
+				SrcGeneration: o.Generation,
+				DstName:       newPrefix + strings.TrimPrefix(o.Name, oldPrefix),
+				DstKmsKeyName: gcsproxy.KmsKeyName(o),
+			})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			stale = true
+			err = nil
+			continue
+		}
+
+		if err != nil {
+			err = fmt.Errorf("CopyObject: %v", err)
+			return
+		}
+
+		copied = append(copied, o)
+	}
+
+	// Delete behind, leaving alone anything modified since we copied it.
+	for _, o := range copied {
+		err = fs.bucket.DeleteObject(
+			ctx,
+			&gcs.DeleteObjectRequest{
+				Name:                   o.Name,
+				GenerationPrecondition: &o.Generation,
+			})
+
+		if _, ok := err.(*gcs.PreconditionError); ok {
+			stale = true
+			err = nil
+			continue
+		}
+
+		if err != nil {
+			err = fmt.Errorf("DeleteObject: %v", err)
+			return
+		}
+	}
+
+	// Keep the old directory around for a retry if it isn't empty.
+	if stale {
+		op.Logf(
+			"Rename: objects beneath %q changed while being copied to %q",
+			oldPrefix,
+			newPrefix)
+
+		err = errRenameStale
+		return
+	}
+
+	oldParent.Lock()
+	err = oldParent.DeleteChildDir(ctx, op.OldName)
+	if err == nil {
+		fs.childCounts.Deleted(oldParent.Name())
+		fs.childCounts.Forget(oldPrefix)
+	}
+	oldParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("DeleteChildDir: %v", err)
+		return
+	}
+
+	// The rename is complete.
+	_, err = fs.bucket.UpdateObject(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     newPrefix,
+			Metadata: map[string]*string{renameDirMetadataKey: nil},
+		})
+
+	if err != nil {
+		err = fmt.Errorf("UpdateObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// Make a placeholder for the destination of a directory rename, cloning the
+// source's placeholder if non-nil, and mark it with renameDirMetadataKey.
+// Return stale if the source's placeholder has changed since it was listed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(newParent)
+func (fs *fileSystem) markRenameDirDest(
+	op *fuseops.RenameOp,
+	newParent inode.DirInode,
+	oldPrefix string,
+	placeholder *gcs.Object) (stale bool, err error) {
+	ctx := op.Context()
+
+	newParent.Lock()
+	if placeholder != nil {
+		_, err = newParent.CloneToChildDir(ctx, op.NewName, placeholder)
+	} else {
+		_, err = newParent.CreateChildDir(ctx, op.NewName)
+	}
+	newParent.Unlock()
+
+	switch err.(type) {
+	case nil:
+
+	// The source's placeholder has gone. Make do with the destination's, if
+	// any.
+	case *gcs.NotFoundError:
+		stale = true
+		err = nil
+
+	// The destination already has a placeholder, which we'll mark.
+	case *gcs.PreconditionError:
+		err = nil
+
+	default:
+		return
+	}
+
+	newPrefix := path.Join(newParent.Name(), op.NewName) + "/"
+	_, err = fs.bucket.UpdateObject(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     newPrefix,
+			Metadata: map[string]*string{renameDirMetadataKey: &oldPrefix},
+		})
+
+	if err != nil {
+		err = fmt.Errorf("UpdateObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return fuse.ENOTEMPTY if there are objects beneath the supplied directory
+// name other than its placeholder.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) checkEmptyBeneath(
+	ctx context.Context,
+	prefix string) (err error) {
+	objects, tooMany, err := fs.listBeneath(ctx, prefix, 1)
+	if err != nil {
+		err = fmt.Errorf("listBeneath: %v", err)
+		return
+	}
+
+	if tooMany || (len(objects) == 1 && objects[0].Name != prefix) {
+		err = fuse.ENOTEMPTY
+		return
+	}
+
+	return
+}
+
+// List the objects whose names begin with the supplied prefix, giving up and
+// setting tooMany if there are more than limit.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) listBeneath(
+	ctx context.Context,
+	prefix string,
+	limit int) (objects []*gcs.Object, tooMany bool, err error) {
+	req := &gcs.ListObjectsRequest{
+		Prefix:     prefix,
+		MaxResults: limit + 1,
+	}
+
+	for {
+		var listing *gcs.Listing
+		listing, err = fs.bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		objects = append(objects, listing.Objects...)
+		if len(objects) > limit {
+			objects = nil
+			tooMany = true
+			return
+		}
+
+		if listing.ContinuationToken == "" {
+			return
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+// Sync every file inode beneath the supplied directory name that has local
+// modifications. Those whose objects have been clobbered are skipped, having
+// reported so already; what is in GCS is moved in their place.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) syncFilesBeneath(
+	ctx context.Context,
+	prefix string) (err error) {
+	var files []*inode.FileInode
+
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		f, ok := in.(*inode.FileInode)
+		if ok && strings.HasPrefix(f.Name(), prefix) {
+			files = append(files, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, f := range files {
+		f.Lock()
+
+		var dirty bool
+		dirty, _, err = f.Dirty(ctx)
+		if err == nil && dirty && f.Stale() == nil {
+			err = fs.syncFile(ctx, f)
+			if err == errStale {
+				err = nil
+			}
+		}
+
+		f.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
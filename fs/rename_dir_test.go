@@ -0,0 +1,387 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for renaming directories, with ServerConfig.RenameDirLimit set to
+// renameDirTestLimit unless a test says otherwise. The bucket starts out with
+// an explicit directory "foo" containing a file and an implicit directory.
+type RenameDirTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket racingBucket
+	fs     *fileSystem
+}
+
+const renameDirTestLimit = 5
+
+func init() { RegisterTestSuite(&RenameDirTest{}) }
+
+func (t *RenameDirTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket.Bucket,
+		map[string]string{
+			"foo/":          "",
+			"foo/taco":      "burrito",
+			"foo/baz/qux":   "enchilada",
+			"unrelated.txt": "",
+		})
+
+	AssertEq(nil, err)
+
+	t.mount(renameDirTestLimit)
+}
+
+func (t *RenameDirTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Create the file system afresh, with the supplied limit.
+func (t *RenameDirTest) mount(limit int) {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		ImplicitDirectories:  true,
+		RenameDirLimit:       limit,
+	})
+
+	AssertEq(nil, err)
+}
+
+// Look up the named child of the root, returning its inode ID.
+func (t *RenameDirTest) lookUp(name string) fuseops.InodeID {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(op))
+	return op.Entry.Child
+}
+
+// Rename the named child of the root to another name within the root.
+func (t *RenameDirTest) rename(oldName string, newName string) (err error) {
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   oldName,
+		NewParent: fuseops.RootInodeID,
+		NewName:   newName,
+	})
+
+	return
+}
+
+// Return the names of all objects in the bucket.
+func (t *RenameDirTest) objectNames() (names []string) {
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket.Bucket,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+// Return the metadata of the named object.
+func (t *RenameDirTest) metadata(name string) map[string]string {
+	o, err := t.bucket.Bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: name})
+
+	AssertEq(nil, err)
+	return o.Metadata
+}
+
+func (t *RenameDirTest) read(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, name)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RenameDirTest) Disabled() {
+	t.mount(0)
+
+	err := t.rename("foo", "bar")
+	ExpectEq(errRenameDirTooLarge, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("foo/", "foo/baz/qux", "foo/taco", "unrelated.txt"))
+}
+
+func (t *RenameDirTest) OverLimit() {
+	t.mount(2)
+
+	err := t.rename("foo", "bar")
+	ExpectEq(errRenameDirTooLarge, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("foo/", "foo/baz/qux", "foo/taco", "unrelated.txt"))
+}
+
+func (t *RenameDirTest) ExplicitDirectory() {
+	err := t.rename("foo", "bar")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("bar/", "bar/baz/qux", "bar/taco", "unrelated.txt"))
+
+	ExpectEq("burrito", t.read("bar/taco"))
+	ExpectEq("enchilada", t.read("bar/baz/qux"))
+
+	// The rename is no longer marked as in progress.
+	_, ok := t.metadata("bar/")[renameDirMetadataKey]
+	ExpectFalse(ok)
+
+	// The new name should be looked up as a directory, and the old one not at
+	// all.
+	t.lookUp("bar")
+
+	err = t.fs.LookUpInode(&fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	})
+
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *RenameDirTest) ImplicitDirectory() {
+	// Move the implicit directory out of foo.
+	fooID := t.lookUp("foo")
+
+	err := t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fooID,
+		OldName:   "baz",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "bar",
+	})
+
+	AssertEq(nil, err)
+
+	// The new directory should have been given a placeholder.
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("bar/", "bar/qux", "foo/", "foo/taco", "unrelated.txt"))
+}
+
+func (t *RenameDirTest) AcrossDirectories() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "dir/", "")
+	AssertEq(nil, err)
+
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo",
+		NewParent: t.lookUp("dir"),
+		NewName:   "bar",
+	})
+
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre(
+			"dir/",
+			"dir/bar/",
+			"dir/bar/baz/qux",
+			"dir/bar/taco",
+			"unrelated.txt"))
+}
+
+func (t *RenameDirTest) IntoItself() {
+	fooID := t.lookUp("foo")
+
+	err := t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo",
+		NewParent: fooID,
+		NewName:   "bar",
+	})
+
+	ExpectEq(errRenameIntoSelf, err)
+}
+
+func (t *RenameDirTest) DestinationIsEmptyDirectory() {
+	placeholder, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "bar/", "")
+	AssertEq(nil, err)
+
+	err = t.rename("foo", "bar")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("bar/", "bar/baz/qux", "bar/taco", "unrelated.txt"))
+
+	// The destination's placeholder was kept rather than cloned over, and is
+	// no longer marked.
+	o, err := t.bucket.Bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "bar/"})
+
+	AssertEq(nil, err)
+	ExpectEq(placeholder.Generation, o.Generation)
+
+	_, ok := o.Metadata[renameDirMetadataKey]
+	ExpectFalse(ok)
+}
+
+func (t *RenameDirTest) DestinationIsNonEmptyDirectory() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "bar/other", "")
+	AssertEq(nil, err)
+
+	err = t.rename("foo", "bar")
+	ExpectEq(fuse.ENOTEMPTY, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre(
+			"bar/other",
+			"foo/",
+			"foo/baz/qux",
+			"foo/taco",
+			"unrelated.txt"))
+}
+
+func (t *RenameDirTest) DestinationIsFile() {
+	err := t.rename("foo", "unrelated.txt")
+	ExpectEq(fuse.ENOTDIR, err)
+}
+
+func (t *RenameDirTest) DirtyFile() {
+	// Write to foo/taco without flushing.
+	fooID := t.lookUp("foo")
+
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fooID,
+		Name:   "taco",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(lookUpOp))
+
+	openOp := &fuseops.OpenFileOp{Inode: lookUpOp.Entry.Child}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  lookUpOp.Entry.Child,
+		Handle: openOp.Handle,
+		Data:   []byte("tostada"),
+	})
+
+	AssertEq(nil, err)
+
+	// The write should move along with the directory.
+	err = t.rename("foo", "bar")
+	AssertEq(nil, err)
+
+	ExpectEq("tostada", t.read("bar/taco"))
+}
+
+func (t *RenameDirTest) CreationDuringRename() {
+	// Someone creates a file in the old directory after it's been listed. It's
+	// left behind, but the rename succeeds.
+	t.bucket.beforeCopy = func() {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo/new", "")
+		AssertEq(nil, err)
+	}
+
+	err := t.rename("foo", "bar")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre(
+			"bar/",
+			"bar/baz/qux",
+			"bar/taco",
+			"foo/new",
+			"unrelated.txt"))
+}
+
+func (t *RenameDirTest) ModificationDuringRenameThenRetry() {
+	// Someone overwrites a file in the old directory after it's been copied.
+	t.bucket.beforeDelete = func() {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo/taco", "queso")
+		AssertEq(nil, err)
+	}
+
+	err := t.rename("foo", "bar")
+	ExpectEq(errRenameStale, err)
+
+	// The old directory should be left with just the modified file, and the new
+	// one should be complete but stale.
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre(
+			"bar/",
+			"bar/baz/qux",
+			"bar/taco",
+			"foo/",
+			"foo/taco",
+			"unrelated.txt"))
+
+	ExpectEq("burrito", t.read("bar/taco"))
+	ExpectEq("foo/", t.metadata("bar/")[renameDirMetadataKey])
+
+	// Retrying should finish the job, despite the destination not being empty.
+	err = t.rename("foo", "bar")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("bar/", "bar/baz/qux", "bar/taco", "unrelated.txt"))
+
+	ExpectEq("queso", t.read("bar/taco"))
+}
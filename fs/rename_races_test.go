@@ -0,0 +1,332 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that runs hooks just before copying and deleting objects, letting
+// tests interleave other changes with the file system's own deterministically.
+// Each hook runs once.
+type racingBucket struct {
+	gcs.Bucket
+	beforeCopy   func()
+	beforeDelete func()
+}
+
+func (b *racingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	if f := b.beforeCopy; f != nil {
+		b.beforeCopy = nil
+		f()
+	}
+
+	o, err = b.Bucket.CopyObject(ctx, req)
+	return
+}
+
+func (b *racingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if f := b.beforeDelete; f != nil {
+		b.beforeDelete = nil
+		f()
+	}
+
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
+
+// Tests of renames and unlinks, including those racing with other changes to
+// the same objects, driving the file system directly through its op methods.
+type RenameRacesTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket racingBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&RenameRacesTest{}) }
+
+func (t *RenameRacesTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket.Bucket,
+		map[string]string{
+			"foo.tmp": "taco",
+		})
+
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *RenameRacesTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *RenameRacesTest) rename() (err error) {
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo.tmp",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "foo",
+	})
+
+	return
+}
+
+// Move foo.tmp to foo directly in the bucket, as an earlier attempt at the
+// rename would have.
+func (t *RenameRacesTest) moveBehindOurBack() {
+	_, err := t.bucket.Bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo.tmp", DstName: "foo"})
+
+	AssertEq(nil, err)
+
+	err = t.bucket.Bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "foo.tmp"})
+
+	AssertEq(nil, err)
+}
+
+func (t *RenameRacesTest) expectMoved() {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo.tmp")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RenameRacesTest) NoRace() {
+	err := t.rename()
+	AssertEq(nil, err)
+
+	t.expectMoved()
+}
+
+func (t *RenameRacesTest) SourceMovedBeforeCopy() {
+	t.bucket.beforeCopy = t.moveBehindOurBack
+
+	err := t.rename()
+	AssertEq(nil, err)
+
+	t.expectMoved()
+}
+
+func (t *RenameRacesTest) SourceDeletedBehindCopy() {
+	// The copy succeeds, but by the time we delete behind, the source has
+	// already gone.
+	t.bucket.beforeDelete = func() {
+		err := t.bucket.Bucket.DeleteObject(
+			t.ctx,
+			&gcs.DeleteObjectRequest{Name: "foo.tmp"})
+
+		AssertEq(nil, err)
+	}
+
+	err := t.rename()
+	AssertEq(nil, err)
+
+	t.expectMoved()
+}
+
+func (t *RenameRacesTest) SourceDeletedBeforeCopy() {
+	// The source disappears without the destination ever being written, so the
+	// rename genuinely didn't happen.
+	t.bucket.beforeCopy = func() {
+		err := t.bucket.Bucket.DeleteObject(
+			t.ctx,
+			&gcs.DeleteObjectRequest{Name: "foo.tmp"})
+
+		AssertEq(nil, err)
+	}
+
+	err := t.rename()
+	ExpectEq(fuse.ENOENT, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *RenameRacesTest) SourceOverwrittenBeforeCopy() {
+	// Someone else replaces the source, and another copy of different contents
+	// lands at the destination. Neither is the rename we were asked for.
+	t.bucket.beforeCopy = func() {
+		err := gcsutil.CreateObjects(
+			t.ctx,
+			t.bucket.Bucket,
+			map[string]string{
+				"foo.tmp": "burrito",
+				"foo":     "enchilada",
+			})
+
+		AssertEq(nil, err)
+	}
+
+	err := t.rename()
+	ExpectEq(fuse.ENOENT, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+}
+
+func (t *RenameRacesTest) SourceOverwrittenBehindCopy() {
+	// The copy succeeds, but the source is replaced before we delete behind.
+	// The new contents must survive, and the caller must hear about it.
+	t.bucket.beforeDelete = func() {
+		_, err := gcsutil.CreateObject(
+			t.ctx,
+			t.bucket.Bucket,
+			"foo.tmp",
+			"burrito")
+
+		AssertEq(nil, err)
+	}
+
+	err := t.rename()
+	ExpectEq(errRenameStale, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo.tmp")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *RenameRacesTest) DirtySource() {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	// Open the source and write to it without flushing.
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo.tmp")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	openOp := &fuseops.OpenFileOp{Inode: child.ID()}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	err = t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  child.ID(),
+		Handle: openOp.Handle,
+		Data:   []byte("burrito"),
+	})
+
+	AssertEq(nil, err)
+
+	// The rename should carry the write along.
+	err = t.rename()
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo.tmp")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *RenameRacesTest) OverwritesDestination() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	err = t.rename()
+	AssertEq(nil, err)
+
+	t.expectMoved()
+}
+
+func (t *RenameRacesTest) AcrossDirectories() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "dir/", "")
+	AssertEq(nil, err)
+
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(lookUpOp))
+
+	err = t.fs.Rename(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo.tmp",
+		NewParent: lookUpOp.Entry.Child,
+		NewName:   "foo",
+	})
+
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "dir/foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo.tmp")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *RenameRacesTest) UnlinkAlreadyDeleted() {
+	t.bucket.beforeDelete = func() {
+		err := t.bucket.Bucket.DeleteObject(
+			t.ctx,
+			&gcs.DeleteObjectRequest{Name: "foo.tmp"})
+
+		AssertEq(nil, err)
+	}
+
+	err := t.fs.Unlink(&fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo.tmp",
+	})
+
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestReplay(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Runs a file system scenario against a recording of GCS.
+type ReplayTest struct {
+	ctx context.Context
+}
+
+func init() { RegisterTestSuite(&ReplayTest{}) }
+
+func (t *ReplayTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+}
+
+// Run a small scenario against a file system backed by the supplied bucket,
+// returning a summary of what was observed.
+func (t *ReplayTest) scenario(bucket gcs.Bucket) (summary string) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	_, err := gcsutil.CreateObject(t.ctx, bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	fs, err := newFileSystem(&ServerConfig{
+		Clock:                &clock,
+		Bucket:               bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+	defer fs.Destroy()
+
+	// Open foo.
+	fs.mu.Lock()
+	root := fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	fs.mu.Unlock()
+
+	child, err := fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	openOp := &fuseops.OpenFileOp{Inode: child.ID()}
+	AssertEq(nil, fs.OpenFile(openOp))
+
+	// Read it, overwrite it, and read it again.
+	read := func() string {
+		op := &fuseops.ReadFileOp{
+			Inode:  child.ID(),
+			Handle: openOp.Handle,
+			Size:   16,
+		}
+
+		AssertEq(nil, fs.ReadFile(op))
+		return string(op.Data)
+	}
+
+	before := read()
+
+	err = fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  child.ID(),
+		Handle: openOp.Handle,
+		Data:   []byte("burrito"),
+	})
+
+	AssertEq(nil, err)
+
+	err = fs.FlushFile(&fuseops.FlushFileOp{
+		Inode:  child.ID(),
+		Handle: openOp.Handle,
+	})
+
+	AssertEq(nil, err)
+
+	after := read()
+
+	// Check what made it to GCS.
+	o, err := bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	summary = fmt.Sprintf(
+		"%q %q size=%d generation=%d",
+		before,
+		after,
+		o.Size,
+		o.Generation)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReplayTest) ScenarioReplaysFromCassette() {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	// Record the scenario against a fake bucket.
+	recorder := gcsproxy.NewRecordBucket(
+		gcsfake.NewFakeBucket(&clock, "some_bucket"),
+		gcsproxy.ScrubOptions{BucketName: true})
+
+	recorded := t.scenario(recorder)
+	ExpectEq(`"taco" "burrito" size=7 generation=2`, recorded)
+
+	var buf bytes.Buffer
+	AssertEq(nil, recorder.Cassette().Encode(&buf))
+
+	// Play it back with no bucket at all.
+	c, err := gcsproxy.DecodeCassette(&buf)
+	AssertEq(nil, err)
+
+	replayer, err := gcsproxy.NewReplayBucket(c, 4)
+	AssertEq(nil, err)
+
+	ExpectEq(recorded, t.scenario(replayer))
+	ExpectEq(nil, replayer.Finish())
+}
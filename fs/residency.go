@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"golang.org/x/net/context"
+)
+
+// The number of files listed by the residency handler when the request
+// doesn't say.
+const defaultResidencySummarySize = 20
+
+// Information about how much of a file's contents are held locally.
+type fileResidency struct {
+	Name     string
+	Resident int64
+	Size     int64
+}
+
+func (fr fileResidency) Ratio() float64 {
+	if fr.Size == 0 {
+		return 0
+	}
+
+	return float64(fr.Resident) / float64(fr.Size)
+}
+
+type residenciesByResident []fileResidency
+
+func (s residenciesByResident) Len() int      { return len(s) }
+func (s residenciesByResident) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s residenciesByResident) Less(i, j int) bool {
+	if s[i].Resident != s[j].Resident {
+		return s[i].Resident > s[j].Resident
+	}
+
+	return s[i].Name < s[j].Name
+}
+
+// Return residency information for the n files known to the file system with
+// the most bytes held locally, in decreasing order.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) residencySummary(
+	ctx context.Context,
+	n int) (files []fileResidency) {
+	// Grab the file inodes. We must not lock them while holding fs.mu.
+	var inodes []*inode.FileInode
+
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok {
+			inodes = append(inodes, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	// Ask each for its residency.
+	for _, f := range inodes {
+		f.Lock()
+		resident, size, err := f.Residency(ctx)
+		f.Unlock()
+
+		if err != nil {
+			logger.Errorf("Residency for %q: %v", f.Name(), err)
+			continue
+		}
+
+		if resident == 0 {
+			continue
+		}
+
+		files = append(files, fileResidency{
+			Name:     f.Name(),
+			Resident: resident,
+			Size:     size,
+		})
+	}
+
+	// Keep the top n.
+	sort.Sort(residenciesByResident(files))
+	if len(files) > n {
+		files = files[:n]
+	}
+
+	return
+}
+
+// Serve a plain text summary of the files with the most bytes held locally,
+// one per line. The optional "n" query parameter controls how many are listed.
+// Given "format=json", serve instead a complete ResidencySnapshot.
+func (fs *fileSystem) serveResidency(
+	w http.ResponseWriter,
+	r *http.Request) {
+	n := defaultResidencySummarySize
+	if s := r.FormValue("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("Invalid n: %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Export what's resident for warming up another mount, if asked.
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(fs.residencySnapshot())
+		if err != nil {
+			logger.Errorf("Encoding residency snapshot: %v", err)
+		}
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%16s %16s %8s  %s\n", "cached_bytes", "size", "ratio", "name")
+
+	for _, fr := range fs.residencySummary(context.Background(), n) {
+		fmt.Fprintf(
+			w,
+			"%16d %16d %8.3f  %s\n",
+			fr.Resident,
+			fr.Size,
+			fr.Ratio(),
+			fr.Name)
+	}
+}
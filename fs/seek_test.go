@@ -0,0 +1,200 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestSeek(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SeekTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// An open handle for the object foo, whose contents are "taco".
+	id fuseops.InodeID
+	h  fuseops.HandleID
+}
+
+var _ SetUpInterface = &SeekTest{}
+var _ TearDownInterface = &SeekTest{}
+
+func init() { RegisterTestSuite(&SeekTest{}) }
+
+func (t *SeekTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 24,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+
+	// Look up and open foo.
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	t.id = child.ID()
+
+	openOp := &fuseops.OpenFileOp{Inode: t.id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+	t.h = openOp.Handle
+}
+
+func (t *SeekTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *SeekTest) seek(
+	offset int64,
+	whence fuseops.Whence) (n int64, err error) {
+	op := &fuseops.SeekFileOp{
+		Inode:  t.id,
+		Handle: t.h,
+		Offset: offset,
+		Whence: whence,
+	}
+
+	err = t.fs.SeekFile(op)
+	n = op.ResultOffset
+	return
+}
+
+func (t *SeekTest) write(data string, offset int64) {
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  t.id,
+		Handle: t.h,
+		Offset: offset,
+		Data:   []byte(data),
+	})
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SeekTest) CleanFile() {
+	var n int64
+	var err error
+
+	// Everything up to the end is data.
+	n, err = t.seek(0, fuseops.WhenceData)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+
+	n, err = t.seek(2, fuseops.WhenceData)
+	AssertEq(nil, err)
+	ExpectEq(2, n)
+
+	n, err = t.seek(0, fuseops.WhenceHole)
+	AssertEq(nil, err)
+	ExpectEq(4, n)
+
+	n, err = t.seek(3, fuseops.WhenceHole)
+	AssertEq(nil, err)
+	ExpectEq(4, n)
+
+	// There's nothing at or beyond the end.
+	_, err = t.seek(4, fuseops.WhenceData)
+	ExpectEq(errSeekNotFound, err)
+
+	_, err = t.seek(4, fuseops.WhenceHole)
+	ExpectEq(errSeekNotFound, err)
+}
+
+func (t *SeekTest) SparseDirtyFile() {
+	const offset = 1 << 22
+
+	var n int64
+	var err error
+
+	// Write far beyond the end of the existing contents.
+	t.write("burrito", offset)
+
+	// The old contents are still data, and so is the new write.
+	n, err = t.seek(0, fuseops.WhenceData)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+
+	n, err = t.seek(offset+3, fuseops.WhenceData)
+	AssertEq(nil, err)
+	ExpectEq(offset+3, n)
+
+	n, err = t.seek(offset, fuseops.WhenceHole)
+	AssertEq(nil, err)
+	ExpectEq(offset+len("burrito"), n)
+
+	_, err = t.seek(offset+int64(len("burrito")), fuseops.WhenceData)
+	ExpectEq(errSeekNotFound, err)
+
+	// On Linux the hole in between should be found, though the file system
+	// may round the extents to blocks.
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	n, err = t.seek(0, fuseops.WhenceHole)
+	AssertEq(nil, err)
+	ExpectGe(n, 4)
+	ExpectLt(n, offset)
+
+	n, err = t.seek(offset/2, fuseops.WhenceData)
+	AssertEq(nil, err)
+	ExpectGt(n, offset/2)
+	ExpectLe(n, offset)
+}
+
+func (t *SeekTest) OtherWhence() {
+	_, err := t.seek(0, fuseops.Whence(0))
+	ExpectEq(errSeekWhence, err)
+}
@@ -0,0 +1,315 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ServerConfigTest struct {
+	clock timeutil.SimulatedClock
+}
+
+func init() { RegisterTestSuite(&ServerConfigTest{}) }
+
+// Return a config that passes validation without any defaulting.
+func (t *ServerConfigTest) validConfig() (cfg fs.ServerConfig) {
+	cfg = fs.ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		FilePerms:            0640,
+		DirPerms:             0750,
+		AppendThreshold:      0,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ServerConfigTest) ValidConfig() {
+	cfg := t.validConfig()
+	ExpectEq(nil, fs.ValidateServerConfig(&cfg))
+
+	// Nothing should have been defaulted.
+	ExpectEq(&t.clock, cfg.Clock)
+	ExpectEq(os.FileMode(0640), cfg.FilePerms)
+	ExpectEq(os.FileMode(0750), cfg.DirPerms)
+}
+
+func (t *ServerConfigTest) Defaults() {
+	cfg := t.validConfig()
+	cfg.Clock = nil
+	cfg.FilePerms = 0
+	cfg.DirPerms = 0
+
+	AssertEq(nil, fs.ValidateServerConfig(&cfg))
+
+	ExpectTrue(cfg.Clock != nil)
+	ExpectEq(os.FileMode(0644), cfg.FilePerms)
+	ExpectEq(os.FileMode(0755), cfg.DirPerms)
+}
+
+func (t *ServerConfigTest) IndividualProblems() {
+	testCases := []struct {
+		modify   func(cfg *fs.ServerConfig)
+		expected string
+	}{
+		{
+			func(cfg *fs.ServerConfig) { cfg.Bucket = nil },
+			"Bucket must be set",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.OnlyDir = "foo//bar" },
+			`Illegal OnlyDir: "foo//bar"`,
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.OnlyDir = "/foo/../bar/" },
+			`Illegal OnlyDir: "/foo/../bar/"`,
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.FilePerms = 0644 | os.ModeSetuid },
+			"Illegal FilePerms",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.DirPerms = 0755 | os.ModeDir },
+			"Illegal DirPerms",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TempDirLimitNumFiles = 0 },
+			"TempDirLimitNumFiles must be positive (got 0)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TempDirLimitBytes = 0 },
+			"TempDirLimitBytes must be positive (got 0)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TempDirLimitBytes = -1 },
+			"TempDirLimitBytes must be positive (got -1)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TempDirLimitBytesPerFile = -1 },
+			"TempDirLimitBytesPerFile must be non-negative (got -1)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.ReadaheadChunks = -1 },
+			"ReadaheadChunks must be non-negative (got -1)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.DirTypeCacheTTL = -time.Second },
+			"DirTypeCacheTTL must be non-negative",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TombstoneTTL = -time.Second },
+			"TombstoneTTL must be non-negative",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.AppendThreshold = -1 },
+			"AppendThreshold must be non-negative (got -1)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.ResumableUploadThreshold = -1 },
+			"ResumableUploadThreshold must be non-negative (got -1)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TmpObjectPrefix = "/tmp/" },
+			"Illegal TmpObjectPrefix",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TmpObjectPrefix = "a//tmp/" },
+			"Illegal TmpObjectPrefix",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TmpObjectPrefix = "../tmp/" },
+			"Illegal TmpObjectPrefix",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) {
+				cfg.OnlyDir = "some/dir"
+				cfg.TmpObjectPrefix = "some/dir/.gcsfuse_tmp/"
+			},
+			"must not repeat it",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TmpObjectPrefix = "" },
+			"TmpObjectPrefix must be set",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TmpObjectPrefix = ".gcsfuse_tmp" },
+			"TmpObjectPrefix must end with '/'",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.RejectSparseWritesOver = -1 },
+			"RejectSparseWritesOver must be non-negative (got -1)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.MaxOpenHandles = -1 },
+			"MaxOpenHandles must be non-negative (got -1)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.HandleIdleTimeout = -time.Second },
+			"HandleIdleTimeout must be non-negative (got -1s)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.HandleIdleTimeout = time.Nanosecond },
+			"HandleIdleTimeout must be zero or at least 1s (got 1ns)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.DirtySyncInterval = -time.Second },
+			"DirtySyncInterval must be non-negative (got -1s)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.DirtySyncInterval = time.Nanosecond },
+			"DirtySyncInterval must be zero or at least 1s (got 1ns)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.AtimeMode = fs.AtimeMode(17) },
+			"Unknown AtimeMode: AtimeMode(17)",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.AtimeMode = fs.AtimePersistRelatime },
+			"AtimePersistInterval must be positive with AtimePersistRelatime",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) {
+				cfg.AtimeMode = fs.AtimePersistRelatime
+				cfg.AtimePersistInterval = time.Hour
+				cfg.ReadOnly = true
+			},
+			"AtimePersistRelatime can't be used with ReadOnly",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.TranscodeGzipSuffixes = []string{""} },
+			"Illegal TranscodeGzipSuffixes entry",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) {
+				cfg.TranscodeGzipSuffixes = []string{".gz", "/.gz"}
+			},
+			`Illegal TranscodeGzipSuffixes entry: "/.gz"`,
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.DropTranscodedGzipSuffix = true },
+			"DropTranscodedGzipSuffix requires TranscodeGzipSuffixes",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.ListingDeniedEACCES = true },
+			"ListingDeniedEACCES requires ListingDenied",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) { cfg.MtimeLayouts = []string{""} },
+			"Illegal MtimeLayouts entry",
+		},
+
+		{
+			func(cfg *fs.ServerConfig) {
+				cfg.DefaultMetadata = []string{"public/:color=blue"}
+			},
+			"Illegal DefaultMetadata",
+		},
+	}
+
+	for i, tc := range testCases {
+		cfg := t.validConfig()
+		tc.modify(&cfg)
+
+		err := fs.ValidateServerConfig(&cfg)
+		AssertNe(nil, err, "Test case %d", i)
+
+		typed, ok := err.(*fs.ServerConfigError)
+		AssertTrue(ok, "Test case %d: %T", i, err)
+		AssertEq(1, len(typed.Problems), "Test case %d: %v", i, typed.Problems)
+		ExpectThat(typed.Problems[0], HasSubstr(tc.expected), "Test case %d", i)
+	}
+}
+
+func (t *ServerConfigTest) MultipleProblems() {
+	cfg := t.validConfig()
+	cfg.Bucket = nil
+	cfg.TempDirLimitBytes = 0
+	cfg.TmpObjectPrefix = "foo"
+
+	err := fs.ValidateServerConfig(&cfg)
+	AssertNe(nil, err)
+
+	typed, ok := err.(*fs.ServerConfigError)
+	AssertTrue(ok, "%T", err)
+	ExpectThat(
+		typed.Problems,
+		ElementsAre(
+			HasSubstr("Bucket"),
+			HasSubstr("TempDirLimitBytes"),
+			HasSubstr("TmpObjectPrefix")))
+
+	ExpectThat(err, Error(HasSubstr("Bucket must be set")))
+	ExpectThat(err, Error(HasSubstr("TmpObjectPrefix must end with '/'")))
+}
+
+func (t *ServerConfigTest) NewServerRejectsInvalidConfig() {
+	cfg := t.validConfig()
+	cfg.TmpObjectPrefix = ""
+
+	_, err := fs.NewServer(&cfg)
+	ExpectThat(err, Error(HasSubstr("TmpObjectPrefix must be set")))
+}
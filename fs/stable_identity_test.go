@@ -0,0 +1,193 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for file systems configured with ServerConfig.StableIdentity.
+
+package fs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StableIdentityTest struct {
+	fsTest
+	ti *TestInfo
+}
+
+func init() { RegisterTestSuite(&StableIdentityTest{}) }
+
+func (t *StableIdentityTest) SetUp(ti *TestInfo) {
+	t.ti = ti
+	t.serverCfg.StableIdentity = true
+	t.fsTest.SetUp(ti)
+}
+
+// Unmount, then mount a fresh server over the same bucket.
+func (t *StableIdentityTest) restart() {
+	t.fsTest.TearDown()
+	t.f1 = nil
+	t.f2 = nil
+
+	t.fsTest.SetUp(t.ti)
+}
+
+// Return the inode ID and change time for the given path.
+func (t *StableIdentityTest) identity(name string) (ino uint64, ctime string) {
+	fi, err := os.Stat(path.Join(t.mfs.Dir(), name))
+	AssertEq(nil, err)
+
+	ino = fi.Sys().(*syscall.Stat_t).Ino
+	ctime = extractCtime(fi.Sys()).String()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StableIdentityTest) RestartPreservesIdentity() {
+	var err error
+
+	// Set up some contents.
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"foo":     "taco",
+				"dir/":    "",
+				"dir/bar": "burrito",
+			}))
+
+	// Record identities.
+	names := []string{"foo", "dir", "dir/bar"}
+	inos := make(map[string]uint64)
+	ctimes := make(map[string]string)
+	for _, n := range names {
+		inos[n], ctimes[n] = t.identity(n)
+	}
+
+	// Distinct names should have distinct IDs.
+	ExpectNe(inos["foo"], inos["dir"])
+	ExpectNe(inos["foo"], inos["dir/bar"])
+	ExpectNe(inos["dir"], inos["dir/bar"])
+
+	// Restart over the unmodified bucket. Nothing should have changed.
+	t.restart()
+
+	for _, n := range names {
+		ino, ctime := t.identity(n)
+		ExpectEq(inos[n], ino, "Name: %s", n)
+		ExpectEq(ctimes[n], ctime, "Name: %s", n)
+	}
+
+	// Reading a file shouldn't change anything either.
+	t.f1, err = os.Open(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	_, err = ioutil.ReadAll(t.f1)
+	AssertEq(nil, err)
+
+	ino, ctime := t.identity("foo")
+	ExpectEq(inos["foo"], ino)
+	ExpectEq(ctimes["foo"], ctime)
+}
+
+func (t *StableIdentityTest) OverwriteChangesChangeTime() {
+	var err error
+
+	// Create an object and record its change time.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	_, ctime0 := t.identity("foo")
+
+	// Overwrite it.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	_, ctime1 := t.identity("foo")
+	ExpectNe(ctime0, ctime1)
+
+	// After a restart, the new change time should persist.
+	t.restart()
+
+	_, ctime2 := t.identity("foo")
+	ExpectEq(ctime1, ctime2)
+}
+
+func (t *StableIdentityTest) LocalModificationChangesChangeTime() {
+	var err error
+
+	// Create an object and record its change time.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	ino0, ctime0 := t.identity("foo")
+
+	// Modify it locally and flush.
+	t.f1, err = os.OpenFile(path.Join(t.mfs.Dir(), "foo"), os.O_WRONLY, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("burrito"))
+	AssertEq(nil, err)
+
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	// The ID stays the same but the change time doesn't.
+	ino1, ctime1 := t.identity("foo")
+	ExpectEq(ino0, ino1)
+	ExpectNe(ctime0, ctime1)
+}
+
+func (t *StableIdentityTest) OverwriteWhileOpen() {
+	var err error
+
+	// Create an object and open it, forcing the kernel to hold on to the inode.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.f1, err = os.Open(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	fi, err := t.f1.Stat()
+	AssertEq(nil, err)
+	ino0 := fi.Sys().(*syscall.Stat_t).Ino
+
+	// Overwrite the object. The new generation is a distinct file, and can't
+	// share the ID of the inode that is still open, so it gets another one.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	ino1, _ := t.identity("foo")
+	ExpectNe(ino0, ino1)
+
+	// After a restart, with nothing else live, the name gets its stable ID
+	// back.
+	t.restart()
+
+	ino2, _ := t.identity("foo")
+	ExpectEq(ino0, ino2)
+}
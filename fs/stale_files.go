@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Bring the supplied file inode up to date with its object in GCS, if another
+// client has overwritten the object and the inode has no local modifications.
+// See inode.FileInode.Refresh.
+//
+// Lookups notice overwrites by themselves, but the kernel doesn't always look
+// a file up before opening it, for example when it is reached through an NFS
+// file handle. Without this, such opens would keep being served the contents
+// of the old generation for as long as the inode lives.
+//
+// An inode that a lookup has already replaced with one for a newer generation
+// is a distinct file from the kernel's point of view (see the "Identity"
+// section of docs/semantics.md), and is left alone. So is one whose object has
+// been deleted: there is nothing newer to present, and it continues to appear
+// unlinked.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(in)
+func (fs *fileSystem) refreshStaleFile(
+	ctx context.Context,
+	in *inode.FileInode) (err error) {
+	if !fs.isCurrentFileInode(in) {
+		return
+	}
+
+	// Stat the object without holding the inode lock, so that reads and writes
+	// through other handles needn't wait for GCS. The bucket answers from the
+	// stat cache, if enabled, so opens that follow closely on a lookup cost no
+	// further requests.
+	o, err := fs.bucket.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: in.Name()})
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	// Holding the inode lock keeps lookups from replacing the inode while we
+	// work, so check again that they haven't already.
+	in.Lock()
+	defer in.Unlock()
+
+	if !fs.isCurrentFileInode(in) {
+		return
+	}
+
+	refreshed, err := in.Refresh(ctx, o)
+	if err != nil {
+		err = fmt.Errorf("Refresh: %v", err)
+		return
+	}
+
+	// The kernel may have cached attributes or content for the old generation.
+	if refreshed {
+		fs.counters.recordStaleFileRefreshed()
+		fs.invalidateInode(in.ID())
+	}
+
+	return
+}
+
+// Is the supplied inode the one that lookups of its name currently find?
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) isCurrentFileInode(in *inode.FileInode) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.generationBackedInodes[in.Name()] == in
+}
@@ -0,0 +1,368 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStaleFiles(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for file inodes whose objects have been overwritten or deleted by
+// another client, when opened without the kernel looking them up again first
+// and when their local modifications are synced. The bucket starts out with a
+// file "foo" containing "taco". The file system sees it through gated, so that
+// tests can hold up its stats.
+type StaleFilesTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	gated  countingReadsBucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&StaleFilesTest{}) }
+
+func (t *StaleFilesTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.gated.Bucket = t.bucket
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               &t.gated,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *StaleFilesTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *StaleFilesTest) lookUpFoo() fuseops.InodeID {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(op))
+	return op.Entry.Child
+}
+
+func (t *StaleFilesTest) open(
+	id fuseops.InodeID,
+	flags bazilfuse.OpenFlags) fuseops.HandleID {
+	op := &fuseops.OpenFileOp{
+		Inode: id,
+		Flags: flags,
+	}
+
+	AssertEq(nil, t.fs.OpenFile(op))
+	return op.Handle
+}
+
+func (t *StaleFilesTest) read(id fuseops.InodeID, h fuseops.HandleID) string {
+	op := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: h,
+		Size:   1 << 10,
+	}
+
+	AssertEq(nil, t.fs.ReadFile(op))
+	return string(op.Data)
+}
+
+// Open the inode, read all of it, and release the handle.
+func (t *StaleFilesTest) openAndRead(id fuseops.InodeID) (s string) {
+	h := t.open(id, bazilfuse.OpenReadOnly)
+	s = t.read(id, h)
+
+	err := t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h})
+	AssertEq(nil, err)
+
+	return
+}
+
+// Write the supplied data at the start of the file through the handle.
+func (t *StaleFilesTest) write(
+	id fuseops.InodeID,
+	h fuseops.HandleID,
+	data string) error {
+	return t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte(data),
+	})
+}
+
+// Overwrite foo as another client would, returning its new generation.
+func (t *StaleFilesTest) overwrite(contents string) int64 {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", contents)
+	AssertEq(nil, err)
+
+	return o.Generation
+}
+
+func (t *StaleFilesTest) fileInode(id fuseops.InodeID) *inode.FileInode {
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	return t.fs.inodes[id].(*inode.FileInode)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StaleFilesTest) OverwriteSeenOnOpen() {
+	id := t.lookUpFoo()
+	AssertEq("taco", t.openAndRead(id))
+
+	gen := t.overwrite("burrito")
+
+	// Opening the same inode again should show the new contents.
+	ExpectEq("burrito", t.openAndRead(id))
+
+	in := t.fileInode(id)
+	in.Lock()
+	ExpectEq(gen, in.SourceGeneration())
+	in.Unlock()
+
+	attrsOp := &fuseops.GetInodeAttributesOp{Inode: id}
+	AssertEq(nil, t.fs.GetInodeAttributes(attrsOp))
+	ExpectEq(len("burrito"), attrsOp.Attributes.Size)
+	ExpectEq(1, attrsOp.Attributes.Nlink)
+
+	// A later lookup finds the same inode.
+	ExpectEq(id, t.lookUpFoo())
+}
+
+func (t *StaleFilesTest) LocalModificationsWin() {
+	id := t.lookUpFoo()
+	h := t.open(id, bazilfuse.OpenReadWrite)
+	AssertEq("taco", t.read(id, h))
+
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h,
+		Data:   []byte("p"),
+	})
+
+	AssertEq(nil, err)
+
+	t.overwrite("burrito")
+
+	// Opening again keeps the local contents.
+	ExpectEq("paco", t.openAndRead(id))
+
+	// And syncing them finds the file clobbered, leaving the new object alone.
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	ExpectEq(errStale, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *StaleFilesTest) SupersededInodeLeftAlone() {
+	oldID := t.lookUpFoo()
+	AssertEq("taco", t.openAndRead(oldID))
+
+	t.overwrite("burrito")
+
+	// A lookup replaces the old inode with a new one.
+	newID := t.lookUpFoo()
+	AssertNe(oldID, newID)
+
+	// Opening the old one mustn't turn it into a second copy of the new.
+	old := t.fileInode(oldID)
+	old.Lock()
+	oldGen := old.SourceGeneration()
+	old.Unlock()
+
+	t.open(oldID, bazilfuse.OpenReadOnly)
+
+	old.Lock()
+	ExpectEq(oldGen, old.SourceGeneration())
+	old.Unlock()
+
+	ExpectEq("burrito", t.openAndRead(newID))
+}
+
+func (t *StaleFilesTest) SyncAfterOverwrite() {
+	id := t.lookUpFoo()
+	h := t.open(id, bazilfuse.OpenReadWrite)
+	AssertEq(nil, t.write(id, h, "p"))
+
+	gen := t.overwrite("burrito")
+
+	// The sync should fail with ESTALE, logging what it found.
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	err := t.fs.SyncFile(&fuseops.SyncFileOp{Inode: id, Handle: h})
+	log.SetOutput(os.Stderr)
+
+	ExpectEq(errStale, err)
+	ExpectThat(logs.String(), HasSubstr(`name="foo"`))
+	ExpectThat(logs.String(), HasSubstr("expected_generation=1 "))
+	ExpectThat(
+		logs.String(),
+		HasSubstr(fmt.Sprintf("observed_generation=%d", gen)))
+
+	// Further modifications and syncs should fail straight away.
+	ExpectEq(errStale, t.write(id, h, "q"))
+
+	size := uint64(0)
+	err = t.fs.SetInodeAttributes(&fuseops.SetInodeAttributesOp{
+		Inode: id,
+		Size:  &size,
+	})
+
+	ExpectEq(errStale, err)
+
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	ExpectEq(errStale, err)
+
+	// Periodic syncs leave the file alone.
+	n, err := t.fs.syncDirtyFiles(t.ctx)
+	ExpectEq(nil, err)
+	ExpectEq(0, n)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *StaleFilesTest) FlushAfterDelete() {
+	id := t.lookUpFoo()
+	h := t.open(id, bazilfuse.OpenWriteOnly)
+	AssertEq(nil, t.write(id, h, "p"))
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	// The flush should fail with ESTALE, without recreating the object.
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: id, Handle: h})
+	log.SetOutput(os.Stderr)
+
+	ExpectEq(errStale, err)
+	ExpectThat(logs.String(), HasSubstr("observed_generation=0"))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	_, ok := err.(*gcs.NotFoundError)
+	ExpectTrue(ok, "Error: %v", err)
+}
+
+func (t *StaleFilesTest) DeleteLeftAloneOnOpen() {
+	id := t.lookUpFoo()
+	AssertEq("taco", t.openAndRead(id))
+
+	in := t.fileInode(id)
+	in.Lock()
+	gen := in.SourceGeneration()
+	in.Unlock()
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	// There's nothing newer to present, so opening succeeds and leaves the
+	// inode as it was.
+	t.open(id, bazilfuse.OpenReadOnly)
+
+	in.Lock()
+	ExpectEq(gen, in.SourceGeneration())
+	in.Unlock()
+}
+
+func (t *StaleFilesTest) InodeNotLockedDuringStat() {
+	id := t.lookUpFoo()
+	h := t.open(id, bazilfuse.OpenReadOnly)
+	AssertEq("taco", t.read(id, h))
+
+	gen := t.overwrite("burrito")
+
+	// Start opening foo again, stopping it while it asks GCS about the object.
+	t.gated.statStarted = make(chan struct{})
+	t.gated.statRelease = make(chan struct{})
+	t.gated.gateStatOf = "foo"
+
+	openErr := make(chan error)
+	go func() {
+		openErr <- t.fs.OpenFile(&fuseops.OpenFileOp{
+			Inode: id,
+			Flags: bazilfuse.OpenReadOnly,
+		})
+	}()
+
+	<-t.gated.statStarted
+
+	// Reading through the existing handle needs the inode lock, and shouldn't
+	// have to wait for GCS.
+	readDone := make(chan string)
+	go func() {
+		readDone <- t.read(id, h)
+	}()
+
+	select {
+	case s := <-readDone:
+		ExpectEq("taco", s)
+
+	case <-time.After(5 * time.Second):
+		AddFailure("Read blocked behind the stat.")
+		close(t.gated.statRelease)
+		AbortTest()
+	}
+
+	// Once the stat returns, the open picks up the new generation.
+	close(t.gated.statRelease)
+	AssertEq(nil, <-openErr)
+
+	in := t.fileInode(id)
+	in.Lock()
+	ExpectEq(gen, in.SourceGeneration())
+	in.Unlock()
+}
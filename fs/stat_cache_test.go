@@ -0,0 +1,158 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStatCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const statCacheTestTTL = time.Minute
+
+var statCacheTestFiles = []string{"bar", "baz", "foo"}
+
+// Tests for how much the record cache in front of the bucket saves the file
+// system, as set up by mount.go. The cache talks to the fake bucket through a
+// cost bucket, so that we can see which requests reach GCS. Directory type
+// caching is disabled, so that every lookup stats both the file and the
+// directory name.
+type StatCacheTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+	cost  gcsproxy.CostBucket
+	fs    *fileSystem
+}
+
+func init() { RegisterTestSuite(&StatCacheTest{}) }
+
+func (t *StatCacheTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	bucket := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.cost = gcsproxy.NewCostBucket(nil, bucket)
+
+	for _, name := range append(statCacheTestFiles, "dir/", "dir/qux") {
+		_, err = gcsutil.CreateObject(t.ctx, bucket, name, "taco")
+		AssertEq(nil, err)
+	}
+
+	policy, err := gcsproxy.ParseStatTTLs(statCacheTestTTL, nil)
+	AssertEq(nil, err)
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock: &t.clock,
+		Bucket: gcsproxy.NewRecordCachingBucket(
+			gcsproxy.NewRecordCache(64, policy, &t.clock),
+			&t.clock,
+			t.cost),
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *StatCacheTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *StatCacheTest) statObjects() uint64 {
+	return t.cost.Stats().ByMethod["StatObject"]
+}
+
+// List the root directory as "ls -l" would: read it in full, then look up
+// and get the attributes of each child.
+func (t *StatCacheTest) lsLong() {
+	openOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	AssertEq(nil, t.fs.OpenDir(openOp))
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  fuseops.RootInodeID,
+		Handle: openOp.Handle,
+		Size:   1 << 12,
+	}
+
+	AssertEq(nil, t.fs.ReadDir(readOp))
+	AssertNe(0, len(readOp.Data))
+
+	for _, name := range append(statCacheTestFiles, "dir") {
+		id := t.lookUp(name)
+		AssertEq(
+			nil,
+			t.fs.GetInodeAttributes(&fuseops.GetInodeAttributesOp{Inode: id}))
+	}
+}
+
+func (t *StatCacheTest) lookUp(name string) fuseops.InodeID {
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	}
+
+	AssertEq(nil, t.fs.LookUpInode(op), "name: %q", name)
+	return op.Entry.Child
+}
+
+// Open every file in the root directory, looking each up afresh as if the
+// kernel had forgotten it.
+func (t *StatCacheTest) openAll() {
+	for _, name := range statCacheTestFiles {
+		id := t.lookUp(name)
+		AssertEq(nil, t.fs.OpenFile(&fuseops.OpenFileOp{Inode: id}))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StatCacheTest) ListThenOpenNeedsNoStats() {
+	// The listing holds records for every file, and shows which names have no
+	// file or no directory placeholder. The only thing it can't show is the
+	// record for the placeholder of dir.
+	t.lsLong()
+	AssertEq(1, t.statObjects())
+
+	// Opening the files needs nothing more.
+	t.openAll()
+	ExpectEq(1, t.statObjects())
+}
+
+func (t *StatCacheTest) StatsResumeAfterTTL() {
+	t.lsLong()
+	t.clock.AdvanceTime(statCacheTestTTL + time.Millisecond)
+	t.openAll()
+
+	ExpectNe(0, t.statObjects())
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The amount of recently streamed contents buffered for each streaming
+// handle, to absorb variation in the size and order of the kernel's reads.
+// This comfortably covers its readahead.
+const streamingWindow = 1 << 20
+
+// The state of a file handle that may serve reads by streaming. See
+// ServerConfig.StreamingReadThreshold.
+type streamingRead struct {
+	// Set if the application opted in with O_DIRECT, in which case streaming
+	// may start at any offset.
+	optIn bool
+
+	mu sync.Mutex
+
+	// The reader, created by the first read, and the generation it reads.
+	//
+	// GUARDED_BY(mu)
+	reader     gcsproxy.StreamingReader
+	generation int64
+
+	// Set once the handle has stopped streaming, after which reads are always
+	// served from the inode's contents.
+	//
+	// GUARDED_BY(mu)
+	fellBack       bool
+	fallBackReason string
+}
+
+// Return streaming state for a new handle for the given inode, or nil if it
+// shouldn't stream.
+//
+// LOCKS_EXCLUDED(in)
+func (fs *fileSystem) newStreamingRead(
+	in *inode.FileInode,
+	flags bazilfuse.OpenFlags) (s *streamingRead) {
+	if fs.streamingReadThreshold == 0 || !flags.IsReadOnly() {
+		return
+	}
+
+	if in.IsDecompressedView() {
+		return
+	}
+
+	optIn := openDirect != 0 && uint32(flags)&openDirect != 0
+
+	in.Lock()
+	size := int64(in.Source().Size)
+	in.Unlock()
+
+	if !optIn && size < fs.streamingReadThreshold {
+		return
+	}
+
+	s = &streamingRead{optIn: optIn}
+	return
+}
+
+// Stop streaming for good, releasing the reader.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *streamingRead) fallBack(reason string) (err error) {
+	s.fellBack = true
+	s.fallBackReason = reason
+
+	if s.reader != nil {
+		err = s.reader.Close()
+		s.reader = nil
+	}
+
+	return
+}
+
+// Release the reader, if any, when the handle goes away.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *streamingRead) close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.fallBack("handle released")
+	return
+}
+
+// Describe the state of streaming, for diagnostics.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *streamingRead) describe() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.fellBack:
+		return fmt.Sprintf("stopped streaming (%s)", s.fallBackReason)
+
+	case s.reader == nil:
+		return "may stream"
+
+	default:
+		return fmt.Sprintf(
+			"streaming generation %d (%d GCS reads)",
+			s.generation,
+			s.reader.Opens())
+	}
+}
+
+// Serve the read by streaming if the handle still may, returning false if
+// instead it should be served from the inode's contents. shared says whether
+// other handles are open for the same inode.
+//
+// LOCKS_EXCLUDED(in)
+func (fs *fileSystem) readStreaming(
+	op *fuseops.ReadFileOp,
+	in *inode.FileInode,
+	s *streamingRead,
+	shared bool) (streamed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fellBack {
+		return
+	}
+
+	// Streaming is correct only as long as the inode's contents are those of
+	// the generation we stream.
+	in.Lock()
+	src := in.Source()
+	dirty, _, err := in.Dirty(op.Context())
+	in.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("Dirty: %v", err)
+		return
+	}
+
+	var reason string
+	switch {
+	case shared:
+		reason = "another handle is open"
+
+	case dirty:
+		reason = "modified locally"
+
+	case s.reader != nil && src.Generation != s.generation:
+		reason = "generation changed"
+
+	case s.reader == nil && op.Offset != 0 && !s.optIn:
+		reason = "first read not at start"
+	}
+
+	if reason != "" {
+		fs.fallBackFromStreaming(s, in, reason)
+		return
+	}
+
+	if s.reader == nil {
+		s.reader = gcsproxy.NewStreamingReader(&src, fs.streamingWindow, fs.bucket)
+		s.generation = src.Generation
+	}
+
+	// Read.
+	data := make([]byte, op.Size)
+	n, err := s.reader.ReadAt(data, op.Offset)
+
+	switch {
+	case err == gcsproxy.ErrBehindWindow:
+		err = nil
+		fs.fallBackFromStreaming(s, in, "read behind window")
+		return
+
+	case err == io.EOF:
+		err = nil
+
+	case err != nil:
+		err = fmt.Errorf("StreamingReader.ReadAt: %v", err)
+		return
+	}
+
+	op.Data = data[:n]
+	streamed = true
+	fs.counters.recordStreamedRead(n)
+
+	in.Lock()
+	fs.noteAccess(in)
+	in.Unlock()
+
+	return
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (fs *fileSystem) fallBackFromStreaming(
+	s *streamingRead,
+	in *inode.FileInode,
+	reason string) {
+	// Handles that never started streaming haven't fallen back from anything
+	// worth counting.
+	if s.reader != nil {
+		fs.counters.recordStreamingFallback()
+	}
+
+	if err := s.fallBack(reason); err != nil {
+		logger.Errorf("Closing stream for %q: %v", in.Name(), err)
+	}
+}
+
+// A release step that closes a handle's stream.
+func closeStreamStep(s *streamingRead) releaseStep {
+	return releaseStep{
+		name: "close stream",
+		run:  s.close,
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStreaming(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	streamingTestChunkSize = 8
+	streamingTestThreshold = 32
+	streamingTestWindow    = 16
+)
+
+// Tests for ServerConfig.StreamingReadThreshold, replaying traces of read ops
+// directly against the file system. The file system talks to the bucket
+// through a cost bucket so that we can count the reads that reach GCS.
+type StreamingTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	cost     gcsproxy.CostBucket
+	counters Counters
+	fs       *fileSystem
+
+	// The contents of "big", which is large enough to stream, and "small",
+	// which isn't.
+	big   string
+	small string
+}
+
+var _ SetUpInterface = &StreamingTest{}
+var _ TearDownInterface = &StreamingTest{}
+
+func init() { RegisterTestSuite(&StreamingTest{}) }
+
+func (t *StreamingTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	for i := 0; i < 64; i++ {
+		t.big += string('a' + byte(i%26))
+	}
+
+	t.small = "taco"
+
+	bucket := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		bucket,
+		map[string]string{
+			"big":   t.big,
+			"small": t.small,
+		})
+
+	AssertEq(nil, err)
+
+	t.cost = gcsproxy.NewCostBucket(nil, bucket)
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                  &t.clock,
+		Bucket:                 t.cost,
+		TempDirLimitNumFiles:   16,
+		TempDirLimitBytes:      1 << 22,
+		GCSChunkSize:           streamingTestChunkSize,
+		TmpObjectPrefix:        ".gcsfuse_tmp/",
+		FilePerms:              0644,
+		DirPerms:               0755,
+		StreamingReadThreshold: streamingTestThreshold,
+		Counters:               &t.counters,
+	})
+
+	AssertEq(nil, err)
+	t.fs.streamingWindow = streamingTestWindow
+}
+
+func (t *StreamingTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Look up and open a child of the root with the given flags.
+func (t *StreamingTest) open(
+	name string,
+	flags bazilfuse.OpenFlags) (id fuseops.InodeID, h fuseops.HandleID) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	op := &fuseops.OpenFileOp{Inode: child.ID(), Flags: flags}
+	AssertEq(nil, t.fs.OpenFile(op))
+
+	id = child.ID()
+	h = op.Handle
+	return
+}
+
+func (t *StreamingTest) release(h fuseops.HandleID) {
+	AssertEq(nil, t.fs.ReleaseFileHandle(&fuseops.ReleaseFileHandleOp{Handle: h}))
+}
+
+// A read in a trace: size bytes at offset.
+type streamingTestRead struct {
+	offset int64
+	size   int
+}
+
+// Replay the trace through the given handle, checking that each read returns
+// the right part of contents.
+func (t *StreamingTest) replay(
+	id fuseops.InodeID,
+	h fuseops.HandleID,
+	contents string,
+	trace []streamingTestRead) {
+	for _, r := range trace {
+		op := &fuseops.ReadFileOp{
+			Inode:  id,
+			Handle: h,
+			Offset: r.offset,
+			Size:   r.size,
+		}
+
+		AssertEq(nil, t.fs.ReadFile(op), "Read: %v", r)
+
+		limit := r.offset + int64(r.size)
+		if limit > int64(len(contents)) {
+			limit = int64(len(contents))
+		}
+
+		AssertEq(contents[r.offset:limit], string(op.Data), "Read: %v", r)
+	}
+}
+
+// Return the names of the objects with contents held in temporary files.
+func (t *StreamingTest) resident() (names []string) {
+	for _, o := range t.fs.residencySnapshot().Objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+func (t *StreamingTest) newReaderCalls() uint64 {
+	return t.cost.Stats().ByMethod["NewReader"]
+}
+
+// A strictly sequential trace of the whole of "big", in reads of varying
+// sizes and with some reordering within the window.
+var sequentialTrace = []streamingTestRead{
+	{0, 10},
+	{10, 10},
+	{25, 10},
+	{20, 5},
+	{35, 29},
+	{64, 10},
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StreamingTest) SequentialReadsStream() {
+	id, h := t.open("big", 0)
+	t.replay(id, h, t.big, sequentialTrace)
+
+	// A single GCS read, and nothing in temporary files.
+	ExpectEq(1, t.newReaderCalls())
+	ExpectEq(0, len(t.resident()))
+
+	s := t.counters.Stats()
+	ExpectEq(len(t.big), s.StreamedBytes)
+	ExpectEq(0, s.StreamingFallbacks)
+
+	// Releasing the handle releases the reader.
+	t.fs.mu.Lock()
+	fh := t.fs.handles[h].(*fileHandle)
+	t.fs.mu.Unlock()
+
+	t.release(h)
+
+	fh.stream.mu.Lock()
+	ExpectEq(nil, fh.stream.reader)
+	fh.stream.mu.Unlock()
+}
+
+func (t *StreamingTest) SmallFilesAreCached() {
+	id, h := t.open("small", 0)
+	t.replay(id, h, t.small, []streamingTestRead{{0, 4}})
+
+	ExpectEq(0, t.counters.Stats().StreamedBytes)
+	ExpectEq("small", strings.Join(t.resident(), ","))
+}
+
+func (t *StreamingTest) HandlesOpenedForWritingAreCached() {
+	id, h := t.open("big", bazilfuse.OpenReadWrite)
+	t.replay(id, h, t.big, sequentialTrace)
+
+	ExpectEq(0, t.counters.Stats().StreamedBytes)
+	ExpectEq("big", strings.Join(t.resident(), ","))
+}
+
+func (t *StreamingTest) FirstReadNotAtStart() {
+	id, h := t.open("big", 0)
+	t.replay(id, h, t.big, []streamingTestRead{
+		{20, 10},
+		{0, 10},
+		{30, 10},
+	})
+
+	s := t.counters.Stats()
+	ExpectEq(0, s.StreamedBytes)
+	ExpectEq(0, s.StreamingFallbacks)
+	ExpectEq("big", strings.Join(t.resident(), ","))
+}
+
+func (t *StreamingTest) DirectIOOptsIn() {
+	if openDirect == 0 {
+		return
+	}
+
+	// Even a small file, starting in the middle.
+	id, h := t.open("small", bazilfuse.OpenFlags(openDirect))
+	t.replay(id, h, t.small, []streamingTestRead{{2, 2}})
+
+	ExpectEq(2, t.counters.Stats().StreamedBytes)
+	ExpectEq(0, len(t.resident()))
+}
+
+func (t *StreamingTest) BackwardSeekFallsBack() {
+	id, h := t.open("big", 0)
+
+	// Read well past the start, then go back to it. The reads should still be
+	// correct, the latter served by the usual path.
+	t.replay(id, h, t.big, []streamingTestRead{
+		{0, 10},
+		{10, 40},
+		{0, 10},
+	})
+
+	s := t.counters.Stats()
+	ExpectEq(50, s.StreamedBytes)
+	ExpectEq(1, s.StreamingFallbacks)
+	ExpectEq("big", strings.Join(t.resident(), ","))
+
+	// Once fallen back, the handle doesn't stream again.
+	t.replay(id, h, t.big, []streamingTestRead{{50, 14}})
+	ExpectEq(50, t.counters.Stats().StreamedBytes)
+}
+
+func (t *StreamingTest) SecondHandleFallsBack() {
+	id, h1 := t.open("big", 0)
+	t.replay(id, h1, t.big, []streamingTestRead{{0, 10}})
+
+	// Once another handle is open, both are served by the usual path.
+	_, h2 := t.open("big", 0)
+	t.replay(id, h2, t.big, []streamingTestRead{{0, 10}})
+	t.replay(id, h1, t.big, []streamingTestRead{{10, 10}})
+
+	s := t.counters.Stats()
+	ExpectEq(10, s.StreamedBytes)
+	ExpectEq(1, s.StreamingFallbacks)
+
+	// Even after the other handle goes away.
+	t.release(h2)
+	t.replay(id, h1, t.big, []streamingTestRead{{20, 10}})
+	ExpectEq(10, t.counters.Stats().StreamedBytes)
+}
+
+func (t *StreamingTest) LocalModificationFallsBack() {
+	id, h1 := t.open("big", 0)
+	t.replay(id, h1, t.big, []streamingTestRead{{0, 10}})
+
+	// Modify the file through another handle, then close that.
+	_, h2 := t.open("big", bazilfuse.OpenReadWrite)
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  id,
+		Handle: h2,
+		Offset: 12,
+		Data:   []byte("TACO"),
+	})
+
+	AssertEq(nil, err)
+	t.release(h2)
+
+	// Reads should see the modification.
+	modified := t.big[:12] + "TACO" + t.big[16:]
+	t.replay(id, h1, modified, []streamingTestRead{{10, 10}})
+
+	s := t.counters.Stats()
+	ExpectEq(10, s.StreamedBytes)
+	ExpectEq(1, s.StreamingFallbacks)
+}
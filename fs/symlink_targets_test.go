@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestSymlinkTargets(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SymlinkTargetsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+}
+
+var _ SetUpInterface = &SymlinkTargetsTest{}
+var _ TearDownInterface = &SymlinkTargetsTest{}
+
+func init() { RegisterTestSuite(&SymlinkTargetsTest{}) }
+
+func (t *SymlinkTargetsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+}
+
+func (t *SymlinkTargetsTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Create a symlink named foo in the root with the supplied target.
+func (t *SymlinkTargetsTest) symlink(target string) (err error) {
+	err = t.fs.CreateSymlink(&fuseops.CreateSymlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Target: target,
+	})
+
+	return
+}
+
+func (t *SymlinkTargetsTest) created() bool {
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return false
+	}
+
+	AssertEq(nil, err)
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SymlinkTargetsTest) LargestTarget() {
+	n := inode.MaxCustomMetadataBytes - len(inode.SymlinkMetadataKey)
+	AssertEq(nil, t.symlink(strings.Repeat("a", n)))
+	ExpectTrue(t.created())
+}
+
+func (t *SymlinkTargetsTest) TargetTooLarge() {
+	n := inode.MaxCustomMetadataBytes - len(inode.SymlinkMetadataKey) + 1
+	err := t.symlink(strings.Repeat("a", n))
+
+	ExpectThat(err, Error(HasSubstr("name too long")))
+	ExpectFalse(t.created())
+}
+
+func (t *SymlinkTargetsTest) InvalidTargets() {
+	for _, target := range []string{"a\xffb", "a\nb"} {
+		err := t.symlink(target)
+		ExpectThat(err, Error(HasSubstr("invalid argument")), "%q", target)
+		ExpectFalse(t.created())
+	}
+}
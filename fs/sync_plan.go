@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"golang.org/x/net/context"
+)
+
+// Report what syncing the file backed by the named object would write to
+// GCS, without writing anything. The file must currently be known to the file
+// system, i.e. have been looked up by the kernel.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) syncPlan(
+	ctx context.Context,
+	name string) (plan gcsproxy.SyncPlan, err error) {
+	// Find the inode. We must not lock it while holding fs.mu.
+	fs.mu.Lock()
+	f, _ := fs.generationBackedInodes[name].(*inode.FileInode)
+	fs.mu.Unlock()
+
+	if f == nil {
+		err = fmt.Errorf("Unknown file: %q", name)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	plan, err = f.SyncPlan(ctx)
+	return
+}
+
+// Serve a description of what syncing the file backed by the object named by
+// the "name" query parameter would do, as a single line of the form
+//
+//     strategy=append upload_bytes=7 if_generation_match=1234
+//
+// The strategy is one of none, append, rewrite, and flatten.
+func (fs *fileSystem) serveSyncPlan(
+	w http.ResponseWriter,
+	r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+
+	plan, err := fs.syncPlan(context.Background(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, plan)
+}
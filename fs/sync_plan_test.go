@@ -0,0 +1,234 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestSyncPlan(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for the sync plan debugging handler, driving the file system directly
+// through its op methods.
+type SyncPlanTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// An open handle for the file "foo", with initial contents "taco".
+	foo       fuseops.InodeID
+	fooHandle fuseops.HandleID
+	fooGen    int64
+}
+
+func init() { RegisterTestSuite(&SyncPlanTest{}) }
+
+func (t *SyncPlanTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create the file.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+	t.fooGen = o.Generation
+
+	// Create the file system.
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		AppendThreshold:      1,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	AssertEq(nil, err)
+
+	// Look up and open the file.
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+	t.foo = child.ID()
+
+	op := &fuseops.OpenFileOp{Inode: t.foo}
+	AssertEq(nil, t.fs.OpenFile(op))
+	t.fooHandle = op.Handle
+}
+
+func (t *SyncPlanTest) TearDown() {
+	t.fs.Destroy()
+}
+
+func (t *SyncPlanTest) write(offset int64, s string) {
+	op := &fuseops.WriteFileOp{
+		Inode:  t.foo,
+		Handle: t.fooHandle,
+		Offset: offset,
+		Data:   []byte(s),
+	}
+
+	AssertEq(nil, t.fs.WriteFile(op))
+}
+
+// Make a request to the sync plan handler, returning the response status and
+// body.
+func (t *SyncPlanTest) get(query string) (code int, body string) {
+	req, err := http.NewRequest("GET", "/sync_plan?"+query, nil)
+	AssertEq(nil, err)
+
+	w := httptest.NewRecorder()
+	t.fs.serveSyncPlan(w, req)
+
+	code = w.Code
+	body = w.Body.String()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SyncPlanTest) Clean() {
+	plan, err := t.fs.syncPlan(t.ctx, "foo")
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyNone, plan.Strategy)
+	ExpectEq(0, plan.UploadBytes)
+}
+
+func (t *SyncPlanTest) Appended() {
+	t.write(4, "burrito")
+
+	plan, err := t.fs.syncPlan(t.ctx, "foo")
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyAppend, plan.Strategy)
+	ExpectEq(len("burrito"), plan.UploadBytes)
+	ExpectEq(t.fooGen, plan.GenerationPrecondition)
+}
+
+func (t *SyncPlanTest) Overwritten() {
+	t.write(1, "i")
+
+	plan, err := t.fs.syncPlan(t.ctx, "foo")
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyRewrite, plan.Strategy)
+	ExpectEq(len("tico"), plan.UploadBytes)
+	ExpectEq(t.fooGen, plan.GenerationPrecondition)
+}
+
+func (t *SyncPlanTest) PlanningDoesntSync() {
+	t.write(4, "burrito")
+
+	_, err := t.fs.syncPlan(t.ctx, "foo")
+	AssertEq(nil, err)
+
+	// GCS should be untouched.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(t.fooGen, o.Generation)
+
+	// Flushing should do what the plan said, after which there is nothing
+	// left to do.
+	err = t.fs.FlushFile(&fuseops.FlushFileOp{Inode: t.foo, Handle: t.fooHandle})
+	AssertEq(nil, err)
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(2, o.ComponentCount)
+
+	plan, err := t.fs.syncPlan(t.ctx, "foo")
+	AssertEq(nil, err)
+	ExpectEq(gcsproxy.SyncStrategyNone, plan.Strategy)
+}
+
+func (t *SyncPlanTest) UnknownFile() {
+	_, err := t.fs.syncPlan(t.ctx, "bar")
+	ExpectThat(err, Error(HasSubstr("Unknown file")))
+}
+
+func (t *SyncPlanTest) Xattr() {
+	get := func() string {
+		op := &fuseops.GetXattrOp{
+			Inode: t.foo,
+			Name:  "user.gcsfuse.sync_plan",
+		}
+
+		AssertEq(nil, t.fs.GetXattr(op))
+		return string(op.Value)
+	}
+
+	ExpectEq("strategy=none upload_bytes=0 if_generation_match=0", get())
+
+	t.write(4, "burrito")
+	ExpectEq(
+		fmt.Sprintf("strategy=append upload_bytes=7 if_generation_match=%d", t.fooGen),
+		get())
+
+	t.write(1, "i")
+	ExpectEq(
+		fmt.Sprintf("strategy=rewrite upload_bytes=11 if_generation_match=%d", t.fooGen),
+		get())
+
+	// Planning can't be requested by setting the attribute.
+	err := t.fs.SetXattr(&fuseops.SetXattrOp{
+		Inode: t.foo,
+		Name:  "user.gcsfuse.sync_plan",
+		Value: []byte("append"),
+	})
+
+	ExpectEq(errXattrReadOnly, err)
+}
+
+func (t *SyncPlanTest) Handler() {
+	t.write(4, "burrito")
+
+	code, body := t.get("name=foo")
+	ExpectEq(http.StatusOK, code)
+	ExpectEq(
+		fmt.Sprintf("strategy=append upload_bytes=7 if_generation_match=%d\n", t.fooGen),
+		body)
+
+	code, _ = t.get("name=bar")
+	ExpectEq(http.StatusNotFound, code)
+
+	code, _ = t.get("")
+	ExpectEq(http.StatusBadRequest, code)
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests that temporary objects stay out of sight, driving the file system
+// directly through its op methods like HandlesTest.
+type TmpObjectsTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+}
+
+func init() { RegisterTestSuite(&TmpObjectsTest{}) }
+
+func (t *TmpObjectsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"foo":                  "taco",
+			"dir/.tmp/leftover":    "burrito",
+			"dir/bar":              "enchilada",
+			".gcsfuse_tmp/default": "queso",
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *TmpObjectsTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+func (t *TmpObjectsTest) mount(cfg *ServerConfig) {
+	var err error
+
+	cfg.Clock = &t.clock
+	cfg.Bucket = t.bucket
+	cfg.TempDirLimitNumFiles = 16
+	cfg.TempDirLimitBytes = 1 << 22
+	cfg.ImplicitDirectories = true
+
+	t.fs, err = newFileSystem(cfg)
+	AssertEq(nil, err)
+}
+
+// Return the names of the entries in the root directory.
+func (t *TmpObjectsTest) listRoot() (names []string) {
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	root.Lock()
+	defer root.Unlock()
+
+	var tok string
+	for {
+		entries, newTok, err := root.ReadEntries(t.ctx, tok)
+		AssertEq(nil, err)
+
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+
+		if newTok == "" {
+			return
+		}
+
+		tok = newTok
+	}
+}
+
+func (t *TmpObjectsTest) lookUpRoot(name string) (err error) {
+	err = t.fs.LookUpInode(&fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+	})
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TmpObjectsTest) DefaultPrefixHidden() {
+	t.mount(&ServerConfig{TmpObjectPrefix: ".gcsfuse_tmp/"})
+
+	ExpectThat(t.listRoot(), ElementsAre("foo", "dir"))
+	ExpectEq(fuse.ENOENT, t.lookUpRoot(".gcsfuse_tmp"))
+}
+
+func (t *TmpObjectsTest) CustomPrefixHidden() {
+	t.mount(&ServerConfig{TmpObjectPrefix: "dir/.tmp/"})
+
+	// The old default prefix is no longer special.
+	ExpectThat(t.listRoot(), ElementsAre("foo", ".gcsfuse_tmp", "dir"))
+
+	// But the new one is.
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	AssertEq(nil, t.fs.LookUpInode(op))
+
+	err := t.fs.LookUpInode(&fuseops.LookUpInodeOp{
+		Parent: op.Entry.Child,
+		Name:   ".tmp",
+	})
+
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *TmpObjectsTest) PrefixRelativeToOnlyDir() {
+	t.mount(&ServerConfig{
+		OnlyDir:         "dir",
+		TmpObjectPrefix: ".tmp/",
+	})
+
+	ExpectThat(t.listRoot(), ElementsAre("bar"))
+	ExpectEq(fuse.ENOENT, t.lookUpRoot(".tmp"))
+}
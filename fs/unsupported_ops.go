@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Ops for things that GCS has no way to represent are refused explicitly,
+// rather than with the ENOSYS of fuseutil.NotImplementedFileSystem. The
+// kernel reports ENOSYS confusingly or not at all, and tools may not
+// recognize it as permanent. Instead each op fails with the errno that a
+// local file system lacking the feature would give.
+
+// The error returned for attempts to create hard links.
+var errLinkNotSupported = bazilfuse.Errno(syscall.ENOTSUP)
+
+// The errors returned by mknod(2) for device nodes, as for an unprivileged
+// caller, and for other special files.
+var (
+	errMkNodDevice       = bazilfuse.Errno(syscall.EPERM)
+	errMkNodNotSupported = bazilfuse.Errno(syscall.ENOTSUP)
+)
+
+// The error returned by fallocate(2), whatever the mode.
+var errFallocateNotSupported = bazilfuse.Errno(syscall.EOPNOTSUPP)
+
+// Return the name of the supplied inode, or of its child with the given name
+// if that is non-empty, for logging.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) inodeNameForLog(
+	id fuseops.InodeID,
+	child string) (name string) {
+	fs.mu.Lock()
+	in, ok := fs.inodes[id]
+	fs.mu.Unlock()
+
+	if !ok {
+		name = "<unknown>"
+		return
+	}
+
+	name = in.Name()
+	if child != "" {
+		name = path.Join(name, child)
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) CreateLink(
+	op *fuseops.CreateLinkOp) (err error) {
+	op.Logf(
+		"CreateLink: hard links aren't supported (%q to %q)",
+		fs.inodeNameForLog(op.Parent, op.Name),
+		fs.inodeNameForLog(op.Target, ""))
+
+	err = errLinkNotSupported
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) MkNode(
+	op *fuseops.MkNodeOp) (err error) {
+	name := fs.inodeNameForLog(op.Parent, op.Name)
+
+	if op.Mode&os.ModeDevice != 0 {
+		op.Logf("MkNode: device nodes aren't supported (%q)", name)
+		err = errMkNodDevice
+		return
+	}
+
+	op.Logf("MkNode: special files aren't supported (%q, %v)", name, op.Mode)
+	err = errMkNodNotSupported
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) Fallocate(
+	op *fuseops.FallocateOp) (err error) {
+	op.Logf(
+		"Fallocate: not supported (%q, mode %#x)",
+		fs.inodeNameForLog(op.Inode, ""),
+		op.Mode)
+
+	err = errFallocateNotSupported
+	return
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for the errors seen by callers of system calls that the file system
+// doesn't support.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+type UnsupportedOpsTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&UnsupportedOpsTest{}) }
+
+func (t *UnsupportedOpsTest) HardLink() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	err = syscall.Link(
+		path.Join(t.mfs.Dir(), "foo"),
+		path.Join(t.mfs.Dir(), "bar"))
+
+	ExpectEq(syscall.ENOTSUP, err)
+
+	// Nothing should have been created.
+	_, err = os.Lstat(path.Join(t.mfs.Dir(), "bar"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *UnsupportedOpsTest) DeviceNode() {
+	err := syscall.Mknod(
+		path.Join(t.mfs.Dir(), "foo"),
+		syscall.S_IFCHR|0600,
+		0x0103) // /dev/null
+
+	ExpectEq(syscall.EPERM, err)
+}
+
+func (t *UnsupportedOpsTest) NamedPipe() {
+	err := syscall.Mkfifo(path.Join(t.mfs.Dir(), "foo"), 0600)
+	ExpectEq(syscall.ENOTSUP, err)
+}
+
+func (t *UnsupportedOpsTest) Fallocate() {
+	var err error
+
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	// The same error should be seen every time, not just when the kernel first
+	// asks.
+	for i := 0; i < 2; i++ {
+		err = syscall.Fallocate(int(t.f1.Fd()), 0, 0, 1024)
+		ExpectEq(syscall.EOPNOTSUPP, err, "Attempt %d", i)
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The version of ResidencySnapshot written by this build. Snapshots with any
+// other version are refused.
+const ResidencySnapshotVersion = 1
+
+// A record of which chunks of which object generations a file system holds
+// locally, for warming up the cache of another mount of the same bucket with
+// WarmUp. The debug endpoint serves one as JSON at /residency?format=json.
+type ResidencySnapshot struct {
+	Version int `json:"version"`
+
+	// The size of the chunks in which the exporting file system reads objects
+	// (see ServerConfig.GCSChunkSize), or zero if it reads them whole.
+	ChunkSize uint64 `json:"chunk_size"`
+
+	// Objects with resident chunks, those with the most bytes resident first.
+	Objects []ResidentObject `json:"objects"`
+}
+
+// An object generation with chunks held locally. See ResidencySnapshot.
+type ResidentObject struct {
+	// The full object name, including any ServerConfig.OnlyDir prefix.
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+
+	// Indices of the resident chunks, in increasing order.
+	Chunks []uint64 `json:"chunks"`
+}
+
+// Decode a snapshot written as JSON, refusing unknown versions.
+func DecodeResidencySnapshot(r io.Reader) (s *ResidencySnapshot, err error) {
+	s = new(ResidencySnapshot)
+	err = json.NewDecoder(r).Decode(s)
+	if err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	if s.Version != ResidencySnapshotVersion {
+		err = fmt.Errorf(
+			"Unsupported snapshot version %d (want %d)",
+			s.Version,
+			ResidencySnapshotVersion)
+
+		return
+	}
+
+	return
+}
+
+type residentObjectsByBytes struct {
+	objects []ResidentObject
+	bytes   []int64
+}
+
+func (s residentObjectsByBytes) Len() int { return len(s.objects) }
+
+func (s residentObjectsByBytes) Swap(i, j int) {
+	s.objects[i], s.objects[j] = s.objects[j], s.objects[i]
+	s.bytes[i], s.bytes[j] = s.bytes[j], s.bytes[i]
+}
+
+func (s residentObjectsByBytes) Less(i, j int) bool {
+	if s.bytes[i] != s.bytes[j] {
+		return s.bytes[i] > s.bytes[j]
+	}
+
+	return s.objects[i].Name < s.objects[j].Name
+}
+
+// Return a snapshot of the chunks of object generations held locally. Files
+// with local modifications are left out.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) residencySnapshot() (s *ResidencySnapshot) {
+	s = &ResidencySnapshot{Version: ResidencySnapshotVersion}
+	if fs.gcsChunkSize != math.MaxUint64 {
+		s.ChunkSize = fs.gcsChunkSize
+	}
+
+	// Grab the file inodes. We must not lock them while holding fs.mu.
+	var inodes []*inode.FileInode
+
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok {
+			inodes = append(inodes, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	// Ask each for its resident ranges, and turn them into chunk indices.
+	var sorter residentObjectsByBytes
+	for _, f := range inodes {
+		f.Lock()
+		gen, ranges := f.ResidentRanges()
+		f.Unlock()
+
+		if len(ranges) == 0 {
+			continue
+		}
+
+		o := ResidentObject{
+			Name:       fs.objectNamePrefix + f.Name(),
+			Generation: gen,
+		}
+
+		var resident int64
+		for _, r := range ranges {
+			resident += r.Limit - r.Start
+
+			var chunk uint64
+			if s.ChunkSize != 0 {
+				chunk = uint64(r.Start) / s.ChunkSize
+			}
+
+			if n := len(o.Chunks); n == 0 || o.Chunks[n-1] != chunk {
+				o.Chunks = append(o.Chunks, chunk)
+			}
+		}
+
+		sorter.objects = append(sorter.objects, o)
+		sorter.bytes = append(sorter.bytes, resident)
+	}
+
+	sort.Sort(sorter)
+	s.Objects = sorter.objects
+
+	return
+}
+
+// Counts describing the outcome of WarmUp.
+type WarmUpStats struct {
+	// Objects whose chunks were handed to the prefetcher, and the number of
+	// ranges handed over.
+	Objects int
+	Ranges  int
+
+	// Objects skipped because they no longer exist at the recorded generation.
+	Stale int
+
+	// Objects skipped because they couldn't be statted.
+	Failed int
+}
+
+// The number of objects statted concurrently by WarmUp.
+const warmUpStatConcurrency = 16
+
+// Hand the chunks recorded in a snapshot, typically taken from a sibling
+// mount, to the prefetcher so that it downloads them ahead of their being
+// read, within its budget and concurrency limit. Each object is first statted
+// in the supplied bucket, which must use full object names, and skipped if it
+// no longer exists at the recorded generation. The recorded chunks are
+// re-cut to chunkSize (see ServerConfig.GCSChunkSize) so that they match the
+// reads this mount will make.
+//
+// Warming up is purely advisory: failures are logged and counted, never
+// returned.
+func WarmUp(
+	ctx context.Context,
+	s *ResidencySnapshot,
+	chunkSize uint64,
+	bucket gcs.Bucket,
+	prefetcher gcsproxy.PrefetchBucket) (stats WarmUpStats) {
+	if chunkSize == 0 {
+		chunkSize = math.MaxUint64
+	}
+
+	// Stat the objects concurrently, keeping the results in snapshot order so
+	// that the hottest objects are fetched first.
+	current := make([]*gcs.Object, len(s.Objects))
+	indices := make(chan int)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < warmUpStatConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				ro := s.Objects[i]
+				req := &gcs.StatObjectRequest{Name: ro.Name}
+				o, err := bucket.StatObject(ctx, req)
+
+				mu.Lock()
+				switch err.(type) {
+				case nil:
+					if o.Generation == ro.Generation {
+						current[i] = o
+					} else {
+						stats.Stale++
+					}
+
+				case *gcs.NotFoundError:
+					stats.Stale++
+
+				default:
+					stats.Failed++
+					logger.Errorf("Warm-up: StatObject(%q): %v", ro.Name, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range s.Objects {
+		indices <- i
+	}
+
+	close(indices)
+	wg.Wait()
+
+	// Translate the chunks into ranges to prefetch.
+	var ranges []gcsproxy.PrefetchRange
+	for i, o := range current {
+		if o == nil {
+			continue
+		}
+
+		n := len(ranges)
+		ranges = appendWarmUpRanges(
+			ranges,
+			o,
+			s.Objects[i].Chunks,
+			s.ChunkSize,
+			chunkSize)
+
+		if len(ranges) != n {
+			stats.Objects++
+		}
+	}
+
+	stats.Ranges = len(ranges)
+	prefetcher.Warm(ranges)
+
+	log.Printf(
+		"Warm-up: prefetching %d ranges of %d objects; skipped %d objects "+
+			"that have changed and %d that couldn't be statted.",
+		stats.Ranges,
+		stats.Objects,
+		stats.Stale,
+		stats.Failed)
+
+	return
+}
+
+// Append to ranges the chunks of size to that cover the supplied chunks of
+// size from (zero meaning the whole object) of the object, without
+// duplicates.
+func appendWarmUpRanges(
+	ranges []gcsproxy.PrefetchRange,
+	o *gcs.Object,
+	chunks []uint64,
+	from uint64,
+	to uint64) []gcsproxy.PrefetchRange {
+	seen := make(map[uint64]bool)
+	for _, c := range chunks {
+		// Find the recorded chunk's extent, ignoring any beyond the end.
+		start, limit := uint64(0), o.Size
+		if from != 0 {
+			if c >= (o.Size+from-1)/from {
+				continue
+			}
+
+			start = c * from
+			if c*from+from < limit {
+				limit = c*from + from
+			}
+		}
+
+		if start >= limit {
+			continue
+		}
+
+		// Cover it with our own chunks.
+		for j := start / to; j <= (limit-1)/to; j++ {
+			if seen[j] {
+				continue
+			}
+
+			seen[j] = true
+			r := gcsproxy.PrefetchRange{
+				Name:       o.Name,
+				Generation: o.Generation,
+				Start:      j * to,
+				Limit:      o.Size,
+			}
+
+			if o.Size-r.Start > to {
+				r.Limit = r.Start + to
+			}
+
+			ranges = append(ranges, r)
+		}
+	}
+
+	return ranges
+}
@@ -0,0 +1,291 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestWarmUp(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const warmUpTestChunkSize = 4
+
+// Tests for exporting a residency snapshot from one file system and warming
+// up another with it. Both talk to the same fake bucket, each through its own
+// cost bucket so that we can count what reaches GCS.
+type WarmUpTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+	fake  gcs.Bucket
+
+	// The file system whose cache is exported.
+	exporter *fileSystem
+
+	// The fresh file system warmed up from it.
+	cost       gcsproxy.CostBucket
+	prefetcher gcsproxy.PrefetchBucket
+	importer   *fileSystem
+}
+
+func init() { RegisterTestSuite(&WarmUpTest{}) }
+
+func (t *WarmUpTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.fake = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.fake,
+		map[string]string{
+			"foo": "tacoburritoenchilada",
+			"bar": "queso123",
+			"baz": "salsa",
+		})
+
+	AssertEq(nil, err)
+
+	t.exporter = t.newFS(gcsproxy.NewCostBucket(nil, t.fake))
+
+	t.cost = gcsproxy.NewCostBucket(nil, t.fake)
+	t.prefetcher = gcsproxy.NewPrefetchBucket(
+		gcsproxy.PrefetchConfig{
+			Budget:      1 << 20,
+			Concurrency: 2,
+			TTL:         time.Minute,
+		},
+		&t.clock,
+		t.cost)
+
+	t.importer = t.newFS(t.prefetcher)
+}
+
+func (t *WarmUpTest) TearDown() {
+	t.exporter.Destroy()
+	t.importer.Destroy()
+}
+
+func (t *WarmUpTest) newFS(bucket gcs.Bucket) (fs *fileSystem) {
+	fs, err := newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		GCSChunkSize:         warmUpTestChunkSize,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+	})
+
+	AssertEq(nil, err)
+	return
+}
+
+// Look up and open a child of the root, then read from it.
+func (t *WarmUpTest) read(
+	fs *fileSystem,
+	name string,
+	offset int64,
+	size int) (data string) {
+	fs.mu.Lock()
+	root := fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	fs.mu.Unlock()
+
+	child, err := fs.lookUpOrCreateChildInode(t.ctx, root, name)
+	AssertEq(nil, err)
+	child.Unlock()
+
+	openOp := &fuseops.OpenFileOp{Inode: child.ID()}
+	AssertEq(nil, fs.OpenFile(openOp))
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  child.ID(),
+		Handle: openOp.Handle,
+		Offset: offset,
+		Size:   size,
+	}
+
+	AssertEq(nil, fs.ReadFile(readOp))
+	data = string(readOp.Data)
+
+	return
+}
+
+// Read some chunks through the exporter, and return a snapshot of them that
+// has made a round trip through JSON.
+func (t *WarmUpTest) export() (s *ResidencySnapshot) {
+	AssertEq("ta", t.read(t.exporter, "foo", 0, 2))
+	AssertEq("to", t.read(t.exporter, "foo", 9, 2))
+	AssertEq("o123", t.read(t.exporter, "bar", 4, 4))
+	AssertEq("s", t.read(t.exporter, "baz", 0, 1))
+
+	var buf bytes.Buffer
+	AssertEq(nil, json.NewEncoder(&buf).Encode(t.exporter.residencySnapshot()))
+
+	s, err := DecodeResidencySnapshot(&buf)
+	AssertEq(nil, err)
+
+	return
+}
+
+// Wait until the prefetcher has finished the given number of downloads, or
+// give up after a while.
+func (t *WarmUpTest) waitForFetches(n uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s := t.prefetcher.Stats()
+		if s.Fetched+s.FetchFailed >= n {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *WarmUpTest) newReaderCalls() uint64 {
+	return t.cost.Stats().ByMethod["NewReader"]
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WarmUpTest) SnapshotContents() {
+	s := t.export()
+
+	ExpectEq(ResidencySnapshotVersion, s.Version)
+	ExpectEq(warmUpTestChunkSize, s.ChunkSize)
+	AssertEq(3, len(s.Objects))
+
+	// Ordered by bytes resident, then name.
+	ExpectEq("foo", s.Objects[0].Name)
+	ExpectThat(s.Objects[0].Chunks, ElementsAre(0, 2))
+	ExpectEq("bar", s.Objects[1].Name)
+	ExpectThat(s.Objects[1].Chunks, ElementsAre(1))
+	ExpectEq("baz", s.Objects[2].Name)
+	ExpectThat(s.Objects[2].Chunks, ElementsAre(0))
+
+	for _, o := range s.Objects {
+		current, err := t.fake.StatObject(
+			t.ctx,
+			&gcs.StatObjectRequest{Name: o.Name})
+
+		AssertEq(nil, err)
+		ExpectEq(current.Generation, o.Generation, "Name: %s", o.Name)
+	}
+}
+
+func (t *WarmUpTest) ImportPrefetchesSameChunks() {
+	s := t.export()
+
+	// One object has since been overwritten.
+	_, err := gcsutil.CreateObject(t.ctx, t.fake, "baz", "guacamole")
+	AssertEq(nil, err)
+
+	// Warm up the fresh file system.
+	stats := WarmUp(t.ctx, s, warmUpTestChunkSize, t.prefetcher, t.prefetcher)
+	ExpectEq(2, stats.Objects)
+	ExpectEq(3, stats.Ranges)
+	ExpectEq(1, stats.Stale)
+	ExpectEq(0, stats.Failed)
+
+	// Exactly the chunks of the unchanged objects should be fetched.
+	t.waitForFetches(3)
+	ExpectEq(3, t.prefetcher.Stats().Fetched)
+	ExpectEq(3, t.newReaderCalls())
+
+	// Reading them needs nothing more from GCS.
+	ExpectEq("ac", t.read(t.importer, "foo", 1, 2))
+	ExpectEq("itoe", t.read(t.importer, "foo", 8, 4))
+	ExpectEq("o123", t.read(t.importer, "bar", 4, 4))
+	ExpectEq(3, t.newReaderCalls())
+	ExpectEq(3, t.prefetcher.Stats().Hits)
+
+	// Anything else does, including the overwritten object.
+	ExpectEq("burr", t.read(t.importer, "foo", 4, 4))
+	ExpectEq("guac", t.read(t.importer, "baz", 0, 4))
+	ExpectEq(5, t.newReaderCalls())
+}
+
+func (t *WarmUpTest) ImportIntoDifferentChunkSize() {
+	s := t.export()
+
+	// An importer with chunks twice the size needs the chunks that cover the
+	// recorded ones.
+	stats := WarmUp(t.ctx, s, 2*warmUpTestChunkSize, t.prefetcher, t.prefetcher)
+	ExpectEq(3, stats.Objects)
+	ExpectEq(4, stats.Ranges)
+
+	// And one that reads objects whole needs the whole of each.
+	var ranges []gcsproxy.PrefetchRange
+	o := &gcs.Object{Name: "foo", Generation: 17, Size: 20}
+	ranges = appendWarmUpRanges(ranges, o, []uint64{0, 2, 9}, 4, 1<<63)
+	AssertEq(1, len(ranges))
+	ExpectEq(0, ranges[0].Start)
+	ExpectEq(20, ranges[0].Limit)
+	ExpectEq(17, ranges[0].Generation)
+
+	// Going the other way, chunks beyond the end are dropped and the last is
+	// clipped.
+	ranges = appendWarmUpRanges(nil, o, []uint64{0}, 0, 8)
+	AssertEq(3, len(ranges))
+	ExpectEq(16, ranges[2].Start)
+	ExpectEq(20, ranges[2].Limit)
+
+	ranges = appendWarmUpRanges(nil, o, []uint64{4, 5}, 4, 8)
+	AssertEq(1, len(ranges))
+	ExpectEq(16, ranges[0].Start)
+}
+
+func (t *WarmUpTest) MissingObjectsSkipped() {
+	s := t.export()
+
+	err := t.fake.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	stats := WarmUp(t.ctx, s, warmUpTestChunkSize, t.prefetcher, t.prefetcher)
+	ExpectEq(2, stats.Objects)
+	ExpectEq(1, stats.Stale)
+}
+
+func (t *WarmUpTest) UnknownVersionRefused() {
+	_, err := DecodeResidencySnapshot(
+		strings.NewReader(`{"version": 2, "chunk_size": 4, "objects": []}`))
+
+	ExpectThat(err, Error(HasSubstr("version 2")))
+
+	_, err = DecodeResidencySnapshot(strings.NewReader(`{"version":`))
+	ExpectThat(err, Error(HasSubstr("Decode")))
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// Write a large file through the file system's op methods a WriteFileOp at a
+// time, as the kernel would with the given max_write, to show how per-op
+// overhead affects throughput. The backing bucket is fake, so only the local
+// write path (locking, bookkeeping, and pwrite to the lease) is measured.
+func BenchmarkWriteFile(b *testing.B) {
+	for _, opSize := range []int{4 << 10, 128 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("max_write=%d", opSize), func(b *testing.B) {
+			benchmarkWriteFile(b, opSize)
+		})
+	}
+}
+
+func benchmarkWriteFile(b *testing.B, opSize int) {
+	const fileSize = 1 << 26
+	ctx := context.Background()
+
+	// Set up a file system with a single file.
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	bucket := gcsfake.NewFakeBucket(&clock, "some_bucket")
+
+	err := gcsutil.CreateObjects(ctx, bucket, map[string]string{"foo": ""})
+	if err != nil {
+		b.Fatalf("CreateObjects: %v", err)
+	}
+
+	fs, err := newFileSystem(&ServerConfig{
+		Clock:                &clock,
+		Bucket:               bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    2 * fileSize,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+	})
+
+	if err != nil {
+		b.Fatalf("newFileSystem: %v", err)
+	}
+
+	defer fs.Destroy()
+
+	// Look it up and open it.
+	fs.mu.Lock()
+	root := fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	fs.mu.Unlock()
+
+	child, err := fs.lookUpOrCreateChildInode(ctx, root, "foo")
+	if err != nil {
+		b.Fatalf("lookUpOrCreateChildInode: %v", err)
+	}
+
+	id := child.ID()
+	child.Unlock()
+
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	if err = fs.OpenFile(openOp); err != nil {
+		b.Fatalf("OpenFile: %v", err)
+	}
+
+	// Write the whole file each iteration, reusing the same buffer as the
+	// kernel connection reuses its receive buffers.
+	data := make([]byte, opSize)
+	var ops int
+
+	b.SetBytes(fileSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for off := 0; off < fileSize; off += opSize {
+			op := &fuseops.WriteFileOp{
+				Inode:  id,
+				Handle: openOp.Handle,
+				Offset: int64(off),
+				Data:   data,
+			}
+
+			if err = fs.WriteFile(op); err != nil {
+				b.Fatalf("WriteFile: %v", err)
+			}
+
+			ops++
+		}
+	}
+
+	b.ReportMetric(float64(ops)/float64(b.N)/(fileSize>>20), "ops/MiB")
+}
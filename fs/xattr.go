@@ -0,0 +1,558 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Extended attributes of files expose their objects, under xattrPrefix. Each
+// custom metadata key of a file's object appears as an attribute named
+// xattrMetadataPrefix plus the key, which may be set and removed. The others
+// are read-only, and derived from the object record; see xattrSynthetic.
+const (
+	xattrPrefix         = "user.gcs."
+	xattrMetadataPrefix = xattrPrefix + "metadata."
+)
+
+// Attributes under xattrLocalPrefix concern the file's state in this mount
+// rather than its object. Those in xattrLocal are read-only, and computed with
+// the inode locked.
+const xattrLocalPrefix = "user.gcsfuse."
+
+var xattrLocal = []struct {
+	name  string
+	value func(ctx context.Context, f *inode.FileInode) (string, error)
+}{
+	{
+		xattrLocalPrefix + "cached_bytes",
+		func(ctx context.Context, f *inode.FileInode) (string, error) {
+			resident, _, err := f.Residency(ctx)
+			return strconv.FormatInt(resident, 10), err
+		},
+	},
+	{
+		xattrLocalPrefix + "cached_ratio",
+		func(ctx context.Context, f *inode.FileInode) (string, error) {
+			resident, size, err := f.Residency(ctx)
+			fr := fileResidency{Resident: resident, Size: size}
+			return strconv.FormatFloat(fr.Ratio(), 'f', 3, 64), err
+		},
+	},
+	{
+		// How many more bytes of custom metadata may be set.
+		xattrLocalPrefix + "metadata_budget",
+		func(ctx context.Context, f *inode.FileInode) (string, error) {
+			o := f.Source()
+			return strconv.Itoa(metadataBudget(&o)), nil
+		},
+	},
+	{
+		// What syncing the file would write, as by the /sync_plan handler.
+		xattrLocalPrefix + "sync_plan",
+		func(ctx context.Context, f *inode.FileInode) (string, error) {
+			plan, err := f.SyncPlan(ctx)
+			return plan.String(), err
+		},
+	},
+}
+
+// Setting this extended attribute of a file to "1" rewrites its object as a
+// single-component object with an MD5 hash, flattening it if it is a
+// composite made by appending. See inode.FileInode.Flatten. It can't be read.
+const xattrFlatten = xattrLocalPrefix + "flatten"
+
+// The feature under which the object fields that extended attributes need are
+// registered with gcsproxy.ObjectFields.
+const xattrObjectFields = "xattrs"
+
+func init() {
+	gcsproxy.ObjectFields.Register(
+		xattrObjectFields,
+		"contentType",
+		"customerEncryption",
+		"kmsKeyName",
+		"md5Hash",
+		"metadata")
+}
+
+// The read-only attributes, in the order they are listed. Each returns false
+// if the object has no value to report.
+var xattrSynthetic = []struct {
+	name  string
+	value func(o *gcs.Object) (string, bool)
+}{
+	{
+		"user.gcs.generation",
+		func(o *gcs.Object) (string, bool) {
+			return strconv.FormatInt(o.Generation, 10), true
+		},
+	},
+	{
+		"user.gcs.metageneration",
+		func(o *gcs.Object) (string, bool) {
+			return strconv.FormatInt(o.MetaGeneration, 10), true
+		},
+	},
+	{
+		"user.gcs.crc32c",
+		func(o *gcs.Object) (string, bool) {
+			return fmt.Sprintf("%08x", o.CRC32C), true
+		},
+	},
+	{
+		"user.gcs.md5",
+		func(o *gcs.Object) (string, bool) {
+			if o.MD5 == nil {
+				return "", false
+			}
+
+			return hex.EncodeToString(o.MD5[:]), true
+		},
+	},
+	{
+		"user.gcs.content_type",
+		func(o *gcs.Object) (string, bool) {
+			return o.ContentType, o.ContentType != ""
+		},
+	},
+	{
+		// The key version, as GCS reports it.
+		"user.gcs.kms_key_name",
+		func(o *gcs.Object) (string, bool) {
+			return o.KmsKeyName, o.KmsKeyName != ""
+		},
+	},
+	{
+		"user.gcs.customer_encryption",
+		func(o *gcs.Object) (string, bool) {
+			ce := o.CustomerEncryption
+			if ce == nil {
+				return "", false
+			}
+
+			return fmt.Sprintf(
+				"algorithm=%s key_sha256=%s",
+				ce.EncryptionAlgorithm,
+				ce.KeySHA256), true
+		},
+	},
+}
+
+// GCS's limit on the length of object names, in bytes.
+const maxObjectNameBytes = 1024
+
+// The room kept free in a file's custom metadata for the keys that gcsfuse
+// sets itself, so that filling the rest through extended attributes can't
+// make recording times or marking a directory rename fail later with an
+// opaque error from GCS. Times are formatted as RFC 3339, and the rename
+// marker holds a directory's object name.
+const xattrMetadataReserve = len(gcsproxy.MtimeMetadataKey) +
+	len(time.RFC3339Nano) +
+	len(inode.AtimeMetadataKey) +
+	len(time.RFC3339Nano) +
+	len(renameDirMetadataKey) +
+	maxObjectNameBytes
+
+// The number of bytes of custom metadata that may be set through extended
+// attributes, counting keys and values as GCS does.
+const xattrMetadataLimit = inode.MaxCustomMetadataBytes - xattrMetadataReserve
+
+// Return a copy of the custom metadata of the supplied object that may be set
+// through extended attributes, leaving out the keys that gcsfuse manages.
+func userMetadata(o *gcs.Object) (m map[string]string) {
+	m = make(map[string]string)
+	for k, v := range o.Metadata {
+		if !strings.HasPrefix(k, "gcsfuse_") {
+			m[k] = v
+		}
+	}
+
+	return
+}
+
+// Return the number of bytes of custom metadata that may still be set on the
+// supplied object through extended attributes, or zero if other clients have
+// already set more than xattrMetadataLimit allows.
+func metadataBudget(o *gcs.Object) (n int) {
+	n = xattrMetadataLimit - inode.CustomMetadataSize(userMetadata(o))
+	if n < 0 {
+		n = 0
+	}
+
+	return
+}
+
+// Flags for SetXattrOp, with the same values on Linux and OS X.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// The errors returned by SetXattr and RemoveXattr for the read-only
+// attributes and reserved metadata keys; for attributes that can't be set at
+// all, such as those of directories or outside xattrPrefix; for metadata that
+// GCS wouldn't accept; and when the file's object has been modified or
+// deleted in GCS.
+var (
+	errXattrReadOnly    = bazilfuse.Errno(syscall.EPERM)
+	errXattrUnsupported = bazilfuse.Errno(syscall.ENOTSUP)
+	errXattrInvalid     = bazilfuse.Errno(syscall.EINVAL)
+	errXattrTooLarge    = bazilfuse.Errno(syscall.ENOSPC)
+	errXattrStale       = bazilfuse.Errno(syscall.ESTALE)
+)
+
+// Return the value of the named extended attribute of the supplied object.
+func xattrValue(o *gcs.Object, name string) (value string, ok bool) {
+	if strings.HasPrefix(name, xattrMetadataPrefix) {
+		value, ok = o.Metadata[strings.TrimPrefix(name, xattrMetadataPrefix)]
+		return
+	}
+
+	for _, a := range xattrSynthetic {
+		if a.name == name {
+			value, ok = a.value(o)
+			return
+		}
+	}
+
+	return
+}
+
+// Return the value of the named attribute in xattrLocal, if it is one.
+//
+// LOCKS_REQUIRED(f)
+func xattrLocalValue(
+	ctx context.Context,
+	f *inode.FileInode,
+	name string) (value string, ok bool, err error) {
+	for _, a := range xattrLocal {
+		if a.name == name {
+			ok = true
+			value, err = a.value(ctx, f)
+			return
+		}
+	}
+
+	return
+}
+
+// Is the name that of one of the attributes in xattrLocal?
+func isXattrLocal(name string) bool {
+	for _, a := range xattrLocal {
+		if a.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the names of the extended attributes of the supplied object: the
+// read-only ones, then those for custom metadata in sorted order.
+func xattrNames(o *gcs.Object) (names []string) {
+	for _, a := range xattrSynthetic {
+		if _, ok := a.value(o); ok {
+			names = append(names, a.name)
+		}
+	}
+
+	var keys []string
+	for k := range o.Metadata {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		names = append(names, xattrMetadataPrefix+k)
+	}
+
+	return
+}
+
+// Return the file inode with the given ID, or nil if it's some other kind of
+// inode. Only files have extended attributes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) xattrFile(id fuseops.InodeID) (f *inode.FileInode) {
+	fs.mu.Lock()
+	f, _ = fs.inodes[id].(*inode.FileInode)
+	fs.mu.Unlock()
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) GetXattr(
+	op *fuseops.GetXattrOp) (err error) {
+	f := fs.xattrFile(op.Inode)
+	if f == nil {
+		err = fuse.ENOATTR
+		return
+	}
+
+	f.Lock()
+	o := f.Source()
+	value, ok, err := xattrLocalValue(op.Context(), f, op.Name)
+	f.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("%s: %v", op.Name, err)
+		return
+	}
+
+	if !ok {
+		value, ok = xattrValue(&o, op.Name)
+	}
+
+	if !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	if op.Size != 0 && uint32(len(value)) > op.Size {
+		err = fuse.ERANGE
+		return
+	}
+
+	op.Value = []byte(value)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ListXattr(
+	op *fuseops.ListXattrOp) (err error) {
+	f := fs.xattrFile(op.Inode)
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	o := f.Source()
+	f.Unlock()
+
+	names := xattrNames(&o)
+	for _, a := range xattrLocal {
+		names = append(names, a.name)
+	}
+
+	var size int
+	for _, name := range names {
+		size += len(name) + 1
+	}
+
+	if op.Size != 0 && size > int(op.Size) {
+		err = fuse.ERANGE
+		return
+	}
+
+	op.Names = names
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SetXattr(
+	op *fuseops.SetXattrOp) (err error) {
+	value := string(op.Value)
+	if op.Name == xattrFlatten {
+		err = fs.flattenFile(op.Context(), op.Inode, value)
+		return
+	}
+
+	err = fs.updateXattr(op.Context(), op.Inode, op.Name, &value, op.Flags)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) RemoveXattr(
+	op *fuseops.RemoveXattrOp) (err error) {
+	err = fs.updateXattr(op.Context(), op.Inode, op.Name, nil, xattrReplace)
+	return
+}
+
+// Flatten the file's object, as requested by setting xattrFlatten to the
+// supplied value. If the file is dirty this happens when it is next synced;
+// otherwise it happens now.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) flattenFile(
+	ctx context.Context,
+	id fuseops.InodeID,
+	value string) (err error) {
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
+	if value != "1" {
+		err = errXattrInvalid
+		return
+	}
+
+	f := fs.xattrFile(id)
+	if f == nil {
+		err = errXattrUnsupported
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.IsDecompressedView() {
+		err = errViewReadOnly
+		return
+	}
+
+	// The rewrite is preconditioned on the generation we have, so this fails
+	// safely if the object has been modified remotely.
+	err = f.Flatten(ctx)
+	switch err.(type) {
+	case nil:
+	case *inode.ClobberedError, *gcs.PreconditionError:
+		err = errXattrStale
+		return
+
+	case *gcsproxy.EncryptionError:
+		logger.Errorf("Flatten refused: %v", err)
+		err = errEncrypted
+		return
+
+	default:
+		err = fmt.Errorf("Flatten: %v", err)
+		return
+	}
+
+	return
+}
+
+// Set the named extended attribute of a file to the supplied value, or remove
+// it if value is nil, by updating the metadata of the file's object.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) updateXattr(
+	ctx context.Context,
+	id fuseops.InodeID,
+	name string,
+	value *string,
+	flags uint32) (err error) {
+	// Nothing may be modified in a read-only file system.
+	if fs.readOnly {
+		err = errReadOnlyFS
+		return
+	}
+
+	// Only metadata may be changed, and not that which we manage ourselves.
+	key := strings.TrimPrefix(name, xattrMetadataPrefix)
+	switch {
+	case isXattrLocal(name):
+		err = errXattrReadOnly
+		return
+
+	case !strings.HasPrefix(name, xattrPrefix):
+		err = errXattrUnsupported
+		return
+
+	case !strings.HasPrefix(name, xattrMetadataPrefix):
+		err = errXattrReadOnly
+		return
+
+	case key == "":
+		err = errXattrInvalid
+		return
+
+	case strings.HasPrefix(key, "gcsfuse_"):
+		err = errXattrReadOnly
+		return
+	}
+
+	f := fs.xattrFile(id)
+	if f == nil {
+		err = errXattrUnsupported
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.IsDecompressedView() {
+		err = errViewReadOnly
+		return
+	}
+
+	// Check the flags against what is there now.
+	o := f.Source()
+	_, exists := o.Metadata[key]
+	switch {
+	case flags&xattrCreate != 0 && exists:
+		err = fuse.EEXIST
+		return
+
+	case flags&xattrReplace != 0 && !exists:
+		err = fuse.ENOATTR
+		return
+	}
+
+	// Check that GCS will accept the result, leaving room for the keys that we
+	// set ourselves.
+	if value != nil {
+		m := userMetadata(&o)
+		m[key] = *value
+
+		switch inode.CheckCustomMetadata(m) {
+		case nil:
+		case inode.ErrMetadataTooLarge:
+			err = errXattrTooLarge
+			return
+
+		default:
+			err = errXattrInvalid
+			return
+		}
+
+		if inode.CustomMetadataSize(m) > xattrMetadataLimit {
+			err = errXattrTooLarge
+			return
+		}
+	}
+
+	err = f.UpdateMetadata(ctx, key, value)
+	switch err.(type) {
+	case nil:
+	case *gcs.PreconditionError, *gcs.NotFoundError:
+		err = errXattrStale
+		return
+
+	default:
+		err = fmt.Errorf("UpdateMetadata: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,502 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestXattr(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for the extended attributes of files. Each test creates the file
+// system, read-only or not, and looks up "foo", which has some custom
+// metadata.
+type XattrTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	fs     *fileSystem
+
+	// The object "foo", and the inode for it.
+	o  *gcs.Object
+	id fuseops.InodeID
+
+	// The chunk size with which the file system reads objects, or zero for the
+	// default.
+	chunkSize uint64
+}
+
+func init() { RegisterTestSuite(&XattrTest{}) }
+
+func (t *XattrTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.o, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:        "foo",
+			ContentType: "text/plain",
+			Metadata:    map[string]string{"owner": "taco"},
+			Contents:    strings.NewReader("burrito"),
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *XattrTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+// Create the file system and look up "foo".
+func (t *XattrTest) mount(readOnly bool) {
+	var err error
+	t.fs, err = newFileSystem(&ServerConfig{
+		Clock:                &t.clock,
+		Bucket:               t.bucket,
+		TempDirLimitNumFiles: 16,
+		TempDirLimitBytes:    1 << 22,
+		TmpObjectPrefix:      ".gcsfuse_tmp/",
+		FilePerms:            0644,
+		DirPerms:             0755,
+		ReadOnly:             readOnly,
+		GCSChunkSize:         t.chunkSize,
+	})
+
+	AssertEq(nil, err)
+
+	t.fs.mu.Lock()
+	root := t.fs.inodes[fuseops.RootInodeID].(inode.DirInode)
+	t.fs.mu.Unlock()
+
+	child, err := t.fs.lookUpOrCreateChildInode(t.ctx, root, "foo")
+	AssertEq(nil, err)
+	child.Unlock()
+
+	t.id = child.ID()
+}
+
+func (t *XattrTest) get(name string) (value string, err error) {
+	op := &fuseops.GetXattrOp{Inode: t.id, Name: name}
+	err = t.fs.GetXattr(op)
+	value = string(op.Value)
+	return
+}
+
+func (t *XattrTest) set(name string, value string, flags uint32) error {
+	return t.fs.SetXattr(&fuseops.SetXattrOp{
+		Inode: t.id,
+		Name:  name,
+		Value: []byte(value),
+		Flags: flags,
+	})
+}
+
+func (t *XattrTest) remove(name string) error {
+	return t.fs.RemoveXattr(&fuseops.RemoveXattrOp{Inode: t.id, Name: name})
+}
+
+// Return the current record for "foo" in the bucket.
+func (t *XattrTest) stat() *gcs.Object {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	return o
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *XattrTest) Get_Metadata() {
+	t.mount(false)
+
+	value, err := t.get("user.gcs.metadata.owner")
+	AssertEq(nil, err)
+	ExpectEq("taco", value)
+
+	_, err = t.get("user.gcs.metadata.pipeline")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) Get_Synthetic() {
+	t.mount(false)
+
+	value, err := t.get("user.gcs.generation")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprint(t.o.Generation), value)
+
+	value, err = t.get("user.gcs.crc32c")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprintf("%08x", t.o.CRC32C), value)
+
+	value, err = t.get("user.gcs.md5")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprintf("%x", *t.o.MD5), value)
+
+	value, err = t.get("user.gcs.content_type")
+	AssertEq(nil, err)
+	ExpectEq("text/plain", value)
+}
+
+func (t *XattrTest) Get_Unknown() {
+	t.mount(false)
+
+	_, err := t.get("user.gcs.taco")
+	ExpectEq(fuse.ENOATTR, err)
+
+	_, err = t.get("security.capability")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) Get_BufferTooSmall() {
+	t.mount(false)
+
+	// Asking for the size alone is fine.
+	op := &fuseops.GetXattrOp{Inode: t.id, Name: "user.gcs.metadata.owner"}
+	AssertEq(nil, t.fs.GetXattr(op))
+	ExpectEq("taco", string(op.Value))
+
+	op = &fuseops.GetXattrOp{
+		Inode: t.id,
+		Name:  "user.gcs.metadata.owner",
+		Size:  3,
+	}
+
+	ExpectEq(fuse.ERANGE, t.fs.GetXattr(op))
+}
+
+func (t *XattrTest) List() {
+	t.mount(false)
+
+	op := &fuseops.ListXattrOp{Inode: t.id}
+	AssertEq(nil, t.fs.ListXattr(op))
+
+	ExpectThat(
+		op.Names,
+		ElementsAre(
+			"user.gcs.generation",
+			"user.gcs.metageneration",
+			"user.gcs.crc32c",
+			"user.gcs.md5",
+			"user.gcs.content_type",
+			"user.gcs.metadata.owner",
+			"user.gcsfuse.cached_bytes",
+			"user.gcsfuse.cached_ratio",
+			"user.gcsfuse.metadata_budget",
+			"user.gcsfuse.sync_plan",
+		))
+
+	op = &fuseops.ListXattrOp{Inode: t.id, Size: 10}
+	ExpectEq(fuse.ERANGE, t.fs.ListXattr(op))
+}
+
+func (t *XattrTest) List_Directory() {
+	t.mount(false)
+
+	op := &fuseops.ListXattrOp{Inode: fuseops.RootInodeID}
+	AssertEq(nil, t.fs.ListXattr(op))
+	ExpectThat(op.Names, ElementsAre())
+}
+
+func (t *XattrTest) Set_Metadata() {
+	t.mount(false)
+
+	AssertEq(nil, t.set("user.gcs.metadata.pipeline", "enchilada", 0))
+	AssertEq(nil, t.set("user.gcs.metadata.owner", "queso", 0))
+
+	// Only the metadata should have changed in GCS.
+	o := t.stat()
+	ExpectEq(t.o.Generation, o.Generation)
+	ExpectEq("enchilada", o.Metadata["pipeline"])
+	ExpectEq("queso", o.Metadata["owner"])
+
+	// The inode should see the changes.
+	value, err := t.get("user.gcs.metadata.pipeline")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", value)
+
+	value, err = t.get("user.gcs.metageneration")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprint(o.MetaGeneration), value)
+}
+
+func (t *XattrTest) Set_KeptOnWrite() {
+	t.mount(false)
+
+	AssertEq(nil, t.set("user.gcs.metadata.pipeline", "enchilada", 0))
+
+	// Modify the file through a handle, and close it.
+	openOp := &fuseops.OpenFileOp{Inode: t.id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  t.id,
+		Handle: openOp.Handle,
+		Data:   []byte("queso"),
+	})
+
+	AssertEq(nil, err)
+
+	err = t.fs.FlushFile(
+		&fuseops.FlushFileOp{Inode: t.id, Handle: openOp.Handle})
+
+	AssertEq(nil, err)
+
+	err = t.fs.ReleaseFileHandle(
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	AssertEq(nil, err)
+
+	// The new generation should carry the metadata over.
+	o := t.stat()
+	AssertNe(t.o.Generation, o.Generation)
+	ExpectEq("enchilada", o.Metadata["pipeline"])
+	ExpectEq("taco", o.Metadata["owner"])
+
+	value, err := t.get("user.gcs.metadata.pipeline")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", value)
+}
+
+func (t *XattrTest) Set_Flags() {
+	t.mount(false)
+
+	ExpectEq(fuse.EEXIST, t.set("user.gcs.metadata.owner", "queso", xattrCreate))
+	ExpectEq(
+		fuse.ENOATTR,
+		t.set("user.gcs.metadata.pipeline", "queso", xattrReplace))
+
+	ExpectEq(nil, t.set("user.gcs.metadata.owner", "queso", xattrReplace))
+	ExpectEq(nil, t.set("user.gcs.metadata.pipeline", "queso", xattrCreate))
+}
+
+func (t *XattrTest) Set_ReadOnlyAttributes() {
+	t.mount(false)
+
+	ExpectEq(errXattrReadOnly, t.set("user.gcs.generation", "17", 0))
+	ExpectEq(errXattrReadOnly, t.set("user.gcs.content_type", "text/html", 0))
+	ExpectEq(errXattrReadOnly, t.set("user.gcs.metadata.gcsfuse_mtime", "", 0))
+	ExpectEq(errXattrReadOnly, t.set("user.gcsfuse.cached_bytes", "0", 0))
+	ExpectEq(errXattrUnsupported, t.set("user.owner", "taco", 0))
+
+	// Nothing should have been written.
+	ExpectEq(1, t.stat().MetaGeneration)
+}
+
+func (t *XattrTest) Set_TooLarge() {
+	t.mount(false)
+
+	value := strings.Repeat("x", inode.MaxCustomMetadataBytes)
+	ExpectEq(errXattrTooLarge, t.set("user.gcs.metadata.big", value, 0))
+	ExpectEq(errXattrInvalid, t.set("user.gcs.metadata.ctl", "\x00", 0))
+}
+
+func (t *XattrTest) MetadataBudget() {
+	t.mount(false)
+
+	// The budget leaves out room for the keys we set ourselves, and counts
+	// the existing "owner" key.
+	AssertLt(0, xattrMetadataReserve)
+	budget := xattrMetadataLimit - len("owner") - len("taco")
+
+	value, err := t.get("user.gcsfuse.metadata_budget")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprint(budget), value)
+
+	// Filling it exactly is fine, but one more byte is not.
+	big := strings.Repeat("x", budget-len("big"))
+	ExpectEq(errXattrTooLarge, t.set("user.gcs.metadata.big", big+"x", 0))
+	AssertEq(nil, t.set("user.gcs.metadata.big", big, 0))
+
+	value, err = t.get("user.gcsfuse.metadata_budget")
+	AssertEq(nil, err)
+	ExpectEq("0", value)
+
+	ExpectEq(errXattrTooLarge, t.set("user.gcs.metadata.a", "", 0))
+
+	// Removing a key frees its room again.
+	AssertEq(nil, t.remove("user.gcs.metadata.owner"))
+
+	value, err = t.get("user.gcsfuse.metadata_budget")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprint(len("owner")+len("taco")), value)
+}
+
+func (t *XattrTest) MetadataBudget_SyncStillFits() {
+	t.mount(false)
+
+	// Use up the budget.
+	budget := xattrMetadataLimit - len("owner") - len("taco")
+	big := strings.Repeat("x", budget-len("big"))
+	AssertEq(nil, t.set("user.gcs.metadata.big", big, 0))
+
+	// Write to the file and flush it, which records its mtime. Then record an
+	// atime, as persisting atimes would.
+	openOp := &fuseops.OpenFileOp{Inode: t.id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	err := t.fs.WriteFile(&fuseops.WriteFileOp{
+		Inode:  t.id,
+		Handle: openOp.Handle,
+		Data:   []byte("queso"),
+	})
+
+	AssertEq(nil, err)
+
+	err = t.fs.FlushFile(
+		&fuseops.FlushFileOp{Inode: t.id, Handle: openOp.Handle})
+
+	AssertEq(nil, err)
+
+	o := t.stat()
+	atime := o.Updated.UTC().Format(time.RFC3339Nano)
+	_, err = t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     "foo",
+			Metadata: map[string]*string{inode.AtimeMetadataKey: &atime},
+		})
+
+	AssertEq(nil, err)
+
+	// The result should still be within what GCS accepts.
+	o = t.stat()
+	ExpectEq(big, o.Metadata["big"])
+	ExpectNe("", o.Metadata[inode.AtimeMetadataKey])
+	ExpectNe("", o.Metadata["gcsfuse_mtime"])
+	ExpectEq(nil, inode.CheckCustomMetadata(o.Metadata))
+}
+
+func (t *XattrTest) Set_Clobbered() {
+	t.mount(false)
+
+	// Overwrite the object behind the inode's back.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "queso")
+	AssertEq(nil, err)
+
+	// The update must not land on the new generation.
+	ExpectEq(errXattrStale, t.set("user.gcs.metadata.pipeline", "enchilada", 0))
+	ExpectEq("", t.stat().Metadata["pipeline"])
+}
+
+func (t *XattrTest) Set_Directory() {
+	t.mount(false)
+
+	err := t.fs.SetXattr(&fuseops.SetXattrOp{
+		Inode: fuseops.RootInodeID,
+		Name:  "user.gcs.metadata.owner",
+		Value: []byte("taco"),
+	})
+
+	ExpectEq(errXattrUnsupported, err)
+}
+
+func (t *XattrTest) Remove() {
+	t.mount(false)
+
+	AssertEq(nil, t.remove("user.gcs.metadata.owner"))
+
+	o := t.stat()
+	ExpectEq(t.o.Generation, o.Generation)
+	_, ok := o.Metadata["owner"]
+	ExpectFalse(ok)
+
+	_, err := t.get("user.gcs.metadata.owner")
+	ExpectEq(fuse.ENOATTR, err)
+
+	ExpectEq(fuse.ENOATTR, t.remove("user.gcs.metadata.owner"))
+	ExpectEq(errXattrReadOnly, t.remove("user.gcs.crc32c"))
+}
+
+func (t *XattrTest) Residency() {
+	// Read "burrito" in two chunks.
+	t.chunkSize = 4
+	t.mount(false)
+
+	value, err := t.get("user.gcsfuse.cached_bytes")
+	AssertEq(nil, err)
+	ExpectEq("0", value)
+
+	// Read the first chunk.
+	openOp := &fuseops.OpenFileOp{Inode: t.id}
+	AssertEq(nil, t.fs.OpenFile(openOp))
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  t.id,
+		Handle: openOp.Handle,
+		Size:   4,
+	}
+
+	AssertEq(nil, t.fs.ReadFile(readOp))
+	AssertEq("burr", string(readOp.Data))
+
+	value, err = t.get("user.gcsfuse.cached_bytes")
+	AssertEq(nil, err)
+	ExpectEq("4", value)
+
+	value, err = t.get("user.gcsfuse.cached_ratio")
+	AssertEq(nil, err)
+	ExpectEq("0.571", value)
+
+	// Once the handle is closed, the chunk can be evicted.
+	AssertEq(
+		nil,
+		t.fs.ReleaseFileHandle(
+			&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle}))
+
+	t.fs.leaser.RevokeReadLeases()
+
+	value, err = t.get("user.gcsfuse.cached_bytes")
+	AssertEq(nil, err)
+	ExpectEq("0", value)
+
+	value, err = t.get("user.gcsfuse.cached_ratio")
+	AssertEq(nil, err)
+	ExpectEq("0.000", value)
+}
+
+func (t *XattrTest) ReadOnly() {
+	t.mount(true)
+
+	value, err := t.get("user.gcs.metadata.owner")
+	AssertEq(nil, err)
+	ExpectEq("taco", value)
+
+	ExpectEq(errReadOnlyFS, t.set("user.gcs.metadata.owner", "queso", 0))
+	ExpectEq(errReadOnlyFS, t.remove("user.gcs.metadata.owner"))
+}
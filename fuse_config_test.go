@@ -0,0 +1,242 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jacobsa/bazilfuse"
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestFuseConfig(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FuseConfigTest struct {
+}
+
+func init() { RegisterTestSuite(&FuseConfigTest{}) }
+
+// Return the response that would be sent to a kernel with the given protocol
+// version and readahead, for a mount with the supplied --max-write.
+func negotiate(
+	kernel bazilfuse.Protocol,
+	kernelMaxReadahead uint32,
+	maxWrite int64) (resp *bazilfuse.InitResponse) {
+	flags := parseArgs([]string{})
+	flags.MaxWrite = maxWrite
+
+	cfg, err := fuseMountConfig("some_bucket", flags)
+	AssertEq(nil, err)
+
+	opts := []bazilfuse.MountOption{bazilfuse.MaxReadahead(1 << 20)}
+	if cfg.MaxWrite != 0 {
+		opts = append(opts, bazilfuse.MaxWrite(cfg.MaxWrite))
+	}
+
+	if cfg.EnableAtomicTrunc {
+		opts = append(opts, bazilfuse.AtomicOTrunc())
+	}
+
+	req := &bazilfuse.InitRequest{
+		Kernel:       kernel,
+		MaxReadahead: kernelMaxReadahead,
+	}
+
+	resp, err = bazilfuse.NewInitResponse(req, opts...)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FuseConfigTest) DefaultMaxWrite() {
+	cfg, err := fuseMountConfig("some_bucket", parseArgs([]string{}))
+	AssertEq(nil, err)
+
+	ExpectEq("some_bucket", cfg.FSName)
+	ExpectEq(0, cfg.MaxWrite)
+}
+
+func (t *FuseConfigTest) MaxWriteFlag() {
+	cfg, err := fuseMountConfig(
+		"some_bucket",
+		parseArgs([]string{"--max-write=1048576"}))
+
+	AssertEq(nil, err)
+	ExpectEq(1<<20, cfg.MaxWrite)
+}
+
+func (t *FuseConfigTest) IllegalMaxWrite() {
+	for _, n := range []int64{-1, 4095, bazilfuse.MaxWriteLimit + 1} {
+		flags := parseArgs([]string{})
+		flags.MaxWrite = n
+
+		_, err := fuseMountConfig("some_bucket", flags)
+		ExpectThat(err, Error(HasSubstr("--max-write")), "n: %d", n)
+	}
+}
+
+func (t *FuseConfigTest) LargeWritesAdvertised() {
+	resp := negotiate(bazilfuse.Protocol{Major: 7, Minor: 12}, 1<<20, 1<<20)
+
+	ExpectEq(1<<20, resp.MaxWrite)
+	ExpectEq(1<<20, resp.MaxReadahead)
+	ExpectNe(0, resp.Flags&bazilfuse.InitBigWrites)
+}
+
+func (t *FuseConfigTest) AtomicTruncAdvertised() {
+	resp := negotiate(bazilfuse.Protocol{Major: 7, Minor: 12}, 1<<20, 0)
+	ExpectNe(0, resp.Flags&bazilfuse.InitAtomicTrunc)
+}
+
+func (t *FuseConfigTest) OlderKernel() {
+	// A kernel that speaks an older protocol version and reads ahead less than
+	// we would like should get what it offered, not what we asked for.
+	resp := negotiate(bazilfuse.Protocol{Major: 7, Minor: 8}, 128<<10, 1<<20)
+
+	ExpectEq(7, resp.Library.Major)
+	ExpectEq(8, resp.Library.Minor)
+	ExpectEq(128<<10, resp.MaxReadahead)
+	ExpectEq(1<<20, resp.MaxWrite)
+}
+
+func (t *FuseConfigTest) PlatformDefaultMaxWrite() {
+	resp := negotiate(bazilfuse.Protocol{Major: 7, Minor: 12}, 1<<20, 0)
+
+	ExpectGe(resp.MaxWrite, 128<<10)
+	ExpectLe(resp.MaxWrite, bazilfuse.MaxWriteLimit)
+}
+
+func (t *FuseConfigTest) DebugLoggerOnlyWithFlag() {
+	cfg, err := fuseMountConfig("some_bucket", parseArgs([]string{}))
+	AssertEq(nil, err)
+	ExpectEq(nil, cfg.DebugLogger)
+
+	cfg, err = fuseMountConfig(
+		"some_bucket",
+		parseArgs([]string{"--debug_fuse"}))
+
+	AssertEq(nil, err)
+	ExpectNe(nil, cfg.DebugLogger)
+}
+
+func (t *FuseConfigTest) OpReceiptLogged() {
+	var msgs []string
+	debugLog := func(calldepth int, format string, v ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, v...))
+	}
+
+	req := &bazilfuse.LookupRequest{
+		Header: bazilfuse.Header{Node: 17},
+		Name:   "taco",
+	}
+
+	op := fuseops.Convert(
+		context.Background(),
+		req,
+		debugLog,
+		nil,
+		func(error) {})
+
+	AssertEq(1, len(msgs))
+	ExpectThat(msgs[0], HasSubstr("<- ("+op.ShortDesc()+")"))
+	ExpectThat(msgs[0], HasSubstr(`"taco"`))
+}
+
+func (t *FuseConfigTest) OpReceiptFormat() {
+	var msgs []string
+	debugLog := func(calldepth int, format string, v ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, v...))
+	}
+
+	req := &bazilfuse.LookupRequest{
+		Header: bazilfuse.Header{Node: 17},
+		Name:   "taco",
+	}
+
+	fuseops.Convert(context.Background(), req, debugLog, nil, func(error) {})
+
+	AssertEq(1, len(msgs))
+	ExpectEq(
+		fmt.Sprintf(`<- (LookUpInode(parent=17, name="taco")) %v`, req),
+		msgs[0])
+}
+
+func (t *FuseConfigTest) NoLoggingAllocationsWhenDisabled() {
+	req := &bazilfuse.LookupRequest{
+		Header: bazilfuse.Header{Node: 17},
+		Name:   "taco",
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		fuseops.Convert(context.Background(), req, nil, nil, func(error) {})
+	})
+
+	// The op itself and the callback that reports its completion. Nothing is
+	// formatted, not even the op's description.
+	ExpectLe(allocs, 2)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Benchmarks
+////////////////////////////////////////////////////////////////////////
+
+// Receive a lookup op, as the connection would for each request from the
+// kernel, and log a line from within the file system about it. Compare
+// allocations per op with debug logging disabled and enabled.
+func BenchmarkOpLogging(b *testing.B) {
+	enabled := func(calldepth int, format string, v ...interface{}) {
+		fmt.Fprintf(ioutil.Discard, format, v...)
+	}
+
+	cases := []struct {
+		name     string
+		debugLog func(int, string, ...interface{})
+	}{
+		{"disabled", nil},
+		{"enabled", enabled},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			req := &bazilfuse.LookupRequest{
+				Header: bazilfuse.Header{Node: 17},
+				Name:   "taco",
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				fuseops.Convert(
+					context.Background(),
+					req,
+					c.debugLog,
+					nil,
+					func(error) {})
+			}
+		})
+	}
+}
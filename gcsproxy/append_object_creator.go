@@ -15,63 +15,195 @@
 package gcsproxy
 
 import (
-	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
 )
 
+// Custom metadata keys recorded on each temporary object when it is created,
+// saying which object it is destined to be appended to, the generation of that
+// object it was derived from, and the mount that created it. They are checked
+// before composing, and help attribute any temporary objects left behind.
+const (
+	TmpTargetMetadataKey           = "gcsfuse_tmp_target"
+	TmpSourceGenerationMetadataKey = "gcsfuse_tmp_source_generation"
+	TmpMountIDMetadataKey          = "gcsfuse_tmp_mount_id"
+)
+
+// The prefix shared by the keys above, which describe a temporary object and
+// mustn't be carried over to the objects derived from it.
+const tmpMetadataKeyPrefix = "gcsfuse_tmp_"
+
 // Create an objectCreator that accepts a source object and the contents that
 // should be "appended" to it, storing temporary objects using the supplied
 // prefix.
 //
+// Temporary object names combine the mount ID, a hash of the source object's
+// name, the time, and a random component, so that mounts sharing a prefix
+// don't collide. Should a name nevertheless already be taken, or the
+// temporary object not turn out to be the one we asked for, Create fails
+// without composing anything.
+//
 // Note that the Create method will attempt to remove any temporary junk left
 // behind, but it may fail to do so. Users should arrange for garbage collection.
 //
 // Create guarantees to return *gcs.PreconditionError when the source object
-// has been clobbered.
+// has been clobbered, and never otherwise.
 func newAppendObjectCreator(
 	prefix string,
+	mountID string,
+	clock timeutil.Clock,
+	randSrc io.Reader,
 	bucket gcs.Bucket) (oc objectCreator) {
 	oc = &appendObjectCreator{
-		prefix: prefix,
+		tmpObjectNamer: tmpObjectNamer{
+			prefix:  prefix,
+			mountID: mountID,
+			clock:   clock,
+			randSrc: randSrc,
+		},
 		bucket: bucket,
 	}
 
 	return
 }
 
+// Generate a random (version 4) UUID identifying this mount in the names and
+// metadata of its temporary objects.
+func newMountID(randSrc io.Reader) (id string, err error) {
+	var b [16]byte
+	_, err = io.ReadFull(randSrc, b[:])
+	if err != nil {
+		err = fmt.Errorf("ReadFull: %v", err)
+		return
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	id = fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Implementation
 ////////////////////////////////////////////////////////////////////////
 
+// Names temporary objects and the metadata they carry, for the object creators
+// that use them.
+type tmpObjectNamer struct {
+	prefix  string
+	mountID string
+	clock   timeutil.Clock
+	randSrc io.Reader
+}
+
 type appendObjectCreator struct {
-	prefix string
+	tmpObjectNamer
 	bucket gcs.Bucket
 }
 
-func (oc *appendObjectCreator) chooseName() (name string, err error) {
+// Choose a name for a temporary object holding contents destined for the
+// named object.
+func (oc *tmpObjectNamer) chooseName(
+	target string) (name string, err error) {
 	// Generate a good 64-bit random number.
 	var buf [8]byte
-	_, err = io.ReadFull(rand.Reader, buf[:])
+	_, err = io.ReadFull(oc.randSrc, buf[:])
 	if err != nil {
 		err = fmt.Errorf("ReadFull: %v", err)
 		return
 	}
 
-	x := uint64(buf[0])<<0 |
-		uint64(buf[1])<<8 |
-		uint64(buf[2])<<16 |
-		uint64(buf[3])<<24 |
-		uint64(buf[4])<<32 |
-		uint64(buf[5])<<40 |
-		uint64(buf[6])<<48 |
-		uint64(buf[7])<<56
+	x := binary.LittleEndian.Uint64(buf[:])
 
-	// Turn it into a name.
-	name = fmt.Sprintf("%s%016x", oc.prefix, x)
+	// Mix in the target and time, so that even mounts sharing an ID or a poor
+	// random source don't collide on different objects.
+	h := sha256.Sum256([]byte(target))
+	name = fmt.Sprintf(
+		"%s%s.%016x.%016x.%016x",
+		oc.prefix,
+		oc.mountID,
+		binary.BigEndian.Uint64(h[:8]),
+		oc.clock.Now().UnixNano(),
+		x)
+
+	return
+}
+
+// The metadata with which we create a temporary object for the source object.
+func (oc *tmpObjectNamer) tmpMetadata(
+	srcObject *gcs.Object) (m map[string]string) {
+	m = map[string]string{
+		TmpTargetMetadataKey:           srcObject.Name,
+		TmpSourceGenerationMetadataKey: strconv.FormatInt(srcObject.Generation, 10),
+		TmpMountIDMetadataKey:          oc.mountID,
+	}
+
+	return
+}
+
+// Read back the record of the temporary object tmp, just created, and return
+// an error if GCS doesn't hold it under the name and with the metadata we
+// asked for, for example because somebody else's object has taken its place.
+func verifyTmpObject(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	tmp *gcs.Object,
+	name string,
+	metadata map[string]string) (err error) {
+	if tmp.Name != name {
+		err = fmt.Errorf("got object %q, expected %q", tmp.Name, name)
+		return
+	}
+
+	o, err := bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	if o.Generation != tmp.Generation {
+		err = fmt.Errorf(
+			"%q has generation %d, expected %d",
+			name,
+			o.Generation,
+			tmp.Generation)
+		return
+	}
+
+	err = checkTmpObject(o, name, metadata)
+	return
+}
+
+// Return an error if the supplied temporary object is not the one we asked to
+// create.
+func checkTmpObject(
+	tmp *gcs.Object,
+	name string,
+	metadata map[string]string) (err error) {
+	if tmp.Name != name {
+		err = fmt.Errorf("got object %q, expected %q", tmp.Name, name)
+		return
+	}
+
+	for k, v := range metadata {
+		if tmp.Metadata[k] != v {
+			err = fmt.Errorf(
+				"%q has %s %q, expected %q",
+				tmp.Name,
+				k,
+				tmp.Metadata[k],
+				v)
+			return
+		}
+	}
 
 	return
 }
@@ -79,45 +211,61 @@ func (oc *appendObjectCreator) chooseName() (name string, err error) {
 func (oc *appendObjectCreator) Create(
 	ctx context.Context,
 	srcObject *gcs.Object,
-	r io.Reader) (o *gcs.Object, err error) {
+	metadata map[string]string,
+	r io.Reader,
+	sums *uploadChecksums) (o *gcs.Object, err error) {
 	// Choose a name for a temporary object.
-	tmpName, err := oc.chooseName()
+	tmpName, err := oc.chooseName(srcObject.Name)
 	if err != nil {
 		err = fmt.Errorf("chooseName: %v", err)
 		return
 	}
 
 	// Create a temporary object containing the additional contents.
+	//
+	// A precondition error here means that the name is taken, which says
+	// nothing about the source object. Report it as an ordinary error, so that
+	// the caller doesn't mistake it for the source having been clobbered and
+	// throw away its contents.
 	var zero int64
+	tmpMetadata := oc.tmpMetadata(srcObject)
 	tmp, err := oc.bucket.CreateObject(
 		ctx,
 		&gcs.CreateObjectRequest{
-			Name: tmpName,
+			Name:                   tmpName,
 			GenerationPrecondition: &zero,
+			Metadata:               tmpMetadata,
 			Contents:               r,
+			CRC32C:                 &sums.CRC32C,
+			MD5:                    &sums.MD5,
+			KmsKeyName:             KmsKeyName(srcObject),
 		})
 
-	// Don't mangle precondition errors.
-	switch typed := err.(type) {
-	case nil:
-
-	case *gcs.PreconditionError:
-		err = &gcs.PreconditionError{
-			Err: fmt.Errorf("CreateObject: %v", typed.Err),
+	if err != nil {
+		// Don't mangle the checksum errors that createChecked retries.
+		if _, ok := err.(*gcs.ChecksumMismatchError); ok {
+			return
 		}
-		return
 
-	default:
 		err = fmt.Errorf("CreateObject: %v", err)
 		return
 	}
 
+	// Make sure we are about to compose the object we created, not somebody
+	// else's. If not, leave it alone for its owner or garbage collection.
+	err = verifyTmpObject(ctx, oc.bucket, tmp, tmpName, tmpMetadata)
+	if err != nil {
+		err = fmt.Errorf("Unexpected temporary object: %v", err)
+		return
+	}
+
 	// Attempt to delete the temporary object when we're done.
 	defer func() {
 		deleteErr := oc.bucket.DeleteObject(
 			ctx,
 			&gcs.DeleteObjectRequest{
-				Name: tmp.Name,
+				Name:       tmp.Name,
+				Generation: tmp.Generation,
 			})
 
 		if err == nil && deleteErr != nil {
@@ -125,12 +273,19 @@ func (oc *appendObjectCreator) Create(
 		}
 	}()
 
+	// Don't compose damaged contents onto the source object.
+	err = sums.check(tmp, false)
+	if err != nil {
+		return
+	}
+
 	// Compose the old contents plus the new over the old.
 	o, err = oc.bucket.ComposeObjects(
 		ctx,
 		&gcs.ComposeObjectsRequest{
 			DstName:                   srcObject.Name,
 			DstGenerationPrecondition: &srcObject.Generation,
+			KmsKeyName:                KmsKeyName(srcObject),
 			Sources: []gcs.ComposeSource{
 				gcs.ComposeSource{
 					Name:       srcObject.Name,
@@ -169,5 +324,6 @@ func (oc *appendObjectCreator) Create(
 		return
 	}
 
+	o = applyComposedMetadata(ctx, oc.bucket, o, metadata)
 	return
 }
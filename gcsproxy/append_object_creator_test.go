@@ -15,17 +15,21 @@
 package gcsproxy
 
 import (
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/mock_gcs"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/oglemock"
 	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
 )
 
@@ -35,6 +39,16 @@ func TestAppendObjectCreator(t *testing.T) { RunTests(t) }
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// Return the checksums of the supplied contents.
+func checksumsOf(contents string) (sums *uploadChecksums) {
+	sums = &uploadChecksums{
+		CRC32C: crc32.Checksum([]byte(contents), castagnoliTable),
+		MD5:    md5.Sum([]byte(contents)),
+	}
+
+	return
+}
+
 func deleteReqName(expected string) (m Matcher) {
 	m = NewMatcher(
 		func(c interface{}) (err error) {
@@ -61,14 +75,20 @@ func deleteReqName(expected string) (m Matcher) {
 ////////////////////////////////////////////////////////////////////////
 
 const prefix = ".gcsfuse_tmp/"
+const mountID = "0b8ad1c6-2f41-4d0e-9a43-8f5e6d1c2b3a"
+
+// Eight bytes that the creator will use as its random component.
+const randBytes = "\x01\x02\x03\x04\x05\x06\x07\x08"
 
 type AppendObjectCreatorTest struct {
 	ctx     context.Context
+	clock   timeutil.SimulatedClock
 	bucket  mock_gcs.MockBucket
 	creator objectCreator
 
 	srcObject   gcs.Object
 	srcContents string
+	metadata    map[string]string
 }
 
 var _ SetUpInterface = &AppendObjectCreatorTest{}
@@ -82,14 +102,50 @@ func (t *AppendObjectCreatorTest) SetUp(ti *TestInfo) {
 	t.bucket = mock_gcs.NewMockBucket(ti.MockController, "bucket")
 
 	// Create the creator.
-	t.creator = newAppendObjectCreator(prefix, t.bucket)
+	t.clock.SetTime(time.Unix(1444000000, 17))
+	t.creator = newAppendObjectCreator(
+		prefix,
+		mountID,
+		&t.clock,
+		strings.NewReader(randBytes),
+		t.bucket)
+
+	t.srcObject.Name = "foo"
+	t.srcObject.Generation = 17
+}
+
+// The name that the creator should choose for its temporary object, given the
+// source object "foo" and the fixed time and random bytes above.
+func (t *AppendObjectCreatorTest) tmpName() string {
+	return prefix + mountID + ".2c26b46b68ffc68f.140a1e596faa0011.0807060504030201"
+}
+
+// A record for the temporary object that the creator asks for, as it would be
+// returned by CreateObject given t.srcContents.
+func (t *AppendObjectCreatorTest) tmpObject(gen int64) (o *gcs.Object) {
+	sums := checksumsOf(t.srcContents)
+	o = &gcs.Object{
+		Name:       t.tmpName(),
+		Generation: gen,
+		CRC32C:     sums.CRC32C,
+		MD5:        &sums.MD5,
+		Metadata: map[string]string{
+			TmpTargetMetadataKey:           "foo",
+			TmpSourceGenerationMetadataKey: "17",
+			TmpMountIDMetadataKey:          mountID,
+		},
+	}
+
+	return
 }
 
 func (t *AppendObjectCreatorTest) call() (o *gcs.Object, err error) {
 	o, err = t.creator.Create(
 		t.ctx,
 		&t.srcObject,
-		strings.NewReader(t.srcContents))
+		t.metadata,
+		strings.NewReader(t.srcContents),
+		checksumsOf(t.srcContents))
 
 	return
 }
@@ -110,8 +166,11 @@ func (t *AppendObjectCreatorTest) CallsCreateObject() {
 	t.call()
 
 	AssertNe(nil, req)
-	ExpectTrue(strings.HasPrefix(req.Name, prefix), "Name: %s", req.Name)
+	ExpectEq(t.tmpName(), req.Name)
 	ExpectThat(req.GenerationPrecondition, Pointee(Equals(0)))
+	ExpectThat(req.Metadata, DeepEquals(t.tmpObject(0).Metadata))
+	ExpectThat(req.CRC32C, Pointee(Equals(checksumsOf("taco").CRC32C)))
+	ExpectThat(req.MD5, Pointee(DeepEquals(checksumsOf("taco").MD5)))
 
 	b, err := ioutil.ReadAll(req.Contents)
 	AssertEq(nil, err)
@@ -142,24 +201,107 @@ func (t *AppendObjectCreatorTest) CreateObjectReturnsPreconditionError() {
 	// Call
 	_, err = t.call()
 
-	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+	// The temporary object's name was taken, which says nothing about the
+	// source object.
+	_, isPrecondErr := err.(*gcs.PreconditionError)
+	ExpectFalse(isPrecondErr)
 	ExpectThat(err, Error(HasSubstr("CreateObject")))
 	ExpectThat(err, Error(HasSubstr("taco")))
 }
 
-func (t *AppendObjectCreatorTest) CallsComposeObjects() {
-	t.srcObject.Name = "foo"
-	t.srcObject.Generation = 17
+func (t *AppendObjectCreatorTest) CreateObjectReturnsForeignObject() {
+	// GCS holds an object recorded as belonging to another mount under the
+	// name, whatever CreateObject said.
+	tmpObject := t.tmpObject(19)
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
+	foreign := t.tmpObject(19)
+	foreign.Metadata[TmpMountIDMetadataKey] = "taco"
+
+	var req *gcs.StatObjectRequest
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(DoAll(SaveArg(1, &req), Return(foreign, nil)))
+
+	// Call. Neither ComposeObjects nor DeleteObject should be called.
+	_, err := t.call()
+
+	_, isPrecondErr := err.(*gcs.PreconditionError)
+	ExpectFalse(isPrecondErr)
+	ExpectThat(err, Error(HasSubstr("Unexpected temporary object")))
+	ExpectThat(err, Error(HasSubstr(TmpMountIDMetadataKey)))
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	AssertNe(nil, req)
+	ExpectEq(t.tmpName(), req.Name)
+}
+
+func (t *AppendObjectCreatorTest) TmpObjectReplaced() {
+	// By the time we read it back, somebody else has replaced the temporary
+	// object.
+	tmpObject := t.tmpObject(19)
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(t.tmpObject(23), nil))
+
+	// Call. Neither ComposeObjects nor DeleteObject should be called.
+	_, err := t.call()
 
+	ExpectThat(err, Error(HasSubstr("Unexpected temporary object")))
+	ExpectThat(err, Error(HasSubstr("generation 23")))
+}
+
+func (t *AppendObjectCreatorTest) CreateObjectReturnsOtherName() {
+	tmpObject := t.tmpObject(19)
+	tmpObject.Name = prefix + "taco"
+
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
+	// Call
+	_, err := t.call()
+
+	ExpectThat(err, Error(HasSubstr("Unexpected temporary object")))
+	ExpectThat(err, Error(HasSubstr(prefix+"taco")))
+}
+
+func (t *AppendObjectCreatorTest) CreateObjectReturnsWrongChecksum() {
+	t.srcContents = "taco"
+
+	// CreateObject returns an object whose contents aren't what we sent.
+	tmpObject := t.tmpObject(19)
+	tmpObject.CRC32C++
+
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
+	// The temporary object should be deleted without being composed.
+	ExpectCall(t.bucket, "DeleteObject")(Any(), deleteReqName(tmpObject.Name)).
+		WillOnce(Return(nil))
+
+	// Call
+	_, err := t.call()
+
+	AssertThat(err, HasSameTypeAs(&uploadChecksumError{}))
+	ExpectEq(nil, err.(*uploadChecksumError).Landed)
+	ExpectThat(err, Error(HasSubstr(tmpObject.Name)))
+}
+
+func (t *AppendObjectCreatorTest) CallsComposeObjects() {
 	// CreateObject
-	tmpObject := &gcs.Object{
-		Name:       "bar",
-		Generation: 19,
-	}
+	tmpObject := t.tmpObject(19)
 
 	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
 		WillOnce(Return(tmpObject, nil))
 
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
 	// ComposeObjects
 	var req *gcs.ComposeObjectsRequest
 	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
@@ -192,13 +334,14 @@ func (t *AppendObjectCreatorTest) CallsComposeObjects() {
 
 func (t *AppendObjectCreatorTest) ComposeObjectsFails() {
 	// CreateObject
-	tmpObject := &gcs.Object{
-		Name: "bar",
-	}
+	tmpObject := t.tmpObject(19)
 
 	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
 		WillOnce(Return(tmpObject, nil))
 
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
 	// ComposeObjects
 	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
 		WillOnce(Return(nil, errors.New("taco")))
@@ -216,13 +359,14 @@ func (t *AppendObjectCreatorTest) ComposeObjectsFails() {
 
 func (t *AppendObjectCreatorTest) ComposeObjectsReturnsPreconditionError() {
 	// CreateObject
-	tmpObject := &gcs.Object{
-		Name: "bar",
-	}
+	tmpObject := t.tmpObject(19)
 
 	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
 		WillOnce(Return(tmpObject, nil))
 
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
 	// ComposeObjects
 	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
 		WillOnce(Return(nil, &gcs.PreconditionError{Err: errors.New("taco")}))
@@ -241,13 +385,14 @@ func (t *AppendObjectCreatorTest) ComposeObjectsReturnsPreconditionError() {
 
 func (t *AppendObjectCreatorTest) ComposeObjectsReturnsNotFoundError() {
 	// CreateObject
-	tmpObject := &gcs.Object{
-		Name: "bar",
-	}
+	tmpObject := t.tmpObject(19)
 
 	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
 		WillOnce(Return(tmpObject, nil))
 
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
 	// ComposeObjects
 	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
 		WillOnce(Return(nil, &gcs.NotFoundError{Err: errors.New("taco")}))
@@ -267,13 +412,14 @@ func (t *AppendObjectCreatorTest) ComposeObjectsReturnsNotFoundError() {
 
 func (t *AppendObjectCreatorTest) CallsDeleteObject() {
 	// CreateObject
-	tmpObject := &gcs.Object{
-		Name: "bar",
-	}
+	tmpObject := t.tmpObject(19)
 
 	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
 		WillOnce(Return(tmpObject, nil))
 
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
 	// ComposeObjects
 	composed := &gcs.Object{}
 	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
@@ -289,13 +435,14 @@ func (t *AppendObjectCreatorTest) CallsDeleteObject() {
 
 func (t *AppendObjectCreatorTest) DeleteObjectFails() {
 	// CreateObject
-	tmpObject := &gcs.Object{
-		Name: "bar",
-	}
+	tmpObject := t.tmpObject(19)
 
 	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
 		WillOnce(Return(tmpObject, nil))
 
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
 	// ComposeObjects
 	composed := &gcs.Object{}
 	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
@@ -314,13 +461,14 @@ func (t *AppendObjectCreatorTest) DeleteObjectFails() {
 
 func (t *AppendObjectCreatorTest) DeleteObjectSucceeds() {
 	// CreateObject
-	tmpObject := &gcs.Object{
-		Name: "bar",
-	}
+	tmpObject := t.tmpObject(19)
 
 	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
 		WillOnce(Return(tmpObject, nil))
 
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(tmpObject, nil))
+
 	// ComposeObjects
 	composed := &gcs.Object{}
 	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
@@ -336,3 +484,120 @@ func (t *AppendObjectCreatorTest) DeleteObjectSucceeds() {
 	AssertEq(nil, err)
 	ExpectEq(composed, o)
 }
+
+func (t *AppendObjectCreatorTest) CallsUpdateObject() {
+	t.metadata = map[string]string{"gcsfuse_mtime": "2015-04-05T02:15:00Z"}
+
+	// CreateObject
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(t.tmpObject(19), nil))
+
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(t.tmpObject(19), nil))
+
+	// ComposeObjects
+	composed := &gcs.Object{Name: "foo", Generation: 23}
+	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
+		WillOnce(Return(composed, nil))
+
+	// UpdateObject
+	var req *gcs.UpdateObjectRequest
+	updated := &gcs.Object{
+		Name:       "foo",
+		Generation: 23,
+		Metadata:   t.metadata,
+	}
+
+	ExpectCall(t.bucket, "UpdateObject")(Any(), Any()).
+		WillOnce(DoAll(SaveArg(1, &req), Return(updated, nil)))
+
+	// DeleteObject
+	ExpectCall(t.bucket, "DeleteObject")(Any(), Any()).
+		WillOnce(Return(nil))
+
+	// Call
+	o, err := t.call()
+
+	AssertEq(nil, err)
+	ExpectEq(updated, o)
+
+	AssertNe(nil, req)
+	ExpectEq("foo", req.Name)
+	AssertNe(nil, req.GenerationPrecondition)
+	ExpectEq(23, *req.GenerationPrecondition)
+	AssertEq(1, len(req.Metadata))
+	AssertNe(nil, req.Metadata["gcsfuse_mtime"])
+	ExpectEq("2015-04-05T02:15:00Z", *req.Metadata["gcsfuse_mtime"])
+}
+
+func (t *AppendObjectCreatorTest) UpdateObjectFails() {
+	t.metadata = map[string]string{"gcsfuse_mtime": "2015-04-05T02:15:00Z"}
+
+	// CreateObject
+	ExpectCall(t.bucket, "CreateObject")(Any(), Any()).
+		WillOnce(Return(t.tmpObject(19), nil))
+
+	ExpectCall(t.bucket, "StatObject")(Any(), Any()).
+		WillOnce(Return(t.tmpObject(19), nil))
+
+	// ComposeObjects
+	composed := &gcs.Object{Name: "foo", Generation: 23}
+	ExpectCall(t.bucket, "ComposeObjects")(Any(), Any()).
+		WillOnce(Return(composed, nil))
+
+	// UpdateObject
+	ExpectCall(t.bucket, "UpdateObject")(Any(), Any()).
+		WillOnce(Return(nil, errors.New("taco")))
+
+	// DeleteObject
+	ExpectCall(t.bucket, "DeleteObject")(Any(), Any()).
+		WillOnce(Return(nil))
+
+	// Call
+	o, err := t.call()
+
+	AssertEq(nil, err)
+	ExpectEq(composed, o)
+}
+
+func (t *AppendObjectCreatorTest) NamesAreDistinct() {
+	oc := &tmpObjectNamer{
+		prefix:  prefix,
+		mountID: mountID,
+		clock:   &t.clock,
+		randSrc: strings.NewReader(randBytes + randBytes + randBytes),
+	}
+
+	// The same random bytes give different names for different targets, and at
+	// different times.
+	a, err := oc.chooseName("foo")
+	AssertEq(nil, err)
+
+	b, err := oc.chooseName("bar")
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Nanosecond)
+	c, err := oc.chooseName("foo")
+	AssertEq(nil, err)
+
+	ExpectEq(t.tmpName(), a)
+	ExpectEq(prefix+mountID+".fcde2b2edba56bf4.140a1e596faa0011.0807060504030201", b)
+	ExpectEq(prefix+mountID+".2c26b46b68ffc68f.140a1e596faa0012.0807060504030201", c)
+
+	// Without randomness, no name is chosen.
+	_, err = oc.chooseName("foo")
+	ExpectThat(err, Error(HasSubstr("ReadFull")))
+}
+
+func (t *AppendObjectCreatorTest) MountIDs() {
+	id, err := newMountID(strings.NewReader(strings.Repeat("\xff", 16)))
+	AssertEq(nil, err)
+	ExpectEq("ffffffff-ffff-4fff-bfff-ffffffffffff", id)
+
+	id, err = newMountID(strings.NewReader(strings.Repeat("\x00", 16)))
+	AssertEq(nil, err)
+	ExpectEq("00000000-0000-4000-8000-000000000000", id)
+
+	_, err = newMountID(strings.NewReader("taco"))
+	ExpectThat(err, Error(HasSubstr("ReadFull")))
+}
@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// A recording of calls made to a bucket, written by a bucket created with
+// NewRecordBucket and played back by one created with NewReplayBucket.
+type Cassette struct {
+	// The name of the recorded bucket, or a placeholder if it was scrubbed.
+	BucketName string
+
+	// The calls made, in the order in which they completed.
+	Interactions []*Interaction
+}
+
+// A single recorded call to a bucket.
+type Interaction struct {
+	// The name of the bucket method called, e.g. "StatObject".
+	Method string
+
+	// The request, normalized to a canonical JSON encoding. The contents of
+	// create requests are represented by their size and hash.
+	Request json.RawMessage
+
+	// The object or listing returned, if any.
+	Object  *gcs.Object  `json:",omitempty"`
+	Listing *gcs.Listing `json:",omitempty"`
+
+	// For NewReader, the contents read through the returned reader.
+	Contents *RecordedContents `json:",omitempty"`
+
+	// The error returned, if any.
+	Error *RecordedError `json:",omitempty"`
+}
+
+// The contents read from an object, as far as the reader got before being
+// closed.
+type RecordedContents struct {
+	Size   int64
+	SHA256 string
+
+	// The full contents, present only if they were small enough to keep.
+	// Otherwise replay synthesizes contents of the same size.
+	Data []byte `json:",omitempty"`
+
+	// The error that ended reading, if other than io.EOF.
+	ReadError *RecordedError `json:",omitempty"`
+}
+
+// An error returned by the recorded bucket. The kind preserves the type of the
+// GCS errors that callers inspect.
+type RecordedError struct {
+	// One of "NotFound", "Precondition", or empty for any other error.
+	Kind    string `json:",omitempty"`
+	Message string
+}
+
+// Read a cassette written with Encode.
+func DecodeCassette(r io.Reader) (c *Cassette, err error) {
+	c = new(Cassette)
+	err = json.NewDecoder(r).Decode(c)
+	if err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	return
+}
+
+// Write the cassette as indented JSON.
+func (c *Cassette) Encode(w io.Writer) (err error) {
+	buf, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("MarshalIndent: %v", err)
+		return
+	}
+
+	_, err = w.Write(append(buf, '\n'))
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the canonical JSON encoding of the supplied request, with any extra
+// fields merged in. Keys are sorted, so equal requests have equal encodings.
+func encodeRequest(
+	req interface{},
+	extra map[string]interface{}) (enc json.RawMessage, err error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	var fields map[string]interface{}
+	if err = decodeJSON(buf, &fields); err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	for k, v := range extra {
+		fields[k] = v
+	}
+
+	enc, err = json.Marshal(fields)
+	return
+}
+
+// Re-encode a request read from a cassette in canonical form, so that
+// formatting differences don't matter when matching.
+func canonicalRequest(raw json.RawMessage) (enc json.RawMessage, err error) {
+	var v interface{}
+	if err = decodeJSON(raw, &v); err != nil {
+		return
+	}
+
+	enc, err = json.Marshal(v)
+	return
+}
+
+// Unmarshal JSON, keeping numbers exact. Generation numbers don't fit in a
+// float64.
+func decodeJSON(buf []byte, v interface{}) (err error) {
+	d := json.NewDecoder(bytes.NewReader(buf))
+	d.UseNumber()
+	err = d.Decode(v)
+	return
+}
+
+func recordError(err error) (re *RecordedError) {
+	if err == nil {
+		return
+	}
+
+	re = &RecordedError{Message: err.Error()}
+	switch err.(type) {
+	case *gcs.NotFoundError:
+		re.Kind = "NotFound"
+	case *gcs.PreconditionError:
+		re.Kind = "Precondition"
+	}
+
+	return
+}
+
+func (re *RecordedError) toError() (err error) {
+	if re == nil {
+		return
+	}
+
+	switch re.Kind {
+	case "NotFound":
+		err = &gcs.NotFoundError{Err: errors.New(re.Message)}
+	case "Precondition":
+		err = &gcs.PreconditionError{Err: errors.New(re.Message)}
+	default:
+		err = errors.New(re.Message)
+	}
+
+	return
+}
+
+// Describe how the request actually made differs from a recorded one, one
+// field per line.
+func diffRequests(
+	recordedMethod string,
+	recorded json.RawMessage,
+	method string,
+	actual json.RawMessage) (diff string) {
+	if recordedMethod != method {
+		diff = fmt.Sprintf("  method: recorded %s, got %s\n", recordedMethod, method)
+		return
+	}
+
+	var r, a map[string]interface{}
+	decodeJSON(recorded, &r)
+	decodeJSON(actual, &a)
+
+	keys := make(map[string]struct{})
+	for k := range r {
+		keys[k] = struct{}{}
+	}
+
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, k := range sorted {
+		if reflect.DeepEqual(r[k], a[k]) {
+			continue
+		}
+
+		rv, _ := json.Marshal(r[k])
+		av, _ := json.Marshal(a[k])
+		lines = append(lines, fmt.Sprintf("  %s: recorded %s, got %s", k, rv, av))
+	}
+
+	if len(lines) != 0 {
+		diff = strings.Join(lines, "\n") + "\n"
+	}
+
+	return
+}
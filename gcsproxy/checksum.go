@@ -0,0 +1,150 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// An error indicating that contents read from GCS don't match what GCS says
+// the object holds. Read proxies fetch the contents once more when they see
+// it; see lease.CorruptionError.
+type ChecksumError struct {
+	Name       string
+	Generation int64
+
+	// The range that was read, or nil for the whole object.
+	Range *gcs.ByteRange
+
+	// Set when the CRC32C checksum of the whole object was compared.
+	WantCRC32C uint32
+	GotCRC32C  uint32
+
+	// The number of bytes expected and received.
+	WantSize int64
+	GotSize  int64
+}
+
+var _ lease.CorruptionError = &ChecksumError{}
+
+func (ce *ChecksumError) Error() string {
+	if ce.GotSize != ce.WantSize {
+		return fmt.Sprintf(
+			"Read %d bytes of %q (generation %d)%s; expected %d",
+			ce.GotSize,
+			ce.Name,
+			ce.Generation,
+			ce.rangeDesc(),
+			ce.WantSize)
+	}
+
+	return fmt.Sprintf(
+		"CRC32C mismatch for %q (generation %d): got 0x%08x, expected 0x%08x",
+		ce.Name,
+		ce.Generation,
+		ce.GotCRC32C,
+		ce.WantCRC32C)
+}
+
+func (ce *ChecksumError) Corrupt() bool {
+	return true
+}
+
+func (ce *ChecksumError) rangeDesc() string {
+	if ce.Range == nil {
+		return ""
+	}
+
+	return fmt.Sprintf(" in [%d, %d)", ce.Range.Start, ce.Range.Limit)
+}
+
+// A read-closer that checks the contents read from the wrapped one as they
+// go by, failing with a *ChecksumError in place of io.EOF if they are wrong.
+//
+// If crc32c is non-nil, the contents must have the checksum it points to.
+// Either way, there must be exactly size bytes of them.
+type checksumReader struct {
+	wrapped io.ReadCloser
+	err     ChecksumError
+
+	crc32c *uint32
+	h      hash.Hash32
+}
+
+func newChecksumReader(
+	wrapped io.ReadCloser,
+	err ChecksumError,
+	crc32c *uint32) (cr *checksumReader) {
+	cr = &checksumReader{
+		wrapped: wrapped,
+		err:     err,
+		crc32c:  crc32c,
+	}
+
+	if crc32c != nil {
+		cr.h = crc32.New(castagnoliTable)
+	}
+
+	return
+}
+
+func (cr *checksumReader) Read(p []byte) (n int, err error) {
+	n, err = cr.wrapped.Read(p)
+	cr.err.GotSize += int64(n)
+	if cr.h != nil {
+		cr.h.Write(p[:n])
+	}
+
+	// Don't wait for the end to notice that there's too much.
+	if cr.err.GotSize > cr.err.WantSize {
+		err = cr.fail()
+		return
+	}
+
+	if err != io.EOF {
+		return
+	}
+
+	if cr.err.GotSize != cr.err.WantSize {
+		err = cr.fail()
+		return
+	}
+
+	if cr.h != nil && cr.h.Sum32() != *cr.crc32c {
+		cr.err.WantCRC32C = *cr.crc32c
+		cr.err.GotCRC32C = cr.h.Sum32()
+		err = cr.fail()
+		return
+	}
+
+	return
+}
+
+func (cr *checksumReader) Close() (err error) {
+	err = cr.wrapped.Close()
+	return
+}
+
+func (cr *checksumReader) fail() (err error) {
+	ce := cr.err
+	err = &ce
+	return
+}
@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestChecksum(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that damages the contents of the first few reads on their way to
+// the caller.
+type corruptingBucket struct {
+	gcs.Bucket
+
+	// The number of reads still to damage.
+	corrupt int
+
+	// If set, damage reads by dropping their last byte. Otherwise flip a bit in
+	// their first.
+	truncate bool
+
+	// The number of reads made.
+	reads int
+}
+
+func (b *corruptingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.reads++
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil || b.corrupt == 0 {
+		return
+	}
+
+	b.corrupt--
+
+	contents, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return
+	}
+
+	if b.truncate {
+		contents = contents[:len(contents)-1]
+	} else {
+		contents[0] ^= 0x04
+	}
+
+	rc = ioutil.NopCloser(bytes.NewReader(contents))
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const checksumContents = "tacoburritoenchilada"
+
+type ChecksumTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket corruptingBucket
+	leaser lease.FileLeaser
+	o      *gcs.Object
+}
+
+var _ SetUpInterface = &ChecksumTest{}
+
+func init() { RegisterTestSuite(&ChecksumTest{}) }
+
+func (t *ChecksumTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.leaser = lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		LimitNumFiles: math.MaxInt32,
+		LimitBytes:    math.MaxInt64,
+		Clock:         &t.clock,
+	})
+
+	t.o, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo",
+		checksumContents)
+
+	AssertEq(nil, err)
+}
+
+// Read the whole object through a proxy that reads it in chunks of the given
+// size.
+func (t *ChecksumTest) read(
+	chunkSize uint64,
+	validateChecksums bool) (contents string, err error) {
+	rp := gcsproxy.NewReadProxy(
+		t.o,
+		nil, // Initial read lease
+		chunkSize,
+		0, // Readahead chunks
+		validateChecksums,
+		t.leaser,
+		nil, // Evictions
+		&t.bucket)
+
+	defer rp.Destroy()
+
+	buf := make([]byte, rp.Size())
+	n, err := rp.ReadAt(t.ctx, buf, 0)
+	contents = string(buf[:n])
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ChecksumTest) WholeObject_Intact() {
+	contents, err := t.read(math.MaxUint64, true)
+
+	AssertEq(nil, err)
+	ExpectEq(checksumContents, contents)
+	ExpectEq(1, t.bucket.reads)
+}
+
+func (t *ChecksumTest) WholeObject_CorruptOnce() {
+	t.bucket.corrupt = 1
+
+	contents, err := t.read(math.MaxUint64, true)
+
+	AssertEq(nil, err)
+	ExpectEq(checksumContents, contents)
+	ExpectEq(2, t.bucket.reads)
+}
+
+func (t *ChecksumTest) WholeObject_CorruptTwice() {
+	t.bucket.corrupt = 2
+
+	_, err := t.read(math.MaxUint64, true)
+
+	ExpectThat(err, Error(HasSubstr("CRC32C mismatch")))
+	ExpectThat(err, Error(HasSubstr("foo")))
+	ExpectEq(2, t.bucket.reads)
+}
+
+func (t *ChecksumTest) WholeObject_Truncated() {
+	t.bucket.corrupt = 2
+	t.bucket.truncate = true
+
+	_, err := t.read(math.MaxUint64, true)
+
+	ExpectThat(err, Error(HasSubstr("Read 19 bytes")))
+	ExpectThat(err, Error(HasSubstr("expected 20")))
+	ExpectEq(2, t.bucket.reads)
+}
+
+func (t *ChecksumTest) Chunk_TruncatedOnce() {
+	t.bucket.corrupt = 1
+	t.bucket.truncate = true
+
+	contents, err := t.read(8, true)
+
+	AssertEq(nil, err)
+	ExpectEq(checksumContents, contents)
+	ExpectEq(4, t.bucket.reads)
+}
+
+func (t *ChecksumTest) Chunk_TruncatedTwice() {
+	t.bucket.corrupt = 2
+	t.bucket.truncate = true
+
+	_, err := t.read(8, true)
+
+	ExpectThat(err, Error(HasSubstr("Read 7 bytes")))
+	ExpectThat(err, Error(HasSubstr("[0, 8)")))
+	ExpectEq(2, t.bucket.reads)
+}
+
+func (t *ChecksumTest) ValidationDisabled() {
+	t.bucket.corrupt = 1
+
+	contents, err := t.read(math.MaxUint64, false)
+
+	AssertEq(nil, err)
+	ExpectEq("pacoburritoenchilada", contents)
+	ExpectEq(1, t.bucket.reads)
+}
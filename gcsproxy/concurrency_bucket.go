@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that allows at most limit requests to the wrapped bucket to
+// be in flight at once, blocking further callers until a slot frees up or
+// their context is cancelled. A reader returned by NewReader takes a slot only
+// while opening and during each call to Read, so that an idle stream left open
+// between reads doesn't keep other requests waiting.
+//
+// If limit is zero, the wrapped bucket is returned unmodified.
+func NewConcurrencyLimitedBucket(
+	limit int,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	if limit == 0 {
+		b = wrapped
+		return
+	}
+
+	b = &concurrencyLimitedBucket{
+		wrapped: wrapped,
+		slots:   make(chan struct{}, limit),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+type concurrencyLimitedBucket struct {
+	wrapped gcs.Bucket
+
+	// A semaphore, with one element for each request in flight.
+	slots chan struct{}
+}
+
+// Wait for a slot, returning the context's error if it is cancelled first.
+func (b *concurrencyLimitedBucket) acquire(ctx context.Context) (err error) {
+	select {
+	case b.slots <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+func (b *concurrencyLimitedBucket) release() {
+	<-b.slots
+}
+
+// A reader that takes a slot in its bucket for each call to Read, waiting for
+// one with the context with which it was opened.
+type slotReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *concurrencyLimitedBucket
+}
+
+func (rc *slotReader) Read(p []byte) (n int, err error) {
+	err = rc.bucket.acquire(rc.ctx)
+	if err != nil {
+		return
+	}
+
+	defer rc.bucket.release()
+	n, err = rc.ReadCloser.Read(p)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *concurrencyLimitedBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *concurrencyLimitedBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc = &slotReader{
+		ReadCloser: rc,
+		ctx:        ctx,
+		bucket:     b,
+	}
+
+	return
+}
+
+func (b *concurrencyLimitedBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *concurrencyLimitedBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *concurrencyLimitedBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *concurrencyLimitedBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *concurrencyLimitedBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *concurrencyLimitedBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *concurrencyLimitedBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.acquire(ctx)
+	if err != nil {
+		return
+	}
+
+	defer b.release()
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
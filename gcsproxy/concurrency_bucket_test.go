@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestConcurrencyLimitedBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// blockingBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose StatObject calls block until unblocked, recording how many
+// were in flight at once.
+type blockingBucket struct {
+	gcs.Bucket
+	unblock chan struct{}
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	calls       int
+}
+
+func (b *blockingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	b.calls++
+	b.inFlight++
+	if b.inFlight > b.maxInFlight {
+		b.maxInFlight = b.inFlight
+	}
+	b.mu.Unlock()
+
+	<-b.unblock
+
+	b.mu.Lock()
+	b.inFlight--
+	b.mu.Unlock()
+
+	err = errors.New("taco")
+	return
+}
+
+func (b *blockingBucket) counts() (inFlight, maxInFlight, calls int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inFlight, b.maxInFlight, b.calls
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ConcurrencyLimitedBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped blockingBucket
+}
+
+var _ SetUpInterface = &ConcurrencyLimitedBucketTest{}
+
+func init() { RegisterTestSuite(&ConcurrencyLimitedBucketTest{}) }
+
+func (t *ConcurrencyLimitedBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.wrapped.unblock = make(chan struct{})
+}
+
+// Wait until the given number of StatObject calls are in flight.
+func (t *ConcurrencyLimitedBucketTest) waitForInFlight(n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if inFlight, _, _ := t.wrapped.counts(); inFlight == n {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	AddFailure("Timed out waiting for %d requests in flight", n)
+	AbortTest()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ConcurrencyLimitedBucketTest) ZeroLimitIsPassThrough() {
+	b := gcsproxy.NewConcurrencyLimitedBucket(0, &t.wrapped)
+	ExpectEq(&t.wrapped, b)
+}
+
+func (t *ConcurrencyLimitedBucketTest) LimitsRequestsInFlight() {
+	const limit = 2
+	const n = 5
+	b := gcsproxy.NewConcurrencyLimitedBucket(limit, &t.wrapped)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+		}()
+	}
+
+	// Only the first two should get through, even given time.
+	t.waitForInFlight(limit)
+	time.Sleep(50 * time.Millisecond)
+
+	_, _, calls := t.wrapped.counts()
+	ExpectEq(limit, calls)
+
+	// Let them all finish.
+	close(t.wrapped.unblock)
+	wg.Wait()
+
+	_, maxInFlight, calls := t.wrapped.counts()
+	ExpectEq(limit, maxInFlight)
+	ExpectEq(n, calls)
+}
+
+func (t *ConcurrencyLimitedBucketTest) BlockedCallerRespectsContext() {
+	b := gcsproxy.NewConcurrencyLimitedBucket(1, &t.wrapped)
+
+	// Occupy the only slot.
+	done := make(chan struct{})
+	go func() {
+		b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+		close(done)
+	}()
+
+	t.waitForInFlight(1)
+
+	// Another caller should give up when its context is cancelled, without
+	// reaching the wrapped bucket.
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err := b.ListObjects(ctx, &gcs.ListObjectsRequest{})
+	ExpectEq(context.DeadlineExceeded, err)
+
+	close(t.wrapped.unblock)
+	<-done
+
+	_, _, calls := t.wrapped.counts()
+	ExpectEq(1, calls)
+}
+
+func (t *ConcurrencyLimitedBucketTest) ReaderTakesSlotOnlyWhileReading() {
+	b := gcsproxy.NewConcurrencyLimitedBucket(1, t.wrapped.Bucket)
+
+	_, err := gcsutil.CreateObject(t.ctx, b, "foo", "taco")
+	AssertEq(nil, err)
+
+	// An open reader doesn't hold the only slot between reads.
+	rc, err := b.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	o, err := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(len("taco"), o.Size)
+
+	contents, err := ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *ConcurrencyLimitedBucketTest) ReadWaitsForSlot() {
+	b := gcsproxy.NewConcurrencyLimitedBucket(1, &t.wrapped)
+
+	_, err := gcsutil.CreateObject(t.ctx, b, "foo", "taco")
+	AssertEq(nil, err)
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	rc, err := b.NewReader(ctx, &gcs.ReadObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	// Occupy the only slot.
+	done := make(chan struct{})
+	go func() {
+		b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+		close(done)
+	}()
+
+	t.waitForInFlight(1)
+
+	// The read should wait for the slot, giving up when the context with which
+	// the reader was opened is cancelled.
+	cancel()
+	_, err = rc.Read(make([]byte, 4))
+	ExpectEq(context.Canceled, err)
+
+	close(t.wrapped.unblock)
+	<-done
+}
+
+func (t *ConcurrencyLimitedBucketTest) FailedReadReleasesSlot() {
+	b := gcsproxy.NewConcurrencyLimitedBucket(1, t.wrapped.Bucket)
+
+	for i := 0; i < 3; i++ {
+		_, err := b.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+		ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The class of a GCS operation for billing purposes. See
+// https://cloud.google.com/storage/pricing#operations-pricing.
+type OpClass int
+
+const (
+	// Operations that are not charged for, e.g. deletions.
+	OpClassFree OpClass = iota
+
+	// Class A operations: listing, and those that write objects or metadata.
+	OpClassA
+
+	// Class B operations: those that read objects or metadata.
+	OpClassB
+)
+
+func (c OpClass) String() string {
+	switch c {
+	case OpClassA:
+		return "A"
+
+	case OpClassB:
+		return "B"
+
+	default:
+		return "free"
+	}
+}
+
+// The billing class of each gcs.Bucket method that sends a request to GCS,
+// keyed by method name.
+var opClasses = map[string]OpClass{
+	"NewReader":      OpClassB,
+	"CreateObject":   OpClassA,
+	"CopyObject":     OpClassA,
+	"ComposeObjects": OpClassA,
+	"StatObject":     OpClassB,
+	"ListObjects":    OpClassA,
+	"UpdateObject":   OpClassA,
+	"DeleteObject":   OpClassFree,
+}
+
+// Return the billing class of the named gcs.Bucket method. ok is false if the
+// method sends no request.
+func ClassOf(method string) (c OpClass, ok bool) {
+	c, ok = opClasses[method]
+	return
+}
+
+// The price of a single operation of each class, in whatever currency the
+// user likes, for estimating what a mount costs.
+type OpPrices struct {
+	ClassA float64
+	ClassB float64
+}
+
+// Operation counts recorded by a CostBucket.
+type CostStats struct {
+	ClassA uint64
+	ClassB uint64
+	Free   uint64
+
+	// Counts by gcs.Bucket method name, including methods not yet called.
+	ByMethod map[string]uint64
+
+	// Bytes of object contents read and written.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// The estimated cost of the operations counted, at the given prices.
+func (s CostStats) EstimatedCost(p OpPrices) float64 {
+	return float64(s.ClassA)*p.ClassA + float64(s.ClassB)*p.ClassB
+}
+
+// Return the counts accumulated since an earlier snapshot.
+func (s CostStats) Since(prev CostStats) (d CostStats) {
+	d = CostStats{
+		ClassA:       s.ClassA - prev.ClassA,
+		ClassB:       s.ClassB - prev.ClassB,
+		Free:         s.Free - prev.Free,
+		ByMethod:     make(map[string]uint64),
+		BytesRead:    s.BytesRead - prev.BytesRead,
+		BytesWritten: s.BytesWritten - prev.BytesWritten,
+	}
+
+	for m, n := range s.ByMethod {
+		d.ByMethod[m] = n - prev.ByMethod[m]
+	}
+
+	return
+}
+
+// A bucket that counts the operations sent through it by billing class, so
+// that the cost of a mount can be attributed to whoever is running it. Put it
+// directly around the bucket that talks to GCS, so that requests answered by
+// caches aren't counted.
+type CostBucket interface {
+	gcs.Bucket
+
+	// The labels given to NewCostBucket.
+	Labels() map[string]string
+
+	// Return a snapshot of the bucket's counters.
+	Stats() (s CostStats)
+
+	// Register the counters in the supplied registry, with the bucket's labels
+	// attached. Registering another bucket with the same labels replaces them.
+	RegisterMetrics(registry *metrics.Registry)
+}
+
+// Create a bucket that counts operations on the wrapped bucket. The labels,
+// e.g. {"team": "search"}, are attached to the exported metrics.
+func NewCostBucket(
+	labels map[string]string,
+	wrapped gcs.Bucket) (b CostBucket) {
+	cb := &costBucket{
+		wrapped: wrapped,
+		labels:  labels,
+		counts:  make(map[string]*uint64),
+	}
+
+	for m := range opClasses {
+		cb.counts[m] = new(uint64)
+	}
+
+	b = cb
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+type costBucket struct {
+	wrapped gcs.Bucket
+	labels  map[string]string
+
+	// A counter for each method in opClasses. The map is not modified after
+	// creation; the counters are accessed atomically.
+	counts map[string]*uint64
+
+	// Accessed atomically.
+	bytesRead    uint64
+	bytesWritten uint64
+}
+
+func (b *costBucket) count(method string) {
+	atomic.AddUint64(b.counts[method], 1)
+}
+
+// An io.Reader that atomically adds the number of bytes read to a counter.
+type byteCountingReader struct {
+	wrapped io.Reader
+	counter *uint64
+}
+
+func (r *byteCountingReader) Read(p []byte) (n int, err error) {
+	n, err = r.wrapped.Read(p)
+	atomic.AddUint64(r.counter, uint64(n))
+	return
+}
+
+type byteCountingReadCloser struct {
+	byteCountingReader
+	io.Closer
+}
+
+func (b *costBucket) Labels() map[string]string {
+	return b.labels
+}
+
+func (b *costBucket) Stats() (s CostStats) {
+	s.BytesRead = atomic.LoadUint64(&b.bytesRead)
+	s.BytesWritten = atomic.LoadUint64(&b.bytesWritten)
+	s.ByMethod = make(map[string]uint64)
+	for m, p := range b.counts {
+		n := atomic.LoadUint64(p)
+		s.ByMethod[m] = n
+
+		switch opClasses[m] {
+		case OpClassA:
+			s.ClassA += n
+
+		case OpClassB:
+			s.ClassB += n
+
+		default:
+			s.Free += n
+		}
+	}
+
+	return
+}
+
+// Return the bucket's labels plus the supplied extra pairs, alternating
+// names and values with names sorted, as taken by metrics.Registry.
+func (b *costBucket) labelPairs(extra ...string) (pairs []string) {
+	all := make(map[string]string)
+	for k, v := range b.labels {
+		all[k] = v
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		all[extra[i]] = extra[i+1]
+	}
+
+	var names []string
+	for k := range all {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	for _, k := range names {
+		pairs = append(pairs, k, all[k])
+	}
+
+	return
+}
+
+func (b *costBucket) RegisterMetrics(registry *metrics.Registry) {
+	registry.CounterFunc(
+		"gcsfuse_gcs_class_a_ops_total",
+		"Class A GCS operations (listing and writes).",
+		func() uint64 { return b.Stats().ClassA },
+		b.labelPairs()...)
+
+	registry.CounterFunc(
+		"gcsfuse_gcs_class_b_ops_total",
+		"Class B GCS operations (reads of objects and metadata).",
+		func() uint64 { return b.Stats().ClassB },
+		b.labelPairs()...)
+
+	for m, p := range b.counts {
+		p := p
+		registry.CounterFunc(
+			"gcsfuse_gcs_ops_total",
+			"GCS operations by bucket method, with their billing class.",
+			func() uint64 { return atomic.LoadUint64(p) },
+			b.labelPairs("method", m, "class", opClasses[m].String())...)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *costBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *costBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.count("NewReader")
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc = &byteCountingReadCloser{
+		byteCountingReader: byteCountingReader{wrapped: rc, counter: &b.bytesRead},
+		Closer:             rc,
+	}
+
+	return
+}
+
+func (b *costBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.count("CreateObject")
+
+	// Count the contents as they are consumed, without modifying the caller's
+	// request.
+	counted := *req
+	counted.Contents = &byteCountingReader{
+		wrapped: req.Contents,
+		counter: &b.bytesWritten,
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, &counted)
+	return
+}
+
+func (b *costBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	b.count("CopyObject")
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *costBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	b.count("ComposeObjects")
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *costBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.count("StatObject")
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *costBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	b.count("ListObjects")
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *costBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	b.count("UpdateObject")
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *costBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.count("DeleteObject")
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestCostBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CostBucketTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcsproxy.CostBucket
+}
+
+var _ SetUpInterface = &CostBucketTest{}
+
+func init() { RegisterTestSuite(&CostBucketTest{}) }
+
+func (t *CostBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = gcsproxy.NewCostBucket(
+		map[string]string{"team": "search", "env": "prod"},
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CostBucketTest) EveryMethodClassified() {
+	// Every method that sends a request must have a class, so that a method
+	// added to gcs.Bucket can't go uncounted.
+	bt := reflect.TypeOf((*gcs.Bucket)(nil)).Elem()
+	for i := 0; i < bt.NumMethod(); i++ {
+		m := bt.Method(i).Name
+		if m == "Name" {
+			continue
+		}
+
+		_, ok := gcsproxy.ClassOf(m)
+		ExpectTrue(ok, "Method: %s", m)
+	}
+
+	_, ok := gcsproxy.ClassOf("Name")
+	ExpectFalse(ok)
+}
+
+func (t *CostBucketTest) Classes() {
+	expected := map[string]gcsproxy.OpClass{
+		"ListObjects":    gcsproxy.OpClassA,
+		"CreateObject":   gcsproxy.OpClassA,
+		"ComposeObjects": gcsproxy.OpClassA,
+		"CopyObject":     gcsproxy.OpClassA,
+		"UpdateObject":   gcsproxy.OpClassA,
+		"NewReader":      gcsproxy.OpClassB,
+		"StatObject":     gcsproxy.OpClassB,
+		"DeleteObject":   gcsproxy.OpClassFree,
+	}
+
+	for m, c := range expected {
+		actual, _ := gcsproxy.ClassOf(m)
+		ExpectEq(c, actual, "Method: %s", m)
+	}
+}
+
+func (t *CostBucketTest) ScriptedWorkload() {
+	var err error
+
+	// Two creations.
+	err = gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string]string{
+			"foo": "taco",
+			"bar": "burrito",
+		})
+
+	AssertEq(nil, err)
+
+	// Reads.
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "baz"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Other writes.
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	_, err = t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo", DstName: "qux"})
+
+	AssertEq(nil, err)
+
+	_, err = t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "foobar",
+			Sources: []gcs.ComposeSource{{Name: "foo"}, {Name: "bar"}},
+		})
+
+	AssertEq(nil, err)
+
+	contentType := "text/plain"
+	_, err = t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{Name: "foo", ContentType: &contentType})
+
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "qux"})
+	AssertEq(nil, err)
+
+	// Check the counts. Failed requests count too.
+	s := t.bucket.Stats()
+	ExpectEq(6, s.ClassA)
+	ExpectEq(3, s.ClassB)
+	ExpectEq(1, s.Free)
+
+	ExpectEq(2, s.ByMethod["CreateObject"])
+	ExpectEq(1, s.ByMethod["NewReader"])
+	ExpectEq(2, s.ByMethod["StatObject"])
+	ExpectEq(1, s.ByMethod["ListObjects"])
+	ExpectEq(1, s.ByMethod["CopyObject"])
+	ExpectEq(1, s.ByMethod["ComposeObjects"])
+	ExpectEq(1, s.ByMethod["UpdateObject"])
+	ExpectEq(1, s.ByMethod["DeleteObject"])
+
+	// Bytes of contents.
+	ExpectEq(len("taco"), s.BytesRead)
+	ExpectEq(len("taco")+len("burrito"), s.BytesWritten)
+
+	// And the estimate.
+	p := gcsproxy.OpPrices{ClassA: 0.5, ClassB: 0.25}
+	ExpectEq(3.75, s.EstimatedCost(p))
+}
+
+func (t *CostBucketTest) StatsSince() {
+	_, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	before := t.bucket.Stats()
+
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	d := t.bucket.Stats().Since(before)
+	ExpectEq(1, d.ClassA)
+	ExpectEq(1, d.ByMethod["ListObjects"])
+	ExpectEq(0, d.ByMethod["NewReader"])
+}
+
+func (t *CostBucketTest) Metrics() {
+	_, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	registry := metrics.NewRegistry()
+	t.bucket.RegisterMetrics(registry)
+
+	var buf bytes.Buffer
+	err = registry.WriteText(&buf)
+	AssertEq(nil, err)
+
+	out := buf.String()
+	ExpectThat(
+		out,
+		HasSubstr(`gcsfuse_gcs_class_a_ops_total{env="prod",team="search"} 1`))
+
+	ExpectThat(
+		out,
+		HasSubstr(`gcsfuse_gcs_class_b_ops_total{env="prod",team="search"} 0`))
+
+	ExpectThat(
+		out,
+		HasSubstr(
+			`gcsfuse_gcs_ops_total{class="A",env="prod",method="ListObjects",`+
+				`team="search"} 1`))
+
+	ExpectThat(out, HasSubstr("# TYPE gcsfuse_gcs_class_a_ops_total counter"))
+}
+
+func (t *CostBucketTest) MetricsWithoutLabels() {
+	b := gcsproxy.NewCostBucket(
+		nil,
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+
+	registry := metrics.NewRegistry()
+	b.RegisterMetrics(registry)
+
+	var buf bytes.Buffer
+	err := registry.WriteText(&buf)
+	AssertEq(nil, err)
+
+	ExpectThat(buf.String(), HasSubstr("\ngcsfuse_gcs_class_a_ops_total 0\n"))
+}
@@ -0,0 +1,389 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// Object fields applied by default to objects created with names under some
+// prefix. Empty fields are not applied.
+type ObjectDefaults struct {
+	CacheControl    string
+	ContentLanguage string
+
+	// Custom metadata. Keys may not begin with ReservedMetadataPrefix.
+	Metadata map[string]string
+}
+
+// Custom metadata keys beginning with this prefix are used by gcsfuse itself
+// (e.g. for symlink targets), and may not be given defaults.
+const ReservedMetadataPrefix = "gcsfuse_"
+
+// A table of ObjectDefaults keyed by object name prefix, consulted using the
+// longest matching prefix. The zero value has no entries.
+type DefaultMetadataPolicy struct {
+	// Sorted by decreasing prefix length.
+	rules []defaultMetadataRule
+}
+
+type defaultMetadataRule struct {
+	prefix   string
+	defaults ObjectDefaults
+}
+
+// Parse a list of specs of the form
+//
+//     prefix:field=value,field=value,...
+//
+// into a policy. The prefix may be empty, in which case the spec applies to
+// the whole bucket. Supported fields are cache_control, content_language, and
+// metadata.KEY for a custom metadata key. Commas, colons, equals signs, and
+// backslashes within values may be escaped with a backslash, so that
+//
+//     public/:cache_control=public\,max-age=3600,content_language=en
+//
+// gives objects under "public/" a Cache-Control of "public,max-age=3600".
+//
+// Errors name the offending spec and the column (counting bytes from one)
+// at which the problem was found.
+func ParseDefaultMetadata(specs []string) (p *DefaultMetadataPolicy, err error) {
+	p = &DefaultMetadataPolicy{}
+	seen := make(map[string]bool)
+
+	for _, spec := range specs {
+		var rule defaultMetadataRule
+		var pos int
+		rule, pos, err = parseDefaultMetadataSpec(spec)
+		if err != nil {
+			err = fmt.Errorf("%q: column %d: %v", spec, pos+1, err)
+			return
+		}
+
+		if seen[rule.prefix] {
+			err = fmt.Errorf(
+				"%q: column 1: Duplicate prefix: %q",
+				spec,
+				rule.prefix)
+			return
+		}
+
+		seen[rule.prefix] = true
+		p.rules = append(p.rules, rule)
+	}
+
+	sort.Sort(rulesByPrefixLength(p.rules))
+	return
+}
+
+// Return the defaults for the object with the given name, or nil if none
+// apply. Directory placeholder objects never have defaults.
+func (p *DefaultMetadataPolicy) Lookup(name string) (d *ObjectDefaults) {
+	if strings.HasSuffix(name, "/") {
+		return
+	}
+
+	for i := range p.rules {
+		if strings.HasPrefix(name, p.rules[i].prefix) {
+			d = &p.rules[i].defaults
+			return
+		}
+	}
+
+	return
+}
+
+// Describe, one line per entry, which specs match the object with the given
+// name and the defaults it would get. Specs that match but are overridden by
+// one with a longer prefix are listed too.
+func (p *DefaultMetadataPolicy) Explain(name string) (lines []string) {
+	if strings.HasSuffix(name, "/") {
+		lines = append(lines, "default metadata: none (directory)")
+		return
+	}
+
+	var winner *defaultMetadataRule
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !strings.HasPrefix(name, r.prefix) {
+			continue
+		}
+
+		if winner != nil {
+			lines = append(lines, fmt.Sprintf("  overrides prefix %q", r.prefix))
+			continue
+		}
+
+		winner = r
+		lines = append(
+			lines,
+			fmt.Sprintf("default metadata: from prefix %q", r.prefix))
+
+		d := &r.defaults
+		if d.CacheControl != "" {
+			lines = append(lines, fmt.Sprintf("  cache_control=%q", d.CacheControl))
+		}
+
+		if d.ContentLanguage != "" {
+			lines = append(
+				lines,
+				fmt.Sprintf("  content_language=%q", d.ContentLanguage))
+		}
+
+		var keys []string
+		for k := range d.Metadata {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		for _, k := range keys {
+			lines = append(lines, fmt.Sprintf("  metadata.%s=%q", k, d.Metadata[k]))
+		}
+	}
+
+	if winner == nil {
+		lines = append(lines, "default metadata: none")
+	}
+
+	return
+}
+
+// Fill in the fields of the supplied request that aren't already set with
+// our defaults. Fields set explicitly by the caller take precedence.
+func (d *ObjectDefaults) ApplyToCreate(req *gcs.CreateObjectRequest) {
+	if req.CacheControl == "" {
+		req.CacheControl = d.CacheControl
+	}
+
+	if req.ContentLanguage == "" {
+		req.ContentLanguage = d.ContentLanguage
+	}
+
+	if len(d.Metadata) == 0 {
+		return
+	}
+
+	// Don't modify the caller's map.
+	metadata := make(map[string]string)
+	for k, v := range d.Metadata {
+		metadata[k] = v
+	}
+
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+
+	req.Metadata = metadata
+}
+
+// Return a request that fills in the fields of the supplied existing object
+// that aren't already set with our defaults, or nil if there are none.
+func (d *ObjectDefaults) UpdateFor(o *gcs.Object) (req *gcs.UpdateObjectRequest) {
+	update := &gcs.UpdateObjectRequest{Name: o.Name}
+	var needed bool
+
+	if o.CacheControl == "" && d.CacheControl != "" {
+		update.CacheControl = &d.CacheControl
+		needed = true
+	}
+
+	if o.ContentLanguage == "" && d.ContentLanguage != "" {
+		update.ContentLanguage = &d.ContentLanguage
+		needed = true
+	}
+
+	for k := range d.Metadata {
+		if _, ok := o.Metadata[k]; ok {
+			continue
+		}
+
+		if update.Metadata == nil {
+			update.Metadata = make(map[string]*string)
+		}
+
+		v := d.Metadata[k]
+		update.Metadata[k] = &v
+		needed = true
+	}
+
+	if needed {
+		req = update
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+type rulesByPrefixLength []defaultMetadataRule
+
+func (s rulesByPrefixLength) Len() int      { return len(s) }
+func (s rulesByPrefixLength) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s rulesByPrefixLength) Less(i, j int) bool {
+	return len(s[i].prefix) > len(s[j].prefix)
+}
+
+// Split s at the first n-1 (or, if n <= 0, every) instances of sep that
+// aren't escaped with a backslash. Escapes are preserved in the pieces.
+// offsets[i] is the offset within s at which pieces[i] begins.
+func splitUnescaped(
+	s string,
+	sep byte,
+	n int) (pieces []string, offsets []int) {
+	start := 0
+	for i := 0; i < len(s) && (n <= 0 || len(pieces) < n-1); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+
+		case sep:
+			pieces = append(pieces, s[start:i])
+			offsets = append(offsets, start)
+			start = i + 1
+		}
+	}
+
+	pieces = append(pieces, s[start:])
+	offsets = append(offsets, start)
+	return
+}
+
+// Remove backslash escapes from s. On error, pos is the offset within s of
+// the problem.
+func unescape(s string) (u string, pos int, err error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			if i == len(s) {
+				pos = i - 1
+				err = errors.New("Trailing backslash")
+				return
+			}
+		}
+
+		b = append(b, s[i])
+	}
+
+	u = string(b)
+	return
+}
+
+// Parse a single spec. On error, pos is the offset within the spec of the
+// problem.
+func parseDefaultMetadataSpec(
+	spec string) (rule defaultMetadataRule, pos int, err error) {
+	// Split off the prefix.
+	pieces, offsets := splitUnescaped(spec, ':', 2)
+	if len(pieces) != 2 {
+		pos = len(spec)
+		err = errors.New("Expected prefix:fields")
+		return
+	}
+
+	rule.prefix, pos, err = unescape(pieces[0])
+	if err != nil {
+		return
+	}
+
+	// Parse the fields.
+	seen := make(map[string]bool)
+	fields, fieldOffsets := splitUnescaped(pieces[1], ',', 0)
+	for i, field := range fields {
+		fieldPos := offsets[1] + fieldOffsets[i]
+		nameAndValue, nameAndValueOffsets := splitUnescaped(field, '=', 2)
+		if len(nameAndValue) != 2 {
+			pos = fieldPos
+			err = fmt.Errorf("Expected field=value: %q", field)
+			return
+		}
+
+		valuePos := fieldPos + nameAndValueOffsets[1]
+
+		var name, value string
+		if name, pos, err = unescape(nameAndValue[0]); err != nil {
+			pos += fieldPos
+			return
+		}
+
+		if value, pos, err = unescape(nameAndValue[1]); err != nil {
+			pos += valuePos
+			return
+		}
+
+		if value == "" {
+			pos = valuePos
+			err = fmt.Errorf("Empty value for %s", name)
+			return
+		}
+
+		// Problems from here on are with the field name.
+		pos = fieldPos
+
+		if seen[name] {
+			err = fmt.Errorf("Duplicate field: %s", name)
+			return
+		}
+
+		seen[name] = true
+
+		switch {
+		case name == "cache_control":
+			rule.defaults.CacheControl = value
+
+		case name == "content_language":
+			rule.defaults.ContentLanguage = value
+
+		case strings.HasPrefix(name, "metadata."):
+			key := strings.TrimPrefix(name, "metadata.")
+			pos += len("metadata.")
+
+			if key == "" {
+				err = errors.New("Empty metadata key")
+				return
+			}
+
+			if strings.HasPrefix(key, ReservedMetadataPrefix) {
+				err = fmt.Errorf("Reserved metadata key: %q", key)
+				return
+			}
+
+			if rule.defaults.Metadata == nil {
+				rule.defaults.Metadata = make(map[string]string)
+			}
+
+			rule.defaults.Metadata[key] = value
+
+		// The GCS client we use can't set this.
+		case name == "content_disposition":
+			err = fmt.Errorf("Unsupported field: %q", name)
+			return
+
+		default:
+			err = fmt.Errorf("Unknown field: %q", name)
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that applies the defaults configured in the supplied policy
+// to objects written through it:
+//
+//  *  CreateObject requests get the defaults for their name, except for
+//     fields that the request already sets.
+//
+//  *  Objects produced by CopyObject and ComposeObjects (which is how renames
+//     and appends are implemented) are updated afterward to fill in any
+//     fields that they don't already have. The update is made only if the
+//     object still has the generation just written. If it fails, the copy or
+//     composition has nevertheless succeeded, so the failure is logged and the
+//     object returned without the defaults.
+//
+// Directory placeholder objects are left alone.
+func NewDefaultMetadataBucket(
+	policy *DefaultMetadataPolicy,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &defaultMetadataBucket{
+		policy:  policy,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type defaultMetadataBucket struct {
+	policy  *DefaultMetadataPolicy
+	wrapped gcs.Bucket
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Fill in any missing defaults for the supplied object, which was just
+// written, returning the updated record. If that fails, o is returned as is.
+func (b *defaultMetadataBucket) fillIn(
+	ctx context.Context,
+	o *gcs.Object) (updated *gcs.Object) {
+	updated = o
+
+	d := b.policy.Lookup(o.Name)
+	if d == nil {
+		return
+	}
+
+	req := d.UpdateFor(o)
+	if req == nil {
+		return
+	}
+
+	req.GenerationPrecondition = &o.Generation
+	newObj, err := b.wrapped.UpdateObject(ctx, req)
+	if err != nil {
+		logger.Errorf("Filling in default metadata of %q: %v", o.Name, err)
+		return
+	}
+
+	updated = newObj
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *defaultMetadataBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *defaultMetadataBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+func (b *defaultMetadataBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if d := b.policy.Lookup(req.Name); d != nil {
+		withDefaults := *req
+		d.ApplyToCreate(&withDefaults)
+		req = &withDefaults
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *defaultMetadataBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	o = b.fillIn(ctx, o)
+	return
+}
+
+func (b *defaultMetadataBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	o = b.fillIn(ctx, o)
+	return
+}
+
+func (b *defaultMetadataBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *defaultMetadataBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *defaultMetadataBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *defaultMetadataBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDefaultMetadataBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DefaultMetadataBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &DefaultMetadataBucketTest{}
+
+func init() { RegisterTestSuite(&DefaultMetadataBucketTest{}) }
+
+func (t *DefaultMetadataBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	policy, err := gcsproxy.ParseDefaultMetadata([]string{
+		"public/:cache_control=public\\,max-age=3600,content_language=en," +
+			"metadata.owner=web",
+	})
+
+	AssertEq(nil, err)
+	t.bucket = gcsproxy.NewDefaultMetadataBucket(policy, t.wrapped)
+}
+
+func (t *DefaultMetadataBucketTest) stat(name string) (o *gcs.Object) {
+	o, err := t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DefaultMetadataBucketTest) CreateObject_Governed() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "public/foo", "taco")
+	AssertEq(nil, err)
+
+	o := t.stat("public/foo")
+	ExpectEq("public,max-age=3600", o.CacheControl)
+	ExpectEq("en", o.ContentLanguage)
+	ExpectEq("web", o.Metadata["owner"])
+}
+
+func (t *DefaultMetadataBucketTest) CreateObject_NotGoverned() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "private/foo", "taco")
+	AssertEq(nil, err)
+
+	o := t.stat("private/foo")
+	ExpectEq("", o.CacheControl)
+	ExpectEq("", o.ContentLanguage)
+	ExpectEq(0, len(o.Metadata))
+}
+
+func (t *DefaultMetadataBucketTest) CreateObject_Directory() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "public/dir/", "")
+	AssertEq(nil, err)
+
+	o := t.stat("public/dir/")
+	ExpectEq("", o.CacheControl)
+	ExpectEq(0, len(o.Metadata))
+}
+
+func (t *DefaultMetadataBucketTest) CreateObject_ExplicitFieldsWin() {
+	req := &gcs.CreateObjectRequest{
+		Name:         "public/foo",
+		CacheControl: "no-cache",
+		Contents:     strings.NewReader("taco"),
+		Metadata: map[string]string{
+			"gcsfuse_mtime": "2015-04-05T02:15:00Z",
+		},
+	}
+
+	_, err := t.bucket.CreateObject(t.ctx, req)
+	AssertEq(nil, err)
+
+	// The caller's request should be unmodified.
+	ExpectEq("", req.ContentLanguage)
+	ExpectEq(1, len(req.Metadata))
+
+	o := t.stat("public/foo")
+	ExpectEq("no-cache", o.CacheControl)
+	ExpectEq("en", o.ContentLanguage)
+	ExpectThat(
+		o.Metadata,
+		DeepEquals(map[string]string{
+			"gcsfuse_mtime": "2015-04-05T02:15:00Z",
+			"owner":         "web",
+		}))
+}
+
+func (t *DefaultMetadataBucketTest) CopyObject_IntoGovernedPrefix() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "private/foo", "taco")
+	AssertEq(nil, err)
+
+	o, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName: "private/foo",
+			DstName: "public/foo",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("public,max-age=3600", o.CacheControl)
+	ExpectEq("en", o.ContentLanguage)
+	ExpectEq("web", o.Metadata["owner"])
+
+	// The stored object should agree.
+	o = t.stat("public/foo")
+	ExpectEq("public,max-age=3600", o.CacheControl)
+	ExpectEq("en", o.ContentLanguage)
+	ExpectEq("web", o.Metadata["owner"])
+}
+
+func (t *DefaultMetadataBucketTest) CopyObject_KeepsExistingFields() {
+	_, err := t.wrapped.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:            "private/foo",
+			ContentLanguage: "de",
+			Contents:        strings.NewReader("taco"),
+		})
+
+	AssertEq(nil, err)
+
+	o, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName: "private/foo",
+			DstName: "public/foo",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("public,max-age=3600", o.CacheControl)
+	ExpectEq("de", o.ContentLanguage)
+}
+
+func (t *DefaultMetadataBucketTest) CopyObject_OutOfGovernedPrefix() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "public/foo", "taco")
+	AssertEq(nil, err)
+
+	o, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName: "public/foo",
+			DstName: "private/foo",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("", o.CacheControl)
+	ExpectEq("", o.ContentLanguage)
+}
+
+func (t *DefaultMetadataBucketTest) ComposeObjects() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "a", "ta")
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "b", "co")
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "public/foo",
+			Sources: []gcs.ComposeSource{
+				{Name: "a"},
+				{Name: "b"},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("public,max-age=3600", o.CacheControl)
+	ExpectEq("en", o.ContentLanguage)
+	ExpectEq("web", o.Metadata["owner"])
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "public/foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestDefaultMetadata(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DefaultMetadataTest struct {
+}
+
+func init() { RegisterTestSuite(&DefaultMetadataTest{}) }
+
+func (t *DefaultMetadataTest) parse(specs ...string) *gcsproxy.DefaultMetadataPolicy {
+	p, err := gcsproxy.ParseDefaultMetadata(specs)
+	AssertEq(nil, err)
+	return p
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DefaultMetadataTest) Empty() {
+	p := t.parse()
+	ExpectEq(nil, p.Lookup("foo"))
+}
+
+func (t *DefaultMetadataTest) AllFields() {
+	p := t.parse(
+		"public/:cache_control=public\\,max-age=3600,content_language=en," +
+			"metadata.owner=web")
+
+	d := p.Lookup("public/foo")
+	AssertNe(nil, d)
+	ExpectEq("public,max-age=3600", d.CacheControl)
+	ExpectEq("en", d.ContentLanguage)
+	ExpectThat(d.Metadata, DeepEquals(map[string]string{"owner": "web"}))
+}
+
+func (t *DefaultMetadataTest) Escapes() {
+	p := t.parse("a\\:b/:metadata.x\\=y=c\\:d\\\\e")
+
+	d := p.Lookup("a:b/foo")
+	AssertNe(nil, d)
+	ExpectThat(d.Metadata, DeepEquals(map[string]string{"x=y": "c:d\\e"}))
+}
+
+func (t *DefaultMetadataTest) EmptyPrefixMatchesEverything() {
+	p := t.parse(":content_language=fr")
+
+	d := p.Lookup("foo/bar")
+	AssertNe(nil, d)
+	ExpectEq("fr", d.ContentLanguage)
+}
+
+func (t *DefaultMetadataTest) LongestPrefixWins() {
+	p := t.parse(
+		":content_language=fr",
+		"public/images/:content_language=de",
+		"public/:content_language=en")
+
+	ExpectEq("fr", p.Lookup("private/foo").ContentLanguage)
+	ExpectEq("en", p.Lookup("public/foo").ContentLanguage)
+	ExpectEq("de", p.Lookup("public/images/foo").ContentLanguage)
+}
+
+func (t *DefaultMetadataTest) DirectoriesNotGoverned() {
+	p := t.parse("public/:content_language=en")
+
+	ExpectEq(nil, p.Lookup("public/"))
+	ExpectEq(nil, p.Lookup("public/foo/"))
+	ExpectEq(nil, p.Lookup("private/foo"))
+}
+
+func (t *DefaultMetadataTest) ParseErrors() {
+	testCases := []struct {
+		spec string
+		err  string
+	}{
+		{"public/", "column 8: Expected prefix:fields"},
+		{"public/:cache_control", "column 9: Expected field=value"},
+		{"public/:cache_control=", "column 23: Empty value"},
+		{"public/:cache_control=a\\", "column 24: Trailing backslash"},
+		{"public/:cache_control=a,cache_control=b", "column 25: Duplicate field"},
+		{"public/:color=blue", "column 9: Unknown field"},
+		{"public/:content_disposition=inline", "column 9: Unsupported field"},
+		{"public/:metadata.=x", "column 18: Empty metadata key"},
+		{"public/:metadata.gcsfuse_mtime=x", "column 18: Reserved metadata key"},
+	}
+
+	for _, tc := range testCases {
+		_, err := gcsproxy.ParseDefaultMetadata([]string{tc.spec})
+		ExpectThat(err, Error(HasSubstr(tc.err)), "spec: %q", tc.spec)
+	}
+}
+
+func (t *DefaultMetadataTest) DuplicatePrefix() {
+	_, err := gcsproxy.ParseDefaultMetadata([]string{
+		"public/:cache_control=a",
+		"public/:content_language=en",
+	})
+
+	ExpectThat(err, Error(HasSubstr("Duplicate prefix")))
+	ExpectThat(err, Error(HasSubstr("public/:content_language=en")))
+}
+
+func (t *DefaultMetadataTest) Explain_NoneMatch() {
+	p := t.parse("public/:content_language=en")
+	ExpectThat(p.Explain("private/foo"), ElementsAre("default metadata: none"))
+}
+
+func (t *DefaultMetadataTest) Explain_Directory() {
+	p := t.parse(":content_language=en")
+	ExpectThat(
+		p.Explain("public/"),
+		ElementsAre("default metadata: none (directory)"))
+}
+
+func (t *DefaultMetadataTest) Explain_OverlappingPrefixes() {
+	p := t.parse(
+		":content_language=fr",
+		"public/:cache_control=public,metadata.b=2,metadata.a=1",
+		"public/images/:content_language=de",
+		"private/:content_language=en")
+
+	ExpectThat(
+		p.Explain("public/foo"),
+		ElementsAre(
+			"default metadata: from prefix \"public/\"",
+			"  cache_control=\"public\"",
+			"  metadata.a=\"1\"",
+			"  metadata.b=\"2\"",
+			"  overrides prefix \"\""))
+
+	// The longest prefix wins outright; fields aren't merged.
+	ExpectThat(
+		p.Explain("public/images/foo"),
+		ElementsAre(
+			"default metadata: from prefix \"public/images/\"",
+			"  content_language=\"de\"",
+			"  overrides prefix \"public/\"",
+			"  overrides prefix \"\""))
+}
+
+func (t *DefaultMetadataTest) ApplyToCreate_ExplicitFieldsWin() {
+	p := t.parse(
+		"public/:cache_control=public,content_language=en," +
+			"metadata.a=default,metadata.b=default")
+
+	callerMetadata := map[string]string{"a": "explicit"}
+	req := &gcs.CreateObjectRequest{
+		Name:         "public/foo",
+		CacheControl: "no-cache",
+		Metadata:     callerMetadata,
+	}
+
+	p.Lookup(req.Name).ApplyToCreate(req)
+
+	ExpectEq("no-cache", req.CacheControl)
+	ExpectEq("en", req.ContentLanguage)
+	ExpectThat(
+		req.Metadata,
+		DeepEquals(map[string]string{"a": "explicit", "b": "default"}))
+
+	// The caller's map should be untouched.
+	ExpectThat(callerMetadata, DeepEquals(map[string]string{"a": "explicit"}))
+}
+
+func (t *DefaultMetadataTest) UpdateFor_NothingNeeded() {
+	p := t.parse("public/:content_language=en,metadata.a=default")
+
+	o := &gcs.Object{
+		Name:            "public/foo",
+		ContentLanguage: "de",
+		Metadata:        map[string]string{"a": "existing"},
+	}
+
+	ExpectEq(nil, p.Lookup(o.Name).UpdateFor(o))
+}
+
+func (t *DefaultMetadataTest) UpdateFor_FillsMissingFields() {
+	p := t.parse(
+		"public/:cache_control=public,content_language=en," +
+			"metadata.a=default,metadata.b=default")
+
+	o := &gcs.Object{
+		Name:            "public/foo",
+		ContentLanguage: "de",
+		Metadata:        map[string]string{"a": "existing"},
+	}
+
+	req := p.Lookup(o.Name).UpdateFor(o)
+	AssertNe(nil, req)
+
+	ExpectEq("public/foo", req.Name)
+	AssertNe(nil, req.CacheControl)
+	ExpectEq("public", *req.CacheControl)
+	ExpectEq(nil, req.ContentLanguage)
+
+	AssertEq(1, len(req.Metadata))
+	AssertNe(nil, req.Metadata["b"])
+	ExpectEq("default", *req.Metadata["b"])
+}
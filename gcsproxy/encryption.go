@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// The feature under which the object fields describing how objects are
+// encrypted are registered with ObjectFields. Without them, a sync would
+// rewrite an object encrypted with a Cloud KMS key using the bucket's default
+// key instead, and would try to replace objects encrypted with
+// customer-supplied keys.
+const EncryptionObjectFields = "encryption"
+
+func init() {
+	ObjectFields.Register(
+		EncryptionObjectFields,
+		"customerEncryption",
+		"kmsKeyName")
+}
+
+// Return the name of the Cloud KMS key with which the supplied object is
+// encrypted, without the "/cryptoKeyVersions/N" suffix naming the version of
+// the key that GCS records, or the empty string if it isn't encrypted with
+// such a key. This is the form in which requests name the key.
+func KmsKeyName(o *gcs.Object) (name string) {
+	name = o.KmsKeyName
+	if i := strings.Index(name, "/cryptoKeyVersions/"); i >= 0 {
+		name = name[:i]
+	}
+
+	return
+}
+
+// An error returned by an ObjectSyncer when the way the source object is
+// encrypted means that its contents can't be faithfully replaced: it is
+// encrypted with a customer-supplied key, which we don't have, or the new
+// generation didn't end up encrypted with the source object's Cloud KMS key.
+type EncryptionError struct {
+	Name string
+
+	// The Cloud KMS key with which the new generation should have been
+	// encrypted and the one with which it was, or empty if nothing was written.
+	Want string
+	Got  string
+}
+
+func (ee *EncryptionError) Error() string {
+	if ee.Want == "" {
+		return fmt.Sprintf(
+			"%q is encrypted with a customer-supplied key, so its contents can't "+
+				"be replaced",
+			ee.Name)
+	}
+
+	return fmt.Sprintf(
+		"%q should have been written with Cloud KMS key %q, but has %q",
+		ee.Name,
+		ee.Want,
+		ee.Got)
+}
+
+// Return an *EncryptionError if content derived from srcObject can't be
+// written out without losing its encryption.
+func checkWritable(srcObject *gcs.Object) (err error) {
+	if srcObject.CustomerEncryption != nil {
+		err = &EncryptionError{Name: srcObject.Name}
+		return
+	}
+
+	return
+}
+
+// Return an *EncryptionError if o, just written out from content derived from
+// srcObject, isn't encrypted with srcObject's Cloud KMS key.
+func checkKmsKey(srcObject *gcs.Object, o *gcs.Object) (err error) {
+	want := KmsKeyName(srcObject)
+	got := KmsKeyName(o)
+	if want == "" || got == want {
+		return
+	}
+
+	err = &EncryptionError{
+		Name: o.Name,
+		Want: want,
+		Got:  got,
+	}
+
+	return
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/jacobsa/util/lrucache"
+)
+
+// Remembers which object contents the file leaser has evicted to stay within
+// its limits, so that read proxies can count the downloads that eviction
+// makes necessary. Safe for concurrent access.
+//
+// Use NoteEviction as the leaser's FileLeaserConfig.OnEviction, and pass the
+// tracker to NewReadProxy.
+type EvictionTracker struct {
+	// The number of refreshes that were for evicted contents. Accessed
+	// atomically.
+	misses uint64
+
+	mu sync.Mutex
+
+	// The number of outstanding evictions for each lease tag, of type int.
+	// There may be more than one for an object read in chunks.
+	//
+	// GUARDED_BY(mu)
+	evicted lrucache.Cache
+}
+
+// Create a tracker that remembers evictions for at most the given number of
+// tags, which must be positive. Once the limit is reached, the least recently
+// evicted are forgotten.
+func NewEvictionTracker(capacity int) (t *EvictionTracker) {
+	t = &EvictionTracker{
+		evicted: lrucache.New(capacity),
+	}
+
+	return
+}
+
+// Record that the leaser evicted a read lease. Leases without tags aren't
+// for object contents, and are ignored.
+func (t *EvictionTracker) NoteEviction(e lease.Eviction) {
+	if e.Tag == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	if v := t.evicted.LookUp(e.Tag); v != nil {
+		n = v.(int)
+	}
+
+	t.evicted.Insert(e.Tag, n+1)
+}
+
+// Record that contents with the given tag are being fetched, counting a miss
+// if they were previously evicted.
+func (t *EvictionTracker) noteRefresh(tag string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v := t.evicted.LookUp(tag)
+	if v == nil {
+		return
+	}
+
+	if n := v.(int); n > 1 {
+		t.evicted.Insert(tag, n-1)
+	} else {
+		t.evicted.Erase(tag)
+	}
+
+	atomic.AddUint64(&t.misses, 1)
+}
+
+// Return the number of times contents have been fetched again after being
+// evicted.
+func (t *EvictionTracker) Misses() uint64 {
+	return atomic.LoadUint64(&t.misses)
+}
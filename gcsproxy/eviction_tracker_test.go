@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestEvictionTracker(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type EvictionTrackerTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	bucket  gcs.Bucket
+	tracker *gcsproxy.EvictionTracker
+	leaser  lease.FileLeaser
+}
+
+var _ SetUpInterface = &EvictionTrackerTest{}
+
+func init() { RegisterTestSuite(&EvictionTrackerTest{}) }
+
+func (t *EvictionTrackerTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.tracker = gcsproxy.NewEvictionTracker(16)
+
+	// Leave room for one of the objects created by newProxy at a time.
+	t.leaser = lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		LimitNumFiles: 16,
+		LimitBytes:    4,
+		OnEviction:    t.tracker.NoteEviction,
+		Clock:         &t.clock,
+	})
+}
+
+// Create an object with four bytes of contents, and a proxy for it that
+// reads in chunks of the given size.
+func (t *EvictionTrackerTest) newProxy(
+	name string,
+	chunkSize uint64) (rp lease.ReadProxy) {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, "taco")
+	AssertEq(nil, err)
+
+	rp = gcsproxy.NewReadProxy(
+		o,
+		nil, // Initial read lease
+		chunkSize,
+		0,    // Readahead chunks
+		true, // Validate checksums
+		t.leaser,
+		t.tracker,
+		t.bucket)
+	return
+}
+
+func (t *EvictionTrackerTest) read(rp lease.ReadProxy) {
+	buf := make([]byte, rp.Size())
+	_, err := rp.ReadAt(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	AssertEq("taco", string(buf))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *EvictionTrackerTest) FirstReadIsNotAMiss() {
+	rp := t.newProxy("foo", 1<<20)
+	defer rp.Destroy()
+
+	t.read(rp)
+	ExpectEq(0, t.tracker.Misses())
+}
+
+func (t *EvictionTrackerTest) ReadAfterEviction() {
+	foo := t.newProxy("foo", 1<<20)
+	defer foo.Destroy()
+
+	bar := t.newProxy("bar", 1<<20)
+	defer bar.Destroy()
+
+	// Reading bar evicts foo, and reading foo again is a miss. That evicts bar
+	// in turn.
+	t.read(foo)
+	t.read(bar)
+	ExpectEq(0, t.tracker.Misses())
+
+	t.read(foo)
+	ExpectEq(1, t.tracker.Misses())
+
+	// Reading what's cached isn't a miss.
+	t.read(foo)
+	ExpectEq(1, t.tracker.Misses())
+
+	t.read(bar)
+	ExpectEq(2, t.tracker.Misses())
+}
+
+func (t *EvictionTrackerTest) EachEvictedChunkIsAMiss() {
+	foo := t.newProxy("foo", 2)
+	defer foo.Destroy()
+
+	bar := t.newProxy("bar", 1<<20)
+	defer bar.Destroy()
+
+	t.read(foo)
+	t.read(bar)
+	t.read(foo)
+	ExpectEq(2, t.tracker.Misses())
+}
+
+func (t *EvictionTrackerTest) UntaggedEvictionsIgnored() {
+	t.tracker.NoteEviction(lease.Eviction{Size: 4})
+
+	rp := t.newProxy("foo", 1<<20)
+	defer rp.Destroy()
+
+	t.read(rp)
+	ExpectEq(0, t.tracker.Misses())
+}
@@ -0,0 +1,333 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// Counters describing the history of a FailedReadBucket.
+type FailedReadStats struct {
+	// The number of read failures that were recorded in the cache.
+	Recorded uint64
+
+	// The number of reads that failed from the cache without contacting GCS.
+	Suppressed uint64
+}
+
+// A bucket that remembers reads that failed for reasons that will not go away
+// by themselves (e.g. permission denied), and for a while fails further reads
+// of the same object generation immediately with the same error rather than
+// sending them to GCS. This keeps an application retrying in a tight loop from
+// generating a flood of doomed requests.
+//
+// Retryable errors (5xx, 429, network trouble) are never cached. Entries are
+// discarded after the TTL, when the object is modified through this bucket,
+// when a different generation is read, or when Invalidate is called.
+type FailedReadBucket interface {
+	gcs.Bucket
+
+	// Discard any cached failure for the given object name.
+	Invalidate(name string)
+
+	// Return a snapshot of the bucket's counters.
+	Stats() (s FailedReadStats)
+}
+
+// Create a failed read bucket that remembers at most capacity failures, each
+// for the given TTL.
+func NewFailedReadBucket(
+	ttl time.Duration,
+	capacity int,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b FailedReadBucket) {
+	b = &failedReadBucket{
+		clock:   clock,
+		wrapped: wrapped,
+		ttl:     ttl,
+		cache:   lrucache.New(capacity),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A class of read failure that is worth remembering.
+type failureClass string
+
+const (
+	failureClassPermission failureClass = "permission denied"
+	failureClassGeneration failureClass = "generation not found"
+	failureClassKMS        failureClass = "encryption key unusable"
+)
+
+// Decide whether the supplied error, returned by NewReader for the given
+// request, is one that we expect to persist. Return the empty class if not.
+func classifyReadError(
+	req *gcs.ReadObjectRequest,
+	err error) (class failureClass) {
+	// A particular generation that doesn't exist will never come back. If no
+	// generation was specified, on the other hand, the object may yet be
+	// created.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		if req.Generation != 0 {
+			class = failureClassGeneration
+		}
+
+		return
+	}
+
+	typed, ok := err.(*googleapi.Error)
+	if !ok {
+		return
+	}
+
+	// GCS reports problems with customer-managed encryption keys as 400s or
+	// 403s mentioning Cloud KMS.
+	if (typed.Code == 400 || typed.Code == 403) &&
+		strings.Contains(typed.Message, "Cloud KMS") {
+		class = failureClassKMS
+		return
+	}
+
+	if typed.Code == 403 {
+		class = failureClassPermission
+		return
+	}
+
+	return
+}
+
+// A cached read failure.
+type failedRead struct {
+	generation int64
+	class      failureClass
+	err        error
+	expiration time.Time
+}
+
+type failedReadBucket struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	clock   timeutil.Clock
+	wrapped gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	ttl time.Duration
+
+	/////////////////////////
+	// Counters
+	/////////////////////////
+
+	// Accessed atomically.
+	recorded   uint64
+	suppressed uint64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// A cache from object name to failedRead record. At most one generation is
+	// remembered per name.
+	//
+	// GUARDED_BY(mu)
+	cache lrucache.Cache
+}
+
+// Look for an unexpired failure for the object generation named by the
+// request, discarding stale entries along the way.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) lookUp(
+	req *gcs.ReadObjectRequest) (entry *failedRead) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v := b.cache.LookUp(req.Name)
+	if v == nil {
+		return
+	}
+
+	// Throw away entries that have expired or that concern a different
+	// generation.
+	candidate := v.(*failedRead)
+	if candidate.generation != req.Generation ||
+		!b.clock.Now().Before(candidate.expiration) {
+		b.cache.Erase(req.Name)
+		return
+	}
+
+	entry = candidate
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) insert(
+	req *gcs.ReadObjectRequest,
+	class failureClass,
+	err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry := &failedRead{
+		generation: req.Generation,
+		class:      class,
+		err:        err,
+		expiration: b.clock.Now().Add(b.ttl),
+	}
+
+	b.cache.Insert(req.Name, entry)
+	atomic.AddUint64(&b.recorded, 1)
+
+	log.Printf(
+		"Failing reads of %q (generation %d) for %v (%s): %v",
+		req.Name,
+		req.Generation,
+		b.ttl,
+		class,
+		err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) Invalidate(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cache.Erase(name)
+}
+
+func (b *failedReadBucket) Stats() (s FailedReadStats) {
+	s = FailedReadStats{
+		Recorded:   atomic.LoadUint64(&b.recorded),
+		Suppressed: atomic.LoadUint64(&b.suppressed),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *failedReadBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// Have we recently failed to read this generation?
+	if entry := b.lookUp(req); entry != nil {
+		atomic.AddUint64(&b.suppressed, 1)
+		err = entry.err
+		return
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+
+	// Remember the failure if it's going to happen again.
+	if err != nil {
+		if class := classifyReadError(req, err); class != "" {
+			b.insert(req, class, err)
+		}
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.Invalidate(req.Name)
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	b.Invalidate(req.DstName)
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	b.Invalidate(req.DstName)
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *failedReadBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *failedReadBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	b.Invalidate(req.Name)
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *failedReadBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.Invalidate(req.Name)
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
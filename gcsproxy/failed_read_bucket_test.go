@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestFailedReadBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// failingBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts calls to NewReader, failing them with err if it is
+// non-nil.
+type failingBucket struct {
+	gcs.Bucket
+
+	err   error
+	calls int
+}
+
+func (b *failingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.calls++
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const failedReadTTL = time.Second
+
+type FailedReadBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped failingBucket
+	bucket  gcsproxy.FailedReadBucket
+
+	obj *gcs.Object
+}
+
+var _ SetUpInterface = &FailedReadBucketTest{}
+
+func init() { RegisterTestSuite(&FailedReadBucketTest{}) }
+
+func (t *FailedReadBucketTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsproxy.NewFailedReadBucket(
+		failedReadTTL,
+		16,
+		&t.clock,
+		&t.wrapped)
+
+	t.obj, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+}
+
+func (t *FailedReadBucketTest) read(generation int64) (err error) {
+	req := &gcs.ReadObjectRequest{
+		Name:       "foo",
+		Generation: generation,
+	}
+
+	rc, err := t.bucket.NewReader(t.ctx, req)
+	if err != nil {
+		return
+	}
+
+	_, err = ioutil.ReadAll(rc)
+	rc.Close()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FailedReadBucketTest) Success() {
+	AssertEq(nil, t.read(t.obj.Generation))
+	AssertEq(nil, t.read(t.obj.Generation))
+
+	ExpectEq(2, t.wrapped.calls)
+	ExpectEq(0, t.bucket.Stats().Recorded)
+}
+
+func (t *FailedReadBucketTest) PermissionDenied() {
+	t.wrapped.err = &googleapi.Error{Code: 403, Message: "Forbidden"}
+
+	// The first read should go to GCS.
+	err := t.read(t.obj.Generation)
+	ExpectEq(t.wrapped.err, err)
+	ExpectEq(1, t.wrapped.calls)
+
+	// Further reads within the TTL should fail the same way without contacting
+	// GCS.
+	for i := 0; i < 100; i++ {
+		t.clock.AdvanceTime(failedReadTTL / 200)
+		AssertEq(t.wrapped.err, t.read(t.obj.Generation))
+	}
+
+	ExpectEq(1, t.wrapped.calls)
+
+	s := t.bucket.Stats()
+	ExpectEq(1, s.Recorded)
+	ExpectEq(100, s.Suppressed)
+
+	// After the TTL, we should try again.
+	t.clock.AdvanceTime(failedReadTTL)
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+	ExpectEq(2, t.wrapped.calls)
+}
+
+func (t *FailedReadBucketTest) KMSError() {
+	t.wrapped.err = &googleapi.Error{
+		Code:    400,
+		Message: "The Cloud KMS key is disabled.",
+	}
+
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *FailedReadBucketTest) GenerationNotFound() {
+	t.wrapped.err = &gcs.NotFoundError{}
+
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+	ExpectEq(1, t.wrapped.calls)
+}
+
+func (t *FailedReadBucketTest) LatestGenerationNotFound() {
+	t.wrapped.err = &gcs.NotFoundError{}
+
+	ExpectEq(t.wrapped.err, t.read(0))
+	ExpectEq(t.wrapped.err, t.read(0))
+	ExpectEq(2, t.wrapped.calls)
+}
+
+func (t *FailedReadBucketTest) RetryableErrors() {
+	errs := []error{
+		&googleapi.Error{Code: 500},
+		&googleapi.Error{Code: 503},
+		&googleapi.Error{Code: 429},
+		&googleapi.Error{Code: 400, Message: "Bad request"},
+		io.ErrUnexpectedEOF,
+		context.DeadlineExceeded,
+	}
+
+	for i, e := range errs {
+		t.wrapped.err = e
+		t.wrapped.calls = 0
+
+		ExpectEq(e, t.read(t.obj.Generation), "Index: %d", i)
+		ExpectEq(e, t.read(t.obj.Generation), "Index: %d", i)
+		ExpectEq(2, t.wrapped.calls, "Index: %d", i)
+	}
+
+	ExpectEq(0, t.bucket.Stats().Recorded)
+}
+
+func (t *FailedReadBucketTest) GenerationChange() {
+	t.wrapped.err = &googleapi.Error{Code: 403}
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+
+	// Reading a different generation should go to GCS.
+	t.wrapped.err = nil
+	ExpectEq(nil, t.read(0))
+	ExpectEq(2, t.wrapped.calls)
+
+	// And should have discarded the old entry.
+	ExpectEq(nil, t.read(t.obj.Generation))
+	ExpectEq(3, t.wrapped.calls)
+}
+
+func (t *FailedReadBucketTest) ExplicitInvalidation() {
+	t.wrapped.err = &googleapi.Error{Code: 403}
+	ExpectEq(t.wrapped.err, t.read(t.obj.Generation))
+
+	t.bucket.Invalidate("foo")
+
+	t.wrapped.err = nil
+	ExpectEq(nil, t.read(t.obj.Generation))
+	ExpectEq(2, t.wrapped.calls)
+}
+
+func (t *FailedReadBucketTest) ModificationInvalidates() {
+	t.wrapped.err = &googleapi.Error{Code: 403}
+	ExpectEq(t.wrapped.err, t.read(0))
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	t.wrapped.err = nil
+	ExpectEq(nil, t.read(0))
+	ExpectEq(2, t.wrapped.calls)
+}
@@ -0,0 +1,719 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The amount of preceding output that deflate back references may refer to.
+const inflateWindowSize = 1 << 15
+
+// A point in a gzip stream between deflate blocks, at which a gzipDecoder can
+// resume decompressing.
+type gzipCheckpoint struct {
+	// The offset within the stream of the byte holding the next unread bit,
+	// and the number of bits of that byte that have already been consumed.
+	offset int64
+	bits   uint
+
+	// Is the point part way through a gzip member? If so, window holds the
+	// member's last inflateWindowSize bytes of output (or all of it, if less),
+	// to which later back references may refer.
+	inMember bool
+	window   []byte
+}
+
+// A decoder for gzip streams that, unlike compress/gzip, can report exactly
+// where it is in the compressed stream between deflate blocks, and resume from
+// such a point. This lets gzipView index a stream made of a single gzip member
+// at a finer grain than the member.
+//
+// Deflate blocks are decoded one at a time by next. Members that begin within
+// the decoder's input have their checksums verified; those it resumes part way
+// through can't be.
+type gzipDecoder struct {
+	br bitReader
+
+	// The offset within the stream of the first byte of br's input.
+	start int64
+
+	// A ring buffer of recent output, of which the hist bytes before wpos are
+	// valid.
+	window [inflateWindowSize]byte
+	wpos   int
+	hist   int
+
+	// State of the member currently being decoded.
+	inMember bool
+	verify   bool
+	crc      uint32
+	size     uint32
+
+	// The output of the block being decoded.
+	out []byte
+
+	// Scratch space for dynamic Huffman codes.
+	lit  huffman
+	dist huffman
+}
+
+// Create a decoder that reads the stream from the given checkpoint, with r
+// supplying the bytes starting at its offset.
+func newGzipDecoder(
+	r io.ByteReader,
+	cp gzipCheckpoint) (d *gzipDecoder, err error) {
+	d = &gzipDecoder{
+		br:       bitReader{r: r},
+		start:    cp.offset,
+		inMember: cp.inMember,
+	}
+
+	if cp.bits != 0 {
+		_, err = d.br.bits(cp.bits)
+		if err != nil {
+			return
+		}
+	}
+
+	d.hist = copy(d.window[:], cp.window)
+	d.wpos = d.hist % inflateWindowSize
+
+	return
+}
+
+// Return a checkpoint for the decoder's current position.
+func (d *gzipDecoder) checkpoint() (cp gzipCheckpoint) {
+	pos := d.position()
+	cp.offset = pos / 8
+	cp.bits = uint(pos % 8)
+	cp.inMember = d.inMember
+
+	if d.inMember {
+		cp.window = make([]byte, d.hist)
+		start := (d.wpos - d.hist + inflateWindowSize) % inflateWindowSize
+		n := copy(cp.window, d.window[start:])
+		copy(cp.window[n:], d.window[:d.hist-n])
+	}
+
+	return
+}
+
+// Return the offset within the stream, in bits, of the next unread bit.
+func (d *gzipDecoder) position() int64 {
+	return d.start*8 + d.br.pos()
+}
+
+// Decode the next deflate block, along with the header of the member it
+// begins or the trailer of the member it ends. Return its output, which is
+// valid until the next call. Return io.EOF if the stream ended cleanly at a
+// member boundary.
+func (d *gzipDecoder) next() (out []byte, err error) {
+	d.out = d.out[:0]
+
+	if !d.inMember {
+		memberStart := d.position() / 8
+		err = d.readHeader()
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Reading gzip header at offset %d: %v", memberStart, err)
+			return
+		}
+
+		d.inMember = true
+		d.verify = true
+		d.crc = 0
+		d.size = 0
+		d.hist = 0
+	}
+
+	blockStart := d.position() / 8
+	final, err := d.inflateBlock()
+	if err == nil {
+		d.crc = crc32.Update(d.crc, crc32.IEEETable, d.out)
+		d.size += uint32(len(d.out))
+
+		if final {
+			err = d.readTrailer()
+			d.inMember = false
+		}
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Decompressing at offset %d: %v", blockStart, err)
+		return
+	}
+
+	out = d.out
+	return
+}
+
+// Gzip header flags.
+const (
+	gzipFlagHCRC    = 1 << 1
+	gzipFlagExtra   = 1 << 2
+	gzipFlagName    = 1 << 3
+	gzipFlagComment = 1 << 4
+)
+
+// Read a member header, returning io.EOF if the stream ends before it.
+func (d *gzipDecoder) readHeader() (err error) {
+	var hdr [10]byte
+	for i := range hdr {
+		hdr[i], err = d.br.readByte()
+		if err == io.EOF && i != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 || hdr[3]&0xe0 != 0 {
+		err = gzip.ErrHeader
+		return
+	}
+
+	flags := hdr[3]
+	if flags&gzipFlagExtra != 0 {
+		var lo, hi byte
+		if lo, err = d.readMemberByte(); err != nil {
+			return
+		}
+
+		if hi, err = d.readMemberByte(); err != nil {
+			return
+		}
+
+		if err = d.skip(int(lo) | int(hi)<<8); err != nil {
+			return
+		}
+	}
+
+	for _, f := range []byte{gzipFlagName, gzipFlagComment} {
+		if flags&f == 0 {
+			continue
+		}
+
+		// Skip a zero-terminated string.
+		for c := byte(1); c != 0; {
+			if c, err = d.readMemberByte(); err != nil {
+				return
+			}
+		}
+	}
+
+	if flags&gzipFlagHCRC != 0 {
+		err = d.skip(2)
+	}
+
+	return
+}
+
+// Read the trailer of the current member, checking it if possible.
+func (d *gzipDecoder) readTrailer() (err error) {
+	d.br.align()
+
+	var trailer [8]byte
+	for i := range trailer {
+		if trailer[i], err = d.readMemberByte(); err != nil {
+			return
+		}
+	}
+
+	le32 := func(b []byte) uint32 {
+		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	}
+
+	if d.verify && (le32(trailer[:4]) != d.crc || le32(trailer[4:]) != d.size) {
+		err = gzip.ErrChecksum
+		return
+	}
+
+	return
+}
+
+// Read a byte that must be present.
+func (d *gzipDecoder) readMemberByte() (c byte, err error) {
+	c, err = d.br.readByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+func (d *gzipDecoder) skip(n int) (err error) {
+	for i := 0; i < n && err == nil; i++ {
+		_, err = d.readMemberByte()
+	}
+
+	return
+}
+
+// Append a byte to the output.
+func (d *gzipDecoder) emit(c byte) {
+	d.window[d.wpos] = c
+	d.wpos = (d.wpos + 1) % inflateWindowSize
+	if d.hist < inflateWindowSize {
+		d.hist++
+	}
+
+	d.out = append(d.out, c)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inflating
+////////////////////////////////////////////////////////////////////////
+
+// Decode a deflate block (RFC 1951 section 3.2.3) into d.out.
+func (d *gzipDecoder) inflateBlock() (final bool, err error) {
+	hdr, err := d.br.bits(3)
+	if err != nil {
+		return
+	}
+
+	final = hdr&1 == 1
+	switch hdr >> 1 {
+	case 0:
+		err = d.inflateStored()
+
+	case 1:
+		err = d.inflateCodes(&fixedLitCode, &fixedDistCode)
+
+	case 2:
+		err = d.inflateDynamic()
+
+	default:
+		err = errors.New("invalid block type")
+	}
+
+	return
+}
+
+func (d *gzipDecoder) inflateStored() (err error) {
+	d.br.align()
+
+	var hdr [4]byte
+	for i := range hdr {
+		if hdr[i], err = d.readMemberByte(); err != nil {
+			return
+		}
+	}
+
+	n := uint16(hdr[0]) | uint16(hdr[1])<<8
+	if n != ^(uint16(hdr[2]) | uint16(hdr[3])<<8) {
+		err = errors.New("stored block length mismatch")
+		return
+	}
+
+	for i := 0; i < int(n); i++ {
+		var c byte
+		if c, err = d.readMemberByte(); err != nil {
+			return
+		}
+
+		d.emit(c)
+	}
+
+	return
+}
+
+// The order in which code length code lengths are stored.
+var codeLengthOrder = [19]int{
+	16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15,
+}
+
+func (d *gzipDecoder) inflateDynamic() (err error) {
+	counts := [3]uint{5, 5, 4}
+	var v [3]uint32
+	for i, n := range counts {
+		if v[i], err = d.br.bits(n); err != nil {
+			return
+		}
+	}
+
+	nlen := int(v[0]) + 257
+	ndist := int(v[1]) + 1
+	ncode := int(v[2]) + 4
+	if nlen > 286 || ndist > 30 {
+		err = errors.New("too many length or distance codes")
+		return
+	}
+
+	// Read the code for code lengths.
+	var lengths [286 + 30]uint8
+	for i := 0; i < ncode; i++ {
+		var l uint32
+		if l, err = d.br.bits(3); err != nil {
+			return
+		}
+
+		lengths[codeLengthOrder[i]] = uint8(l)
+	}
+
+	var lencode huffman
+	if err = lencode.init(lengths[:19]); err != nil {
+		return
+	}
+
+	// Use it to read the literal/length and distance code lengths.
+	for i := 0; i < nlen+ndist; {
+		var sym int
+		if sym, err = d.br.decode(&lencode); err != nil {
+			return
+		}
+
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var l uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if i == 0 {
+				err = errors.New("repeated length with no first length")
+				return
+			}
+
+			l = lengths[i-1]
+			rep, err = d.br.bits(2)
+			rep += 3
+
+		case 17:
+			rep, err = d.br.bits(3)
+			rep += 3
+
+		default:
+			rep, err = d.br.bits(7)
+			rep += 11
+		}
+
+		if err != nil {
+			return
+		}
+
+		if i+int(rep) > nlen+ndist {
+			err = errors.New("too many code lengths")
+			return
+		}
+
+		for ; rep > 0; rep-- {
+			lengths[i] = l
+			i++
+		}
+	}
+
+	if lengths[256] == 0 {
+		err = errors.New("no end-of-block code")
+		return
+	}
+
+	if err = d.lit.init(lengths[:nlen]); err != nil {
+		return
+	}
+
+	if err = d.dist.init(lengths[nlen : nlen+ndist]); err != nil {
+		return
+	}
+
+	err = d.inflateCodes(&d.lit, &d.dist)
+	return
+}
+
+var lengthBase = [29]int{
+	3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67,
+	83, 99, 115, 131, 163, 195, 227, 258,
+}
+
+var lengthExtra = [29]uint{
+	0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5,
+	5, 5, 0,
+}
+
+var distBase = [30]int{
+	1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513,
+	769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577,
+}
+
+var distExtra = [30]uint{
+	0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11,
+	11, 12, 12, 13, 13,
+}
+
+// The codes used by blocks compressed with fixed Huffman codes.
+var fixedLitCode, fixedDistCode = makeFixedCodes()
+
+func makeFixedCodes() (lit huffman, dist huffman) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+
+	if err := lit.init(lengths[:]); err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 30; i++ {
+		lengths[i] = 5
+	}
+
+	if err := dist.init(lengths[:30]); err != nil {
+		panic(err)
+	}
+
+	return
+}
+
+// Decode compressed data up to the end-of-block code.
+func (d *gzipDecoder) inflateCodes(lit *huffman, dist *huffman) (err error) {
+	for {
+		var sym int
+		if sym, err = d.br.decode(lit); err != nil {
+			return
+		}
+
+		if sym < 256 {
+			d.emit(byte(sym))
+			continue
+		}
+
+		if sym == 256 {
+			return
+		}
+
+		// A length, followed by a distance.
+		sym -= 257
+		if sym >= len(lengthBase) {
+			err = errors.New("invalid length code")
+			return
+		}
+
+		var extra uint32
+		if extra, err = d.br.bits(lengthExtra[sym]); err != nil {
+			return
+		}
+
+		length := lengthBase[sym] + int(extra)
+
+		if sym, err = d.br.decode(dist); err != nil {
+			return
+		}
+
+		if sym >= len(distBase) {
+			err = errors.New("invalid distance code")
+			return
+		}
+
+		if extra, err = d.br.bits(distExtra[sym]); err != nil {
+			return
+		}
+
+		distance := distBase[sym] + int(extra)
+		if distance > d.hist {
+			err = errors.New("distance too far back")
+			return
+		}
+
+		for i := 0; i < length; i++ {
+			d.emit(d.window[(d.wpos-distance+inflateWindowSize)%inflateWindowSize])
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// huffman
+////////////////////////////////////////////////////////////////////////
+
+const maxCodeBits = 15
+
+// A canonical Huffman code, as used by deflate.
+type huffman struct {
+	// The number of symbols with codes of each length.
+	count [maxCodeBits + 1]uint16
+
+	// The symbols, ordered by code.
+	symbol []uint16
+}
+
+// Set up the code for the given code lengths, where zero means the symbol is
+// unused. Incomplete codes are allowed; decoding a missing code fails.
+func (h *huffman) init(lengths []uint8) (err error) {
+	h.count = [maxCodeBits + 1]uint16{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			err = errors.New("over-subscribed Huffman code")
+			return
+		}
+	}
+
+	var offs [maxCodeBits + 2]uint16
+	for l := 1; l <= maxCodeBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+
+	h.symbol = h.symbol[:0]
+	for len(h.symbol) < int(offs[maxCodeBits+1]) {
+		h.symbol = append(h.symbol, 0)
+	}
+
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// bitReader
+////////////////////////////////////////////////////////////////////////
+
+// Reads bits, least significant first, keeping track of exactly how many
+// have been consumed.
+type bitReader struct {
+	r io.ByteReader
+
+	// Buffered bits not yet consumed, and how many there are.
+	b  uint64
+	nb uint
+
+	// The number of bytes taken from r.
+	read int64
+}
+
+// Return the number of bits consumed.
+func (br *bitReader) pos() int64 {
+	return br.read*8 - int64(br.nb)
+}
+
+// Buffer at least n bits.
+func (br *bitReader) fill(n uint) (err error) {
+	for br.nb < n {
+		var c byte
+		c, err = br.r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return
+		}
+
+		br.b |= uint64(c) << br.nb
+		br.nb += 8
+		br.read++
+	}
+
+	return
+}
+
+// Consume n bits.
+func (br *bitReader) bits(n uint) (v uint32, err error) {
+	if err = br.fill(n); err != nil {
+		return
+	}
+
+	v = uint32(br.b & (1<<n - 1))
+	br.b >>= n
+	br.nb -= n
+	return
+}
+
+// Discard bits up to the next byte boundary.
+func (br *bitReader) align() {
+	br.b >>= br.nb % 8
+	br.nb -= br.nb % 8
+}
+
+// Consume a byte, returning io.EOF if there are none left.
+//
+// REQUIRES: At a byte boundary.
+func (br *bitReader) readByte() (c byte, err error) {
+	if br.nb >= 8 {
+		c = byte(br.b)
+		br.b >>= 8
+		br.nb -= 8
+		return
+	}
+
+	c, err = br.r.ReadByte()
+	if err == nil {
+		br.read++
+	}
+
+	return
+}
+
+// Consume a symbol encoded with the supplied code.
+func (br *bitReader) decode(h *huffman) (sym int, err error) {
+	// Buffer enough bits for the longest code, if there are that many left.
+	// Running out is an error only if the code turns out to need them.
+	fillErr := br.fill(maxCodeBits)
+
+	var code, first, index int
+	for l := uint(1); l <= maxCodeBits; l++ {
+		if l > br.nb {
+			err = fillErr
+			return
+		}
+
+		code |= int(br.b>>(l-1)) & 1
+		count := int(h.count[l])
+		if code-first < count {
+			sym = int(h.symbol[index+code-first])
+			br.b >>= l
+			br.nb -= l
+			return
+		}
+
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+
+	err = errors.New("invalid Huffman code")
+	return
+}
@@ -0,0 +1,530 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// A read-only view of the decompressed contents of a particular generation of
+// a gzip-compressed GCS object.
+//
+// The first time the contents are needed, the whole object is streamed
+// through a decompressor once, with the output stored in leased temporary
+// files in blocks of roughly a configured size. Each block begins at a gzip
+// member or deflate block boundary, and remembers the decompressor state
+// needed to resume there (up to 32 KiB of preceding output), so that if its
+// temporary file is later evicted it can be rebuilt by decompressing only the
+// corresponding range of the object, rather than starting from the beginning.
+// This holds even for objects consisting of a single gzip member, the common
+// case for files produced by gzip(1).
+//
+// External synchronization is required, except for BuildIndex.
+type GzipView interface {
+	// Return the size of the decompressed contents and true if the view has
+	// been indexed. Otherwise return an estimate and false. Guarantees to not
+	// block.
+	Size() (size int64, exact bool)
+
+	// Decompress the object, returning an index recording the size of its
+	// contents and the locations of its blocks, for use with SetIndex. This
+	// doesn't touch the view's state, so unlike the other methods it may be
+	// called concurrently with anything but Destroy.
+	BuildIndex(ctx context.Context) (idx *GzipIndex, err error)
+
+	// Use an index returned by BuildIndex, unless the view has already been
+	// indexed, in which case it is destroyed.
+	SetIndex(idx *GzipIndex)
+
+	// Build and set an index if this hasn't already been done.
+	Index(ctx context.Context) (err error)
+
+	// Semantics matching io.ReaderAt, except with context support. Calls Index
+	// if necessary.
+	ReadAt(ctx context.Context, p []byte, off int64) (n int, err error)
+
+	// Return the number of bytes of decompressed content currently held in
+	// unrevoked leases. Doesn't fetch or decompress anything.
+	Residency() (resident int64)
+
+	// Destroy any resources in use by the view. It must not be used further.
+	Destroy()
+
+	// Panic if any internal invariants are violated.
+	CheckInvariants()
+}
+
+// The decompressed contents of a gzip view's object, as returned by
+// GzipView.BuildIndex.
+type GzipIndex struct {
+	// The size of the decompressed contents.
+	//
+	// INVARIANT: Equal to the sum of the sizes of blocks.
+	size int64
+
+	// The blocks making up the contents, in order.
+	//
+	// INVARIANT: Each block's offset is the sum of the previous blocks' sizes.
+	blocks []gzipBlock
+}
+
+// Throw away the index, along with any decompressed contents it holds.
+func (idx *GzipIndex) Destroy() {
+	for _, b := range idx.blocks {
+		b.rp.Destroy()
+	}
+
+	idx.blocks = nil
+}
+
+// Create a view on the decompressed contents of the given GCS object
+// generation. blockSize controls the minimum amount of decompressed data in
+// each block, except the last.
+//
+// REQUIRES: blockSize > 0
+func NewGzipView(
+	o *gcs.Object,
+	blockSize int64,
+	leaser lease.FileLeaser,
+	bucket gcs.Bucket) (v GzipView) {
+	if blockSize <= 0 {
+		panic(fmt.Sprintf("Illegal block size: %d", blockSize))
+	}
+
+	v = &gzipView{
+		o:         o,
+		blockSize: blockSize,
+		leaser:    leaser,
+		bucket:    bucket,
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+// A contiguous run of decompressed content, produced by one or more whole gzip
+// members.
+type gzipBlock struct {
+	// The offset of the block within the decompressed contents.
+	offset int64
+
+	// A read proxy for the block's contents.
+	rp lease.ReadProxy
+}
+
+type gzipView struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	leaser lease.FileLeaser
+	bucket gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	o         *gcs.Object
+	blockSize int64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// The index, or nil if SetIndex has not yet been called.
+	index *GzipIndex
+}
+
+func (v *gzipView) CheckInvariants() {
+	if v.index == nil {
+		return
+	}
+
+	var offset int64
+	for i, b := range v.index.blocks {
+		if b.offset != offset {
+			panic(fmt.Sprintf("Block %d offset %d; expected %d", i, b.offset, offset))
+		}
+
+		b.rp.CheckInvariants()
+		offset += b.rp.Size()
+	}
+
+	if offset != v.index.size {
+		panic(fmt.Sprintf("Size mismatch: %d vs. %d", offset, v.index.size))
+	}
+}
+
+func (v *gzipView) Size() (size int64, exact bool) {
+	if v.index != nil {
+		size = v.index.size
+		exact = true
+		return
+	}
+
+	// Until we've seen the contents, the compressed size is as good a guess as
+	// any.
+	size = int64(v.o.Size)
+	return
+}
+
+func (v *gzipView) BuildIndex(
+	ctx context.Context) (idx *GzipIndex, err error) {
+	rc, err := v.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       v.o.Name,
+			Generation: v.o.Generation,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	d, err := newGzipDecoder(bufio.NewReader(rc), gzipCheckpoint{})
+	if err != nil {
+		err = fmt.Errorf("newGzipDecoder: %v", err)
+		return
+	}
+
+	idx = &GzipIndex{}
+	var w *gzipBlockWriter
+
+	defer func() {
+		if w != nil {
+			w.abandon()
+		}
+
+		if err != nil {
+			idx.Destroy()
+			idx = nil
+		}
+	}()
+
+	// Decompress one deflate block at a time. Once the current block of our own
+	// is big enough, finish it at the end of the member, or part way through
+	// at the next deflate block with any output. (Compressors often end a
+	// member with an empty block, which is better left with what came before.)
+	for {
+		split := w != nil && w.size >= v.blockSize
+
+		var cp gzipCheckpoint
+		if w == nil || split {
+			cp = d.checkpoint()
+		}
+
+		var out []byte
+		out, err = d.next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+
+		if err != nil {
+			return
+		}
+
+		if split && len(out) != 0 {
+			idx.blocks = append(idx.blocks, w.finish(v, idx.size))
+			idx.size += w.size
+			w = nil
+		}
+
+		if w == nil {
+			w, err = newGzipBlockWriter(v, cp)
+			if err != nil {
+				return
+			}
+		}
+
+		_, err = w.rwl.Write(out)
+		if err != nil {
+			err = fmt.Errorf("Write: %v", err)
+			return
+		}
+
+		w.size += int64(len(out))
+		w.limit = uint64((d.position() + 7) / 8)
+
+		if w.size >= v.blockSize && !d.inMember {
+			idx.blocks = append(idx.blocks, w.finish(v, idx.size))
+			idx.size += w.size
+			w = nil
+		}
+	}
+
+	// Finish the last block.
+	if w != nil {
+		idx.blocks = append(idx.blocks, w.finish(v, idx.size))
+		idx.size += w.size
+		w = nil
+	}
+
+	return
+}
+
+func (v *gzipView) SetIndex(idx *GzipIndex) {
+	if v.index != nil {
+		idx.Destroy()
+		return
+	}
+
+	v.index = idx
+}
+
+func (v *gzipView) Index(ctx context.Context) (err error) {
+	if v.index != nil {
+		return
+	}
+
+	idx, err := v.BuildIndex(ctx)
+	if err != nil {
+		return
+	}
+
+	v.SetIndex(idx)
+	return
+}
+
+func (v *gzipView) ReadAt(
+	ctx context.Context,
+	p []byte,
+	off int64) (n int, err error) {
+	err = v.Index(ctx)
+	if err != nil {
+		err = fmt.Errorf("Index: %v", err)
+		return
+	}
+
+	// Find the first block containing data at or after the offset.
+	blocks := v.index.blocks
+	i := sort.Search(len(blocks), func(i int) bool {
+		b := blocks[i]
+		return b.offset+b.rp.Size() > off
+	})
+
+	// Read from each block in turn.
+	for ; i < len(blocks) && n < len(p); i++ {
+		b := blocks[i]
+
+		var blockN int
+		blockN, err = b.rp.ReadAt(ctx, p[n:], off+int64(n)-b.offset)
+		n += blockN
+
+		// Reaching the end of a block is expected.
+		if err == io.EOF {
+			err = nil
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Block %d: %v", i, err)
+			return
+		}
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+func (v *gzipView) Residency() (resident int64) {
+	if v.index == nil {
+		return
+	}
+
+	for _, b := range v.index.blocks {
+		resident += b.rp.Residency()
+	}
+
+	return
+}
+
+func (v *gzipView) Destroy() {
+	if v.index != nil {
+		v.index.Destroy()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// gzipBlockWriter
+////////////////////////////////////////////////////////////////////////
+
+// A block under construction by gzipView.BuildIndex.
+type gzipBlockWriter struct {
+	rwl lease.ReadWriteLease
+
+	// Where the block begins in the object, and the end of the range of the
+	// object holding its compressed contents.
+	start gzipCheckpoint
+	limit uint64
+
+	size int64
+}
+
+func newGzipBlockWriter(
+	v *gzipView,
+	start gzipCheckpoint) (w *gzipBlockWriter, err error) {
+	rwl, err := v.leaser.NewTaggedFile(LeaseTag(v.o.Name, v.o.Generation))
+	if err != nil {
+		err = fmt.Errorf("NewTaggedFile: %v", err)
+		return
+	}
+
+	w = &gzipBlockWriter{
+		rwl:   rwl,
+		start: start,
+		limit: uint64(start.offset),
+	}
+
+	return
+}
+
+// Turn the written data into a block at the given offset in the decompressed
+// contents. The writer must not be used again.
+func (w *gzipBlockWriter) finish(v *gzipView, offset int64) (b gzipBlock) {
+	refresher := &gzipBlockRefresher{
+		bucket: v.bucket,
+		o:      v.o,
+		start:  w.start,
+		r:      gcs.ByteRange{Start: uint64(w.start.offset), Limit: w.limit},
+		size:   w.size,
+	}
+
+	b = gzipBlock{
+		offset: offset,
+		rp:     lease.NewReadProxy(v.leaser, refresher, w.rwl.Downgrade()),
+	}
+
+	return
+}
+
+// Throw away the written data. The writer must not be used again.
+func (w *gzipBlockWriter) abandon() {
+	w.rwl.Downgrade().Revoke()
+}
+
+////////////////////////////////////////////////////////////////////////
+// gzipBlockRefresher
+////////////////////////////////////////////////////////////////////////
+
+// A refresher that decompresses a particular range of a GCS object generation,
+// starting from a checkpoint at its start.
+type gzipBlockRefresher struct {
+	bucket gcs.Bucket
+	o      *gcs.Object
+	start  gzipCheckpoint
+	r      gcs.ByteRange
+	size   int64
+}
+
+var _ lease.TaggedRefresher = &gzipBlockRefresher{}
+
+func (r *gzipBlockRefresher) Size() (size int64) {
+	size = r.size
+	return
+}
+
+func (r *gzipBlockRefresher) Tag() (tag string) {
+	tag = LeaseTag(r.o.Name, r.o.Generation)
+	return
+}
+
+func (r *gzipBlockRefresher) Refresh(
+	ctx context.Context) (rc io.ReadCloser, err error) {
+	objectRC, err := r.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       r.o.Name,
+			Generation: r.o.Generation,
+			Range:      &r.r,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	d, err := newGzipDecoder(bufio.NewReader(objectRC), r.start)
+	if err != nil {
+		objectRC.Close()
+		err = fmt.Errorf("newGzipDecoder: %v", err)
+		return
+	}
+
+	rc = &gzipBlockReader{
+		d:         d,
+		remaining: r.size,
+		closer:    objectRC,
+	}
+
+	return
+}
+
+// Reads a block's worth of output from a decoder, closing the underlying
+// reader when closed.
+type gzipBlockReader struct {
+	d         *gzipDecoder
+	buf       []byte
+	remaining int64
+	closer    io.Closer
+}
+
+func (br *gzipBlockReader) Read(p []byte) (n int, err error) {
+	for len(br.buf) == 0 {
+		if br.remaining == 0 {
+			err = io.EOF
+			return
+		}
+
+		br.buf, err = br.d.next()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return
+		}
+
+		if int64(len(br.buf)) > br.remaining {
+			br.buf = br.buf[:br.remaining]
+		}
+
+		br.remaining -= int64(len(br.buf))
+	}
+
+	n = copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return
+}
+
+func (br *gzipBlockReader) Close() (err error) {
+	err = br.closer.Close()
+	return
+}
@@ -0,0 +1,394 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestGzipView(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that records the read requests made to it.
+type readRecordingBucket struct {
+	gcs.Bucket
+	reqs []*gcs.ReadObjectRequest
+}
+
+func (b *readRecordingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.reqs = append(b.reqs, req)
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+// Compress each of the supplied chunks as a separate gzip member, returning
+// the concatenation.
+func gzipMembers(chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, c := range chunks {
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(c); err != nil {
+			panic(err)
+		}
+
+		if err := w.Close(); err != nil {
+			panic(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Return compressible text made of words chosen at random.
+func randText(n int) []byte {
+	words := []string{"taco ", "burrito ", "enchilada ", "queso\n"}
+
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		buf.WriteString(words[rand.Intn(len(words))])
+	}
+
+	return buf.Bytes()[:n]
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const gzipBlockSize = 100
+
+type GzipViewTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket readRecordingBucket
+	leaser lease.FileLeaser
+
+	// The uncompressed contents of the members of the object, and the object
+	// itself.
+	members  [][]byte
+	contents []byte
+	o        *gcs.Object
+
+	view gcsproxy.GzipView
+}
+
+var _ SetUpInterface = &GzipViewTest{}
+var _ TearDownInterface = &GzipViewTest{}
+
+func init() { RegisterTestSuite(&GzipViewTest{}) }
+
+func (t *GzipViewTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.leaser = lease.NewFileLeaser("", 100, 1<<30)
+
+	// Members of various sizes, some smaller than the block size and some
+	// larger. The empty member must not confuse anything.
+	t.members = [][]byte{
+		randBytes(32),
+		randBytes(80),
+		randBytes(252),
+		nil,
+		randBytes(12),
+		randBytes(120),
+		randBytes(8),
+	}
+
+	t.create(gzipMembers(t.members...))
+}
+
+func (t *GzipViewTest) TearDown() {
+	t.view.Destroy()
+}
+
+// Create the object with the given compressed contents, and a view on it.
+func (t *GzipViewTest) create(compressed []byte) {
+	var err error
+
+	t.contents = nil
+	for _, m := range t.members {
+		t.contents = append(t.contents, m...)
+	}
+
+	t.o, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket.Bucket,
+		"foo.gz",
+		string(compressed))
+
+	AssertEq(nil, err)
+
+	t.view = gcsproxy.NewGzipView(t.o, gzipBlockSize, t.leaser, &t.bucket)
+}
+
+func (t *GzipViewTest) readAt(off int64, size int) (data []byte, err error) {
+	data = make([]byte, size)
+	n, err := t.view.ReadAt(t.ctx, data, off)
+	data = data[:n]
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GzipViewTest) SizeBeforeAndAfterIndexing() {
+	size, exact := t.view.Size()
+	ExpectFalse(exact)
+	ExpectEq(t.o.Size, size)
+	ExpectEq(0, len(t.bucket.reqs))
+
+	AssertEq(nil, t.view.Index(t.ctx))
+
+	size, exact = t.view.Size()
+	ExpectTrue(exact)
+	ExpectEq(len(t.contents), size)
+	ExpectEq(1, len(t.bucket.reqs))
+
+	// Indexing again should do nothing.
+	AssertEq(nil, t.view.Index(t.ctx))
+	ExpectEq(1, len(t.bucket.reqs))
+	t.view.CheckInvariants()
+}
+
+func (t *GzipViewTest) ReadEverything() {
+	data, err := t.readAt(0, len(t.contents)+10)
+
+	ExpectEq(io.EOF, err)
+	ExpectTrue(bytes.Equal(t.contents, data))
+	ExpectEq(1, len(t.bucket.reqs))
+}
+
+func (t *GzipViewTest) RandomAccess() {
+	AssertEq(nil, t.view.Index(t.ctx))
+
+	for i := 0; i < 500; i++ {
+		off := rand.Intn(len(t.contents))
+		size := rand.Intn(len(t.contents) - off + 1)
+
+		data, err := t.readAt(int64(off), size)
+		AssertEq(nil, err, "off: %d, size: %d", off, size)
+		AssertTrue(
+			bytes.Equal(t.contents[off:off+size], data),
+			"off: %d, size: %d",
+			off,
+			size)
+	}
+
+	// Everything should have been served from the first pass.
+	ExpectEq(1, len(t.bucket.reqs))
+}
+
+func (t *GzipViewTest) ReadPastEnd() {
+	data, err := t.readAt(int64(len(t.contents)), 10)
+	ExpectEq(io.EOF, err)
+	ExpectEq(0, len(data))
+
+	data, err = t.readAt(int64(len(t.contents))+100, 10)
+	ExpectEq(io.EOF, err)
+	ExpectEq(0, len(data))
+}
+
+func (t *GzipViewTest) EvictedBlocksAreRebuiltFromTheirOwnRange() {
+	AssertEq(nil, t.view.Index(t.ctx))
+	ExpectEq(len(t.contents), t.view.Residency())
+
+	t.leaser.RevokeReadLeases()
+	ExpectEq(0, t.view.Residency())
+
+	// Read a range in the middle of the large third member, which makes up a
+	// block by itself (the first two members make up the first block).
+	off := int64(len(t.members[0]) + len(t.members[1]) + 100)
+	data, err := t.readAt(off, 20)
+
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents[off:off+20], data))
+
+	ExpectEq(len(t.members[2]), t.view.Residency())
+
+	// Only the range of the object holding that member should have been read.
+	AssertEq(2, len(t.bucket.reqs))
+	r := t.bucket.reqs[1].Range
+	AssertNe(nil, r)
+
+	compressedPrefix := gzipMembers(t.members[0], t.members[1])
+	compressedBlock := gzipMembers(t.members[2])
+	ExpectEq(len(compressedPrefix), r.Start)
+	ExpectEq(len(compressedPrefix)+len(compressedBlock), r.Limit)
+
+	// A read spanning every block should rebuild the others and still return
+	// the right data.
+	data, err = t.readAt(0, len(t.contents))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents, data))
+	t.view.CheckInvariants()
+}
+
+func (t *GzipViewTest) SingleMember() {
+	t.view.Destroy()
+	t.members = [][]byte{randBytes(1000)}
+	t.create(gzipMembers(t.members...))
+
+	data, err := t.readAt(500, 100)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents[500:600], data))
+
+	size, exact := t.view.Size()
+	ExpectTrue(exact)
+	ExpectEq(1000, size)
+}
+
+func (t *GzipViewTest) SingleMemberIsIndexedWithinIt() {
+	t.view.Destroy()
+	t.members = [][]byte{randText(1 << 20)}
+	t.create(gzipMembers(t.members...))
+
+	AssertEq(nil, t.view.Index(t.ctx))
+	t.leaser.RevokeReadLeases()
+
+	// Reading from the middle should decompress only part of the object,
+	// starting part way through.
+	off := len(t.contents) / 2
+	data, err := t.readAt(int64(off), 20)
+
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents[off:off+20], data))
+	ExpectLt(t.view.Residency(), len(t.contents)/2)
+
+	AssertEq(2, len(t.bucket.reqs))
+	r := t.bucket.reqs[1].Range
+	AssertNe(nil, r)
+	ExpectGt(r.Start, 0)
+	ExpectLt(r.Limit, t.o.Size)
+
+	// Everything should still read back correctly.
+	t.leaser.RevokeReadLeases()
+	data, err = t.readAt(0, len(t.contents))
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(t.contents, data))
+	t.view.CheckInvariants()
+}
+
+func (t *GzipViewTest) CompressionLevels() {
+	levels := []int{
+		gzip.NoCompression,
+		gzip.BestSpeed,
+		gzip.DefaultCompression,
+		gzip.BestCompression,
+		gzip.HuffmanOnly,
+	}
+
+	for _, level := range levels {
+		t.view.Destroy()
+		t.members = [][]byte{randText(1 << 18), randBytes(1 << 12)}
+		t.bucket.reqs = nil
+
+		// Flush part way through, for an empty stored block.
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, level)
+		AssertEq(nil, err)
+
+		_, err = w.Write(t.members[0])
+		AssertEq(nil, err)
+		AssertEq(nil, w.Flush())
+
+		_, err = w.Write(t.members[1])
+		AssertEq(nil, err)
+		AssertEq(nil, w.Close())
+
+		t.create(buf.Bytes())
+
+		AssertEq(nil, t.view.Index(t.ctx), "level: %d", level)
+		t.leaser.RevokeReadLeases()
+
+		// Read in pieces, so that each block is rebuilt from its checkpoint.
+		var data []byte
+		for off := 0; off < len(t.contents); off += 1 << 14 {
+			var piece []byte
+			piece, err = t.readAt(int64(off), 1<<14)
+			if err == io.EOF {
+				err = nil
+			}
+
+			AssertEq(nil, err, "level: %d", level)
+			data = append(data, piece...)
+			t.leaser.RevokeReadLeases()
+		}
+
+		ExpectTrue(bytes.Equal(t.contents, data), "level: %d", level)
+	}
+}
+
+func (t *GzipViewTest) EmptyObject() {
+	t.view.Destroy()
+	t.members = nil
+	t.create(nil)
+
+	data, err := t.readAt(0, 10)
+	ExpectEq(io.EOF, err)
+	ExpectEq(0, len(data))
+
+	size, exact := t.view.Size()
+	ExpectTrue(exact)
+	ExpectEq(0, size)
+}
+
+func (t *GzipViewTest) NotGzip() {
+	t.view.Destroy()
+	t.members = nil
+	t.create([]byte("taco"))
+
+	_, err := t.readAt(0, 10)
+	ExpectThat(err, Error(HasSubstr("gzip header")))
+
+	_, exact := t.view.Size()
+	ExpectFalse(exact)
+}
+
+func (t *GzipViewTest) CorruptMember() {
+	t.view.Destroy()
+
+	compressed := gzipMembers(t.members...)
+	compressed = compressed[:len(compressed)-3]
+	t.create(compressed)
+
+	_, err := t.readAt(0, 10)
+	ExpectThat(err, Error(HasSubstr("Decompressing")))
+
+	_, exact := t.view.Size()
+	ExpectFalse(exact)
+	t.view.CheckInvariants()
+}
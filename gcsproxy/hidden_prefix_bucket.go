@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that leaves out of listings the objects whose names begin
+// with the given prefix, and the collapsed runs that they would form. For
+// example, with prefix ".gcsfuse_tmp/" a listing of the root with a "/"
+// delimiter doesn't contain the run ".gcsfuse_tmp/", and a listing with that
+// prefix is empty. A page of the wrapped bucket's listing that would be left
+// empty is skipped over. All other requests are passed through unmodified, so the
+// objects can still be read, written, and deleted by name.
+//
+// The prefix should end with a slash, so that objects merely sharing a leading
+// part of its name remain visible.
+func NewHiddenPrefixBucket(
+	prefix string,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &hiddenPrefixBucket{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type hiddenPrefixBucket struct {
+	prefix  string
+	wrapped gcs.Bucket
+}
+
+func (b *hiddenPrefixBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *hiddenPrefixBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+func (b *hiddenPrefixBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *hiddenPrefixBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *hiddenPrefixBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *hiddenPrefixBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *hiddenPrefixBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	// Nothing under the prefix is visible.
+	if strings.HasPrefix(req.Prefix, b.prefix) {
+		listing = &gcs.Listing{}
+		return
+	}
+
+	// Filter into a new listing, leaving the wrapped bucket's copy alone. Skip
+	// over pages that turn out to contain only hidden objects, so that callers
+	// asking for a single result (e.g. to find out whether a directory is
+	// non-empty) aren't misled.
+	wrappedReq := *req
+	for {
+		var wrappedListing *gcs.Listing
+		wrappedListing, err = b.wrapped.ListObjects(ctx, &wrappedReq)
+		if err != nil {
+			return
+		}
+
+		listing = &gcs.Listing{
+			ContinuationToken: wrappedListing.ContinuationToken,
+		}
+
+		for _, o := range wrappedListing.Objects {
+			if !strings.HasPrefix(o.Name, b.prefix) {
+				listing.Objects = append(listing.Objects, o)
+			}
+		}
+
+		for _, run := range wrappedListing.CollapsedRuns {
+			if !strings.HasPrefix(run, b.prefix) {
+				listing.CollapsedRuns = append(listing.CollapsedRuns, run)
+			}
+		}
+
+		if len(listing.Objects) != 0 ||
+			len(listing.CollapsedRuns) != 0 ||
+			listing.ContinuationToken == "" {
+			return
+		}
+
+		wrappedReq.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+func (b *hiddenPrefixBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *hiddenPrefixBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
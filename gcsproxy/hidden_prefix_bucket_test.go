@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestHiddenPrefixBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type HiddenPrefixBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &HiddenPrefixBucketTest{}
+
+func init() { RegisterTestSuite(&HiddenPrefixBucketTest{}) }
+
+func (t *HiddenPrefixBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsproxy.NewHiddenPrefixBucket("a/.tmp/", t.wrapped)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.wrapped,
+		[]string{
+			".tmp/foo",
+			"a/",
+			"a/.tmp/foo",
+			"a/.tmp/bar/baz",
+			"a/.tmpfoo",
+			"a/b/",
+			"a/c",
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *HiddenPrefixBucketTest) list(
+	req *gcs.ListObjectsRequest) (names []string, runs []string) {
+	listing, err := t.bucket.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+
+	for _, o := range listing.Objects {
+		names = append(names, o.Name)
+	}
+
+	runs = listing.CollapsedRuns
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *HiddenPrefixBucketTest) ListWithDelimiter() {
+	names, runs := t.list(&gcs.ListObjectsRequest{
+		Prefix:    "a/",
+		Delimiter: "/",
+	})
+
+	ExpectThat(names, ElementsAre("a/", "a/.tmpfoo", "a/c"))
+	ExpectThat(runs, ElementsAre("a/b/"))
+}
+
+func (t *HiddenPrefixBucketTest) ListWithoutDelimiter() {
+	names, runs := t.list(&gcs.ListObjectsRequest{})
+
+	ExpectThat(names, ElementsAre(".tmp/foo", "a/", "a/.tmpfoo", "a/b/", "a/c"))
+	ExpectThat(runs, ElementsAre())
+}
+
+func (t *HiddenPrefixBucketTest) ListHiddenPrefix() {
+	names, runs := t.list(&gcs.ListObjectsRequest{
+		Prefix:    "a/.tmp/",
+		Delimiter: "/",
+	})
+
+	ExpectThat(names, ElementsAre())
+	ExpectThat(runs, ElementsAre())
+}
+
+func (t *HiddenPrefixBucketTest) SkipsHiddenPages() {
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:     "a/.",
+			MaxResults: 1,
+		})
+
+	AssertEq(nil, err)
+
+	var names []string
+	for _, o := range listing.Objects {
+		names = append(names, o.Name)
+	}
+
+	ExpectThat(names, ElementsAre("a/.tmpfoo"))
+}
+
+func (t *HiddenPrefixBucketTest) HiddenObjectsAreStillAccessible() {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "a/.tmp/foo"})
+
+	AssertEq(nil, err)
+	ExpectEq("a/.tmp/foo", o.Name)
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "a/.tmp/foo"})
+
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.wrapped, "a/.tmp/foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -16,11 +16,13 @@ package gcsproxy_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
@@ -65,26 +67,179 @@ func randBytes(n int) (b []byte) {
 // Boilerplate
 ////////////////////////////////////////////////////////////////////////
 
-const chunkSize = 1<<18 + 3
 const fileLeaserLimitNumFiles = math.MaxInt32
 const fileLeaserLimitBytes = 1 << 21
+const tmpObjectPrefix = ".gcsfuse_tmp/"
 
-type IntegrationTest struct {
-	ctx    context.Context
-	bucket gcs.Bucket
-	leaser lease.FileLeaser
-	clock  timeutil.SimulatedClock
-	syncer gcsproxy.ObjectSyncer
+// A bucket that creates all temporary objects under the same name, as if two
+// mounts sharing a prefix had chosen the same one.
+type collidingBucket struct {
+	gcs.Bucket
+	tmpName string
+}
 
-	mc mutable.Content
+func (b *collidingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if strings.HasPrefix(req.Name, tmpObjectPrefix) {
+		req.Name = b.tmpName
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
 }
 
-var _ SetUpInterface = &IntegrationTest{}
-var _ TearDownInterface = &IntegrationTest{}
+// A bucket in which another mount's temporary object replaces each of ours as
+// soon as it is created.
+type replacingBucket struct {
+	gcs.Bucket
+}
 
-func init() { RegisterTestSuite(&IntegrationTest{}) }
+func (b *replacingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	if err != nil || !strings.HasPrefix(req.Name, tmpObjectPrefix) {
+		return
+	}
 
-func (t *IntegrationTest) SetUp(ti *TestInfo) {
+	_, err = b.Bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:     req.Name,
+			Contents: strings.NewReader("enchilada"),
+			Metadata: map[string]string{
+				gcsproxy.TmpTargetMetadataKey:  req.Metadata[gcsproxy.TmpTargetMetadataKey],
+				gcsproxy.TmpMountIDMetadataKey: "some-other-mount",
+			},
+		})
+
+	return
+}
+
+// A bucket that fails one CreateObject call part way through uploading its
+// contents, after allowing failAfter calls to succeed, and that counts the
+// bytes uploaded.
+type interruptingBucket struct {
+	gcs.Bucket
+	failAfter int
+	uploaded  int64
+}
+
+func (b *interruptingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	counter := &countingReader{r: req.Contents}
+	req.Contents = counter
+	defer func() { b.uploaded += counter.n }()
+
+	if b.failAfter == 0 {
+		b.failAfter = -1
+		io.CopyN(ioutil.Discard, counter, 1)
+		err = errors.New("connection reset by peer")
+		return
+	}
+
+	if b.failAfter > 0 {
+		b.failAfter--
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+// A bucket that flips a bit in the contents of the first few CreateObject
+// calls on their way to the wrapped bucket, and that counts the calls. If
+// unchecked is set, it also drops the checksums sent with them, so that the
+// damaged contents are written.
+type flippingBucket struct {
+	gcs.Bucket
+	flips     int
+	unchecked bool
+	creates   int
+}
+
+func (b *flippingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.creates++
+
+	if b.flips > 0 {
+		b.flips--
+
+		var contents []byte
+		contents, err = ioutil.ReadAll(req.Contents)
+		if err != nil {
+			return
+		}
+
+		contents[len(contents)/2] ^= 0x10
+		req.Contents = bytes.NewReader(contents)
+
+		if b.unchecked {
+			req.CRC32C = nil
+			req.MD5 = nil
+		}
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+// A bucket that composes the sources of the first few ComposeObjects calls
+// onto the object named dst in reverse order.
+type reorderingBucket struct {
+	gcs.Bucket
+	dst      string
+	reorders int
+}
+
+func (b *reorderingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if req.DstName == b.dst && b.reorders > 0 {
+		b.reorders--
+
+		reqCopy := *req
+		reqCopy.Sources = nil
+		for i := len(req.Sources) - 1; i >= 0; i-- {
+			reqCopy.Sources = append(reqCopy.Sources, req.Sources[i])
+		}
+
+		req = &reqCopy
+	}
+
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+// The tests below are run once for each of the chunk sizes registered at the
+// end of this file. Embedders must set chunkSize, and optionally
+// readaheadChunks, before calling SetUp.
+type integrationTest struct {
+	ctx             context.Context
+	chunkSize       int
+	readaheadChunks int
+	bucket          gcs.Bucket
+	leaser          lease.FileLeaser
+	clock           timeutil.SimulatedClock
+	syncer          gcsproxy.ObjectSyncer
+
+	mc mutable.Content
+}
+
+func (t *integrationTest) SetUp(ti *TestInfo) {
 	t.ctx = ti.Ctx
 	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
 	t.leaser = lease.NewFileLeaser(
@@ -97,27 +252,30 @@ func (t *IntegrationTest) SetUp(ti *TestInfo) {
 
 	// Set up the object syncer.
 	const appendThreshold = 0
-	const tmpObjectPrefix = ".gcsfuse_tmp/"
 
 	t.syncer = gcsproxy.NewObjectSyncer(
 		appendThreshold,
+		0, // Resumable upload threshold
 		tmpObjectPrefix,
 		t.bucket)
 }
 
-func (t *IntegrationTest) TearDown() {
+func (t *integrationTest) TearDown() {
 	if t.mc != nil {
 		t.mc.Destroy()
 	}
 }
 
-func (t *IntegrationTest) create(o *gcs.Object) {
+func (t *integrationTest) create(o *gcs.Object) {
 	// Set up the read proxy.
 	rp := gcsproxy.NewReadProxy(
 		o,
 		nil,
-		chunkSize,
+		uint64(t.chunkSize),
+		t.readaheadChunks,
+		true, // Validate checksums
 		t.leaser,
+		nil,
 		t.bucket)
 
 	// Use it to create the mutable content.
@@ -125,7 +283,7 @@ func (t *IntegrationTest) create(o *gcs.Object) {
 }
 
 // Return the object generation, or -1 if non-existent. Panic on error.
-func (t *IntegrationTest) objectGeneration(name string) (gen int64) {
+func (t *integrationTest) objectGeneration(name string) (gen int64) {
 	// Stat.
 	req := &gcs.StatObjectRequest{Name: name}
 	o, err := t.bucket.StatObject(t.ctx, req)
@@ -148,10 +306,10 @@ func (t *IntegrationTest) objectGeneration(name string) (gen int64) {
 	return
 }
 
-func (t *IntegrationTest) sync(src *gcs.Object) (
+func (t *integrationTest) sync(src *gcs.Object) (
 	rl lease.ReadLease, o *gcs.Object, err error) {
 	rl, o, err = t.syncer.SyncObject(t.ctx, src, t.mc)
-	if err == nil && rl != nil {
+	if err == nil && o != nil {
 		t.mc = nil
 	}
 
@@ -162,7 +320,7 @@ func (t *IntegrationTest) sync(src *gcs.Object) (
 // Tests
 ////////////////////////////////////////////////////////////////////////
 
-func (t *IntegrationTest) ReadThenSync() {
+func (t *integrationTest) ReadThenSync() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -185,7 +343,7 @@ func (t *IntegrationTest) ReadThenSync() {
 	ExpectEq(nil, newObj)
 }
 
-func (t *IntegrationTest) WriteThenSync() {
+func (t *integrationTest) WriteThenSync() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -210,6 +368,11 @@ func (t *IntegrationTest) WriteThenSync() {
 	AssertEq(nil, err)
 	ExpectEq("paco", string(contents))
 
+	// The new generation should record when it was modified.
+	ExpectEq(
+		gcsproxy.FormatMtime(t.clock.Now()),
+		newObj.Metadata[gcsproxy.MtimeMetadataKey])
+
 	// Read via the lease.
 	_, err = rl.Seek(0, 0)
 	AssertEq(nil, err)
@@ -232,7 +395,7 @@ func (t *IntegrationTest) WriteThenSync() {
 	ExpectEq("foo", objects[0].Name)
 }
 
-func (t *IntegrationTest) AppendThenSync() {
+func (t *integrationTest) AppendThenSync() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -257,13 +420,14 @@ func (t *IntegrationTest) AppendThenSync() {
 	AssertEq(nil, err)
 	ExpectEq("tacoburrito", string(contents))
 
-	// Read via the lease.
-	_, err = rl.Seek(0, 0)
-	AssertEq(nil, err)
+	// The new generation should record when it was modified.
+	ExpectEq(
+		gcsproxy.FormatMtime(t.clock.Now()),
+		newObj.Metadata[gcsproxy.MtimeMetadataKey])
 
-	contents, err = ioutil.ReadAll(rl)
-	AssertEq(nil, err)
-	ExpectEq("tacoburrito", string(contents))
+	// The original contents were never fetched, so there is no lease holding
+	// the new ones.
+	ExpectEq(nil, rl)
 
 	// There should be no junk left over in the bucket besides the object of
 	// interest.
@@ -279,7 +443,227 @@ func (t *IntegrationTest) AppendThenSync() {
 	ExpectEq("foo", objects[0].Name)
 }
 
-func (t *IntegrationTest) TruncateThenSync() {
+// Have the syncer write through a flippingBucket that damages the given
+// number of uploads.
+func (t *integrationTest) flipUploads(flips int) (b *flippingBucket) {
+	b = &flippingBucket{
+		Bucket: t.bucket,
+		flips:  flips,
+	}
+
+	t.syncer = gcsproxy.NewObjectSyncer(
+		0, // Append threshold
+		0, // Resumable upload threshold
+		tmpObjectPrefix,
+		b)
+
+	return
+}
+
+func (t *integrationTest) WriteThenSync_DamagedOnce() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+	b := t.flipUploads(1)
+
+	// Overwrite the first byte.
+	_, err = t.mc.WriteAt(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Sync should notice the damage and upload again.
+	_, newObj, err := t.sync(o)
+
+	AssertEq(nil, err)
+	ExpectEq(2, b.creates)
+	ExpectEq(t.objectGeneration("foo"), newObj.Generation)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+}
+
+func (t *integrationTest) WriteThenSync_DamagedTwice() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+	b := t.flipUploads(2)
+
+	// Overwrite the first byte.
+	_, err = t.mc.WriteAt(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Sync should give up rather than writing damaged contents.
+	_, _, err = t.sync(o)
+
+	ExpectThat(err, Error(HasSubstr("CRC32C")))
+	ExpectEq(2, b.creates)
+	ExpectEq(o.Generation, t.objectGeneration("foo"))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// The content is still intact, so a later sync can succeed.
+	buf := make([]byte, 4)
+	_, err = t.mc.ReadAt(t.ctx, buf, 0)
+	AssertThat(err, AnyOf(io.EOF, nil))
+	ExpectEq("paco", string(buf))
+
+	_, _, err = t.sync(o)
+	AssertEq(nil, err)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+}
+
+func (t *integrationTest) WriteThenSync_DamagedTwiceUnnoticed() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+	b := t.flipUploads(2)
+	b.unchecked = true
+
+	// Overwrite the first byte.
+	_, err = t.mc.WriteAt(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// The damaged contents are written both times, and noticed only
+	// afterward. Sync should give up and delete them.
+	_, _, err = t.sync(o)
+
+	ExpectThat(err, Error(HasSubstr("CRC32C")))
+	ExpectEq(2, b.creates)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *integrationTest) AppendThenSync_DamagedTwice() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+	b := t.flipUploads(2)
+
+	// Append some data.
+	_, err = t.mc.WriteAt(t.ctx, []byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	// Sync should give up without composing anything onto the object.
+	_, _, err = t.sync(o)
+
+	ExpectThat(err, Error(HasSubstr("CRC32C")))
+	ExpectEq(2, b.creates)
+	ExpectEq(o.Generation, t.objectGeneration("foo"))
+
+	// Nor should any temporary objects be left behind.
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(objects))
+	ExpectEq("foo", objects[0].Name)
+}
+
+func (t *integrationTest) TempObjectNameCollision() {
+	// Another mount's temporary object, destined for the same object.
+	foreignName := tmpObjectPrefix + "foreign"
+	foreign, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     foreignName,
+			Contents: strings.NewReader("enchilada"),
+			Metadata: map[string]string{
+				gcsproxy.TmpTargetMetadataKey:  "foo",
+				gcsproxy.TmpMountIDMetadataKey: "some-other-mount",
+			},
+		})
+
+	AssertEq(nil, err)
+
+	// Create and append to the object.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+	_, err = t.mc.WriteAt(t.ctx, []byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	// Syncing with a syncer that collides on the temporary object's name should
+	// fail, without claiming that the source was clobbered.
+	syncer := gcsproxy.NewObjectSyncer(
+		0,
+		0,
+		tmpObjectPrefix,
+		&collidingBucket{Bucket: t.bucket, tmpName: foreignName})
+
+	_, _, err = syncer.SyncObject(t.ctx, o, t.mc)
+	ExpectThat(err, Error(HasSubstr("CreateObject")))
+
+	_, isPrecondErr := err.(*gcs.PreconditionError)
+	ExpectFalse(isPrecondErr)
+
+	// Neither object should have been touched.
+	ExpectEq(o.Generation, t.objectGeneration("foo"))
+	ExpectEq(foreign.Generation, t.objectGeneration(foreignName))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, foreignName)
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+
+	// Our contents should still be intact, so that a later sync can succeed.
+	_, newObj, err := t.sync(o)
+	AssertEq(nil, err)
+	AssertNe(nil, newObj)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *integrationTest) TempObjectReplaced() {
+	// Create and append to the object.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+	_, err = t.mc.WriteAt(t.ctx, []byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	// Syncing should notice that the temporary object read back from the bucket
+	// isn't ours, and refuse to compose it.
+	syncer := gcsproxy.NewObjectSyncer(
+		0,
+		0,
+		tmpObjectPrefix,
+		&replacingBucket{Bucket: t.bucket})
+
+	_, _, err = syncer.SyncObject(t.ctx, o, t.mc)
+	ExpectThat(err, Error(HasSubstr("Unexpected temporary object")))
+
+	// The object should not have been touched.
+	ExpectEq(o.Generation, t.objectGeneration("foo"))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *integrationTest) TruncateThenSync() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -310,7 +694,96 @@ func (t *IntegrationTest) TruncateThenSync() {
 	ExpectEq("ta", string(contents))
 }
 
-func (t *IntegrationTest) Stat_InitialState() {
+func (t *integrationTest) TruncateToZeroWithoutFetching() {
+	// Create an object to obtain a record, then delete it.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: o.Name})
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	// Truncating to zero shouldn't need the original contents.
+	err = t.mc.Truncate(t.ctx, 0)
+	AssertEq(nil, err)
+
+	// Write and read back.
+	_, err = t.mc.WriteAt(t.ctx, []byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 1024)
+	n, err := t.mc.ReadAt(t.ctx, buf, 0)
+
+	AssertThat(err, AnyOf(io.EOF, nil))
+	ExpectEq("burrito", string(buf[:n]))
+
+	// Stat.
+	sr, err := t.mc.Stat(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq(len("burrito"), sr.Size)
+	ExpectEq(0, sr.DirtyThreshold)
+}
+
+func (t *integrationTest) TruncateToZeroThenSync() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	// Truncate to zero, then write.
+	err = t.mc.Truncate(t.ctx, 0)
+	AssertEq(nil, err)
+
+	_, err = t.mc.WriteAt(t.ctx, []byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	// Sync should save out the new generation.
+	rl, newObj, err := t.sync(o)
+	AssertEq(nil, err)
+
+	ExpectNe(o.Generation, newObj.Generation)
+	ExpectEq(t.objectGeneration("foo"), newObj.Generation)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// Read via the lease.
+	_, err = rl.Seek(0, 0)
+	AssertEq(nil, err)
+
+	contents, err = ioutil.ReadAll(rl)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *integrationTest) TruncateToZeroThenSync_Empty() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	// Truncate to zero.
+	err = t.mc.Truncate(t.ctx, 0)
+	AssertEq(nil, err)
+
+	// Sync should save out an empty new generation.
+	_, newObj, err := t.sync(o)
+	AssertEq(nil, err)
+
+	ExpectNe(o.Generation, newObj.Generation)
+	ExpectEq(0, newObj.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
+}
+
+func (t *integrationTest) Stat_InitialState() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -326,7 +799,7 @@ func (t *IntegrationTest) Stat_InitialState() {
 	ExpectEq(nil, sr.Mtime)
 }
 
-func (t *IntegrationTest) Stat_Dirty() {
+func (t *integrationTest) Stat_Dirty() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -351,7 +824,104 @@ func (t *IntegrationTest) Stat_Dirty() {
 	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(truncateTime)))
 }
 
-func (t *IntegrationTest) WithinLeaserLimit() {
+func (t *integrationTest) Stat_Appended() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	// Append.
+	_, err = t.mc.WriteAt(t.ctx, []byte("s"), 4)
+	AssertEq(nil, err)
+
+	// Stat. Only the new byte is dirty.
+	sr, err := t.mc.Stat(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq(5, sr.Size)
+	ExpectEq(4, sr.DirtyThreshold)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{{Start: 4, Limit: 5}}))
+}
+
+func (t *integrationTest) AppendWithoutFetching() {
+	// Create an object to obtain a record, then delete it.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: o.Name})
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	// Appending shouldn't need the original contents.
+	_, err = t.mc.WriteAt(t.ctx, []byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	sr, err := t.mc.Stat(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), sr.Size)
+
+	// Nor should reading back what was appended.
+	buf := make([]byte, len("burrito"))
+	n, err := t.mc.ReadAt(t.ctx, buf, 4)
+
+	AssertThat(err, AnyOf(io.EOF, nil))
+	ExpectEq("burrito", string(buf[:n]))
+
+	// Reading the rest should fault in the contents, which fails.
+	_, err = t.mc.ReadAt(t.ctx, make([]byte, 1), 0)
+	ExpectThat(err, Error(HasSubstr("not found")))
+}
+
+func (t *integrationTest) AppendThenOverwrite() {
+	// Create.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	// Append, then modify the original contents.
+	_, err = t.mc.WriteAt(t.ctx, []byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	_, err = t.mc.WriteAt(t.ctx, []byte("T"), 0)
+	AssertEq(nil, err)
+
+	// Stat.
+	sr, err := t.mc.Stat(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectEq(len("Tacoburrito"), sr.Size)
+	ExpectEq(0, sr.DirtyThreshold)
+
+	// Read back.
+	buf := make([]byte, 1024)
+	n, err := t.mc.ReadAt(t.ctx, buf, 0)
+
+	AssertThat(err, AnyOf(io.EOF, nil))
+	ExpectEq("Tacoburrito", string(buf[:n]))
+
+	// Sync. Everything is now local, so we should get a read lease.
+	rl, _, err := t.sync(o)
+	AssertEq(nil, err)
+	AssertNe(nil, rl)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("Tacoburrito", string(contents))
+
+	_, err = rl.Seek(0, 0)
+	AssertEq(nil, err)
+
+	contents, err = ioutil.ReadAll(rl)
+	AssertEq(nil, err)
+	ExpectEq("Tacoburrito", string(contents))
+}
+
+func (t *integrationTest) WithinLeaserLimit() {
 	AssertLt(len("taco"), fileLeaserLimitBytes)
 
 	// Create.
@@ -386,7 +956,7 @@ func (t *IntegrationTest) WithinLeaserLimit() {
 	ExpectEq("taco", string(buf[0:n]))
 }
 
-func (t *IntegrationTest) LargerThanLeaserLimit() {
+func (t *integrationTest) LargerThanLeaserLimit() {
 	AssertLt(len("taco"), fileLeaserLimitBytes)
 
 	// Create.
@@ -418,7 +988,7 @@ func (t *IntegrationTest) LargerThanLeaserLimit() {
 	ExpectThat(err, Error(HasSubstr("revoked")))
 }
 
-func (t *IntegrationTest) BackingObjectHasBeenDeleted_BeforeReading() {
+func (t *integrationTest) BackingObjectHasBeenDeleted_BeforeReading() {
 	// Create an object to obtain a record, then delete it.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -443,11 +1013,16 @@ func (t *IntegrationTest) BackingObjectHasBeenDeleted_BeforeReading() {
 	err = t.mc.Truncate(t.ctx, 10)
 	ExpectThat(err, Error(HasSubstr("not found")))
 
-	_, err = t.mc.WriteAt(t.ctx, []byte{}, 0)
+	// Writing doesn't need the contents, but reading around what was written
+	// does.
+	_, err = t.mc.WriteAt(t.ctx, []byte("x"), 0)
+	AssertEq(nil, err)
+
+	_, err = t.mc.ReadAt(t.ctx, make([]byte, 2), 0)
 	ExpectThat(err, Error(HasSubstr("not found")))
 }
 
-func (t *IntegrationTest) BackingObjectHasBeenDeleted_AfterReading() {
+func (t *integrationTest) BackingObjectHasBeenDeleted_AfterReading() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -491,7 +1066,7 @@ func (t *IntegrationTest) BackingObjectHasBeenDeleted_AfterReading() {
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
 
-func (t *IntegrationTest) BackingObjectHasBeenOverwritten_BeforeReading() {
+func (t *integrationTest) BackingObjectHasBeenOverwritten_BeforeReading() {
 	// Create an object, then create the mutable object wrapper around it.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -516,11 +1091,16 @@ func (t *IntegrationTest) BackingObjectHasBeenOverwritten_BeforeReading() {
 	err = t.mc.Truncate(t.ctx, 10)
 	ExpectThat(err, Error(HasSubstr("not found")))
 
-	_, err = t.mc.WriteAt(t.ctx, []byte{}, 0)
+	// Writing doesn't need the contents, but reading around what was written
+	// does.
+	_, err = t.mc.WriteAt(t.ctx, []byte("x"), 0)
+	AssertEq(nil, err)
+
+	_, err = t.mc.ReadAt(t.ctx, make([]byte, 2), 0)
 	ExpectThat(err, Error(HasSubstr("not found")))
 }
 
-func (t *IntegrationTest) BackingObjectHasBeenOverwritten_AfterReading() {
+func (t *integrationTest) BackingObjectHasBeenOverwritten_AfterReading() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
 	AssertEq(nil, err)
@@ -565,9 +1145,10 @@ func (t *IntegrationTest) BackingObjectHasBeenOverwritten_AfterReading() {
 	ExpectEq("burrito", string(contents))
 }
 
-func (t *IntegrationTest) MultipleInteractions() {
+func (t *integrationTest) MultipleInteractions() {
 	// We will run through the script below for multiple interesting object
 	// sizes.
+	chunkSize := t.chunkSize
 	sizes := []int{
 		0,
 		1,
@@ -585,7 +1166,8 @@ func (t *IntegrationTest) MultipleInteractions() {
 		((fileLeaserLimitBytes / chunkSize) + 1) * chunkSize,
 	}
 
-	// Generate random contents for the maximum size.
+	// Generate random contents for the maximum size, rounded up to suit
+	// randBytes.
 	var maxSize int
 	for _, size := range sizes {
 		if size > maxSize {
@@ -593,11 +1175,17 @@ func (t *IntegrationTest) MultipleInteractions() {
 		}
 	}
 
-	randData := randBytes(maxSize)
+	randData := randBytes((maxSize + 3) &^ 3)
 
 	// Transition the mutable object in and out of the dirty state. Make sure
 	// everything stays consistent.
 	for i, size := range sizes {
+		// Chunks larger than the leaser limit make some of the sizes above
+		// negative.
+		if size < 0 {
+			continue
+		}
+
 		desc := fmt.Sprintf("test case %d (size %d)", i, size)
 		name := fmt.Sprintf("obj_%d", i)
 		buf := make([]byte, size)
@@ -694,3 +1282,253 @@ func (t *IntegrationTest) MultipleInteractions() {
 		}
 	}
 }
+
+////////////////////////////////////////////////////////////////////////
+// Chunk sizes
+////////////////////////////////////////////////////////////////////////
+
+// Chunks that don't divide the leaser limit evenly.
+type IntegrationTest struct {
+	integrationTest
+}
+
+var _ SetUpInterface = &IntegrationTest{}
+var _ TearDownInterface = &IntegrationTest{}
+
+func init() { RegisterTestSuite(&IntegrationTest{}) }
+
+func (t *IntegrationTest) SetUp(ti *TestInfo) {
+	t.chunkSize = 1<<18 + 3
+	t.integrationTest.SetUp(ti)
+}
+
+func (t *IntegrationTest) WriteFetchesOnlyChunksRead() {
+	// Create an object spanning three chunks, watching what is read from it.
+	contents := randBytes(4 * ((3*t.chunkSize + 3) / 4))
+	contents = contents[:3*t.chunkSize]
+
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", string(contents))
+	AssertEq(nil, err)
+
+	recorder := &readRecordingBucket{Bucket: t.bucket}
+	t.bucket = recorder
+	t.create(o)
+
+	// Patch a few bytes in the middle chunk. This shouldn't read anything.
+	offset := int64(t.chunkSize + 100)
+	_, err = t.mc.WriteAt(t.ctx, []byte("taco"), offset)
+	AssertEq(nil, err)
+
+	copy(contents[offset:], "taco")
+	ExpectEq(0, len(recorder.reqs))
+
+	// Reading around the patch should fetch only the middle chunk.
+	buf := make([]byte, 20)
+	n, err := t.mc.ReadAt(t.ctx, buf, offset-8)
+
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents[offset-8:offset+12], buf[:n]))
+
+	AssertEq(1, len(recorder.reqs))
+	ExpectThat(
+		recorder.reqs[0].Range,
+		Pointee(DeepEquals(gcs.ByteRange{
+			Start: uint64(t.chunkSize),
+			Limit: uint64(2 * t.chunkSize),
+		})))
+
+	// Syncing still writes out everything.
+	_, _, err = t.sync(o)
+	AssertEq(nil, err)
+
+	actual, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(contents, actual))
+}
+
+// Small chunks, so that most objects span many of them, with readahead.
+type SmallChunkIntegrationTest struct {
+	integrationTest
+}
+
+func init() { RegisterTestSuite(&SmallChunkIntegrationTest{}) }
+
+func (t *SmallChunkIntegrationTest) SetUp(ti *TestInfo) {
+	t.chunkSize = 1<<12 + 1
+	t.readaheadChunks = 2
+	t.integrationTest.SetUp(ti)
+}
+
+// Chunks larger than the leaser limit, so that all but the largest objects in
+// these tests are read whole.
+type LargeChunkIntegrationTest struct {
+	integrationTest
+}
+
+func init() { RegisterTestSuite(&LargeChunkIntegrationTest{}) }
+
+func (t *LargeChunkIntegrationTest) SetUp(ti *TestInfo) {
+	t.chunkSize = fileLeaserLimitBytes + 4
+	t.integrationTest.SetUp(ti)
+}
+
+func (t *integrationTest) ResumableUpload() {
+	// Create an object, then dirty it and make it much larger.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	expected := randBytes(1 << 12)
+	_, err = t.mc.WriteAt(t.ctx, expected, 0)
+	AssertEq(nil, err)
+
+	// Sync with a syncer that uploads in pieces of 256 bytes, and a bucket that
+	// fails part way through the fifth piece.
+	bucket := &interruptingBucket{Bucket: t.bucket, failAfter: 4}
+	syncer := gcsproxy.NewObjectSyncer(
+		0,
+		1<<10,
+		tmpObjectPrefix,
+		bucket)
+
+	_, _, err = syncer.SyncObject(t.ctx, o, t.mc)
+	ExpectThat(err, Error(HasSubstr("connection reset by peer")))
+
+	_, isPrecondErr := err.(*gcs.PreconditionError)
+	ExpectFalse(isPrecondErr)
+	ExpectEq(o.Generation, t.objectGeneration("foo"))
+
+	// Trying again should pick up after the pieces already uploaded.
+	bucket.uploaded = 0
+
+	rl, newObj, err := syncer.SyncObject(t.ctx, o, t.mc)
+	AssertEq(nil, err)
+	t.mc = nil
+
+	ExpectEq(len(expected)-4*256, bucket.uploaded)
+	ExpectEq(newObj.Generation, t.objectGeneration("foo"))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, contents))
+
+	_, err = rl.Seek(0, 0)
+	AssertEq(nil, err)
+
+	contents, err = ioutil.ReadAll(rl)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, contents))
+
+	// There should be no temporary objects left over.
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(objects))
+	ExpectEq("foo", objects[0].Name)
+}
+
+func (t *integrationTest) ResumableUpload_DamagedPiece() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	expected := randBytes(1 << 12)
+	_, err = t.mc.WriteAt(t.ctx, expected, 0)
+	AssertEq(nil, err)
+
+	// Sync with a syncer that uploads in pieces of 256 bytes, and a bucket that
+	// damages the first. GCS refuses it, and the upload is tried again.
+	bucket := &flippingBucket{Bucket: t.bucket, flips: 1}
+	syncer := gcsproxy.NewObjectSyncer(
+		0,
+		1<<10,
+		tmpObjectPrefix,
+		bucket)
+
+	_, newObj, err := syncer.SyncObject(t.ctx, o, t.mc)
+	AssertEq(nil, err)
+	t.mc = nil
+
+	ExpectEq(1+len(expected)/256, bucket.creates)
+	ExpectEq(newObj.Generation, t.objectGeneration("foo"))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, contents))
+}
+
+func (t *integrationTest) ResumableUpload_DamagedComposition() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	expected := randBytes(1 << 12)
+	_, err = t.mc.WriteAt(t.ctx, expected, 0)
+	AssertEq(nil, err)
+
+	// Compose the final object wrongly the first time. That should be noticed,
+	// and the damaged generation replaced.
+	bucket := &reorderingBucket{Bucket: t.bucket, dst: "foo", reorders: 1}
+	syncer := gcsproxy.NewObjectSyncer(
+		0,
+		1<<10,
+		tmpObjectPrefix,
+		bucket)
+
+	_, newObj, err := syncer.SyncObject(t.ctx, o, t.mc)
+	AssertEq(nil, err)
+	t.mc = nil
+
+	ExpectEq(newObj.Generation, t.objectGeneration("foo"))
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, contents))
+}
+
+func (t *integrationTest) ResumableUpload_Clobbered() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.create(o)
+
+	_, err = t.mc.WriteAt(t.ctx, randBytes(1<<12), 0)
+	AssertEq(nil, err)
+
+	// Fail part way through.
+	bucket := &interruptingBucket{Bucket: t.bucket, failAfter: 4}
+	syncer := gcsproxy.NewObjectSyncer(
+		0,
+		1<<10,
+		tmpObjectPrefix,
+		bucket)
+
+	_, _, err = syncer.SyncObject(t.ctx, o, t.mc)
+	AssertNe(nil, err)
+
+	// Clobber the object before trying again.
+	clobbered, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	_, _, err = syncer.SyncObject(t.ctx, o, t.mc)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	// The clobbering object should be untouched, and the temporary objects
+	// cleaned up.
+	ExpectEq(clobbered.Generation, t.objectGeneration("foo"))
+
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(objects))
+	ExpectEq("foo", objects[0].Name)
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// GCS object names can't contain line feeds, so a tag can be split
+// unambiguously at the last one.
+const leaseTagSeparator = "\n"
+
+// Return the tag given to leases holding contents of the supplied object
+// generation, or derived from them. See lease.FileLeaser.RevokeReadLeasesMatching.
+func LeaseTag(name string, generation int64) (tag string) {
+	tag = name + leaseTagSeparator + strconv.FormatInt(generation, 10)
+	return
+}
+
+// Undo LeaseTag. ok is false if the tag wasn't returned by it.
+func ParseLeaseTag(tag string) (name string, generation int64, ok bool) {
+	i := strings.LastIndex(tag, leaseTagSeparator)
+	if i < 0 {
+		return
+	}
+
+	generation, err := strconv.ParseInt(tag[i+len(leaseTagSeparator):], 10, 64)
+	if err != nil {
+		return
+	}
+
+	name = tag[:i]
+	ok = true
+	return
+}
+
+// Return a predicate for lease.FileLeaser.RevokeReadLeasesMatching that
+// matches the leases for generations of the named object older than the
+// supplied one.
+func GenerationsBefore(
+	name string,
+	generation int64) (match func(tag string) bool) {
+	match = func(tag string) bool {
+		n, g, ok := ParseLeaseTag(tag)
+		return ok && n == name && g < generation
+	}
+
+	return
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestLeaseTags(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LeaseTagsTest struct {
+}
+
+func init() { RegisterTestSuite(&LeaseTagsTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LeaseTagsTest) RoundTrip() {
+	names := []string{
+		"foo",
+		"foo/bar",
+		"foo 17",
+		"",
+	}
+
+	for _, name := range names {
+		tag := gcsproxy.LeaseTag(name, 17)
+
+		n, g, ok := gcsproxy.ParseLeaseTag(tag)
+		AssertTrue(ok, "name: %q", name)
+		ExpectEq(name, n)
+		ExpectEq(17, g)
+	}
+}
+
+func (t *LeaseTagsTest) ForeignTags() {
+	tags := []string{
+		"",
+		"foo",
+		"foo\n",
+		"foo\ntaco",
+	}
+
+	for _, tag := range tags {
+		_, _, ok := gcsproxy.ParseLeaseTag(tag)
+		ExpectFalse(ok, "tag: %q", tag)
+	}
+}
+
+func (t *LeaseTagsTest) GenerationsBefore() {
+	match := gcsproxy.GenerationsBefore("foo", 17)
+
+	ExpectTrue(match(gcsproxy.LeaseTag("foo", 1)))
+	ExpectTrue(match(gcsproxy.LeaseTag("foo", 16)))
+	ExpectFalse(match(gcsproxy.LeaseTag("foo", 17)))
+	ExpectFalse(match(gcsproxy.LeaseTag("foo", 18)))
+
+	// Other objects, even those whose names the object's is a prefix of, don't
+	// match.
+	ExpectFalse(match(gcsproxy.LeaseTag("foo/bar", 1)))
+	ExpectFalse(match(gcsproxy.LeaseTag("fo", 1)))
+	ExpectFalse(match(gcsproxy.LeaseTag("foo\n1", 1)))
+	ExpectFalse(match("foo"))
+}
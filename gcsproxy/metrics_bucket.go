@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that records the count, errors, and latency of each
+// request sent to the wrapped bucket, and the bytes of object contents read
+// and written, in the supplied registry.
+func NewMetricsBucket(
+	clock timeutil.Clock,
+	registry *metrics.Registry,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	mb := &metricsBucket{
+		clock:   clock,
+		wrapped: wrapped,
+		methods: make(map[string]*methodMetrics),
+
+		bytesRead: registry.Counter(
+			"gcsfuse_gcs_bytes_read_total",
+			"Bytes of object contents read from GCS."),
+
+		bytesWritten: registry.Counter(
+			"gcsfuse_gcs_bytes_written_total",
+			"Bytes of object contents written to GCS."),
+	}
+
+	for m := range opClasses {
+		mb.methods[m] = &methodMetrics{
+			count: registry.Counter(
+				"gcsfuse_gcs_requests_total",
+				"Requests sent to GCS, by bucket method.",
+				"method", m),
+
+			errors: registry.Counter(
+				"gcsfuse_gcs_request_errors_total",
+				"Requests to GCS that failed, by bucket method.",
+				"method", m),
+
+			latency: registry.Histogram(
+				"gcsfuse_gcs_request_latency_seconds",
+				"Time taken for GCS to respond, by bucket method.",
+				metrics.LatencyBuckets,
+				"method", m),
+		}
+	}
+
+	b = mb
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+// Metrics for a single gcs.Bucket method.
+type methodMetrics struct {
+	count   *metrics.Counter
+	errors  *metrics.Counter
+	latency *metrics.Histogram
+}
+
+type metricsBucket struct {
+	clock   timeutil.Clock
+	wrapped gcs.Bucket
+
+	// Metrics for each method in opClasses. Not modified after creation.
+	methods map[string]*methodMetrics
+
+	bytesRead    *metrics.Counter
+	bytesWritten *metrics.Counter
+}
+
+// Record a request that started at the given time and returned *err. For use
+// with defer.
+func (b *metricsBucket) record(
+	method string,
+	start time.Time,
+	err *error) {
+	m := b.methods[method]
+	m.count.Inc()
+	if *err != nil {
+		m.errors.Inc()
+	}
+
+	m.latency.Observe(b.clock.Now().Sub(start).Seconds())
+}
+
+// An io.Reader that adds the number of bytes read to a counter.
+type metricsReader struct {
+	wrapped io.Reader
+	counter *metrics.Counter
+}
+
+func (r *metricsReader) Read(p []byte) (n int, err error) {
+	n, err = r.wrapped.Read(p)
+	r.counter.Add(uint64(n))
+	return
+}
+
+type metricsReadCloser struct {
+	metricsReader
+	io.Closer
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *metricsBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+// The latency recorded is the time taken to start reading, not to read the
+// whole object.
+func (b *metricsBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	defer b.record("NewReader", b.clock.Now(), &err)
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc = &metricsReadCloser{
+		metricsReader: metricsReader{wrapped: rc, counter: b.bytesRead},
+		Closer:        rc,
+	}
+
+	return
+}
+
+func (b *metricsBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	defer b.record("CreateObject", b.clock.Now(), &err)
+
+	// Count the contents as they are consumed, without modifying the caller's
+	// request.
+	counted := *req
+	counted.Contents = &metricsReader{
+		wrapped: req.Contents,
+		counter: b.bytesWritten,
+	}
+
+	o, err = b.wrapped.CreateObject(ctx, &counted)
+	return
+}
+
+func (b *metricsBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	defer b.record("CopyObject", b.clock.Now(), &err)
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *metricsBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	defer b.record("ComposeObjects", b.clock.Now(), &err)
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *metricsBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	defer b.record("StatObject", b.clock.Now(), &err)
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *metricsBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	defer b.record("ListObjects", b.clock.Now(), &err)
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *metricsBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	defer b.record("UpdateObject", b.clock.Now(), &err)
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *metricsBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	defer b.record("DeleteObject", b.clock.Now(), &err)
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestMetricsBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MetricsBucketTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	registry *metrics.Registry
+	bucket   gcs.Bucket
+}
+
+var _ SetUpInterface = &MetricsBucketTest{}
+
+func init() { RegisterTestSuite(&MetricsBucketTest{}) }
+
+func (t *MetricsBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.registry = metrics.NewRegistry()
+	t.bucket = gcsproxy.NewMetricsBucket(
+		&t.clock,
+		t.registry,
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+}
+
+func (t *MetricsBucketTest) requests(method string) uint64 {
+	return t.registry.Counter(
+		"gcsfuse_gcs_requests_total",
+		"",
+		"method", method).Value()
+}
+
+func (t *MetricsBucketTest) errors(method string) uint64 {
+	return t.registry.Counter(
+		"gcsfuse_gcs_request_errors_total",
+		"",
+		"method", method).Value()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MetricsBucketTest) CountsAndErrors() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	AssertNe(nil, err)
+
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	ExpectEq(1, t.requests("CreateObject"))
+	ExpectEq(2, t.requests("StatObject"))
+	ExpectEq(1, t.requests("ListObjects"))
+	ExpectEq(0, t.requests("NewReader"))
+
+	ExpectEq(0, t.errors("CreateObject"))
+	ExpectEq(1, t.errors("StatObject"))
+}
+
+func (t *MetricsBucketTest) Bytes() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:  "foo",
+			Range: &gcs.ByteRange{Start: 1, Limit: 3},
+		})
+
+	AssertEq(nil, err)
+	_, err = ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+	rc.Close()
+
+	written := t.registry.Counter("gcsfuse_gcs_bytes_written_total", "")
+	read := t.registry.Counter("gcsfuse_gcs_bytes_read_total", "")
+
+	ExpectEq(4, written.Value())
+	ExpectEq(6, read.Value())
+	ExpectEq(2, t.requests("NewReader"))
+}
+
+func (t *MetricsBucketTest) Exposition() {
+	_, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	var buf bytes.Buffer
+	AssertEq(nil, t.registry.WriteText(&buf))
+
+	ExpectThat(
+		buf.String(),
+		HasSubstr(`gcsfuse_gcs_requests_total{method="ListObjects"} 1`))
+
+	ExpectThat(
+		buf.String(),
+		HasSubstr(`gcsfuse_gcs_request_latency_seconds_count{method="ListObjects"} 1`))
+
+	ExpectThat(
+		buf.String(),
+		HasSubstr(`gcsfuse_gcs_request_latency_seconds_bucket{method="DeleteObject",le="+Inf"} 0`))
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The feature that every mask includes: what the file system needs to make
+// inodes from objects, plus the CRC32C checksum, without which package gcs
+// refuses to decode an object resource.
+const CoreObjectFields = "core"
+
+// A table of the fields of GCS object resources that each feature of the file
+// system consumes, from which a mask can be made for the JSON API's fields
+// parameter so that listings and stats return only what is needed. Fields are
+// named in that parameter's syntax, e.g. "size" or "metadata/some_key".
+//
+// Features that consume fields beyond those of CoreObjectFields must register
+// them, or they will find them missing whenever masks are in use. Safe for
+// concurrent access.
+type ObjectFieldTable struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	needs map[string][]string
+}
+
+// Create a table containing only CoreObjectFields.
+func NewObjectFieldTable() (t *ObjectFieldTable) {
+	t = &ObjectFieldTable{
+		needs: map[string][]string{
+			CoreObjectFields: {
+				"crc32c",
+				"generation",
+				"metageneration",
+				"name",
+				"size",
+				"updated",
+			},
+		},
+	}
+
+	return
+}
+
+// The table used by the file system, to which features register their needs
+// when their packages are initialized.
+var ObjectFields = NewObjectFieldTable()
+
+// Record that the named feature consumes the supplied fields, in addition to
+// any it has already registered.
+func (t *ObjectFieldTable) Register(feature string, fields ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.needs[feature] = append(t.needs[feature], fields...)
+}
+
+// Return the sorted fields needed by CoreObjectFields and the named features.
+// A whole object, like "metadata", subsumes any of its own fields, like
+// "metadata/some_key".
+func (t *ObjectFieldTable) Fields(
+	features []string) (fields []string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, feature := range append([]string{CoreObjectFields}, features...) {
+		needs, ok := t.needs[feature]
+		if !ok {
+			err = fmt.Errorf("Unknown feature: %q", feature)
+			return
+		}
+
+		for _, f := range needs {
+			wanted[f] = true
+		}
+	}
+
+	for f := range wanted {
+		if i := strings.Index(f, "/"); i >= 0 && wanted[f[:i]] {
+			continue
+		}
+
+		fields = append(fields, f)
+	}
+
+	sort.Strings(fields)
+	return
+}
+
+// Return the value of the fields parameter that asks for only the supplied
+// fields of an object resource, as when statting an object.
+func ObjectFieldMask(fields []string) string {
+	return strings.Join(fields, ",")
+}
+
+// Return the value of the fields parameter that asks for only the supplied
+// fields of each object in a listing, along with everything needed to page
+// through the listing and find its collapsed runs.
+func ListingFieldMask(fields []string) string {
+	return fmt.Sprintf(
+		"items(%s),nextPageToken,prefixes",
+		strings.Join(fields, ","))
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestObjectFields(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+var coreFields = []interface{}{
+	"crc32c",
+	"generation",
+	"metageneration",
+	"name",
+	"size",
+	"updated",
+}
+
+type ObjectFieldTableTest struct {
+	table *gcsproxy.ObjectFieldTable
+}
+
+var _ SetUpInterface = &ObjectFieldTableTest{}
+
+func init() { RegisterTestSuite(&ObjectFieldTableTest{}) }
+
+func (t *ObjectFieldTableTest) SetUp(ti *TestInfo) {
+	t.table = gcsproxy.NewObjectFieldTable()
+	t.table.Register("symlinks", "metadata/symlink_target")
+	t.table.Register("mtimes", "metadata/mtime")
+	t.table.Register("checksums", "md5Hash", "crc32c")
+	t.table.Register("renames", "contentType", "metadata")
+}
+
+func (t *ObjectFieldTableTest) fields(features ...string) []string {
+	fields, err := t.table.Fields(features)
+	AssertEq(nil, err)
+	return fields
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ObjectFieldTableTest) CoreOnly() {
+	ExpectThat(t.fields(), ElementsAre(coreFields...))
+}
+
+func (t *ObjectFieldTableTest) FeatureCombinations() {
+	testCases := []struct {
+		features []string
+		extra    []interface{}
+	}{
+		{
+			[]string{"symlinks"},
+			[]interface{}{"metadata/symlink_target"},
+		},
+
+		{
+			[]string{"mtimes", "symlinks"},
+			[]interface{}{"metadata/mtime", "metadata/symlink_target"},
+		},
+
+		// A field needed by several features appears once.
+		{
+			[]string{"checksums", "checksums"},
+			[]interface{}{"md5Hash"},
+		},
+
+		// The whole of an object subsumes its fields.
+		{
+			[]string{"mtimes", "renames", "symlinks"},
+			[]interface{}{"contentType", "metadata"},
+		},
+
+		{
+			[]string{"checksums", "mtimes", "renames", "symlinks"},
+			[]interface{}{"contentType", "md5Hash", "metadata"},
+		},
+	}
+
+	for _, tc := range testCases {
+		var expected []string
+		for _, f := range append(coreFields, tc.extra...) {
+			expected = append(expected, f.(string))
+		}
+
+		sort.Strings(expected)
+		ExpectThat(
+			t.fields(tc.features...),
+			DeepEquals(expected),
+			"Features: %v", tc.features)
+	}
+}
+
+func (t *ObjectFieldTableTest) SortedAndStable() {
+	a := t.fields("renames", "checksums")
+	b := t.fields("checksums", "renames")
+	ExpectThat(a, DeepEquals(b))
+
+	for i := 1; i < len(a); i++ {
+		ExpectLt(a[i-1], a[i])
+	}
+}
+
+func (t *ObjectFieldTableTest) RegisteringMore() {
+	t.table.Register("symlinks", "contentType")
+	ExpectThat(
+		t.fields("symlinks"),
+		Contains("contentType"))
+
+	ExpectThat(
+		t.fields("symlinks"),
+		Contains("metadata/symlink_target"))
+}
+
+func (t *ObjectFieldTableTest) UnknownFeature() {
+	_, err := t.table.Fields([]string{"symlinks", "taco"})
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *ObjectFieldTableTest) Masks() {
+	fields := []string{"metadata/mtime", "name", "size"}
+
+	ExpectEq(
+		"metadata/mtime,name,size",
+		gcsproxy.ObjectFieldMask(fields))
+
+	ExpectEq(
+		"items(metadata/mtime,name,size),nextPageToken,prefixes",
+		gcsproxy.ListingFieldMask(fields))
+}
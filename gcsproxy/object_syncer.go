@@ -15,12 +15,20 @@
 package gcsproxy
 
 import (
+	"crypto/md5"
+	"crypto/rand"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/lease"
+	"github.com/googlecloudplatform/gcsfuse/logger"
 	"github.com/googlecloudplatform/gcsfuse/mutable"
 	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
 )
 
@@ -34,7 +42,17 @@ type ObjectSyncer interface {
 	//
 	// *   Otherwise, write out a new generation in the bucket (failing with
 	//     *gcs.PreconditionError if the source generation is no longer current)
-	//     and return a read lease for that object's contents.
+	//     and return a read lease for that object's contents, or a nil read
+	//     lease if the content had only been appended to and so doesn't hold
+	//     them all. The content's modification time is recorded in the new
+	//     generation's metadata under MtimeMetadataKey.
+	//
+	// The new generation is encrypted with the source object's Cloud KMS key,
+	// if any. Content derived from an object encrypted with a customer-supplied
+	// key can't be written out, and *EncryptionError is returned. So it is if
+	// the new generation turns out to have some other key; in that case the
+	// sync has otherwise succeeded, and the read lease and new object are
+	// returned along with the error.
 	//
 	// In the second case, the mutable.Content is destroyed. Otherwise, including
 	// when this function fails, it is guaranteed to still be valid.
@@ -42,6 +60,80 @@ type ObjectSyncer interface {
 		ctx context.Context,
 		srcObject *gcs.Object,
 		content mutable.Content) (rl lease.ReadLease, o *gcs.Object, err error)
+
+	// Like SyncObject, but always write out a new generation containing the
+	// full content, whether or not it has been modified and regardless of the
+	// append optimization. The result is a single-component object, which
+	// unlike a composite object has an MD5 hash. If the content had not been
+	// modified, the source object's modification time is kept.
+	//
+	// If the content had not been modified, the returned read lease is nil. On
+	// success the mutable.Content is destroyed in either case.
+	FlattenObject(
+		ctx context.Context,
+		srcObject *gcs.Object,
+		content mutable.Content) (rl lease.ReadLease, o *gcs.Object, err error)
+
+	// Report what SyncObject (or FlattenObject, if flatten is set) would do
+	// given the same arguments, without doing it. Neither the content nor the
+	// bucket is modified, so this is suitable for introspection and testing.
+	PlanSync(
+		ctx context.Context,
+		srcObject *gcs.Object,
+		content mutable.Content,
+		flatten bool) (plan SyncPlan, err error)
+}
+
+// The ways in which an object syncer may write out content.
+type SyncStrategy string
+
+const (
+	// The content is unmodified, and nothing need be written.
+	SyncStrategyNone SyncStrategy = "none"
+
+	// The content has only been appended to. The new bytes are written to a
+	// temporary object that is then composed onto the source object.
+	SyncStrategyAppend SyncStrategy = "append"
+
+	// The full content is written out as a new generation.
+	SyncStrategyRewrite SyncStrategy = "rewrite"
+
+	// Like SyncStrategyRewrite, but the content is large enough that it is
+	// uploaded in pieces, such that a failed sync can be resumed by a later one.
+	SyncStrategyResumable SyncStrategy = "resumable"
+
+	// The full content is written out as a new single-component generation,
+	// because FlattenObject was called, whether or not it has been modified.
+	SyncStrategyFlatten SyncStrategy = "flatten"
+)
+
+// The feature under which the object fields that the append strategy needs
+// are registered with ObjectFields. Without the component count of the source
+// object, we can't tell whether composing onto it is allowed.
+const AppendObjectFields = "appends"
+
+func init() {
+	ObjectFields.Register(AppendObjectFields, "componentCount")
+}
+
+// A description of the work that syncing some content would involve.
+type SyncPlan struct {
+	Strategy SyncStrategy
+
+	// The number of bytes of content that would be uploaded.
+	UploadBytes int64
+
+	// The generation that the object must still have in GCS for the write to
+	// succeed, or zero if nothing would be written.
+	GenerationPrecondition int64
+}
+
+func (p SyncPlan) String() string {
+	return fmt.Sprintf(
+		"strategy=%s upload_bytes=%d if_generation_match=%d",
+		p.Strategy,
+		p.UploadBytes,
+		p.GenerationPrecondition)
 }
 
 // Create an object syncer that syncs into the supplied bucket.
@@ -50,11 +142,18 @@ type ObjectSyncer interface {
 // object's size is at least appendThreshold, we will "append" to it by writing
 // out a temporary blob and composing it with the source object.
 //
-// Temporary blobs have names beginning with tmpObjectPrefix. We make an effort
-// to delete them, but if we are interrupted for some reason we may not be able
-// to do so. Therefore the user should arrange for garbage collection.
+// Temporary blobs have names beginning with tmpObjectPrefix, followed by a
+// random ID for this syncer, and carry metadata under the Tmp*MetadataKey
+// keys. We make an effort to delete them, but if we are interrupted for some
+// reason we may not be able to do so. Therefore the user should arrange for
+// garbage collection.
+//
+// When the content must be rewritten and is at least resumableThreshold bytes
+// long, it is uploaded resumably; see newResumableObjectCreator. Zero disables
+// this.
 func NewObjectSyncer(
 	appendThreshold int64,
+	resumableThreshold int64,
 	tmpObjectPrefix string,
 	bucket gcs.Bucket) (os ObjectSyncer) {
 	// Create the object creators.
@@ -62,12 +161,34 @@ func NewObjectSyncer(
 		bucket: bucket,
 	}
 
+	mountID, err := newMountID(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("newMountID: %v", err))
+	}
+
 	appendCreator := newAppendObjectCreator(
 		tmpObjectPrefix,
+		mountID,
+		timeutil.RealClock(),
+		rand.Reader,
+		bucket)
+
+	resumableCreator := newResumableObjectCreator(
+		resumableThreshold,
+		tmpObjectPrefix,
+		mountID,
+		timeutil.RealClock(),
+		rand.Reader,
 		bucket)
 
 	// And the object syncer.
-	os = newObjectSyncer(appendThreshold, fullCreator, appendCreator)
+	os = newObjectSyncer(
+		appendThreshold,
+		resumableThreshold,
+		fullCreator,
+		appendCreator,
+		resumableCreator,
+		bucket)
 
 	return
 }
@@ -83,17 +204,25 @@ type fullObjectCreator struct {
 func (oc *fullObjectCreator) Create(
 	ctx context.Context,
 	srcObject *gcs.Object,
-	r io.Reader) (o *gcs.Object, err error) {
+	metadata map[string]string,
+	r io.Reader,
+	sums *uploadChecksums) (o *gcs.Object, err error) {
 	req := &gcs.CreateObjectRequest{
 		Name: srcObject.Name,
 		GenerationPrecondition: &srcObject.Generation,
+		Metadata:               metadata,
 		Contents:               r,
+		CRC32C:                 &sums.CRC32C,
+		MD5:                    &sums.MD5,
+		KmsKeyName:             KmsKeyName(srcObject),
 	}
 
 	o, err = oc.bucket.CreateObject(ctx, req)
 	if err != nil {
-		// Don't mangle precondition errors.
-		if _, ok := err.(*gcs.PreconditionError); ok {
+		// Don't mangle precondition errors, nor the checksum errors that
+		// createChecked retries.
+		switch err.(type) {
+		case *gcs.PreconditionError, *gcs.ChecksumMismatchError:
 			return
 		}
 
@@ -101,6 +230,7 @@ func (oc *fullObjectCreator) Create(
 		return
 	}
 
+	err = sums.check(o, true)
 	return
 }
 
@@ -110,11 +240,19 @@ func (oc *fullObjectCreator) Create(
 
 // An implementation detail of objectSyncer. See notes on
 // newObjectSyncer.
+//
+// The checksums are those of the contents of r, and are sent along with them
+// so that GCS refuses them if they are damaged on the way. If the object
+// created doesn't have them, Create fails with an *uploadChecksumError.
+//
+// The object created has the supplied custom metadata.
 type objectCreator interface {
 	Create(
 		ctx context.Context,
 		srcObject *gcs.Object,
-		r io.Reader) (o *gcs.Object, err error)
+		metadata map[string]string,
+		r io.Reader,
+		sums *uploadChecksums) (o *gcs.Object, err error)
 }
 
 // Create an object syncer that stats the mutable content to see if it's dirty
@@ -130,23 +268,39 @@ type objectCreator interface {
 // worthwhile to make the append optimization. It should be set to a value on
 // the order of the bandwidth to GCS times three times the round trip latency
 // to GCS (for a small create, a compose, and a delete).
+//
+// Content that would otherwise go to fullCreator is instead given to
+// resumableCreator when it is at least resumableThreshold bytes long, unless
+// that is zero.
+//
+// bucket is used to delete generations that the creators leave holding
+// damaged contents; see uploadChecked.
 func newObjectSyncer(
 	appendThreshold int64,
+	resumableThreshold int64,
 	fullCreator objectCreator,
-	appendCreator objectCreator) (os ObjectSyncer) {
+	appendCreator objectCreator,
+	resumableCreator resumableObjectCreator,
+	bucket gcs.Bucket) (os ObjectSyncer) {
 	os = &objectSyncer{
-		appendThreshold: appendThreshold,
-		fullCreator:     fullCreator,
-		appendCreator:   appendCreator,
+		appendThreshold:    appendThreshold,
+		resumableThreshold: resumableThreshold,
+		fullCreator:        fullCreator,
+		appendCreator:      appendCreator,
+		resumableCreator:   resumableCreator,
+		bucket:             bucket,
 	}
 
 	return
 }
 
 type objectSyncer struct {
-	appendThreshold int64
-	fullCreator     objectCreator
-	appendCreator   objectCreator
+	appendThreshold    int64
+	resumableThreshold int64
+	fullCreator        objectCreator
+	appendCreator      objectCreator
+	resumableCreator   resumableObjectCreator
+	bucket             gcs.Bucket
 }
 
 func (os *objectSyncer) SyncObject(
@@ -160,48 +314,119 @@ func (os *objectSyncer) SyncObject(
 		return
 	}
 
-	// Make sure the dirty threshold makes sense.
-	srcSize := int64(srcObject.Size)
-	if sr.DirtyThreshold > srcSize {
-		err = fmt.Errorf(
-			"Stat returned weird DirtyThreshold field: %d vs. %d",
-			sr.DirtyThreshold,
-			srcObject.Size)
+	// Decide what to do.
+	plan, err := planSync(
+		os.appendThreshold,
+		os.resumableThreshold,
+		srcObject,
+		sr,
+		false)
+	if err != nil {
+		return
+	}
 
+	if plan.Strategy == SyncStrategyNone {
 		return
 	}
 
-	// If the content hasn't been dirtied (i.e. it is the same size as the source
-	// object, and no bytes within the source object have been dirtied), we're
-	// done.
-	if sr.Size == srcSize && sr.DirtyThreshold == srcSize {
+	err = checkWritable(srcObject)
+	if err != nil {
 		return
 	}
 
-	// Otherwise, we need to create a new generation. If the source object is
-	// long enough, hasn't been dirtied, and has a low enough component count,
-	// then we can make the optimization of not rewriting its contents.
-	if srcSize >= os.appendThreshold &&
-		sr.DirtyThreshold == srcSize &&
-		srcObject.ComponentCount < gcs.MaxComponentCount {
-		o, err = os.appendCreator.Create(
+	metadata := syncMetadata(srcObject, sr)
+
+	switch plan.Strategy {
+	case SyncStrategyAppend:
+		warnIfSparse(ctx, srcObject.Name, content)
+		o, err = createChecked(
 			ctx,
+			os.bucket,
+			os.appendCreator,
 			srcObject,
-			&mutableContentReader{
-				Ctx:     ctx,
-				Content: content,
-				Offset:  srcSize,
-			})
-	} else {
-		o, err = os.fullCreator.Create(
+			metadata,
+			content,
+			int64(srcObject.Size))
+
+	case SyncStrategyResumable:
+		if err = fetchContent(ctx, content); err != nil {
+			return
+		}
+
+		warnIfSparse(ctx, srcObject.Name, content)
+		o, err = os.createResumable(ctx, srcObject, metadata, content, sr.Size)
+
+	default:
+		if err = fetchContent(ctx, content); err != nil {
+			return
+		}
+
+		warnIfSparse(ctx, srcObject.Name, content)
+		o, err = createChecked(
 			ctx,
+			os.bucket,
+			os.fullCreator,
 			srcObject,
-			&mutableContentReader{
-				Ctx:     ctx,
-				Content: content,
-			})
+			metadata,
+			content,
+			0)
+	}
+
+	// Deal with errors.
+	if err != nil {
+		// Special case: don't mess with precondition errors.
+		if _, ok := err.(*gcs.PreconditionError); ok {
+			return
+		}
+
+		err = fmt.Errorf("Create: %v", err)
+		return
+	}
+
+	// Yank out the contents, which now belong to the new generation. Content
+	// that was only appended to isn't held locally in full, so there is
+	// nothing worth keeping.
+	if rwl := content.Release(); rwl != nil {
+		rl = rwl.DowngradeWithTag(LeaseTag(o.Name, o.Generation))
+	} else {
+		content.Destroy()
+	}
+
+	err = checkKmsKey(srcObject, o)
+	return
+}
+
+func (os *objectSyncer) FlattenObject(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	content mutable.Content) (rl lease.ReadLease, o *gcs.Object, err error) {
+	sr, err := content.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	err = checkWritable(srcObject)
+	if err != nil {
+		return
+	}
+
+	// Write out the full contents. If the content is clean, this streams the
+	// source object's contents back through us.
+	if err = fetchContent(ctx, content); err != nil {
+		return
 	}
 
+	warnIfSparse(ctx, srcObject.Name, content)
+	o, err = createChecked(
+		ctx,
+		os.bucket,
+		os.fullCreator,
+		srcObject,
+		syncMetadata(srcObject, sr),
+		content,
+		0)
+
 	// Deal with errors.
 	if err != nil {
 		// Special case: don't mess with precondition errors.
@@ -213,18 +438,544 @@ func (os *objectSyncer) SyncObject(
 		return
 	}
 
-	// Yank out the contents.
-	rl = content.Release().Downgrade()
+	// Yank out the contents if they were dirty. Otherwise there is nothing
+	// worth keeping.
+	if rwl := content.Release(); rwl != nil {
+		rl = rwl.DowngradeWithTag(LeaseTag(o.Name, o.Generation))
+	} else {
+		content.Destroy()
+	}
+
+	err = checkKmsKey(srcObject, o)
+	return
+}
+
+func (os *objectSyncer) PlanSync(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	content mutable.Content,
+	flatten bool) (plan SyncPlan, err error) {
+	sr, err := content.Stat(ctx)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	plan, err = planSync(
+		os.appendThreshold,
+		os.resumableThreshold,
+		srcObject,
+		sr,
+		flatten)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Planning
+////////////////////////////////////////////////////////////////////////
+
+// Decide how to write out content derived from srcObject whose current state
+// is described by sr. See the notes on newObjectSyncer for the meaning of
+// appendThreshold and resumableThreshold. This is a pure function of its
+// arguments.
+func planSync(
+	appendThreshold int64,
+	resumableThreshold int64,
+	srcObject *gcs.Object,
+	sr mutable.StatResult,
+	flatten bool) (plan SyncPlan, err error) {
+	// Make sure the dirty threshold makes sense.
+	srcSize := int64(srcObject.Size)
+	if sr.DirtyThreshold > srcSize {
+		err = fmt.Errorf(
+			"Stat returned weird DirtyThreshold field: %d vs. %d",
+			sr.DirtyThreshold,
+			srcObject.Size)
+
+		return
+	}
+
+	switch {
+	// A flatten always writes everything.
+	case flatten:
+		plan.Strategy = SyncStrategyFlatten
+		plan.UploadBytes = sr.Size
+
+	// If the content hasn't been dirtied (i.e. it is the same size as the
+	// source object, and no bytes within the source object have been dirtied),
+	// there is nothing to do.
+	case sr.Size == srcSize && sourceClean(sr, srcSize):
+		plan.Strategy = SyncStrategyNone
+		return
+
+	// If the source object is long enough, hasn't been dirtied, and has a low
+	// enough component count, then we can make the optimization of not
+	// rewriting its contents.
+	case srcSize >= appendThreshold &&
+		sourceClean(sr, srcSize) &&
+		srcObject.ComponentCount < gcs.MaxComponentCount:
+		plan.Strategy = SyncStrategyAppend
+		plan.UploadBytes = sr.Size - srcSize
+
+	// Large enough content is worth uploading in a way that survives failures.
+	case resumableThreshold > 0 && sr.Size >= resumableThreshold:
+		plan.Strategy = SyncStrategyResumable
+		plan.UploadBytes = sr.Size
+
+	default:
+		plan.Strategy = SyncStrategyRewrite
+		plan.UploadBytes = sr.Size
+	}
+
+	// Every write is preconditioned on the source generation.
+	plan.GenerationPrecondition = srcObject.Generation
+
+	return
+}
+
+// Return true if content whose state is described by sr still holds all of the
+// first srcSize bytes of the source object unmodified, so that anything dirty
+// lies beyond it.
+func sourceClean(sr mutable.StatResult, srcSize int64) bool {
+	if sr.DirtyThreshold < srcSize {
+		return false
+	}
+
+	for _, r := range sr.DirtyRanges {
+		if r.Start < srcSize {
+			return false
+		}
+	}
+
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Metadata
+////////////////////////////////////////////////////////////////////////
+
+// The object metadata key under which the syncer records the modification
+// time of the content it writes out, formatted with FormatMtime.
+const MtimeMetadataKey = "gcsfuse_mtime"
+
+// Format a modification time for MtimeMetadataKey, in RFC 3339 format with
+// nanoseconds.
+func FormatMtime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Return the custom metadata with which to write out content derived from
+// srcObject whose state is described by sr: the source object's own, such as
+// keys set through extended attributes, along with the content's modification
+// time. Content that hasn't been modified keeps the source object's
+// modification time: the one in its metadata if any, or else its update time.
+// Keys describing temporary objects are dropped.
+func syncMetadata(
+	srcObject *gcs.Object,
+	sr mutable.StatResult) (m map[string]string) {
+	var value string
+	switch {
+	case sr.Mtime != nil:
+		value = FormatMtime(*sr.Mtime)
+
+	case srcObject.Metadata[MtimeMetadataKey] != "":
+		value = srcObject.Metadata[MtimeMetadataKey]
+
+	default:
+		value = FormatMtime(srcObject.Updated)
+	}
+
+	m = make(map[string]string, len(srcObject.Metadata)+1)
+	for k, v := range srcObject.Metadata {
+		if !strings.HasPrefix(k, tmpMetadataKeyPrefix) {
+			m[k] = v
+		}
+	}
+
+	m[MtimeMetadataKey] = value
+	return
+}
+
+// Give the supplied object generation, just created by composing objects, the
+// supplied custom metadata, since composing can't set it. Return the updated
+// record.
+//
+// By this point the new generation exists, so failing the sync would only
+// make a retry fail its precondition. Instead we log any failure, including
+// the object having been replaced concurrently, and return o as it is.
+func applyComposedMetadata(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object,
+	metadata map[string]string) (updated *gcs.Object) {
+	updated = o
+
+	req := &gcs.UpdateObjectRequest{
+		Name:                   o.Name,
+		GenerationPrecondition: &o.Generation,
+		Metadata:               make(map[string]*string),
+	}
+
+	for k, v := range metadata {
+		if o.Metadata[k] != v {
+			v := v
+			req.Metadata[k] = &v
+		}
+	}
+
+	if len(req.Metadata) == 0 {
+		return
+	}
+
+	newObj, err := bucket.UpdateObject(ctx, req)
+	if err != nil {
+		logger.Errorf("Setting metadata of composed object %q: %v", o.Name, err)
+		return
+	}
+
+	updated = newObj
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Checksums
+////////////////////////////////////////////////////////////////////////
+
+// Checksums of contents being uploaded.
+type uploadChecksums struct {
+	CRC32C uint32
+	MD5    [md5.Size]byte
+}
+
+// Compute the checksums of everything in r.
+func computeUploadChecksums(r io.Reader) (sums *uploadChecksums, err error) {
+	crc32cHash := crc32.New(castagnoliTable)
+	md5Hash := md5.New()
+
+	_, err = io.Copy(io.MultiWriter(crc32cHash, md5Hash), r)
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	sums = &uploadChecksums{
+		CRC32C: crc32cHash.Sum32(),
+	}
+
+	copy(sums.MD5[:], md5Hash.Sum(nil))
+	return
+}
+
+// Compute the checksums of the content from the given offset on.
+func checksumContent(
+	ctx context.Context,
+	content mutable.Content,
+	offset int64) (sums *uploadChecksums, err error) {
+	sums, err = computeUploadChecksums(&mutableContentReader{
+		Ctx:     ctx,
+		Content: content,
+		Offset:  offset,
+	})
+
+	return
+}
+
+// Return an *uploadChecksumError if the supplied object, just created with
+// contents having these checksums, doesn't have them too. landed says
+// whether the object is the one the caller asked for, rather than a temporary
+// one.
+func (sums *uploadChecksums) check(
+	o *gcs.Object,
+	landed bool) (err error) {
+	if o.CRC32C == sums.CRC32C && (o.MD5 == nil || *o.MD5 == sums.MD5) {
+		return
+	}
+
+	ue := &uploadChecksumError{
+		Name: o.Name,
+		Sent: *sums,
+		Got: uploadChecksums{
+			CRC32C: o.CRC32C,
+		},
+	}
+
+	if o.MD5 != nil {
+		ue.Got.MD5 = *o.MD5
+	}
+
+	if landed {
+		ue.Landed = o
+	}
+
+	err = ue
+	return
+}
+
+// An error returned by an objectCreator when the object it created doesn't
+// have the checksums of the contents that were sent for it.
+type uploadChecksumError struct {
+	Name string
+	Sent uploadChecksums
+	Got  uploadChecksums
+
+	// The object created, if it is the one the caller asked for (so that it
+	// now holds corrupt contents), or nil.
+	Landed *gcs.Object
+}
+
+func (ue *uploadChecksumError) Error() string {
+	return fmt.Sprintf(
+		"%q was created with CRC32C 0x%08x and MD5 %x; sent 0x%08x and %x",
+		ue.Name,
+		ue.Got.CRC32C,
+		ue.Got.MD5,
+		ue.Sent.CRC32C,
+		ue.Sent.MD5)
+}
+
+// Return true if the supplied error from an objectCreator says that the
+// contents were damaged on the way to GCS, whether GCS noticed that they
+// didn't match the checksums sent with them or we noticed afterward.
+func isUploadChecksumErr(err error) bool {
+	switch err.(type) {
+	case *uploadChecksumError, *gcs.ChecksumMismatchError:
+		return true
+	}
+
+	return false
+}
+
+// Create an object with the supplied creator from the content from the given
+// offset on, sending its checksums along. See uploadChecked.
+func createChecked(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	creator objectCreator,
+	srcObject *gcs.Object,
+	metadata map[string]string,
+	content mutable.Content,
+	offset int64) (o *gcs.Object, err error) {
+	sums, err := checksumContent(ctx, content, offset)
+	if err != nil {
+		err = fmt.Errorf("checksumContent: %v", err)
+		return
+	}
+
+	o, err = uploadChecked(
+		ctx,
+		bucket,
+		srcObject,
+		func(srcObject *gcs.Object) (*gcs.Object, error) {
+			return creator.Create(
+				ctx,
+				srcObject,
+				metadata,
+				&mutableContentReader{
+					Ctx:     ctx,
+					Content: content,
+					Offset:  offset,
+				},
+				sums)
+		})
+
+	return
+}
+
+// Overwrite the source object with the content using the resumable creator,
+// checking that the object composed from the pieces has the content's
+// checksum. See uploadChecked.
+func (os *objectSyncer) createResumable(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	metadata map[string]string,
+	content mutable.Content,
+	size int64) (o *gcs.Object, err error) {
+	sums, err := checksumContent(ctx, content, 0)
+	if err != nil {
+		err = fmt.Errorf("checksumContent: %v", err)
+		return
+	}
+
+	o, err = uploadChecked(
+		ctx,
+		os.bucket,
+		srcObject,
+		func(srcObject *gcs.Object) (o *gcs.Object, err error) {
+			o, err = os.resumableCreator.Create(
+				ctx,
+				srcObject,
+				metadata,
+				&mutableContentReader{
+					Ctx:     ctx,
+					Content: content,
+				},
+				size)
+
+			if err == nil {
+				err = sums.check(o, true)
+			}
+
+			return
+		})
 
 	return
 }
 
+// Overwrite the source object by calling upload, which returns an
+// *uploadChecksumError or *gcs.ChecksumMismatchError if the contents are
+// damaged on the way. In that case try once more before giving up.
+//
+// If damaged contents made it into a new generation of the object and can't
+// be replaced, delete that generation so that nobody reads them. The object
+// is then gone, and a later sync fails its precondition.
+func uploadChecked(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	srcObject *gcs.Object,
+	upload func(srcObject *gcs.Object) (*gcs.Object, error)) (
+	o *gcs.Object,
+	err error) {
+	var damaged *gcs.Object
+	for attempt := 0; ; attempt++ {
+		o, err = upload(srcObject)
+		if ue, ok := err.(*uploadChecksumError); ok && ue.Landed != nil {
+			damaged = ue.Landed
+		}
+
+		if err == nil || attempt > 0 || !isUploadChecksumErr(err) {
+			break
+		}
+
+		logger.Errorf("Uploading %q again: %v", srcObject.Name, err)
+
+		// If the damaged contents made it into a new generation, replace that
+		// one rather than failing the precondition on the old.
+		if damaged != nil {
+			landed := *srcObject
+			landed.Generation = damaged.Generation
+			srcObject = &landed
+		}
+	}
+
+	if err != nil && damaged != nil {
+		deleteDamaged(ctx, bucket, damaged)
+	}
+
+	return
+}
+
+// Delete the supplied generation holding damaged contents, unless it has been
+// replaced in the meantime. Errors are logged.
+func deleteDamaged(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object) {
+	err := bucket.DeleteObject(
+		ctx,
+		&gcs.DeleteObjectRequest{
+			Name:                   o.Name,
+			Generation:             o.Generation,
+			GenerationPrecondition: &o.Generation,
+		})
+
+	if err != nil {
+		logger.Errorf(
+			"Deleting generation %d of %q, which holds damaged contents: %v",
+			o.Generation,
+			o.Name,
+			err)
+
+		return
+	}
+
+	logger.Errorf(
+		"Deleted generation %d of %q, which held damaged contents",
+		o.Generation,
+		o.Name)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Sparse content
+////////////////////////////////////////////////////////////////////////
+
+// Make sure content that was appended to without fetching the source object's
+// contents holds them locally before it is written out in full, so that the
+// upload doesn't read the source object while replacing it.
+func fetchContent(ctx context.Context, content mutable.Content) (err error) {
+	err = content.Fetch(ctx)
+	if err != nil {
+		err = fmt.Errorf("Fetch: %v", err)
+		return
+	}
+
+	return
+}
+
+// Content at least this large whose size is at least sparseWarningRatio times
+// the amount of it that is data rather than holes gets a warning when it is
+// uploaded. This is usually the result of a buggy application writing at a
+// bogus offset, and the upload will consist mostly of zeroes.
+const sparseWarningMinSize = 1 << 20
+const sparseWarningRatio = 16
+
+// Log a prominent warning if the supplied content, about to be uploaded to the
+// named object, is dramatically sparse. Errors are logged and otherwise
+// ignored, since this is advisory.
+func warnIfSparse(
+	ctx context.Context,
+	name string,
+	content mutable.Content) {
+	sr, err := content.Stat(ctx)
+	if err != nil {
+		logger.Errorf("warnIfSparse: Stat: %v", err)
+		return
+	}
+
+	if sr.Size < sparseWarningMinSize {
+		return
+	}
+
+	// Count the bytes that are really there, rather than the disk space they
+	// take up, which file systems round up to blocks and may preallocate.
+	extents, err := content.Extents(ctx)
+	if err != nil {
+		logger.Errorf("warnIfSparse: Extents: %v", err)
+		return
+	}
+
+	data := lease.ExtentBytes(extents)
+	if data*sparseWarningRatio > sr.Size {
+		return
+	}
+
+	// Don't divide by zero for content that is nothing but a hole.
+	ratio := float64(sr.Size)
+	if data > 0 {
+		ratio /= float64(data)
+	}
+
+	log.Printf(
+		"WARNING: Uploading very sparse content for %q: %d bytes, of which only "+
+			"%d are backed by data locally (ratio %.0f:1). The file may have been "+
+			"written at a bogus offset; most of the upload will be zeroes.",
+		name,
+		sr.Size,
+		data,
+		ratio)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // mutableContentReader
 ////////////////////////////////////////////////////////////////////////
 
+// The largest read we make from mutable content at a time when uploading it,
+// no matter how large a buffer the consumer supplies. This bounds the amount
+// of memory into which we materialize content, in particular the long runs of
+// zeroes in sparse files.
+const maxUploadReadSize = 1 << 20
+
 // An io.Reader that wraps a mutable.Content object, reading starting from a
-// base offset.
+// base offset. It is also an io.ReaderAt, ignoring that offset.
 type mutableContentReader struct {
 	Ctx     context.Context
 	Content mutable.Content
@@ -232,7 +983,32 @@ type mutableContentReader struct {
 }
 
 func (mcr *mutableContentReader) Read(p []byte) (n int, err error) {
+	if len(p) > maxUploadReadSize {
+		p = p[:maxUploadReadSize]
+	}
+
 	n, err = mcr.Content.ReadAt(mcr.Ctx, p, mcr.Offset)
 	mcr.Offset += int64(n)
 	return
 }
+
+func (mcr *mutableContentReader) ReadAt(p []byte, off int64) (n int, err error) {
+	for len(p) > 0 && err == nil {
+		chunk := p
+		if len(chunk) > maxUploadReadSize {
+			chunk = chunk[:maxUploadReadSize]
+		}
+
+		var m int
+		m, err = mcr.Content.ReadAt(mcr.Ctx, chunk, off)
+		n += m
+		off += int64(m)
+		p = p[m:]
+
+		if m == 0 && err == nil {
+			err = io.ErrNoProgress
+		}
+	}
+
+	return
+}
@@ -15,10 +15,13 @@
 package gcsproxy
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"io/ioutil"
+	"log"
 	"math"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -46,7 +49,9 @@ type fakeObjectCreator struct {
 
 	// Supplied arguments
 	srcObject *gcs.Object
+	metadata  map[string]string
 	contents  []byte
+	sums      *uploadChecksums
 
 	// Canned results
 	o   *gcs.Object
@@ -56,33 +61,96 @@ type fakeObjectCreator struct {
 func (oc *fakeObjectCreator) Create(
 	ctx context.Context,
 	srcObject *gcs.Object,
-	r io.Reader) (o *gcs.Object, err error) {
+	metadata map[string]string,
+	r io.Reader,
+	sums *uploadChecksums) (o *gcs.Object, err error) {
 	// Have we been called more than once?
 	AssertFalse(oc.called)
 	oc.called = true
 
 	// Record args.
 	oc.srcObject = srcObject
+	oc.metadata = metadata
 	oc.contents, err = ioutil.ReadAll(r)
 	AssertEq(nil, err)
+	oc.sums = sums
 
 	// Return results.
 	o, err = oc.o, oc.err
 	return
 }
 
+// A resumableObjectCreator that records the arguments it is called with,
+// returning canned results.
+type fakeResumableCreator struct {
+	called bool
+
+	// Supplied arguments
+	srcObject *gcs.Object
+	metadata  map[string]string
+	contents  []byte
+
+	// Canned results
+	o   *gcs.Object
+	err error
+}
+
+func (oc *fakeResumableCreator) Create(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	metadata map[string]string,
+	r io.ReaderAt,
+	size int64) (o *gcs.Object, err error) {
+	AssertFalse(oc.called)
+	oc.called = true
+
+	// Record args.
+	oc.srcObject = srcObject
+	oc.metadata = metadata
+	oc.contents, err = ioutil.ReadAll(io.NewSectionReader(r, 0, size))
+	AssertEq(nil, err)
+
+	// Return results.
+	o, err = oc.o, oc.err
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// readSizeRecordingContent
+////////////////////////////////////////////////////////////////////////
+
+// A mutable.Content that records the largest read made from it.
+type readSizeRecordingContent struct {
+	mutable.Content
+	maxReadSize int
+}
+
+func (rc *readSizeRecordingContent) ReadAt(
+	ctx context.Context,
+	buf []byte,
+	offset int64) (n int, err error) {
+	if len(buf) > rc.maxReadSize {
+		rc.maxReadSize = len(buf)
+	}
+
+	n, err = rc.Content.ReadAt(ctx, buf, offset)
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Boilerplate
 ////////////////////////////////////////////////////////////////////////
 
 const srcObjectContents = "taco"
 const appendThreshold = int64(len(srcObjectContents))
+const resumableThreshold = 1 << 10
 
 type ObjectSyncerTest struct {
 	ctx context.Context
 
-	fullCreator   fakeObjectCreator
-	appendCreator fakeObjectCreator
+	fullCreator      fakeObjectCreator
+	appendCreator    fakeObjectCreator
+	resumableCreator fakeResumableCreator
 
 	bucket gcs.Bucket
 	leaser lease.FileLeaser
@@ -106,8 +174,11 @@ func (t *ObjectSyncerTest) SetUp(ti *TestInfo) {
 	t.leaser = lease.NewFileLeaser("", math.MaxInt32, math.MaxInt32)
 	t.syncer = newObjectSyncer(
 		appendThreshold,
+		resumableThreshold,
 		&t.fullCreator,
-		&t.appendCreator)
+		&t.appendCreator,
+		&t.resumableCreator,
+		t.bucket)
 
 	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
 
@@ -127,13 +198,17 @@ func (t *ObjectSyncerTest) SetUp(ti *TestInfo) {
 			t.srcObject,
 			nil,            // Initial read lease
 			math.MaxUint64, // Chunk size
+			0,              // Readahead chunks
+			true,           // Validate checksums
 			t.leaser,
+			nil, // Evictions
 			t.bucket),
 		&t.clock)
 
 	// Return errors from the fakes by default.
 	t.fullCreator.err = errors.New("Fake error")
 	t.appendCreator.err = errors.New("Fake error")
+	t.resumableCreator.err = errors.New("Fake error")
 }
 
 func (t *ObjectSyncerTest) call() (
@@ -215,8 +290,11 @@ func (t *ObjectSyncerTest) SourceTooShortForAppend() {
 	// Recreate the syncer with a higher append threshold.
 	t.syncer = newObjectSyncer(
 		int64(len(srcObjectContents)+1),
+		resumableThreshold,
 		&t.fullCreator,
-		&t.appendCreator)
+		&t.appendCreator,
+		&t.resumableCreator,
+		t.bucket)
 
 	// Extend the length of the content.
 	err = t.content.Truncate(t.ctx, int64(len(srcObjectContents)+1))
@@ -274,6 +352,15 @@ func (t *ObjectSyncerTest) CallsFullCreator() {
 	AssertTrue(t.fullCreator.called)
 	ExpectEq(t.srcObject, t.fullCreator.srcObject)
 	ExpectEq(srcObjectContents[:2], string(t.fullCreator.contents))
+	ExpectThat(
+		t.fullCreator.sums,
+		Pointee(DeepEquals(*checksumsOf(srcObjectContents[:2]))))
+
+	ExpectThat(
+		t.fullCreator.metadata,
+		DeepEquals(map[string]string{
+			MtimeMetadataKey: FormatMtime(t.clock.Now()),
+		}))
 }
 
 func (t *ObjectSyncerTest) FullCreatorFails() {
@@ -307,7 +394,7 @@ func (t *ObjectSyncerTest) FullCreatorReturnsPreconditionError() {
 
 func (t *ObjectSyncerTest) FullCreatorSucceeds() {
 	var err error
-	t.fullCreator.o = &gcs.Object{}
+	t.fullCreator.o = &gcs.Object{Name: "foo", Generation: 17}
 	t.fullCreator.err = nil
 
 	// Truncate downward.
@@ -327,6 +414,144 @@ func (t *ObjectSyncerTest) FullCreatorSucceeds() {
 	buf, err := ioutil.ReadAll(rl)
 	AssertEq(nil, err)
 	ExpectEq(srcObjectContents[:2], string(buf))
+
+	// It should be tagged with the new generation.
+	ExpectEq(LeaseTag("foo", 17), rl.Tag())
+}
+
+func (t *ObjectSyncerTest) CustomerEncryptedSource() {
+	var err error
+	t.srcObject.CustomerEncryption = &gcs.CustomerEncryption{
+		EncryptionAlgorithm: "AES256",
+	}
+
+	// Truncate downward.
+	err = t.content.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Call
+	_, _, err = t.call()
+
+	_, ok := err.(*EncryptionError)
+	ExpectTrue(ok, "err: %v", err)
+	ExpectFalse(t.fullCreator.called)
+
+	// The content is still valid.
+	sr, err := t.content.Stat(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(2, sr.Size)
+}
+
+func (t *ObjectSyncerTest) KmsKeyKept() {
+	var err error
+	t.srcObject.KmsKeyName = "some/key/cryptoKeyVersions/3"
+	t.fullCreator.o = &gcs.Object{
+		Name:       "foo",
+		Generation: 17,
+		KmsKeyName: "some/key/cryptoKeyVersions/4",
+	}
+
+	t.fullCreator.err = nil
+
+	// Truncate downward.
+	err = t.content.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Call
+	_, o, err := t.call()
+
+	AssertEq(nil, err)
+	ExpectEq(t.fullCreator.o, o)
+}
+
+func (t *ObjectSyncerTest) KmsKeyLost() {
+	var err error
+	t.srcObject.KmsKeyName = "some/key/cryptoKeyVersions/3"
+	t.fullCreator.o = &gcs.Object{
+		Name:       "foo",
+		Generation: 17,
+		KmsKeyName: "other/key/cryptoKeyVersions/1",
+	}
+
+	t.fullCreator.err = nil
+
+	// Truncate downward.
+	err = t.content.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Call
+	rl, o, err := t.call()
+
+	ee, ok := err.(*EncryptionError)
+	AssertTrue(ok, "err: %v", err)
+	ExpectEq("some/key", ee.Want)
+	ExpectEq("other/key", ee.Got)
+
+	// The new generation is returned all the same.
+	ExpectEq(t.fullCreator.o, o)
+	AssertNe(nil, rl)
+	ExpectEq(LeaseTag("foo", 17), rl.Tag())
+}
+
+func (t *ObjectSyncerTest) CallsResumableCreator() {
+	var err error
+
+	// Dirty the content and make it long enough.
+	_, err = t.content.WriteAt(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	err = t.content.Truncate(t.ctx, resumableThreshold)
+	AssertEq(nil, err)
+
+	// Call
+	t.call()
+
+	ExpectFalse(t.fullCreator.called)
+	AssertTrue(t.resumableCreator.called)
+	ExpectEq(t.srcObject, t.resumableCreator.srcObject)
+	ExpectThat(
+		t.resumableCreator.metadata,
+		DeepEquals(map[string]string{
+			MtimeMetadataKey: FormatMtime(t.clock.Now()),
+		}))
+
+	expected := make([]byte, resumableThreshold)
+	copy(expected, "paco")
+	ExpectTrue(
+		bytes.Equal(expected, t.resumableCreator.contents),
+		"%q",
+		t.resumableCreator.contents)
+}
+
+func (t *ObjectSyncerTest) ResumableCreatorReturnsPreconditionError() {
+	var err error
+	t.resumableCreator.err = &gcs.PreconditionError{}
+
+	err = t.content.Truncate(t.ctx, resumableThreshold+1)
+	AssertEq(nil, err)
+
+	_, err = t.content.WriteAt(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	// Call
+	_, _, err = t.call()
+
+	ExpectEq(t.resumableCreator.err, err)
+}
+
+func (t *ObjectSyncerTest) AppendsAreNotResumable() {
+	var err error
+
+	// Extend the content past the resumable threshold without dirtying the
+	// source object's contents.
+	err = t.content.Truncate(t.ctx, 2*resumableThreshold)
+	AssertEq(nil, err)
+
+	// Call
+	t.call()
+
+	ExpectTrue(t.appendCreator.called)
+	ExpectFalse(t.resumableCreator.called)
 }
 
 func (t *ObjectSyncerTest) CallsAppendCreator() {
@@ -342,6 +567,15 @@ func (t *ObjectSyncerTest) CallsAppendCreator() {
 	AssertTrue(t.appendCreator.called)
 	ExpectEq(t.srcObject, t.appendCreator.srcObject)
 	ExpectEq("burrito", string(t.appendCreator.contents))
+	ExpectThat(
+		t.appendCreator.sums,
+		Pointee(DeepEquals(*checksumsOf("burrito"))))
+
+	ExpectThat(
+		t.appendCreator.metadata,
+		DeepEquals(map[string]string{
+			MtimeMetadataKey: FormatMtime(t.clock.Now()),
+		}))
 }
 
 func (t *ObjectSyncerTest) AppendCreatorFails() {
@@ -388,6 +622,102 @@ func (t *ObjectSyncerTest) AppendCreatorSucceeds() {
 	AssertEq(nil, err)
 	ExpectEq(t.appendCreator.o, o)
 
+	// Appending didn't fetch the source object's contents, so there is no read
+	// lease for the new ones.
+	ExpectEq(nil, rl)
+}
+
+func (t *ObjectSyncerTest) Flatten_NotDirty() {
+	t.fullCreator.o = &gcs.Object{}
+	t.fullCreator.err = nil
+
+	// Call
+	rl, o, err := t.syncer.FlattenObject(t.ctx, t.srcObject, t.content)
+
+	AssertEq(nil, err)
+	ExpectEq(nil, rl)
+	ExpectEq(t.fullCreator.o, o)
+
+	// The full creator should have been given the unmodified contents.
+	AssertTrue(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+	ExpectEq(t.srcObject, t.fullCreator.srcObject)
+	ExpectEq(srcObjectContents, string(t.fullCreator.contents))
+
+	// It should keep the source object's modification time.
+	ExpectThat(
+		t.fullCreator.metadata,
+		DeepEquals(map[string]string{
+			MtimeMetadataKey: FormatMtime(t.srcObject.Updated),
+		}))
+}
+
+func (t *ObjectSyncerTest) Flatten_NotDirty_MtimeMetadata() {
+	t.fullCreator.o = &gcs.Object{}
+	t.fullCreator.err = nil
+	t.srcObject.Metadata = map[string]string{
+		MtimeMetadataKey: "2012-08-15T22:56:34.1234Z",
+	}
+
+	// Call
+	_, _, err := t.syncer.FlattenObject(t.ctx, t.srcObject, t.content)
+	AssertEq(nil, err)
+
+	// The source object's recorded modification time should be kept as is.
+	AssertTrue(t.fullCreator.called)
+	ExpectThat(
+		t.fullCreator.metadata,
+		DeepEquals(map[string]string{
+			MtimeMetadataKey: "2012-08-15T22:56:34.1234Z",
+		}))
+}
+
+func (t *ObjectSyncerTest) CustomMetadataKept() {
+	var err error
+	t.srcObject.Metadata = map[string]string{
+		"owner":               "taco",
+		MtimeMetadataKey:      "2012-08-15T22:56:34.1234Z",
+		TmpTargetMetadataKey:  "burrito",
+		TmpMountIDMetadataKey: "enchilada",
+	}
+
+	// Truncate downward.
+	err = t.content.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Call
+	t.call()
+
+	// The source object's own metadata should be carried over, with a new
+	// modification time, while that describing temporary objects is dropped.
+	AssertTrue(t.fullCreator.called)
+	ExpectThat(
+		t.fullCreator.metadata,
+		DeepEquals(map[string]string{
+			"owner":          "taco",
+			MtimeMetadataKey: FormatMtime(t.clock.Now()),
+		}))
+}
+
+func (t *ObjectSyncerTest) Flatten_Appended() {
+	var err error
+	t.fullCreator.o = &gcs.Object{}
+	t.fullCreator.err = nil
+
+	// Append some data, which would normally use the append creator.
+	_, err = t.content.WriteAt(t.ctx, []byte("burrito"), int64(t.srcObject.Size))
+	AssertEq(nil, err)
+
+	// Call
+	rl, o, err := t.syncer.FlattenObject(t.ctx, t.srcObject, t.content)
+
+	AssertEq(nil, err)
+	ExpectEq(t.fullCreator.o, o)
+
+	AssertTrue(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+	ExpectEq(srcObjectContents+"burrito", string(t.fullCreator.contents))
+
 	// Check the read lease.
 	_, err = rl.Seek(0, 0)
 	AssertEq(nil, err)
@@ -396,3 +726,252 @@ func (t *ObjectSyncerTest) AppendCreatorSucceeds() {
 	AssertEq(nil, err)
 	ExpectEq(srcObjectContents+"burrito", string(buf))
 }
+
+func (t *ObjectSyncerTest) Flatten_PreconditionError() {
+	t.fullCreator.err = &gcs.PreconditionError{}
+
+	// Call
+	_, _, err := t.syncer.FlattenObject(t.ctx, t.srcObject, t.content)
+	ExpectEq(t.fullCreator.err, err)
+
+	// The content should still be usable.
+	buf := make([]byte, 1024)
+	n, _ := t.content.ReadAt(t.ctx, buf, 0)
+	ExpectEq(srcObjectContents, string(buf[:n]))
+}
+
+func (t *ObjectSyncerTest) SparseContent() {
+	var err error
+
+	// Capture log output.
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// Write a single byte far beyond the end of the content.
+	const offset = 4 * sparseWarningMinSize
+	_, err = t.content.WriteAt(t.ctx, []byte("a"), offset)
+	AssertEq(nil, err)
+
+	// Sync, keeping track of how the content is read.
+	content := &readSizeRecordingContent{Content: t.content}
+	t.appendCreator.err = nil
+	t.appendCreator.o = &gcs.Object{}
+
+	_, _, err = t.syncer.SyncObject(t.ctx, t.srcObject, content)
+	AssertEq(nil, err)
+
+	// All of the appended content should have been uploaded, a bounded amount
+	// at a time.
+	AssertTrue(t.appendCreator.called)
+	contents := t.appendCreator.contents
+	AssertEq(offset+1-len(srcObjectContents), len(contents))
+	ExpectEq('a', contents[len(contents)-1])
+	ExpectLe(content.maxReadSize, maxUploadReadSize)
+
+	// There should have been a warning.
+	ExpectThat(logs.String(), HasSubstr("WARNING"))
+	ExpectThat(logs.String(), HasSubstr("very sparse"))
+	ExpectThat(logs.String(), HasSubstr(`"foo"`))
+}
+
+func (t *ObjectSyncerTest) DenseContent() {
+	var err error
+
+	// Capture log output.
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// Write a large amount of real data.
+	data := bytes.Repeat([]byte("a"), 4*sparseWarningMinSize)
+	_, err = t.content.WriteAt(t.ctx, data, 0)
+	AssertEq(nil, err)
+
+	// Sync. The content is large enough to be uploaded resumably.
+	t.resumableCreator.err = nil
+	t.resumableCreator.o = &gcs.Object{
+		CRC32C: checksumsOf(string(data)).CRC32C,
+	}
+
+	_, _, err = t.call()
+	AssertEq(nil, err)
+	ExpectTrue(t.resumableCreator.called)
+
+	// There should have been no warning.
+	ExpectEq("", logs.String())
+}
+
+func (t *ObjectSyncerTest) PlanSync_DoesNothing() {
+	var err error
+
+	// Append some data.
+	_, err = t.content.WriteAt(t.ctx, []byte("burrito"), int64(t.srcObject.Size))
+	AssertEq(nil, err)
+
+	// Plan, both ways.
+	plan, err := t.syncer.PlanSync(t.ctx, t.srcObject, t.content, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyAppend, plan.Strategy)
+	ExpectEq(len("burrito"), plan.UploadBytes)
+	ExpectEq(t.srcObject.Generation, plan.GenerationPrecondition)
+
+	plan, err = t.syncer.PlanSync(t.ctx, t.srcObject, t.content, true)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyFlatten, plan.Strategy)
+	ExpectEq(len(srcObjectContents+"burrito"), plan.UploadBytes)
+
+	// Neither creator should have been called, and the content should be
+	// untouched.
+	ExpectFalse(t.fullCreator.called)
+	ExpectFalse(t.appendCreator.called)
+
+	buf := make([]byte, 1024)
+	n, _ := t.content.ReadAt(t.ctx, buf, 0)
+	ExpectEq(srcObjectContents+"burrito", string(buf[:n]))
+}
+
+func (t *ObjectSyncerTest) PlanSync_DecisionMatrix() {
+	const srcSize = 100
+	testCases := []struct {
+		componentCount int64
+		sr             mutable.StatResult
+		flatten        bool
+
+		expectedStrategy    SyncStrategy
+		expectedUploadBytes int64
+	}{
+		// Clean
+		{1, mutable.StatResult{Size: 100, DirtyThreshold: 100}, false,
+			SyncStrategyNone, 0},
+
+		// Clean, flattened
+		{1, mutable.StatResult{Size: 100, DirtyThreshold: 100}, true,
+			SyncStrategyFlatten, 100},
+
+		// Truncated
+		{1, mutable.StatResult{Size: 50, DirtyThreshold: 50}, false,
+			SyncStrategyRewrite, 50},
+
+		// Truncated to zero
+		{1, mutable.StatResult{Size: 0, DirtyThreshold: 0}, false,
+			SyncStrategyRewrite, 0},
+
+		// Dirtied without changing size
+		{1, mutable.StatResult{Size: 100, DirtyThreshold: 17}, false,
+			SyncStrategyRewrite, 100},
+
+		// Dirtied and extended
+		{1, mutable.StatResult{Size: 150, DirtyThreshold: 17}, false,
+			SyncStrategyRewrite, 150},
+
+		// Appended
+		{1, mutable.StatResult{Size: 150, DirtyThreshold: 100}, false,
+			SyncStrategyAppend, 50},
+
+		// Appended, flattened
+		{1, mutable.StatResult{Size: 150, DirtyThreshold: 100}, true,
+			SyncStrategyFlatten, 150},
+
+		// Appended to an object with too many components
+		{gcs.MaxComponentCount, mutable.StatResult{Size: 150, DirtyThreshold: 100},
+			false, SyncStrategyRewrite, 150},
+	}
+
+	for i, tc := range testCases {
+		srcObject := &gcs.Object{
+			Name:           "foo",
+			Size:           srcSize,
+			Generation:     17,
+			ComponentCount: tc.componentCount,
+		}
+
+		plan, err := planSync(srcSize, 0, srcObject, tc.sr, tc.flatten)
+		AssertEq(nil, err, "Test case %d", i)
+		ExpectEq(tc.expectedStrategy, plan.Strategy, "Test case %d", i)
+		ExpectEq(tc.expectedUploadBytes, plan.UploadBytes, "Test case %d", i)
+
+		if tc.expectedStrategy == SyncStrategyNone {
+			ExpectEq(0, plan.GenerationPrecondition, "Test case %d", i)
+		} else {
+			ExpectEq(17, plan.GenerationPrecondition, "Test case %d", i)
+		}
+	}
+}
+
+func (t *ObjectSyncerTest) PlanSync_SourceTooShortForAppend() {
+	srcObject := &gcs.Object{Size: 10, Generation: 17}
+	sr := mutable.StatResult{Size: 20, DirtyThreshold: 10}
+
+	plan, err := planSync(11, 0, srcObject, sr, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyRewrite, plan.Strategy)
+	ExpectEq(20, plan.UploadBytes)
+
+	plan, err = planSync(10, 0, srcObject, sr, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyAppend, plan.Strategy)
+	ExpectEq(10, plan.UploadBytes)
+}
+
+func (t *ObjectSyncerTest) PlanSync_Resumable() {
+	srcObject := &gcs.Object{Size: 10, Generation: 17}
+	sr := mutable.StatResult{Size: 20, DirtyThreshold: 5}
+
+	// Large enough
+	plan, err := planSync(0, 20, srcObject, sr, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyResumable, plan.Strategy)
+	ExpectEq(20, plan.UploadBytes)
+	ExpectEq(17, plan.GenerationPrecondition)
+
+	// Too small
+	plan, err = planSync(0, 21, srcObject, sr, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyRewrite, plan.Strategy)
+
+	// Disabled
+	plan, err = planSync(0, 0, srcObject, sr, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyRewrite, plan.Strategy)
+
+	// Flattening always writes a single component.
+	plan, err = planSync(0, 20, srcObject, sr, true)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyFlatten, plan.Strategy)
+}
+
+func (t *ObjectSyncerTest) PlanSync_DirtyRanges() {
+	srcObject := &gcs.Object{Size: 100, Generation: 17}
+
+	// Everything dirty is beyond the source object.
+	sr := mutable.StatResult{
+		Size:           150,
+		DirtyThreshold: 100,
+		DirtyRanges:    []lease.ByteRange{{Start: 100, Limit: 150}},
+	}
+
+	plan, err := planSync(100, 0, srcObject, sr, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyAppend, plan.Strategy)
+	ExpectEq(50, plan.UploadBytes)
+
+	// Some of it is within the source object.
+	sr.DirtyRanges = []lease.ByteRange{
+		{Start: 17, Limit: 19},
+		{Start: 100, Limit: 150},
+	}
+
+	plan, err = planSync(100, 0, srcObject, sr, false)
+	AssertEq(nil, err)
+	ExpectEq(SyncStrategyRewrite, plan.Strategy)
+	ExpectEq(150, plan.UploadBytes)
+}
+
+func (t *ObjectSyncerTest) PlanSync_WeirdDirtyThreshold() {
+	srcObject := &gcs.Object{Size: 10}
+	sr := mutable.StatResult{Size: 20, DirtyThreshold: 11}
+
+	_, err := planSync(0, 0, srcObject, sr, false)
+	ExpectThat(err, Error(HasSubstr("DirtyThreshold")))
+}
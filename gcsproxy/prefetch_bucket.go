@@ -0,0 +1,929 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// Configuration for a PrefetchBucket.
+type PrefetchConfig struct {
+	// Objects larger than this are never prefetched, and looking them up or
+	// reading them doesn't count toward triggering a prefetch.
+	SmallObjectThreshold int64
+
+	// The maximum number of bytes held in prefetched objects that haven't yet
+	// been read, including those still being downloaded. This bounds the memory
+	// used and the bytes wasted when a prediction turns out to be wrong.
+	Budget int64
+
+	// A prefetch of the small objects in a directory is triggered when this many
+	// lookups or reads of small objects in that directory happen within Window.
+	Trigger int
+	Window  time.Duration
+
+	// The maximum number of downloads in flight at once.
+	Concurrency int
+
+	// Prefetched objects that haven't been read after this long are discarded.
+	// This happens in the background, as well as whenever the bucket is used.
+	TTL time.Duration
+}
+
+// Counters describing the history of a PrefetchBucket.
+type PrefetchStats struct {
+	// The number of times a directory's contents were predicted to be read.
+	Triggered uint64
+
+	// Objects downloaded ahead of being read, and downloads that failed.
+	Fetched      uint64
+	FetchedBytes uint64
+	FetchFailed  uint64
+
+	// Reads served from prefetched contents without contacting GCS.
+	Hits     uint64
+	HitBytes uint64
+
+	// Prefetched objects that were discarded without being read.
+	Wasted      uint64
+	WastedBytes uint64
+}
+
+// A bucket that notices when an application appears to be working its way
+// through many small objects in a directory (for example reading every file
+// in it), and downloads the rest of them concurrently ahead of time. This
+// hides the per-request latency of GCS that otherwise dominates reading small
+// files one at a time.
+//
+// Prefetched contents are held in memory until NewReader is called for the
+// same object generation, whereupon they are handed over (and from there make
+// their way into the file system's lease cache as usual). Contents are keyed
+// by generation, so a misprediction can only cost the budget, never serve the
+// wrong data. A prefetched object expiring unread is taken as a sign that the
+// prediction was wrong, and anything still queued or being downloaded is
+// dropped. A download is also cancelled if the reader waiting for it gives
+// up.
+type PrefetchBucket interface {
+	gcs.Bucket
+
+	// Queue the supplied ranges of object generations for download, in order,
+	// as if they had been predicted: they are subject to the budget and the
+	// concurrency limit, and are discarded if unread after the TTL. Each is
+	// handed over to a NewReader call for the same generation and a range
+	// starting at the same offset and ending no later. Ranges already queued or
+	// prefetched are ignored, as are any larger than the budget. Doesn't block.
+	Warm(ranges []PrefetchRange)
+
+	// Return a snapshot of the bucket's counters.
+	Stats() (s PrefetchStats)
+}
+
+// A range of a particular object generation to be downloaded ahead of time.
+// See PrefetchBucket.Warm.
+type PrefetchRange struct {
+	Name       string
+	Generation int64
+	Start      uint64
+	Limit      uint64
+}
+
+// Create a prefetch bucket. To see every lookup made by the file system, it
+// should wrap any stat caching layer.
+func NewPrefetchBucket(
+	cfg PrefetchConfig,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b PrefetchBucket) {
+	const dirCapacity = 64
+
+	b = &prefetchBucket{
+		clock:   clock,
+		wrapped: wrapped,
+		cfg:     cfg,
+		dirs:    lrucache.New(dirCapacity),
+		entries: make(map[prefetchKey]*prefetchEntry),
+		queued:  make(map[prefetchKey]bool),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// The most listed objects and read names we remember for a directory.
+const maxPrefetchDirNames = 4096
+
+// A lookup or read of a small object.
+type prefetchEvent struct {
+	name string
+	time time.Time
+}
+
+// What we know about recent activity in a directory.
+type prefetchDir struct {
+	// Recent lookups and reads of small objects, oldest first.
+	recent []prefetchEvent
+
+	// When a prefetch was last triggered, or the zero time if never.
+	triggered time.Time
+
+	// Small objects seen in the most recent listing of the directory, or nil if
+	// it hasn't been listed.
+	listed []*gcs.Object
+
+	// Names of objects that have already been read, and so are not worth
+	// prefetching.
+	read map[string]bool
+}
+
+// Identifies an object, or a range of one, that is queued for or has been
+// prefetched. Whole objects have start zero.
+type prefetchKey struct {
+	name  string
+	start uint64
+}
+
+// An object, or a range of one, waiting to be prefetched.
+type prefetchItem struct {
+	name       string
+	generation int64
+
+	// The range to download, or nil for the whole object.
+	rng *gcs.ByteRange
+
+	// The number of bytes to download.
+	size int64
+}
+
+func (it prefetchItem) key() (k prefetchKey) {
+	k.name = it.name
+	if it.rng != nil {
+		k.start = it.rng.Start
+	}
+
+	return
+}
+
+// An object, or a range of one, that has been or is being prefetched.
+type prefetchEntry struct {
+	generation int64
+	size       int64
+
+	// Set if the contents are only a range of the object, starting at
+	// prefetchKey.start. Such entries serve only reads of ranges starting at
+	// the same offset.
+	partial bool
+
+	// Closed when the download finishes.
+	done chan struct{}
+
+	// Cancels the download.
+	cancel context.CancelFunc
+
+	// Set before done is closed.
+	contents []byte
+	err      error
+
+	// Has the download finished? Equivalent to done being closed, but can be
+	// checked under the lock.
+	//
+	// GUARDED_BY(prefetchBucket.mu)
+	finished bool
+
+	// Has a reader claimed the entry while it was still being downloaded? If
+	// so it is no longer in prefetchBucket.entries, and fetch releases its
+	// share of the budget when done.
+	//
+	// GUARDED_BY(prefetchBucket.mu)
+	taken bool
+
+	// The time after which the entry is discarded if not read. Set when the
+	// download finishes.
+	//
+	// GUARDED_BY(prefetchBucket.mu)
+	expiration time.Time
+}
+
+type prefetchBucket struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	clock   timeutil.Clock
+	wrapped gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	cfg PrefetchConfig
+
+	/////////////////////////
+	// Counters
+	/////////////////////////
+
+	// Accessed atomically.
+	triggered    uint64
+	fetched      uint64
+	fetchedBytes uint64
+	fetchFailed  uint64
+	hits         uint64
+	hitBytes     uint64
+	wasted       uint64
+	wastedBytes  uint64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// A cache from directory name (e.g. "foo/bar/", or "" for the root) to
+	// *prefetchDir.
+	//
+	// GUARDED_BY(mu)
+	dirs lrucache.Cache
+
+	// Objects and ranges that have been or are being prefetched.
+	//
+	// GUARDED_BY(mu)
+	entries map[prefetchKey]*prefetchEntry
+
+	// Objects and ranges waiting to be prefetched, in order, and an index of
+	// them.
+	//
+	// GUARDED_BY(mu)
+	queue  []prefetchItem
+	queued map[prefetchKey]bool
+
+	// The number of downloads in flight.
+	//
+	// INVARIANT: 0 <= inFlight <= cfg.Concurrency
+	//
+	// GUARDED_BY(mu)
+	inFlight int
+
+	// The total size of the objects in entries, plus those taken by readers
+	// but still being downloaded.
+	//
+	// INVARIANT: committed <= cfg.Budget
+	//
+	// GUARDED_BY(mu)
+	committed int64
+
+	// Set while a call to expireLater is scheduled.
+	//
+	// GUARDED_BY(mu)
+	expiryScheduled bool
+}
+
+// Return the name of the directory containing the named object.
+func prefetchDirName(name string) string {
+	return name[:strings.LastIndex(name, "/")+1]
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) getDir(name string) (d *prefetchDir) {
+	if v := b.dirs.LookUp(name); v != nil {
+		d = v.(*prefetchDir)
+		return
+	}
+
+	d = &prefetchDir{read: make(map[string]bool)}
+	b.dirs.Insert(name, d)
+	return
+}
+
+// Is the object worth prefetching, if it hasn't already been read?
+func (b *prefetchBucket) isSmall(o *gcs.Object) bool {
+	return o.Size > 0 &&
+		int64(o.Size) <= b.cfg.SmallObjectThreshold &&
+		!strings.HasSuffix(o.Name, "/")
+}
+
+// Throw away prefetched objects that have gone unread for too long. If there
+// are any, the prediction that queued them was probably wrong, so drop the
+// queue too.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) expire() {
+	now := b.clock.Now()
+	var expired bool
+	for k, e := range b.entries {
+		if !e.finished || now.Before(e.expiration) {
+			continue
+		}
+
+		b.discard(k, e)
+		expired = true
+	}
+
+	if !expired {
+		return
+	}
+
+	b.queue = nil
+	b.queued = make(map[prefetchKey]bool)
+
+	// Nor is there any point finishing the downloads that nobody is waiting
+	// for.
+	for _, e := range b.entries {
+		if !e.finished {
+			e.cancel()
+		}
+	}
+}
+
+// Arrange for expireLater to run once the TTL has passed, unless it already
+// will, so that prefetched objects expire even if the bucket isn't used.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) scheduleExpiry() {
+	if b.expiryScheduled {
+		return
+	}
+
+	b.expiryScheduled = true
+	time.AfterFunc(b.cfg.TTL, b.expireLater)
+}
+
+// Throw away expired objects, and check again later if there are others.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) expireLater() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expiryScheduled = false
+	b.expire()
+
+	for _, e := range b.entries {
+		if e.finished {
+			b.scheduleExpiry()
+			break
+		}
+	}
+}
+
+// Discard a downloaded entry that was never read.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) discard(k prefetchKey, e *prefetchEntry) {
+	delete(b.entries, k)
+	b.committed -= e.size
+	atomic.AddUint64(&b.wasted, 1)
+	atomic.AddUint64(&b.wastedBytes, uint64(e.size))
+}
+
+// Record a lookup or read of a small object, triggering a prefetch of the
+// directory containing it if enough distinct objects in it have been used
+// within the window.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) note(name string, read bool) {
+	dirName := prefetchDirName(name)
+	d := b.getDir(dirName)
+
+	if read {
+		if len(d.read) >= maxPrefetchDirNames {
+			d.read = make(map[string]bool)
+		}
+
+		d.read[name] = true
+	}
+
+	// Forget about activity outside the window, and don't let repeated use of
+	// the same few objects pile up.
+	now := b.clock.Now()
+	cutoff := now.Add(-b.cfg.Window)
+	for len(d.recent) > 0 &&
+		(d.recent[0].time.Before(cutoff) || len(d.recent) >= 4*b.cfg.Trigger) {
+		d.recent = d.recent[1:]
+	}
+
+	d.recent = append(d.recent, prefetchEvent{name: name, time: now})
+
+	// Have we seen enough to predict more, and not just done so?
+	distinct := make(map[string]bool)
+	for _, e := range d.recent {
+		distinct[e.name] = true
+	}
+
+	if len(distinct) < b.cfg.Trigger {
+		return
+	}
+
+	if !d.triggered.IsZero() && now.Sub(d.triggered) < b.cfg.Window {
+		return
+	}
+
+	d.recent = nil
+	d.triggered = now
+	atomic.AddUint64(&b.triggered, 1)
+
+	// If we know what's in the directory, go ahead. Otherwise find out first.
+	if d.listed != nil {
+		b.enqueue(d)
+		return
+	}
+
+	go b.listAndEnqueue(dirName)
+}
+
+// Queue the directory's small objects that haven't already been read or
+// fetched, and start downloading them.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) enqueue(d *prefetchDir) {
+	for _, o := range d.listed {
+		if d.read[o.Name] {
+			continue
+		}
+
+		b.push(prefetchItem{
+			name:       o.Name,
+			generation: o.Generation,
+			size:       int64(o.Size),
+		})
+	}
+
+	b.pump()
+}
+
+// Add the item to the queue, unless it's already there or has already been
+// fetched. The caller must pump.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) push(it prefetchItem) {
+	k := it.key()
+	if b.queued[k] {
+		return
+	}
+
+	if e, ok := b.entries[k]; ok && e.generation == it.generation {
+		return
+	}
+
+	b.queue = append(b.queue, it)
+	b.queued[k] = true
+}
+
+// Remove the item with the given key from the queue, if it's there.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) dequeue(k prefetchKey) {
+	if !b.queued[k] {
+		return
+	}
+
+	delete(b.queued, k)
+	for i, it := range b.queue {
+		if it.key() == k {
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Start as many queued downloads as the concurrency limit and budget allow,
+// in order. Items that don't currently fit in the budget stay queued without
+// holding up those behind them.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) pump() {
+	var waiting []prefetchItem
+	for i, it := range b.queue {
+		if b.inFlight >= b.cfg.Concurrency {
+			waiting = append(waiting, b.queue[i:]...)
+			break
+		}
+
+		if b.committed+it.size > b.cfg.Budget {
+			waiting = append(waiting, it)
+			continue
+		}
+
+		k := it.key()
+		delete(b.queued, k)
+
+		// Replace any downloaded entry for a different generation.
+		if old, ok := b.entries[k]; ok {
+			if !old.finished {
+				continue
+			}
+
+			b.discard(k, old)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		e := &prefetchEntry{
+			generation: it.generation,
+			size:       it.size,
+			partial:    it.rng != nil,
+			done:       make(chan struct{}),
+			cancel:     cancel,
+		}
+
+		b.entries[k] = e
+		b.committed += e.size
+		b.inFlight++
+
+		go b.fetch(ctx, it, e)
+	}
+
+	b.queue = waiting
+}
+
+// Remember the small objects in a listing of the directory with the given
+// name.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) recordListing(
+	dirName string,
+	continued bool,
+	listing *gcs.Listing) {
+	d := b.getDir(dirName)
+	if !continued || d.listed == nil {
+		d.listed = []*gcs.Object{}
+	}
+
+	for _, o := range listing.Objects {
+		if len(d.listed) >= maxPrefetchDirNames {
+			break
+		}
+
+		if b.isSmall(o) {
+			d.listed = append(d.listed, o)
+		}
+	}
+}
+
+// List the directory with the given name, then queue its small objects.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) listAndEnqueue(dirName string) {
+	req := &gcs.ListObjectsRequest{
+		Prefix:    dirName,
+		Delimiter: "/",
+	}
+
+	listing, err := b.wrapped.ListObjects(context.Background(), req)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.recordListing(dirName, false, listing)
+	b.enqueue(b.getDir(dirName))
+}
+
+// Download the contents of the item into the entry.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) fetch(
+	ctx context.Context,
+	it prefetchItem,
+	e *prefetchEntry) {
+	e.contents, e.err = b.read(ctx, it)
+	e.cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.inFlight--
+	e.finished = true
+	e.expiration = b.clock.Now().Add(b.cfg.TTL)
+
+	if e.err != nil {
+		atomic.AddUint64(&b.fetchFailed, 1)
+	} else {
+		atomic.AddUint64(&b.fetched, 1)
+		atomic.AddUint64(&b.fetchedBytes, uint64(e.size))
+	}
+
+	// Nobody will want a failed download, and one taken by a reader is no
+	// longer our concern.
+	switch {
+	case e.taken:
+		b.committed -= e.size
+
+	case e.err != nil:
+		delete(b.entries, it.key())
+		b.committed -= e.size
+
+	default:
+		b.scheduleExpiry()
+	}
+
+	close(e.done)
+	b.pump()
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) read(
+	ctx context.Context,
+	it prefetchItem) (p []byte, err error) {
+	req := &gcs.ReadObjectRequest{
+		Name:       it.name,
+		Generation: it.generation,
+		Range:      it.rng,
+	}
+
+	rc, err := b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	p, err = ioutil.ReadAll(io.LimitReader(rc, it.size+1))
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	if int64(len(p)) != it.size {
+		err = fmt.Errorf("Read %d bytes; expected %d", len(p), it.size)
+		return
+	}
+
+	return
+}
+
+// Find the entry, if any, that can serve the read.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *prefetchBucket) findEntry(
+	req *gcs.ReadObjectRequest) (k prefetchKey, e *prefetchEntry) {
+	// A whole object can serve any range.
+	k = prefetchKey{name: req.Name}
+	if c := b.entries[k]; c != nil &&
+		!c.partial &&
+		c.generation == req.Generation {
+		e = c
+		return
+	}
+
+	// A range can serve only reads starting where it does, and no longer.
+	if req.Range == nil {
+		return
+	}
+
+	k.start = req.Range.Start
+	if c := b.entries[k]; c != nil &&
+		c.partial &&
+		c.generation == req.Generation &&
+		req.Range.Limit <= k.start+uint64(c.size) {
+		e = c
+	}
+
+	return
+}
+
+// If the requested generation, or a range of it that can serve the request,
+// has been or is being prefetched, claim it and return its contents, waiting
+// for the download if necessary. offset is the offset within the object of
+// the start of the contents. Return nil if there is nothing suitable or the
+// download failed.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) take(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (contents []byte, offset uint64, err error) {
+	b.mu.Lock()
+	b.expire()
+
+	// Count the read, if we can tell that the object is small.
+	if r := req.Range; r != nil &&
+		r.Start == 0 &&
+		int64(r.Limit) <= b.cfg.SmallObjectThreshold {
+		b.note(req.Name, true)
+	}
+
+	// There's no point downloading it twice.
+	k := prefetchKey{name: req.Name}
+	if req.Range != nil {
+		k.start = req.Range.Start
+	}
+
+	b.dequeue(k)
+
+	// Claim the entry, if any.
+	k, e := b.findEntry(req)
+	if e == nil {
+		b.mu.Unlock()
+		return
+	}
+
+	delete(b.entries, k)
+	if e.finished {
+		b.committed -= e.size
+		b.pump()
+	} else {
+		e.taken = true
+	}
+
+	b.mu.Unlock()
+
+	// Wait for the download. If we give up, nobody else will want it.
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		e.cancel()
+		err = ctx.Err()
+		return
+	}
+
+	if e.err != nil {
+		return
+	}
+
+	contents = e.contents
+	offset = k.start
+	atomic.AddUint64(&b.hits, 1)
+	atomic.AddUint64(&b.hitBytes, uint64(e.size))
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) Warm(ranges []PrefetchRange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+
+	for _, r := range ranges {
+		size := int64(r.Limit - r.Start)
+		if r.Limit <= r.Start || size > b.cfg.Budget {
+			continue
+		}
+
+		b.push(prefetchItem{
+			name:       r.Name,
+			generation: r.Generation,
+			rng:        &gcs.ByteRange{Start: r.Start, Limit: r.Limit},
+			size:       size,
+		})
+	}
+
+	b.pump()
+}
+
+func (b *prefetchBucket) Stats() (s PrefetchStats) {
+	s = PrefetchStats{
+		Triggered:    atomic.LoadUint64(&b.triggered),
+		Fetched:      atomic.LoadUint64(&b.fetched),
+		FetchedBytes: atomic.LoadUint64(&b.fetchedBytes),
+		FetchFailed:  atomic.LoadUint64(&b.fetchFailed),
+		Hits:         atomic.LoadUint64(&b.hits),
+		HitBytes:     atomic.LoadUint64(&b.hitBytes),
+		Wasted:       atomic.LoadUint64(&b.wasted),
+		WastedBytes:  atomic.LoadUint64(&b.wastedBytes),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *prefetchBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	contents, offset, err := b.take(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// Serve from the prefetched contents if we can.
+	if contents != nil {
+		start, limit := uint64(0), uint64(len(contents))
+		if req.Range != nil {
+			start = req.Range.Start - offset
+			if req.Range.Limit-offset < limit {
+				limit = req.Range.Limit - offset
+			}
+		}
+
+		if start <= limit {
+			rc = ioutil.NopCloser(bytes.NewReader(contents[start:limit]))
+			return
+		}
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	if b.isSmall(o) {
+		b.mu.Lock()
+		b.expire()
+		b.note(o.Name, false)
+		b.mu.Unlock()
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *prefetchBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// Remember what's in directories.
+	if req.Delimiter == "/" &&
+		(req.Prefix == "" || strings.HasSuffix(req.Prefix, "/")) {
+		b.mu.Lock()
+		b.recordListing(req.Prefix, req.ContinuationToken != "", listing)
+		b.mu.Unlock()
+	}
+
+	return
+}
+
+func (b *prefetchBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *prefetchBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *prefetchBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *prefetchBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *prefetchBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,568 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPrefetchBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// slowBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that delays each call to NewReader, counting them by object name
+// and recording how many were in flight at once. Calls whose context is
+// cancelled while delayed fail.
+type slowBucket struct {
+	gcs.Bucket
+	latency time.Duration
+
+	mu          sync.Mutex
+	reads       map[string]int // GUARDED_BY(mu)
+	inFlight    int            // GUARDED_BY(mu)
+	maxInFlight int            // GUARDED_BY(mu)
+}
+
+func (b *slowBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.mu.Lock()
+	b.reads[req.Name]++
+	b.inFlight++
+	if b.inFlight > b.maxInFlight {
+		b.maxInFlight = b.inFlight
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-time.After(b.latency):
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	b.mu.Lock()
+	b.inFlight--
+	b.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *slowBucket) totalReads() (n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range b.reads {
+		n += c
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	prefetchNumFiles  = 32
+	prefetchFileSize  = 1 << 10
+	prefetchTrigger   = 4
+	prefetchTTL       = time.Minute
+	prefetchThreshold = 4 << 10
+)
+
+type PrefetchBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped slowBucket
+	bucket  gcsproxy.PrefetchBucket
+	cfg     gcsproxy.PrefetchConfig
+}
+
+var _ SetUpInterface = &PrefetchBucketTest{}
+
+func init() { RegisterTestSuite(&PrefetchBucketTest{}) }
+
+func (t *PrefetchBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.wrapped.latency = 5 * time.Millisecond
+	t.wrapped.reads = make(map[string]int)
+
+	// Set up a directory of small files, plus a large one and some files
+	// elsewhere.
+	contents := make(map[string]string)
+	for i := 0; i < prefetchNumFiles; i++ {
+		contents[t.fileName(i)] = t.fileContents(i)
+	}
+
+	contents["dir/large"] = strings.Repeat("x", prefetchThreshold+1)
+	contents["other/foo"] = "taco"
+
+	err := gcsutil.CreateObjects(t.ctx, t.wrapped.Bucket, contents)
+	AssertEq(nil, err)
+
+	t.cfg = gcsproxy.PrefetchConfig{
+		SmallObjectThreshold: prefetchThreshold,
+		Budget:               1 << 20,
+		Trigger:              prefetchTrigger,
+		Window:               time.Second,
+		Concurrency:          8,
+		TTL:                  prefetchTTL,
+	}
+
+	t.resetBucket()
+}
+
+func (t *PrefetchBucketTest) resetBucket() {
+	t.bucket = gcsproxy.NewPrefetchBucket(t.cfg, &t.clock, &t.wrapped)
+}
+
+func (t *PrefetchBucketTest) fileName(i int) string {
+	return fmt.Sprintf("dir/%02d", i)
+}
+
+func (t *PrefetchBucketTest) fileContents(i int) string {
+	return strings.Repeat(fmt.Sprintf("%02d", i), prefetchFileSize/2)
+}
+
+// Look up the object with the given name, then read it the way the file
+// system does.
+func (t *PrefetchBucketTest) lookUpAndRead(name string) (contents []byte) {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       name,
+			Generation: o.Generation,
+			Range:      &gcs.ByteRange{Start: 0, Limit: o.Size},
+		})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	contents, err = ioutil.ReadAll(rc)
+	AssertEq(nil, err)
+
+	return
+}
+
+func (t *PrefetchBucketTest) listDir() {
+	_, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:    "dir/",
+			Delimiter: "/",
+		})
+
+	AssertEq(nil, err)
+}
+
+// Wait until the supplied condition on the bucket's stats holds, or give up
+// after a while.
+func (t *PrefetchBucketTest) waitFor(cond func(gcsproxy.PrefetchStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(t.bucket.Stats()) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefetchBucketTest) ReadEveryFileInDirectory() {
+	// Replay the trace of "ls -l dir && cat dir/*".
+	t.listDir()
+	for i := 0; i < prefetchNumFiles; i++ {
+		o, err := t.bucket.StatObject(
+			t.ctx,
+			&gcs.StatObjectRequest{Name: t.fileName(i)})
+
+		AssertEq(nil, err)
+		AssertNe(nil, o)
+	}
+
+	for i := 0; i < prefetchNumFiles; i++ {
+		contents := t.lookUpAndRead(t.fileName(i))
+		ExpectEq(t.fileContents(i), string(contents), "i: %d", i)
+	}
+
+	// Every file should have been read from GCS exactly once, many of them
+	// concurrently, and the reads should have been served from what was
+	// prefetched.
+	ExpectEq(prefetchNumFiles, t.wrapped.totalReads())
+	for i := 0; i < prefetchNumFiles; i++ {
+		ExpectEq(1, t.wrapped.reads[t.fileName(i)], "i: %d", i)
+	}
+
+	ExpectGt(t.wrapped.maxInFlight, 1)
+	ExpectLe(t.wrapped.maxInFlight, t.cfg.Concurrency)
+
+	s := t.bucket.Stats()
+	ExpectEq(1, s.Triggered)
+	ExpectEq(prefetchNumFiles, s.Fetched)
+	ExpectEq(prefetchNumFiles, s.Hits)
+	ExpectEq(prefetchNumFiles*prefetchFileSize, s.HitBytes)
+	ExpectEq(0, s.Wasted)
+	ExpectEq(0, s.FetchFailed)
+}
+
+func (t *PrefetchBucketTest) ReadEveryFileWithoutListing() {
+	// Replay the trace of "for f in dir/*; do cat $f; done", where the shell's
+	// globbing isn't visible to us.
+	for i := 0; i < prefetchNumFiles; i++ {
+		contents := t.lookUpAndRead(t.fileName(i))
+		ExpectEq(t.fileContents(i), string(contents), "i: %d", i)
+	}
+
+	// The files read before the prediction was made shouldn't be prefetched,
+	// and no file should be read twice.
+	for i := 0; i < prefetchNumFiles; i++ {
+		ExpectEq(1, t.wrapped.reads[t.fileName(i)], "i: %d", i)
+	}
+
+	s := t.bucket.Stats()
+	ExpectEq(1, s.Triggered)
+	ExpectThat(s.Hits, AllOf(GreaterThan(0), LessOrEqual(prefetchNumFiles)))
+	ExpectEq(s.Fetched, s.Hits)
+	ExpectGt(s.Hits, prefetchNumFiles/2)
+}
+
+func (t *PrefetchBucketTest) LargeObjectsDontTrigger() {
+	for i := 0; i < 2*prefetchTrigger; i++ {
+		_, err := t.bucket.StatObject(
+			t.ctx,
+			&gcs.StatObjectRequest{Name: "dir/large"})
+
+		AssertEq(nil, err)
+	}
+
+	ExpectEq(0, t.bucket.Stats().Triggered)
+	ExpectEq(0, t.wrapped.totalReads())
+}
+
+func (t *PrefetchBucketTest) LargeObjectsNotPrefetched() {
+	t.listDir()
+	for i := 0; i < prefetchTrigger; i++ {
+		t.lookUpAndRead(t.fileName(i))
+	}
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool {
+		return s.Fetched == prefetchNumFiles-prefetchTrigger+1
+	})
+
+	ExpectEq(0, t.wrapped.reads["dir/large"])
+	ExpectEq(0, t.wrapped.reads["other/foo"])
+}
+
+func (t *PrefetchBucketTest) SlowActivityDoesntTrigger() {
+	t.listDir()
+	for i := 0; i < 2*prefetchTrigger; i++ {
+		t.lookUpAndRead(t.fileName(i))
+		t.clock.AdvanceTime(t.cfg.Window)
+	}
+
+	ExpectEq(0, t.bucket.Stats().Triggered)
+}
+
+func (t *PrefetchBucketTest) BudgetEnforced() {
+	const budgetFiles = 5
+	t.cfg.Budget = budgetFiles * prefetchFileSize
+	t.resetBucket()
+
+	// Trigger a prefetch of the whole directory, then read nothing.
+	t.listDir()
+	for i := 0; i < prefetchTrigger; i++ {
+		_, err := t.bucket.StatObject(
+			t.ctx,
+			&gcs.StatObjectRequest{Name: t.fileName(i)})
+
+		AssertEq(nil, err)
+	}
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool {
+		return s.Fetched == budgetFiles
+	})
+
+	// No more than the budget should be fetched, even given time.
+	time.Sleep(10 * t.wrapped.latency)
+
+	s := t.bucket.Stats()
+	ExpectEq(budgetFiles, s.Fetched)
+	ExpectEq(t.cfg.Budget, s.FetchedBytes)
+	ExpectEq(budgetFiles, t.wrapped.totalReads())
+
+	// Once the prefetched files expire, they should be counted as waste, and
+	// nothing further should be fetched.
+	t.clock.AdvanceTime(prefetchTTL + time.Second)
+	_, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "other/foo"})
+
+	AssertEq(nil, err)
+	time.Sleep(10 * t.wrapped.latency)
+
+	s = t.bucket.Stats()
+	ExpectEq(budgetFiles, s.Wasted)
+	ExpectEq(t.cfg.Budget, s.WastedBytes)
+	ExpectEq(budgetFiles, s.Fetched)
+	ExpectEq(budgetFiles, t.wrapped.totalReads())
+}
+
+func (t *PrefetchBucketTest) ReadsFreeBudget() {
+	const budgetFiles = 3
+	t.cfg.Budget = budgetFiles * prefetchFileSize
+	t.resetBucket()
+
+	// Read the whole directory. Despite the small budget, everything after the
+	// prediction should be served from prefetched contents.
+	t.listDir()
+	for i := 0; i < prefetchNumFiles; i++ {
+		contents := t.lookUpAndRead(t.fileName(i))
+		ExpectEq(t.fileContents(i), string(contents), "i: %d", i)
+	}
+
+	s := t.bucket.Stats()
+	ExpectEq(prefetchNumFiles-prefetchTrigger+1, s.Hits)
+	ExpectEq(0, s.Wasted)
+	ExpectEq(prefetchNumFiles, t.wrapped.totalReads())
+}
+
+func (t *PrefetchBucketTest) ObjectOverwritten() {
+	// Cause the directory to be prefetched.
+	t.listDir()
+	for i := 0; i < prefetchTrigger; i++ {
+		t.lookUpAndRead(t.fileName(i))
+	}
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool {
+		return s.Fetched == prefetchNumFiles-prefetchTrigger+1
+	})
+
+	// Overwrite one of the prefetched objects.
+	name := t.fileName(prefetchNumFiles - 1)
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, "burrito")
+	AssertEq(nil, err)
+
+	// Reading it should return the new contents, not the prefetched ones.
+	contents := t.lookUpAndRead(name)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *PrefetchBucketTest) WarmRanges() {
+	const name = "dir/large"
+	o, err := t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+
+	// Warm two chunks of a large object, as if a sibling mount had them.
+	const chunk = 1 << 10
+	t.bucket.Warm([]gcsproxy.PrefetchRange{
+		{Name: name, Generation: o.Generation, Start: 0, Limit: chunk},
+		{Name: name, Generation: o.Generation, Start: 2 * chunk, Limit: 3 * chunk},
+	})
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool { return s.Fetched == 2 })
+	ExpectEq(2, t.wrapped.totalReads())
+
+	// Reads of those chunks, or the start of them, are served without GCS.
+	read := func(start, limit uint64) {
+		rc, err := t.bucket.NewReader(
+			t.ctx,
+			&gcs.ReadObjectRequest{
+				Name:       name,
+				Generation: o.Generation,
+				Range:      &gcs.ByteRange{Start: start, Limit: limit},
+			})
+
+		AssertEq(nil, err)
+		defer rc.Close()
+
+		contents, err := ioutil.ReadAll(rc)
+		AssertEq(nil, err)
+		ExpectEq(strings.Repeat("x", int(limit-start)), string(contents))
+	}
+
+	read(0, chunk)
+	read(2*chunk, 2*chunk+10)
+	ExpectEq(2, t.wrapped.totalReads())
+	ExpectEq(2, t.bucket.Stats().Hits)
+
+	// Each was handed over once; other chunks go to GCS.
+	read(0, chunk)
+	read(chunk, 2*chunk)
+	ExpectEq(4, t.wrapped.totalReads())
+}
+
+func (t *PrefetchBucketTest) WarmRangesForOtherGeneration() {
+	const name = "dir/large"
+	o, err := t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	AssertEq(nil, err)
+
+	// A generation that doesn't exist can't be fetched.
+	t.bucket.Warm([]gcsproxy.PrefetchRange{
+		{Name: name, Generation: o.Generation + 1, Start: 0, Limit: 10},
+	})
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool { return s.FetchFailed == 1 })
+	ExpectEq(1, t.bucket.Stats().FetchFailed)
+
+	// Nor does a fetched range serve reads of another generation.
+	t.bucket.Warm([]gcsproxy.PrefetchRange{
+		{Name: name, Generation: o.Generation, Start: 0, Limit: 10},
+	})
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool { return s.Fetched == 1 })
+
+	_, err = t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       name,
+			Generation: o.Generation + 1,
+			Range:      &gcs.ByteRange{Start: 0, Limit: 10},
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(0, t.bucket.Stats().Hits)
+}
+
+func (t *PrefetchBucketTest) WarmRangesLargerThanBudgetIgnored() {
+	t.cfg.Budget = 100
+	t.resetBucket()
+
+	t.bucket.Warm([]gcsproxy.PrefetchRange{
+		{Name: "dir/large", Generation: 1, Start: 0, Limit: 101},
+		{Name: "other/foo", Generation: 1, Start: 0, Limit: 4},
+	})
+
+	// The second isn't held up behind the first.
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool {
+		return s.Fetched+s.FetchFailed == 1
+	})
+
+	ExpectEq(0, t.wrapped.reads["dir/large"])
+	ExpectEq(1, t.wrapped.reads["other/foo"])
+}
+
+func (t *PrefetchBucketTest) RangesThatDontFitDontHoldUpOthers() {
+	t.cfg.Budget = 2 * prefetchFileSize
+	t.resetBucket()
+
+	gen := func(name string) int64 {
+		o, err := t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+		AssertEq(nil, err)
+		return o.Generation
+	}
+
+	// Once the first is fetched, the second doesn't fit in what remains of the
+	// budget. The third still does.
+	small := t.fileName(0)
+	t.bucket.Warm([]gcsproxy.PrefetchRange{
+		{Name: small, Generation: gen(small), Start: 0, Limit: prefetchFileSize},
+		{Name: "dir/large", Generation: gen("dir/large"), Start: 0, Limit: 3 << 9},
+		{Name: "other/foo", Generation: gen("other/foo"), Start: 0, Limit: 4},
+	})
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool {
+		return s.Fetched+s.FetchFailed == 2
+	})
+
+	ExpectEq(1, t.wrapped.reads[t.fileName(0)])
+	ExpectEq(0, t.wrapped.reads["dir/large"])
+	ExpectEq(1, t.wrapped.reads["other/foo"])
+}
+
+func (t *PrefetchBucketTest) ExpiresWithoutActivity() {
+	t.cfg.TTL = 10 * time.Millisecond
+	t.resetBucket()
+
+	o, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "other/foo"})
+
+	AssertEq(nil, err)
+
+	t.bucket.Warm([]gcsproxy.PrefetchRange{
+		{Name: "other/foo", Generation: o.Generation, Start: 0, Limit: 4},
+	})
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool { return s.Fetched == 1 })
+
+	// Nothing further uses the bucket, but the contents should still be
+	// thrown away once they expire.
+	t.clock.AdvanceTime(t.cfg.TTL + time.Second)
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool { return s.Wasted == 1 })
+
+	ExpectEq(1, t.bucket.Stats().Wasted)
+	ExpectEq(4, t.bucket.Stats().WastedBytes)
+}
+
+func (t *PrefetchBucketTest) AbandonedDownloadCancelled() {
+	t.wrapped.latency = time.Hour
+
+	o, err := t.wrapped.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "other/foo"})
+
+	AssertEq(nil, err)
+
+	t.bucket.Warm([]gcsproxy.PrefetchRange{
+		{Name: "other/foo", Generation: o.Generation, Start: 0, Limit: 4},
+	})
+
+	// A reader that gives up waiting for the download should take the download
+	// with it.
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err = t.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       "other/foo",
+			Generation: o.Generation,
+			Range:      &gcs.ByteRange{Start: 0, Limit: 4},
+		})
+
+	ExpectEq(context.DeadlineExceeded, err)
+
+	t.waitFor(func(s gcsproxy.PrefetchStats) bool { return s.FetchFailed == 1 })
+	ExpectEq(1, t.bucket.Stats().FetchFailed)
+	ExpectEq(0, t.bucket.Stats().Fetched)
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+	"strings"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that exposes only the objects in the wrapped bucket whose
+// names begin with the given prefix, with the prefix removed. For example,
+// with prefix "foo/" the object "foo/bar/baz" appears as "bar/baz", and the
+// object "qux" is invisible.
+//
+// Names are translated in both directions: the prefix is added to every name
+// in a request (including list prefixes and compose sources) and removed from
+// every name in a response. Objects returned by the wrapped bucket are copied
+// before being modified.
+//
+// The prefix should end with a slash, so that listings of the root contain
+// only the children of the corresponding directory and not its siblings.
+func NewPrefixBucket(
+	prefix string,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &prefixBucket{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type prefixBucket struct {
+	prefix  string
+	wrapped gcs.Bucket
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (b *prefixBucket) wrappedName(n string) string {
+	return b.prefix + n
+}
+
+func (b *prefixBucket) localName(n string) string {
+	return strings.TrimPrefix(n, b.prefix)
+}
+
+// Return a copy of the supplied object with its name translated, or nil if o
+// is nil.
+func (b *prefixBucket) localObject(o *gcs.Object) (local *gcs.Object) {
+	if o == nil {
+		return
+	}
+
+	copied := *o
+	copied.Name = b.localName(o.Name)
+	local = &copied
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *prefixBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *prefixBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	wrappedReq := *req
+	wrappedReq.Name = b.wrappedName(req.Name)
+
+	rc, err = b.wrapped.NewReader(ctx, &wrappedReq)
+	return
+}
+
+func (b *prefixBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	wrappedReq := *req
+	wrappedReq.Name = b.wrappedName(req.Name)
+
+	o, err = b.wrapped.CreateObject(ctx, &wrappedReq)
+	o = b.localObject(o)
+	return
+}
+
+func (b *prefixBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	wrappedReq := *req
+	wrappedReq.SrcName = b.wrappedName(req.SrcName)
+	wrappedReq.DstName = b.wrappedName(req.DstName)
+
+	o, err = b.wrapped.CopyObject(ctx, &wrappedReq)
+	o = b.localObject(o)
+	return
+}
+
+func (b *prefixBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	wrappedReq := *req
+	wrappedReq.DstName = b.wrappedName(req.DstName)
+
+	wrappedReq.Sources = make([]gcs.ComposeSource, len(req.Sources))
+	for i, src := range req.Sources {
+		src.Name = b.wrappedName(src.Name)
+		wrappedReq.Sources[i] = src
+	}
+
+	o, err = b.wrapped.ComposeObjects(ctx, &wrappedReq)
+	o = b.localObject(o)
+	return
+}
+
+func (b *prefixBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	wrappedReq := *req
+	wrappedReq.Name = b.wrappedName(req.Name)
+
+	o, err = b.wrapped.StatObject(ctx, &wrappedReq)
+	o = b.localObject(o)
+	return
+}
+
+func (b *prefixBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	wrappedReq := *req
+	wrappedReq.Prefix = b.wrappedName(req.Prefix)
+
+	wrappedListing, err := b.wrapped.ListObjects(ctx, &wrappedReq)
+	if err != nil {
+		return
+	}
+
+	// Translate the names in the listing, leaving the wrapped bucket's copy
+	// alone.
+	listing = &gcs.Listing{
+		ContinuationToken: wrappedListing.ContinuationToken,
+	}
+
+	for _, o := range wrappedListing.Objects {
+		listing.Objects = append(listing.Objects, b.localObject(o))
+	}
+
+	for _, run := range wrappedListing.CollapsedRuns {
+		listing.CollapsedRuns = append(listing.CollapsedRuns, b.localName(run))
+	}
+
+	return
+}
+
+func (b *prefixBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	wrappedReq := *req
+	wrappedReq.Name = b.wrappedName(req.Name)
+
+	o, err = b.wrapped.UpdateObject(ctx, &wrappedReq)
+	o = b.localObject(o)
+	return
+}
+
+func (b *prefixBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	wrappedReq := *req
+	wrappedReq.Name = b.wrappedName(req.Name)
+
+	err = b.wrapped.DeleteObject(ctx, &wrappedReq)
+	return
+}
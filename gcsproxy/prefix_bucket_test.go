@@ -0,0 +1,239 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPrefixBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PrefixBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &PrefixBucketTest{}
+
+func init() { RegisterTestSuite(&PrefixBucketTest{}) }
+
+func (t *PrefixBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsproxy.NewPrefixBucket("foo/", t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefixBucketTest) Name() {
+	ExpectEq("some_bucket", t.bucket.Name())
+}
+
+func (t *PrefixBucketTest) CreateAndRead() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", "taco")
+	AssertEq(nil, err)
+	ExpectEq("bar", o.Name)
+
+	// The object should be visible in the wrapped bucket with the prefix.
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "foo/bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// And readable through the prefix bucket without it.
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *PrefixBucketTest) StatObject() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "foo/bar", "taco")
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	AssertEq(nil, err)
+	ExpectEq("bar", o.Name)
+	ExpectEq(len("taco"), o.Size)
+
+	// The wrapped bucket's view of the object should be unaffected.
+	o, err = t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo/bar"})
+	AssertEq(nil, err)
+	ExpectEq("foo/bar", o.Name)
+}
+
+func (t *PrefixBucketTest) ObjectsOutsidePrefixAreInvisible() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "bar", "taco")
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *PrefixBucketTest) ListRootDoesntLeakSiblings() {
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.wrapped,
+		[]string{
+			"bar",
+			"foo",
+			"foo/",
+			"foo/baz",
+			"foo/qux/",
+			"foo/qux/norf",
+			"foobar/",
+			"foobar/baz",
+			"fop/baz",
+		})
+
+	AssertEq(nil, err)
+
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Delimiter: "/"})
+
+	AssertEq(nil, err)
+	AssertEq("", listing.ContinuationToken)
+
+	var names []string
+	for _, o := range listing.Objects {
+		names = append(names, o.Name)
+	}
+
+	ExpectThat(names, ElementsAre("", "baz"))
+	ExpectThat(listing.CollapsedRuns, ElementsAre("qux/"))
+}
+
+func (t *PrefixBucketTest) ListWithPrefix() {
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.wrapped,
+		[]string{
+			"qux/a",
+			"foo/qux/a",
+			"foo/qux/b/c",
+		})
+
+	AssertEq(nil, err)
+
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: "qux/", Delimiter: "/"})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+	ExpectEq("qux/a", listing.Objects[0].Name)
+	ExpectThat(listing.CollapsedRuns, ElementsAre("qux/b/"))
+}
+
+func (t *PrefixBucketTest) CopyObject() {
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", "taco")
+	AssertEq(nil, err)
+
+	o, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{
+			SrcName:       "bar",
+			DstName:       "baz",
+			SrcGeneration: src.Generation,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("baz", o.Name)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "foo/baz")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *PrefixBucketTest) ComposeObjects() {
+	a, err := gcsutil.CreateObject(t.ctx, t.bucket, "a", "taco")
+	AssertEq(nil, err)
+
+	b, err := gcsutil.CreateObject(t.ctx, t.bucket, "b", "burrito")
+	AssertEq(nil, err)
+
+	o, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "c",
+			Sources: []gcs.ComposeSource{
+				{Name: "a", Generation: a.Generation},
+				{Name: "b", Generation: b.Generation},
+			},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("c", o.Name)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "foo/c")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *PrefixBucketTest) UpdateObject() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", "taco")
+	AssertEq(nil, err)
+
+	contentType := "text/plain"
+	o, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:        "bar",
+			ContentType: &contentType,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("bar", o.Name)
+	ExpectEq(contentType, o.ContentType)
+}
+
+func (t *PrefixBucketTest) DeleteObject() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "bar", "taco")
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "foo/bar", "burrito")
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "bar"})
+	AssertEq(nil, err)
+
+	// Only the object under the prefix should be gone.
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.wrapped,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(objects))
+	ExpectEq("bar", objects[0].Name)
+}
@@ -0,0 +1,288 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// Counters describing the history of a PublicReadBucket.
+type PublicReadStats struct {
+	// The number of reads that failed for want of credentials but were then
+	// served anonymously.
+	Fallbacks uint64
+
+	// The number of times an anonymous read failed too, disabling the
+	// fallback for a while.
+	Disabled uint64
+}
+
+// A bucket that serves reads of object contents anonymously when they fail for
+// want of valid credentials, e.g. while a token can't be refreshed during
+// credential rotation. This helps only for buckets whose objects are publicly
+// readable, so the fallback is used only if the bucket was found to be so when
+// mounting. Metadata requests and writes are never retried anonymously.
+//
+// If an anonymous read fails, the fallback is disabled for a while rather than
+// doubling the latency of every failure; the next authentication failure after
+// that serves as a fresh probe.
+type PublicReadBucket interface {
+	gcs.Bucket
+
+	// Return a snapshot of the bucket's counters.
+	Stats() (s PublicReadStats)
+}
+
+// Create a bucket that falls back to reading through anonymous, a bucket that
+// sends no credentials, if public is true. Otherwise the fallback is never
+// used. After an anonymous read fails, the fallback is disabled for the given
+// period.
+func NewPublicReadBucket(
+	anonymous gcs.Bucket,
+	public bool,
+	disablePeriod time.Duration,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b PublicReadBucket) {
+	b = &publicReadBucket{
+		clock:         clock,
+		wrapped:       wrapped,
+		anonymous:     anonymous,
+		public:        public,
+		disablePeriod: disablePeriod,
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Is the supplied error from an authenticated request one that an anonymous
+// request might avoid? That is, are our credentials themselves the problem?
+func isAuthError(err error) bool {
+	if typed, ok := err.(*googleapi.Error); ok {
+		return typed.Code == http.StatusUnauthorized
+	}
+
+	// Failures to obtain a token in the first place don't reach GCS at all, and
+	// come back from the oauth2 package as plain errors.
+	return err != nil &&
+		strings.Contains(err.Error(), "oauth2: cannot fetch token")
+}
+
+type publicReadBucket struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	clock     timeutil.Clock
+	wrapped   gcs.Bucket
+	anonymous gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	public        bool
+	disablePeriod time.Duration
+
+	/////////////////////////
+	// Counters
+	/////////////////////////
+
+	// Accessed atomically.
+	fallbacks uint64
+	disabled  uint64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The fallback is not to be used before this time.
+	//
+	// GUARDED_BY(mu)
+	disabledUntil time.Time
+
+	// Are we in the middle of an episode of serving reads anonymously? Cleared
+	// when an authenticated read succeeds, so that we warn once per episode.
+	//
+	// GUARDED_BY(mu)
+	inEpisode bool
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *publicReadBucket) fallbackEnabled() bool {
+	if !b.public {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.clock.Now().Before(b.disabledUntil)
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *publicReadBucket) authenticatedReadSucceeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.inEpisode {
+		b.inEpisode = false
+		log.Println("Authenticated reads are working again.")
+	}
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *publicReadBucket) fallbackSucceeded(authErr error) {
+	atomic.AddUint64(&b.fallbacks, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.inEpisode {
+		b.inEpisode = true
+		log.Printf(
+			"Warning: authenticated reads are failing (%v); reading anonymously "+
+				"until they recover.",
+			authErr)
+	}
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *publicReadBucket) fallbackFailed(anonErr error) {
+	atomic.AddUint64(&b.disabled, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.disabledUntil = b.clock.Now().Add(b.disablePeriod)
+	logger.Errorf(
+		"Anonymous read failed (%v); not falling back for %v.",
+		anonErr,
+		b.disablePeriod)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *publicReadBucket) Stats() (s PublicReadStats) {
+	s = PublicReadStats{
+		Fallbacks: atomic.LoadUint64(&b.fallbacks),
+		Disabled:  atomic.LoadUint64(&b.disabled),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *publicReadBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *publicReadBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err == nil {
+		b.authenticatedReadSucceeded()
+		return
+	}
+
+	if !isAuthError(err) || !b.fallbackEnabled() {
+		return
+	}
+
+	// Retry the same request, range and all, without credentials. If that
+	// fails too, report the original error.
+	anonRC, anonErr := b.anonymous.NewReader(ctx, req)
+	if anonErr != nil {
+		b.fallbackFailed(anonErr)
+		return
+	}
+
+	b.fallbackSucceeded(err)
+	rc, err = anonRC, nil
+	return
+}
+
+func (b *publicReadBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *publicReadBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *publicReadBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *publicReadBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *publicReadBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *publicReadBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *publicReadBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
@@ -0,0 +1,292 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestPublicReadBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// rejectingBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that fails every call with err if it is non-nil, counting calls.
+type rejectingBucket struct {
+	gcs.Bucket
+	err   error
+	calls int
+}
+
+func (b *rejectingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.calls++
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+func (b *rejectingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.calls++
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *rejectingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.calls++
+	if b.err != nil {
+		err = b.err
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const publicReadDisablePeriod = time.Minute
+
+type PublicReadBucketTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+
+	// Authenticated and anonymous views of the same underlying bucket.
+	authed rejectingBucket
+	anon   rejectingBucket
+
+	logs bytes.Buffer
+
+	bucket gcsproxy.PublicReadBucket
+}
+
+var _ SetUpInterface = &PublicReadBucketTest{}
+var _ TearDownInterface = &PublicReadBucketTest{}
+
+func init() { RegisterTestSuite(&PublicReadBucketTest{}) }
+
+func (t *PublicReadBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	fake := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.authed.Bucket = fake
+	t.anon.Bucket = fake
+
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		fake,
+		map[string]string{"foo": "taco"})
+
+	AssertEq(nil, err)
+
+	log.SetOutput(&t.logs)
+	t.bucket = t.newBucket(true)
+}
+
+func (t *PublicReadBucketTest) TearDown() {
+	log.SetOutput(os.Stderr)
+}
+
+func (t *PublicReadBucketTest) newBucket(public bool) gcsproxy.PublicReadBucket {
+	return gcsproxy.NewPublicReadBucket(
+		&t.anon,
+		public,
+		publicReadDisablePeriod,
+		&t.clock,
+		&t.authed)
+}
+
+func (t *PublicReadBucketTest) read(
+	b gcs.Bucket,
+	r *gcs.ByteRange) (contents string, err error) {
+	rc, err := b.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo", Range: r})
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	contents = string(buf)
+	return
+}
+
+func (t *PublicReadBucketTest) rejectCredentials() {
+	t.authed.err = &googleapi.Error{Code: 401, Message: "Invalid Credentials"}
+}
+
+func (t *PublicReadBucketTest) warnings() int {
+	return strings.Count(t.logs.String(), "reading anonymously")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PublicReadBucketTest) AuthenticatedReadsSucceed() {
+	contents, err := t.read(t.bucket, nil)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	ExpectEq(0, t.anon.calls)
+	ExpectEq(0, t.bucket.Stats().Fallbacks)
+}
+
+func (t *PublicReadBucketTest) ReadsFallBackTransparently() {
+	t.rejectCredentials()
+
+	contents, err := t.read(t.bucket, nil)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+
+	// The range is preserved.
+	contents, err = t.read(t.bucket, &gcs.ByteRange{Start: 1, Limit: 3})
+	AssertEq(nil, err)
+	ExpectEq("ac", contents)
+
+	ExpectEq(2, t.bucket.Stats().Fallbacks)
+}
+
+func (t *PublicReadBucketTest) TokenFetchFailuresFallBack() {
+	t.authed.err = &tokenError{}
+
+	contents, err := t.read(t.bucket, nil)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+}
+
+func (t *PublicReadBucketTest) WarnsOncePerEpisode() {
+	t.rejectCredentials()
+	for i := 0; i < 3; i++ {
+		_, err := t.read(t.bucket, nil)
+		AssertEq(nil, err)
+	}
+
+	ExpectEq(1, t.warnings())
+
+	// Credentials recover, then fail again.
+	t.authed.err = nil
+	_, err := t.read(t.bucket, nil)
+	AssertEq(nil, err)
+	ExpectThat(t.logs.String(), HasSubstr("working again"))
+
+	t.rejectCredentials()
+	_, err = t.read(t.bucket, nil)
+	AssertEq(nil, err)
+
+	ExpectEq(2, t.warnings())
+}
+
+func (t *PublicReadBucketTest) OtherErrorsNotRetried() {
+	t.authed.err = &googleapi.Error{Code: 403, Message: "Forbidden"}
+
+	_, err := t.read(t.bucket, nil)
+	ExpectThat(err, HasSameTypeAs(&googleapi.Error{}))
+	ExpectEq(0, t.anon.calls)
+}
+
+func (t *PublicReadBucketTest) WritesNotRetried() {
+	t.rejectCredentials()
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "bar", "burrito")
+	ExpectThat(err, Error(HasSubstr("Invalid Credentials")))
+	ExpectEq(0, t.anon.calls)
+}
+
+func (t *PublicReadBucketTest) MetadataNotRetried() {
+	t.rejectCredentials()
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, Error(HasSubstr("Invalid Credentials")))
+	ExpectEq(0, t.anon.calls)
+}
+
+func (t *PublicReadBucketTest) PrivateBucket() {
+	b := t.newBucket(false)
+	t.rejectCredentials()
+
+	_, err := t.read(b, nil)
+	ExpectThat(err, Error(HasSubstr("Invalid Credentials")))
+	ExpectEq(0, t.anon.calls)
+	ExpectEq(0, t.warnings())
+}
+
+func (t *PublicReadBucketTest) AnonymousFailureDisablesFallback() {
+	t.rejectCredentials()
+	t.anon.err = &googleapi.Error{Code: 403, Message: "Anonymous caller"}
+
+	// The original error is reported.
+	_, err := t.read(t.bucket, nil)
+	ExpectThat(err, Error(HasSubstr("Invalid Credentials")))
+	ExpectEq(1, t.anon.calls)
+	ExpectEq(1, t.bucket.Stats().Disabled)
+
+	// For a while, we don't try again.
+	t.clock.AdvanceTime(publicReadDisablePeriod - time.Second)
+	_, err = t.read(t.bucket, nil)
+	ExpectThat(err, Error(HasSubstr("Invalid Credentials")))
+	ExpectEq(1, t.anon.calls)
+
+	// After that, the next failure probes again.
+	t.anon.err = nil
+	t.clock.AdvanceTime(time.Second)
+
+	contents, err := t.read(t.bucket, nil)
+	AssertEq(nil, err)
+	ExpectEq("taco", contents)
+	ExpectEq(2, t.anon.calls)
+}
+
+// An error like the one returned by the oauth2 package when it can't refresh
+// a token.
+type tokenError struct{}
+
+func (e *tokenError) Error() string {
+	return "Get https://...: oauth2: cannot fetch token: 400 Bad Request"
+}
@@ -31,13 +31,27 @@ import (
 // contain a lease for the contents of the object and will be used when
 // possible instead of re-reading the object.
 //
+// Leases obtained by the proxy are tagged with LeaseTag for the generation.
+//
 // If the object is larger than the given chunk size, we will only read
-// and cache portions of it at a time.
+// and cache portions of it at a time. In that case, up to readaheadChunks
+// chunks are fetched ahead of sequential reads; see lease.NewMultiReadProxy.
+//
+// If evictions is non-nil, it is told of each fetch so that it can count
+// those made necessary by the leaser evicting contents.
+//
+// If validateChecksums is set, the contents of each fetch are checked as they
+// arrive: the whole object against the CRC32C checksum in o, and each chunk
+// against its expected size. If they are wrong, they are fetched once more
+// before failing with a *ChecksumError.
 func NewReadProxy(
 	o *gcs.Object,
 	rl lease.ReadLease,
 	chunkSize uint64,
+	readaheadChunks int,
+	validateChecksums bool,
 	leaser lease.FileLeaser,
+	evictions *EvictionTracker,
 	bucket gcs.Bucket) (rp lease.ReadProxy) {
 	// Sanity check: the read lease's size should match the object's size if it
 	// is present.
@@ -50,11 +64,17 @@ func NewReadProxy(
 
 	// Special case: don't bring in the complication of a multi-read proxy if we
 	// have only one refresher.
-	refreshers := makeRefreshers(chunkSize, o, bucket)
+	refreshers := makeRefreshers(
+		chunkSize,
+		o,
+		validateChecksums,
+		evictions,
+		bucket)
+
 	if len(refreshers) == 1 {
 		rp = lease.NewReadProxy(leaser, refreshers[0], rl)
 	} else {
-		rp = lease.NewMultiReadProxy(leaser, refreshers, rl)
+		rp = lease.NewMultiReadProxy(leaser, refreshers, readaheadChunks, rl)
 	}
 
 	return
@@ -67,6 +87,8 @@ func NewReadProxy(
 func makeRefreshers(
 	chunkSize uint64,
 	o *gcs.Object,
+	validateChecksums bool,
+	evictions *EvictionTracker,
 	bucket gcs.Bucket) (refreshers []lease.Refresher) {
 	// Iterate over each chunk of the object.
 	for startOff := uint64(0); startOff < o.Size; startOff += chunkSize {
@@ -78,9 +100,11 @@ func makeRefreshers(
 		}
 
 		refresher := &objectRefresher{
-			O:      o,
-			Bucket: bucket,
-			Range:  &r,
+			O:                 o,
+			Bucket:            bucket,
+			Evictions:         evictions,
+			Range:             &r,
+			ValidateChecksums: validateChecksums,
 		}
 
 		refreshers = append(refreshers, refresher)
@@ -91,12 +115,20 @@ func makeRefreshers(
 
 // A refresher that returns the contents of a particular generation of a GCS
 // object. Optionally, only a particular range is returned.
+//
+// If ValidateChecksums is set, the returned read-closer fails with a
+// *ChecksumError if the contents are the wrong size or, when they are the
+// whole object, don't match its CRC32C checksum.
 type objectRefresher struct {
-	Bucket gcs.Bucket
-	O      *gcs.Object
-	Range  *gcs.ByteRange
+	Bucket            gcs.Bucket
+	Evictions         *EvictionTracker // May be nil
+	O                 *gcs.Object
+	Range             *gcs.ByteRange
+	ValidateChecksums bool
 }
 
+var _ lease.TaggedRefresher = &objectRefresher{}
+
 func (r *objectRefresher) Size() (size int64) {
 	if r.Range != nil {
 		size = int64(r.Range.Limit - r.Range.Start)
@@ -107,8 +139,17 @@ func (r *objectRefresher) Size() (size int64) {
 	return
 }
 
+func (r *objectRefresher) Tag() (tag string) {
+	tag = LeaseTag(r.O.Name, r.O.Generation)
+	return
+}
+
 func (r *objectRefresher) Refresh(
 	ctx context.Context) (rc io.ReadCloser, err error) {
+	if r.Evictions != nil {
+		r.Evictions.noteRefresh(r.Tag())
+	}
+
 	req := &gcs.ReadObjectRequest{
 		Name:       r.O.Name,
 		Generation: r.O.Generation,
@@ -121,5 +162,36 @@ func (r *objectRefresher) Refresh(
 		return
 	}
 
+	if r.ValidateChecksums {
+		rc = r.checkContents(rc)
+	}
+
+	return
+}
+
+// Wrap the supplied read-closer for our contents in one that checks them.
+func (r *objectRefresher) checkContents(
+	rc io.ReadCloser) (cr *checksumReader) {
+	ce := ChecksumError{
+		Name:       r.O.Name,
+		Generation: r.O.Generation,
+		WantSize:   r.Size(),
+	}
+
+	// Only whole objects have a checksum to compare against. GCS records one
+	// for every object, so a zero checksum on a non-empty object means that it
+	// didn't come from GCS (e.g. it was made up by a test); the odds of it
+	// being genuine are too small to worry about.
+	whole := r.Range == nil || (r.Range.Start == 0 && r.Range.Limit == r.O.Size)
+	if !whole {
+		ce.Range = r.Range
+	}
+
+	var crc32c *uint32
+	if whole && (r.O.CRC32C != 0 || r.O.Size == 0) {
+		crc32c = &r.O.CRC32C
+	}
+
+	cr = newChecksumReader(rc, ce, crc32c)
 	return
 }
@@ -0,0 +1,382 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Options controlling what a bucket created with NewRecordBucket leaves out of
+// its cassette. Object owners are always removed, and continuation tokens are
+// always replaced with placeholders.
+type ScrubOptions struct {
+	// Replace the name of the bucket, wherever it appears, with a placeholder.
+	BucketName bool
+}
+
+// The placeholder used for scrubbed bucket names.
+const scrubbedBucketName = "some-bucket"
+
+// The largest contents kept verbatim in a cassette. Replay synthesizes
+// anything larger.
+const maxRecordedPayload = 4096
+
+// Create a bucket that passes calls through to the wrapped bucket, recording
+// each of them, with the request and the response, into a cassette that can
+// later be played back with NewReplayBucket.
+func NewRecordBucket(
+	wrapped gcs.Bucket,
+	scrub ScrubOptions) (b *RecordBucket) {
+	b = &RecordBucket{
+		wrapped: wrapped,
+		scrub:   scrub,
+		tokens:  make(map[string]string),
+	}
+
+	b.cassette.BucketName = b.scrubString(wrapped.Name())
+	return
+}
+
+// A bucket that records calls into a cassette. See NewRecordBucket.
+type RecordBucket struct {
+	wrapped gcs.Bucket
+	scrub   ScrubOptions
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	cassette Cassette
+
+	// Placeholders handed out for continuation tokens, indexed by real token.
+	//
+	// GUARDED_BY(mu)
+	tokens map[string]string
+}
+
+var _ gcs.Bucket = &RecordBucket{}
+
+// Return the cassette recorded so far. Readers returned by NewReader fill in
+// their contents when closed, so this should be called once they all have
+// been.
+func (b *RecordBucket) Cassette() (c *Cassette) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c = &Cassette{
+		BucketName:   b.cassette.BucketName,
+		Interactions: append([]*Interaction(nil), b.cassette.Interactions...),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (b *RecordBucket) scrubString(s string) string {
+	if b.scrub.BucketName {
+		s = strings.Replace(s, b.wrapped.Name(), scrubbedBucketName, -1)
+	}
+
+	return s
+}
+
+// Return the placeholder for the supplied continuation token.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *RecordBucket) scrubToken(t string) (placeholder string) {
+	if t == "" {
+		return
+	}
+
+	placeholder, ok := b.tokens[t]
+	if !ok {
+		placeholder = fmt.Sprintf("token-%d", len(b.tokens)+1)
+		b.tokens[t] = placeholder
+	}
+
+	return
+}
+
+// Return a scrubbed copy of the supplied object, or nil if it is nil.
+func (b *RecordBucket) scrubObject(o *gcs.Object) (scrubbed *gcs.Object) {
+	if o == nil {
+		return
+	}
+
+	copied := *o
+	copied.Owner = ""
+	copied.MediaLink = b.scrubString(o.MediaLink)
+	scrubbed = &copied
+
+	return
+}
+
+// Return a scrubbed copy of the supplied listing, or nil if it is nil.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *RecordBucket) scrubListing(
+	l *gcs.Listing) (scrubbed *gcs.Listing) {
+	if l == nil {
+		return
+	}
+
+	scrubbed = &gcs.Listing{
+		CollapsedRuns:     l.CollapsedRuns,
+		ContinuationToken: b.scrubToken(l.ContinuationToken),
+	}
+
+	for _, o := range l.Objects {
+		scrubbed.Objects = append(scrubbed.Objects, b.scrubObject(o))
+	}
+
+	return
+}
+
+func (b *RecordBucket) scrubError(err error) (re *RecordedError) {
+	re = recordError(err)
+	if re != nil {
+		re.Message = b.scrubString(re.Message)
+	}
+
+	return
+}
+
+// Append an interaction to the cassette, returning it.
+func (b *RecordBucket) record(
+	method string,
+	req json.RawMessage,
+	o *gcs.Object,
+	err error) (in *Interaction) {
+	in = &Interaction{
+		Method:  method,
+		Request: req,
+		Object:  b.scrubObject(o),
+		Error:   b.scrubError(err),
+	}
+
+	b.mu.Lock()
+	b.cassette.Interactions = append(b.cassette.Interactions, in)
+	b.mu.Unlock()
+
+	return
+}
+
+// Encode a request, panicking on failure. Requests are plain data, so this
+// can fail only due to a bug.
+func mustEncodeRequest(
+	req interface{},
+	extra map[string]interface{}) (enc json.RawMessage) {
+	enc, err := encodeRequest(req, extra)
+	if err != nil {
+		panic(fmt.Sprintf("encodeRequest: %v", err))
+	}
+
+	return
+}
+
+// A reader that hashes and counts what passes through it.
+type hashingReader struct {
+	wrapped io.Reader
+	h       hash.Hash
+	n       int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{
+		wrapped: r,
+		h:       sha256.New(),
+	}
+}
+
+func (r *hashingReader) Read(p []byte) (n int, err error) {
+	n, err = r.wrapped.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return
+}
+
+func (r *hashingReader) Sum() string {
+	return hex.EncodeToString(r.h.Sum(nil))
+}
+
+// Wraps a reader returned by the wrapped bucket, filling in the contents of
+// the interaction when closed.
+type recordingReader struct {
+	bucket *RecordBucket
+	in     *Interaction
+	rc     io.ReadCloser
+	hr     *hashingReader
+
+	// The contents read so far, while small enough to keep.
+	data    []byte
+	readErr error
+}
+
+func (r *recordingReader) Read(p []byte) (n int, err error) {
+	n, err = r.hr.Read(p)
+
+	if r.hr.n <= maxRecordedPayload {
+		r.data = append(r.data, p[:n]...)
+	}
+
+	if err != nil && err != io.EOF && r.readErr == nil {
+		r.readErr = err
+	}
+
+	return
+}
+
+func (r *recordingReader) Close() (err error) {
+	contents := &RecordedContents{
+		Size:      r.hr.n,
+		SHA256:    r.hr.Sum(),
+		ReadError: r.bucket.scrubError(r.readErr),
+	}
+
+	if r.hr.n <= maxRecordedPayload {
+		contents.Data = r.data
+	}
+
+	r.bucket.mu.Lock()
+	r.in.Contents = contents
+	r.bucket.mu.Unlock()
+
+	err = r.rc.Close()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *RecordBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *RecordBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	in := b.record("NewReader", mustEncodeRequest(req, nil), nil, err)
+	if err != nil {
+		return
+	}
+
+	rc = &recordingReader{
+		bucket: b,
+		in:     in,
+		rc:     rc,
+		hr:     newHashingReader(rc),
+	}
+
+	return
+}
+
+func (b *RecordBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	// Hash the contents as they are consumed, consuming whatever the wrapped
+	// bucket didn't so that the hash doesn't depend on where it stopped.
+	hr := newHashingReader(req.Contents)
+
+	wrappedReq := *req
+	wrappedReq.Contents = hr
+
+	o, err = b.wrapped.CreateObject(ctx, &wrappedReq)
+	io.Copy(ioutil.Discard, hr)
+
+	wrappedReq.Contents = nil
+	enc := mustEncodeRequest(&wrappedReq, map[string]interface{}{
+		"ContentsSize":   hr.n,
+		"ContentsSHA256": hr.Sum(),
+	})
+
+	b.record("CreateObject", enc, o, err)
+	return
+}
+
+func (b *RecordBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.CopyObject(ctx, req)
+	b.record("CopyObject", mustEncodeRequest(req, nil), o, err)
+	return
+}
+
+func (b *RecordBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	b.record("ComposeObjects", mustEncodeRequest(req, nil), o, err)
+	return
+}
+
+func (b *RecordBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.StatObject(ctx, req)
+	b.record("StatObject", mustEncodeRequest(req, nil), o, err)
+	return
+}
+
+func (b *RecordBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.wrapped.ListObjects(ctx, req)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	recordedReq := *req
+	recordedReq.ContinuationToken = b.scrubToken(req.ContinuationToken)
+
+	b.cassette.Interactions = append(b.cassette.Interactions, &Interaction{
+		Method:  "ListObjects",
+		Request: mustEncodeRequest(&recordedReq, nil),
+		Listing: b.scrubListing(listing),
+		Error:   b.scrubError(err),
+	})
+
+	return
+}
+
+func (b *RecordBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	b.record("UpdateObject", mustEncodeRequest(req, nil), o, err)
+	return
+}
+
+func (b *RecordBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.wrapped.DeleteObject(ctx, req)
+	b.record("DeleteObject", mustEncodeRequest(req, nil), nil, err)
+	return
+}
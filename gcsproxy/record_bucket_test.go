@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestRecordBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RecordBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped gcs.Bucket
+	bucket  *gcsproxy.RecordBucket
+}
+
+var _ SetUpInterface = &RecordBucketTest{}
+
+func init() { RegisterTestSuite(&RecordBucketTest{}) }
+
+func (t *RecordBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	// The fake bucket's media links contain "fake", which lets us check that
+	// the bucket name is scrubbed from them.
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "fake")
+	t.bucket = gcsproxy.NewRecordBucket(t.wrapped, gcsproxy.ScrubOptions{})
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RecordBucketTest) PassesThrough() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.wrapped, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// The caller sees the real object.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("user-fake", o.Owner)
+}
+
+func (t *RecordBucketTest) RecordsRequestsAndResponses() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	c := t.bucket.Cassette()
+	ExpectEq("fake", c.BucketName)
+	AssertEq(2, len(c.Interactions))
+
+	// Create: the contents are represented by their size and hash.
+	in := c.Interactions[0]
+	ExpectEq("CreateObject", in.Method)
+	ExpectThat(string(in.Request), HasSubstr(`"Name":"foo"`))
+	ExpectThat(string(in.Request), HasSubstr(`"ContentsSize":4`))
+	ExpectThat(string(in.Request), HasSubstr(sha256Hex("taco")))
+	AssertNe(nil, in.Object)
+	ExpectEq("foo", in.Object.Name)
+	ExpectEq(nil, in.Error)
+
+	// Stat: the error kind is kept.
+	in = c.Interactions[1]
+	ExpectEq("StatObject", in.Method)
+	ExpectEq(`{"Name":"bar"}`, string(in.Request))
+	ExpectEq(nil, in.Object)
+	AssertNe(nil, in.Error)
+	ExpectEq("NotFound", in.Error.Kind)
+}
+
+func (t *RecordBucketTest) RecordsContentsOnClose() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped, "small", "taco")
+	AssertEq(nil, err)
+
+	large := strings.Repeat("x", 1<<16)
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped, "large", large)
+	AssertEq(nil, err)
+
+	for _, name := range []string{"small", "large"} {
+		contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+		AssertEq(nil, err)
+		ExpectEq(name == "small", string(contents) == "taco")
+	}
+
+	c := t.bucket.Cassette()
+	AssertEq(2, len(c.Interactions))
+
+	// Small contents are kept verbatim.
+	rc := c.Interactions[0].Contents
+	AssertNe(nil, rc)
+	ExpectEq(4, rc.Size)
+	ExpectEq(sha256Hex("taco"), rc.SHA256)
+	ExpectEq("taco", string(rc.Data))
+
+	// Large ones only by size and hash.
+	rc = c.Interactions[1].Contents
+	AssertNe(nil, rc)
+	ExpectEq(len(large), rc.Size)
+	ExpectEq(sha256Hex(large), rc.SHA256)
+	ExpectEq(nil, rc.Data)
+}
+
+func (t *RecordBucketTest) ScrubsOwnersAndTokens() {
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, "")
+		AssertEq(nil, err)
+	}
+
+	// List one at a time, following continuation tokens.
+	req := &gcs.ListObjectsRequest{MaxResults: 1}
+	for {
+		listing, err := t.bucket.ListObjects(t.ctx, req)
+		AssertEq(nil, err)
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	c := t.bucket.Cassette()
+	AssertEq(3, len(c.Interactions))
+
+	// Tokens are replaced with placeholders, consistently between the listing
+	// that returned them and the request that used them.
+	l0 := c.Interactions[0].Listing
+	AssertNe(nil, l0)
+	ExpectEq("token-1", l0.ContinuationToken)
+	ExpectThat(string(c.Interactions[1].Request), HasSubstr(`"token-1"`))
+	ExpectEq("token-2", c.Interactions[1].Listing.ContinuationToken)
+	ExpectThat(string(c.Interactions[2].Request), HasSubstr(`"token-2"`))
+
+	// Owners are removed.
+	AssertEq(1, len(l0.Objects))
+	ExpectEq("", l0.Objects[0].Owner)
+}
+
+func (t *RecordBucketTest) ScrubsBucketName() {
+	t.bucket = gcsproxy.NewRecordBucket(
+		t.wrapped,
+		gcsproxy.ScrubOptions{BucketName: true})
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	c := t.bucket.Cassette()
+	ExpectEq("some-bucket", c.BucketName)
+
+	var buf bytes.Buffer
+	AssertEq(nil, c.Encode(&buf))
+	ExpectFalse(strings.Contains(buf.String(), "fake"), "%s", buf.String())
+
+	AssertEq(1, len(c.Interactions))
+	ExpectThat(c.Interactions[0].Object.MediaLink, HasSubstr("some-bucket"))
+}
+
+func (t *RecordBucketTest) EncodeAndDecode() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	var buf bytes.Buffer
+	AssertEq(nil, t.bucket.Cassette().Encode(&buf))
+
+	c, err := gcsproxy.DecodeCassette(ioutil.NopCloser(&buf))
+	AssertEq(nil, err)
+	ExpectEq("fake", c.BucketName)
+	AssertEq(1, len(c.Interactions))
+	ExpectEq("CreateObject", c.Interactions[0].Method)
+	ExpectEq("foo", c.Interactions[0].Object.Name)
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+)
+
+// A cache of the most recent known object record for each name, or of the
+// knowledge that there is no object with the name, shared by everything that
+// sees records for the bucket. Safe for concurrent access.
+//
+// Every record, whatever its source, goes in through Offer, which is the only
+// place that decides whether it is fresher than what is already known.
+type RecordCache struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	clock timeutil.Clock
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	policy *StatTTLPolicy
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// Values are of type recordCacheEntry.
+	//
+	// GUARDED_BY(mu)
+	entries lrucache.Cache
+}
+
+// An entry in the cache. A nil object means there was no object with the
+// name as of the time observed.
+type recordCacheEntry struct {
+	o          *gcs.Object
+	observed   time.Time
+	expiration time.Time
+}
+
+// Create a cache holding entries for at most the given number of names, which
+// must be positive, for as long as the policy says.
+func NewRecordCache(
+	capacity int,
+	policy *StatTTLPolicy,
+	clock timeutil.Clock) (rc *RecordCache) {
+	rc = &RecordCache{
+		clock:   clock,
+		policy:  policy,
+		entries: lrucache.New(capacity),
+	}
+
+	return
+}
+
+// Should a record (or nil for none) observed at the given time replace the
+// existing entry?
+func fresher(o *gcs.Object, observed time.Time, existing recordCacheEntry) bool {
+	// Generations only ever increase, so when both records are for objects the
+	// higher generation wins no matter when either was observed. Break ties on
+	// metadata generation, then in favour of the newcomer so that the
+	// expiration is pushed back.
+	if o != nil && existing.o != nil {
+		if o.Generation != existing.o.Generation {
+			return o.Generation > existing.o.Generation
+		}
+
+		return o.MetaGeneration >= existing.o.MetaGeneration
+	}
+
+	// Otherwise at least one side says there's no object, and we can only go by
+	// when each was known to be true. A listing page that was requested before
+	// a deletion completed mustn't bring the object back, and a stat that
+	// failed before a creation completed mustn't hide it.
+	return !observed.Before(existing.observed)
+}
+
+// Offer what is known about the object with the given name: its record, or
+// nil if it doesn't exist. observed is a time at which this was true, which
+// for a response from GCS should be the time at which the request was sent,
+// and for the result of a mutation the time at which it completed.
+//
+// The offer is ignored if the policy doesn't cache the name, or if the cache
+// already holds something fresher.
+func (rc *RecordCache) Offer(name string, o *gcs.Object, observed time.Time) {
+	ttl := rc.policy.TTL(name)
+	if ttl == 0 {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if v := rc.entries.LookUp(name); v != nil {
+		if !fresher(o, observed, v.(recordCacheEntry)) {
+			return
+		}
+	}
+
+	rc.entries.Insert(name, recordCacheEntry{
+		o:          o,
+		observed:   observed,
+		expiration: observed.Add(ttl),
+	})
+}
+
+// Return the current entry for the given name: the record, or nil if the
+// object is known not to exist. hit is false if there is no unexpired entry.
+func (rc *RecordCache) LookUp(name string) (hit bool, o *gcs.Object) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	v := rc.entries.LookUp(name)
+	if v == nil {
+		return
+	}
+
+	e := v.(recordCacheEntry)
+	if e.expiration.Before(rc.clock.Now()) {
+		rc.entries.Erase(name)
+		return
+	}
+
+	hit = true
+	o = e.o
+	return
+}
+
+// Forget anything known about the object with the given name.
+func (rc *RecordCache) Erase(name string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.entries.Erase(name)
+}
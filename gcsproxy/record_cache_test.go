@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestRecordCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const recordTTL = time.Minute
+
+type RecordCacheTest struct {
+	clock timeutil.SimulatedClock
+	cache *gcsproxy.RecordCache
+}
+
+var _ SetUpInterface = &RecordCacheTest{}
+
+func init() { RegisterTestSuite(&RecordCacheTest{}) }
+
+func (t *RecordCacheTest) SetUp(ti *TestInfo) {
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	policy, err := gcsproxy.ParseStatTTLs(recordTTL, []string{"nocache/:0s"})
+	AssertEq(nil, err)
+
+	t.cache = gcsproxy.NewRecordCache(16, policy, &t.clock)
+}
+
+// Return a time relative to the clock's current time.
+func (t *RecordCacheTest) at(d time.Duration) time.Time {
+	return t.clock.Now().Add(d)
+}
+
+func objectRecord(name string, gen int64, metaGen int64) *gcs.Object {
+	return &gcs.Object{
+		Name:           name,
+		Generation:     gen,
+		MetaGeneration: metaGen,
+	}
+}
+
+// Return the generation cached for foo: zero for a negative entry, and -1 for
+// none at all.
+func (t *RecordCacheTest) cachedGeneration() int64 {
+	hit, o := t.cache.LookUp("foo")
+	switch {
+	case !hit:
+		return -1
+
+	case o == nil:
+		return 0
+
+	default:
+		return o.Generation
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RecordCacheTest) Empty() {
+	ExpectEq(-1, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) PositiveAndNegativeEntries() {
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(0))
+	ExpectEq(17, t.cachedGeneration())
+
+	t.cache.Offer("bar", nil, t.at(0))
+	hit, o := t.cache.LookUp("bar")
+	ExpectTrue(hit)
+	ExpectEq(nil, o)
+}
+
+func (t *RecordCacheTest) ExpiresAfterTTLFromObservation() {
+	// The TTL counts from when the record was known to be true, not from when
+	// it was offered.
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(-recordTTL/2))
+
+	t.clock.AdvanceTime(recordTTL/2 - time.Millisecond)
+	ExpectEq(17, t.cachedGeneration())
+
+	t.clock.AdvanceTime(2 * time.Millisecond)
+	ExpectEq(-1, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) PolicyDisablesCaching() {
+	t.cache.Offer("nocache/foo", objectRecord("nocache/foo", 17, 1), t.at(0))
+	hit, _ := t.cache.LookUp("nocache/foo")
+	ExpectFalse(hit)
+}
+
+func (t *RecordCacheTest) NewerGenerationReplacesOlder() {
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(0))
+	t.cache.Offer("foo", objectRecord("foo", 19, 1), t.at(0))
+	ExpectEq(19, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) OlderGenerationNeverReplacesNewer() {
+	// Even when observed later, as for a stale listing page.
+	t.cache.Offer("foo", objectRecord("foo", 19, 1), t.at(-time.Second))
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(0))
+	ExpectEq(19, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) MetaGenerationBreaksTies() {
+	t.cache.Offer("foo", objectRecord("foo", 17, 3), t.at(0))
+	t.cache.Offer("foo", objectRecord("foo", 17, 2), t.at(0))
+
+	_, o := t.cache.LookUp("foo")
+	ExpectEq(3, o.MetaGeneration)
+
+	t.cache.Offer("foo", objectRecord("foo", 17, 4), t.at(0))
+
+	_, o = t.cache.LookUp("foo")
+	ExpectEq(4, o.MetaGeneration)
+}
+
+func (t *RecordCacheTest) SameRecordExtendsExpiration() {
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(0))
+	t.clock.AdvanceTime(recordTTL / 2)
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(0))
+
+	t.clock.AdvanceTime(recordTTL/2 + time.Millisecond)
+	ExpectEq(17, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) StaleRecordDoesntReplaceLaterDeletion() {
+	t.cache.Offer("foo", nil, t.at(0))
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(-time.Second))
+	ExpectEq(0, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) LaterRecordReplacesDeletion() {
+	t.cache.Offer("foo", nil, t.at(-time.Second))
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(0))
+	ExpectEq(17, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) StaleAbsenceDoesntHideLaterCreation() {
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(0))
+	t.cache.Offer("foo", nil, t.at(-time.Second))
+	ExpectEq(17, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) LaterAbsenceReplacesRecord() {
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(-time.Second))
+	t.cache.Offer("foo", nil, t.at(0))
+	ExpectEq(0, t.cachedGeneration())
+}
+
+func (t *RecordCacheTest) Erase() {
+	t.cache.Offer("foo", nil, t.at(0))
+	t.cache.Erase("foo")
+	ExpectEq(-1, t.cachedGeneration())
+
+	// Nothing remains to be compared against.
+	t.cache.Offer("foo", objectRecord("foo", 17, 1), t.at(-time.Second))
+	ExpectEq(17, t.cachedGeneration())
+}
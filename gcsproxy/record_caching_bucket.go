@@ -0,0 +1,239 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that answers StatObject from the supplied cache where it
+// can, and offers the cache every object record that passes through it:
+// those returned by stats, listings, and mutations. A listing that covers a
+// whole directory also tells the cache which of its children's file and
+// directory names don't exist, so that looking up each child afterward
+// needn't go to GCS.
+//
+// Entries are erased when modifications through this bucket begin, and
+// replaced with the result when they complete.
+func NewRecordCachingBucket(
+	cache *RecordCache,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b gcs.Bucket) {
+	b = &recordCachingBucket{
+		cache:   cache,
+		clock:   clock,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type recordCachingBucket struct {
+	cache   *RecordCache
+	clock   timeutil.Clock
+	wrapped gcs.Bucket
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Offer the cache what a complete listing of a directory, made with "/" as
+// the delimiter, shows about names that don't exist.
+//
+// A listing shows an object "d/foo/" only as the collapsed run "d/foo/", and
+// any object beginning with that prefix would have produced the same run. So
+// when a listing of "d/" contains "d/foo" but no run "d/foo/", there is no
+// object "d/foo/". Conversely a run "d/bar/" without an object "d/bar" means
+// there is no object "d/bar". Neither holds for a partial listing, since the
+// counterpart may be on another page.
+func (b *recordCachingBucket) offerAbsences(
+	listing *gcs.Listing,
+	listedAt time.Time) {
+	objects := make(map[string]bool)
+	for _, o := range listing.Objects {
+		objects[o.Name] = true
+	}
+
+	runs := make(map[string]bool)
+	for _, r := range listing.CollapsedRuns {
+		runs[r] = true
+	}
+
+	for _, o := range listing.Objects {
+		if strings.HasSuffix(o.Name, "/") {
+			continue
+		}
+
+		if !runs[o.Name+"/"] {
+			b.cache.Offer(o.Name+"/", nil, listedAt)
+		}
+	}
+
+	for _, r := range listing.CollapsedRuns {
+		name := strings.TrimSuffix(r, "/")
+		if !objects[name] {
+			b.cache.Offer(name, nil, listedAt)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *recordCachingBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *recordCachingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.wrapped.NewReader(ctx, req)
+	return
+}
+
+func (b *recordCachingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	b.cache.Erase(req.Name)
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	b.cache.Offer(o.Name, o, b.clock.Now())
+	return
+}
+
+func (b *recordCachingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	b.cache.Erase(req.DstName)
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	b.cache.Offer(o.Name, o, b.clock.Now())
+	return
+}
+
+func (b *recordCachingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	b.cache.Erase(req.DstName)
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	b.cache.Offer(o.Name, o, b.clock.Now())
+	return
+}
+
+func (b *recordCachingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if hit, entry := b.cache.LookUp(req.Name); hit {
+		if entry == nil {
+			err = &gcs.NotFoundError{
+				Err: fmt.Errorf("Negative cache entry for %v", req.Name),
+			}
+
+			return
+		}
+
+		o = entry
+		return
+	}
+
+	sentAt := b.clock.Now()
+	o, err = b.wrapped.StatObject(ctx, req)
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		b.cache.Offer(req.Name, nil, sentAt)
+	}
+
+	if err != nil {
+		return
+	}
+
+	b.cache.Offer(o.Name, o, sentAt)
+	return
+}
+
+func (b *recordCachingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	sentAt := b.clock.Now()
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	if err != nil {
+		return
+	}
+
+	for _, o := range listing.Objects {
+		b.cache.Offer(o.Name, o, sentAt)
+	}
+
+	if req.Delimiter == "/" &&
+		req.ContinuationToken == "" &&
+		listing.ContinuationToken == "" {
+		b.offerAbsences(listing, sentAt)
+	}
+
+	return
+}
+
+func (b *recordCachingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	b.cache.Erase(req.Name)
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	b.cache.Offer(o.Name, o, b.clock.Now())
+	return
+}
+
+func (b *recordCachingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.cache.Erase(req.Name)
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	if err != nil {
+		return
+	}
+
+	// Deleting a particular generation may have left a newer one in place.
+	if req.Generation == 0 {
+		b.cache.Offer(req.Name, nil, b.clock.Now())
+	}
+
+	return
+}
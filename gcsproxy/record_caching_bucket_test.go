@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestRecordCachingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// statCountingBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts calls to StatObject.
+type statCountingBucket struct {
+	gcs.Bucket
+	stats int
+}
+
+func (b *statCountingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.stats++
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RecordCachingBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	wrapped statCountingBucket
+	cache   *gcsproxy.RecordCache
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &RecordCachingBucketTest{}
+
+func init() { RegisterTestSuite(&RecordCachingBucketTest{}) }
+
+func (t *RecordCachingBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	policy, err := gcsproxy.ParseStatTTLs(recordTTL, nil)
+	AssertEq(nil, err)
+
+	t.cache = gcsproxy.NewRecordCache(64, policy, &t.clock)
+	t.bucket = gcsproxy.NewRecordCachingBucket(t.cache, &t.clock, &t.wrapped)
+}
+
+// Stat the named object through the caching bucket, returning its generation
+// or zero if it doesn't exist.
+func (t *RecordCachingBucketTest) stat(name string) int64 {
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		return 0
+	}
+
+	AssertEq(nil, err)
+	return o.Generation
+}
+
+func (t *RecordCachingBucketTest) list(
+	req *gcs.ListObjectsRequest) *gcs.Listing {
+	listing, err := t.bucket.ListObjects(t.ctx, req)
+	AssertEq(nil, err)
+	return listing
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RecordCachingBucketTest) StatsAreCached() {
+	o, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	ExpectEq(o.Generation, t.stat("foo"))
+	ExpectEq(o.Generation, t.stat("foo"))
+	ExpectEq(0, t.stat("bar"))
+	ExpectEq(0, t.stat("bar"))
+	ExpectEq(2, t.wrapped.stats)
+
+	// Until the TTL expires.
+	t.clock.AdvanceTime(recordTTL + time.Millisecond)
+	ExpectEq(o.Generation, t.stat("foo"))
+	ExpectEq(3, t.wrapped.stats)
+}
+
+func (t *RecordCachingBucketTest) MutationResultsAreCached() {
+	created, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "taco")
+	AssertEq(nil, err)
+	ExpectEq(created.Generation, t.stat("foo"))
+
+	copied, err := t.bucket.CopyObject(
+		t.ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo", DstName: "bar"})
+
+	AssertEq(nil, err)
+	ExpectEq(copied.Generation, t.stat("bar"))
+
+	composed, err := t.bucket.ComposeObjects(
+		t.ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName: "foo",
+			Sources: []gcs.ComposeSource{{Name: "foo"}, {Name: "bar"}},
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(composed.Generation, t.stat("foo"))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "bar"})
+	AssertEq(nil, err)
+	ExpectEq(0, t.stat("bar"))
+
+	ExpectEq(0, t.wrapped.stats)
+}
+
+func (t *RecordCachingBucketTest) ListingsFeedTheCache() {
+	foo, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "d/foo", "")
+	AssertEq(nil, err)
+
+	bar, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "d/bar/", "")
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "d/baz/qux", "")
+	AssertEq(nil, err)
+
+	t.list(&gcs.ListObjectsRequest{Prefix: "d/bar/"})
+	t.list(&gcs.ListObjectsRequest{Prefix: "d/", Delimiter: "/"})
+
+	// Records in the listings are cached, as is what a complete listing of d/
+	// shows not to exist: a directory named foo, and files named bar and baz.
+	ExpectEq(foo.Generation, t.stat("d/foo"))
+	ExpectEq(bar.Generation, t.stat("d/bar/"))
+	ExpectEq(0, t.stat("d/foo/"))
+	ExpectEq(0, t.stat("d/bar"))
+	ExpectEq(0, t.stat("d/baz"))
+	ExpectEq(0, t.wrapped.stats)
+
+	// Nothing is known about the placeholder for baz, which wasn't listed.
+	ExpectEq(0, t.stat("d/baz/"))
+	ExpectEq(1, t.wrapped.stats)
+}
+
+func (t *RecordCachingBucketTest) PartialListingsShowNoAbsences() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "d/foo", "")
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "d/foo/bar", "")
+	AssertEq(nil, err)
+
+	// The first page holds only d/foo, and d/foo/ follows on the next.
+	listing := t.list(&gcs.ListObjectsRequest{
+		Prefix:     "d/",
+		Delimiter:  "/",
+		MaxResults: 1,
+	})
+
+	AssertThat(listing.CollapsedRuns, ElementsAre())
+	AssertNe("", listing.ContinuationToken)
+
+	ExpectEq(0, t.stat("d/foo/"))
+	ExpectEq(1, t.wrapped.stats)
+}
+
+func (t *RecordCachingBucketTest) StaleListingDoesntResurrectDeletedObject() {
+	_, err := gcsutil.CreateObject(t.ctx, t.wrapped.Bucket, "foo", "")
+	AssertEq(nil, err)
+
+	// Take a listing, then delete the object through the caching bucket while
+	// the listing's response is notionally in flight, by moving the clock
+	// forward before the deletion is recorded.
+	listing, err := t.wrapped.Bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	listedAt := t.clock.Now()
+
+	t.clock.AdvanceTime(time.Second)
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	for _, o := range listing.Objects {
+		t.cache.Offer(o.Name, o, listedAt)
+	}
+
+	ExpectEq(0, t.stat("foo"))
+	ExpectEq(0, t.wrapped.stats)
+}
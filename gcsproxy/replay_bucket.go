@@ -0,0 +1,377 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that serves calls from the supplied cassette, recorded with
+// NewRecordBucket, rather than from GCS.
+//
+// Each call is matched by method and request against the interactions not yet
+// played. Independent calls made concurrently may arrive in a different order
+// than they were recorded in, so a call may match any of the oldest window
+// unplayed interactions; a window of one demands exactly the recorded order.
+// A call that matches none of them fails with an error describing how it
+// differs from what was expected. Reads of contents too large to have been
+// recorded are served synthesized contents of the recorded size.
+func NewReplayBucket(
+	c *Cassette,
+	window int) (b *ReplayBucket, err error) {
+	if window < 1 {
+		window = 1
+	}
+
+	b = &ReplayBucket{
+		name:   c.BucketName,
+		window: window,
+	}
+
+	for i, in := range c.Interactions {
+		var sig json.RawMessage
+		sig, err = canonicalRequest(in.Request)
+		if err != nil {
+			err = fmt.Errorf("Interaction %d: %v", i, err)
+			return
+		}
+
+		b.pending = append(b.pending, replayEntry{in, sig})
+	}
+
+	return
+}
+
+// A bucket that plays back a cassette. See NewReplayBucket.
+type ReplayBucket struct {
+	name   string
+	window int
+
+	mu sync.Mutex
+
+	// The interactions not yet played, in recorded order.
+	//
+	// GUARDED_BY(mu)
+	pending []replayEntry
+
+	// Calls that matched no interaction.
+	//
+	// GUARDED_BY(mu)
+	mismatches []error
+}
+
+var _ gcs.Bucket = &ReplayBucket{}
+
+type replayEntry struct {
+	in  *Interaction
+	sig json.RawMessage
+}
+
+// Return an error if any call failed to match, or if any recorded interaction
+// was never played.
+func (b *ReplayBucket) Finish() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.mismatches) != 0 {
+		err = fmt.Errorf(
+			"%d calls diverged from the cassette; first: %v",
+			len(b.mismatches),
+			b.mismatches[0])
+		return
+	}
+
+	if len(b.pending) != 0 {
+		first := b.pending[0]
+		err = fmt.Errorf(
+			"%d recorded interactions were never played; first: %s %s",
+			len(b.pending),
+			first.in.Method,
+			first.sig)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Find and remove the interaction matching the supplied call.
+func (b *ReplayBucket) take(
+	method string,
+	req json.RawMessage) (in *Interaction, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(b.pending)
+	if n > b.window {
+		n = b.window
+	}
+
+	for i := 0; i < n; i++ {
+		e := b.pending[i]
+		if e.in.Method == method && bytes.Equal(e.sig, req) {
+			in = e.in
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			return
+		}
+	}
+
+	err = b.mismatch(method, req, b.pending[:n])
+	b.mismatches = append(b.mismatches, err)
+	return
+}
+
+// Describe a call that matched none of the supplied candidates, comparing it
+// to the closest: the first with the same method, if any.
+func (b *ReplayBucket) mismatch(
+	method string,
+	req json.RawMessage,
+	candidates []replayEntry) (err error) {
+	if len(candidates) == 0 {
+		err = fmt.Errorf("Replay: cassette exhausted at %s %s", method, req)
+		return
+	}
+
+	closest := candidates[0]
+	for _, e := range candidates {
+		if e.in.Method == method {
+			closest = e
+			break
+		}
+	}
+
+	err = fmt.Errorf(
+		"Replay: no recorded interaction among the next %d matches %s %s. "+
+			"Differences from the closest:\n%s",
+		len(candidates),
+		method,
+		req,
+		diffRequests(closest.in.Method, closest.sig, method, req))
+
+	return
+}
+
+// Play a call that returns an object.
+func (b *ReplayBucket) playObject(
+	method string,
+	req interface{}) (o *gcs.Object, err error) {
+	in, err := b.take(method, mustEncodeRequest(req, nil))
+	if err != nil {
+		return
+	}
+
+	o, err = copyObject(in.Object), in.Error.toError()
+	return
+}
+
+// Return a copy of the supplied object, or nil if it is nil, so that callers
+// can't modify the cassette.
+func copyObject(o *gcs.Object) (copied *gcs.Object) {
+	if o == nil {
+		return
+	}
+
+	c := *o
+	copied = &c
+	return
+}
+
+// Return the contents to serve for a recorded read.
+func replayContents(c *RecordedContents) (data []byte) {
+	if int64(len(c.Data)) == c.Size {
+		data = c.Data
+		return
+	}
+
+	// Synthesize contents of the right size from the hash. They won't hash to
+	// it, but they are deterministic.
+	seed, _ := hex.DecodeString(c.SHA256)
+	if len(seed) == 0 {
+		seed = []byte{0}
+	}
+
+	data = make([]byte, c.Size)
+	for i := range data {
+		data[i] = seed[i%len(seed)]
+	}
+
+	return
+}
+
+// Serves recorded contents, followed by the recorded read error if any.
+type replayReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *replayReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if err == io.EOF && r.err != nil {
+		err = r.err
+	}
+
+	return
+}
+
+func (r *replayReader) Close() (err error) {
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *ReplayBucket) Name() string {
+	return b.name
+}
+
+func (b *ReplayBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	in, err := b.take("NewReader", mustEncodeRequest(req, nil))
+	if err != nil {
+		return
+	}
+
+	err = in.Error.toError()
+	if err != nil {
+		return
+	}
+
+	// The reader was never closed while recording, so we don't know what it
+	// returned.
+	if in.Contents == nil {
+		rc = &replayReader{
+			r:   bytes.NewReader(nil),
+			err: errors.New("Replay: contents not recorded"),
+		}
+
+		return
+	}
+
+	rc = &replayReader{
+		r:   bytes.NewReader(replayContents(in.Contents)),
+		err: in.Contents.ReadError.toError(),
+	}
+
+	return
+}
+
+func (b *ReplayBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	// Consume and hash the contents, as the recording did.
+	hr := newHashingReader(req.Contents)
+	_, err = io.Copy(ioutil.Discard, hr)
+	if err != nil {
+		err = fmt.Errorf("Reading contents: %v", err)
+		return
+	}
+
+	recordedReq := *req
+	recordedReq.Contents = nil
+	enc := mustEncodeRequest(&recordedReq, map[string]interface{}{
+		"ContentsSize":   hr.n,
+		"ContentsSHA256": hr.Sum(),
+	})
+
+	in, err := b.take("CreateObject", enc)
+	if err != nil {
+		return
+	}
+
+	o, err = copyObject(in.Object), in.Error.toError()
+	return
+}
+
+func (b *ReplayBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.playObject("CopyObject", req)
+	return
+}
+
+func (b *ReplayBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.playObject("ComposeObjects", req)
+	return
+}
+
+func (b *ReplayBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.playObject("StatObject", req)
+	return
+}
+
+func (b *ReplayBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	in, err := b.take("ListObjects", mustEncodeRequest(req, nil))
+	if err != nil {
+		return
+	}
+
+	err = in.Error.toError()
+	if err != nil {
+		return
+	}
+
+	if in.Listing != nil {
+		listing = &gcs.Listing{
+			CollapsedRuns:     in.Listing.CollapsedRuns,
+			ContinuationToken: in.Listing.ContinuationToken,
+		}
+
+		for _, o := range in.Listing.Objects {
+			listing.Objects = append(listing.Objects, copyObject(o))
+		}
+	}
+
+	return
+}
+
+func (b *ReplayBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.playObject("UpdateObject", req)
+	return
+}
+
+func (b *ReplayBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	in, err := b.take("DeleteObject", mustEncodeRequest(req, nil))
+	if err != nil {
+		return
+	}
+
+	err = in.Error.toError()
+	return
+}
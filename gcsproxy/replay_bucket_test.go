@@ -0,0 +1,236 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestReplayBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReplayBucketTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	recorder *gcsproxy.RecordBucket
+}
+
+var _ SetUpInterface = &ReplayBucketTest{}
+
+func init() { RegisterTestSuite(&ReplayBucketTest{}) }
+
+func (t *ReplayBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.recorder = gcsproxy.NewRecordBucket(
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+		gcsproxy.ScrubOptions{})
+}
+
+// Create a replay bucket for what has been recorded so far, round-tripping
+// the cassette through its encoding.
+func (t *ReplayBucketTest) replay(window int) (b *gcsproxy.ReplayBucket) {
+	var buf bytes.Buffer
+	AssertEq(nil, t.recorder.Cassette().Encode(&buf))
+
+	c, err := gcsproxy.DecodeCassette(&buf)
+	AssertEq(nil, err)
+
+	b, err = gcsproxy.NewReplayBucket(c, window)
+	AssertEq(nil, err)
+
+	return
+}
+
+func (t *ReplayBucketTest) stat(b gcs.Bucket, name string) (err error) {
+	_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReplayBucketTest) RoundTrip() {
+	// Record a scenario.
+	scenario := func(b gcs.Bucket) (summary string) {
+		o, err := gcsutil.CreateObject(t.ctx, b, "foo", "taco")
+		AssertEq(nil, err)
+
+		contents, err := gcsutil.ReadObject(t.ctx, b, "foo")
+		AssertEq(nil, err)
+
+		listing, err := b.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+		AssertEq(nil, err)
+
+		_, statErr := b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+		deleteErr := b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+
+		summary = fmt.Sprintf(
+			"%s %d %q %d %T %v",
+			o.Name,
+			o.Generation,
+			contents,
+			len(listing.Objects),
+			statErr,
+			deleteErr)
+
+		return
+	}
+
+	recorded := scenario(t.recorder)
+
+	// Play it back.
+	b := t.replay(1)
+	ExpectEq("some_bucket", b.Name())
+	ExpectEq(recorded, scenario(b))
+	ExpectEq(nil, b.Finish())
+}
+
+func (t *ReplayBucketTest) SynthesizesLargeContents() {
+	large := strings.Repeat("x", 1<<16)
+	_, err := gcsutil.CreateObject(t.ctx, t.recorder, "foo", large)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.recorder, "foo")
+	AssertEq(nil, err)
+
+	b := t.replay(1)
+
+	_, err = gcsutil.CreateObject(t.ctx, b, "foo", large)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, b, "foo")
+	AssertEq(nil, err)
+	ExpectEq(len(large), len(contents))
+	ExpectEq(nil, b.Finish())
+}
+
+func (t *ReplayBucketTest) DivergenceFailsWithDiff() {
+	t.stat(t.recorder, "foo")
+
+	b := t.replay(1)
+
+	err := t.stat(b, "bar")
+	ExpectThat(err, Error(HasSubstr(`Name: recorded "foo", got "bar"`)))
+
+	err = b.Finish()
+	ExpectThat(err, Error(HasSubstr("1 calls diverged")))
+}
+
+func (t *ReplayBucketTest) DifferentContentsDiverge() {
+	_, err := gcsutil.CreateObject(t.ctx, t.recorder, "foo", "taco")
+	AssertEq(nil, err)
+
+	b := t.replay(1)
+
+	_, err = gcsutil.CreateObject(t.ctx, b, "foo", "burrito")
+	ExpectThat(err, Error(HasSubstr("ContentsSize: recorded 4, got 7")))
+}
+
+func (t *ReplayBucketTest) UnplayedInteractions() {
+	t.stat(t.recorder, "foo")
+	t.stat(t.recorder, "bar")
+
+	b := t.replay(1)
+	t.stat(b, "foo")
+
+	err := b.Finish()
+	ExpectThat(err, Error(HasSubstr("1 recorded interactions were never played")))
+	ExpectThat(err, Error(HasSubstr("bar")))
+}
+
+func (t *ReplayBucketTest) StrictWindowRequiresOrder() {
+	t.stat(t.recorder, "foo")
+	t.stat(t.recorder, "bar")
+
+	b := t.replay(1)
+	err := t.stat(b, "bar")
+	ExpectThat(err, Error(HasSubstr("no recorded interaction")))
+}
+
+func (t *ReplayBucketTest) WindowToleratesReordering() {
+	t.stat(t.recorder, "foo")
+	t.stat(t.recorder, "bar")
+	t.stat(t.recorder, "baz")
+
+	b := t.replay(2)
+	ExpectThat(t.stat(b, "bar"), HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectThat(t.stat(b, "foo"), HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectThat(t.stat(b, "baz"), HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(nil, b.Finish())
+}
+
+func (t *ReplayBucketTest) WindowIsBounded() {
+	t.stat(t.recorder, "foo")
+	t.stat(t.recorder, "bar")
+	t.stat(t.recorder, "baz")
+
+	// "baz" is beyond the window of the two oldest unplayed interactions.
+	b := t.replay(2)
+	err := t.stat(b, "baz")
+	ExpectThat(err, Error(HasSubstr("no recorded interaction among the next 2")))
+}
+
+func (t *ReplayBucketTest) ConcurrentCalls() {
+	const n = 8
+
+	var names []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%d", i)
+		names = append(names, name)
+
+		_, err := gcsutil.CreateObject(t.ctx, t.recorder, name, name)
+		AssertEq(nil, err)
+	}
+
+	// Replay the creations concurrently.
+	b := t.replay(n)
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			_, errs[i] = gcsutil.CreateObject(t.ctx, b, name, name)
+		}(i, name)
+	}
+
+	wg.Wait()
+
+	for i := range errs {
+		ExpectEq(nil, errs[i], "%d", i)
+	}
+
+	ExpectEq(nil, b.Finish())
+}
@@ -0,0 +1,441 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"github.com/jacobsa/util/lrucache"
+	"golang.org/x/net/context"
+)
+
+// The largest piece in which we upload content resumably. A failure costs at
+// most one piece's worth of re-uploading.
+const maxResumablePieceSize = 32 << 20
+
+// The most pieces into which we split content, leaving the resulting
+// composite object room for plenty of appends before it must be rewritten.
+const maxResumablePieces = gcs.MaxComponentCount / 2
+
+// The number of interrupted uploads for which we remember what has already
+// been uploaded. Each costs only an object record.
+const resumableCheckpointCapacity = 64
+
+// An implementation detail of objectSyncer. See notes on newObjectSyncer.
+type resumableObjectCreator interface {
+	// Overwrite the source object with the supplied size bytes of content and
+	// custom metadata, resuming from where any previous failed call for the
+	// same generation of the source object left off.
+	Create(
+		ctx context.Context,
+		srcObject *gcs.Object,
+		metadata map[string]string,
+		r io.ReaderAt,
+		size int64) (o *gcs.Object, err error)
+}
+
+// Create a resumableObjectCreator that uploads content in pieces no larger
+// than a quarter of threshold (and maxResumablePieceSize), storing the pieces
+// as temporary objects named as for newAppendObjectCreator.
+//
+// The Bucket interface offers no access to upload sessions, so the committed
+// prefix of the content is kept instead as a temporary "accumulator" object
+// onto which each piece is composed in turn. When a piece fails to upload,
+// the accumulator is remembered, and a later call for the same generation of
+// the same source object picks up after it, so long as its CRC32C still
+// matches the content. The final piece is composed together with the
+// accumulator over the source object, preconditioned on its generation. The
+// result is a composite object, with no MD5 hash.
+//
+// Accumulators are remembered only in memory, for the most recent
+// resumableCheckpointCapacity failures. One that is forgotten, or whose
+// upload is never retried, stays in the bucket until garbage collected with
+// the other temporary objects.
+//
+// As with the append creator, Create guarantees to return
+// *gcs.PreconditionError when the source object has been clobbered, and never
+// otherwise.
+func newResumableObjectCreator(
+	threshold int64,
+	prefix string,
+	mountID string,
+	clock timeutil.Clock,
+	randSrc io.Reader,
+	bucket gcs.Bucket) (oc resumableObjectCreator) {
+	pieceSize := threshold / 4
+	if pieceSize > maxResumablePieceSize {
+		pieceSize = maxResumablePieceSize
+	}
+
+	if pieceSize < 1 {
+		pieceSize = 1
+	}
+
+	oc = &resumableCreator{
+		tmpObjectNamer: tmpObjectNamer{
+			prefix:  prefix,
+			mountID: mountID,
+			clock:   clock,
+			randSrc: randSrc,
+		},
+		bucket:      bucket,
+		pieceSize:   pieceSize,
+		checkpoints: lrucache.New(resumableCheckpointCapacity),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+type resumableCreator struct {
+	tmpObjectNamer
+	bucket    gcs.Bucket
+	pieceSize int64
+
+	mu sync.Mutex
+
+	// The accumulator object left behind by the latest failed upload for each
+	// generation of a source object, keyed by checkpointKey.
+	//
+	// GUARDED_BY(mu)
+	checkpoints lrucache.Cache
+}
+
+func checkpointKey(srcObject *gcs.Object) string {
+	return fmt.Sprintf("%s#%d", srcObject.Name, srcObject.Generation)
+}
+
+// Remove and return the checkpoint for the source object, if any.
+//
+// LOCKS_EXCLUDED(oc.mu)
+func (oc *resumableCreator) takeCheckpoint(
+	srcObject *gcs.Object) (accum *gcs.Object) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	key := checkpointKey(srcObject)
+	accum, _ = oc.checkpoints.LookUp(key).(*gcs.Object)
+	oc.checkpoints.Erase(key)
+
+	return
+}
+
+// LOCKS_EXCLUDED(oc.mu)
+func (oc *resumableCreator) saveCheckpoint(
+	srcObject *gcs.Object,
+	accum *gcs.Object) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	oc.checkpoints.Insert(checkpointKey(srcObject), accum)
+}
+
+// Make a best-effort attempt to delete the supplied temporary object, which
+// is no longer needed.
+func (oc *resumableCreator) deleteTmp(
+	ctx context.Context,
+	tmp *gcs.Object) {
+	err := oc.bucket.DeleteObject(
+		ctx,
+		&gcs.DeleteObjectRequest{
+			Name:       tmp.Name,
+			Generation: tmp.Generation,
+		})
+
+	if err != nil {
+		logger.Errorf("Deleting temporary object %q: %v", tmp.Name, err)
+	}
+}
+
+// Return true if the supplied accumulator holds a proper prefix of the size
+// bytes of content in r.
+func accumMatches(
+	accum *gcs.Object,
+	r io.ReaderAt,
+	size int64) (ok bool, err error) {
+	if int64(accum.Size) >= size {
+		return
+	}
+
+	h := crc32.New(castagnoliTable)
+	_, err = io.Copy(h, io.NewSectionReader(r, 0, int64(accum.Size)))
+	if err != nil {
+		err = fmt.Errorf("Copy: %v", err)
+		return
+	}
+
+	ok = h.Sum32() == accum.CRC32C
+	return
+}
+
+// Upload the n bytes of the content for the source object at the given
+// offset to a new temporary object, along with their checksums.
+func (oc *resumableCreator) createPiece(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	r io.ReaderAt,
+	off int64,
+	n int64) (piece *gcs.Object, err error) {
+	name, err := oc.chooseName(srcObject.Name)
+	if err != nil {
+		err = fmt.Errorf("chooseName: %v", err)
+		return
+	}
+
+	sums, err := computeUploadChecksums(io.NewSectionReader(r, off, n))
+	if err != nil {
+		err = fmt.Errorf("computeUploadChecksums: %v", err)
+		return
+	}
+
+	// As in appendObjectCreator, a precondition error here says nothing about
+	// the source object, so report it as an ordinary error.
+	var zero int64
+	metadata := oc.tmpMetadata(srcObject)
+	piece, err = oc.bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   name,
+			GenerationPrecondition: &zero,
+			Metadata:               metadata,
+			Contents:               io.NewSectionReader(r, off, n),
+			CRC32C:                 &sums.CRC32C,
+			MD5:                    &sums.MD5,
+			KmsKeyName:             KmsKeyName(srcObject),
+		})
+
+	if err != nil {
+		// Don't mangle the checksum errors that the syncer retries.
+		if _, ok := err.(*gcs.ChecksumMismatchError); ok {
+			return
+		}
+
+		err = fmt.Errorf("CreateObject: %v", err)
+		return
+	}
+
+	err = verifyTmpObject(ctx, oc.bucket, piece, name, metadata)
+	if err != nil {
+		err = fmt.Errorf("Unexpected temporary object: %v", err)
+		return
+	}
+
+	// Don't keep damaged contents around for later composing.
+	err = sums.check(piece, false)
+	if err != nil {
+		oc.deleteTmp(ctx, piece)
+		piece = nil
+		return
+	}
+
+	return
+}
+
+// Compose the supplied piece onto the end of the accumulator, returning the
+// accumulator's new generation. The piece is deleted either way.
+func (oc *resumableCreator) appendPiece(
+	ctx context.Context,
+	accum *gcs.Object,
+	piece *gcs.Object) (newAccum *gcs.Object, err error) {
+	defer oc.deleteTmp(ctx, piece)
+
+	newAccum, err = oc.bucket.ComposeObjects(
+		ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                   accum.Name,
+			DstGenerationPrecondition: &accum.Generation,
+			KmsKeyName:                KmsKeyName(accum),
+			Sources: []gcs.ComposeSource{
+				gcs.ComposeSource{
+					Name:       accum.Name,
+					Generation: accum.Generation,
+				},
+
+				gcs.ComposeSource{
+					Name:       piece.Name,
+					Generation: piece.Generation,
+				},
+			},
+		})
+
+	if err != nil {
+		err = fmt.Errorf("ComposeObjects: %v", err)
+		return
+	}
+
+	return
+}
+
+func (oc *resumableCreator) Create(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	metadata map[string]string,
+	r io.ReaderAt,
+	size int64) (o *gcs.Object, err error) {
+	// Don't split the content into more pieces than the result may have
+	// components.
+	pieceSize := oc.pieceSize
+	if size > pieceSize*maxResumablePieces {
+		pieceSize = (size + maxResumablePieces - 1) / maxResumablePieces
+	}
+
+	// Content that fits in a single piece gains nothing from resumption.
+	if size <= pieceSize {
+		var sums *uploadChecksums
+		sums, err = computeUploadChecksums(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			err = fmt.Errorf("computeUploadChecksums: %v", err)
+			return
+		}
+
+		full := &fullObjectCreator{bucket: oc.bucket}
+		o, err = full.Create(
+			ctx,
+			srcObject,
+			metadata,
+			io.NewSectionReader(r, 0, size),
+			sums)
+		return
+	}
+
+	// Pick up where any previous attempt left off, if its accumulator still
+	// matches the content.
+	var off int64
+	accum := oc.takeCheckpoint(srcObject)
+	if accum != nil {
+		var ok bool
+		ok, err = accumMatches(accum, r, size)
+		if err != nil {
+			oc.saveCheckpoint(srcObject, accum)
+			err = fmt.Errorf("accumMatches: %v", err)
+			return
+		}
+
+		if ok {
+			off = int64(accum.Size)
+		} else {
+			oc.deleteTmp(ctx, accum)
+			accum = nil
+		}
+	}
+
+	// Should we fail while the accumulator is intact, remember it for next
+	// time.
+	keepAccum := true
+	defer func() {
+		if accum == nil {
+			return
+		}
+
+		if err != nil && keepAccum {
+			oc.saveCheckpoint(srcObject, accum)
+			return
+		}
+
+		oc.deleteTmp(ctx, accum)
+	}()
+
+	// Upload all but the final piece onto the accumulator.
+	for off+pieceSize < size {
+		var piece *gcs.Object
+		piece, err = oc.createPiece(ctx, srcObject, r, off, pieceSize)
+
+		if err != nil {
+			return
+		}
+
+		if accum == nil {
+			accum = piece
+		} else {
+			var newAccum *gcs.Object
+			newAccum, err = oc.appendPiece(ctx, accum, piece)
+			if err != nil {
+				// We can't tell whether the compose took effect, so the
+				// accumulator we have is no longer trustworthy.
+				keepAccum = false
+				return
+			}
+
+			accum = newAccum
+		}
+
+		off += pieceSize
+	}
+
+	// Upload the final piece, and compose everything over the source object.
+	last, err := oc.createPiece(ctx, srcObject, r, off, size-off)
+
+	if err != nil {
+		return
+	}
+
+	defer oc.deleteTmp(ctx, last)
+
+	o, err = oc.bucket.ComposeObjects(
+		ctx,
+		&gcs.ComposeObjectsRequest{
+			DstName:                   srcObject.Name,
+			DstGenerationPrecondition: &srcObject.Generation,
+			KmsKeyName:                KmsKeyName(srcObject),
+			Sources: []gcs.ComposeSource{
+				gcs.ComposeSource{
+					Name:       accum.Name,
+					Generation: accum.Generation,
+				},
+
+				gcs.ComposeSource{
+					Name:       last.Name,
+					Generation: last.Generation,
+				},
+			},
+		})
+
+	switch typed := err.(type) {
+	case nil:
+
+	// The source object was clobbered, so there is nothing left to resume.
+	case *gcs.PreconditionError:
+		keepAccum = false
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf("ComposeObjects: %v", typed.Err),
+		}
+		return
+
+	// The source object isn't one of the components, so a not found error
+	// means that one of our temporary objects has gone missing.
+	case *gcs.NotFoundError:
+		keepAccum = false
+		err = fmt.Errorf("ComposeObjects: %v", err)
+		return
+
+	default:
+		err = fmt.Errorf("ComposeObjects: %v", err)
+		return
+	}
+
+	o = applyComposedMetadata(ctx, oc.bucket, o, metadata)
+	return
+}
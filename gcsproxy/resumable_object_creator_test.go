@@ -0,0 +1,282 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestResumableObjectCreator(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// faultyBucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the bytes uploaded by CreateObject, and that can be
+// told to fail a CreateObject call part way through its contents.
+type faultyBucket struct {
+	gcs.Bucket
+
+	// The number of CreateObject calls to allow before failing one, or
+	// negative to never fail.
+	failAfter int
+
+	uploaded int64
+}
+
+func (b *faultyBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if b.failAfter == 0 {
+		b.failAfter = -1
+		n, _ := io.CopyN(ioutil.Discard, req.Contents, 1)
+		b.uploaded += n
+		err = errors.New("injected fault")
+		return
+	}
+
+	if b.failAfter > 0 {
+		b.failAfter--
+	}
+
+	buf := new(bytes.Buffer)
+	_, err = io.Copy(buf, req.Contents)
+	if err != nil {
+		return
+	}
+
+	b.uploaded += int64(buf.Len())
+	req.Contents = buf
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Content is uploaded in pieces of four bytes.
+const testResumableThreshold = 16
+
+type ResumableObjectCreatorTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	bucket  faultyBucket
+	creator resumableObjectCreator
+
+	srcObject *gcs.Object
+}
+
+var _ SetUpInterface = &ResumableObjectCreatorTest{}
+
+func init() { RegisterTestSuite(&ResumableObjectCreatorTest{}) }
+
+func (t *ResumableObjectCreatorTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket.failAfter = -1
+
+	t.creator = newResumableObjectCreator(
+		testResumableThreshold,
+		prefix,
+		mountID,
+		&t.clock,
+		rand.Reader,
+		&t.bucket)
+
+	t.srcObject, err = gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", "taco")
+	AssertEq(nil, err)
+
+	t.bucket.uploaded = 0
+}
+
+func (t *ResumableObjectCreatorTest) call(
+	contents string) (o *gcs.Object, err error) {
+	o, err = t.creator.Create(
+		t.ctx,
+		t.srcObject,
+		map[string]string{"gcsfuse_mtime": "2015-04-05T02:15:00Z"},
+		strings.NewReader(contents),
+		int64(len(contents)))
+
+	return
+}
+
+// Return the names of the temporary objects in the bucket.
+func (t *ResumableObjectCreatorTest) tmpObjects() (names []string) {
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket.Bucket,
+		&gcs.ListObjectsRequest{Prefix: prefix})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+func (t *ResumableObjectCreatorTest) readFoo() string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "foo")
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ResumableObjectCreatorTest) SinglePiece() {
+	o, err := t.call("burr")
+	AssertEq(nil, err)
+
+	ExpectEq("foo", o.Name)
+	ExpectEq(1, o.ComponentCount)
+	ExpectEq("2015-04-05T02:15:00Z", o.Metadata["gcsfuse_mtime"])
+	ExpectEq("burr", t.readFoo())
+	ExpectEq(4, t.bucket.uploaded)
+	ExpectThat(t.tmpObjects(), ElementsAre())
+}
+
+func (t *ResumableObjectCreatorTest) ComposesPieces() {
+	o, err := t.call("burrito!!!")
+	AssertEq(nil, err)
+
+	ExpectEq("foo", o.Name)
+	ExpectLt(t.srcObject.Generation, o.Generation)
+	ExpectEq(3, o.ComponentCount)
+	ExpectEq("2015-04-05T02:15:00Z", o.Metadata["gcsfuse_mtime"])
+	ExpectEq("burrito!!!", t.readFoo())
+	ExpectEq(10, t.bucket.uploaded)
+	ExpectThat(t.tmpObjects(), ElementsAre())
+}
+
+func (t *ResumableObjectCreatorTest) NewObject() {
+	t.srcObject = &gcs.Object{Name: "bar"}
+
+	_, err := t.call("enchilada")
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket.Bucket, "bar")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+}
+
+func (t *ResumableObjectCreatorTest) LimitsPieceCount() {
+	contents := strings.Repeat("x", 4*maxResumablePieces+1)
+
+	o, err := t.call(contents)
+	AssertEq(nil, err)
+
+	ExpectLe(o.ComponentCount, maxResumablePieces)
+	ExpectEq(contents, t.readFoo())
+}
+
+func (t *ResumableObjectCreatorTest) SourceClobbered() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", "queso")
+	AssertEq(nil, err)
+
+	_, err = t.call("burrito!!!")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	ExpectEq("queso", t.readFoo())
+	ExpectThat(t.tmpObjects(), ElementsAre())
+}
+
+func (t *ResumableObjectCreatorTest) ResumesAfterFailure() {
+	// Fail the third piece.
+	t.bucket.failAfter = 2
+
+	_, err := t.call("burrito!!!")
+	ExpectThat(err, Error(HasSubstr("injected fault")))
+
+	_, ok := err.(*gcs.PreconditionError)
+	ExpectFalse(ok)
+	ExpectEq("taco", t.readFoo())
+
+	// The next attempt should upload only the remaining piece.
+	t.bucket.uploaded = 0
+
+	_, err = t.call("burrito!!!")
+	AssertEq(nil, err)
+
+	ExpectEq("burrito!!!", t.readFoo())
+	ExpectEq(2, t.bucket.uploaded)
+	ExpectThat(t.tmpObjects(), ElementsAre())
+}
+
+func (t *ResumableObjectCreatorTest) RestartsWhenContentChanged() {
+	t.bucket.failAfter = 2
+
+	_, err := t.call("burrito!!!")
+	ExpectThat(err, Error(HasSubstr("injected fault")))
+
+	// Changing what was already uploaded means starting over.
+	t.bucket.uploaded = 0
+
+	_, err = t.call("Burrito!!!")
+	AssertEq(nil, err)
+
+	ExpectEq("Burrito!!!", t.readFoo())
+	ExpectEq(10, t.bucket.uploaded)
+	ExpectThat(t.tmpObjects(), ElementsAre())
+}
+
+func (t *ResumableObjectCreatorTest) CheckpointVanished() {
+	t.bucket.failAfter = 2
+
+	_, err := t.call("burrito!!!")
+	ExpectThat(err, Error(HasSubstr("injected fault")))
+
+	// Somebody garbage collects the temporary objects.
+	names := t.tmpObjects()
+	AssertThat(names, Not(ElementsAre()))
+
+	for _, name := range names {
+		err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+		AssertEq(nil, err)
+	}
+
+	// The next attempt fails, but not with a precondition error.
+	_, err = t.call("burrito!!!")
+	ExpectThat(err, Error(HasSubstr("ComposeObjects")))
+
+	_, ok := err.(*gcs.PreconditionError)
+	ExpectFalse(ok)
+
+	// The one after that starts over.
+	_, err = t.call("burrito!!!")
+	AssertEq(nil, err)
+	ExpectEq("burrito!!!", t.readFoo())
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A table of stat cache TTLs keyed by object name prefix, consulted using the
+// longest matching prefix and falling back to a default. A TTL of zero means
+// records for matching objects aren't cached.
+type StatTTLPolicy struct {
+	defaultTTL time.Duration
+
+	// Sorted by decreasing prefix length.
+	rules []statTTLRule
+}
+
+type statTTLRule struct {
+	prefix string
+	ttl    time.Duration
+}
+
+type statTTLRulesByPrefixLength []statTTLRule
+
+func (r statTTLRulesByPrefixLength) Len() int      { return len(r) }
+func (r statTTLRulesByPrefixLength) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r statTTLRulesByPrefixLength) Less(i, j int) bool {
+	return len(r[i].prefix) > len(r[j].prefix)
+}
+
+// Parse a list of specs of the form
+//
+//     prefix:ttl
+//
+// where ttl is as accepted by time.ParseDuration, into a policy that uses
+// defaultTTL for objects matching none of them. The prefix may be empty, in
+// which case the spec overrides defaultTTL. Since object names may contain
+// colons, the spec is split at the last one.
+func ParseStatTTLs(
+	defaultTTL time.Duration,
+	specs []string) (p *StatTTLPolicy, err error) {
+	if defaultTTL < 0 {
+		err = fmt.Errorf("Negative default TTL: %v", defaultTTL)
+		return
+	}
+
+	p = &StatTTLPolicy{defaultTTL: defaultTTL}
+	seen := make(map[string]bool)
+
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i < 0 {
+			err = fmt.Errorf("%q: Expected prefix:ttl", spec)
+			return
+		}
+
+		var rule statTTLRule
+		rule.prefix = spec[:i]
+		rule.ttl, err = time.ParseDuration(spec[i+1:])
+		if err != nil {
+			err = fmt.Errorf("%q: %v", spec, err)
+			return
+		}
+
+		if rule.ttl < 0 {
+			err = fmt.Errorf("%q: Negative TTL", spec)
+			return
+		}
+
+		if seen[rule.prefix] {
+			err = fmt.Errorf("%q: Duplicate prefix: %q", spec, rule.prefix)
+			return
+		}
+
+		seen[rule.prefix] = true
+		p.rules = append(p.rules, rule)
+	}
+
+	sort.Sort(statTTLRulesByPrefixLength(p.rules))
+	return
+}
+
+// Return the TTL for records of the object with the given name.
+func (p *StatTTLPolicy) TTL(name string) time.Duration {
+	for _, r := range p.rules {
+		if strings.HasPrefix(name, r.prefix) {
+			return r.ttl
+		}
+	}
+
+	return p.defaultTTL
+}
+
+// Return true if no object's records are cached under this policy.
+func (p *StatTTLPolicy) Disabled() bool {
+	if p.defaultTTL != 0 {
+		return false
+	}
+
+	for _, r := range p.rules {
+		if r.ttl != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestStatTTL(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StatTTLTest struct {
+}
+
+func init() { RegisterTestSuite(&StatTTLTest{}) }
+
+func (t *StatTTLTest) parse(
+	defaultTTL time.Duration,
+	specs ...string) *gcsproxy.StatTTLPolicy {
+	p, err := gcsproxy.ParseStatTTLs(defaultTTL, specs)
+	AssertEq(nil, err)
+	return p
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StatTTLTest) DefaultOnly() {
+	p := t.parse(time.Minute)
+	ExpectEq(time.Minute, p.TTL("foo"))
+	ExpectEq(time.Minute, p.TTL("foo/bar/"))
+	ExpectFalse(p.Disabled())
+}
+
+func (t *StatTTLTest) LongestPrefixWins() {
+	p := t.parse(time.Minute, "logs/:5s", "logs/archive/:1h", "tmp/:0s")
+
+	ExpectEq(time.Minute, p.TTL("foo"))
+	ExpectEq(5*time.Second, p.TTL("logs/today"))
+	ExpectEq(time.Hour, p.TTL("logs/archive/2015"))
+	ExpectEq(0, p.TTL("tmp/foo"))
+}
+
+func (t *StatTTLTest) EmptyPrefixOverridesDefault() {
+	p := t.parse(time.Minute, ":5s", "logs/:1h")
+
+	ExpectEq(5*time.Second, p.TTL("foo"))
+	ExpectEq(time.Hour, p.TTL("logs/today"))
+}
+
+func (t *StatTTLTest) ColonsInPrefix() {
+	p := t.parse(time.Minute, "a:b:5s")
+	ExpectEq(5*time.Second, p.TTL("a:b/c"))
+}
+
+func (t *StatTTLTest) Disabled() {
+	ExpectTrue(t.parse(0).Disabled())
+	ExpectTrue(t.parse(0, "logs/:0s").Disabled())
+	ExpectFalse(t.parse(0, "logs/:5s").Disabled())
+}
+
+func (t *StatTTLTest) Errors() {
+	testCases := []struct {
+		specs []string
+		err   string
+	}{
+		{[]string{"logs/"}, "Expected prefix:ttl"},
+		{[]string{"logs/:taco"}, "time: invalid duration"},
+		{[]string{"logs/:-1s"}, "Negative TTL"},
+		{[]string{"logs/:1s", "logs/:2s"}, "Duplicate prefix"},
+	}
+
+	for _, tc := range testCases {
+		_, err := gcsproxy.ParseStatTTLs(time.Minute, tc.specs)
+		ExpectThat(err, Error(HasSubstr(tc.err)), "specs: %q", tc.specs)
+	}
+
+	_, err := gcsproxy.ParseStatTTLs(-time.Second, nil)
+	ExpectThat(err, Error(HasSubstr("Negative default TTL")))
+}
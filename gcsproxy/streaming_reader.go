@@ -0,0 +1,234 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Returned by StreamingReader.ReadAt for offsets that have already been
+// streamed past and are no longer buffered.
+var ErrBehindWindow = errors.New("Offset is behind the streaming window")
+
+// A reader for the contents of a particular object generation, for consumers
+// that read it once from start to finish. Rather than materializing contents
+// in leased temporary files, reads are served from a single long-lived GCS
+// read that is advanced as the offsets requested progress.
+//
+// The most recent contents are buffered in memory, up to a window of the size
+// given to NewStreamingReader, so that reads may arrive somewhat out of order
+// or overlap. Reads that skip ahead by no more than the window are served by
+// reading through the gap; those that skip further re-open the GCS read at
+// the new offset. Reads of anything before the window fail with
+// ErrBehindWindow, at which point the caller should read some other way.
+//
+// Not safe for concurrent access.
+type StreamingReader interface {
+	// Read len(p) bytes at the given offset, as for io.ReaderAt.
+	ReadAt(p []byte, offset int64) (n int, err error)
+
+	// Return the number of times a GCS read has been opened so far.
+	Opens() int
+
+	// Release the GCS read, if any. The reader must not be used again.
+	Close() (err error)
+}
+
+// Create a streaming reader for the given object generation, buffering up to
+// window bytes.
+//
+// REQUIRES: window > 0
+func NewStreamingReader(
+	o *gcs.Object,
+	window int,
+	bucket gcs.Bucket) (sr StreamingReader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sr = &streamingReader{
+		ctx:        ctx,
+		cancel:     cancel,
+		bucket:     bucket,
+		name:       o.Name,
+		generation: o.Generation,
+		size:       int64(o.Size),
+		window:     int64(window),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+type streamingReader struct {
+	// The context for GCS reads, which outlive the ops that cause them, and a
+	// function that cancels it.
+	ctx    context.Context
+	cancel func()
+
+	bucket     gcs.Bucket
+	name       string
+	generation int64
+	size       int64
+	window     int64
+
+	// The current GCS read, if any, and the offset of the next byte it will
+	// return.
+	rc       io.ReadCloser
+	rcOffset int64
+
+	// The most recently read contents, which end at rcOffset.
+	//
+	// INVARIANT: bufStart + len(buf) == rcOffset
+	buf      []byte
+	bufStart int64
+
+	opens int
+}
+
+// Throw away any GCS read and buffered contents, and arrange for the next read
+// to start at the given offset.
+func (sr *streamingReader) reset(offset int64) {
+	if sr.rc != nil {
+		sr.rc.Close()
+		sr.rc = nil
+	}
+
+	sr.buf = sr.buf[:0]
+	sr.bufStart = offset
+	sr.rcOffset = offset
+}
+
+// Read from GCS into the buffer until it reaches the given offset.
+func (sr *streamingReader) fill(limit int64) (err error) {
+	if sr.rc == nil {
+		sr.rc, err = sr.bucket.NewReader(
+			sr.ctx,
+			&gcs.ReadObjectRequest{
+				Name:       sr.name,
+				Generation: sr.generation,
+				Range: &gcs.ByteRange{
+					Start: uint64(sr.rcOffset),
+					Limit: uint64(sr.size),
+				},
+			})
+
+		if err != nil {
+			sr.rc = nil
+			err = fmt.Errorf("NewReader: %v", err)
+			return
+		}
+
+		sr.opens++
+	}
+
+	// Read into the end of the buffer.
+	n := len(sr.buf)
+	need := int(limit - sr.rcOffset)
+	if cap(sr.buf)-n < need {
+		grown := make([]byte, n, 2*(n+need))
+		copy(grown, sr.buf)
+		sr.buf = grown
+	}
+
+	sr.buf = sr.buf[:n+need]
+	read, err := io.ReadFull(sr.rc, sr.buf[n:])
+	sr.buf = sr.buf[:n+read]
+	sr.rcOffset += int64(read)
+
+	// On error, start a new GCS read next time.
+	if err != nil {
+		sr.rc.Close()
+		sr.rc = nil
+		err = fmt.Errorf("ReadFull: %v", err)
+		return
+	}
+
+	return
+}
+
+// Drop buffered contents beyond the window. To amortize the cost of copying,
+// this happens only once there is at least a full window to drop.
+func (sr *streamingReader) trim() {
+	excess := int64(len(sr.buf)) - sr.window
+	if excess < sr.window {
+		return
+	}
+
+	copy(sr.buf, sr.buf[excess:])
+	sr.buf = sr.buf[:sr.window]
+	sr.bufStart += excess
+}
+
+func (sr *streamingReader) ReadAt(
+	p []byte,
+	offset int64) (n int, err error) {
+	if offset >= sr.size {
+		err = io.EOF
+		return
+	}
+
+	// Don't read past the end of the object.
+	limit := offset + int64(len(p))
+	if limit > sr.size {
+		limit = sr.size
+	}
+
+	// Anything behind the window is gone. Anything too far ahead requires a new
+	// GCS read.
+	if offset < sr.bufStart {
+		err = ErrBehindWindow
+		return
+	}
+
+	if offset > sr.rcOffset+sr.window {
+		sr.reset(offset)
+	}
+
+	// Read as far as we need.
+	if limit > sr.rcOffset {
+		err = sr.fill(limit)
+		if err != nil {
+			return
+		}
+	}
+
+	n = copy(p, sr.buf[offset-sr.bufStart:limit-sr.bufStart])
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	sr.trim()
+	return
+}
+
+func (sr *streamingReader) Opens() int {
+	return sr.opens
+}
+
+func (sr *streamingReader) Close() (err error) {
+	if sr.rc != nil {
+		err = sr.rc.Close()
+		sr.rc = nil
+	}
+
+	sr.cancel()
+	return
+}
@@ -0,0 +1,196 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsproxy_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStreamingReader(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const streamingWindow = 16
+
+type StreamingReaderTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+
+	contents string
+	sr       gcsproxy.StreamingReader
+}
+
+var _ SetUpInterface = &StreamingReaderTest{}
+var _ TearDownInterface = &StreamingReaderTest{}
+
+func init() { RegisterTestSuite(&StreamingReaderTest{}) }
+
+func (t *StreamingReaderTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// 100 bytes, each different from its neighbours.
+	for i := 0; i < 100; i++ {
+		t.contents += string('!' + byte(i%90))
+	}
+
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", t.contents)
+	AssertEq(nil, err)
+
+	t.sr = gcsproxy.NewStreamingReader(o, streamingWindow, t.bucket)
+}
+
+func (t *StreamingReaderTest) TearDown() {
+	t.sr.Close()
+}
+
+// A read in a trace: size bytes at offset.
+type traceRead struct {
+	offset int64
+	size   int
+}
+
+// Replay the trace, checking that each read returns the right contents.
+func (t *StreamingReaderTest) replay(trace []traceRead) {
+	for _, r := range trace {
+		p := make([]byte, r.size)
+		n, err := t.sr.ReadAt(p, r.offset)
+
+		limit := r.offset + int64(r.size)
+		if limit > int64(len(t.contents)) {
+			limit = int64(len(t.contents))
+			AssertEq(io.EOF, err, "Read: %v", r)
+		} else {
+			AssertEq(nil, err, "Read: %v", r)
+		}
+
+		AssertEq(t.contents[r.offset:limit], string(p[:n]), "Read: %v", r)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StreamingReaderTest) Sequential() {
+	var trace []traceRead
+	for off := int64(0); off < 100; off += 7 {
+		trace = append(trace, traceRead{off, 7})
+	}
+
+	t.replay(trace)
+	ExpectEq(1, t.sr.Opens())
+}
+
+func (t *StreamingReaderTest) JitterWithinWindow() {
+	// Reads of varying sizes, overlapping, and reordered within the window.
+	t.replay([]traceRead{
+		{0, 10},
+		{20, 10},
+		{10, 10},
+		{15, 12},
+		{30, 1},
+		{29, 8},
+		{37, 63},
+	})
+
+	ExpectEq(1, t.sr.Opens())
+}
+
+func (t *StreamingReaderTest) SmallSkipReadsThrough() {
+	t.replay([]traceRead{
+		{0, 10},
+		{10 + streamingWindow, 10},
+	})
+
+	ExpectEq(1, t.sr.Opens())
+}
+
+func (t *StreamingReaderTest) LargeSkipReopens() {
+	t.replay([]traceRead{
+		{0, 10},
+		{11 + streamingWindow, 10},
+		{31 + streamingWindow, 10},
+	})
+
+	ExpectEq(2, t.sr.Opens())
+}
+
+func (t *StreamingReaderTest) ReadLargerThanWindow() {
+	t.replay([]traceRead{
+		{0, 3 * streamingWindow},
+		{3 * streamingWindow, 3 * streamingWindow},
+	})
+
+	ExpectEq(1, t.sr.Opens())
+}
+
+func (t *StreamingReaderTest) BehindWindow() {
+	t.replay([]traceRead{
+		{0, 10},
+		{20, 3 * streamingWindow},
+	})
+
+	// The start of the object has long since been dropped.
+	p := make([]byte, 10)
+	_, err := t.sr.ReadAt(p, 0)
+	ExpectEq(gcsproxy.ErrBehindWindow, err)
+
+	// Reads further on still work.
+	t.replay([]traceRead{{80, 10}})
+	ExpectEq(1, t.sr.Opens())
+}
+
+func (t *StreamingReaderTest) PastEnd() {
+	t.replay([]traceRead{
+		{90, 20},
+	})
+
+	p := make([]byte, 10)
+	n, err := t.sr.ReadAt(p, 100)
+	ExpectEq(0, n)
+	ExpectEq(io.EOF, err)
+}
+
+func (t *StreamingReaderTest) GenerationIsPinned() {
+	t.replay([]traceRead{{0, 10}})
+
+	// Overwrite the object. Reads from the existing GCS read still return the
+	// old contents.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", "burrito")
+	AssertEq(nil, err)
+
+	t.replay([]traceRead{{10, 10}})
+
+	// A new GCS read is for the old generation, which is gone, rather than
+	// silently switching to the new contents.
+	p := make([]byte, 10)
+	_, err = t.sr.ReadAt(p, 80)
+	ExpectThat(err, Error(HasSubstr("NewReader")))
+	ExpectThat(err, Error(HasSubstr("not found")))
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// Detach the file system mounted at dir, leaving the kernel to finish
+// unmounting it once it is no longer busy.
+func lazyUnmount(dir string) (err error) {
+	output, err := exec.Command("fusermount", "-u", "-z", dir).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("fusermount: %v: %s", err, bytes.TrimSpace(output))
+		return
+	}
+
+	return
+}
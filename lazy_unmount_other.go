@@ -0,0 +1,38 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// MNT_FORCE from <sys/mount.h>, the same on OS X and FreeBSD, which the
+// syscall package doesn't export.
+const mntForce = 0x80000
+
+// Detach the file system mounted at dir despite it being busy. There is no
+// lazy unmount outside of Linux, so force it instead.
+func lazyUnmount(dir string) (err error) {
+	err = syscall.Unmount(dir, mntForce)
+	if err != nil {
+		err = &os.PathError{Op: "unmount", Path: dir, Err: err}
+		return
+	}
+
+	return
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+// Find the result of lseek(2) with SEEK_DATA (or SEEK_HOLE, if hole is set) at
+// the given offset within a file of the given size whose data lies in the
+// supplied extents, as returned by ReadWriteLease.Extents. There is an
+// implicit hole at the end of the file.
+//
+// ok is false if there is no such offset, for which lseek returns ENXIO: the
+// offset is negative or not before the end of the file, or there is no data
+// after it.
+func SeekExtents(
+	extents []ByteRange,
+	size int64,
+	offset int64,
+	hole bool) (n int64, ok bool) {
+	if offset < 0 || offset >= size {
+		return
+	}
+
+	for _, e := range extents {
+		// Skip extents entirely before the offset.
+		if e.Limit <= offset {
+			continue
+		}
+
+		// The offset is either in this extent or in the hole before it.
+		inExtent := e.Start <= offset
+		switch {
+		case hole && inExtent:
+			n = e.Limit
+
+		case hole:
+			n = offset
+
+		case inExtent:
+			n = offset
+
+		default:
+			n = e.Start
+		}
+
+		ok = true
+		return
+	}
+
+	// The offset is in the hole at the end of the file.
+	if hole {
+		n = offset
+		ok = true
+	}
+
+	return
+}
+
+// Return the sum of the lengths of the supplied extents.
+func ExtentBytes(extents []ByteRange) (n int64) {
+	for _, e := range extents {
+		n += e.Limit - e.Start
+	}
+
+	return
+}
+
+// The extents of a file of the given size that holds nothing but data.
+func wholeFileExtents(size int64) (extents []ByteRange) {
+	if size > 0 {
+		extents = []ByteRange{{0, size}}
+	}
+
+	return
+}
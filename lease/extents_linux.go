@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lseek(2) whence values, supported since Linux 3.1 by most local file
+// systems including ext4, xfs, btrfs, and tmpfs.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Find the data extents of a file of the given size by walking it with
+// SEEK_DATA and SEEK_HOLE, falling back to treating the whole file as data if
+// the file system doesn't support them. The file's offset is preserved.
+func fileExtents(f *os.File, size int64) (extents []ByteRange, err error) {
+	fd := int(f.Fd())
+
+	saved, err := unix.Seek(fd, 0, os.SEEK_CUR)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	defer func() {
+		if _, seekErr := unix.Seek(fd, saved, os.SEEK_SET); seekErr != nil && err == nil {
+			err = fmt.Errorf("Seek: %v", seekErr)
+		}
+	}()
+
+	for off := int64(0); off < size; {
+		var start, limit int64
+
+		// ENXIO means there is no more data.
+		start, err = unix.Seek(fd, off, seekData)
+		if err == unix.ENXIO {
+			err = nil
+			break
+		}
+
+		if err == unix.EINVAL {
+			extents, err = wholeFileExtents(size), nil
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Seek(SEEK_DATA): %v", err)
+			return
+		}
+
+		limit, err = unix.Seek(fd, start, seekHole)
+		if err != nil {
+			err = fmt.Errorf("Seek(SEEK_HOLE): %v", err)
+			return
+		}
+
+		// Don't trust the file system to stay within the size we were given.
+		if start >= size {
+			break
+		}
+
+		if limit > size {
+			limit = size
+		}
+
+		extents = append(extents, ByteRange{start, limit})
+		off = limit
+	}
+
+	return
+}
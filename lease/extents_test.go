@@ -0,0 +1,191 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease_test
+
+import (
+	"math"
+	"runtime"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestExtents(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ExtentsTest struct {
+	fl lease.FileLeaser
+}
+
+var _ SetUpInterface = &ExtentsTest{}
+
+func init() { RegisterTestSuite(&ExtentsTest{}) }
+
+func (t *ExtentsTest) SetUp(ti *TestInfo) {
+	t.fl = lease.NewFileLeaser("", math.MaxInt32, math.MaxInt64)
+}
+
+// Data in [0, 4) and [100, 110) of a file of size 200.
+var someExtents = []lease.ByteRange{
+	{Start: 0, Limit: 4},
+	{Start: 100, Limit: 110},
+}
+
+func seek(offset int64, hole bool) (n int64, ok bool) {
+	n, ok = lease.SeekExtents(someExtents, 200, offset, hole)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ExtentsTest) SeekData() {
+	testCases := []struct {
+		offset   int64
+		expected int64
+		ok       bool
+	}{
+		{0, 0, true},
+		{3, 3, true},
+		{4, 100, true},
+		{99, 100, true},
+		{109, 109, true},
+
+		// Nothing but the implicit hole at the end.
+		{110, 0, false},
+		{199, 0, false},
+
+		// Out of range.
+		{-1, 0, false},
+		{200, 0, false},
+		{1000, 0, false},
+	}
+
+	for _, tc := range testCases {
+		n, ok := seek(tc.offset, false)
+		ExpectEq(tc.ok, ok, "offset: %d", tc.offset)
+		if ok {
+			ExpectEq(tc.expected, n, "offset: %d", tc.offset)
+		}
+	}
+}
+
+func (t *ExtentsTest) SeekHole() {
+	testCases := []struct {
+		offset   int64
+		expected int64
+		ok       bool
+	}{
+		{0, 4, true},
+		{3, 4, true},
+		{4, 4, true},
+		{99, 99, true},
+		{100, 110, true},
+		{110, 110, true},
+		{199, 199, true},
+
+		// Out of range.
+		{-1, 0, false},
+		{200, 0, false},
+	}
+
+	for _, tc := range testCases {
+		n, ok := seek(tc.offset, true)
+		ExpectEq(tc.ok, ok, "offset: %d", tc.offset)
+		if ok {
+			ExpectEq(tc.expected, n, "offset: %d", tc.offset)
+		}
+	}
+}
+
+func (t *ExtentsTest) AllData() {
+	extents := []lease.ByteRange{{Start: 0, Limit: 10}}
+
+	// The only hole is the implicit one at the end.
+	n, ok := lease.SeekExtents(extents, 10, 3, true)
+	AssertTrue(ok)
+	ExpectEq(10, n)
+
+	n, ok = lease.SeekExtents(extents, 10, 3, false)
+	AssertTrue(ok)
+	ExpectEq(3, n)
+}
+
+func (t *ExtentsTest) EmptyFile() {
+	_, ok := lease.SeekExtents(nil, 0, 0, false)
+	ExpectFalse(ok)
+
+	_, ok = lease.SeekExtents(nil, 0, 0, true)
+	ExpectFalse(ok)
+}
+
+func (t *ExtentsTest) EmptyLease() {
+	rwl, err := t.fl.NewFile()
+	AssertEq(nil, err)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	extents, err := rwl.Extents()
+	AssertEq(nil, err)
+	ExpectThat(extents, ElementsAre())
+}
+
+func (t *ExtentsTest) SparseLease() {
+	const offset = 1 << 22
+
+	rwl, err := t.fl.NewFile()
+	AssertEq(nil, err)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	// Write at the start and far beyond it, then move the file offset
+	// somewhere recognizable.
+	_, err = rwl.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = rwl.WriteAt([]byte("burrito"), offset)
+	AssertEq(nil, err)
+
+	_, err = rwl.Seek(2, 0)
+	AssertEq(nil, err)
+
+	// Both writes should be covered, and the extents should end at the end of
+	// the file.
+	extents, err := rwl.Extents()
+	AssertEq(nil, err)
+	AssertGt(len(extents), 0)
+
+	ExpectEq(0, extents[0].Start)
+	ExpectGe(extents[0].Limit, 4)
+	ExpectEq(offset+len("burrito"), extents[len(extents)-1].Limit)
+
+	n, ok := lease.SeekExtents(extents, offset+7, offset, false)
+	ExpectTrue(ok)
+	ExpectEq(offset, n)
+
+	// On Linux the hole in between should be found.
+	if runtime.GOOS == "linux" {
+		ExpectLt(lease.ExtentBytes(extents), offset)
+	}
+
+	// The file offset should be unchanged.
+	off, err := rwl.Seek(0, 1)
+	AssertEq(nil, err)
+	ExpectEq(2, off)
+}
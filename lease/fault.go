@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import "golang.org/x/net/context"
+
+// A fetch of a read proxy's contents running in the background, started by
+// ReadProxy.TryReadAt. Any number of goroutines may wait for it to complete.
+// Its result is collected by the read proxy that started it the next time that
+// proxy is used, so a fault is shared by every read of the same chunk that
+// arrives while it is in flight.
+type Fault struct {
+	// Closed when the fetch completes.
+	done chan struct{}
+
+	// Cancels the context given to the fetch.
+	cancel context.CancelFunc
+
+	// The result of the fetch. Written only before done is closed. If the fault
+	// downgrades its result, rl is set in place of rwl.
+	rwl ReadWriteLease
+	rl  ReadLease
+	err error
+}
+
+// Start a fault that calls the supplied function in the background.
+//
+// The function is given a context of its own rather than that of any one
+// caller: a fault may be shared by several reads, and one of them being
+// cancelled must not fail the others. The context is cancelled only when the
+// fault is abandoned.
+//
+// If downgrade is set, a read/write lease returned by the function is
+// downgraded as soon as it is, so that the leaser may revoke it to make space
+// before anybody collects it.
+func startFault(
+	fetch func(context.Context) (ReadWriteLease, error),
+	downgrade bool) (f *Fault) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f = &Fault{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	go func() {
+		f.rwl, f.err = fetch(ctx)
+		if downgrade && f.rwl != nil {
+			f.rl = f.rwl.Downgrade()
+			f.rwl = nil
+		}
+
+		cancel()
+		close(f.done)
+	}()
+
+	return
+}
+
+// Block until the fault has completed or the context is cancelled, whichever
+// comes first. Cancellation returns the context's error to this caller only;
+// the fault keeps running and its result is kept for later reads.
+//
+// A nil return doesn't mean that the fetch succeeded. The caller should retry
+// the read, which will observe the fetch's error if any.
+func (f *Fault) Wait(ctx context.Context) (err error) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Return true if the fault has completed. Guarantees to not block.
+func (f *Fault) Done() (done bool) {
+	select {
+	case <-f.done:
+		done = true
+	default:
+	}
+
+	return
+}
+
+// Block until the fault completes and return its result, which the caller
+// then owns. At most one of rwl and rl is non-nil.
+func (f *Fault) result() (rwl ReadWriteLease, rl ReadLease, err error) {
+	<-f.done
+	rwl, rl, err = f.rwl, f.rl, f.err
+	return
+}
+
+// Cancel the fetch if it is still running, and arrange for the result of the
+// fault to be thrown away once it completes, without waiting for that to
+// happen.
+func (f *Fault) abandon() {
+	f.cancel()
+	go func() {
+		rwl, rl, _ := f.result()
+		if rwl != nil {
+			rl = rwl.Downgrade()
+		}
+
+		if rl != nil {
+			rl.Revoke()
+		}
+	}()
+}
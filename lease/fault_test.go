@@ -0,0 +1,309 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFault(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A refresher whose Refresh calls block until released, and which counts
+// them.
+type gatedRefresher struct {
+	contents string
+	release  chan struct{}
+
+	mu    sync.Mutex
+	calls int   // GUARDED_BY(mu)
+	err   error // GUARDED_BY(mu)
+}
+
+func newGatedRefresher(contents string) (r *gatedRefresher) {
+	r = &gatedRefresher{
+		contents: contents,
+		release:  make(chan struct{}),
+	}
+
+	return
+}
+
+func (r *gatedRefresher) Size() (size int64) {
+	size = int64(len(r.contents))
+	return
+}
+
+func (r *gatedRefresher) Refresh(
+	ctx context.Context) (rc io.ReadCloser, err error) {
+	r.mu.Lock()
+	r.calls++
+	err = r.err
+	r.mu.Unlock()
+
+	<-r.release
+	if err != nil {
+		return
+	}
+
+	rc = ioutil.NopCloser(strings.NewReader(r.contents))
+	return
+}
+
+func (r *gatedRefresher) Calls() (calls int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	calls = r.calls
+	return
+}
+
+func (r *gatedRefresher) SetErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.err = err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FaultTest struct {
+	ctx       context.Context
+	leaser    lease.FileLeaser
+	refresher *gatedRefresher
+	proxy     lease.ReadProxy
+}
+
+var _ SetUpInterface = &FaultTest{}
+var _ TearDownInterface = &FaultTest{}
+
+func init() { RegisterTestSuite(&FaultTest{}) }
+
+func (t *FaultTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.leaser = lease.NewFileLeaser("", math.MaxInt32, math.MaxInt64)
+	t.refresher = newGatedRefresher("taco")
+	t.proxy = lease.NewReadProxy(t.leaser, t.refresher, nil)
+}
+
+func (t *FaultTest) TearDown() {
+	t.proxy.Destroy()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FaultTest) TryReadAt_NothingResident() {
+	buf := make([]byte, 2)
+
+	n, f, err := t.proxy.TryReadAt(buf, 1)
+	AssertEq(nil, err)
+	AssertNe(nil, f)
+	ExpectEq(0, n)
+	ExpectFalse(f.Done())
+
+	// Once the fault completes, the read is served locally.
+	close(t.refresher.release)
+	AssertEq(nil, f.Wait(t.ctx))
+	ExpectTrue(f.Done())
+
+	n, f, err = t.proxy.TryReadAt(buf, 1)
+	AssertEq(nil, err)
+	ExpectEq(nil, f)
+	ExpectEq("ac", string(buf[:n]))
+	ExpectEq(len("taco"), t.proxy.Residency())
+}
+
+func (t *FaultTest) TryReadAt_SingleFlight() {
+	buf := make([]byte, 4)
+
+	_, f0, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	AssertNe(nil, f0)
+
+	// Further reads while the fault is in flight join it.
+	_, f1, err := t.proxy.TryReadAt(buf[:1], 3)
+	AssertEq(nil, err)
+	ExpectEq(f0, f1)
+
+	close(t.refresher.release)
+	AssertEq(nil, f1.Wait(t.ctx))
+
+	n, f, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq(nil, f)
+	ExpectEq("taco", string(buf[:n]))
+
+	ExpectEq(1, t.refresher.Calls())
+}
+
+func (t *FaultTest) Wait_Cancelled() {
+	buf := make([]byte, 4)
+
+	_, f, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	AssertNe(nil, f)
+
+	// Cancelling the wait returns the context's error without affecting the
+	// fault.
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	err = f.Wait(ctx)
+	ExpectEq(context.Canceled, err)
+	ExpectFalse(f.Done())
+
+	// The result is still collected by a later read, without fetching again.
+	close(t.refresher.release)
+	AssertEq(nil, f.Wait(t.ctx))
+
+	n, f, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq(nil, f)
+	ExpectEq("taco", string(buf[:n]))
+	ExpectEq(1, t.refresher.Calls())
+}
+
+func (t *FaultTest) FetchFails() {
+	buf := make([]byte, 4)
+	t.refresher.SetErr(errors.New("taco"))
+	close(t.refresher.release)
+
+	_, f, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	AssertNe(nil, f)
+	AssertEq(nil, f.Wait(t.ctx))
+
+	// The error is returned by the next read.
+	_, f, err = t.proxy.TryReadAt(buf, 0)
+	ExpectThat(err, Error(HasSubstr("taco")))
+	ExpectEq(nil, f)
+
+	// The read after that tries again.
+	t.refresher.SetErr(nil)
+
+	_, f, err = t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	AssertNe(nil, f)
+	AssertEq(nil, f.Wait(t.ctx))
+
+	n, f, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq(nil, f)
+	ExpectEq("taco", string(buf[:n]))
+	ExpectEq(2, t.refresher.Calls())
+}
+
+func (t *FaultTest) ReadAtJoinsInFlightFault() {
+	buf := make([]byte, 4)
+
+	_, f, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	AssertNe(nil, f)
+
+	close(t.refresher.release)
+
+	n, err := t.proxy.ReadAt(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(buf[:n]))
+	ExpectEq(1, t.refresher.Calls())
+}
+
+func (t *FaultTest) DestroyWithFaultInFlight() {
+	_, f, err := t.proxy.TryReadAt(make([]byte, 4), 0)
+	AssertEq(nil, err)
+	AssertNe(nil, f)
+
+	// Destroying doesn't wait for the fault, whose result is thrown away.
+	t.proxy.Destroy()
+	close(t.refresher.release)
+	AssertEq(nil, f.Wait(t.ctx))
+
+	t.proxy = lease.NewReadProxy(t.leaser, t.refresher, nil)
+}
+
+func (t *FaultTest) MultiReadProxy_FaultsEachMissingChunk() {
+	refreshers := []*gatedRefresher{
+		newGatedRefresher("taco"),
+		newGatedRefresher("burrito"),
+		newGatedRefresher("enchilada"),
+	}
+
+	// The first chunk is already resident.
+	close(refreshers[0].release)
+
+	var wrapped []lease.Refresher
+	for _, r := range refreshers {
+		wrapped = append(wrapped, r)
+	}
+
+	t.proxy.Destroy()
+	t.proxy = lease.NewMultiReadProxy(t.leaser, wrapped, 0, nil)
+
+	buf := make([]byte, 4)
+	n, err := t.proxy.ReadAt(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	AssertEq("taco", string(buf[:n]))
+
+	// A read of the first chunk alone is served immediately.
+	n, f, err := t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq(nil, f)
+	ExpectEq("taco", string(buf[:n]))
+
+	// A read spanning all three starts faults for the missing two.
+	buf = make([]byte, 20)
+	n, f, err = t.proxy.TryReadAt(buf, 0)
+	AssertEq(nil, err)
+	AssertNe(nil, f)
+	ExpectEq(0, n)
+
+	// Once they complete, the read is served.
+	close(refreshers[1].release)
+	close(refreshers[2].release)
+
+	for {
+		AssertEq(nil, f.Wait(t.ctx))
+
+		n, f, err = t.proxy.TryReadAt(buf, 0)
+		AssertEq(nil, err)
+		if f == nil {
+			break
+		}
+	}
+
+	ExpectEq("tacoburritoenchilada", string(buf[:n]))
+	ExpectEq(1, refreshers[0].Calls())
+	ExpectEq(1, refreshers[1].Calls())
+	ExpectEq(1, refreshers[2].Calls())
+}
@@ -17,11 +17,13 @@ package lease
 import (
 	"container/list"
 	"fmt"
-	"log"
 	"os"
+	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/logger"
 	"github.com/jacobsa/fuse/fsutil"
 	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
 )
 
 // A type that manages read and read/write leases for anonymous temporary files.
@@ -31,10 +33,111 @@ type FileLeaser interface {
 	// Create a new anonymous file, and return a read/write lease for it. The
 	// read/write lease will pin resources until rwl.Downgrade is called. It need
 	// not be called if the process is exiting.
+	//
+	// If pinned read leases (see ReadLease.Pin) leave no room for the file
+	// within the limits, return a *NoSpaceError rather than revoking them.
 	NewFile() (rwl ReadWriteLease, err error)
 
+	// Like NewFile, but the lease carries the supplied tag, as does the read
+	// lease it is downgraded to (unless the caller supplies another). Tags are
+	// opaque to the leaser; see RevokeReadLeasesMatching.
+	NewTaggedFile(tag string) (rwl ReadWriteLease, err error)
+
 	// Revoke all read leases that have been issued. For testing use only.
 	RevokeReadLeases()
+
+	// Revoke the outstanding read leases whose tags are non-empty and satisfy
+	// match, returning the number revoked. Other leases keep their place in the
+	// order of recency of use.
+	//
+	// match is called with the leaser's lock held, so it must not call back into
+	// the leaser or its leases.
+	RevokeReadLeasesMatching(match func(tag string) bool) (n int)
+
+	// Return the number of temporary files currently leased, and an estimate of
+	// the bytes they occupy.
+	Usage() (numFiles int, bytes int64)
+
+	// Return a snapshot of the leaser's usage and limits, for reporting.
+	Stats() (s LeaserStats)
+
+	// Replace the limits on number of files and bytes, both of which must be
+	// positive, revoking least recently used read leases as necessary to get
+	// within the new ones before returning. As before, read/write leases may
+	// take usage over the limits, since they can't be revoked.
+	SetLimits(numFiles int, bytes int64)
+}
+
+// A snapshot of a file leaser's usage. See FileLeaser.Stats.
+type LeaserStats struct {
+	// The number of temporary files currently leased, and an estimate of the
+	// bytes they occupy, as for FileLeaser.Usage.
+	NumFiles int
+	Bytes    int64
+
+	// The limits currently in force. See FileLeaser.SetLimits.
+	LimitNumFiles int
+	LimitBytes    int64
+
+	// The number of read leases the leaser has revoked so far to stay within
+	// its limits, and the number revoked on request: by ReadLease.Revoke,
+	// RevokeReadLeases, or RevokeReadLeasesMatching. A high rate of the former
+	// means the leaser is thrashing.
+	CapacityRevocations  uint64
+	VoluntaryRevocations uint64
+
+	// The number of read leases currently pinned, and the bytes they occupy.
+	// These are included in NumFiles and Bytes. See ReadLease.Pin.
+	PinnedNumFiles int
+	PinnedBytes    int64
+}
+
+// A description of a read lease revoked to stay within the leaser's limits.
+// See FileLeaserConfig.OnEviction.
+type Eviction struct {
+	// The lease's tag, or the empty string if none.
+	Tag string
+
+	// The size of the lease's file.
+	Size int64
+
+	// The time since the lease was created by downgrading a read/write lease.
+	Age time.Duration
+}
+
+// Configuration for NewFileLeaserWithConfig.
+type FileLeaserConfig struct {
+	// The directory in which to create temporary files (before unlinking
+	// them). If empty, the system default will be used.
+	Dir string
+
+	// The limits on number of files and bytes that the leaser attempts to keep
+	// usage below. Both must be positive.
+	LimitNumFiles int
+	LimitBytes    int64
+
+	// If positive, read leases larger than this are revoked as soon as they're
+	// created by downgrading, without evicting anything else to make room for
+	// them. Read leases sharing a non-empty tag, such as those for the chunks
+	// of one object, are held to it together: the least recently used of them
+	// are revoked to keep their total within it. This stops one huge file from
+	// pushing all other cached contents out. Read/write leases may still grow
+	// past it.
+	LimitBytesPerLease int64
+
+	// See NewFileLeaserWithSpaceLimit. A zero MaxFreeFraction or a nil
+	// FreeSpace disables the check.
+	MaxFreeFraction float64
+	FreeSpace       FreeSpaceFunc
+
+	// If non-nil, called for each read lease revoked to stay within the limits.
+	// It is called with the leaser's lock held, so it must be quick and must
+	// not call back into the leaser or its leases.
+	OnEviction func(e Eviction)
+
+	// The clock used to measure the ages of leases. Defaults to the real
+	// clock.
+	Clock timeutil.Clock
 }
 
 // Create a new file leaser that uses the supplied directory for temporary
@@ -48,11 +151,55 @@ func NewFileLeaser(
 	dir string,
 	limitNumFiles int,
 	limitBytes int64) (fl FileLeaser) {
+	fl = NewFileLeaserWithSpaceLimit(dir, limitNumFiles, limitBytes, 0, nil)
+	return
+}
+
+// Like NewFileLeaser, but also refuse to create read/write leases or grow them
+// when they would occupy more than maxFreeFraction of the space in dir's file
+// system, as reported by freeSpace. Space occupied by read leases that aren't
+// pinned counts as free, since they are revoked to make room when the file
+// system has none. Operations refused for this reason fail with
+// *NoSpaceError, before anything is written. freeSpace is asked at most once a
+// second, its answer being adjusted in between for the leases' own growth.
+//
+// A maxFreeFraction of zero disables the check, as does a nil freeSpace.
+func NewFileLeaserWithSpaceLimit(
+	dir string,
+	limitNumFiles int,
+	limitBytes int64,
+	maxFreeFraction float64,
+	freeSpace FreeSpaceFunc) (fl FileLeaser) {
+	fl = NewFileLeaserWithConfig(FileLeaserConfig{
+		Dir:             dir,
+		LimitNumFiles:   limitNumFiles,
+		LimitBytes:      limitBytes,
+		MaxFreeFraction: maxFreeFraction,
+		FreeSpace:       freeSpace,
+	})
+
+	return
+}
+
+// Create a file leaser with the supplied configuration. See NewFileLeaser
+// and NewFileLeaserWithSpaceLimit.
+func NewFileLeaserWithConfig(cfg FileLeaserConfig) (fl FileLeaser) {
+	clock := cfg.Clock
+	if clock == nil {
+		clock = timeutil.RealClock()
+	}
+
 	typed := &fileLeaser{
-		dir:             dir,
-		limitNumFiles:   limitNumFiles,
-		limitBytes:      limitBytes,
+		dir:             cfg.Dir,
+		maxFreeFraction: cfg.MaxFreeFraction,
+		freeSpace:       cfg.FreeSpace,
+		onEviction:      cfg.OnEviction,
+		clock:           clock,
+		limitPerLease:   cfg.LimitBytesPerLease,
+		limitNumFiles:   cfg.LimitNumFiles,
+		limitBytes:      cfg.LimitBytes,
 		readLeasesIndex: make(map[*readLease]*list.Element),
+		pinnedLeases:    make(map[*readLease]struct{}),
 	}
 
 	typed.mu = syncutil.NewInvariantMutex(typed.checkInvariants)
@@ -66,9 +213,19 @@ type fileLeaser struct {
 	// Constant data
 	/////////////////////////
 
-	dir           string
-	limitNumFiles int
-	limitBytes    int64
+	dir string
+
+	// See NewFileLeaserWithSpaceLimit. freeSpace is nil if the check is
+	// disabled.
+	maxFreeFraction float64
+	freeSpace       FreeSpaceFunc
+
+	// See FileLeaserConfig. onEviction may be nil.
+	onEviction func(e Eviction)
+	clock      timeutil.Clock
+
+	// See FileLeaserConfig.LimitBytesPerLease. Zero if there is no limit.
+	limitPerLease int64
 
 	/////////////////////////
 	// Mutable state
@@ -91,6 +248,13 @@ type fileLeaser struct {
 	// locks from the same category together.
 	mu syncutil.InvariantMutex
 
+	// The limits on files and bytes. See SetLimits.
+	//
+	// INVARIANT: limitNumFiles > 0
+	// INVARIANT: limitBytes > 0
+	limitNumFiles int
+	limitBytes    int64
+
 	// The number of outstanding read/write leases.
 	//
 	// INVARIANT: readWriteCount >= 0
@@ -101,28 +265,65 @@ type fileLeaser struct {
 	// the wrapped file to e.g. write or truncate.
 	readWriteBytes int64
 
-	// All outstanding read leases, ordered by recency of use.
+	// All outstanding read leases that aren't pinned, ordered by recency of
+	// use. These are the ones that may be evicted.
 	//
 	// INVARIANT: Each element is of type *readLease
 	// INVARIANT: No element has been revoked.
-	// INVARIANT: 0 <= readLeases.Len() <= max(0, limitNumFiles - readWriteCount)
+	// INVARIANT: For each element rl, rl.pins == 0
+	// INVARIANT: 0 <= readLeases.Len() <=
+	//                max(0, limitNumFiles - readWriteCount - len(pinnedLeases))
 	readLeases list.List
 
-	// The sum of all outstanding read lease sizes.
+	// The sum of all outstanding unpinned read lease sizes.
 	//
 	// INVARIANT: Equal to the sum over readLeases sizes.
 	// INVARIANT: 0 <= readOutstanding
-	// INVARIANT: readOutstanding <= max(0, limitBytes - readWriteBytes)
+	// INVARIANT: readOutstanding <=
+	//                max(0, limitBytes - readWriteBytes - pinnedOutstanding)
 	readOutstanding int64
 
 	// Index of read leases by pointer.
 	//
 	// INVARIANT: Is an index of exactly the elements of readLeases
 	readLeasesIndex map[*readLease]*list.Element
+
+	// All outstanding read leases that are pinned, and the sum of their sizes.
+	//
+	// INVARIANT: No element has been revoked.
+	// INVARIANT: For each element rl, rl.pins > 0
+	// INVARIANT: No element is in readLeasesIndex.
+	// INVARIANT: pinnedOutstanding is the sum over pinnedLeases sizes.
+	pinnedLeases      map[*readLease]struct{}
+	pinnedOutstanding int64
+
+	// The number of read leases revoked by evict, and by other means. See
+	// LeaserStats.
+	capacityRevocations  uint64
+	voluntaryRevocations uint64
+
+	// The answer freeSpace last gave, when it gave it, and the bytes that our
+	// leases occupied at the time, or zero if it hasn't been asked. See
+	// refreshFreeSpace.
+	statFree  int64
+	statTime  time.Time
+	statUsage int64
 }
 
 // LOCKS_EXCLUDED(fl.mu)
 func (fl *fileLeaser) NewFile() (rwl ReadWriteLease, err error) {
+	rwl, err = fl.NewTaggedFile("")
+	return
+}
+
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) NewTaggedFile(tag string) (rwl ReadWriteLease, err error) {
+	// Refuse if we're already out of space.
+	err = fl.checkSpace(0)
+	if err != nil {
+		return
+	}
+
 	// Create an anonymous file.
 	f, err := fsutil.AnonymousFile(fl.dir)
 	if err != nil {
@@ -130,15 +331,35 @@ func (fl *fileLeaser) NewFile() (rwl ReadWriteLease, err error) {
 		return
 	}
 
-	// Wrap a lease around it.
-	rwl = newReadWriteLease(fl, 0, f)
+	// The file is created 0600 less the umask. Make sure it's exactly 0600, so
+	// that the owner can always reopen it and nobody else ever can.
+	err = f.Chmod(0600)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("Chmod: %v", err)
+		return
+	}
 
-	// Update state.
+	// Update state, backing out if pinned read leases leave no room for the
+	// file.
 	fl.mu.Lock()
 	fl.readWriteCount++
 	fl.evict(fl.limitNumFiles, fl.limitBytes)
+	err = fl.checkPinnedRoom()
+	if err != nil {
+		fl.readWriteCount--
+	}
+
 	fl.mu.Unlock()
 
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	// Wrap a lease around it.
+	rwl = newReadWriteLease(fl, 0, f, tag)
+
 	return
 }
 
@@ -147,7 +368,120 @@ func (fl *fileLeaser) RevokeReadLeases() {
 	fl.mu.Lock()
 	defer fl.mu.Unlock()
 
-	fl.evict(0, 0)
+	var all []*readLease
+	for e := fl.readLeases.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*readLease))
+	}
+
+	for rl := range fl.pinnedLeases {
+		all = append(all, rl)
+	}
+
+	for _, rl := range all {
+		func() {
+			rl.Mu.Lock()
+			defer rl.Mu.Unlock()
+
+			fl.revoke(rl)
+		}()
+
+		fl.voluntaryRevocations++
+	}
+}
+
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) RevokeReadLeasesMatching(
+	match func(tag string) bool) (n int) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	// Revoking removes the lease from the list, so find the next element first.
+	var next *list.Element
+	for e := fl.readLeases.Front(); e != nil; e = next {
+		next = e.Next()
+
+		rl := e.Value.(*readLease)
+		if rl.tag == "" || !match(rl.tag) {
+			continue
+		}
+
+		func() {
+			rl.Mu.Lock()
+			defer rl.Mu.Unlock()
+
+			fl.revoke(rl)
+		}()
+
+		n++
+		fl.voluntaryRevocations++
+	}
+
+	// Pinned leases are revoked too, since their contents are just as stale.
+	for rl := range fl.pinnedLeases {
+		if rl.tag == "" || !match(rl.tag) {
+			continue
+		}
+
+		func() {
+			rl.Mu.Lock()
+			defer rl.Mu.Unlock()
+
+			fl.revoke(rl)
+		}()
+
+		n++
+		fl.voluntaryRevocations++
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) Usage() (numFiles int, bytes int64) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	numFiles = fl.readWriteCount + fl.readLeases.Len() + len(fl.pinnedLeases)
+	bytes = fl.readWriteBytes + fl.readOutstanding + fl.pinnedOutstanding
+	return
+}
+
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) Stats() (s LeaserStats) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	s = LeaserStats{
+		NumFiles: fl.readWriteCount + fl.readLeases.Len() + len(fl.pinnedLeases),
+		Bytes: fl.readWriteBytes + fl.readOutstanding +
+			fl.pinnedOutstanding,
+		LimitNumFiles: fl.limitNumFiles,
+		LimitBytes:    fl.limitBytes,
+
+		CapacityRevocations:  fl.capacityRevocations,
+		VoluntaryRevocations: fl.voluntaryRevocations,
+
+		PinnedNumFiles: len(fl.pinnedLeases),
+		PinnedBytes:    fl.pinnedOutstanding,
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) SetLimits(numFiles int, bytes int64) {
+	if numFiles <= 0 || bytes <= 0 {
+		panic(fmt.Sprintf("Illegal limits: %d files, %d bytes", numFiles, bytes))
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	// Evict while still holding the lock, so that nobody sees the new limits
+	// before we're within them.
+	fl.limitNumFiles = numFiles
+	fl.limitBytes = bytes
+	fl.evict(fl.limitNumFiles, fl.limitBytes)
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -172,6 +506,15 @@ func maxInt64(a int64, b int64) int64 {
 
 // LOCKS_REQUIRED(fl.mu)
 func (fl *fileLeaser) checkInvariants() {
+	// INVARIANT: limitNumFiles > 0
+	// INVARIANT: limitBytes > 0
+	if fl.limitNumFiles <= 0 || fl.limitBytes <= 0 {
+		panic(fmt.Sprintf(
+			"Illegal limits: %d files, %d bytes",
+			fl.limitNumFiles,
+			fl.limitBytes))
+	}
+
 	// INVARIANT: readWriteCount >= 0
 	if fl.readWriteCount < 0 {
 		panic(fmt.Sprintf("Unexpected read/write count: %d", fl.readWriteCount))
@@ -179,6 +522,7 @@ func (fl *fileLeaser) checkInvariants() {
 
 	// INVARIANT: Each element is of type *readLease
 	// INVARIANT: No element has been revoked.
+	// INVARIANT: For each element rl, rl.pins == 0
 	for e := fl.readLeases.Front(); e != nil; e = e.Next() {
 		rl := e.Value.(*readLease)
 		func() {
@@ -189,16 +533,25 @@ func (fl *fileLeaser) checkInvariants() {
 				panic("Found revoked read lease")
 			}
 		}()
+
+		if rl.pins != 0 {
+			panic(fmt.Sprintf("Unpinned read lease has pin count %d", rl.pins))
+		}
 	}
 
-	// INVARIANT: 0 <= readLeases.Len() <= max(0, limitNumFiles - readWriteCount)
+	// INVARIANT: 0 <= readLeases.Len() <=
+	//                max(0, limitNumFiles - readWriteCount - len(pinnedLeases))
 	if !(0 <= fl.readLeases.Len() &&
-		fl.readLeases.Len() <= maxInt(0, fl.limitNumFiles-fl.readWriteCount)) {
+		fl.readLeases.Len() <= maxInt(
+			0,
+			fl.limitNumFiles-fl.readWriteCount-len(fl.pinnedLeases))) {
 		panic(fmt.Sprintf(
-			"Out of range read lease count: %d, limitNumFiles: %d, readWriteCount: %d",
+			"Out of range read lease count: %d, limitNumFiles: %d, "+
+				"readWriteCount: %d, pinned: %d",
 			fl.readLeases.Len(),
 			fl.limitNumFiles,
-			fl.readWriteCount))
+			fl.readWriteCount,
+			len(fl.pinnedLeases)))
 	}
 
 	// INVARIANT: Equal to the sum over readLeases sizes.
@@ -220,13 +573,18 @@ func (fl *fileLeaser) checkInvariants() {
 		panic(fmt.Sprintf("Unexpected readOutstanding: %v", fl.readOutstanding))
 	}
 
-	// INVARIANT: readOutstanding <= max(0, limitBytes - readWriteBytes)
-	if !(fl.readOutstanding <= maxInt64(0, fl.limitBytes-fl.readWriteBytes)) {
+	// INVARIANT: readOutstanding <=
+	//                max(0, limitBytes - readWriteBytes - pinnedOutstanding)
+	if !(fl.readOutstanding <= maxInt64(
+		0,
+		fl.limitBytes-fl.readWriteBytes-fl.pinnedOutstanding)) {
 		panic(fmt.Sprintf(
-			"Unexpected readOutstanding: %v. limitBytes: %v, readWriteBytes: %v",
+			"Unexpected readOutstanding: %v. limitBytes: %v, readWriteBytes: %v, "+
+				"pinnedOutstanding: %v",
 			fl.readOutstanding,
 			fl.limitBytes,
-			fl.readWriteBytes))
+			fl.readWriteBytes,
+			fl.pinnedOutstanding))
 	}
 
 	// INVARIANT: Is an index of exactly the elements of readLeases
@@ -242,6 +600,39 @@ func (fl *fileLeaser) checkInvariants() {
 			panic("Mismatch in readLeasesIndex")
 		}
 	}
+
+	// INVARIANT: No element has been revoked.
+	// INVARIANT: For each element rl, rl.pins > 0
+	// INVARIANT: No element is in readLeasesIndex.
+	// INVARIANT: pinnedOutstanding is the sum over pinnedLeases sizes.
+	var pinnedSum int64
+	for rl := range fl.pinnedLeases {
+		func() {
+			rl.Mu.Lock()
+			defer rl.Mu.Unlock()
+
+			if rl.revoked() {
+				panic("Found revoked pinned read lease")
+			}
+		}()
+
+		if rl.pins <= 0 {
+			panic(fmt.Sprintf("Pinned read lease has pin count %d", rl.pins))
+		}
+
+		if _, ok := fl.readLeasesIndex[rl]; ok {
+			panic("Pinned read lease is in readLeasesIndex")
+		}
+
+		pinnedSum += rl.Size()
+	}
+
+	if fl.pinnedOutstanding != pinnedSum {
+		panic(fmt.Sprintf(
+			"pinnedOutstanding mismatch: %v vs. %v",
+			fl.pinnedOutstanding,
+			pinnedSum))
+	}
 }
 
 // Add the supplied delta to the leaser's view of outstanding read/write lease
@@ -259,10 +650,175 @@ func (fl *fileLeaser) addReadWriteByteDelta(delta int64) {
 	fl.evict(fl.limitNumFiles, fl.limitBytes)
 }
 
+// Is the check made by checkSpace enabled?
+func (fl *fileLeaser) spaceLimited() bool {
+	return fl.freeSpace != nil && fl.maxFreeFraction > 0
+}
+
+// Might checkSpace refuse to let read/write leases grow?
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) growthLimited() bool {
+	if fl.spaceLimited() {
+		return true
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	return len(fl.pinnedLeases) != 0
+}
+
+// How long the answer given by freeSpace is trusted, so that writes don't
+// each cost a statfs(2).
+const freeSpaceCacheTTL = time.Second
+
+// Return a *NoSpaceError if growing read/write leases by delta bytes would
+// take them over the limit set by NewFileLeaserWithSpaceLimit, or over our
+// byte limit only because of pinned read leases. Otherwise revoke read leases
+// as necessary to free up the room counted on.
+//
+// Called by readWriteLease while holding its lock.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) checkSpace(delta int64) (err error) {
+	err = fl.checkPinnedSpace(delta)
+	if err != nil || !fl.spaceLimited() {
+		return
+	}
+
+	err = fl.refreshFreeSpace()
+	if err != nil {
+		return
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	// What we already occupy is available to us, as are unpinned read leases,
+	// which can be revoked. Pinned read leases can't be, so they don't count.
+	free := fl.estimateFreeSpace()
+	available := free + fl.readWriteBytes + fl.readOutstanding
+	allowed := int64(fl.maxFreeFraction * float64(available))
+	needed := fl.readWriteBytes + delta
+
+	if needed > allowed {
+		err = &NoSpaceError{
+			Needed:  needed,
+			Allowed: allowed,
+		}
+
+		return
+	}
+
+	// Read leases count as free only because they can be revoked, so do that if
+	// the file system doesn't have the room without them.
+	for delta > fl.estimateFreeSpace() {
+		lru := fl.readLeases.Back()
+		if lru == nil {
+			break
+		}
+
+		fl.evictLease(lru.Value.(*readLease))
+	}
+
+	return
+}
+
+// Ask freeSpace how much space is free in our directory's file system, unless
+// it was asked within freeSpaceCacheTTL.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) refreshFreeSpace() (err error) {
+	fl.mu.Lock()
+	fresh := !fl.statTime.IsZero() &&
+		fl.clock.Now().Sub(fl.statTime) < freeSpaceCacheTTL
+	fl.mu.Unlock()
+
+	if fresh {
+		return
+	}
+
+	// Don't hold the lock while asking the file system.
+	free, err := fl.freeSpace(fl.dir)
+	if err != nil {
+		err = fmt.Errorf("freeSpace: %v", err)
+		return
+	}
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	fl.statFree = free
+	fl.statTime = fl.clock.Now()
+	fl.statUsage = fl.readWriteBytes + fl.readOutstanding + fl.pinnedOutstanding
+
+	return
+}
+
+// Return the space free in our directory's file system: what freeSpace last
+// said, less whatever our leases have taken up since.
+//
+// LOCKS_REQUIRED(fl.mu)
+func (fl *fileLeaser) estimateFreeSpace() int64 {
+	usage := fl.readWriteBytes + fl.readOutstanding + fl.pinnedOutstanding
+	return fl.statFree - (usage - fl.statUsage)
+}
+
 // LOCKS_REQUIRED(fl.mu)
 func (fl *fileLeaser) overLimit(limitNumFiles int, limitBytes int64) bool {
-	return fl.readLeases.Len()+fl.readWriteCount > limitNumFiles ||
-		fl.readOutstanding+fl.readWriteBytes > limitBytes
+	return fl.readLeases.Len()+len(fl.pinnedLeases)+fl.readWriteCount >
+		limitNumFiles ||
+		fl.readOutstanding+fl.pinnedOutstanding+fl.readWriteBytes > limitBytes
+}
+
+// Return a *NoSpaceError if growing read/write leases by delta bytes would
+// leave no room for pinned read leases within our byte limit. As in
+// checkPinnedRoom, read/write leases alone may exceed it.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) checkPinnedSpace(delta int64) (err error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	needed := fl.readWriteBytes + delta
+	if needed <= fl.limitBytes && needed+fl.pinnedOutstanding > fl.limitBytes {
+		err = &NoSpaceError{
+			Needed:  needed + fl.pinnedOutstanding,
+			Allowed: fl.limitBytes,
+		}
+	}
+
+	return
+}
+
+// Having evicted what we can, return a *NoSpaceError if we're still over our
+// limits only because of pinned read leases. Read/write leases alone are
+// allowed to take us over them, as documented.
+//
+// LOCKS_REQUIRED(fl.mu)
+func (fl *fileLeaser) checkPinnedRoom() (err error) {
+	if len(fl.pinnedLeases) == 0 || !fl.overLimit(fl.limitNumFiles, fl.limitBytes) {
+		return
+	}
+
+	switch {
+	case fl.readWriteCount+len(fl.pinnedLeases) > fl.limitNumFiles &&
+		fl.readWriteCount <= fl.limitNumFiles:
+		err = &NoSpaceError{
+			NeededFiles:  fl.readWriteCount + len(fl.pinnedLeases),
+			AllowedFiles: fl.limitNumFiles,
+		}
+
+	case fl.readWriteBytes+fl.pinnedOutstanding > fl.limitBytes &&
+		fl.readWriteBytes <= fl.limitBytes:
+		err = &NoSpaceError{
+			Needed:  fl.readWriteBytes + fl.pinnedOutstanding,
+			Allowed: fl.limitBytes,
+		}
+	}
+
+	return
 }
 
 // Revoke read leases until we're within the given limitBytes or we run out of
@@ -278,28 +834,75 @@ func (fl *fileLeaser) evict(limitNumFiles int, limitBytes int64) {
 		}
 
 		// Revoke it.
-		rl := lru.Value.(*readLease)
-		func() {
-			rl.Mu.Lock()
-			defer rl.Mu.Unlock()
+		fl.evictLease(lru.Value.(*readLease))
+	}
+}
 
-			fl.revoke(rl)
-		}()
+// Revoke the supplied read lease to stay within our limits, reporting it as
+// an eviction.
+//
+// LOCKS_REQUIRED(fl.mu)
+func (fl *fileLeaser) evictLease(rl *readLease) {
+	fl.capacityRevocations++
+	func() {
+		rl.Mu.Lock()
+		defer rl.Mu.Unlock()
+
+		fl.revoke(rl)
+	}()
+
+	if fl.onEviction != nil {
+		fl.onEviction(Eviction{
+			Tag:  rl.tag,
+			Size: rl.size,
+			Age:  fl.clock.Now().Sub(rl.created),
+		})
+	}
+}
+
+// Revoke the least recently used read leases carrying the supplied tag until
+// those left, pinned or not, total no more than the per-lease limit. Leases
+// sharing a tag hold parts of the same contents, such as the chunks of an
+// object, so the limit applies to them together.
+//
+// LOCKS_REQUIRED(fl.mu)
+func (fl *fileLeaser) evictTagOverLimit(tag string) {
+	var total int64
+	for rl := range fl.pinnedLeases {
+		if rl.tag == tag {
+			total += rl.size
+		}
+	}
+
+	// Find the unpinned ones, most recently used first.
+	var tagged []*readLease
+	for e := fl.readLeases.Front(); e != nil; e = e.Next() {
+		rl := e.Value.(*readLease)
+		if rl.tag == tag {
+			tagged = append(tagged, rl)
+			total += rl.size
+		}
+	}
+
+	for i := len(tagged) - 1; i >= 0 && total > fl.limitPerLease; i-- {
+		total -= tagged[i].size
+		fl.evictLease(tagged[i])
 	}
 }
 
 // Note that a read/write lease of the given size is destroying itself, and
-// turn it into a read lease of the supplied size wrapped around the given
-// file.
+// turn it into a read lease of the supplied size and tag wrapped around the
+// given file.
 //
 // Called by readWriteLease with its lock held.
 //
 // LOCKS_EXCLUDED(fl.mu)
 func (fl *fileLeaser) downgrade(
 	size int64,
-	file *os.File) (rl ReadLease) {
+	file *os.File,
+	tag string) (rl ReadLease) {
 	// Create the read lease.
-	rlTyped := newReadLease(size, fl, file)
+	rlTyped := newReadLease(size, fl, file, tag, fl.clock.Now())
 	rl = rlTyped
 
 	// Update the leaser's state, noting the new read lease and that the
@@ -314,7 +917,17 @@ func (fl *fileLeaser) downgrade(
 	e := fl.readLeases.PushFront(rl)
 	fl.readLeasesIndex[rlTyped] = e
 
-	// Ensure that we're not now over capacity.
+	// If the lease is too large to keep, get rid of it alone. Otherwise ensure
+	// that we're not now over capacity.
+	if fl.limitPerLease > 0 && size > fl.limitPerLease {
+		fl.evictLease(rlTyped)
+		return
+	}
+
+	if fl.limitPerLease > 0 && tag != "" {
+		fl.evictTagOverLimit(tag)
+	}
+
 	fl.evict(fl.limitNumFiles, fl.limitBytes)
 
 	return
@@ -344,19 +957,15 @@ func (fl *fileLeaser) upgrade(rl *readLease) (rwl ReadWriteLease, err error) {
 	// Update leaser state.
 	fl.readWriteCount++
 	fl.readWriteBytes += size
-	fl.readOutstanding -= size
-
-	e := fl.readLeasesIndex[rl]
-	delete(fl.readLeasesIndex, rl)
-	fl.readLeases.Remove(e)
+	fl.forget(rl)
 
 	// Extract the interesting information from the read lease, leaving it an
 	// empty husk.
 	file := rl.release()
 
 	// Create the read/write lease, telling it that we already know its initial
-	// size.
-	rwl = newReadWriteLease(fl, size, file)
+	// size. It keeps the read lease's tag.
+	rwl = newReadWriteLease(fl, size, file, rl.tag)
 
 	return
 }
@@ -389,19 +998,13 @@ func (fl *fileLeaser) revoke(rl *readLease) {
 		panic("Already revoked")
 	}
 
-	size := rl.Size()
-
 	// Update leaser state.
-	fl.readOutstanding -= size
-
-	e := fl.readLeasesIndex[rl]
-	delete(fl.readLeasesIndex, rl)
-	fl.readLeases.Remove(e)
+	fl.forget(rl)
 
 	// Kill the lease and close its file.
 	file := rl.release()
 	if err := file.Close(); err != nil {
-		log.Println("Error closing file for revoked lease:", err)
+		logger.Errorf("Error closing file for revoked lease: %v", err)
 	}
 }
 
@@ -424,4 +1027,90 @@ func (fl *fileLeaser) revokeVoluntarily(rl *readLease) {
 
 	// Revoke it.
 	fl.revoke(rl)
+	fl.voluntaryRevocations++
+}
+
+// Remove the supplied read lease from our records of outstanding read leases,
+// whether or not it is pinned.
+//
+// REQUIRES: !rl.revoked()
+//
+// LOCKS_REQUIRED(fl.mu)
+func (fl *fileLeaser) forget(rl *readLease) {
+	size := rl.Size()
+
+	if rl.pins > 0 {
+		delete(fl.pinnedLeases, rl)
+		fl.pinnedOutstanding -= size
+		return
+	}
+
+	fl.readOutstanding -= size
+
+	e := fl.readLeasesIndex[rl]
+	delete(fl.readLeasesIndex, rl)
+	fl.readLeases.Remove(e)
+}
+
+// Called by the read lease when the user wants to pin it. Revocation happens
+// only with our lock held, so there is no need for the lease's.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) pin(rl *readLease) (err error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	// Has the lease already been revoked?
+	if rl.revoked() {
+		err = &RevokedError{}
+		return
+	}
+
+	// Move the lease out of reach of eviction if this is its first pin. This
+	// doesn't change our usage, so there's no need to evict anything.
+	rl.pins++
+	if rl.pins == 1 {
+		size := rl.Size()
+
+		e := fl.readLeasesIndex[rl]
+		delete(fl.readLeasesIndex, rl)
+		fl.readLeases.Remove(e)
+		fl.readOutstanding -= size
+
+		fl.pinnedLeases[rl] = struct{}{}
+		fl.pinnedOutstanding += size
+	}
+
+	return
+}
+
+// Called by the read lease when the user wants to unpin it.
+//
+// LOCKS_EXCLUDED(fl.mu)
+func (fl *fileLeaser) unpin(rl *readLease) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	if rl.pins == 0 {
+		panic("Unpin without matching Pin")
+	}
+
+	rl.pins--
+
+	// A revoked lease is in neither set, so there's nothing else to do.
+	if rl.pins > 0 || rl.revoked() {
+		return
+	}
+
+	// Make the lease most recently used again, then get back within our limits
+	// if the pin was holding us over them.
+	size := rl.Size()
+	delete(fl.pinnedLeases, rl)
+	fl.pinnedOutstanding -= size
+
+	fl.readOutstanding += size
+	e := fl.readLeases.PushFront(rl)
+	fl.readLeasesIndex[rl] = e
+
+	fl.evict(fl.limitNumFiles, fl.limitBytes)
 }
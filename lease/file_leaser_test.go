@@ -18,11 +18,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/lease"
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
 )
 
 func TestFileLeaser(t *testing.T) { RunTests(t) }
@@ -69,6 +73,24 @@ func newFileOfLength(
 	return
 }
 
+// Like newFileOfLength, but with a tagged lease.
+func newTaggedFileOfLength(
+	fl lease.FileLeaser,
+	tag string,
+	length int) (rwl lease.ReadWriteLease) {
+	var err error
+	defer panicIf(&err)
+
+	rwl, err = fl.NewTaggedFile(tag)
+	if err != nil {
+		err = fmt.Errorf("NewTaggedFile: %v", err)
+		return
+	}
+
+	growBy(rwl, length)
+	return
+}
+
 // Upgrade the supplied lease or panic.
 func upgrade(rl lease.ReadLease) (rwl lease.ReadWriteLease) {
 	var err error
@@ -109,7 +131,11 @@ const limitNumFiles = 5
 const limitBytes = 17
 
 type FileLeaserTest struct {
-	fl lease.FileLeaser
+	clock timeutil.SimulatedClock
+	fl    lease.FileLeaser
+
+	// Evictions reported by the leaser.
+	evictions []lease.Eviction
 }
 
 var _ SetUpInterface = &FileLeaserTest{}
@@ -117,7 +143,15 @@ var _ SetUpInterface = &FileLeaserTest{}
 func init() { RegisterTestSuite(&FileLeaserTest{}) }
 
 func (t *FileLeaserTest) SetUp(ti *TestInfo) {
-	t.fl = lease.NewFileLeaser("", limitNumFiles, limitBytes)
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.fl = lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		LimitNumFiles: limitNumFiles,
+		LimitBytes:    limitBytes,
+		Clock:         &t.clock,
+		OnEviction: func(e lease.Eviction) {
+			t.evictions = append(t.evictions, e)
+		},
+	})
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -156,6 +190,29 @@ func (t *FileLeaserTest) ReadWriteLeaseInitialState() {
 	ExpectEq(0, n)
 }
 
+func (t *FileLeaserTest) SparseReadWriteLease() {
+	var err error
+
+	rwl, err := t.fl.NewFile()
+	AssertEq(nil, err)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	// Write a single byte far into the file.
+	const offset = 1 << 30
+	_, err = rwl.WriteAt([]byte("a"), offset)
+	AssertEq(nil, err)
+
+	size, err := rwl.Size()
+	AssertEq(nil, err)
+	ExpectEq(offset+1, size)
+
+	// Very little should actually be allocated.
+	allocated, err := rwl.AllocatedBytes()
+	AssertEq(nil, err)
+	ExpectGt(allocated, 0)
+	ExpectLt(allocated, 1<<20)
+}
+
 func (t *FileLeaserTest) ModifyThenObserveReadWriteLease() {
 	var n int
 	var off int64
@@ -589,3 +646,587 @@ func (t *FileLeaserTest) RevokeAllReadLeases() {
 	rl0.Revoke()
 	rl1.Revoke()
 }
+
+func (t *FileLeaserTest) Usage() {
+	type usage struct {
+		numFiles int
+		bytes    int64
+	}
+
+	current := func() usage {
+		n, b := t.fl.Usage()
+		return usage{n, b}
+	}
+
+	ExpectThat(current(), DeepEquals(usage{0, 0}))
+
+	// Read/write leases count.
+	rwl := newFileOfLength(t.fl, 3)
+	ExpectThat(current(), DeepEquals(usage{1, 3}))
+
+	// So do read leases.
+	rl := rwl.Downgrade()
+	ExpectThat(current(), DeepEquals(usage{1, 3}))
+
+	newFileOfLength(t.fl, 4)
+	ExpectThat(current(), DeepEquals(usage{2, 7}))
+
+	// Revoked leases don't.
+	rl.Revoke()
+	ExpectThat(current(), DeepEquals(usage{1, 4}))
+}
+
+func (t *FileLeaserTest) Stats() {
+	ExpectThat(
+		t.fl.Stats(),
+		DeepEquals(lease.LeaserStats{
+			LimitNumFiles: limitNumFiles,
+			LimitBytes:    limitBytes,
+		}))
+
+	// Fill up to the byte limit with read leases, then add one more. The
+	// least recently used should be revoked to make room.
+	rl0 := newFileOfLength(t.fl, limitBytes-1).Downgrade()
+	newFileOfLength(t.fl, 1).Downgrade()
+	newFileOfLength(t.fl, 1).Downgrade()
+
+	AssertTrue(rl0.Revoked())
+
+	s := t.fl.Stats()
+	ExpectEq(2, s.NumFiles)
+	ExpectEq(2, s.Bytes)
+	ExpectEq(1, s.CapacityRevocations)
+	ExpectEq(0, s.VoluntaryRevocations)
+}
+
+func (t *FileLeaserTest) EvictionsAreReported() {
+	rl0 := newTaggedFileOfLength(t.fl, "taco", limitBytes-2).Downgrade()
+	t.clock.AdvanceTime(time.Second)
+	rl1 := newFileOfLength(t.fl, 1).Downgrade()
+	t.clock.AdvanceTime(time.Second)
+
+	// Revoking voluntarily isn't an eviction.
+	rl1.Revoke()
+	ExpectEq(0, len(t.evictions))
+
+	// Pushing out the first lease is.
+	newFileOfLength(t.fl, 3).Downgrade()
+	AssertTrue(rl0.Revoked())
+	ExpectThat(
+		t.evictions,
+		ElementsAre(
+			DeepEquals(lease.Eviction{
+				Tag:  "taco",
+				Size: limitBytes - 2,
+				Age:  2 * time.Second,
+			})))
+}
+
+func (t *FileLeaserTest) VoluntaryRevocations() {
+	rl0 := newTaggedFileOfLength(t.fl, "a", 1).Downgrade()
+	newTaggedFileOfLength(t.fl, "b", 1).Downgrade()
+	newFileOfLength(t.fl, 1).Downgrade()
+
+	// Revoking a lease directly, by tag, or wholesale all count.
+	rl0.Revoke()
+	rl0.Revoke()
+	ExpectEq(1, t.fl.Stats().VoluntaryRevocations)
+
+	t.fl.RevokeReadLeasesMatching(func(tag string) bool { return tag == "b" })
+	ExpectEq(2, t.fl.Stats().VoluntaryRevocations)
+
+	t.fl.RevokeReadLeases()
+
+	s := t.fl.Stats()
+	ExpectEq(3, s.VoluntaryRevocations)
+	ExpectEq(0, s.CapacityRevocations)
+}
+
+func (t *FileLeaserTest) PerLeaseLimit_DowngradeAboveLimit() {
+	t.fl = lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		LimitNumFiles:      limitNumFiles,
+		LimitBytes:         limitBytes,
+		LimitBytesPerLease: 4,
+		Clock:              &t.clock,
+		OnEviction: func(e lease.Eviction) {
+			t.evictions = append(t.evictions, e)
+		},
+	})
+
+	// Set up a read lease within the per-lease limit.
+	rl0 := newFileOfLength(t.fl, 4).Downgrade()
+
+	// A read/write lease may grow past the per-lease limit.
+	rwl := newTaggedFileOfLength(t.fl, "taco", 5)
+	size, err := rwl.Size()
+	AssertEq(nil, err)
+	ExpectEq(5, size)
+
+	// But the read lease it becomes is revoked on arrival, leaving the other
+	// alone.
+	rl1 := rwl.Downgrade()
+	ExpectTrue(rl1.Revoked())
+	ExpectFalse(rl0.Revoked())
+
+	// That counts as an eviction.
+	ExpectThat(
+		t.evictions,
+		ElementsAre(
+			DeepEquals(lease.Eviction{
+				Tag:  "taco",
+				Size: 5,
+			})))
+
+	s := t.fl.Stats()
+	ExpectEq(1, s.NumFiles)
+	ExpectEq(4, s.Bytes)
+	ExpectEq(1, s.CapacityRevocations)
+}
+
+func (t *FileLeaserTest) PerLeaseLimit_SmallLeasesSurviveLargeOnes() {
+	t.fl = lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		LimitNumFiles:      limitNumFiles,
+		LimitBytes:         limitBytes,
+		LimitBytesPerLease: 2,
+	})
+
+	// Set up some small read leases.
+	AssertLt(3*2+10, limitBytes)
+	var small []lease.ReadLease
+	for i := 0; i < 3; i++ {
+		small = append(small, newFileOfLength(t.fl, 2).Downgrade())
+	}
+
+	// Stream many large files through the leaser, each fitting in the space
+	// that's left. None of them should stay around to push the small leases
+	// out.
+	for i := 0; i < 4*limitNumFiles; i++ {
+		rl := newFileOfLength(t.fl, 10).Downgrade()
+		AssertTrue(rl.Revoked(), "i: %d", i)
+	}
+
+	for i, rl := range small {
+		ExpectFalse(rl.Revoked(), "i: %d", i)
+	}
+
+	// They remain usable.
+	buf := make([]byte, 2)
+	n, err := small[0].ReadAt(buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("aa", string(buf[:n]))
+}
+
+func (t *FileLeaserTest) PinnedLeasesAreNotEvicted() {
+	AssertLt(4, limitBytes)
+
+	// Set up two read leases, and pin the least recently used.
+	rl0 := newFileOfLength(t.fl, 2).Downgrade()
+	rl1 := newFileOfLength(t.fl, 2).Downgrade()
+	AssertEq(nil, rl0.Pin())
+
+	// Making room for a read/write lease should evict the other.
+	rwl := newFileOfLength(t.fl, limitBytes-2)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	ExpectFalse(rl0.Revoked())
+	ExpectTrue(rl1.Revoked())
+
+	s := t.fl.Stats()
+	ExpectEq(2, s.NumFiles)
+	ExpectEq(limitBytes, s.Bytes)
+	ExpectEq(1, s.PinnedNumFiles)
+	ExpectEq(2, s.PinnedBytes)
+}
+
+func (t *FileLeaserTest) PinsNest() {
+	rl := newFileOfLength(t.fl, 1).Downgrade()
+	AssertEq(nil, rl.Pin())
+	AssertEq(nil, rl.Pin())
+	rl.Unpin()
+
+	// Still pinned, so a read/write lease too large for the limit on its own
+	// may take us over it without the read lease being evicted.
+	rwl := newFileOfLength(t.fl, limitBytes+1)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	ExpectFalse(rl.Revoked())
+
+	// Unpinning for the last time should get us back within the limit.
+	rl.Unpin()
+	ExpectTrue(rl.Revoked())
+	ExpectEq(0, t.fl.Stats().PinnedNumFiles)
+}
+
+func (t *FileLeaserTest) UnpinningMakesMostRecentlyUsed() {
+	AssertLe(3, limitNumFiles)
+
+	// Set up three read leases, pinning the least recently used and then
+	// unpinning it after the others have been created.
+	rl0 := newFileOfLength(t.fl, 1).Downgrade()
+	AssertEq(nil, rl0.Pin())
+
+	rl1 := newFileOfLength(t.fl, 1).Downgrade()
+	rl2 := newFileOfLength(t.fl, 1).Downgrade()
+	rl0.Unpin()
+
+	// Shrinking the limit should evict the others first.
+	t.fl.SetLimits(1, limitBytes)
+	ExpectFalse(rl0.Revoked())
+	ExpectTrue(rl1.Revoked())
+	ExpectTrue(rl2.Revoked())
+}
+
+func (t *FileLeaserTest) NewFileFailsWhenPinnedLeasesFillFileLimit() {
+	// Pin as many read leases as we may have files.
+	var rls []lease.ReadLease
+	for i := 0; i < limitNumFiles; i++ {
+		rl := newFileOfLength(t.fl, 1).Downgrade()
+		AssertEq(nil, rl.Pin())
+		rls = append(rls, rl)
+	}
+
+	// There's no room for another file, and nothing is evicted to make some.
+	_, err := t.fl.NewFile()
+	ExpectThat(err, HasSameTypeAs(&lease.NoSpaceError{}))
+	ExpectThat(err, Error(HasSubstr("need 6 files, allowed 5")))
+
+	for i, rl := range rls {
+		ExpectFalse(rl.Revoked(), "i: %d", i)
+	}
+
+	ExpectEq(limitNumFiles, t.fl.Stats().NumFiles)
+
+	// Once one is unpinned, it can be evicted to make room.
+	rls[0].Unpin()
+
+	rwl, err := t.fl.NewFile()
+	AssertEq(nil, err)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	ExpectTrue(rls[0].Revoked())
+	ExpectFalse(rls[1].Revoked())
+}
+
+func (t *FileLeaserTest) NewFileFailsWhenPinnedLeasesFillByteLimit() {
+	// Pin a read lease that takes up nearly all of the byte limit, and fill the
+	// rest with a read/write lease.
+	rl := newFileOfLength(t.fl, limitBytes-1).Downgrade()
+	AssertEq(nil, rl.Pin())
+
+	rwl := newFileOfLength(t.fl, 1)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	// The read/write lease can't grow any further.
+	_, err := rwl.Write([]byte("a"))
+	ExpectThat(err, HasSameTypeAs(&lease.NoSpaceError{}))
+	ExpectThat(err, Error(HasSubstr("need 18 bytes, allowed 17")))
+
+	// Nor is there room for another file once the limit shrinks.
+	t.fl.SetLimits(limitNumFiles, limitBytes-1)
+
+	_, err = t.fl.NewFile()
+	ExpectThat(err, HasSameTypeAs(&lease.NoSpaceError{}))
+	ExpectThat(err, Error(HasSubstr("need 17 bytes, allowed 16")))
+	ExpectFalse(rl.Revoked())
+}
+
+func (t *FileLeaserTest) PinnedLeasesMayBeRevokedOnRequest() {
+	rl0 := newTaggedFileOfLength(t.fl, "taco", 1).Downgrade()
+	rl1 := newTaggedFileOfLength(t.fl, "burrito", 1).Downgrade()
+	rl2 := newFileOfLength(t.fl, 1).Downgrade()
+	AssertEq(nil, rl0.Pin())
+	AssertEq(nil, rl1.Pin())
+	AssertEq(nil, rl2.Pin())
+
+	n := t.fl.RevokeReadLeasesMatching(func(tag string) bool {
+		return tag == "taco"
+	})
+
+	ExpectEq(1, n)
+	ExpectTrue(rl0.Revoked())
+	ExpectFalse(rl1.Revoked())
+
+	rl1.Revoke()
+	ExpectTrue(rl1.Revoked())
+
+	t.fl.RevokeReadLeases()
+	ExpectTrue(rl2.Revoked())
+
+	// Unpinning revoked leases is fine, but they can't be pinned again.
+	rl0.Unpin()
+	rl1.Unpin()
+	rl2.Unpin()
+	ExpectThat(rl0.Pin(), HasSameTypeAs(&lease.RevokedError{}))
+
+	s := t.fl.Stats()
+	ExpectEq(0, s.NumFiles)
+	ExpectEq(0, s.PinnedNumFiles)
+	ExpectEq(3, s.VoluntaryRevocations)
+}
+
+func (t *FileLeaserTest) UpgradePinnedLease() {
+	rl := newFileOfLength(t.fl, 3).Downgrade()
+	AssertEq(nil, rl.Pin())
+
+	rwl, err := rl.Upgrade()
+	AssertEq(nil, err)
+	rl.Unpin()
+
+	s := t.fl.Stats()
+	ExpectEq(1, s.NumFiles)
+	ExpectEq(3, s.Bytes)
+	ExpectEq(0, s.PinnedNumFiles)
+
+	rwl.Downgrade().Revoke()
+}
+
+func (t *FileLeaserTest) UnpinWithoutPinPanics() {
+	rl := newFileOfLength(t.fl, 1).Downgrade()
+	AssertEq(nil, rl.Pin())
+	rl.Unpin()
+
+	ExpectThat(rl.Unpin, Panics(HasSubstr("Unpin without matching Pin")))
+
+	// The lease is still usable.
+	ExpectFalse(rl.Revoked())
+	AssertEq(nil, rl.Pin())
+	rl.Unpin()
+}
+
+func (t *FileLeaserTest) PerLeaseLimit_TaggedLeasesShareLimit() {
+	t.fl = lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		LimitNumFiles:      limitNumFiles,
+		LimitBytes:         limitBytes,
+		LimitBytesPerLease: 5,
+	})
+
+	// Leases for different contents don't count against each other.
+	other := newTaggedFileOfLength(t.fl, "burrito", 4).Downgrade()
+	untagged := newFileOfLength(t.fl, 4).Downgrade()
+
+	// Leases sharing a tag do. Adding a third evicts the least recently used.
+	rl0 := newTaggedFileOfLength(t.fl, "taco", 2).Downgrade()
+	rl1 := newTaggedFileOfLength(t.fl, "taco", 2).Downgrade()
+	ExpectFalse(rl0.Revoked())
+
+	rl2 := newTaggedFileOfLength(t.fl, "taco", 2).Downgrade()
+	ExpectTrue(rl0.Revoked())
+	ExpectFalse(rl1.Revoked())
+	ExpectFalse(rl2.Revoked())
+
+	ExpectFalse(other.Revoked())
+	ExpectFalse(untagged.Revoked())
+}
+
+func (t *FileLeaserTest) SetLimits_Shrink() {
+	// Set up read leases of 1, 2, and 3 bytes, with the first least recently
+	// used.
+	rl1 := newFileOfLength(t.fl, 1).Downgrade()
+	rl2 := newFileOfLength(t.fl, 2).Downgrade()
+	rl3 := newFileOfLength(t.fl, 3).Downgrade()
+
+	// Shrinking the byte limit should revoke the least recently used until we
+	// fit.
+	t.fl.SetLimits(limitNumFiles, 4)
+
+	ExpectTrue(rl1.Revoked())
+	ExpectTrue(rl2.Revoked())
+	ExpectFalse(rl3.Revoked())
+
+	s := t.fl.Stats()
+	ExpectEq(1, s.NumFiles)
+	ExpectEq(3, s.Bytes)
+	ExpectEq(4, s.LimitBytes)
+	ExpectEq(2, s.CapacityRevocations)
+
+	// The same goes for the file limit.
+	rl4 := newFileOfLength(t.fl, 1).Downgrade()
+	t.fl.SetLimits(1, 4)
+
+	ExpectTrue(rl3.Revoked())
+	ExpectFalse(rl4.Revoked())
+	ExpectEq(1, t.fl.Stats().LimitNumFiles)
+}
+
+func (t *FileLeaserTest) SetLimits_Grow() {
+	t.fl.SetLimits(limitNumFiles, 2*limitBytes)
+
+	// Twice as many bytes of read leases should now fit.
+	rl0 := newFileOfLength(t.fl, limitBytes).Downgrade()
+	rl1 := newFileOfLength(t.fl, limitBytes).Downgrade()
+
+	ExpectFalse(rl0.Revoked())
+	ExpectFalse(rl1.Revoked())
+
+	// But no more.
+	newFileOfLength(t.fl, 1).Downgrade()
+	ExpectTrue(rl0.Revoked())
+}
+
+func (t *FileLeaserTest) SetLimits_ReadWriteLeasesNotRevoked() {
+	rwl := newFileOfLength(t.fl, 10)
+	rl := newFileOfLength(t.fl, 1).Downgrade()
+
+	t.fl.SetLimits(limitNumFiles, 5)
+
+	// The read lease goes, but the read/write lease stays, over the limit.
+	ExpectTrue(rl.Revoked())
+	ExpectEq(10, t.fl.Stats().Bytes)
+
+	// Once it's downgraded, it goes too.
+	rl = rwl.Downgrade()
+	ExpectTrue(rl.Revoked())
+	ExpectEq(0, t.fl.Stats().Bytes)
+}
+
+func (t *FileLeaserTest) SetLimits_ConcurrentWrites() {
+	const numWorkers = 8
+	const fileSize = 4
+	const shrunk = 2 * fileSize
+
+	t.fl.SetLimits(limitNumFiles, 1<<20)
+
+	// Create and downgrade files continually until told to stop.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				newFileOfLength(t.fl, fileSize).Downgrade()
+			}
+		}()
+	}
+
+	// Shrink the limit. From then on read leases never take us over it, though
+	// read/write leases in flight may.
+	t.fl.SetLimits(limitNumFiles, shrunk)
+	for i := 0; i < 100; i++ {
+		ExpectLe(t.fl.Stats().Bytes, shrunk+numWorkers*fileSize)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	ExpectLe(t.fl.Stats().Bytes, shrunk)
+}
+
+func (t *FileLeaserTest) TagsFollowLeases() {
+	// Untagged.
+	rl := newFileOfLength(t.fl, 1).Downgrade()
+	ExpectEq("", rl.Tag())
+
+	// A tag given on creation survives downgrading and upgrading.
+	rl = newTaggedFileOfLength(t.fl, "taco", 1).Downgrade()
+	ExpectEq("taco", rl.Tag())
+
+	rl = upgrade(rl).Downgrade()
+	ExpectEq("taco", rl.Tag())
+
+	// Unless replaced when downgrading.
+	rl = upgrade(rl).DowngradeWithTag("burrito")
+	ExpectEq("burrito", rl.Tag())
+
+	rl = upgrade(rl).Downgrade()
+	ExpectEq("burrito", rl.Tag())
+}
+
+func (t *FileLeaserTest) RevokeMatchingReadLeases() {
+	var err error
+	buf := make([]byte, 1024)
+
+	AssertLe(4, limitNumFiles)
+	AssertLt(4+3, limitBytes)
+
+	// Set up read leases with various tags.
+	rlA1 := newTaggedFileOfLength(t.fl, "a/1", 1).Downgrade()
+	rlA2 := newTaggedFileOfLength(t.fl, "a/2", 2).Downgrade()
+	rlB1 := newTaggedFileOfLength(t.fl, "b/1", 3).Downgrade()
+	rlUntagged := newFileOfLength(t.fl, 4).Downgrade()
+
+	// Revoke those for "a". The predicate should see only tagged leases.
+	var seen []string
+	n := t.fl.RevokeReadLeasesMatching(func(tag string) bool {
+		seen = append(seen, tag)
+		return strings.HasPrefix(tag, "a/")
+	})
+
+	ExpectEq(2, n)
+	ExpectThat(seen, ElementsAre("b/1", "a/2", "a/1"))
+
+	AssertTrue(rlA1.Revoked())
+	AssertTrue(rlA2.Revoked())
+	AssertFalse(rlB1.Revoked())
+	AssertFalse(rlUntagged.Revoked())
+
+	_, err = rlA1.Read(buf)
+	ExpectThat(err, HasSameTypeAs(&lease.RevokedError{}))
+
+	_, err = rlB1.ReadAt(buf[:3], 0)
+	ExpectEq(nil, err)
+
+	// Matching nothing revokes nothing.
+	n = t.fl.RevokeReadLeasesMatching(func(tag string) bool { return false })
+	ExpectEq(0, n)
+	ExpectFalse(rlB1.Revoked())
+
+	// The bytes of the revoked leases should have been given back, so that a
+	// read/write lease can use them without booting the others.
+	rwl := newFileOfLength(t.fl, limitBytes-3-4)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	ExpectFalse(rlB1.Revoked())
+	ExpectFalse(rlUntagged.Revoked())
+
+	// But one more byte should evict the least recently used, as usual. That's
+	// the untagged lease, since we read from the other above.
+	growBy(rwl, 1)
+	ExpectFalse(rlB1.Revoked())
+	ExpectTrue(rlUntagged.Revoked())
+}
+
+func (t *FileLeaserTest) RevokingMatchingReadLeasesPreservesRecency() {
+	AssertLe(4, limitNumFiles)
+	AssertLt(4, limitBytes)
+
+	// Set up four read leases, from least to most recently used, two of them
+	// for the object we are going to invalidate.
+	rl0 := newTaggedFileOfLength(t.fl, "other", 1).Downgrade()
+	rl1 := newTaggedFileOfLength(t.fl, "foo", 1).Downgrade()
+	rl2 := newTaggedFileOfLength(t.fl, "unrelated", 1).Downgrade()
+	rl3 := newTaggedFileOfLength(t.fl, "foo", 1).Downgrade()
+
+	// Invalidate the object. Others' contents should survive, where revoking
+	// all read leases would have thrown them away.
+	n := t.fl.RevokeReadLeasesMatching(func(tag string) bool {
+		return tag == "foo"
+	})
+
+	AssertEq(2, n)
+	AssertFalse(rl0.Revoked())
+	AssertTrue(rl1.Revoked())
+	AssertFalse(rl2.Revoked())
+	AssertTrue(rl3.Revoked())
+
+	// Fill up the remaining space, then use one more byte at a time. The
+	// survivors should be evicted in their original order.
+	rwl := newFileOfLength(t.fl, limitBytes-2)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	AssertFalse(rl0.Revoked())
+	AssertFalse(rl2.Revoked())
+
+	growBy(rwl, 1)
+	ExpectTrue(rl0.Revoked())
+	ExpectFalse(rl2.Revoked())
+
+	growBy(rwl, 1)
+	ExpectTrue(rl2.Revoked())
+}
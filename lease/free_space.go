@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returned when creating or growing a read/write lease would take more of the
+// space free in the temporary directory's file system than the leaser is
+// allowed (see NewFileLeaserWithSpaceLimit), or when pinned read leases leave
+// no room for a new read/write lease within the leaser's limits.
+//
+// Callers that wrap errors should pass this one through unchanged, so that it
+// can be recognized by IsNoSpaceError further up.
+type NoSpaceError struct {
+	// The number of bytes that read/write leases (and any pinned read leases)
+	// would occupy, and the number they are allowed.
+	Needed  int64
+	Allowed int64
+
+	// When it is the number of files that is the problem, the number that
+	// would be needed and the number allowed. Zero otherwise.
+	NeededFiles  int
+	AllowedFiles int
+}
+
+func (e *NoSpaceError) Error() string {
+	if e.AllowedFiles != 0 {
+		return fmt.Sprintf(
+			"Not enough room in temporary directory: need %d files, allowed %d",
+			e.NeededFiles,
+			e.AllowedFiles)
+	}
+
+	return fmt.Sprintf(
+		"Not enough space in temporary directory: need %d bytes, allowed %d",
+		e.Needed,
+		e.Allowed)
+}
+
+// Is the supplied error a *NoSpaceError?
+func IsNoSpaceError(err error) bool {
+	_, ok := err.(*NoSpaceError)
+	return ok
+}
+
+// A function that returns the number of bytes available to unprivileged users
+// in the file system containing the supplied directory.
+type FreeSpaceFunc func(dir string) (free int64, err error)
+
+// A FreeSpaceFunc based on statfs(2). The empty string means the system's
+// default temporary directory.
+func StatFreeSpace(dir string) (free int64, err error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	var st unix.Statfs_t
+	err = unix.Statfs(dir, &st)
+	if err != nil {
+		err = fmt.Errorf("Statfs: %v", err)
+		return
+	}
+
+	free = int64(st.Bavail) * int64(st.Bsize)
+	return
+}
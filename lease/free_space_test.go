@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFreeSpace(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FreeSpaceTest struct {
+	// The size of the pretend file system holding the leaser's files, of which
+	// the leaser may use half. Space not used by the leaser is free.
+	capacity int64
+	calls    int
+
+	clock timeutil.SimulatedClock
+	fl    lease.FileLeaser
+}
+
+var _ SetUpInterface = &FreeSpaceTest{}
+
+func init() { RegisterTestSuite(&FreeSpaceTest{}) }
+
+func (t *FreeSpaceTest) SetUp(ti *TestInfo) {
+	t.capacity = 100
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.fl = lease.NewFileLeaserWithConfig(lease.FileLeaserConfig{
+		LimitNumFiles:   math.MaxInt32,
+		LimitBytes:      math.MaxInt64,
+		MaxFreeFraction: 0.5,
+		FreeSpace:       t.freeSpace,
+		Clock:           &t.clock,
+	})
+}
+
+func (t *FreeSpaceTest) freeSpace(dir string) (free int64, err error) {
+	t.calls++
+
+	_, used := t.fl.Usage()
+	free = t.capacity - used
+	return
+}
+
+func (t *FreeSpaceTest) size(rwl lease.ReadWriteLease) int64 {
+	size, err := rwl.Size()
+	AssertEq(nil, err)
+	return size
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FreeSpaceTest) WritesUpToLimit() {
+	rwl := newFileOfLength(t.fl, 50)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	// One more byte is too many, and nothing is written.
+	_, err := rwl.Write([]byte("a"))
+	ExpectThat(err, HasSameTypeAs(&lease.NoSpaceError{}))
+	ExpectEq(50, t.size(rwl))
+
+	_, err = rwl.WriteAt([]byte("a"), 50)
+	ExpectThat(err, HasSameTypeAs(&lease.NoSpaceError{}))
+	ExpectEq(50, t.size(rwl))
+
+	// Overwriting is fine.
+	_, err = rwl.WriteAt(bytes.Repeat([]byte("b"), 10), 40)
+	ExpectEq(nil, err)
+	ExpectEq(50, t.size(rwl))
+}
+
+func (t *FreeSpaceTest) Truncate() {
+	rwl := newFileOfLength(t.fl, 10)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	err := rwl.Truncate(51)
+	ExpectTrue(lease.IsNoSpaceError(err), "%v", err)
+	ExpectEq(10, t.size(rwl))
+
+	err = rwl.Truncate(50)
+	AssertEq(nil, err)
+
+	// Shrinking is always allowed.
+	t.capacity = 0
+	err = rwl.Truncate(5)
+	AssertEq(nil, err)
+	ExpectEq(5, t.size(rwl))
+}
+
+func (t *FreeSpaceTest) NewFileWhenFull() {
+	rwl := newFileOfLength(t.fl, 40)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	// Someone else fills up the file system, which we find out once the last
+	// answer is too old to trust.
+	t.capacity = 60
+
+	_, err := t.fl.NewFile()
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Second)
+	_, err = t.fl.NewFile()
+	AssertThat(err, HasSameTypeAs(&lease.NoSpaceError{}))
+	ExpectThat(err, Error(HasSubstr("need 40 bytes, allowed 30")))
+}
+
+func (t *FreeSpaceTest) LeasesShareLimit() {
+	rwl0 := newFileOfLength(t.fl, 30)
+	defer func() { rwl0.Downgrade().Revoke() }()
+
+	rwl1 := newFileOfLength(t.fl, 20)
+	defer func() { rwl1.Downgrade().Revoke() }()
+
+	_, err := rwl1.Write([]byte("a"))
+	ExpectTrue(lease.IsNoSpaceError(err), "%v", err)
+}
+
+func (t *FreeSpaceTest) ReadLeasesCountAsFree() {
+	rl := newFileOfLength(t.fl, 40).Downgrade()
+	defer rl.Revoke()
+
+	rwl := newFileOfLength(t.fl, 50)
+	defer func() { rwl.Downgrade().Revoke() }()
+}
+
+func (t *FreeSpaceTest) ReadLeasesRevokedToMakeRoom() {
+	rl := newFileOfLength(t.fl, 50).Downgrade()
+	defer rl.Revoke()
+
+	// Someone else takes up space, leaving only 20 bytes free. The read lease
+	// makes room for 30.
+	t.capacity = 70
+	t.clock.AdvanceTime(time.Second)
+
+	rwl := newFileOfLength(t.fl, 30)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	ExpectTrue(rl.Revoked())
+}
+
+func (t *FreeSpaceTest) FreeSpaceCached() {
+	rwl := newFileOfLength(t.fl, 10)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	_, err := rwl.Write([]byte("a"))
+	AssertEq(nil, err)
+	ExpectEq(1, t.calls)
+
+	// Growth since then is accounted for without asking again.
+	_, err = rwl.Write(bytes.Repeat([]byte("a"), 39))
+	AssertEq(nil, err)
+
+	_, err = rwl.Write([]byte("a"))
+	ExpectTrue(lease.IsNoSpaceError(err), "%v", err)
+	ExpectEq(1, t.calls)
+
+	// The answer expires.
+	t.clock.AdvanceTime(time.Second)
+	_, err = rwl.Write([]byte("a"))
+	ExpectTrue(lease.IsNoSpaceError(err), "%v", err)
+	ExpectEq(2, t.calls)
+}
+
+func (t *FreeSpaceTest) Disabled() {
+	t.fl = lease.NewFileLeaserWithSpaceLimit(
+		"",
+		math.MaxInt32,
+		math.MaxInt64,
+		0,
+		t.freeSpace)
+
+	t.capacity = 0
+	rwl := newFileOfLength(t.fl, 100)
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	ExpectEq(0, t.calls)
+}
+
+func (t *FreeSpaceTest) StatFreeSpace() {
+	free, err := lease.StatFreeSpace("")
+	AssertEq(nil, err)
+	ExpectGt(free, 0)
+
+	_, err = lease.StatFreeSpace("/no/such/dir")
+	ExpectThat(err, Error(HasSubstr("Statfs")))
+}
@@ -70,6 +70,35 @@ func (m *mockFileLeaser) NewFile() (o0 lease.ReadWriteLease, o1 error) {
 	return
 }
 
+func (m *mockFileLeaser) NewTaggedFile(p0 string) (o0 lease.ReadWriteLease, o1 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"NewTaggedFile",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockFileLeaser.NewTaggedFile: invalid return values: %v", retVals))
+	}
+
+	// o0 lease.ReadWriteLease
+	if retVals[0] != nil {
+		o0 = retVals[0].(lease.ReadWriteLease)
+	}
+
+	// o1 error
+	if retVals[1] != nil {
+		o1 = retVals[1].(error)
+	}
+
+	return
+}
+
 func (m *mockFileLeaser) RevokeReadLeases() {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -88,3 +117,99 @@ func (m *mockFileLeaser) RevokeReadLeases() {
 
 	return
 }
+
+func (m *mockFileLeaser) RevokeReadLeasesMatching(p0 func(string) bool) (o0 int) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"RevokeReadLeasesMatching",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockFileLeaser.RevokeReadLeasesMatching: invalid return values: %v", retVals))
+	}
+
+	// o0 int
+	if retVals[0] != nil {
+		o0 = retVals[0].(int)
+	}
+
+	return
+}
+
+func (m *mockFileLeaser) SetLimits(p0 int, p1 int64) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"SetLimits",
+		file,
+		line,
+		[]interface{}{p0, p1})
+
+	if len(retVals) != 0 {
+		panic(fmt.Sprintf("mockFileLeaser.SetLimits: invalid return values: %v", retVals))
+	}
+
+	return
+}
+
+func (m *mockFileLeaser) Stats() (o0 lease.LeaserStats) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Stats",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockFileLeaser.Stats: invalid return values: %v", retVals))
+	}
+
+	// o0 lease.LeaserStats
+	if retVals[0] != nil {
+		o0 = retVals[0].(lease.LeaserStats)
+	}
+
+	return
+}
+
+func (m *mockFileLeaser) Usage() (o0 int, o1 int64) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Usage",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockFileLeaser.Usage: invalid return values: %v", retVals))
+	}
+
+	// o0 int
+	if retVals[0] != nil {
+		o0 = retVals[0].(int)
+	}
+
+	// o1 int64
+	if retVals[1] != nil {
+		o1 = retVals[1].(int64)
+	}
+
+	return
+}
@@ -41,6 +41,30 @@ func (m *mockReadLease) Oglemock_Description() string {
 	return m.description
 }
 
+func (m *mockReadLease) Pin() (o0 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Pin",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockReadLease.Pin: invalid return values: %v", retVals))
+	}
+
+	// o0 error
+	if retVals[0] != nil {
+		o0 = retVals[0].(error)
+	}
+
+	return
+}
+
 func (m *mockReadLease) Read(p0 []uint8) (o0 int, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -195,6 +219,49 @@ func (m *mockReadLease) Size() (o0 int64) {
 	return
 }
 
+func (m *mockReadLease) Tag() (o0 string) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Tag",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockReadLease.Tag: invalid return values: %v", retVals))
+	}
+
+	// o0 string
+	if retVals[0] != nil {
+		o0 = retVals[0].(string)
+	}
+
+	return
+}
+
+func (m *mockReadLease) Unpin() {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Unpin",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 0 {
+		panic(fmt.Sprintf("mockReadLease.Unpin: invalid return values: %v", retVals))
+	}
+
+	return
+}
+
 func (m *mockReadLease) Upgrade() (o0 lease.ReadWriteLease, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
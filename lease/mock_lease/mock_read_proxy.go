@@ -80,6 +80,35 @@ func (m *mockReadProxy) Destroy() {
 	return
 }
 
+func (m *mockReadProxy) NewOverlay() (o0 lease.ReadWriteLease, o1 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"NewOverlay",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockReadProxy.NewOverlay: invalid return values: %v", retVals))
+	}
+
+	// o0 lease.ReadWriteLease
+	if retVals[0] != nil {
+		o0 = retVals[0].(lease.ReadWriteLease)
+	}
+
+	// o1 error
+	if retVals[1] != nil {
+		o1 = retVals[1].(error)
+	}
+
+	return
+}
+
 func (m *mockReadProxy) ReadAt(p0 context.Context, p1 []uint8, p2 int64) (o0 int, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -109,6 +138,73 @@ func (m *mockReadProxy) ReadAt(p0 context.Context, p1 []uint8, p2 int64) (o0 int
 	return
 }
 
+func (m *mockReadProxy) Residency() (o0 int64) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Residency",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockReadProxy.Residency: invalid return values: %v", retVals))
+	}
+
+	// o0 int64
+	if retVals[0] != nil {
+		o0 = retVals[0].(int64)
+	}
+
+	return
+}
+
+func (m *mockReadProxy) ResidentRanges() (o0 []lease.ByteRange) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"ResidentRanges",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockReadProxy.ResidentRanges: invalid return values: %v", retVals))
+	}
+
+	// o0 []lease.ByteRange
+	if retVals[0] != nil {
+		o0 = retVals[0].([]lease.ByteRange)
+	}
+
+	return
+}
+
+func (m *mockReadProxy) SetPinned(p0 bool) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"SetPinned",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 0 {
+		panic(fmt.Sprintf("mockReadProxy.SetPinned: invalid return values: %v", retVals))
+	}
+
+	return
+}
+
 func (m *mockReadProxy) Size() (o0 int64) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -133,6 +229,40 @@ func (m *mockReadProxy) Size() (o0 int64) {
 	return
 }
 
+func (m *mockReadProxy) TryReadAt(p0 []uint8, p1 int64) (o0 int, o1 *lease.Fault, o2 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"TryReadAt",
+		file,
+		line,
+		[]interface{}{p0, p1})
+
+	if len(retVals) != 3 {
+		panic(fmt.Sprintf("mockReadProxy.TryReadAt: invalid return values: %v", retVals))
+	}
+
+	// o0 int
+	if retVals[0] != nil {
+		o0 = retVals[0].(int)
+	}
+
+	// o1 *lease.Fault
+	if retVals[1] != nil {
+		o1 = retVals[1].(*lease.Fault)
+	}
+
+	// o2 error
+	if retVals[2] != nil {
+		o2 = retVals[2].(error)
+	}
+
+	return
+}
+
 func (m *mockReadProxy) Upgrade(p0 context.Context) (o0 lease.ReadWriteLease, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
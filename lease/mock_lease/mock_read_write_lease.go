@@ -41,6 +41,35 @@ func (m *mockReadWriteLease) Oglemock_Description() string {
 	return m.description
 }
 
+func (m *mockReadWriteLease) AllocatedBytes() (o0 int64, o1 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"AllocatedBytes",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockReadWriteLease.AllocatedBytes: invalid return values: %v", retVals))
+	}
+
+	// o0 int64
+	if retVals[0] != nil {
+		o0 = retVals[0].(int64)
+	}
+
+	// o1 error
+	if retVals[1] != nil {
+		o1 = retVals[1].(error)
+	}
+
+	return
+}
+
 func (m *mockReadWriteLease) Downgrade() (o0 lease.ReadLease) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -65,6 +94,59 @@ func (m *mockReadWriteLease) Downgrade() (o0 lease.ReadLease) {
 	return
 }
 
+func (m *mockReadWriteLease) DowngradeWithTag(p0 string) (o0 lease.ReadLease) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"DowngradeWithTag",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockReadWriteLease.DowngradeWithTag: invalid return values: %v", retVals))
+	}
+
+	// o0 lease.ReadLease
+	if retVals[0] != nil {
+		o0 = retVals[0].(lease.ReadLease)
+	}
+
+	return
+}
+
+func (m *mockReadWriteLease) Extents() (o0 []lease.ByteRange, o1 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Extents",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockReadWriteLease.Extents: invalid return values: %v", retVals))
+	}
+
+	// o0 []lease.ByteRange
+	if retVals[0] != nil {
+		o0 = retVals[0].([]lease.ByteRange)
+	}
+
+	// o1 error
+	if retVals[1] != nil {
+		o1 = retVals[1].(error)
+	}
+
+	return
+}
+
 func (m *mockReadWriteLease) Read(p0 []uint8) (o0 int, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
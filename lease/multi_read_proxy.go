@@ -19,11 +19,19 @@ import (
 	"io"
 	"sort"
 
+	"github.com/jacobsa/syncutil"
 	"golang.org/x/net/context"
 )
 
 // Create a read proxy consisting of the contents defined by the supplied
-// refreshers concatenated. See NewReadProxy for more.
+// refreshers concatenated. See NewReadProxy for more. A lease for the entire
+// contents carries the tag of the first refresher, if any.
+//
+// Once several reads in a row have each started where the last ended, the
+// contents of up to readahead refreshers following the one being read are
+// fetched in the background, using space obtained from the leaser like any
+// other contents. This is cancelled when a read breaks the pattern. Zero
+// disables readahead.
 //
 // If rl is non-nil, it will be used as the first temporary copy of the
 // contents, and must match the concatenation of the content returned by the
@@ -31,13 +39,14 @@ import (
 func NewMultiReadProxy(
 	fl FileLeaser,
 	refreshers []Refresher,
+	readahead int,
 	rl ReadLease) (rp ReadProxy) {
 	// Create one wrapped read proxy per refresher.
 	var wrappedProxies []readProxyAndOffset
 	var size int64
 
 	for _, r := range refreshers {
-		wrapped := NewReadProxy(fl, r, nil)
+		wrapped := newReadProxy(fl, r, nil)
 		wrappedProxies = append(wrappedProxies, readProxyAndOffset{size, wrapped})
 		size += wrapped.Size()
 	}
@@ -53,11 +62,19 @@ func NewMultiReadProxy(
 	}
 
 	// Create the multi-read proxy.
+	var tag string
+	if len(refreshers) != 0 {
+		tag = refresherTag(refreshers[0])
+	}
+
 	rp = &multiReadProxy{
-		size:   size,
-		leaser: fl,
-		rps:    wrappedProxies,
-		lease:  rl,
+		size:        size,
+		tag:         tag,
+		readahead:   readahead,
+		leaser:      fl,
+		rps:         wrappedProxies,
+		lease:       rl,
+		pinnedIndex: -1,
 	}
 
 	return
@@ -75,6 +92,13 @@ type multiReadProxy struct {
 	// The size of the proxied content.
 	size int64
 
+	// The tag for a lease for the entire contents.
+	tag string
+
+	// The number of wrapped proxies to prefetch once reads are sequential. See
+	// NewMultiReadProxy.
+	readahead int
+
 	/////////////////////////
 	// Dependencies
 	/////////////////////////
@@ -98,6 +122,32 @@ type multiReadProxy struct {
 	// INVARIANT: If lease != nil, size == lease.Size()
 	lease ReadLease
 
+	// The range [lastOff, nextOff) of the most recent read, and the number of
+	// reads in a row up to and including it that each started where the
+	// previous one ended.
+	lastOff         int64
+	nextOff         int64
+	sequentialReads int
+
+	// The indices within rps of the wrapped proxies asked to prefetch since
+	// reads last broke the pattern, less those that reads have since reached.
+	//
+	// INVARIANT: Strictly increasing
+	// INVARIANT: For each i, 0 <= i < len(rps)
+	prefetched []int
+
+	// The offset of the last byte of the most recent read.
+	lastByte int64
+
+	// See SetPinned. When pinned, either pin holds lease, or lease is nil and
+	// the wrapped proxy at index pinnedIndex is pinned. pinnedIndex is -1 when
+	// no wrapped proxy is pinned.
+	//
+	// INVARIANT: -1 <= pinnedIndex < len(rps)
+	pinned      bool
+	pin         leasePin
+	pinnedIndex int
+
 	destroyed bool
 }
 
@@ -106,6 +156,38 @@ func (mrp *multiReadProxy) Size() (size int64) {
 	return
 }
 
+func (mrp *multiReadProxy) Residency() (resident int64) {
+	// A lease for the entire contents trumps everything else.
+	if mrp.lease != nil && !mrp.lease.Revoked() {
+		resident = mrp.size
+		return
+	}
+
+	for _, entry := range mrp.rps {
+		resident += entry.rp.Residency()
+	}
+
+	return
+}
+
+func (mrp *multiReadProxy) ResidentRanges() (ranges []ByteRange) {
+	// A lease for the entire contents covers every refresher's range.
+	whole := mrp.lease != nil && !mrp.lease.Revoked()
+
+	for _, entry := range mrp.rps {
+		size := entry.rp.Size()
+		if size == 0 {
+			continue
+		}
+
+		if whole || entry.rp.Residency() != 0 {
+			ranges = append(ranges, ByteRange{entry.off, entry.off + size})
+		}
+	}
+
+	return
+}
+
 func (mrp *multiReadProxy) ReadAt(
 	ctx context.Context,
 	p []byte,
@@ -143,6 +225,9 @@ func (mrp *multiReadProxy) ReadAt(
 		return
 	}
 
+	mrp.noteRead(off, len(p))
+	mrp.movePin(off, len(p))
+
 	// The read proxy that contains off is the *last* read proxy whose start
 	// offset is less than or equal to off. Find the first that is greater and
 	// move back one.
@@ -182,9 +267,114 @@ func (mrp *multiReadProxy) ReadAt(
 	return
 }
 
+func (mrp *multiReadProxy) TryReadAt(
+	p []byte,
+	off int64) (n int, f *Fault, err error) {
+	// Special case: can we read directly from our initial read lease?
+	if mrp.lease != nil {
+		n, err = mrp.lease.ReadAt(p, off)
+
+		// Successful?
+		if err == nil {
+			return
+		}
+
+		// Revoked?
+		if _, ok := err.(*RevokedError); ok {
+			mrp.lease = nil
+			n = 0
+			err = nil
+		} else {
+			// Propagate other errors
+			return
+		}
+	}
+
+	// Special cases as in ReadAt.
+	if off < 0 {
+		err = fmt.Errorf("Invalid offset: %v", off)
+		return
+	}
+
+	if off >= mrp.Size() {
+		err = io.EOF
+		return
+	}
+
+	mrp.noteRead(off, len(p))
+	mrp.movePin(off, len(p))
+
+	// Walk the wrapped proxies covering the range, serving what is resident.
+	// Keep going after the first fault so that faults for all of the missing
+	// chunks are in flight at once, but return only the first.
+	for i := mrp.upperBound(off) - 1; i < len(mrp.rps) && len(p) > 0; i++ {
+		entry := mrp.rps[i]
+		wrappedOff := off - entry.off
+
+		buf := p
+		if remaining := entry.rp.Size() - wrappedOff; int64(len(buf)) > remaining {
+			buf = buf[:remaining]
+		}
+
+		var wrappedN int
+		var wrappedF *Fault
+		var wrappedErr error
+
+		wrappedN, wrappedF, wrappedErr = entry.rp.TryReadAt(buf, wrappedOff)
+		if wrappedErr == io.EOF && wrappedN == len(buf) {
+			wrappedErr = nil
+		}
+
+		switch {
+		case wrappedErr != nil:
+			err = wrappedErr
+			return
+
+		case wrappedF != nil:
+			if f == nil {
+				f = wrappedF
+			}
+
+		case wrappedN != len(buf):
+			err = fmt.Errorf(
+				"Wrapped proxy %d returned only %d bytes for a %d-byte read "+
+					"starting at wrapped offset %d",
+				i,
+				wrappedN,
+				len(buf),
+				wrappedOff)
+
+			return
+		}
+
+		n += wrappedN
+		p = p[len(buf):]
+		off += int64(len(buf))
+	}
+
+	// The data read doesn't count if we must wait for a fault.
+	if f != nil {
+		n = 0
+		return
+	}
+
+	if len(p) > 0 {
+		err = io.EOF
+	}
+
+	return
+}
+
+func (mrp *multiReadProxy) NewOverlay() (rwl ReadWriteLease, err error) {
+	rwl, err = mrp.leaser.NewFile()
+	return
+}
+
 func (mrp *multiReadProxy) Upgrade(
 	ctx context.Context) (rwl ReadWriteLease, err error) {
 	// This function is destructive; the user is not allowed to call us again.
+	// Nor is a read/write lease at risk of eviction.
+	mrp.SetPinned(false)
 	mrp.destroyed = true
 
 	// Special case: can we upgrade directly from our initial read lease?
@@ -208,9 +398,12 @@ func (mrp *multiReadProxy) Upgrade(
 
 	// Create a new read/write lease to return to the user. Ensure that it is
 	// destroyed if we return in error.
-	rwl, err = mrp.leaser.NewFile()
+	rwl, err = mrp.leaser.NewTaggedFile(mrp.tag)
 	if err != nil {
-		err = fmt.Errorf("NewFile: %v", err)
+		if !IsNoSpaceError(err) {
+			err = fmt.Errorf("NewTaggedFile: %v", err)
+		}
+
 		return
 	}
 
@@ -220,19 +413,56 @@ func (mrp *multiReadProxy) Upgrade(
 		}
 	}()
 
-	// Accumulate each wrapped read proxy in turn.
-	for i, entry := range mrp.rps {
-		err = mrp.upgradeOne(ctx, rwl, entry.rp)
-		if err != nil {
-			err = fmt.Errorf("upgradeOne(%d): %v", i, err)
-			return
+	// Fetch the wrapped read proxies concurrently, each writing to its own
+	// offset within the new lease. The first failure cancels the rest.
+	b := syncutil.NewBundle(ctx)
+
+	indices := make(chan int)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(indices)
+		for i := range mrp.rps {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+
+			case indices <- i:
+			}
 		}
+
+		return
+	})
+
+	for i := 0; i < parallelUpgrades; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for i := range indices {
+				entry := mrp.rps[i]
+				err = mrp.upgradeOne(ctx, rwl, entry.off, entry.rp)
+				if err != nil {
+					if !IsNoSpaceError(err) {
+						err = fmt.Errorf("upgradeOne(%d): %v", i, err)
+					}
+
+					return
+				}
+			}
+
+			return
+		})
 	}
 
+	err = b.Join()
 	return
 }
 
+func (mrp *multiReadProxy) SetPinned(pinned bool) {
+	mrp.pinned = pinned
+	mrp.updatePins()
+}
+
 func (mrp *multiReadProxy) Destroy() {
+	mrp.SetPinned(false)
+
 	// Destroy all of the wrapped proxies.
 	for _, entry := range mrp.rps {
 		entry.rp.Destroy()
@@ -246,6 +476,7 @@ func (mrp *multiReadProxy) Destroy() {
 	// Crash early if called again.
 	mrp.rps = nil
 	mrp.lease = nil
+	mrp.prefetched = nil
 	mrp.destroyed = true
 }
 
@@ -287,6 +518,23 @@ func (mrp *multiReadProxy) CheckInvariants() {
 	if mrp.lease != nil && mrp.size != mrp.lease.Size() {
 		panic(fmt.Sprintf("Size mismatch: %v vs. %v", mrp.size, mrp.lease.Size()))
 	}
+
+	// INVARIANT: -1 <= pinnedIndex < len(rps)
+	if mrp.pinnedIndex < -1 || mrp.pinnedIndex >= len(mrp.rps) {
+		panic(fmt.Sprintf("Pinned index out of range: %v", mrp.pinnedIndex))
+	}
+
+	// INVARIANT: Strictly increasing
+	// INVARIANT: For each i, 0 <= i < len(rps)
+	for j, i := range mrp.prefetched {
+		if i < 0 || i >= len(mrp.rps) {
+			panic(fmt.Sprintf("Prefetched index out of range: %v", i))
+		}
+
+		if j > 0 && i <= mrp.prefetched[j-1] {
+			panic(fmt.Sprintf("Prefetched indices out of order: %v", mrp.prefetched))
+		}
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -295,7 +543,139 @@ func (mrp *multiReadProxy) CheckInvariants() {
 
 type readProxyAndOffset struct {
 	off int64
-	rp  ReadProxy
+	rp  *readProxy
+}
+
+// The number of reads in a row that must each start where the previous one
+// ended before readahead begins.
+const sequentialReadsForReadahead = 3
+
+// The maximum number of wrapped proxies fetched at once by Upgrade.
+const parallelUpgrades = 8
+
+// Update our picture of the access pattern with a read of size bytes at off,
+// starting or cancelling readahead to suit. Guarantees to not block.
+//
+// REQUIRES: 0 <= off < mrp.size
+func (mrp *multiReadProxy) noteRead(off int64, size int) {
+	if mrp.readahead == 0 || size == 0 {
+		return
+	}
+
+	limit := off + int64(size)
+	if limit > mrp.size {
+		limit = mrp.size
+	}
+
+	// Retrying the previous read, for example after waiting for a fault, tells
+	// us nothing new.
+	if off == mrp.lastOff && limit == mrp.nextOff {
+		return
+	}
+
+	first := mrp.upperBound(off) - 1
+	last := mrp.upperBound(limit-1) - 1
+
+	if off == mrp.nextOff {
+		mrp.sequentialReads++
+	} else {
+		mrp.sequentialReads = 1
+		mrp.cancelReadahead(first, last)
+	}
+
+	mrp.lastOff = off
+	mrp.nextOff = limit
+
+	// Forget the wrapped proxies that this read reaches; it will collect their
+	// faults itself. Settle the rest, so that what they hold may be evicted.
+	for len(mrp.prefetched) > 0 && mrp.prefetched[0] <= last {
+		mrp.prefetched = mrp.prefetched[1:]
+	}
+
+	for _, i := range mrp.prefetched {
+		mrp.rps[i].rp.settlePrefetch()
+	}
+
+	if mrp.sequentialReads < sequentialReadsForReadahead {
+		return
+	}
+
+	// Prefetch the wrapped proxies following the one holding the end of the
+	// read that haven't been already.
+	next := last + 1
+	if n := len(mrp.prefetched); n > 0 && mrp.prefetched[n-1] >= next {
+		next = mrp.prefetched[n-1] + 1
+	}
+
+	for i := next; i <= last+mrp.readahead && i < len(mrp.rps); i++ {
+		mrp.rps[i].rp.prefetch()
+		mrp.prefetched = append(mrp.prefetched, i)
+	}
+}
+
+// Note a read of size bytes at off, moving the pin onto the wrapped proxy
+// holding the end of the read if we are pinned.
+//
+// REQUIRES: 0 <= off < mrp.size
+func (mrp *multiReadProxy) movePin(off int64, size int) {
+	mrp.lastByte = off
+	if size > 0 {
+		mrp.lastByte = off + int64(size) - 1
+	}
+
+	if mrp.lastByte >= mrp.size {
+		mrp.lastByte = mrp.size - 1
+	}
+
+	mrp.updatePins()
+}
+
+// Pin or unpin to match mrp.pinned: the lease for the entire contents if we
+// have one, and otherwise the wrapped proxy holding mrp.lastByte.
+func (mrp *multiReadProxy) updatePins() {
+	switch {
+	case !mrp.pinned || len(mrp.rps) == 0:
+		mrp.pin.set(nil)
+		mrp.pinWrapped(-1)
+
+	case mrp.lease != nil:
+		mrp.pin.set(mrp.lease)
+		mrp.pinWrapped(-1)
+
+	default:
+		mrp.pin.set(nil)
+		mrp.pinWrapped(mrp.upperBound(mrp.lastByte) - 1)
+	}
+}
+
+// Pin the wrapped proxy at the given index in place of whichever is pinned
+// now. -1 means none.
+func (mrp *multiReadProxy) pinWrapped(i int) {
+	if i == mrp.pinnedIndex {
+		return
+	}
+
+	if mrp.pinnedIndex >= 0 {
+		mrp.rps[mrp.pinnedIndex].rp.SetPinned(false)
+	}
+
+	if i >= 0 {
+		mrp.rps[i].rp.SetPinned(true)
+	}
+
+	mrp.pinnedIndex = i
+}
+
+// Cancel the prefetching of all wrapped proxies except those with indices in
+// [first, last], which a read is about to want.
+func (mrp *multiReadProxy) cancelReadahead(first int, last int) {
+	for _, i := range mrp.prefetched {
+		if i < first || i > last {
+			mrp.rps[i].rp.cancelPrefetch()
+		}
+	}
+
+	mrp.prefetched = nil
 }
 
 // Return the index within mrp.rps of the first read proxy whose logical offset
@@ -405,15 +785,20 @@ func (mrp *multiReadProxy) readFromOne(
 }
 
 // Upgrade the read proxy and copy its contents into the supplied read/write
-// lease, then destroy it.
+// lease at the given offset, then destroy it. Safe to call concurrently for
+// distinct read proxies.
 func (mrp *multiReadProxy) upgradeOne(
 	ctx context.Context,
 	dst ReadWriteLease,
+	off int64,
 	rp ReadProxy) (err error) {
 	// Upgrade.
 	src, err := rp.Upgrade(ctx)
 	if err != nil {
-		err = fmt.Errorf("Upgrade: %v", err)
+		if !IsNoSpaceError(err) {
+			err = fmt.Errorf("Upgrade: %v", err)
+		}
+
 		return
 	}
 
@@ -428,11 +813,27 @@ func (mrp *multiReadProxy) upgradeOne(
 		return
 	}
 
-	_, err = io.Copy(dst, src)
+	_, err = io.Copy(&offsetWriter{dst, off}, src)
 	if err != nil {
-		err = fmt.Errorf("Copy: %v", err)
+		if !IsNoSpaceError(err) {
+			err = fmt.Errorf("Copy: %v", err)
+		}
+
 		return
 	}
 
 	return
 }
+
+// An io.Writer that writes sequentially to an io.WriterAt, starting at a
+// given offset.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (n int, err error) {
+	n, err = ow.w.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return
+}
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"math"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -50,6 +51,22 @@ func (crp *checkingReadProxy) Size() (size int64) {
 	return
 }
 
+func (crp *checkingReadProxy) Residency() (resident int64) {
+	crp.Wrapped.CheckInvariants()
+	defer crp.Wrapped.CheckInvariants()
+
+	resident = crp.Wrapped.Residency()
+	return
+}
+
+func (crp *checkingReadProxy) ResidentRanges() (ranges []lease.ByteRange) {
+	crp.Wrapped.CheckInvariants()
+	defer crp.Wrapped.CheckInvariants()
+
+	ranges = crp.Wrapped.ResidentRanges()
+	return
+}
+
 func (crp *checkingReadProxy) ReadAt(
 	ctx context.Context,
 	p []byte,
@@ -61,6 +78,16 @@ func (crp *checkingReadProxy) ReadAt(
 	return
 }
 
+func (crp *checkingReadProxy) TryReadAt(
+	p []byte,
+	off int64) (n int, f *lease.Fault, err error) {
+	crp.Wrapped.CheckInvariants()
+	defer crp.Wrapped.CheckInvariants()
+
+	n, f, err = crp.Wrapped.TryReadAt(p, off)
+	return
+}
+
 func (crp *checkingReadProxy) Upgrade(
 	ctx context.Context) (rwl lease.ReadWriteLease, err error) {
 	crp.Wrapped.CheckInvariants()
@@ -68,11 +95,27 @@ func (crp *checkingReadProxy) Upgrade(
 	return
 }
 
+func (crp *checkingReadProxy) NewOverlay() (
+	rwl lease.ReadWriteLease, err error) {
+	crp.Wrapped.CheckInvariants()
+	defer crp.Wrapped.CheckInvariants()
+
+	rwl, err = crp.Wrapped.NewOverlay()
+	return
+}
+
 func (crp *checkingReadProxy) Destroy() {
 	crp.Wrapped.CheckInvariants()
 	crp.Wrapped.Destroy()
 }
 
+func (crp *checkingReadProxy) SetPinned(pinned bool) {
+	crp.Wrapped.CheckInvariants()
+	defer crp.Wrapped.CheckInvariants()
+
+	crp.Wrapped.SetPinned(pinned)
+}
+
 func (crp *checkingReadProxy) CheckInvariants() {
 	crp.Wrapped.CheckInvariants()
 }
@@ -157,6 +200,7 @@ func (t *MultiReadProxyTest) resetProxy() {
 		Wrapped: lease.NewMultiReadProxy(
 			t.leaser,
 			t.makeRefreshers(),
+			0, // Readahead
 			t.initialLease),
 	}
 }
@@ -436,6 +480,81 @@ func (t *MultiReadProxyTest) Upgrade_AllSuccessful() {
 	ExpectEq("tacoburritoenchilada", string(contents))
 }
 
+func (t *MultiReadProxyTest) Upgrade_ManyRefreshers() {
+	// Set up more refreshers than are fetched at once, of varying sizes.
+	t.refresherContents = nil
+	for i := 0; i < 50; i++ {
+		b := make([]byte, 17*i+1)
+		for j := range b {
+			b[j] = byte(i + j)
+		}
+
+		t.refresherContents = append(t.refresherContents, string(b))
+	}
+
+	t.refresherErrors = make([]error, len(t.refresherContents))
+	t.resetProxy()
+
+	// Upgrade
+	rwl, err := t.proxy.Upgrade(context.Background())
+	t.proxy = nil
+	AssertEq(nil, err)
+
+	defer func() { rwl.Downgrade().Revoke() }()
+
+	// Check the contents of the read/write lease.
+	size, err := rwl.Size()
+	AssertEq(nil, err)
+	ExpectEq(len(strings.Join(t.refresherContents, "")), size)
+
+	_, err = rwl.Seek(0, 0)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadAll(rwl)
+	AssertEq(nil, err)
+	ExpectTrue(strings.Join(t.refresherContents, "") == string(contents))
+}
+
+func (t *MultiReadProxyTest) Upgrade_ErrorCancelsOtherRefreshers() {
+	// Set up refreshers that block until cancelled, except for one that fails
+	// straight away.
+	var cancelled uint64
+	var refreshers []lease.Refresher
+	for i := 0; i < 20; i++ {
+		r := &funcRefresher{
+			N: 1,
+			F: func(ctx context.Context) (rc io.ReadCloser, err error) {
+				<-ctx.Done()
+				atomic.AddUint64(&cancelled, 1)
+				err = ctx.Err()
+				return
+			},
+		}
+
+		refreshers = append(refreshers, r)
+	}
+
+	refreshers[5] = &funcRefresher{
+		N: 1,
+		F: func(ctx context.Context) (rc io.ReadCloser, err error) {
+			err = errors.New("foobar")
+			return
+		},
+	}
+
+	t.proxy = &checkingReadProxy{
+		Wrapped: lease.NewMultiReadProxy(t.leaser, refreshers, 0, nil),
+	}
+
+	// Upgrade. The refreshers started before the failing one must have been
+	// cancelled for this to return at all.
+	_, err := t.proxy.Upgrade(context.Background())
+	t.proxy = nil
+
+	ExpectThat(err, Error(HasSubstr("foobar")))
+	ExpectGe(atomic.LoadUint64(&cancelled), 5)
+}
+
 func (t *MultiReadProxyTest) Upgrade_ContentAlreadyCached() {
 	AssertThat(
 		t.refresherContents,
@@ -563,3 +682,149 @@ func (t *MultiReadProxyTest) InitialReadLeaseRevoked() {
 
 	ExpectThat(err, Error(HasSubstr("foobar")))
 }
+
+func (t *MultiReadProxyTest) Residency() {
+	AssertThat(
+		t.refresherContents,
+		ElementsAre(
+			"taco",
+			"burrito",
+			"enchilada",
+		))
+
+	buf := make([]byte, 1024)
+
+	// Initially nothing is resident.
+	ExpectEq(0, t.proxy.Residency())
+
+	// Reading from the second refresher's range should fault in only that.
+	_, err := t.proxy.ReadAt(context.Background(), buf[:2], 5)
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), t.proxy.Residency())
+
+	// Now the first.
+	_, err = t.proxy.ReadAt(context.Background(), buf[:1], 0)
+	AssertEq(nil, err)
+	ExpectEq(len("taco")+len("burrito"), t.proxy.Residency())
+
+	// Revoking the leases should make it all go away. Asking shouldn't fault
+	// anything back in.
+	t.leaser.RevokeReadLeases()
+	ExpectEq(0, t.proxy.Residency())
+	ExpectEq(0, t.proxy.Residency())
+}
+
+func (t *MultiReadProxyTest) Residency_InitialReadLease() {
+	// Set up an initial read lease.
+	rwl, err := t.leaser.NewFile()
+	AssertEq(nil, err)
+
+	_, err = rwl.Write([]byte("tacoburritoenchilada"))
+	AssertEq(nil, err)
+
+	t.initialLease = rwl.Downgrade()
+	t.resetProxy()
+
+	// Everything is resident until the lease is revoked.
+	ExpectEq(len("tacoburritoenchilada"), t.proxy.Residency())
+
+	t.leaser.RevokeReadLeases()
+	ExpectEq(0, t.proxy.Residency())
+}
+
+func (t *MultiReadProxyTest) ResidentRanges() {
+	AssertThat(
+		t.refresherContents,
+		ElementsAre(
+			"taco",
+			"burrito",
+			"enchilada",
+		))
+
+	buf := make([]byte, 1024)
+
+	// Initially nothing is resident.
+	ExpectEq(0, len(t.proxy.ResidentRanges()))
+
+	// Fault in the first and last refreshers' ranges, which should be reported
+	// separately.
+	_, err := t.proxy.ReadAt(context.Background(), buf[:1], 0)
+	AssertEq(nil, err)
+
+	_, err = t.proxy.ReadAt(context.Background(), buf[:1], 12)
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.proxy.ResidentRanges(),
+		DeepEquals([]lease.ByteRange{{0, 4}, {11, 20}}))
+
+	// Revoking the leases should make them go away.
+	t.leaser.RevokeReadLeases()
+	ExpectEq(0, len(t.proxy.ResidentRanges()))
+}
+
+func (t *MultiReadProxyTest) ResidentRanges_InitialReadLease() {
+	// Set up an initial read lease.
+	rwl, err := t.leaser.NewFile()
+	AssertEq(nil, err)
+
+	_, err = rwl.Write([]byte("tacoburritoenchilada"))
+	AssertEq(nil, err)
+
+	t.initialLease = rwl.Downgrade()
+	t.resetProxy()
+
+	// Every refresher's range is resident.
+	ExpectThat(
+		t.proxy.ResidentRanges(),
+		DeepEquals([]lease.ByteRange{{0, 4}, {4, 11}, {11, 20}}))
+}
+
+func (t *MultiReadProxyTest) LeasesTaggedByRefreshers() {
+	AssertThat(
+		t.refresherContents,
+		ElementsAre(
+			"taco",
+			"burrito",
+			"enchilada",
+		))
+
+	// Tag the first two refreshers, but not the third.
+	var refreshers []lease.Refresher
+	for i, r := range t.makeRefreshers() {
+		fr := r.(*funcRefresher)
+		if i < 2 {
+			refreshers = append(refreshers, &taggedRefresher{*fr, "foo"})
+		} else {
+			refreshers = append(refreshers, fr)
+		}
+	}
+
+	t.proxy = &checkingReadProxy{
+		Wrapped: lease.NewMultiReadProxy(t.leaser, refreshers, 0, nil),
+	}
+
+	// Fault everything in.
+	buf := make([]byte, 1024)
+	_, err := t.proxy.ReadAt(context.Background(), buf[:t.proxy.Size()], 0)
+	AssertEq(nil, err)
+	AssertEq(t.proxy.Size(), t.proxy.Residency())
+
+	// Revoking the tagged leases should leave the untagged one.
+	n := t.leaser.RevokeReadLeasesMatching(func(tag string) bool {
+		return tag == "foo"
+	})
+
+	ExpectEq(2, n)
+	ExpectEq(len("enchilada"), t.proxy.Residency())
+
+	// A lease for the entire contents carries the first refresher's tag.
+	rwl, err := t.proxy.Upgrade(context.Background())
+	t.proxy = nil
+	AssertEq(nil, err)
+
+	rl := rwl.Downgrade()
+	defer rl.Revoke()
+
+	ExpectEq("foo", rl.Tag())
+}
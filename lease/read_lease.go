@@ -18,6 +18,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 )
 
 // A sentinel error used when a lease has been revoked.
@@ -43,9 +44,14 @@ type ReadLease interface {
 
 	// Has the lease been revoked? Note that this is completely racy in the
 	// absence of external synchronization on all leases and the file leaser, so
-	// is suitable only for testing purposes.
+	// is suitable only for testing purposes and for advisory reporting.
 	Revoked() (revoked bool)
 
+	// Return the tag given to the lease when its file was created or
+	// downgraded, or the empty string if none. See
+	// FileLeaser.RevokeReadLeasesMatching.
+	Tag() (tag string)
+
 	// Attempt to upgrade the lease to a read/write lease. After successfully
 	// upgrading, it is as if the lease has been revoked.
 	Upgrade() (rwl ReadWriteLease, err error)
@@ -53,6 +59,16 @@ type ReadLease interface {
 	// Cause the lease to be revoked and any associated resources to be cleaned
 	// up, if it has not already been revoked.
 	Revoke()
+
+	// Stop the leaser from revoking the lease to stay within its limits until a
+	// matching call to Unpin. Calls nest. Pinning doesn't prevent revoking the
+	// lease on request or upgrading it. Return a *RevokedError if the lease has
+	// already been revoked, in which case there is nothing to unpin.
+	Pin() (err error)
+
+	// Undo a successful call to Pin. This is legal even if the lease has since
+	// been revoked or upgraded.
+	Unpin()
 }
 
 type readLease struct {
@@ -63,7 +79,9 @@ type readLease struct {
 	// Constant data
 	/////////////////////////
 
-	size int64
+	size    int64
+	tag     string
+	created time.Time
 
 	/////////////////////////
 	// Dependencies
@@ -76,6 +94,15 @@ type readLease struct {
 	//
 	// GUARDED_BY(Mu)
 	file *os.File
+
+	// The number of calls to Pin not yet matched by Unpin. While positive and
+	// the lease is unrevoked, it is in the leaser's pinned set rather than its
+	// LRU list.
+	//
+	// INVARIANT: pins >= 0
+	//
+	// GUARDED_BY(leaser.mu)
+	pins int
 }
 
 var _ ReadLease = &readLease{}
@@ -83,11 +110,15 @@ var _ ReadLease = &readLease{}
 func newReadLease(
 	size int64,
 	leaser *fileLeaser,
-	file *os.File) (rl *readLease) {
+	file *os.File,
+	tag string,
+	created time.Time) (rl *readLease) {
 	rl = &readLease{
-		size:   size,
-		leaser: leaser,
-		file:   file,
+		size:    size,
+		tag:     tag,
+		created: created,
+		leaser:  leaser,
+		file:    file,
 	}
 
 	return
@@ -154,6 +185,12 @@ func (rl *readLease) Size() (size int64) {
 	return
 }
 
+// No lock necessary.
+func (rl *readLease) Tag() (tag string) {
+	tag = rl.tag
+	return
+}
+
 // LOCKS_EXCLUDED(rl.Mu)
 func (rl *readLease) Revoked() (revoked bool) {
 	rl.Mu.Lock()
@@ -178,6 +215,17 @@ func (rl *readLease) Revoke() {
 	rl.leaser.revokeVoluntarily(rl)
 }
 
+// LOCKS_EXCLUDED(rl.leaser.mu)
+func (rl *readLease) Pin() (err error) {
+	err = rl.leaser.pin(rl)
+	return
+}
+
+// LOCKS_EXCLUDED(rl.leaser.mu)
+func (rl *readLease) Unpin() {
+	rl.leaser.unpin(rl)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
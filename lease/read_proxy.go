@@ -17,6 +17,7 @@ package lease
 import (
 	"fmt"
 	"io"
+	"log"
 
 	"golang.org/x/net/context"
 )
@@ -29,9 +30,56 @@ type Refresher interface {
 
 	// Return a read-closer for the contents. The same contents will always be
 	// returned, and they will always be of length Size().
+	//
+	// If the read-closer finds that what it returned was damaged on the way,
+	// it should fail with an error satisfying IsCorruptionError. Read proxies
+	// then refresh once more before giving up.
 	Refresh(ctx context.Context) (rc io.ReadCloser, err error)
 }
 
+// An error returned by a refresher's read-closer to say that the contents it
+// returned were damaged, and so are worth fetching again.
+type CorruptionError interface {
+	error
+
+	// Always returns true.
+	Corrupt() bool
+}
+
+// Return true if the supplied error is a CorruptionError.
+func IsCorruptionError(err error) bool {
+	ce, ok := err.(CorruptionError)
+	return ok && ce.Corrupt()
+}
+
+// A Refresher that can name its contents, e.g. by the object generation they
+// come from. Read proxies tag the leases holding the contents with the name,
+// so that they may be revoked with FileLeaser.RevokeReadLeasesMatching
+// without disturbing others.
+type TaggedRefresher interface {
+	Refresher
+
+	// Return the tag for leases holding the contents. The same tag will always
+	// be returned.
+	Tag() (tag string)
+}
+
+// Return the tag for leases holding the contents returned by r, or the empty
+// string if it doesn't implement TaggedRefresher.
+func refresherTag(r Refresher) (tag string) {
+	if tr, ok := r.(TaggedRefresher); ok {
+		tag = tr.Tag()
+	}
+
+	return
+}
+
+// A range of offsets [Start, Limit) within some content.
+type ByteRange struct {
+	Start int64
+	Limit int64
+}
+
 // A wrapper around a read lease, exposing a similar interface with the
 // following differences:
 //
@@ -48,18 +96,54 @@ type ReadProxy interface {
 	// Return the size of the proxied content. Guarantees to not block.
 	Size() (size int64)
 
+	// Return the number of bytes of the proxied content that are currently held
+	// in unrevoked read leases, and so could be read without fetching them
+	// again. This is a snapshot that may be stale as soon as it is returned.
+	// Guarantees to not block on I/O, and to not fetch anything.
+	Residency() (resident int64)
+
+	// Return the ranges of the proxied content that make up Residency, in
+	// increasing order. Adjacent ranges aren't merged, so for a proxy created by
+	// NewMultiReadProxy each is the range of one refresher. The same guarantees
+	// apply as for Residency.
+	ResidentRanges() (ranges []ByteRange)
+
 	// Semantics matching io.ReaderAt, except with context support and without
 	// the guarantee of being thread-safe.
 	ReadAt(ctx context.Context, p []byte, off int64) (n int, err error)
 
+	// Like ReadAt, but guarantees to not block on fetching contents. If the read
+	// can't be served from contents held locally, return a non-nil fault
+	// fetching them in the background (joining one already in flight if any),
+	// with n == 0 and err == nil. The caller may then wait for the fault without
+	// holding the lock that synchronizes the proxy, and try again.
+	//
+	// Fetched contents may be evicted before the caller tries again, in which
+	// case the read faults again. Callers must bound their attempts and fall
+	// back to ReadAt, which reads what it fetches before it can be evicted.
+	TryReadAt(p []byte, off int64) (n int, f *Fault, err error)
+
 	// Return a read/write lease for the proxied contents, destroying the read
 	// proxy. The read proxy must not be used after calling this method.
 	Upgrade(ctx context.Context) (rwl ReadWriteLease, err error)
 
+	// Return a new, empty read/write lease from the leaser that holds the
+	// proxied contents, without fetching them or otherwise affecting the
+	// proxy. This lets the user accumulate modifications to the contents while
+	// leaving them in GCS.
+	NewOverlay() (rwl ReadWriteLease, err error)
+
 	// Destroy any resources in use by the read proxy. It must not be used
 	// further.
 	Destroy()
 
+	// While pinned, keep the read lease holding the most recently read
+	// contents pinned (see ReadLease.Pin), so that the leaser doesn't evict
+	// what is likely to be read again soon. For a proxy created by
+	// NewMultiReadProxy that is the contents of one refresher, so that reading
+	// a large file doesn't pin all of it. Proxies start out unpinned.
+	SetPinned(pinned bool)
+
 	// Panic if any internal invariants are violated.
 	CheckInvariants()
 }
@@ -67,7 +151,8 @@ type ReadProxy interface {
 // Create a read proxy.
 //
 // The supplied refresher will be used to obtain the proxy's contents whenever
-// the file leaser decides to expire the temporary copy thus obtained.
+// the file leaser decides to expire the temporary copy thus obtained. If it is
+// a TaggedRefresher, the leases holding the contents carry its tag.
 //
 // If rl is non-nil, it will be used as the first temporary copy of the
 // contents, and must match what the refresher returns.
@@ -75,6 +160,14 @@ func NewReadProxy(
 	fl FileLeaser,
 	r Refresher,
 	rl ReadLease) (rp ReadProxy) {
+	rp = newReadProxy(fl, r, rl)
+	return
+}
+
+func newReadProxy(
+	fl FileLeaser,
+	r Refresher,
+	rl ReadLease) (rp *readProxy) {
 	rp = &readProxy{
 		size:      r.Size(),
 		leaser:    fl,
@@ -115,6 +208,18 @@ type readProxy struct {
 
 	// The current wrapped lease, or nil if one has never been issued.
 	lease ReadLease
+
+	// A fault started by TryReadAt or prefetch whose result has not yet been
+	// collected, or nil if none.
+	fault *Fault
+
+	// Set when fault was started by prefetch and no read has wanted its result
+	// since, so that it may be cancelled without failing anybody.
+	speculative bool
+
+	// See SetPinned. When pinned, pin holds lease if it could be pinned.
+	pinned bool
+	pin    leasePin
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -131,10 +236,46 @@ func isRevokedErr(err error) bool {
 // REQUIRES: The caller has observed that rp.lease has expired.
 func (rp *readProxy) getContents(
 	ctx context.Context) (rwl ReadWriteLease, err error) {
+	rwl, err = fetchContents(ctx, rp.leaser, rp.refresher, rp.size)
+	return
+}
+
+// Set up a read/write lease and fill it with the contents returned by the
+// refresher, which must be of the given size. If the contents turn out to be
+// corrupt, fetch them once more. Does not touch any read proxy, so may be
+// called without holding a proxy's lock.
+func fetchContents(
+	ctx context.Context,
+	fl FileLeaser,
+	r Refresher,
+	size int64) (rwl ReadWriteLease, err error) {
+	rwl, err = fetchContentsOnce(ctx, fl, r, size)
+	if IsCorruptionError(err) {
+		log.Printf("Fetching again after %v", err)
+		rwl, err = fetchContentsOnce(ctx, fl, r, size)
+	}
+
+	if IsCorruptionError(err) {
+		err = fmt.Errorf("Copy: %v", err)
+	}
+
+	return
+}
+
+// A single attempt for fetchContents. Corruption errors are returned
+// unwrapped.
+func fetchContentsOnce(
+	ctx context.Context,
+	fl FileLeaser,
+	r Refresher,
+	size int64) (rwl ReadWriteLease, err error) {
 	// Obtain some space to write the contents.
-	rwl, err = rp.leaser.NewFile()
+	rwl, err = fl.NewTaggedFile(refresherTag(r))
 	if err != nil {
-		err = fmt.Errorf("NewFile: %v", err)
+		if !IsNoSpaceError(err) {
+			err = fmt.Errorf("NewTaggedFile: %v", err)
+		}
+
 		return
 	}
 
@@ -142,11 +283,12 @@ func (rp *readProxy) getContents(
 	defer func() {
 		if err != nil {
 			rwl.Downgrade().Revoke()
+			rwl = nil
 		}
 	}()
 
 	// Obtain the reader for our contents.
-	rc, err := rp.refresher.Refresh(ctx)
+	rc, err := r.Refresh(ctx)
 	if err != nil {
 		err = fmt.Errorf("User function: %v", err)
 		return
@@ -162,16 +304,67 @@ func (rp *readProxy) getContents(
 	// Copy into the read/write lease.
 	copied, err := io.Copy(rwl, rc)
 	if err != nil {
-		err = fmt.Errorf("Copy: %v", err)
+		if !IsNoSpaceError(err) && !IsCorruptionError(err) {
+			err = fmt.Errorf("Copy: %v", err)
+		}
+
 		return
 	}
 
 	// Did the user lie about the size?
-	if copied != rp.Size() {
-		err = fmt.Errorf("Copied %v bytes; expected %v", copied, rp.Size())
+	if copied != size {
+		err = fmt.Errorf("Copied %v bytes; expected %v", copied, size)
+		return
+	}
+
+	return
+}
+
+// Start a fault fetching our contents in the background, unless one is
+// already in flight. See startFault for the meaning of downgrade.
+func (rp *readProxy) startFault(downgrade bool) {
+	if rp.fault != nil {
+		return
+	}
+
+	fl, r, size := rp.leaser, rp.refresher, rp.size
+	fetch := func(ctx context.Context) (ReadWriteLease, error) {
+		return fetchContents(ctx, fl, r, size)
+	}
+
+	rp.fault = startFault(fetch, downgrade)
+}
+
+// Wait for the in-flight fault, if any, and collect its result. If it
+// succeeded, its contents become our lease.
+func (rp *readProxy) collectFault(ctx context.Context) (err error) {
+	if rp.fault == nil {
+		return
+	}
+
+	err = rp.fault.Wait(ctx)
+	if err != nil {
+		return
+	}
+
+	rwl, rl, err := rp.fault.result()
+	rp.fault = nil
+	rp.speculative = false
+
+	if err != nil {
+		err = fmt.Errorf("getContents: %v", err)
+		return
+	}
+
+	if rwl != nil {
+		rp.saveContents(rwl)
 		return
 	}
 
+	// The fault downgraded its result already. If the leaser has since revoked
+	// it, reads will notice and fetch again.
+	rp.lease = rl
+	rp.updatePin()
 	return
 }
 
@@ -179,6 +372,60 @@ func (rp *readProxy) getContents(
 // for later use.
 func (rp *readProxy) saveContents(rwl ReadWriteLease) {
 	rp.lease = rwl.Downgrade()
+	rp.updatePin()
+}
+
+// Pin or unpin our lease to match rp.pinned.
+func (rp *readProxy) updatePin() {
+	if rp.pinned {
+		rp.pin.set(rp.lease)
+	} else {
+		rp.pin.set(nil)
+	}
+}
+
+// Start fetching our contents in the background on behalf of readahead,
+// unless they are already held or on their way. Guarantees to not block.
+//
+// The contents are held as a read lease as soon as they arrive, which the
+// leaser may revoke when it needs the space, rather than as a read/write lease
+// until collected, which it may not: readahead that nobody reads must not push
+// the leaser beyond its limits.
+func (rp *readProxy) prefetch() {
+	if rp.fault != nil || (rp.lease != nil && !rp.lease.Revoked()) {
+		return
+	}
+
+	rp.startFault(true)
+	rp.speculative = true
+}
+
+// If a fault started by prefetch has completed, collect its result so that it
+// becomes our lease. Guarantees to not block.
+func (rp *readProxy) settlePrefetch() {
+	if !rp.speculative || !rp.fault.Done() {
+		return
+	}
+
+	// A failed fetch is forgotten, and the next read will try again.
+	rp.collectFault(context.Background())
+}
+
+// Cancel a fault started by prefetch that no read has wanted since. A fault
+// that has already completed is kept, since its contents cost nothing more.
+func (rp *readProxy) cancelPrefetch() {
+	if !rp.speculative {
+		return
+	}
+
+	if rp.fault.Done() {
+		rp.settlePrefetch()
+		return
+	}
+
+	rp.fault.abandon()
+	rp.fault = nil
+	rp.speculative = false
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -186,6 +433,9 @@ func (rp *readProxy) saveContents(rwl ReadWriteLease) {
 ////////////////////////////////////////////////////////////////////////
 
 func (rp *readProxy) CheckInvariants() {
+	if rp.speculative && rp.fault == nil {
+		panic("Speculative without a fault")
+	}
 }
 
 // Semantics matching io.ReaderAt, except with context support.
@@ -193,6 +443,13 @@ func (rp *readProxy) ReadAt(
 	ctx context.Context,
 	p []byte,
 	off int64) (n int, err error) {
+	// If a fault is in flight, use its result rather than fetching again.
+	rp.speculative = false
+	err = rp.collectFault(ctx)
+	if err != nil {
+		return
+	}
+
 	// Common case: is the existing lease still valid?
 	if rp.lease != nil {
 		n, err = rp.lease.ReadAt(p, off)
@@ -219,12 +476,58 @@ func (rp *readProxy) ReadAt(
 	return
 }
 
+func (rp *readProxy) TryReadAt(
+	p []byte,
+	off int64) (n int, f *Fault, err error) {
+	// Collect the result of a completed fault, if any.
+	rp.speculative = false
+	if rp.fault != nil && rp.fault.Done() {
+		err = rp.collectFault(context.Background())
+		if err != nil {
+			return
+		}
+	}
+
+	// Is the existing lease still valid?
+	if rp.lease != nil {
+		n, err = rp.lease.ReadAt(p, off)
+		if !isRevokedErr(err) {
+			return
+		}
+
+		n = 0
+		err = nil
+	}
+
+	// Fetch in the background.
+	rp.startFault(false)
+	f = rp.fault
+
+	return
+}
+
 // Return the size of the proxied content. Guarantees to not block.
 func (rp *readProxy) Size() (size int64) {
 	size = rp.size
 	return
 }
 
+func (rp *readProxy) Residency() (resident int64) {
+	if rp.lease != nil && !rp.lease.Revoked() {
+		resident = rp.size
+	}
+
+	return
+}
+
+func (rp *readProxy) ResidentRanges() (ranges []ByteRange) {
+	if resident := rp.Residency(); resident != 0 {
+		ranges = []ByteRange{{0, resident}}
+	}
+
+	return
+}
+
 // Return a read/write lease for the proxied contents, destroying the read
 // proxy. The read proxy must not be used after calling this method.
 func (rp *readProxy) Upgrade(
@@ -236,6 +539,12 @@ func (rp *readProxy) Upgrade(
 		}
 	}()
 
+	// If a fault is in flight, use its result rather than fetching again.
+	err = rp.collectFault(ctx)
+	if err != nil {
+		return
+	}
+
 	// Common case: is the existing lease still valid?
 	if rp.lease != nil {
 		rwl, err = rp.lease.Upgrade()
@@ -250,15 +559,34 @@ func (rp *readProxy) Upgrade(
 	// Build the read/write lease anew.
 	rwl, err = rp.getContents(ctx)
 	if err != nil {
-		err = fmt.Errorf("getContents: %v", err)
+		if !IsNoSpaceError(err) {
+			err = fmt.Errorf("getContents: %v", err)
+		}
+
 		return
 	}
 
 	return
 }
 
+func (rp *readProxy) NewOverlay() (rwl ReadWriteLease, err error) {
+	rwl, err = rp.leaser.NewFile()
+	return
+}
+
+func (rp *readProxy) SetPinned(pinned bool) {
+	rp.pinned = pinned
+	rp.updatePin()
+}
+
 // Destroy any resources in use by the read proxy. It must not be used further.
 func (rp *readProxy) Destroy() {
+	rp.SetPinned(false)
+
+	if rp.fault != nil {
+		rp.fault.abandon()
+	}
+
 	if rp.lease != nil {
 		rp.lease.Revoke()
 	}
@@ -268,4 +596,34 @@ func (rp *readProxy) Destroy() {
 	rp.leaser = nil
 	rp.refresher = nil
 	rp.lease = nil
+	rp.fault = nil
+	rp.speculative = false
+}
+
+////////////////////////////////////////////////////////////////////////
+// leasePin
+////////////////////////////////////////////////////////////////////////
+
+// A pin held on at most one read lease at a time, on behalf of a read proxy.
+// The zero value holds none.
+type leasePin struct {
+	// The lease pinned, or nil.
+	rl ReadLease
+}
+
+// Pin rl in place of whatever lease is currently pinned, or just unpin that if
+// rl is nil. A lease that has already been revoked isn't pinned.
+func (p *leasePin) set(rl ReadLease) {
+	if p.rl == rl {
+		return
+	}
+
+	if p.rl != nil {
+		p.rl.Unpin()
+		p.rl = nil
+	}
+
+	if rl != nil && rl.Pin() == nil {
+		p.rl = rl
+	}
 }
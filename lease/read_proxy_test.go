@@ -82,6 +82,16 @@ func (r *funcRefresher) Refresh(
 	return
 }
 
+// A funcRefresher with a tag.
+type taggedRefresher struct {
+	funcRefresher
+	T string
+}
+
+func (r *taggedRefresher) Tag() (tag string) {
+	return r.T
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Boilerplate
 ////////////////////////////////////////////////////////////////////////
@@ -139,8 +149,8 @@ func (t *ReadProxyTest) Size() {
 func (t *ReadProxyTest) LeaserReturnsError() {
 	var err error
 
-	// NewFile
-	ExpectCall(t.leaser, "NewFile")().
+	// NewTaggedFile
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(nil, errors.New("taco")))
 
 	// Attempt to read.
@@ -149,9 +159,9 @@ func (t *ReadProxyTest) LeaserReturnsError() {
 }
 
 func (t *ReadProxyTest) CallsFunc() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Downgrade and Revoke
@@ -175,9 +185,9 @@ func (t *ReadProxyTest) CallsFunc() {
 }
 
 func (t *ReadProxyTest) FuncReturnsError() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Downgrade and Revoke
@@ -197,9 +207,9 @@ func (t *ReadProxyTest) FuncReturnsError() {
 }
 
 func (t *ReadProxyTest) ContentsReturnReadError() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -228,9 +238,9 @@ func (t *ReadProxyTest) ContentsReturnReadError() {
 }
 
 func (t *ReadProxyTest) ContentsReturnCloseError() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -261,9 +271,9 @@ func (t *ReadProxyTest) ContentsReturnCloseError() {
 func (t *ReadProxyTest) ContentsAreWrongLength() {
 	AssertEq(4, len(contents))
 
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -288,9 +298,9 @@ func (t *ReadProxyTest) ContentsAreWrongLength() {
 }
 
 func (t *ReadProxyTest) WritesCorrectData() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -322,9 +332,9 @@ func (t *ReadProxyTest) WritesCorrectData() {
 }
 
 func (t *ReadProxyTest) WriteError() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -351,9 +361,9 @@ func (t *ReadProxyTest) WriteError() {
 func (t *ReadProxyTest) ReadAt_CallsWrapped() {
 	const offset = 17
 
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -379,9 +389,9 @@ func (t *ReadProxyTest) ReadAt_CallsWrapped() {
 }
 
 func (t *ReadProxyTest) ReadAt_Error() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -409,9 +419,9 @@ func (t *ReadProxyTest) ReadAt_Error() {
 }
 
 func (t *ReadProxyTest) ReadAt_Successful() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -438,9 +448,9 @@ func (t *ReadProxyTest) ReadAt_Successful() {
 }
 
 func (t *ReadProxyTest) Upgrade_Error() {
-	// NewFile
+	// NewTaggedFile
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	// Write
@@ -464,9 +474,9 @@ func (t *ReadProxyTest) Upgrade_Error() {
 }
 
 func (t *ReadProxyTest) Upgrade_Successful() {
-	// NewFile
+	// NewTaggedFile
 	expected := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(expected, nil))
 
 	// Write
@@ -488,7 +498,7 @@ func (t *ReadProxyTest) Upgrade_Successful() {
 func (t *ReadProxyTest) WrappedRevoked() {
 	// Arrange a successful wrapped read lease.
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	ExpectCall(rwl, "Write")(Any()).
@@ -514,7 +524,7 @@ func (t *ReadProxyTest) WrappedRevoked() {
 	ExpectCall(rl, "Upgrade")().
 		WillOnce(Return(nil, &lease.RevokedError{}))
 
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		Times(2).
 		WillRepeatedly(Return(nil, errors.New("")))
 
@@ -527,7 +537,7 @@ func (t *ReadProxyTest) WrappedStillValid() {
 
 	// Arrange a successful wrapped read lease.
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	ExpectCall(rwl, "Write")(Any()).
@@ -585,7 +595,7 @@ func (t *ReadProxyTest) InitialReadLease_Revoked() {
 	ExpectCall(rl, "Upgrade")().
 		WillOnce(Return(nil, &lease.RevokedError{}))
 
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		Times(2).
 		WillRepeatedly(Return(nil, errors.New("")))
 
@@ -632,7 +642,7 @@ func (t *ReadProxyTest) InitialReadLease_Valid() {
 func (t *ReadProxyTest) Destroy() {
 	// Arrange a successful wrapped read lease.
 	rwl := mock_lease.NewMockReadWriteLease(t.mockController, "rwl")
-	ExpectCall(t.leaser, "NewFile")().
+	ExpectCall(t.leaser, "NewTaggedFile")("").
 		WillOnce(Return(rwl, nil))
 
 	ExpectCall(rwl, "Write")(Any()).
@@ -17,9 +17,10 @@ package lease
 import (
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"syscall"
 
+	"github.com/googlecloudplatform/gcsfuse/logger"
 	"github.com/jacobsa/syncutil"
 )
 
@@ -37,10 +38,27 @@ type ReadWriteLease interface {
 	// Return the current size of the underlying file.
 	Size() (size int64, err error)
 
+	// Return the number of bytes of disk space actually allocated to the
+	// underlying file. This may be much smaller than its size if the file is
+	// sparse, e.g. because it was written at a large offset. If the file system
+	// doesn't say, this is the same as the size.
+	AllocatedBytes() (n int64, err error)
+
+	// Return the ranges of the underlying file that hold data, in increasing
+	// order, with everything else being holes that read as zeroes. If the file
+	// system can't say, the whole file is a single range. Ranges never extend
+	// past the current size.
+	Extents() (extents []ByteRange, err error)
+
 	// Downgrade to a read lease, releasing any resources pinned by this lease to
 	// the pool that may be revoked, as with any read lease. After downgrading,
-	// this lease must not be used again.
+	// this lease must not be used again. The read lease carries this lease's
+	// tag.
 	Downgrade() (rl ReadLease)
+
+	// Like Downgrade, but give the read lease the supplied tag instead, e.g.
+	// because the contents now belong to something else.
+	DowngradeWithTag(tag string) (rl ReadLease)
 }
 
 type readWriteLease struct {
@@ -53,6 +71,9 @@ type readWriteLease struct {
 	// The leaser that issued this lease.
 	leaser *fileLeaser
 
+	// The tag for the read lease we are downgraded to by Downgrade.
+	tag string
+
 	// The underlying file, set to nil once downgraded.
 	//
 	// GUARDED_BY(mu)
@@ -86,9 +107,11 @@ var _ ReadWriteLease = &readWriteLease{}
 func newReadWriteLease(
 	leaser *fileLeaser,
 	size int64,
-	file *os.File) (rwl *readWriteLease) {
+	file *os.File,
+	tag string) (rwl *readWriteLease) {
 	rwl = &readWriteLease{
 		leaser:       leaser,
+		tag:          tag,
 		file:         file,
 		reportedSize: size,
 		fileSize:     size,
@@ -117,6 +140,22 @@ func (rwl *readWriteLease) Write(p []byte) (n int, err error) {
 	rwl.mu.Lock()
 	defer rwl.mu.Unlock()
 
+	// Refuse to grow if the leaser says there isn't room. Finding the offset
+	// costs a system call, so don't bother if it wouldn't.
+	if rwl.leaser.growthLimited() {
+		var off int64
+		off, err = rwl.file.Seek(0, 1)
+		if err != nil {
+			err = fmt.Errorf("Seek: %v", err)
+			return
+		}
+
+		err = rwl.checkGrowth(off + int64(len(p)))
+		if err != nil {
+			return
+		}
+	}
+
 	// Ensure that we reconcile our size when we're done.
 	defer rwl.reconcileSize()
 
@@ -151,6 +190,12 @@ func (rwl *readWriteLease) WriteAt(p []byte, off int64) (n int, err error) {
 	rwl.mu.Lock()
 	defer rwl.mu.Unlock()
 
+	// Refuse to grow if the leaser says there isn't room.
+	err = rwl.checkGrowth(off + int64(len(p)))
+	if err != nil {
+		return
+	}
+
 	// Ensure that we reconcile our size when we're done.
 	defer rwl.reconcileSize()
 
@@ -165,6 +210,12 @@ func (rwl *readWriteLease) Truncate(size int64) (err error) {
 	rwl.mu.Lock()
 	defer rwl.mu.Unlock()
 
+	// Refuse to grow if the leaser says there isn't room.
+	err = rwl.checkGrowth(size)
+	if err != nil {
+		return
+	}
+
 	// Ensure that we reconcile our size when we're done.
 	defer rwl.reconcileSize()
 
@@ -183,8 +234,50 @@ func (rwl *readWriteLease) Size() (size int64, err error) {
 	return
 }
 
+// LOCKS_EXCLUDED(rwl.mu)
+func (rwl *readWriteLease) AllocatedBytes() (n int64, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	fi, err := rwl.file.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	// st_blocks is always in units of 512 bytes, regardless of the file
+	// system's block size.
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		n = int64(st.Blocks) * 512
+		return
+	}
+
+	n = fi.Size()
+	return
+}
+
+// LOCKS_EXCLUDED(rwl.mu)
+func (rwl *readWriteLease) Extents() (extents []ByteRange, err error) {
+	rwl.mu.Lock()
+	defer rwl.mu.Unlock()
+
+	size, err := rwl.sizeLocked()
+	if err != nil {
+		return
+	}
+
+	extents, err = fileExtents(rwl.file, size)
+	return
+}
+
 // LOCKS_EXCLUDED(rwl.mu)
 func (rwl *readWriteLease) Downgrade() (rl ReadLease) {
+	rl = rwl.DowngradeWithTag(rwl.tag)
+	return
+}
+
+// LOCKS_EXCLUDED(rwl.mu)
+func (rwl *readWriteLease) DowngradeWithTag(tag string) (rl ReadLease) {
 	rwl.mu.Lock()
 	defer rwl.mu.Unlock()
 
@@ -206,13 +299,13 @@ func (rwl *readWriteLease) Downgrade() (rl ReadLease) {
 	// bookkeeping, but discard its result in favor of a lease that ostensibly
 	// has the right size but whose contents cannot be read.
 	if rwl.fileSize < 0 {
-		rwl.leaser.downgrade(rwl.reportedSize, rwl.file)
-		rl = &alwaysRevokedReadLease{size: rwl.reportedSize}
+		rwl.leaser.downgrade(rwl.reportedSize, rwl.file, tag)
+		rl = &alwaysRevokedReadLease{size: rwl.reportedSize, tag: tag}
 		return
 	}
 
 	// Otherwise, just call through to the leaser.
-	rl = rwl.leaser.downgrade(rwl.fileSize, rwl.file)
+	rl = rwl.leaser.downgrade(rwl.fileSize, rwl.file, tag)
 
 	return
 }
@@ -259,6 +352,21 @@ func (rwl *readWriteLease) sizeLocked() (size int64, err error) {
 	return
 }
 
+// Return a *NoSpaceError if the leaser won't let the file grow to the supplied
+// size. Shrinking is always allowed, as is anything when we don't know our
+// current size.
+//
+// LOCKS_REQUIRED(rwl.mu)
+// LOCKS_EXCLUDED(rwl.leaser.mu)
+func (rwl *readWriteLease) checkGrowth(size int64) (err error) {
+	if rwl.fileSize < 0 || size <= rwl.fileSize {
+		return
+	}
+
+	err = rwl.leaser.checkSpace(size - rwl.fileSize)
+	return
+}
+
 // Notify the leaser if our size has changed. Log errors when we fail to find
 // our size.
 //
@@ -277,7 +385,7 @@ func (rwl *readWriteLease) reconcileSize() {
 	// Find our size.
 	size, err := rwl.sizeLocked()
 	if err != nil {
-		log.Println("Error getting size for reconciliation:", err)
+		logger.Errorf("Error getting size for reconciliation: %v", err)
 		return
 	}
 
@@ -298,6 +406,7 @@ func (rwl *readWriteLease) reconcileSize() {
 
 type alwaysRevokedReadLease struct {
 	size int64
+	tag  string
 }
 
 func (rl *alwaysRevokedReadLease) Read(p []byte) (n int, err error) {
@@ -323,6 +432,11 @@ func (rl *alwaysRevokedReadLease) Size() (size int64) {
 	return
 }
 
+func (rl *alwaysRevokedReadLease) Tag() (tag string) {
+	tag = rl.tag
+	return
+}
+
 func (rl *alwaysRevokedReadLease) Revoked() (revoked bool) {
 	revoked = true
 	return
@@ -335,3 +449,11 @@ func (rl *alwaysRevokedReadLease) Upgrade() (rwl ReadWriteLease, err error) {
 
 func (rl *alwaysRevokedReadLease) Revoke() {
 }
+
+func (rl *alwaysRevokedReadLease) Pin() (err error) {
+	err = &RevokedError{}
+	return
+}
+
+func (rl *alwaysRevokedReadLease) Unpin() {
+}
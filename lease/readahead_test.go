@@ -0,0 +1,356 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease_test
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A refresher that counts its calls and, if gated, blocks them until released
+// or cancelled.
+type readaheadRefresher struct {
+	contents string
+	gate     chan struct{}
+
+	mu        sync.Mutex
+	calls     int  // GUARDED_BY(mu)
+	cancelled bool // GUARDED_BY(mu)
+}
+
+func (r *readaheadRefresher) Size() (size int64) {
+	size = int64(len(r.contents))
+	return
+}
+
+func (r *readaheadRefresher) Refresh(
+	ctx context.Context) (rc io.ReadCloser, err error) {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+
+	if r.gate != nil {
+		select {
+		case <-r.gate:
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.cancelled = true
+			r.mu.Unlock()
+
+			err = ctx.Err()
+			return
+		}
+	}
+
+	rc = ioutil.NopCloser(strings.NewReader(r.contents))
+	return
+}
+
+func (r *readaheadRefresher) Calls() (calls int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	calls = r.calls
+	return
+}
+
+func (r *readaheadRefresher) Cancelled() (cancelled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cancelled = r.cancelled
+	return
+}
+
+// Wait for the supplied condition to become true, which happens in the
+// background, returning false if it doesn't within a reasonable time.
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const readaheadChunkSize = 4
+
+type ReadaheadTest struct {
+	ctx        context.Context
+	leaser     lease.FileLeaser
+	refreshers []*readaheadRefresher
+	proxy      *checkingReadProxy
+}
+
+var _ SetUpInterface = &ReadaheadTest{}
+var _ TearDownInterface = &ReadaheadTest{}
+
+func init() { RegisterTestSuite(&ReadaheadTest{}) }
+
+func (t *ReadaheadTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.leaser = lease.NewFileLeaser("", math.MaxInt32, math.MaxInt64)
+
+	for _, s := range []string{"taco", "burr", "ito_", "ench", "ilad"} {
+		t.refreshers = append(t.refreshers, &readaheadRefresher{contents: s})
+	}
+
+	t.resetProxy(2)
+}
+
+func (t *ReadaheadTest) TearDown() {
+	if t.proxy != nil {
+		t.proxy.Destroy()
+	}
+}
+
+// Reset the proxy to use t.refreshers and the given readahead depth.
+func (t *ReadaheadTest) resetProxy(readahead int) {
+	if t.proxy != nil {
+		t.proxy.Destroy()
+	}
+
+	var refreshers []lease.Refresher
+	for _, r := range t.refreshers {
+		refreshers = append(refreshers, r)
+	}
+
+	t.proxy = &checkingReadProxy{
+		Wrapped: lease.NewMultiReadProxy(t.leaser, refreshers, readahead, nil),
+	}
+}
+
+// Read size bytes at off, expecting success.
+func (t *ReadaheadTest) read(off int64, size int) string {
+	buf := make([]byte, size)
+	n, err := t.proxy.ReadAt(t.ctx, buf, off)
+	AssertEq(nil, err)
+
+	return string(buf[:n])
+}
+
+// Return the number of calls made to each refresher.
+func (t *ReadaheadTest) calls() (calls []int) {
+	for _, r := range t.refreshers {
+		calls = append(calls, r.Calls())
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadaheadTest) FewSequentialReads() {
+	ExpectEq("ta", t.read(0, 2))
+	ExpectEq("co", t.read(2, 2))
+
+	// Two reads in a row aren't yet enough to start readahead.
+	ExpectThat(t.calls(), ElementsAre(1, 0, 0, 0, 0))
+}
+
+func (t *ReadaheadTest) SequentialReads() {
+	ExpectEq("ta", t.read(0, 2))
+	ExpectEq("co", t.read(2, 2))
+	ExpectEq("bu", t.read(4, 2))
+
+	// The two chunks after the one holding the end of the third read are
+	// fetched in the background.
+	ExpectTrue(eventually(func() bool {
+		return t.refreshers[3].Calls() == 1
+	}))
+
+	ExpectThat(t.calls(), ElementsAre(1, 1, 1, 1, 0))
+
+	// Reading on serves them without fetching again, and keeps going.
+	ExpectEq("rrito_", t.read(6, 6))
+	ExpectTrue(eventually(func() bool {
+		return t.refreshers[4].Calls() == 1
+	}))
+
+	ExpectEq("enchilad", t.read(12, 8))
+	ExpectThat(t.calls(), ElementsAre(1, 1, 1, 1, 1))
+}
+
+func (t *ReadaheadTest) RetriedReadsDontCount() {
+	ExpectEq("ta", t.read(0, 2))
+	ExpectEq("ta", t.read(0, 2))
+	ExpectEq("ta", t.read(0, 2))
+
+	ExpectThat(t.calls(), ElementsAre(1, 0, 0, 0, 0))
+}
+
+func (t *ReadaheadTest) RandomReads() {
+	ExpectEq("ta", t.read(0, 2))
+	ExpectEq("en", t.read(12, 2))
+	ExpectEq("bu", t.read(4, 2))
+	ExpectEq("co", t.read(2, 2))
+
+	ExpectThat(t.calls(), ElementsAre(1, 1, 0, 1, 0))
+}
+
+func (t *ReadaheadTest) Disabled() {
+	t.resetProxy(0)
+
+	for off := int64(0); off < 8; off += 2 {
+		t.read(off, 2)
+	}
+
+	ExpectThat(t.calls(), ElementsAre(1, 1, 0, 0, 0))
+}
+
+func (t *ReadaheadTest) TryReadAt() {
+	buf := make([]byte, 2)
+	for off := int64(0); off < 6; off += 2 {
+		for {
+			n, f, err := t.proxy.TryReadAt(buf, off)
+			AssertEq(nil, err)
+			if f == nil {
+				AssertEq(2, n)
+				break
+			}
+
+			AssertEq(nil, f.Wait(t.ctx))
+		}
+	}
+
+	ExpectTrue(eventually(func() bool {
+		return t.refreshers[3].Calls() == 1
+	}))
+
+	ExpectThat(t.calls(), ElementsAre(1, 1, 1, 1, 0))
+}
+
+func (t *ReadaheadTest) BreakingThePatternCancels() {
+	t.refreshers[3].gate = make(chan struct{})
+	t.resetProxy(2)
+
+	t.read(0, 2)
+	t.read(2, 2)
+	t.read(4, 2)
+
+	// Chunk 2 arrives, and chunk 3 is in flight when the reader jumps back.
+	ExpectTrue(eventually(func() bool {
+		return t.refreshers[2].Calls() == 1 && t.refreshers[3].Calls() == 1
+	}))
+
+	ExpectEq("ta", t.read(0, 2))
+	ExpectTrue(eventually(t.refreshers[3].Cancelled))
+
+	// What did arrive is kept, and the rest is fetched on demand.
+	close(t.refreshers[3].gate)
+	ExpectEq("ito_ench", t.read(8, 8))
+	ExpectThat(t.calls(), ElementsAre(1, 1, 1, 2, 0))
+}
+
+func (t *ReadaheadTest) ReadingTheChunkInFlightWaitsForIt() {
+	t.refreshers[2].gate = make(chan struct{})
+	t.resetProxy(1)
+
+	t.read(0, 2)
+	t.read(2, 2)
+	t.read(4, 2)
+
+	ExpectTrue(eventually(func() bool {
+		return t.refreshers[2].Calls() == 1
+	}))
+
+	// A read that skips ahead into the chunk being fetched joins the fetch
+	// rather than cancelling it.
+	close(t.refreshers[2].gate)
+	ExpectEq("o_", t.read(10, 2))
+
+	ExpectFalse(t.refreshers[2].Cancelled())
+	ExpectThat(t.calls(), ElementsAre(1, 1, 1, 0, 0))
+}
+
+func (t *ReadaheadTest) DestroyCancels() {
+	t.refreshers[2].gate = make(chan struct{})
+	t.resetProxy(2)
+
+	t.read(0, 2)
+	t.read(2, 2)
+	t.read(4, 2)
+
+	ExpectTrue(eventually(func() bool {
+		return t.refreshers[2].Calls() == 1
+	}))
+
+	t.proxy.Destroy()
+	t.proxy = nil
+
+	ExpectTrue(eventually(t.refreshers[2].Cancelled))
+}
+
+func (t *ReadaheadTest) ChargedToLeaser() {
+	// Room for only three chunks.
+	t.leaser = lease.NewFileLeaser("", math.MaxInt32, 3*readaheadChunkSize)
+	t.resetProxy(2)
+
+	// Reading through still works, with the leaser evicting what it must.
+	var s string
+	for off := int64(0); off < 20; off += 2 {
+		s += t.read(off, 2)
+	}
+
+	ExpectEq("tacoburrito_enchilad", s)
+
+	// Everything was fetched once, and what is held fits within the limit.
+	for i, r := range t.refreshers {
+		ExpectEq(1, r.Calls(), "Refresher %d", i)
+	}
+
+	ExpectLe(t.proxy.Residency(), 3*readaheadChunkSize)
+}
+
+func (t *ReadaheadTest) UnreadReadaheadIsRevocable() {
+	// Room for only one chunk.
+	t.leaser = lease.NewFileLeaser("", math.MaxInt32, readaheadChunkSize)
+	t.resetProxy(2)
+
+	t.read(0, 2)
+	t.read(2, 2)
+	t.read(4, 2)
+
+	// Once the readahead arrives, it may be evicted to bring the leaser back
+	// within its limit, even though no read has collected it.
+	ExpectTrue(eventually(func() bool {
+		_, bytes := t.leaser.Usage()
+		return t.refreshers[3].Calls() == 1 && bytes <= readaheadChunkSize
+	}))
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+)
+
+// Serve a plain text description of whether the bucket may be listed.
+func serveListingState(denied bool, eacces bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		switch {
+		case !denied:
+			fmt.Fprintln(w, "listing: allowed")
+
+		case eacces:
+			fmt.Fprintln(
+				w,
+				"listing: denied (reading directories fails with EACCES)")
+
+		default:
+			fmt.Fprintf(
+				w,
+				"listing: denied (directories appear to contain only %q)\n",
+				fs.ListingDeniedEntryName)
+		}
+	}
+}
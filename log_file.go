@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// A log file opened for appending that can be reopened by name, so that a tool
+// like logrotate can move the file aside and have us start a new one. Safe for
+// concurrent use.
+type logFile struct {
+	path string
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	f *os.File
+
+	// Set if our stderr should follow f. See RedirectStderr.
+	//
+	// GUARDED_BY(mu)
+	stderr bool
+}
+
+func openLogFile(path string) (lf *logFile, err error) {
+	lf = &logFile{path: path}
+	lf.f, err = lf.open()
+	return
+}
+
+func (lf *logFile) open() (f *os.File, err error) {
+	f, err = os.OpenFile(
+		lf.path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0644)
+
+	if err != nil {
+		err = fmt.Errorf("OpenFile: %v", err)
+		return
+	}
+
+	return
+}
+
+func (lf *logFile) Write(p []byte) (n int, err error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	n, err = lf.f.Write(p)
+	return
+}
+
+// Point our stderr at the log file, now and after each reopening, so that
+// output that bypasses the logger, such as the runtime's report of a panic,
+// isn't lost when stderr would otherwise be /dev/null.
+func (lf *logFile) RedirectStderr() (err error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	err = syscall.Dup2(int(lf.f.Fd()), int(os.Stderr.Fd()))
+	if err != nil {
+		err = fmt.Errorf("Dup2: %v", err)
+		return
+	}
+
+	lf.stderr = true
+	return
+}
+
+// Open the path again and switch to writing there. If this fails, keep
+// writing to the old file.
+func (lf *logFile) Reopen() (err error) {
+	f, err := lf.open()
+	if err != nil {
+		return
+	}
+
+	lf.mu.Lock()
+	old := lf.f
+	lf.f = f
+	if lf.stderr {
+		err = syscall.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
+	}
+	lf.mu.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("Dup2: %v", err)
+	}
+
+	if closeErr := old.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("Close: %v", closeErr)
+	}
+
+	return
+}
+
+// A writer that writes to each of several writers, like io.MultiWriter, but
+// carries on to the rest when one fails. It returns the first error.
+type multiWriter []io.Writer
+
+func (mw multiWriter) Write(p []byte) (n int, err error) {
+	for _, w := range mw {
+		_, wErr := w.Write(p)
+		if wErr != nil && err == nil {
+			err = wErr
+		}
+	}
+
+	n = len(p)
+	return
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LogFileTest struct {
+	dir string
+}
+
+var _ SetUpInterface = &LogFileTest{}
+var _ TearDownInterface = &LogFileTest{}
+
+func init() { RegisterTestSuite(&LogFileTest{}) }
+
+func (t *LogFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "log_file_test")
+	AssertEq(nil, err)
+}
+
+func (t *LogFileTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+func (t *LogFileTest) read(name string) string {
+	contents, err := ioutil.ReadFile(path.Join(t.dir, name))
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LogFileTest) AppendsToExistingFile() {
+	p := path.Join(t.dir, "gcsfuse.log")
+	err := ioutil.WriteFile(p, []byte("taco\n"), 0644)
+	AssertEq(nil, err)
+
+	lf, err := openLogFile(p)
+	AssertEq(nil, err)
+
+	_, err = lf.Write([]byte("burrito\n"))
+	AssertEq(nil, err)
+
+	ExpectEq("taco\nburrito\n", t.read("gcsfuse.log"))
+}
+
+func (t *LogFileTest) ReopenAfterRotation() {
+	p := path.Join(t.dir, "gcsfuse.log")
+	lf, err := openLogFile(p)
+	AssertEq(nil, err)
+
+	_, err = lf.Write([]byte("taco\n"))
+	AssertEq(nil, err)
+
+	// Move the file aside, as logrotate does. Until we reopen, output follows
+	// the file.
+	err = os.Rename(p, path.Join(t.dir, "gcsfuse.log.1"))
+	AssertEq(nil, err)
+
+	_, err = lf.Write([]byte("burrito\n"))
+	AssertEq(nil, err)
+
+	err = lf.Reopen()
+	AssertEq(nil, err)
+
+	_, err = lf.Write([]byte("enchilada\n"))
+	AssertEq(nil, err)
+
+	ExpectEq("taco\nburrito\n", t.read("gcsfuse.log.1"))
+	ExpectEq("enchilada\n", t.read("gcsfuse.log"))
+}
+
+func (t *LogFileTest) ReopenFailure() {
+	subdir := path.Join(t.dir, "subdir")
+	err := os.Mkdir(subdir, 0700)
+	AssertEq(nil, err)
+
+	p := path.Join(subdir, "gcsfuse.log")
+	lf, err := openLogFile(p)
+	AssertEq(nil, err)
+
+	// Make it impossible to open the path again.
+	err = os.RemoveAll(subdir)
+	AssertEq(nil, err)
+
+	err = lf.Reopen()
+	ExpectThat(err, Error(HasSubstr("OpenFile")))
+
+	// Writing should still work.
+	_, err = lf.Write([]byte("taco\n"))
+	ExpectEq(nil, err)
+}
+
+func (t *LogFileTest) OpenFailure() {
+	_, err := openLogFile(path.Join(t.dir, "missing", "gcsfuse.log"))
+	ExpectThat(err, Error(HasSubstr("no such file")))
+}
+
+func (t *LogFileTest) RedirectStderr() {
+	// Put our real stderr back afterward.
+	saved, err := syscall.Dup(int(os.Stderr.Fd()))
+	AssertEq(nil, err)
+	defer func() {
+		AssertEq(nil, syscall.Dup2(saved, int(os.Stderr.Fd())))
+		syscall.Close(saved)
+	}()
+
+	p := path.Join(t.dir, "gcsfuse.log")
+	lf, err := openLogFile(p)
+	AssertEq(nil, err)
+
+	err = lf.RedirectStderr()
+	AssertEq(nil, err)
+
+	_, err = os.Stderr.Write([]byte("taco\n"))
+	AssertEq(nil, err)
+
+	// Stderr should follow the file when it is reopened.
+	err = os.Rename(p, path.Join(t.dir, "gcsfuse.log.1"))
+	AssertEq(nil, err)
+
+	err = lf.Reopen()
+	AssertEq(nil, err)
+
+	_, err = os.Stderr.Write([]byte("burrito\n"))
+	AssertEq(nil, err)
+
+	ExpectEq("taco\n", t.read("gcsfuse.log.1"))
+	ExpectEq("burrito\n", t.read("gcsfuse.log"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// multiWriter
+////////////////////////////////////////////////////////////////////////
+
+// A writer that always fails.
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (n int, err error) {
+	err = errors.New("taco")
+	return
+}
+
+// A writer that records what it is given.
+type recordingWriter struct {
+	written []byte
+}
+
+func (w *recordingWriter) Write(p []byte) (n int, err error) {
+	w.written = append(w.written, p...)
+	n = len(p)
+	return
+}
+
+type MultiWriterTest struct {
+}
+
+func init() { RegisterTestSuite(&MultiWriterTest{}) }
+
+func (t *MultiWriterTest) FailureDoesntStopOthers() {
+	var a, b recordingWriter
+	mw := multiWriter{&a, failingWriter{}, &b}
+
+	n, err := mw.Write([]byte("burrito"))
+	ExpectEq(len("burrito"), n)
+	ExpectThat(err, Error(Equals("taco")))
+
+	ExpectEq("burrito", string(a.written))
+	ExpectEq("burrito", string(b.written))
+}
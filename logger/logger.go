@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Logging of messages that report errors. These go to the standard logger
+// like any other message, unless SetErrorOutput has been called to send them
+// somewhere else, such as to syslog with a higher severity.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+var (
+	mu sync.Mutex
+
+	// The logger for errors, or nil to use the standard logger.
+	//
+	// GUARDED_BY(mu)
+	errorLog *log.Logger
+)
+
+// Log a message reporting an error, formatted as by log.Printf.
+func Errorf(format string, v ...interface{}) {
+	mu.Lock()
+	l := errorLog
+	mu.Unlock()
+
+	msg := fmt.Sprintf(format, v...)
+	if l == nil {
+		log.Output(2, msg)
+		return
+	}
+
+	l.Output(2, msg)
+}
+
+// Send later messages reporting errors to the supplied writer, with the
+// standard logger's current prefix and flags. If w is nil, send them to the
+// standard logger again.
+func SetErrorOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	errorLog = nil
+	if w != nil {
+		errorLog = log.New(w, log.Prefix(), log.Flags())
+	}
+}
+
+// Return a logger whose every message reports an error, such as the error
+// logger of a library, with the given prefix.
+func NewErrorLogger(prefix string) *log.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	w := log.Writer()
+	if errorLog != nil {
+		w = errorLog.Writer()
+	}
+
+	return log.New(w, prefix, log.Flags())
+}
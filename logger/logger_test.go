@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestLogger(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LoggerTest struct {
+	std  bytes.Buffer
+	errs bytes.Buffer
+}
+
+var _ SetUpInterface = &LoggerTest{}
+var _ TearDownInterface = &LoggerTest{}
+
+func init() { RegisterTestSuite(&LoggerTest{}) }
+
+func (t *LoggerTest) SetUp(ti *TestInfo) {
+	log.SetOutput(&t.std)
+	log.SetFlags(0)
+}
+
+func (t *LoggerTest) TearDown() {
+	logger.SetErrorOutput(nil)
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LoggerTest) ErrorsGoToStandardLoggerByDefault() {
+	logger.Errorf("taco: %d", 17)
+	ExpectEq("taco: 17\n", t.std.String())
+}
+
+func (t *LoggerTest) SetErrorOutput() {
+	logger.SetErrorOutput(&t.errs)
+
+	log.Printf("burrito")
+	logger.Errorf("taco: %d", 17)
+	logger.NewErrorLogger("fuse: ").Printf("enchilada")
+
+	ExpectEq("burrito\n", t.std.String())
+	ExpectEq("taco: 17\nfuse: enchilada\n", t.errs.String())
+
+	// Back to the standard logger.
+	logger.SetErrorOutput(nil)
+	logger.Errorf("queso")
+	ExpectEq("burrito\nqueso\n", t.std.String())
+}
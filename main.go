@@ -16,19 +16,19 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
-	"runtime/pprof"
 	"syscall"
-	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 
-	"github.com/jacobsa/fuse"
+	"github.com/googlecloudplatform/gcsfuse/daemonize"
+	"github.com/googlecloudplatform/gcsfuse/logger"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/syncutil"
 	"github.com/jgeewax/cli"
@@ -38,107 +38,99 @@ import (
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
-func registerSIGINTHandler(mountPoint string) {
-	// Register for SIGINT.
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+// Reopen the log file on SIGUSR1.
+func registerSIGUSR1Handler(lf *logFile) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
 
-	// Start a goroutine that will unmount when the signal is received.
 	go func() {
 		for {
-			<-signalChan
-			log.Println("Received SIGINT, attempting to unmount...")
-
-			err := fuse.Unmount(mountPoint)
-			if err != nil {
-				log.Printf("Failed to unmount in response to SIGINT: %v", err)
+			<-c
+			if err := lf.Reopen(); err != nil {
+				logger.Errorf("Error reopening log file: %v", err)
 			} else {
-				log.Printf("Successfully unmounted in response to SIGINT.")
-				return
+				log.Println("Reopened log file in response to SIGUSR1.")
 			}
 		}
 	}()
 }
 
-// Dump profiles on SIGHUP, if enabled.
-func registerSIGHUPHandler(cpu bool, mem bool) {
-	var desc string
+// Direct the output of the standard logger, and therefore of the loggers
+// derived from it by getConn and fuseMountConfig, according to the flags and
+// whether we have daemonized. If flags.LogFile is non-empty, output is appended
+// to that file and the returned logFile may be used to reopen it. If
+// flags.LogToSyslog is set, output goes to syslog, messages logged with
+// logger.Errorf are sent with severity LOG_ERR, and the returned syslogWriter
+// should be used for fatal errors (see fatalf).
+//
+// In a daemonized child, output is also sent to the foreground process while
+// it waits for the outcome of mounting. After that, unless there is a log
+// file or syslog, it is discarded; our stderr is /dev/null. If there is a log
+// file, stderr is pointed at it too, so that panics are recorded there.
+func setUpLogging(
+	flags *flagStorage) (lf *logFile, sw *syslogWriter, err error) {
+	var dst, errDst io.Writer
 	switch {
-	case cpu && mem:
-		desc = "CPU and memory profiles"
+	case flags.LogFile != "":
+		lf, err = openLogFile(flags.LogFile)
+		if err != nil {
+			err = fmt.Errorf("Opening log file: %v", err)
+			return
+		}
 
-	case cpu:
-		desc = "CPU profile"
+		dst = lf
 
-	case mem:
-		desc = "memory profile"
+	case flags.LogToSyslog:
+		sw, err = openSyslog()
+		if err != nil {
+			err = fmt.Errorf("Connecting to syslog: %v", err)
+			return
+		}
 
-	default:
-		return
+		// syslog records its own timestamps.
+		log.SetFlags(0)
+		dst = sw
+		errDst = sw.Errors()
 	}
 
-	const duration = 10 * time.Second
-	profileOnce := func() (err error) {
-		// CPU
-		if cpu {
-			var f *os.File
-			f, err = os.Create("/tmp/cpu.pprof")
-			if err != nil {
-				err = fmt.Errorf("Create: %v", err)
-				return
-			}
-
-			defer func() {
-				closeErr := f.Close()
-				if err == nil {
-					err = closeErr
-				}
-			}()
+	var w io.Writer = os.Stderr
+	if daemonize.Child() {
+		w = daemonize.StatusWriter
+		if errDst != nil {
+			errDst = multiWriter{w, errDst}
+		}
 
-			pprof.StartCPUProfile(f)
-			defer pprof.StopCPUProfile()
+		if dst != nil {
+			w = multiWriter{w, dst}
 		}
 
-		// Memory
-		if mem {
-			var f *os.File
-			f, err = os.Create("/tmp/mem.pprof")
-			if err != nil {
-				err = fmt.Errorf("Create: %v", err)
+		if lf != nil {
+			if err = lf.RedirectStderr(); err != nil {
+				err = fmt.Errorf("Redirecting stderr to log file: %v", err)
 				return
 			}
-
-			defer func() {
-				closeErr := f.Close()
-				if err == nil {
-					err = closeErr
-				}
-			}()
-
-			defer func() {
-				pprof.Lookup("heap").WriteTo(f, 0)
-			}()
 		}
+	} else if dst != nil {
+		w = dst
+	}
 
-		time.Sleep(duration)
-		return
+	log.SetOutput(w)
+	if errDst != nil {
+		logger.SetErrorOutput(errDst)
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
+	return
+}
 
-	// Wait for SIGHUP in the background.
-	go func() {
-		for {
-			<-c
-			log.Printf("Received SIGHUP. Dumping %s to /tmp...", desc)
-			if err := profileOnce(); err != nil {
-				log.Printf("Error profiling: %v", err)
-			} else {
-				log.Println("Done profiling.")
-			}
-		}
-	}()
+// Like log.Fatalf, but when logging to syslog send the message with severity
+// LOG_CRIT.
+func fatalf(sw *syslogWriter, format string, v ...interface{}) {
+	if sw == nil {
+		log.Fatalf(format, v...)
+	}
+
+	sw.Crit(fmt.Sprintf(format, v...))
+	os.Exit(1)
 }
 
 // Create token source from the JSON file at the supplide path.
@@ -165,11 +157,16 @@ func newTokenSourceFromPath(
 	return
 }
 
-func getConn(flags *flagStorage) (c gcs.Conn, err error) {
-	// Create the oauth2 token source.
-	const scope = gcs.Scope_FullControl
+// Create the oauth2 token source used for talking to GCS.
+func getTokenSource(
+	flags *flagStorage) (tokenSrc oauth2.TokenSource, err error) {
+	// Don't ask for more than we need, so that a read-only mount can't write
+	// even by mistake.
+	scope := gcs.Scope_FullControl
+	if flags.ReadOnly {
+		scope = gcs.Scope_ReadOnly
+	}
 
-	var tokenSrc oauth2.TokenSource
 	if flags.KeyFile != "" {
 		tokenSrc, err = newTokenSourceFromPath(flags.KeyFile, scope)
 		if err != nil {
@@ -184,22 +181,89 @@ func getConn(flags *flagStorage) (c gcs.Conn, err error) {
 		}
 	}
 
-	// Create the connection.
-	const userAgent = "gcsfuse/0.0"
-	cfg := &gcs.ConnConfig{
-		TokenSource: tokenSrc,
-		UserAgent:   userAgent,
+	return
+}
+
+// If tokenSrc is nil, the connection sends no credentials.
+func getConn(
+	flags *flagStorage,
+	tokenSrc oauth2.TokenSource) (c gcs.Conn, err error) {
+	cfg, err := BuildConnConfig(flags, tokenSrc)
+	if err != nil {
+		return
 	}
 
-	if flags.DebugHTTP {
-		cfg.HTTPDebugLogger = log.New(os.Stderr, "http: ", 0)
+	return gcs.NewConn(&cfg)
+}
+
+// Set up everything needed to talk to GCS, then mount the file system.
+func mountWithFlags(
+	bucketName string,
+	mountPoint string,
+	flags *flagStorage) (
+	m *mountedFS,
+	stats *mountStats,
+	err error) {
+	// Enable invariant checking if requested.
+	if flags.DebugInvariants {
+		syncutil.EnableInvariantChecking()
 	}
 
-	if flags.DebugGCS {
-		cfg.GCSDebugLogger = log.New(os.Stderr, "gcs: ", 0)
+	// Grab the connection.
+	tokenSrc, err := getTokenSource(flags)
+	if err != nil {
+		err = fmt.Errorf("getTokenSource: %v", err)
+		return
+	}
+
+	conn, err := getConn(flags, tokenSrc)
+	if err != nil {
+		err = fmt.Errorf("getConn: %v", err)
+		return
+	}
+
+	// Turn off features that the bucket can't support.
+	ctx := context.Background()
+	features := gateFeatures(
+		gatedFeatures,
+		flags,
+		func() (bucketCapabilities, error) {
+			return fetchBucketCapabilities(
+				ctx,
+				oauth2.NewClient(ctx, tokenSrc),
+				storageAPIBaseURL,
+				bucketName)
+		})
+
+	// Mount the file system.
+	m, stats, err = mount(
+		ctx,
+		bucketName,
+		mountPoint,
+		flags,
+		features,
+		conn)
+
+	return
+}
+
+// Re-execute this binary with the same arguments in the background, waiting
+// for it to mount the file system. Its logging up to that point is copied to
+// our stderr, and if it fails to mount the returned error carries its reason.
+func daemonizeSelf() (err error) {
+	path, err := os.Executable()
+	if err != nil {
+		err = fmt.Errorf("Executable: %v", err)
+		return
+	}
+
+	err = daemonize.Run(path, os.Args[1:], os.Environ(), os.Stderr)
+	if err != nil {
+		err = fmt.Errorf("Mounting file system: %v", err)
+		return
 	}
 
-	return gcs.NewConn(cfg)
+	return
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -227,41 +291,84 @@ func main() {
 		// Populate and parse flags.
 		bucketName := c.Args()[0]
 		mountPoint := c.Args()[1]
-		flags := populateFlags(c)
+		flags, err := populateFlags(c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			cli.ShowAppHelp(c)
+			os.Exit(1)
+		}
 
-		// Enable invariant checking if requested.
-		if flags.DebugInvariants {
-			syncutil.EnableInvariantChecking()
+		// Describe what we would do instead of mounting, if asked to.
+		if flags.Explain {
+			err = explain(os.Stdout, bucketName, flags)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			return
 		}
 
-		// Enable profiling if requested.
-		registerSIGHUPHandler(flags.DebugCPUProfile, flags.DebugMemProfile)
+		// Unless told not to, hand off to a copy of ourselves running in the
+		// background, and exit as soon as it reports the result of mounting.
+		if !flags.Foreground && !daemonize.Child() {
+			err = daemonizeSelf()
+			if err != nil {
+				log.Fatalln(err)
+			}
 
-		// Grab the connection.
-		conn, err := getConn(flags)
-		if err != nil {
-			log.Fatalf("getConn: %v", err)
+			return
 		}
 
-		// Mount the file system.
-		mfs, err := mount(
-			context.Background(),
-			bucketName,
-			mountPoint,
-			flags,
-			conn)
+		// Send logging where it belongs, then mount the file system.
+		var m *mountedFS
+		var stats *mountStats
+		lf, sw, err := setUpLogging(flags)
+		if err == nil {
+			log.Printf("Starting %s.", getUserAgent(flags.AppName))
+			m, stats, err = mountWithFlags(bucketName, mountPoint, flags)
+		}
+
+		if daemonize.Child() {
+			if signalErr := daemonize.SignalOutcome(err); signalErr != nil {
+				logger.Errorf("SignalOutcome: %v", signalErr)
+			}
+		}
 
 		if err != nil {
-			log.Fatalf("Mounting file system: %v", err)
+			fatalf(sw, "Mounting file system: %v", err)
 		}
 
 		log.Println("File system has been successfully mounted.")
 
-		// Let the user unmount with Ctrl-C (SIGINT).
-		registerSIGINTHandler(mfs.Dir())
+		// Summarize the mount on SIGHUP, and enable profiling if requested.
+		registerSIGHUPHandler(
+			stats,
+			flags.DebugCPUProfile,
+			flags.DebugMemProfile,
+			flags.ProfileDir)
+
+		// Let the user unmount with Ctrl-C (SIGINT), and systemd with SIGTERM.
+		registerSIGINTHandler(m.Dir(), m, flags.UnmountRetryTimeout)
+
+		// Let logrotate tell us to reopen the log file.
+		if lf != nil {
+			registerSIGUSR1Handler(lf)
+		}
+
+		// Wait for the file system to be unmounted, remounting it if its kernel
+		// connection dies and we've been asked to.
+		err = newMountSupervisor(flags.AutoRemount).Supervise(
+			context.Background(),
+			m)
+
+		log.Println(stats.Summary())
+
+		if err == errConnectionDied {
+			logger.Errorf("%v; exiting.", err)
+			os.Exit(connectionDiedExitCode)
+		}
 
-		// Wait for the file system to be unmounted.
-		err = mfs.Join(context.Background())
 		if err != nil {
 			err = fmt.Errorf("MountedFileSystem.Join: %v", err)
 			return
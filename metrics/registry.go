@@ -0,0 +1,362 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A registry of counters and histograms, exported in the Prometheus text
+// exposition format. Updating a metric takes no locks, so that instrumenting
+// a hot path doesn't serialize concurrent callers.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Histogram bucket upper bounds suitable for latencies measured in seconds,
+// from 100 µs to 10 s.
+var LatencyBuckets = []float64{
+	0.0001,
+	0.0005,
+	0.001,
+	0.005,
+	0.01,
+	0.05,
+	0.1,
+	0.5,
+	1,
+	5,
+	10,
+}
+
+// A monotonically increasing count. Safe for concurrent use.
+type Counter struct {
+	// Accessed atomically.
+	v uint64
+}
+
+// Increment the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Increment the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Return the current count.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// A distribution of observed values, counted in fixed buckets. Safe for
+// concurrent use.
+type Histogram struct {
+	// Upper bounds of the buckets, increasing. Not modified after creation.
+	bounds []float64
+
+	// The number of observations falling in each bucket, with a final bucket
+	// for those above all bounds. Accessed atomically.
+	counts []uint64
+
+	// The bits of the float64 sum of all observations. Accessed atomically.
+	sumBits uint64
+}
+
+// Record a single observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64frombits(old) + v
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// Return the total number of observations.
+func (h *Histogram) Count() (n uint64) {
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+	}
+
+	return
+}
+
+// Return the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+// A collection of named metrics. Metrics are created (or found) by name and
+// label values, typically once at start-up, and then updated without
+// involving the registry.
+type Registry struct {
+	mu sync.Mutex
+
+	// Metric families by name.
+	//
+	// GUARDED_BY(mu)
+	families map[string]*family
+}
+
+// All metrics with a given name, which differ only in their labels.
+type family struct {
+	name string
+	help string
+
+	// "counter" or "histogram".
+	kind string
+
+	// Members keyed by their formatted label set, e.g. `{op="ReadFile"}`.
+	// Each is a *Counter, counterFunc, or *Histogram according to kind.
+	members map[string]interface{}
+}
+
+// A counter whose value is kept elsewhere and read when the metrics are
+// written.
+type counterFunc func() uint64
+
+// Create an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// Return the counter with the given name and labels, creating it if
+// necessary. labels alternates label names and values. Panics if the name is
+// already used for a metric of another kind.
+func (r *Registry) Counter(
+	name string,
+	help string,
+	labels ...string) (c *Counter) {
+	m := r.findOrCreate(name, help, "counter", labels, func() interface{} {
+		return new(Counter)
+	})
+
+	c = m.(*Counter)
+	return
+}
+
+// Register a counter with the given name and labels whose value is obtained
+// by calling f each time the metrics are written, for counts that are already
+// kept elsewhere. f must be safe for concurrent use and must not call back
+// into the registry. Registering the same name and labels again replaces the
+// function, so that the metric follows the most recent source. Panics if they
+// are in use by an ordinary counter.
+func (r *Registry) CounterFunc(
+	name string,
+	help string,
+	f func() uint64,
+	labels ...string) {
+	key := formatLabels(labels)
+	r.findOrCreate(name, help, "counter", labels, func() interface{} {
+		return counterFunc(f)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members := r.families[name].members
+	if _, ok := members[key].(counterFunc); !ok {
+		panic(fmt.Sprintf("Counter %s%s isn't a function", name, key))
+	}
+
+	members[key] = counterFunc(f)
+}
+
+// Return the histogram with the given name, bucket bounds, and labels,
+// creating it if necessary. The bounds must be increasing; those of an
+// existing histogram are not changed.
+func (r *Registry) Histogram(
+	name string,
+	help string,
+	bounds []float64,
+	labels ...string) (h *Histogram) {
+	m := r.findOrCreate(name, help, "histogram", labels, func() interface{} {
+		return &Histogram{
+			bounds: bounds,
+			counts: make([]uint64, len(bounds)+1),
+		}
+	})
+
+	h = m.(*Histogram)
+	return
+}
+
+func (r *Registry) findOrCreate(
+	name string,
+	help string,
+	kind string,
+	labels []string,
+	create func() interface{}) (m interface{}) {
+	key := formatLabels(labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{
+			name:    name,
+			help:    help,
+			kind:    kind,
+			members: make(map[string]interface{}),
+		}
+
+		r.families[name] = f
+	}
+
+	if f.kind != kind {
+		panic(fmt.Sprintf("Metric %q is a %s, not a %s", name, f.kind, kind))
+	}
+
+	m, ok = f.members[key]
+	if !ok {
+		m = create()
+		f.members[key] = m
+	}
+
+	return
+}
+
+var labelValueEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`)
+
+// Format alternating label names and values as a Prometheus label set, or
+// the empty string if there are none.
+func formatLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("Odd number of label names and values: %q", labels))
+	}
+
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(
+			pairs,
+			fmt.Sprintf(`%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Add a label to a formatted label set.
+func withLabel(set string, name string, value string) string {
+	pair := fmt.Sprintf(`%s="%s"`, name, value)
+	if set == "" {
+		return "{" + pair + "}"
+	}
+
+	return set[:len(set)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write all metrics in the Prometheus text exposition format, with families
+// and their members in a stable order.
+func (r *Registry) WriteText(w io.Writer) (err error) {
+	var buf bytes.Buffer
+
+	r.mu.Lock()
+
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.kind)
+
+		var keys []string
+		for k := range f.members {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			switch m := f.members[k].(type) {
+			case *Counter:
+				fmt.Fprintf(&buf, "%s%s %d\n", f.name, k, m.Value())
+
+			case counterFunc:
+				fmt.Fprintf(&buf, "%s%s %d\n", f.name, k, m())
+
+			case *Histogram:
+				writeHistogram(&buf, f.name, k, m)
+			}
+		}
+	}
+
+	r.mu.Unlock()
+
+	_, err = w.Write(buf.Bytes())
+	return
+}
+
+func writeHistogram(w io.Writer, name string, labels string, h *Histogram) {
+	// Buckets are cumulative in the exposition format.
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+
+		le := math.Inf(+1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s_bucket%s %d\n",
+			name,
+			withLabel(labels, "le", formatFloat(le)),
+			cumulative)
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.Sum()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, cumulative)
+}
+
+// Serve the metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
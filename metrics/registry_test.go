@@ -0,0 +1,183 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/metrics"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestRegistry(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RegistryTest struct {
+	r *metrics.Registry
+}
+
+var _ SetUpInterface = &RegistryTest{}
+
+func init() { RegisterTestSuite(&RegistryTest{}) }
+
+func (t *RegistryTest) SetUp(ti *TestInfo) {
+	t.r = metrics.NewRegistry()
+}
+
+func (t *RegistryTest) text() string {
+	var buf bytes.Buffer
+	AssertEq(nil, t.r.WriteText(&buf))
+	return buf.String()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RegistryTest) Empty() {
+	ExpectEq("", t.text())
+}
+
+func (t *RegistryTest) CounterFoundByNameAndLabels() {
+	a := t.r.Counter("ops_total", "Ops.", "op", "read")
+	b := t.r.Counter("ops_total", "Ops.", "op", "write")
+
+	ExpectEq(a, t.r.Counter("ops_total", "Ops.", "op", "read"))
+	ExpectNe(a, b)
+}
+
+func (t *RegistryTest) Counters() {
+	t.r.Counter("ops_total", "Ops handled.", "op", "write").Add(2)
+	t.r.Counter("ops_total", "Ops handled.", "op", "read").Inc()
+	t.r.Counter("bytes_total", "Bytes.").Add(17)
+
+	expected := strings.Join([]string{
+		"# HELP bytes_total Bytes.",
+		"# TYPE bytes_total counter",
+		"bytes_total 17",
+		"# HELP ops_total Ops handled.",
+		"# TYPE ops_total counter",
+		`ops_total{op="read"} 1`,
+		`ops_total{op="write"} 2`,
+		"",
+	}, "\n")
+
+	ExpectEq(expected, t.text())
+}
+
+func (t *RegistryTest) CounterFuncs() {
+	var n uint64
+	f := func() uint64 { return n }
+	t.r.CounterFunc("evictions_total", "Evictions.", f, "reason", "capacity")
+	t.r.Counter("evictions_total", "Evictions.", "reason", "other").Inc()
+
+	// The function is consulted each time.
+	n = 3
+	ExpectThat(t.text(), HasSubstr(`evictions_total{reason="capacity"} 3`+"\n"))
+
+	n = 5
+	ExpectThat(t.text(), HasSubstr(`evictions_total{reason="capacity"} 5`+"\n"))
+	ExpectThat(t.text(), HasSubstr(`evictions_total{reason="other"} 1`+"\n"))
+
+	// Registering it again replaces the function.
+	t.r.CounterFunc(
+		"evictions_total",
+		"Evictions.",
+		func() uint64 { return 17 },
+		"reason", "capacity")
+
+	ExpectThat(t.text(), HasSubstr(`evictions_total{reason="capacity"} 17`+"\n"))
+
+	// But an ordinary counter can't be replaced.
+	ExpectThat(
+		func() { t.r.CounterFunc("evictions_total", "Evictions.", f, "reason", "other") },
+		Panics(HasSubstr("isn't a function")))
+}
+
+func (t *RegistryTest) LabelValuesEscaped() {
+	t.r.Counter("c", "C.", "name", "a\"b\\c\nd").Inc()
+	ExpectThat(t.text(), HasSubstr(`c{name="a\"b\\c\nd"} 1`))
+}
+
+func (t *RegistryTest) Histogram() {
+	h := t.r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "op", "x")
+
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	ExpectEq(4, h.Count())
+	ExpectEq(3.65, h.Sum())
+
+	expected := strings.Join([]string{
+		"# HELP latency_seconds Latency.",
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{op="x",le="0.1"} 2`,
+		`latency_seconds_bucket{op="x",le="1"} 3`,
+		`latency_seconds_bucket{op="x",le="+Inf"} 4`,
+		`latency_seconds_sum{op="x"} 3.65`,
+		`latency_seconds_count{op="x"} 4`,
+		"",
+	}, "\n")
+
+	ExpectEq(expected, t.text())
+}
+
+func (t *RegistryTest) HistogramWithoutLabels() {
+	t.r.Histogram("h", "H.", []float64{1}).Observe(2)
+	ExpectThat(t.text(), HasSubstr(`h_bucket{le="+Inf"} 1`))
+	ExpectThat(t.text(), HasSubstr("h_count 1"))
+}
+
+func (t *RegistryTest) KindMismatch() {
+	t.r.Counter("m", "M.")
+	ExpectThat(
+		func() { t.r.Histogram("m", "M.", metrics.LatencyBuckets) },
+		Panics(HasSubstr("counter")))
+}
+
+func (t *RegistryTest) ConcurrentUpdates() {
+	const workers = 8
+	const perWorker = 1000
+
+	c := t.r.Counter("c", "C.")
+	h := t.r.Histogram("h", "H.", metrics.LatencyBuckets)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				c.Inc()
+				h.Observe(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	ExpectEq(workers*perWorker, c.Value())
+	ExpectEq(workers*perWorker, h.Count())
+	ExpectEq(workers*perWorker, h.Sum())
+}
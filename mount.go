@@ -17,40 +17,146 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
 
 	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	mountpkg "github.com/googlecloudplatform/gcsfuse/mount"
 	"github.com/googlecloudplatform/gcsfuse/perms"
+	"github.com/jacobsa/bazilfuse"
 	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fsutil"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/timeutil"
 )
 
+// Return an error if a FUSE file system is already mounted at the supplied
+// mount point, identifying its owner if possible. Do nothing on systems that
+// lack a Linux-style mountinfo table.
+func checkNotMounted(mountPoint string) (err error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	mounts, err := mountpkg.ParseMountInfo(f)
+	if err != nil {
+		err = fmt.Errorf("ParseMountInfo: %v", err)
+		return
+	}
+
+	resolved, err := mountpkg.ResolveMountPoint(mountPoint)
+	if err != nil {
+		err = fmt.Errorf("ResolveMountPoint: %v", err)
+		return
+	}
+
+	mi := mountpkg.FindFuseMount(mounts, resolved)
+	if mi == nil {
+		return
+	}
+
+	owner := "an unknown process"
+	if fp := mountpkg.FindFuseProcess("/proc", resolved); fp != nil {
+		owner = fmt.Sprintf(
+			"pid %d (cmdline %q)",
+			fp.Pid,
+			strings.Join(fp.Cmdline, " "))
+	}
+
+	err = fmt.Errorf(
+		"%s is already mounted (fsname %q) by %s. "+
+			"Use --allow-mount-over to mount on top of it anyway.",
+		resolved,
+		mi.Source,
+		owner)
+
+	return
+}
+
+// Return the configuration for mounting the named bucket with fuse.
+func fuseMountConfig(
+	bucketName string,
+	flags *flagStorage) (cfg *fuse.MountConfig, err error) {
+	cfg = &fuse.MountConfig{
+		FSName:      bucketName,
+		Options:     flags.MountOptions,
+		ReadOnly:    flags.ReadOnly,
+		ErrorLogger: logger.NewErrorLogger("fuse: "),
+
+		// Opening with O_TRUNC can then skip reading the object's contents.
+		EnableAtomicTrunc: true,
+	}
+
+	if flags.DebugFuse {
+		cfg.DebugLogger = log.New(log.Writer(), "fuse_debug: ", 0)
+	}
+
+	// Zero means the platform default.
+	if flags.MaxWrite != 0 {
+		if flags.MaxWrite < 4096 || flags.MaxWrite > bazilfuse.MaxWriteLimit {
+			err = fmt.Errorf(
+				"--max-write must be 0 or in [4096, %d] (got %d)",
+				bazilfuse.MaxWriteLimit,
+				flags.MaxWrite)
+			return
+		}
+
+		cfg.MaxWrite = uint32(flags.MaxWrite)
+	}
+
+	return
+}
+
 // Mount the file system based on the supplied arguments, returning a
-// fuse.MountedFileSystem that can be joined to wait for unmounting.
+// fuse.MountedFileSystem that can be joined to wait for unmounting, and the
+// stats to summarize when it is.
 func mount(
 	ctx context.Context,
 	bucketName string,
 	mountPoint string,
 	flags *flagStorage,
-	conn gcs.Conn) (mfs *fuse.MountedFileSystem, err error) {
+	features []featureState,
+	conn gcs.Conn) (
+	m *mountedFS,
+	stats *mountStats,
+	err error) {
 	// Sanity check: make sure the temporary directory exists and is writable
 	// currently. This gives a better user experience than harder to debug EIO
 	// errors when reading files in the future.
 	if flags.TempDir != "" {
-		var f *os.File
-		f, err = fsutil.AnonymousFile(flags.TempDir)
-		f.Close()
+		err = prepareTempDir(flags.TempDir)
+		if err != nil {
+			err = fmt.Errorf("--temp-dir: %v", err)
+			return
+		}
+	}
 
+	err = checkTempDirLimits(
+		flags.TempDir,
+		flags.TempDirLimit,
+		flags.TempDirLimitFiles)
+	if err != nil {
+		return
+	}
+
+	// Refuse to stack on top of an existing FUSE mount, which would hide it and
+	// confuse later attempts to unmount.
+	if !flags.AllowMountOver {
+		err = checkNotMounted(mountPoint)
 		if err != nil {
-			err = fmt.Errorf(
-				"Error writing to temporary directory (%q); are you sure it exists "+
-					"with the correct permissions?",
-				err.Error())
 			return
 		}
 	}
@@ -62,9 +168,7 @@ func mount(
 	// 10.10.3). So print a warning if the limit is low.
 	var rlimit unix.Rlimit
 	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit); err == nil {
-		const reasonableLimit = 4096
-
-		if rlimit.Cur < reasonableLimit {
+		if rlimit.Cur < reasonableFileRlimit {
 			log.Printf(
 				"Warning: low file rlimit of %d will cause cached content to be "+
 					"frequently evicted. Consider raising with `ulimit -n`.",
@@ -72,74 +176,207 @@ func mount(
 		}
 	}
 
-	// Choose UID and GID.
+	// Inodes are owned by us unless the flags say otherwise.
 	uid, gid, err := perms.MyUserAndGroup()
 	if err != nil {
 		err = fmt.Errorf("MyUserAndGroup: %v", err)
 		return
 	}
 
-	if flags.Uid >= 0 {
-		uid = uint32(flags.Uid)
+	// Check how directories should behave if the bucket can't be listed, before
+	// we find out whether it can.
+	unlistableEACCES, err := parseUnlistableDirs(flags.UnlistableDirs)
+	if err != nil {
+		return
 	}
 
-	if flags.Gid >= 0 {
-		gid = uint32(flags.Gid)
+	// Check the fuse configuration before we do anything expensive.
+	mountCfg, err := fuseMountConfig(bucketName, flags)
+	if err != nil {
+		return
 	}
 
 	// Set up the bucket.
-	bucket, err := setUpBucket(
-		ctx,
-		flags,
-		conn,
-		bucketName)
+	bucket, prefetcher, costs, publicRead, forgetObject, listingDenied, err :=
+		setUpBucket(
+			ctx,
+			flags,
+			conn,
+			bucketName)
 
 	if err != nil {
 		err = fmt.Errorf("setUpBucket: %v", err)
 		return
 	}
 
+	costs.RegisterMetrics(metricsRegistry)
+
 	// Create a file system server.
-	serverCfg := &fs.ServerConfig{
-		Clock:                timeutil.RealClock(),
-		Bucket:               bucket,
-		TempDir:              flags.TempDir,
-		TempDirLimitNumFiles: fs.ChooseTempDirLimitNumFiles(),
-		TempDirLimitBytes:    flags.TempDirLimit,
-		GCSChunkSize:         flags.GCSChunkSize,
-		ImplicitDirectories:  flags.ImplicitDirs,
-		DirTypeCacheTTL:      flags.TypeCacheTTL,
-		Uid:                  uid,
-		Gid:                  gid,
-		FilePerms:            os.FileMode(flags.FileMode),
-		DirPerms:             os.FileMode(flags.DirMode),
-
-		AppendThreshold: 1 << 21, // 2 MiB, a total guess.
-		TmpObjectPrefix: ".gcsfuse_tmp/",
+	counters := new(fs.Counters)
+	deps := serverConfigDeps{
+		Clock:         timeutil.RealClock(),
+		Bucket:        bucket,
+		Uid:           uid,
+		Gid:           gid,
+		ListingDenied: listingDenied,
+		Metrics:       metricsRegistry,
+		Counters:      counters,
 	}
 
-	server, err := fs.NewServer(serverCfg)
+	// Let notifications of changes made by other clients reach the caches in
+	// the bucket.
+	deps.ForgetObject = forgetObject
+
+	cfg, err := BuildServerConfig(flags, deps)
 	if err != nil {
-		err = fmt.Errorf("fs.NewServer: %v", err)
 		return
 	}
 
+	if cfg.FixedOwner {
+		log.Printf(
+			"Reporting all inodes as owned by uid %d and gid %d, per --uid and "+
+				"--gid; changes of owner will be refused.",
+			cfg.Uid,
+			cfg.Gid)
+	}
+
+	serverCfg := &cfg
+
+	// Tell the kernel when its cached state turns out to be stale.
+	serverCfg.Invalidator = fs.NewKernelInvalidator()
+
+	// Serve debugging information, if requested. The file system server
+	// registers its handlers in a mux of its own, which a remount replaces.
+	var fsHandlers *replaceableHandler
+	if flags.DebugEndpoint != "" {
+		mux := newDebugMux()
+		mux.HandleFunc("/features", serveFeatures(features))
+		mux.HandleFunc(
+			"/listing",
+			serveListingState(listingDenied, unlistableEACCES))
+
+		mux.HandleFunc("/temp_dir", serveTempDirStats(flags.TempDir, counters))
+
+		if publicRead != nil {
+			mux.HandleFunc("/public_read", servePublicReadStats(publicRead))
+		}
+
+		if prefetcher != nil {
+			mux.HandleFunc("/prefetch", servePrefetchStats(prefetcher))
+		}
+
+		fsHandlers = &replaceableHandler{}
+		mux.Handle("/", fsHandlers)
+		serverCfg.DebugMux = http.NewServeMux()
+
+		_, err = startDebugHTTPServer(flags.DebugEndpoint, mux)
+		if err != nil {
+			err = fmt.Errorf("startDebugHTTPServer: %v", err)
+			return
+		}
+	}
+
 	// Mount the file system.
-	mountCfg := &fuse.MountConfig{
-		FSName:      bucket.Name(),
-		Options:     flags.MountOptions,
-		ErrorLogger: log.New(os.Stderr, "fuse: ", log.Flags()),
+	m, err = mountServer(mountPoint, serverCfg, mountCfg)
+	if err != nil {
+		return
 	}
 
-	if flags.DebugFuse {
-		mountCfg.DebugLogger = log.New(os.Stderr, "fuse_debug: ", 0)
+	if fsHandlers != nil {
+		fsHandlers.Set(serverCfg.DebugMux)
+		m.fsHandlers = fsHandlers
+	}
+
+	// Warm up the cache from a sibling mount's snapshot, if requested. This is
+	// advisory, so it happens in the background and never fails the mount.
+	if flags.WarmupFrom != "" {
+		go warmUpFrom(flags.WarmupFrom, flags.GCSChunkSize, bucket, prefetcher)
+	}
+
+	// Summarize the mount's work periodically, if requested.
+	stats = newMountStats(timeutil.RealClock(), flags.TempDir, counters, costs)
+	if flags.PrintStatsInterval > 0 {
+		go logMountStats(stats, flags.PrintStatsInterval)
+	}
+
+	// Report what the mount is costing, if requested.
+	if flags.CostSummaryInterval > 0 {
+		go logCostSummaries(
+			newCostSummarizer(timeutil.RealClock(), costs, flags.OpPrices),
+			flags.CostSummaryInterval)
+	}
+
+	return
+}
+
+// A mounted file system, with what's needed to rescue and remount it should
+// its kernel connection die.
+type mountedFS struct {
+	*fuse.MountedFileSystem
+	server fs.Server
+
+	serverCfg *fs.ServerConfig
+	mountCfg  *fuse.MountConfig
+
+	// Forwards debug endpoint requests to the server's DebugMux, or nil if
+	// there is no debug endpoint.
+	fsHandlers *replaceableHandler
+}
+
+// Create a file system server and mount it.
+func mountServer(
+	mountPoint string,
+	serverCfg *fs.ServerConfig,
+	mountCfg *fuse.MountConfig) (m *mountedFS, err error) {
+	server, err := fs.NewServer(serverCfg)
+	if err != nil {
+		err = fmt.Errorf("fs.NewServer: %v", err)
+		return
 	}
 
-	mfs, err = fuse.Mount(mountPoint, server, mountCfg)
+	mfs, err := fuse.Mount(mountPoint, server, mountCfg)
 	if err != nil {
 		err = fmt.Errorf("Mount: %v", err)
 		return
 	}
 
+	m = &mountedFS{
+		MountedFileSystem: mfs,
+		server:            server,
+		serverCfg:         serverCfg,
+		mountCfg:          mountCfg,
+	}
+
+	return
+}
+
+func (m *mountedFS) SyncDirtyFiles(ctx context.Context) (n int, err error) {
+	n, err = m.server.SyncDirtyFiles(ctx)
+	return
+}
+
+// Mount a fresh file system server, with cold caches, at the same place and
+// with the same configuration, after stopping the old server's background
+// work. The debug endpoint switches to the new server's handlers.
+func (m *mountedFS) Remount() (next supervisedMount, err error) {
+	m.server.StopBackgroundWork()
+
+	cfg := *m.serverCfg
+	cfg.Invalidator = fs.NewKernelInvalidator()
+	if m.fsHandlers != nil {
+		cfg.DebugMux = http.NewServeMux()
+	}
+
+	nm, err := mountServer(m.Dir(), &cfg, m.mountCfg)
+	if err != nil {
+		return
+	}
+
+	if m.fsHandlers != nil {
+		m.fsHandlers.Set(cfg.DebugMux)
+		nm.fsHandlers = m.fsHandlers
+	}
+
+	next = nm
 	return
 }
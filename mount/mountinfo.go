@@ -0,0 +1,254 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A single entry from a Linux mountinfo table, as found in
+// /proc/<pid>/mountinfo. See proc(5).
+type MountInfo struct {
+	// The path, within the mounting file system, that forms the root of this
+	// mount. This is something other than "/" for bind mounts.
+	Root string
+
+	// The absolute path of the mount point, relative to the process's root.
+	MountPoint string
+
+	// The file system type, e.g. "ext4" or "fuse".
+	FSType string
+
+	// File system specific information, e.g. the FSName of a FUSE file system.
+	Source string
+}
+
+// Is this a FUSE mount?
+func (mi *MountInfo) IsFuse() bool {
+	return mi.FSType == "fuse" ||
+		mi.FSType == "fuseblk" ||
+		strings.HasPrefix(mi.FSType, "fuse.")
+}
+
+// Parse the contents of a Linux mountinfo table.
+func ParseMountInfo(r io.Reader) (mounts []MountInfo, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		// The line consists of six fixed fields, a variable number of optional
+		// fields, a separator, and then three more fixed fields:
+		//
+		//     36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		//
+		fields := strings.Fields(line)
+
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+
+		if sep == -1 || len(fields) < sep+3 {
+			err = fmt.Errorf("Malformed mountinfo line %d: %q", lineNum, line)
+			return
+		}
+
+		mi := MountInfo{
+			Root:       unescapeMountInfo(fields[3]),
+			MountPoint: unescapeMountInfo(fields[4]),
+			FSType:     fields[sep+1],
+			Source:     unescapeMountInfo(fields[sep+2]),
+		}
+
+		mounts = append(mounts, mi)
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// The kernel escapes space, tab, newline, and backslash in mountinfo paths
+// as three-digit octal sequences like \040. Undo that.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				buf.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+
+		buf.WriteByte(s[i])
+	}
+
+	return buf.String()
+}
+
+// Turn a user-supplied mount point into the form in which the kernel reports
+// it in mountinfo: absolute, clean, and free of symlinks.
+//
+// The mount point may be the root of a dead FUSE mount, in which case even
+// lstat(2) on it fails. So if the full path can't be resolved, resolve its
+// parent and use the final component as is.
+func ResolveMountPoint(p string) (resolved string, err error) {
+	p, err = filepath.Abs(p)
+	if err != nil {
+		err = fmt.Errorf("Abs: %v", err)
+		return
+	}
+
+	resolved, err = filepath.EvalSymlinks(p)
+	if err == nil {
+		return
+	}
+
+	parent, err := filepath.EvalSymlinks(path.Dir(p))
+	if err != nil {
+		err = fmt.Errorf("EvalSymlinks: %v", err)
+		return
+	}
+
+	resolved = path.Join(parent, path.Base(p))
+	return
+}
+
+// Find the FUSE mount, if any, that is currently visible at the supplied
+// resolved mount point (see ResolveMountPoint). If several file systems are
+// stacked there, the topmost FUSE one is returned. Return nil if there is no
+// such mount.
+func FindFuseMount(
+	mounts []MountInfo,
+	resolvedMountPoint string) (mi *MountInfo) {
+	// Later entries are mounted on top of earlier ones.
+	for i := range mounts {
+		m := &mounts[i]
+		if path.Clean(m.MountPoint) == resolvedMountPoint && m.IsFuse() {
+			mi = m
+		}
+	}
+
+	return
+}
+
+// A process that may be serving a FUSE file system.
+type FuseProcess struct {
+	Pid     int
+	Cmdline []string
+}
+
+// Look for the process serving the FUSE file system mounted at the supplied
+// resolved mount point, by scanning the given proc file system (normally
+// "/proc") for processes that hold /dev/fuse open and whose command line
+// mentions the mount point. Return nil if none can be identified.
+//
+// This is a heuristic: the kernel doesn't expose the owner of a FUSE mount
+// directly.
+func FindFuseProcess(
+	procDir string,
+	resolvedMountPoint string) (fp *FuseProcess) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+
+		pidDir := path.Join(procDir, e.Name())
+		if !holdsDevFuse(pidDir) {
+			continue
+		}
+
+		cmdline, err := ioutil.ReadFile(path.Join(pidDir, "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		// Relative paths in the command line are relative to the process's
+		// working directory, not ours.
+		cwd, _ := os.Readlink(path.Join(pidDir, "cwd"))
+
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		for _, arg := range args {
+			if arg == "" {
+				continue
+			}
+
+			if !path.IsAbs(arg) {
+				if cwd == "" {
+					continue
+				}
+
+				arg = path.Join(cwd, arg)
+			}
+
+			resolved, err := ResolveMountPoint(arg)
+			if err != nil || resolved != resolvedMountPoint {
+				continue
+			}
+
+			fp = &FuseProcess{
+				Pid:     pid,
+				Cmdline: args,
+			}
+
+			return
+		}
+	}
+
+	return
+}
+
+// Does the process with the given /proc/<pid> directory hold /dev/fuse open?
+func holdsDevFuse(pidDir string) bool {
+	fdDir := path.Join(pidDir, "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return false
+	}
+
+	for _, fd := range fds {
+		target, err := os.Readlink(path.Join(fdDir, fd.Name()))
+		if err == nil && target == "/dev/fuse" {
+			return true
+		}
+	}
+
+	return false
+}
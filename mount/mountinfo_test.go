@@ -0,0 +1,287 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mount_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/mount"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMountInfo(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MountInfoTest struct {
+	// A temporary directory, with symlinks resolved.
+	dir string
+}
+
+var _ SetUpInterface = &MountInfoTest{}
+var _ TearDownInterface = &MountInfoTest{}
+
+func init() { RegisterTestSuite(&MountInfoTest{}) }
+
+func (t *MountInfoTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.dir, err = ioutil.TempDir("", "mountinfo_test")
+	AssertEq(nil, err)
+
+	t.dir, err = filepath.EvalSymlinks(t.dir)
+	AssertEq(nil, err)
+}
+
+func (t *MountInfoTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+func (t *MountInfoTest) parse(lines ...string) (mounts []mount.MountInfo) {
+	mounts, err := mount.ParseMountInfo(
+		strings.NewReader(strings.Join(lines, "\n") + "\n"))
+
+	AssertEq(nil, err)
+	return
+}
+
+// Create a fake /proc/<pid> directory within procDir.
+func (t *MountInfoTest) fakeProcess(
+	procDir string,
+	pid string,
+	cwd string,
+	devFuse bool,
+	args ...string) {
+	var err error
+
+	pidDir := path.Join(procDir, pid)
+	err = os.MkdirAll(path.Join(pidDir, "fd"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(
+		path.Join(pidDir, "cmdline"),
+		[]byte(strings.Join(args, "\x00")+"\x00"),
+		0600)
+	AssertEq(nil, err)
+
+	err = os.Symlink(cwd, path.Join(pidDir, "cwd"))
+	AssertEq(nil, err)
+
+	err = os.Symlink("/dev/null", path.Join(pidDir, "fd", "0"))
+	AssertEq(nil, err)
+
+	if devFuse {
+		err = os.Symlink("/dev/fuse", path.Join(pidDir, "fd", "3"))
+		AssertEq(nil, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MountInfoTest) Parse() {
+	mounts := t.parse(
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw",
+		"36 22 0:31 / /mnt/some\\040dir rw,nosuid shared:17 master:2 - "+
+			"fuse some_bucket rw,user_id=1000",
+		"37 22 8:1 /var/data /srv/data rw - ext4 /dev/sda1 rw",
+	)
+
+	AssertEq(3, len(mounts))
+
+	ExpectEq("/", mounts[0].MountPoint)
+	ExpectEq("ext4", mounts[0].FSType)
+	ExpectFalse(mounts[0].IsFuse())
+
+	ExpectEq("/", mounts[1].Root)
+	ExpectEq("/mnt/some dir", mounts[1].MountPoint)
+	ExpectEq("fuse", mounts[1].FSType)
+	ExpectEq("some_bucket", mounts[1].Source)
+	ExpectTrue(mounts[1].IsFuse())
+
+	ExpectEq("/var/data", mounts[2].Root)
+	ExpectEq("/srv/data", mounts[2].MountPoint)
+}
+
+func (t *MountInfoTest) ParseMalformed() {
+	_, err := mount.ParseMountInfo(strings.NewReader(
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+			"36 22 0:31 / /mnt rw\n"))
+
+	ExpectThat(err, Error(HasSubstr("line 2")))
+}
+
+func (t *MountInfoTest) FuseTypes() {
+	mounts := t.parse(
+		"1 0 0:1 / /a rw - fuse a rw",
+		"2 0 0:2 / /b rw - fuse.sshfs b rw",
+		"3 0 0:3 / /c rw - fuseblk c rw",
+		"4 0 0:4 / /d rw - fusectl d rw",
+	)
+
+	ExpectTrue(mounts[0].IsFuse())
+	ExpectTrue(mounts[1].IsFuse())
+	ExpectTrue(mounts[2].IsFuse())
+	ExpectFalse(mounts[3].IsFuse())
+}
+
+func (t *MountInfoTest) FindFuseMount_ExactPathOnly() {
+	mounts := t.parse(
+		"22 1 8:1 / / rw - ext4 /dev/sda1 rw",
+		"36 22 0:31 / /mnt/foo rw - fuse some_bucket rw",
+	)
+
+	ExpectNe(nil, mount.FindFuseMount(mounts, "/mnt/foo"))
+	ExpectEq(nil, mount.FindFuseMount(mounts, "/mnt"))
+	ExpectEq(nil, mount.FindFuseMount(mounts, "/mnt/foo/bar"))
+	ExpectEq(nil, mount.FindFuseMount(mounts, "/mnt/fo"))
+}
+
+func (t *MountInfoTest) FindFuseMount_NonFuse() {
+	mounts := t.parse(
+		"22 1 8:1 / / rw - ext4 /dev/sda1 rw",
+		"36 22 0:31 / /mnt/foo rw - tmpfs tmpfs rw",
+	)
+
+	ExpectEq(nil, mount.FindFuseMount(mounts, "/mnt/foo"))
+}
+
+func (t *MountInfoTest) FindFuseMount_Stacked() {
+	mounts := t.parse(
+		"36 22 0:31 / /mnt/foo rw - fuse first_bucket rw",
+		"37 36 0:32 / /mnt/foo rw - fuse second_bucket rw",
+	)
+
+	mi := mount.FindFuseMount(mounts, "/mnt/foo")
+	AssertNe(nil, mi)
+	ExpectEq("second_bucket", mi.Source)
+}
+
+func (t *MountInfoTest) FindFuseMount_BindMount() {
+	// A FUSE file system mounted at /mnt/foo, and a subdirectory of it bind
+	// mounted at /srv/bar. The bind mount shows up with the FUSE type.
+	mounts := t.parse(
+		"36 22 0:31 / /mnt/foo rw - fuse some_bucket rw",
+		"40 22 0:31 /sub /srv/bar rw - fuse some_bucket rw",
+	)
+
+	mi := mount.FindFuseMount(mounts, "/srv/bar")
+	AssertNe(nil, mi)
+	ExpectEq("/sub", mi.Root)
+}
+
+func (t *MountInfoTest) ResolveMountPoint_Symlink() {
+	var err error
+
+	// Create a directory, and a symlink to it.
+	real := path.Join(t.dir, "real")
+	err = os.Mkdir(real, 0700)
+	AssertEq(nil, err)
+
+	link := path.Join(t.dir, "link")
+	err = os.Symlink("real", link)
+	AssertEq(nil, err)
+
+	resolved, err := mount.ResolveMountPoint(link + "/")
+	AssertEq(nil, err)
+	ExpectEq(real, resolved)
+
+	// A symlinked path should match the mount table's entry for the real path.
+	mounts := t.parse("36 22 0:31 / " + real + " rw - fuse some_bucket rw")
+	ExpectNe(nil, mount.FindFuseMount(mounts, resolved))
+}
+
+func (t *MountInfoTest) ResolveMountPoint_SymlinkedParent() {
+	var err error
+
+	err = os.Mkdir(path.Join(t.dir, "real"), 0700)
+	AssertEq(nil, err)
+
+	err = os.Symlink("real", path.Join(t.dir, "link"))
+	AssertEq(nil, err)
+
+	// The final component doesn't exist, as would be the case if lstat(2) on
+	// a dead FUSE mount failed.
+	resolved, err := mount.ResolveMountPoint(path.Join(t.dir, "link/mnt"))
+	AssertEq(nil, err)
+	ExpectEq(path.Join(t.dir, "real/mnt"), resolved)
+}
+
+func (t *MountInfoTest) ResolveMountPoint_Relative() {
+	var err error
+
+	wd, err := os.Getwd()
+	AssertEq(nil, err)
+	defer os.Chdir(wd)
+
+	err = os.Chdir(t.dir)
+	AssertEq(nil, err)
+
+	err = os.Mkdir(path.Join(t.dir, "foo"), 0700)
+	AssertEq(nil, err)
+
+	resolved, err := mount.ResolveMountPoint("./foo/../foo")
+	AssertEq(nil, err)
+	ExpectEq(path.Join(t.dir, "foo"), resolved)
+}
+
+func (t *MountInfoTest) FindFuseProcess() {
+	var err error
+	procDir := path.Join(t.dir, "proc")
+	mountPoint := path.Join(t.dir, "mnt")
+
+	err = os.Mkdir(mountPoint, 0700)
+	AssertEq(nil, err)
+
+	err = os.Symlink("mnt", path.Join(t.dir, "link"))
+	AssertEq(nil, err)
+
+	// A process that mentions the mount point but doesn't hold /dev/fuse.
+	t.fakeProcess(procDir, "17", "/", false, "ls", mountPoint)
+
+	// A FUSE process for a different mount point.
+	t.fakeProcess(procDir, "19", "/", true, "sshfs", "host:", "/elsewhere")
+
+	// The one we want, which refers to the mount point relative to its working
+	// directory and via a symlink.
+	t.fakeProcess(procDir, "23", t.dir, true, "gcsfuse", "some_bucket", "link")
+
+	// Something that isn't a process.
+	err = os.Mkdir(path.Join(procDir, "self_but_not_really"), 0700)
+	AssertEq(nil, err)
+
+	fp := mount.FindFuseProcess(procDir, mountPoint)
+	AssertNe(nil, fp)
+	ExpectEq(23, fp.Pid)
+	ExpectThat(fp.Cmdline, ElementsAre("gcsfuse", "some_bucket", "link"))
+}
+
+func (t *MountInfoTest) FindFuseProcess_NoneFound() {
+	procDir := path.Join(t.dir, "proc")
+	t.fakeProcess(procDir, "19", "/", true, "sshfs", "host:", "/elsewhere")
+
+	ExpectEq(nil, mount.FindFuseProcess(procDir, "/mnt/foo"))
+	ExpectEq(nil, mount.FindFuseProcess(path.Join(t.dir, "missing"), "/"))
+}
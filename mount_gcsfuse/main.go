@@ -12,24 +12,23 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// A small helper for using gcsfuse with mount(8).
+// A mount(8) helper for gcsfuse, allowing buckets to be mounted with
+// `mount -t gcsfuse` and from /etc/fstab.
 //
-// Can be invoked using a command-line of the form expected for mount helpers.
-// Calls the gcsfuse binary, which must be in $PATH, and waits for it to
-// complete. The device and mount point are passed on as positional arguments,
-// and other known options are converted to appropriate flags.
-//
-// This binary does not daemonize, and therefore must be used with a wrapper
-// that performs daemonization if it is to be used directly with mount(8).
+// Install it as /sbin/mount_gcsfuse on OS X or /sbin/mount.gcsfuse on Linux.
+// It accepts a command-line of the form expected for mount helpers, translates
+// it into gcsfuse flags, and replaces itself with gcsfuse, which mounts the
+// bucket and daemonizes once the file system is ready. The gcsfuse binary is
+// looked for in the directory containing this one, then in $PATH.
 package main
 
 // Example invocation on OS X:
 //
-//     mount -t porp -o foo=bar\ baz -o ro,blah bucket ~/tmp/mp
+//     mount -t gcsfuse -o foo=bar\ baz -o ro,blah bucket ~/tmp/mp
 //
 // becomes the following arguments:
 //
-//     Arg 0: "/path/to/gcsfuse_mount_helper"
+//     Arg 0: "/sbin/mount_gcsfuse"
 //     Arg 1: "-o"
 //     Arg 2: "foo=bar baz"
 //     Arg 3: "-o"
@@ -41,11 +40,11 @@ package main
 //
 // On Linux, the fstab entry
 //
-//     bucket /path/to/mp porp user,foo=bar\040baz
+//     bucket /path/to/mp gcsfuse user,foo=bar\040baz
 //
 // becomes
 //
-//     Arg 0: "/path/to/gcsfuse_mount_helper"
+//     Arg 0: "/sbin/mount.gcsfuse"
 //     Arg 1: "bucket"
 //     Arg 2: "/path/to/mp"
 //     Arg 3: "-o"
@@ -57,6 +56,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"syscall"
 
 	"github.com/googlecloudplatform/gcsfuse/mount"
 )
@@ -69,36 +71,36 @@ func makeGcsfuseArgs(
 	device string,
 	mountPoint string,
 	opts map[string]string) (args []string, err error) {
+	// Process options in a predictable order.
+	var names []string
+	for name := range opts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
 	// Deal with options.
-	for name, value := range opts {
+	for _, name := range names {
+		value := opts[name]
 		switch name {
 		case "fuse_debug":
-			args = append(args, "--fuse.debug")
+			args = append(args, "--debug_fuse")
 
 		case "gcs_debug":
-			args = append(args, "--gcs.debug")
-
-		case "uid":
-			args = append(args, "--uid="+value)
+			args = append(args, "--debug_gcs")
 
-		case "gid":
-			args = append(args, "--gid="+value)
-
-		case "file_mode":
-			args = append(args, "--file-mode="+value)
-
-		case "dir_mode":
-			args = append(args, "--dir-mode="+value)
-
-		// On Linux, option 'user' is necessary for mount(8) to let a non-root user
-		// mount a file system. It is passed through to us, but we don't want to
-		// pass it on to gcsfuse because fusermount chokes on it with
+		// These options are interpreted by mount(8) itself. On Linux, option
+		// 'user' is necessary for mount(8) to let a non-root user mount a file
+		// system. It is passed through to us, but we don't want to pass it on to
+		// gcsfuse because fusermount chokes on it with
 		//
 		//     fusermount: mount failed: Invalid argument
 		//
-		case "user":
+		case "user", "nouser", "users", "auto", "noauto", "_netdev", "nofail",
+			"defaults":
 
-		// Pass through everything else.
+		// Pass through everything else. gcsfuse understands options like
+		// key_file and uid, and passes on the rest to fuse.
 		default:
 			var formatted string
 			if value == "" {
@@ -147,6 +149,11 @@ func parseArgs(
 		case i > 0 && args[i-1] == "-o":
 			mount.ParseOptions(opts, s)
 
+		// Linux's mount(8) may pass along its own -n (don't write mtab), -s
+		// (sloppy), and -v (verbose) flags, none of which mean anything to us.
+		case s == "-n" || s == "-s" || s == "-v":
+			continue
+
 		// Is this the device?
 		case positionalCount == 0:
 			device = s
@@ -163,6 +170,11 @@ func parseArgs(
 		}
 	}
 
+	if positionalCount != 2 {
+		err = fmt.Errorf("Expected a bucket name and a mount point.")
+		return
+	}
+
 	return
 }
 
@@ -208,16 +220,37 @@ func main() {
 		log.Printf("gcsfuse arg: %q", a)
 	}
 
-	// Run gcsfuse and wait for it to complete.
-	cmd := exec.Command("gcsfuse", gcsfuseArgs...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Replace ourselves with gcsfuse, which exits once the file system has
+	// been mounted, just as mount(8) expects.
+	gcsfuse, err := findGcsfuse()
+	if err != nil {
+		log.Fatalf("findGcsfuse: %v", err)
+	}
+
+	err = syscall.Exec(
+		gcsfuse,
+		append([]string{gcsfuse}, gcsfuseArgs...),
+		os.Environ())
+
+	log.Fatalf("Exec(%q): %v", gcsfuse, err)
+}
 
-	err = cmd.Run()
+// Find the gcsfuse binary, preferring one installed alongside this binary
+// since mount(8) may run us with a minimal $PATH.
+func findGcsfuse() (path string, err error) {
+	if self, selfErr := os.Executable(); selfErr == nil {
+		candidate := filepath.Join(filepath.Dir(self), "gcsfuse")
+		if _, statErr := os.Stat(candidate); statErr == nil {
+			path = candidate
+			return
+		}
+	}
+
+	path, err = exec.LookPath("gcsfuse")
 	if err != nil {
-		log.Fatalf("gcsfuse failed or failed to run: %v", err)
+		err = fmt.Errorf("LookPath: %v", err)
+		return
 	}
 
-	log.Println("gcsfuse completed successfully.")
+	return
 }
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMountHelper(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MountHelperTest struct {
+}
+
+func init() { RegisterTestSuite(&MountHelperTest{}) }
+
+func (t *MountHelperTest) translate(args ...string) (gcsfuseArgs []string) {
+	device, mountPoint, opts, err := parseArgs(append([]string{"helper"}, args...))
+	AssertEq(nil, err)
+
+	gcsfuseArgs, err = makeGcsfuseArgs(device, mountPoint, opts)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MountHelperTest) LinuxFstabEntry() {
+	args := t.translate(
+		"bucket",
+		"/mnt/data",
+		"-o",
+		"rw,noexec,nosuid,nodev,user,key_file=/etc/key.json")
+
+	ExpectThat(
+		args,
+		ElementsAre(
+			"-o", "key_file=/etc/key.json",
+			"-o", "nodev",
+			"-o", "noexec",
+			"-o", "nosuid",
+			"-o", "rw",
+			"bucket",
+			"/mnt/data"))
+}
+
+func (t *MountHelperTest) OSXInvocation() {
+	args := t.translate(
+		"-o", "uid=1000",
+		"-o", "ro,noauto",
+		"-o", "gcs_debug",
+		"bucket",
+		"/mnt/data")
+
+	ExpectThat(
+		args,
+		ElementsAre(
+			"--debug_gcs",
+			"-o", "ro",
+			"-o", "uid=1000",
+			"bucket",
+			"/mnt/data"))
+}
+
+func (t *MountHelperTest) MountFlagsIgnored() {
+	args := t.translate("-n", "bucket", "/mnt/data", "-s", "-o", "rw")
+	ExpectThat(args, ElementsAre("-o", "rw", "bucket", "/mnt/data"))
+}
+
+func (t *MountHelperTest) MissingMountPoint() {
+	_, _, _, err := parseArgs([]string{"helper", "-o", "rw", "bucket"})
+	ExpectThat(err, Error(HasSubstr("mount point")))
+}
+
+func (t *MountHelperTest) TrailingDashO() {
+	_, _, _, err := parseArgs([]string{"helper", "bucket", "/mnt/data", "-o"})
+	ExpectThat(err, Error(HasSubstr("-o at end")))
+}
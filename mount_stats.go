@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/timeutil"
+)
+
+// The work done by a mount since it started, gathered from the file system and
+// from the cost bucket that sees every request sent to GCS.
+type mountStats struct {
+	clock   timeutil.Clock
+	start   time.Time
+	tempDir string
+	files   *fs.Counters
+	costs   gcsproxy.CostBucket
+}
+
+// The temporary directory is the one given to the file leaser, with "" meaning
+// the system default.
+func newMountStats(
+	clock timeutil.Clock,
+	tempDir string,
+	files *fs.Counters,
+	costs gcsproxy.CostBucket) (s *mountStats) {
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	s = &mountStats{
+		clock:   clock,
+		start:   clock.Now(),
+		tempDir: tempDir,
+		files:   files,
+		costs:   costs,
+	}
+
+	return
+}
+
+// Return a multi-line summary of the work done since the mount started.
+func (s *mountStats) Summary() (msg string) {
+	f := s.files.Stats()
+	c := s.costs.Stats()
+
+	// Pick out the requests people usually care about.
+	var total uint64
+	for _, n := range c.ByMethod {
+		total += n
+	}
+
+	reads := c.ByMethod["NewReader"]
+	creates := c.ByMethod["CreateObject"]
+	stats := c.ByMethod["StatObject"]
+	lists := c.ByMethod["ListObjects"]
+	other := total - reads - creates - stats - lists
+
+	lines := []string{
+		fmt.Sprintf(
+			"Mount summary after %v:",
+			s.clock.Now().Sub(s.start)),
+
+		fmt.Sprintf(
+			"  File ops:       %d reads (%d bytes), %d writes (%d bytes)",
+			f.ReadOps,
+			f.BytesRead,
+			f.WriteOps,
+			f.BytesWritten),
+
+		fmt.Sprintf(
+			"  GCS requests:   %d (%d reads, %d creates, %d stats, %d lists, "+
+				"%d other)",
+			total,
+			reads,
+			creates,
+			stats,
+			lists,
+			other),
+
+		fmt.Sprintf(
+			"  GCS transfer:   %d bytes down, %d bytes up",
+			c.BytesRead,
+			c.BytesWritten),
+
+		fmt.Sprintf(
+			"  Lookup retries: %d",
+			f.LookUpRetries),
+
+		fmt.Sprintf(
+			"  Temp dir:       %s (%d of %d files, %d of %d bytes in use, "+
+				"%d evictions causing %d refetches, %d other revocations)",
+			s.tempDir,
+			f.TempFiles,
+			f.TempLimitFiles,
+			f.TempBytes,
+			f.TempLimitBytes,
+			f.TempEvictions,
+			f.TempEvictionMisses,
+			f.TempRevocations),
+	}
+
+	msg = strings.Join(lines, "\n")
+	return
+}
+
+// Log a summary every interval, forever.
+func logMountStats(s *mountStats, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		log.Println(s.Summary())
+	}
+}
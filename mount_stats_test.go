@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MountStatsTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	counters fs.Counters
+	costs    gcsproxy.CostBucket
+	stats    *mountStats
+}
+
+var _ SetUpInterface = &MountStatsTest{}
+
+func init() { RegisterTestSuite(&MountStatsTest{}) }
+
+func (t *MountStatsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	t.costs = gcsproxy.NewCostBucket(
+		nil,
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+
+	t.stats = newMountStats(&t.clock, "/some/dir", &t.counters, t.costs)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MountStatsTest) NothingDone() {
+	t.clock.AdvanceTime(time.Minute)
+
+	expected := strings.Join([]string{
+		"Mount summary after 1m0s:",
+		"  File ops:       0 reads (0 bytes), 0 writes (0 bytes)",
+		"  GCS requests:   0 (0 reads, 0 creates, 0 stats, 0 lists, 0 other)",
+		"  GCS transfer:   0 bytes down, 0 bytes up",
+		"  Lookup retries: 0",
+		"  Temp dir:       /some/dir (0 of 0 files, 0 of 0 bytes in use, " +
+			"0 evictions causing 0 refetches, 0 other revocations)",
+	}, "\n")
+
+	ExpectEq(expected, t.stats.Summary())
+}
+
+func (t *MountStatsTest) GCSRequests() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.costs, "foo", "taco")
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.costs, "foo")
+	AssertEq(nil, err)
+
+	_, err = t.costs.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.costs.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	err = t.costs.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	s := t.stats.Summary()
+	ExpectThat(
+		s,
+		HasSubstr(
+			"GCS requests:   5 (1 reads, 1 creates, 1 stats, 1 lists, 1 other)"))
+
+	ExpectThat(s, HasSubstr("GCS transfer:   4 bytes down, 4 bytes up"))
+}
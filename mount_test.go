@@ -30,6 +30,7 @@ import (
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsfake"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
 	"github.com/jgeewax/cli"
@@ -81,7 +82,8 @@ func (t *MountTest) mount(
 	app := newApp()
 	var flags *flagStorage
 	app.Action = func(appCtx *cli.Context) {
-		flags = populateFlags(appCtx)
+		flags, err = populateFlags(appCtx)
+		AssertEq(nil, err)
 	}
 
 	err = app.Run([]string{"mount_test"})
@@ -89,7 +91,12 @@ func (t *MountTest) mount(
 	AssertNe(nil, flags)
 
 	// Mount.
-	mfs, err = mount(t.ctx, bucketName, mountPoint, flags, t.conn)
+	m, _, err := mount(t.ctx, bucketName, mountPoint, flags, nil, t.conn)
+	if err != nil {
+		return
+	}
+
+	mfs = m.MountedFileSystem
 
 	return
 }
@@ -152,3 +159,31 @@ func (t *MountTest) BasicUsage() {
 	err = mfs.Join(t.ctx)
 	AssertEq(nil, err)
 }
+
+func (t *MountTest) MountTwice() {
+	var err error
+
+	bucket, err := t.conn.OpenBucket(t.ctx, "some_bucket")
+	AssertEq(nil, err)
+
+	// Mount once.
+	mfs, err := t.mount(bucket.Name(), t.dir)
+	AssertEq(nil, err)
+
+	// A second attempt, via a symlink to the mount point, should be refused.
+	link := t.dir + ".link"
+	err = os.Symlink(t.dir, link)
+	AssertEq(nil, err)
+	defer os.Remove(link)
+
+	_, err = t.mount(bucket.Name(), link)
+	ExpectThat(err, Error(HasSubstr("already mounted")))
+	ExpectThat(err, Error(HasSubstr("allow-mount-over")))
+
+	// Unmount and join.
+	err = t.unmount()
+	AssertEq(nil, err)
+
+	err = mfs.Join(t.ctx)
+	AssertEq(nil, err)
+}
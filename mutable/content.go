@@ -16,6 +16,7 @@ package mutable
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"time"
 
@@ -28,6 +29,13 @@ import (
 // which then can be modified by the user and read back. Keeps track of which
 // portion of the content has been dirtied.
 //
+// Writing doesn't fetch the initial contents. The bytes written are held in a
+// sparse overlay alongside the initial view, and reads are served from the
+// overlay where it has been written and from the initial view elsewhere. The
+// two are combined into a single read/write lease holding everything, fetching
+// the initial contents, only when the content is truncated or fetched
+// explicitly.
+//
 // External synchronization is required.
 type Content interface {
 	// Panic if any internal invariants are violated.
@@ -38,7 +46,8 @@ type Content interface {
 	Destroy()
 
 	// If the content has been dirtied from its initial state, return a
-	// read/write lease for the current content. Otherwise return nil.
+	// read/write lease for the current content. Otherwise, or if the content
+	// has only been written to and so isn't held locally in full, return nil.
 	//
 	// If this method returns a non-nil read/write lease, the Content is
 	// implicitly destroyed and must not be used again.
@@ -48,16 +57,61 @@ type Content interface {
 	// from context support.
 	ReadAt(ctx context.Context, buf []byte, offset int64) (n int, err error)
 
+	// Like ReadAt, but guarantees to not block on fetching content. If the read
+	// requires fetching, return a non-nil fault to wait for before trying
+	// again. See lease.ReadProxy.TryReadAt.
+	TryReadAt(buf []byte, offset int64) (n int, f *lease.Fault, err error)
+
 	// Return information about the current state of the content.
 	Stat(ctx context.Context) (sr StatResult, err error)
 
+	// Return the number of bytes of local disk space used to hold the content.
+	// For dirty content this may be far less than its size, if it has been
+	// written sparsely. For clean content it is the same as the size. For
+	// content that has only been written to, only the bytes written count.
+	AllocatedBytes(ctx context.Context) (n int64, err error)
+
+	// Return the ranges of the content that hold data rather than holes, as
+	// for lease.ReadWriteLease.Extents. Clean content has no holes, since GCS
+	// objects don't.
+	Extents(ctx context.Context) (extents []lease.ByteRange, err error)
+
+	// Return the number of bytes of the content that are held locally, and so
+	// could be read without fetching anything. Dirty content is entirely local,
+	// except for the unmodified parts of content that has only been written
+	// to. Doesn't fetch anything.
+	Residency() (resident int64, err error)
+
+	// Return the ranges of the initial contents that are held locally, as for
+	// lease.ReadProxy.ResidentRanges. Dirty content, including content that has
+	// only been written to, reports none, since it no longer matches what it
+	// was created from. Doesn't fetch anything.
+	ResidentRanges() (ranges []lease.ByteRange)
+
 	// Write into the content, with semantics equivalent to io.WriterAt aside from
-	// context support.
+	// context support. This doesn't fetch the initial contents.
 	WriteAt(ctx context.Context, buf []byte, offset int64) (n int, err error)
 
 	// Truncate our the content to the given number of bytes, extending if n is
-	// greater than the current size.
+	// greater than the current size. This fetches the initial contents unless
+	// n is zero.
 	Truncate(ctx context.Context, n int64) (err error)
+
+	// If the content has been written to without fetching the initial
+	// contents, fetch them now and combine them with what was written, so that
+	// the content is held locally in full. Otherwise do nothing.
+	Fetch(ctx context.Context) (err error)
+
+	// Set the modification time of content that has been modified, as with
+	// utimes(2). Content that hasn't been modified has no modification time of
+	// its own, so this has no effect on it.
+	SetMtime(mtime time.Time)
+
+	// Pin or unpin the initial contents held locally, as for
+	// lease.ReadProxy.SetPinned. Dirty content can't be evicted anyway, so this
+	// has no effect once the initial contents have been fetched for
+	// modification.
+	SetPinned(pinned bool)
 }
 
 type StatResult struct {
@@ -66,9 +120,17 @@ type StatResult struct {
 
 	// It is guaranteed that all bytes in the range [0, DirtyThreshold) are
 	// unmodified from the original content with which the mutable content object
-	// was created.
+	// was created. Derived from Size and DirtyRanges.
 	DirtyThreshold int64
 
+	// The ranges of the content that may differ from the original content,
+	// sorted, non-overlapping, and within the current size. Everything beyond
+	// the original size is in one of them. Bytes outside of them are as they
+	// were in the original content, although if the content has been truncated
+	// below its original size then those beyond that point are gone. Nil if
+	// nothing has been modified.
+	DirtyRanges []lease.ByteRange
+
 	// The time at which the content was last updated, or nil if we've never
 	// changed it.
 	Mtime *time.Time
@@ -82,7 +144,8 @@ func NewContent(
 	mc = &mutableContent{
 		clock:          clock,
 		initialContent: initialContent,
-		dirtyThreshold: initialContent.Size(),
+		initialSize:    initialContent.Size(),
+		size:           initialContent.Size(),
 	}
 
 	return
@@ -101,27 +164,47 @@ type mutableContent struct {
 
 	destroyed bool
 
-	// The initial contents with which this object was created, or nil if it has
-	// been dirtied.
+	// The initial contents with which this object was created, or nil if they
+	// have been upgraded to readWriteLease.
 	//
 	// INVARIANT: When non-nil, initialContent.CheckInvariants() does not panic.
 	initialContent lease.ReadProxy
 
-	// When dirty, a read/write lease containing our current contents. When
-	// clean, nil.
+	// When dirty, a read/write lease containing our current contents, or only
+	// the initial contents if overlay is non-nil. When clean, nil.
 	//
 	// INVARIANT: (initialContent == nil) != (readWriteLease == nil)
 	readWriteLease lease.ReadWriteLease
 
-	// The lowest byte index that has been modified from the initial contents.
+	// When we have been written to without fetching the initial contents, a
+	// sparse read/write lease holding what was written at the same offsets.
+	// Only the bytes within dirtyRanges are meaningful. Otherwise nil.
+	//
+	// This may also be non-nil alongside readWriteLease, if copying it there
+	// failed when upgrading; ensureReadWriteLease tries again.
+	overlay lease.ReadWriteLease
+
+	// The size of the initial contents.
+	initialSize int64
+
+	// The size of our contents as far as the calls made to modify them are
+	// concerned.
 	//
-	// INVARIANT: initialContent != nil => dirtyThreshold == initialContent.Size()
-	dirtyThreshold int64
+	// INVARIANT: size >= initialSize || overlay == nil
+	// INVARIANT: initialContent != nil && overlay == nil => size == initialSize
+	size int64
+
+	// The ranges of bytes that WriteAt and Truncate have modified, including
+	// any zeroes they have extended the content with.
+	//
+	// INVARIANT: Sorted, non-overlapping, non-adjacent, and within [0, size)
+	// INVARIANT: initialContent != nil && overlay == nil => len(dirtyRanges) == 0
+	dirtyRanges []lease.ByteRange
 
 	// The time at which a method that modifies our contents was last called, or
 	// nil if never.
 	//
-	// INVARIANT: If dirty(), then mtime != nil
+	// INVARIANT: If dirty() or overlaid(), then mtime != nil
 	mtime *time.Time
 }
 
@@ -148,19 +231,33 @@ func (mc *mutableContent) CheckInvariants() {
 		panic("Both initialContent and readWriteLease are non-nil")
 	}
 
-	// INVARIANT: If dirty(), then mtime != nil
-	if mc.dirty() && mc.mtime == nil {
+	// INVARIANT: If dirty() or overlaid(), then mtime != nil
+	if (mc.dirty() || mc.overlaid()) && mc.mtime == nil {
 		panic("Expected non-nil mtime.")
 	}
 
-	// INVARIANT: initialContent != nil => dirtyThreshold == initialContent.Size()
-	if mc.initialContent != nil {
-		if mc.dirtyThreshold != mc.initialContent.Size() {
-			panic(fmt.Sprintf(
-				"Dirty threshold mismatch: %d vs. %d",
-				mc.dirtyThreshold,
-				mc.initialContent.Size()))
-		}
+	// INVARIANT: size >= initialSize || overlay == nil
+	if mc.overlaid() && mc.size < mc.initialSize {
+		panic(fmt.Sprintf(
+			"Size %d below initial size %d with overlay",
+			mc.size,
+			mc.initialSize))
+	}
+
+	// INVARIANT: initialContent != nil && overlay == nil => size == initialSize
+	if mc.initialContent != nil && !mc.overlaid() && mc.size != mc.initialSize {
+		panic(fmt.Sprintf(
+			"Size mismatch for clean content: %d vs. %d",
+			mc.size,
+			mc.initialSize))
+	}
+
+	// INVARIANT: Sorted, non-overlapping, non-adjacent, and within [0, size)
+	checkRanges(mc.dirtyRanges, mc.size)
+
+	// INVARIANT: initialContent != nil && overlay == nil => len(dirtyRanges) == 0
+	if mc.initialContent != nil && !mc.overlaid() && len(mc.dirtyRanges) != 0 {
+		panic(fmt.Sprintf("Clean content has dirty ranges: %v", mc.dirtyRanges))
 	}
 }
 
@@ -176,17 +273,29 @@ func (mc *mutableContent) Destroy() {
 		mc.readWriteLease.Downgrade().Revoke()
 		mc.readWriteLease = nil
 	}
+
+	if mc.overlay != nil {
+		mc.overlay.Downgrade().Revoke()
+		mc.overlay = nil
+	}
 }
 
 func (mc *mutableContent) Release() (rwl lease.ReadWriteLease) {
-	if !mc.dirty() {
+	switch {
+	// If there were no initial contents, the overlay holds everything.
+	case mc.overlaid() && !mc.dirty() && mc.initialSize == 0:
+		rwl = mc.overlay
+		mc.overlay = nil
+
+	case mc.dirty() && !mc.overlaid():
+		rwl = mc.readWriteLease
+		mc.readWriteLease = nil
+
+	default:
 		return
 	}
 
-	rwl = mc.readWriteLease
-	mc.readWriteLease = nil
 	mc.Destroy()
-
 	return
 }
 
@@ -195,51 +304,149 @@ func (mc *mutableContent) ReadAt(
 	buf []byte,
 	offset int64) (n int, err error) {
 	// Serve from the appropriate place.
-	if mc.dirty() {
+	switch {
+	case mc.overlaid():
+		n, _, err = mc.readOverlaid(ctx, buf, offset, false)
+
+	case mc.dirty():
 		n, err = mc.readWriteLease.ReadAt(buf, offset)
-	} else {
+
+	default:
 		n, err = mc.initialContent.ReadAt(ctx, buf, offset)
 	}
 
 	return
 }
 
+func (mc *mutableContent) TryReadAt(
+	buf []byte,
+	offset int64) (n int, f *lease.Fault, err error) {
+	// Dirty content is entirely local.
+	switch {
+	case mc.overlaid():
+		n, f, err = mc.readOverlaid(nil, buf, offset, true)
+
+	case mc.dirty():
+		n, err = mc.readWriteLease.ReadAt(buf, offset)
+
+	default:
+		n, f, err = mc.initialContent.TryReadAt(buf, offset)
+	}
+
+	return
+}
+
 func (mc *mutableContent) Stat(
 	ctx context.Context) (sr StatResult, err error) {
-	sr.DirtyThreshold = mc.dirtyThreshold
+	sr.DirtyThreshold = mc.dirtyThreshold()
 	sr.Mtime = mc.mtime
 
+	if len(mc.dirtyRanges) != 0 {
+		sr.DirtyRanges = append([]lease.ByteRange(nil), mc.dirtyRanges...)
+	}
+
 	// Get the size from the appropriate place.
-	if mc.dirty() {
+	switch {
+	case mc.overlaid():
+		sr.Size = mc.size
+
+	case mc.dirty():
 		sr.Size, err = mc.readWriteLease.Size()
 		if err != nil {
 			return
 		}
-	} else {
+
+	default:
 		sr.Size = mc.initialContent.Size()
 	}
 
 	return
 }
 
+func (mc *mutableContent) AllocatedBytes(
+	ctx context.Context) (n int64, err error) {
+	if mc.overlaid() {
+		n, err = mc.overlay.AllocatedBytes()
+		return
+	}
+
+	if !mc.dirty() {
+		n = mc.initialContent.Size()
+		return
+	}
+
+	n, err = mc.readWriteLease.AllocatedBytes()
+	return
+}
+
+func (mc *mutableContent) Extents(
+	ctx context.Context) (extents []lease.ByteRange, err error) {
+	if mc.overlaid() {
+		extents, err = mc.overlaidExtents()
+		return
+	}
+
+	if !mc.dirty() {
+		if size := mc.initialContent.Size(); size > 0 {
+			extents = []lease.ByteRange{{Start: 0, Limit: size}}
+		}
+
+		return
+	}
+
+	extents, err = mc.readWriteLease.Extents()
+	return
+}
+
+func (mc *mutableContent) Residency() (resident int64, err error) {
+	if mc.overlaid() {
+		resident = mc.overlaidResidency()
+		return
+	}
+
+	if !mc.dirty() {
+		resident = mc.initialContent.Residency()
+		return
+	}
+
+	resident, err = mc.readWriteLease.Size()
+	return
+}
+
+func (mc *mutableContent) ResidentRanges() (ranges []lease.ByteRange) {
+	if !mc.dirty() && !mc.overlaid() {
+		ranges = mc.initialContent.ResidentRanges()
+	}
+
+	return
+}
+
 func (mc *mutableContent) WriteAt(
 	ctx context.Context,
 	buf []byte,
 	offset int64) (n int, err error) {
+	// Unless the initial contents have already been fetched, write into the
+	// overlay rather than fetching them.
+	if mc.overlaid() || !mc.dirty() {
+		n, err = mc.writeOverlay(buf, offset)
+		return
+	}
+
 	// Make sure we have a read/write lease.
 	if err = mc.ensureReadWriteLease(ctx); err != nil {
-		err = fmt.Errorf("ensureReadWriteLease: %v", err)
+		if !lease.IsNoSpaceError(err) {
+			err = fmt.Errorf("ensureReadWriteLease: %v", err)
+		}
+
 		return
 	}
 
-	// Update our state regarding being dirty.
-	mc.dirtyThreshold = minInt64(mc.dirtyThreshold, offset)
-
 	newMtime := mc.clock.Now()
 	mc.mtime = &newMtime
 
 	// Call through.
 	n, err = mc.readWriteLease.WriteAt(buf, offset)
+	mc.noteWritten(offset, n)
 
 	return
 }
@@ -247,9 +454,24 @@ func (mc *mutableContent) WriteAt(
 func (mc *mutableContent) Truncate(
 	ctx context.Context,
 	n int64) (err error) {
+	// Truncating to nothing doesn't need the initial contents, so don't fetch
+	// them just to throw them away.
+	if n == 0 && mc.initialContent != nil {
+		if err = mc.discardInitialContent(); err != nil {
+			if !lease.IsNoSpaceError(err) {
+				err = fmt.Errorf("discardInitialContent: %v", err)
+			}
+
+			return
+		}
+	}
+
 	// Make sure we have a read/write lease.
 	if err = mc.ensureReadWriteLease(ctx); err != nil {
-		err = fmt.Errorf("ensureReadWriteLease: %v", err)
+		if !lease.IsNoSpaceError(err) {
+			err = fmt.Errorf("ensureReadWriteLease: %v", err)
+		}
+
 		return
 	}
 
@@ -259,8 +481,17 @@ func (mc *mutableContent) Truncate(
 		return
 	}
 
-	// Update our state regarding being dirty.
-	mc.dirtyThreshold = minInt64(mc.dirtyThreshold, n)
+	// Update our state regarding being dirty. We can't tell how much of a
+	// failed truncation took effect, so assume that all of it did: anything
+	// beyond n is gone, and anything it extends into is zeroes.
+	if n < mc.size {
+		mc.dirtyRanges = clipRanges(mc.dirtyRanges, n)
+	} else if n > mc.size {
+		extended := lease.ByteRange{Start: mc.size, Limit: n}
+		mc.dirtyRanges = addRange(mc.dirtyRanges, extended)
+	}
+
+	mc.size = n
 
 	newMtime := mc.clock.Now()
 	mc.mtime = &newMtime
@@ -271,6 +502,36 @@ func (mc *mutableContent) Truncate(
 	return
 }
 
+func (mc *mutableContent) Fetch(ctx context.Context) (err error) {
+	if !mc.overlaid() {
+		return
+	}
+
+	if err = mc.ensureReadWriteLease(ctx); err != nil {
+		if !lease.IsNoSpaceError(err) {
+			err = fmt.Errorf("ensureReadWriteLease: %v", err)
+		}
+
+		return
+	}
+
+	return
+}
+
+func (mc *mutableContent) SetMtime(mtime time.Time) {
+	if mc.mtime == nil {
+		return
+	}
+
+	mc.mtime = &mtime
+}
+
+func (mc *mutableContent) SetPinned(pinned bool) {
+	if mc.initialContent != nil {
+		mc.initialContent.SetPinned(pinned)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
@@ -283,28 +544,309 @@ func minInt64(a int64, b int64) int64 {
 	return b
 }
 
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// Return the lowest byte index that may have been modified from the initial
+// contents, or removed from them by truncation.
+func (mc *mutableContent) dirtyThreshold() (t int64) {
+	t = minInt64(mc.initialSize, mc.size)
+	if len(mc.dirtyRanges) != 0 {
+		t = minInt64(t, mc.dirtyRanges[0].Start)
+	}
+
+	return
+}
+
 func (mc *mutableContent) dirty() bool {
 	return mc.readWriteLease != nil
 }
 
+func (mc *mutableContent) overlaid() bool {
+	return mc.overlay != nil
+}
+
+// Update our state regarding being dirty after n bytes were written at the
+// given offset. As for io.WriterAt, exactly the bytes reported as written have
+// been, even on error. Writing beyond the end fills the gap with zeroes, so
+// that is dirty too.
+func (mc *mutableContent) noteWritten(offset int64, n int) {
+	if n > 0 {
+		written := lease.ByteRange{Start: offset, Limit: offset + int64(n)}
+		written.Start = minInt64(written.Start, mc.size)
+		mc.dirtyRanges = addRange(mc.dirtyRanges, written)
+		mc.size = maxInt64(mc.size, written.Limit)
+	}
+}
+
+// Write into the overlay, creating it if necessary.
+//
+// REQUIRES: mc.overlaid() || !mc.dirty()
+func (mc *mutableContent) writeOverlay(
+	buf []byte,
+	offset int64) (n int, err error) {
+	if mc.overlay == nil {
+		var rwl lease.ReadWriteLease
+		rwl, err = mc.initialContent.NewOverlay()
+		if err != nil {
+			if !lease.IsNoSpaceError(err) {
+				err = fmt.Errorf("initialContent.NewOverlay: %v", err)
+			}
+
+			return
+		}
+
+		mc.overlay = rwl
+	}
+
+	newMtime := mc.clock.Now()
+	mc.mtime = &newMtime
+
+	n, err = mc.overlay.WriteAt(buf, offset)
+	mc.noteWritten(offset, n)
+
+	return
+}
+
+// Read from content that has been written to without fetching the initial
+// contents, taking dirty bytes from the overlay and the rest from the initial
+// contents (or readWriteLease, if they have been fetched). If try is set,
+// don't fetch anything, with the semantics of lease.ReadProxy.TryReadAt.
+//
+// REQUIRES: mc.overlaid()
+func (mc *mutableContent) readOverlaid(
+	ctx context.Context,
+	buf []byte,
+	offset int64,
+	try bool) (n int, f *lease.Fault, err error) {
+	// Don't read past the end.
+	if offset >= mc.size {
+		err = io.EOF
+		return
+	}
+
+	short := int64(len(buf)) > mc.size-offset
+	if short {
+		buf = buf[:mc.size-offset]
+	}
+
+	// Read one piece at a time, each either entirely dirty or entirely clean.
+	// Everything beyond the initial size is dirty.
+	for n < len(buf) {
+		off := offset + int64(n)
+		p := buf[n:]
+
+		// Find the first dirty range that ends after off.
+		i := 0
+		for i < len(mc.dirtyRanges) && mc.dirtyRanges[i].Limit <= off {
+			i++
+		}
+
+		var m int
+		if i < len(mc.dirtyRanges) && mc.dirtyRanges[i].Start <= off {
+			if limit := mc.dirtyRanges[i].Limit - off; int64(len(p)) > limit {
+				p = p[:limit]
+			}
+
+			m, err = mc.overlay.ReadAt(p, off)
+		} else {
+			limit := mc.initialSize - off
+			if i < len(mc.dirtyRanges) {
+				limit = minInt64(limit, mc.dirtyRanges[i].Start-off)
+			}
+
+			if int64(len(p)) > limit {
+				p = p[:limit]
+			}
+
+			switch {
+			case mc.dirty():
+				m, err = mc.readWriteLease.ReadAt(p, off)
+
+			case try:
+				m, f, err = mc.initialContent.TryReadAt(p, off)
+				if f != nil {
+					n = 0
+					return
+				}
+
+			default:
+				m, err = mc.initialContent.ReadAt(ctx, p, off)
+			}
+		}
+
+		n += m
+
+		// Reaching the end of one piece isn't the end of ours.
+		if err == io.EOF && m == len(p) {
+			err = nil
+		}
+
+		if err != nil {
+			return
+		}
+
+		if m < len(p) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+	}
+
+	if short {
+		err = io.EOF
+	}
+
+	return
+}
+
+// Return the extents of content with an overlay: the initial contents
+// combined with those of the overlay.
+//
+// REQUIRES: mc.overlaid()
+func (mc *mutableContent) overlaidExtents() (
+	extents []lease.ByteRange,
+	err error) {
+	// Find the extents of the initial contents.
+	if mc.dirty() {
+		extents, err = mc.readWriteLease.Extents()
+		if err != nil {
+			return
+		}
+	} else if mc.initialSize > 0 {
+		extents = []lease.ByteRange{{Start: 0, Limit: mc.initialSize}}
+	}
+
+	// Add those of the overlay.
+	written, err := mc.overlay.Extents()
+	if err != nil {
+		return
+	}
+
+	for _, r := range written {
+		extents = addRange(extents, r)
+	}
+
+	return
+}
+
+// Return the number of bytes of content with an overlay that are held
+// locally: those that are dirty, along with any of the initial contents that
+// are resident.
+//
+// REQUIRES: mc.overlaid()
+func (mc *mutableContent) overlaidResidency() (resident int64) {
+	local := append([]lease.ByteRange(nil), mc.dirtyRanges...)
+
+	var initial []lease.ByteRange
+	if mc.dirty() {
+		initial = []lease.ByteRange{{Start: 0, Limit: mc.initialSize}}
+	} else {
+		initial = mc.initialContent.ResidentRanges()
+	}
+
+	for _, r := range initial {
+		if r.Start < r.Limit {
+			local = addRange(local, r)
+		}
+	}
+
+	for _, r := range local {
+		resident += r.Limit - r.Start
+	}
+
+	return
+}
+
 // Ensure that mc.readWriteLease is non-nil with an authoritative view of mc's
 // contents.
 func (mc *mutableContent) ensureReadWriteLease(
 	ctx context.Context) (err error) {
-	// Is there anything to do?
-	if mc.readWriteLease != nil {
-		return
+	// Set up the read/write lease, if necessary.
+	if mc.readWriteLease == nil {
+		var rwl lease.ReadWriteLease
+		rwl, err = mc.initialContent.Upgrade(ctx)
+		if err != nil {
+			if !lease.IsNoSpaceError(err) {
+				err = fmt.Errorf("initialContent.Upgrade: %v", err)
+			}
+
+			return
+		}
+
+		mc.readWriteLease = rwl
+		mc.initialContent = nil
 	}
 
-	// Set up the read/write lease.
-	rwl, err := mc.initialContent.Upgrade(ctx)
+	// Move anything we've written to the overlay into it. If this fails,
+	// leave things as they are so that we can try again next time.
+	if mc.overlay != nil {
+		err = mc.mergeOverlay()
+		if err != nil {
+			err = fmt.Errorf("mergeOverlay: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Replace the initial contents with an empty read/write lease, without
+// fetching them, along with anything written over them. The caller must then
+// truncate to zero to make our state consistent.
+//
+// REQUIRES: mc.initialContent != nil
+func (mc *mutableContent) discardInitialContent() (err error) {
+	rwl, err := mc.initialContent.NewOverlay()
 	if err != nil {
-		err = fmt.Errorf("initialContent.Upgrade: %v", err)
+		if !lease.IsNoSpaceError(err) {
+			err = fmt.Errorf("NewOverlay: %v", err)
+		}
+
 		return
 	}
 
-	mc.readWriteLease = rwl
+	mc.initialContent.Destroy()
 	mc.initialContent = nil
+	mc.readWriteLease = rwl
+
+	if mc.overlay != nil {
+		mc.overlay.Downgrade().Revoke()
+		mc.overlay = nil
+	}
+
+	return
+}
+
+// Copy the dirty ranges of the overlay into mc.readWriteLease, which holds
+// the initial contents, then get rid of it.
+//
+// REQUIRES: mc.dirty()
+// REQUIRES: mc.overlaid()
+func (mc *mutableContent) mergeOverlay() (err error) {
+	for _, r := range mc.dirtyRanges {
+		_, err = mc.readWriteLease.Seek(r.Start, 0)
+		if err != nil {
+			err = fmt.Errorf("Seek: %v", err)
+			return
+		}
+
+		_, err = io.Copy(
+			mc.readWriteLease,
+			io.NewSectionReader(mc.overlay, r.Start, r.Limit-r.Start))
+
+		if err != nil {
+			err = fmt.Errorf("Copy: %v", err)
+			return
+		}
+	}
+
+	mc.overlay.Downgrade().Revoke()
+	mc.overlay = nil
 
 	return
 }
@@ -61,6 +61,19 @@ func bufferIs(buf []byte) Matcher {
 		fmt.Sprintf("Buffer matches"))
 }
 
+func bufferLenIs(n int) Matcher {
+	return NewMatcher(
+		func(candidate interface{}) error {
+			p := candidate.([]byte)
+			if len(p) != n {
+				return fmt.Errorf("which has length %d", len(p))
+			}
+
+			return nil
+		},
+		fmt.Sprintf("buffer of length %d", n))
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Invariant-checking mutable content
 ////////////////////////////////////////////////////////////////////////
@@ -78,6 +91,24 @@ func (mc *checkingContent) Stat() (mutable.StatResult, error) {
 	return mc.wrapped.Stat(mc.ctx)
 }
 
+func (mc *checkingContent) AllocatedBytes() (int64, error) {
+	mc.wrapped.CheckInvariants()
+	defer mc.wrapped.CheckInvariants()
+	return mc.wrapped.AllocatedBytes(mc.ctx)
+}
+
+func (mc *checkingContent) Extents() ([]lease.ByteRange, error) {
+	mc.wrapped.CheckInvariants()
+	defer mc.wrapped.CheckInvariants()
+	return mc.wrapped.Extents(mc.ctx)
+}
+
+func (mc *checkingContent) Residency() (int64, error) {
+	mc.wrapped.CheckInvariants()
+	defer mc.wrapped.CheckInvariants()
+	return mc.wrapped.Residency()
+}
+
 func (mc *checkingContent) ReadAt(b []byte, o int64) (int, error) {
 	mc.wrapped.CheckInvariants()
 	defer mc.wrapped.CheckInvariants()
@@ -96,6 +127,12 @@ func (mc *checkingContent) Truncate(n int64) error {
 	return mc.wrapped.Truncate(mc.ctx, n)
 }
 
+func (mc *checkingContent) SetMtime(mtime time.Time) {
+	mc.wrapped.CheckInvariants()
+	defer mc.wrapped.CheckInvariants()
+	mc.wrapped.SetMtime(mtime)
+}
+
 func (mc *checkingContent) Destroy() {
 	mc.wrapped.CheckInvariants()
 	mc.wrapped.Destroy()
@@ -208,35 +245,111 @@ func (t *CleanTest) Stat() {
 	ExpectEq(nil, sr.Mtime)
 }
 
-func (t *CleanTest) WriteAt_UpgradeFails() {
-	// Upgrade
-	ExpectCall(t.initialContent, "Upgrade")(Any()).
+func (t *CleanTest) AllocatedBytes() {
+	n, err := t.mc.AllocatedBytes()
+
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize, n)
+}
+
+func (t *CleanTest) Extents() {
+	extents, err := t.mc.Extents()
+
+	AssertEq(nil, err)
+	ExpectThat(
+		extents,
+		ElementsAre(DeepEquals(lease.ByteRange{Start: 0, Limit: initialContentSize})))
+}
+
+func (t *CleanTest) Residency() {
+	// Initial content
+	ExpectCall(t.initialContent, "Residency")().
+		WillOnce(Return(7))
+
+	// Call
+	resident, err := t.mc.Residency()
+
+	AssertEq(nil, err)
+	ExpectEq(7, resident)
+}
+
+func (t *CleanTest) WriteAt_NewOverlayFails() {
+	// NewOverlay
+	ExpectCall(t.initialContent, "NewOverlay")().
 		WillOnce(Return(nil, errors.New("taco")))
 
 	// Call
 	_, err := t.mc.WriteAt(make([]byte, 1), 0)
 
-	ExpectThat(err, Error(HasSubstr("Upgrade")))
+	ExpectThat(err, Error(HasSubstr("NewOverlay")))
 	ExpectThat(err, Error(HasSubstr("taco")))
 }
 
-func (t *CleanTest) WriteAt_UpgradeSucceeds() {
-	// Upgrade -- succeed.
-	ExpectCall(t.initialContent, "Upgrade")(Any()).
+func (t *CleanTest) WriteAt_DoesntUpgrade() {
+	// NewOverlay -- succeed. The overlay should be written at the same
+	// offsets, and nothing should be upgraded.
+	ExpectCall(t.initialContent, "NewOverlay")().
 		WillOnce(Return(t.rwl, nil))
 
-	// The read/write lease should be called.
-	ExpectCall(t.rwl, "WriteAt")(Any(), 17).
-		WillOnce(Return(0, errors.New("")))
+	ExpectCall(t.rwl, "WriteAt")(Any(), 7).
+		WillOnce(Return(1, nil))
 
 	// Call.
-	t.mc.WriteAt(make([]byte, 1), 17)
+	_, err := t.mc.WriteAt(make([]byte, 1), 7)
+	AssertEq(nil, err)
 
-	// A further call should go right through to the read/write lease again.
+	// Further calls, including ones past the end, should go to the same
+	// overlay.
 	ExpectCall(t.rwl, "WriteAt")(Any(), 19).
-		WillOnce(Return(0, errors.New("")))
+		WillOnce(Return(1, nil))
 
-	t.mc.WriteAt(make([]byte, 1), 19)
+	_, err = t.mc.WriteAt(make([]byte, 1), 19)
+	AssertEq(nil, err)
+
+	// Stat should report the new size, with the bytes written and those
+	// extended into dirty.
+	sr, err := t.mc.Stat()
+	AssertEq(nil, err)
+
+	ExpectEq(20, sr.Size)
+	ExpectEq(7, sr.DirtyThreshold)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: 7, Limit: 8},
+			{Start: initialContentSize, Limit: 20},
+		}))
+
+	// The content isn't held locally in full, so there is nothing to release.
+	ExpectEq(nil, t.mc.Release())
+}
+
+func (t *CleanTest) ReadAt_Overlaid() {
+	// Write a byte into the overlay.
+	ExpectCall(t.initialContent, "NewOverlay")().
+		WillOnce(Return(t.rwl, nil))
+
+	ExpectCall(t.rwl, "WriteAt")(Any(), 3).
+		WillOnce(Return(1, nil))
+
+	_, err := t.mc.WriteAt([]byte("x"), 3)
+	AssertEq(nil, err)
+
+	// Reading across it should take the byte written from the overlay and the
+	// rest from the initial contents.
+	ExpectCall(t.initialContent, "ReadAt")(Any(), bufferLenIs(1), 2).
+		WillOnce(Return(1, nil))
+
+	ExpectCall(t.rwl, "ReadAt")(bufferLenIs(1), 3).
+		WillOnce(Return(1, nil))
+
+	ExpectCall(t.initialContent, "ReadAt")(Any(), bufferLenIs(2), 4).
+		WillOnce(Return(2, nil))
+
+	n, err := t.mc.ReadAt(make([]byte, 4), 2)
+
+	AssertEq(nil, err)
+	ExpectEq(4, n)
 }
 
 func (t *CleanTest) Truncate_UpgradeFails() {
@@ -245,7 +358,7 @@ func (t *CleanTest) Truncate_UpgradeFails() {
 		WillOnce(Return(nil, errors.New("taco")))
 
 	// Call
-	err := t.mc.Truncate(0)
+	err := t.mc.Truncate(1)
 
 	ExpectThat(err, Error(HasSubstr("Upgrade")))
 	ExpectThat(err, Error(HasSubstr("taco")))
@@ -270,11 +383,67 @@ func (t *CleanTest) Truncate_UpgradeSucceeds() {
 	t.mc.Truncate(19)
 }
 
+func (t *CleanTest) Truncate_Zero_NewOverlayFails() {
+	// NewOverlay
+	ExpectCall(t.initialContent, "NewOverlay")().
+		WillOnce(Return(nil, errors.New("taco")))
+
+	// Call
+	err := t.mc.Truncate(0)
+
+	ExpectThat(err, Error(HasSubstr("NewOverlay")))
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *CleanTest) Truncate_Zero_DoesntUpgrade() {
+	// The initial contents should be replaced by a fresh lease without being
+	// fetched.
+	ExpectCall(t.initialContent, "NewOverlay")().
+		WillOnce(Return(t.rwl, nil))
+
+	ExpectCall(t.initialContent, "Destroy")()
+
+	ExpectCall(t.rwl, "Truncate")(0).
+		WillOnce(Return(nil))
+
+	// Call.
+	err := t.mc.Truncate(0)
+	AssertEq(nil, err)
+
+	// Stat should show the whole thing dirty.
+	ExpectCall(t.rwl, "Size")().
+		WillOnce(Return(0, nil))
+
+	sr, err := t.mc.Stat()
+	AssertEq(nil, err)
+
+	ExpectEq(0, sr.Size)
+	ExpectEq(0, sr.DirtyThreshold)
+	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(t.clock.Now())))
+
+	// Further writes should go right through to the new lease.
+	ExpectCall(t.rwl, "WriteAt")(Any(), 0).
+		WillOnce(Return(1, nil))
+
+	_, err = t.mc.WriteAt(make([]byte, 1), 0)
+	AssertEq(nil, err)
+}
+
 func (t *CleanTest) Release() {
 	rwl := t.mc.Release()
 	ExpectEq(nil, rwl)
 }
 
+func (t *CleanTest) SetMtime() {
+	t.mc.SetMtime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	// Clean content has no modification time of its own.
+	sr, err := t.mc.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(nil, sr.Mtime)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Dirty state
 ////////////////////////////////////////////////////////////////////////
@@ -341,6 +510,47 @@ func (t *DirtyTest) ReadAt_LeaseSuceeds() {
 	ExpectEq(nil, err)
 }
 
+func (t *DirtyTest) AllocatedBytes() {
+	// Lease
+	ExpectCall(t.rwl, "AllocatedBytes")().
+		WillOnce(Return(4096, nil))
+
+	// Call
+	n, err := t.mc.AllocatedBytes()
+
+	AssertEq(nil, err)
+	ExpectEq(4096, n)
+}
+
+func (t *DirtyTest) Extents() {
+	expected := []lease.ByteRange{
+		{Start: 0, Limit: 4},
+		{Start: 4096, Limit: 4100},
+	}
+
+	// Lease
+	ExpectCall(t.rwl, "Extents")().
+		WillOnce(Return(expected, nil))
+
+	// Call
+	extents, err := t.mc.Extents()
+
+	AssertEq(nil, err)
+	ExpectThat(extents, DeepEquals(expected))
+}
+
+func (t *DirtyTest) Residency() {
+	// Lease
+	ExpectCall(t.rwl, "Size")().
+		WillOnce(Return(17, nil))
+
+	// Call
+	resident, err := t.mc.Residency()
+
+	AssertEq(nil, err)
+	ExpectEq(17, resident)
+}
+
 func (t *DirtyTest) Stat_LeaseFails() {
 	// Lease
 	ExpectCall(t.rwl, "Size")().
@@ -428,16 +638,16 @@ func (t *DirtyTest) WriteAt_DirtyThreshold() {
 	var sr mutable.StatResult
 	var err error
 
-	// Simulate successful writes and size requests.
+	// Simulate successful one-byte writes and size requests.
 	ExpectCall(t.rwl, "WriteAt")(Any(), Any()).
-		WillRepeatedly(Return(0, nil))
+		WillRepeatedly(Return(1, nil))
 
 	ExpectCall(t.rwl, "Size")().
 		WillRepeatedly(Return(100, nil))
 
 	// Writing at the end of the initial content should not affect the dirty
 	// threshold.
-	_, err = t.mc.WriteAt([]byte{}, initialContentSize)
+	_, err = t.mc.WriteAt([]byte("a"), initialContentSize)
 	AssertEq(nil, err)
 
 	sr, err = t.mc.Stat()
@@ -445,7 +655,7 @@ func (t *DirtyTest) WriteAt_DirtyThreshold() {
 	ExpectEq(initialContentSize, sr.DirtyThreshold)
 
 	// Nor should writing past the end.
-	_, err = t.mc.WriteAt([]byte{}, initialContentSize+100)
+	_, err = t.mc.WriteAt([]byte("a"), initialContentSize+100)
 	AssertEq(nil, err)
 
 	sr, err = t.mc.Stat()
@@ -453,7 +663,7 @@ func (t *DirtyTest) WriteAt_DirtyThreshold() {
 	ExpectEq(initialContentSize, sr.DirtyThreshold)
 
 	// But writing before the end should.
-	_, err = t.mc.WriteAt([]byte{}, initialContentSize-1)
+	_, err = t.mc.WriteAt([]byte("a"), initialContentSize-1)
 	AssertEq(nil, err)
 
 	sr, err = t.mc.Stat()
@@ -461,6 +671,111 @@ func (t *DirtyTest) WriteAt_DirtyThreshold() {
 	ExpectEq(initialContentSize-1, sr.DirtyThreshold)
 }
 
+func (t *DirtyTest) WriteAt_DirtyRanges() {
+	var sr mutable.StatResult
+	var err error
+
+	// Simulate writes that write everything, and size requests.
+	ExpectCall(t.rwl, "WriteAt")(Any(), Any()).
+		WillRepeatedly(Invoke(func(p []byte, off int64) (int, error) {
+			return len(p), nil
+		}))
+
+	ExpectCall(t.rwl, "Size")().
+		WillRepeatedly(Return(100, nil))
+
+	// Truncating to the same size in SetUp dirtied nothing.
+	sr, err = t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectEq(nil, sr.DirtyRanges)
+
+	// Append to the content. Only what was appended is dirty.
+	_, err = t.mc.WriteAt([]byte("taco"), initialContentSize)
+	AssertEq(nil, err)
+
+	sr, err = t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: initialContentSize, Limit: initialContentSize + 4},
+		}))
+
+	// Disjoint writes are kept apart, and sorted.
+	_, err = t.mc.WriteAt([]byte("b"), 1)
+	AssertEq(nil, err)
+
+	sr, err = t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectEq(1, sr.DirtyThreshold)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: 1, Limit: 2},
+			{Start: initialContentSize, Limit: initialContentSize + 4},
+		}))
+
+	// Writes that touch existing ranges merge with them.
+	_, err = t.mc.WriteAt([]byte("burrito"), 2)
+	AssertEq(nil, err)
+
+	_, err = t.mc.WriteAt([]byte("enchilada"), initialContentSize-1)
+	AssertEq(nil, err)
+
+	sr, err = t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: 1, Limit: 9},
+			{Start: initialContentSize - 1, Limit: initialContentSize + 8},
+		}))
+}
+
+func (t *DirtyTest) WriteAt_PastEnd() {
+	// Lease
+	ExpectCall(t.rwl, "WriteAt")(Any(), Any()).
+		WillOnce(Return(1, nil))
+
+	ExpectCall(t.rwl, "Size")().
+		WillRepeatedly(Return(initialContentSize+11, nil))
+
+	// The gap between the old end and the write is dirty too.
+	_, err := t.mc.WriteAt([]byte("a"), initialContentSize+10)
+	AssertEq(nil, err)
+
+	sr, err := t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: initialContentSize, Limit: initialContentSize + 11},
+		}))
+}
+
+func (t *DirtyTest) WriteAt_PartialWrite() {
+	// Lease
+	ExpectCall(t.rwl, "WriteAt")(Any(), Any()).
+		WillOnce(Return(2, errors.New("taco")))
+
+	ExpectCall(t.rwl, "Size")().
+		WillRepeatedly(Return(initialContentSize+2, nil))
+
+	// Only the bytes that were written are dirty.
+	_, err := t.mc.WriteAt([]byte("burrito"), initialContentSize)
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	sr, err := t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: initialContentSize, Limit: initialContentSize + 2},
+		}))
+}
+
 func (t *DirtyTest) Truncate_CallsLease() {
 	// Lease
 	ExpectCall(t.rwl, "Truncate")(17).
@@ -544,7 +859,80 @@ func (t *DirtyTest) Truncate_DirtyThreshold() {
 	ExpectEq(initialContentSize-1, sr.DirtyThreshold)
 }
 
+func (t *DirtyTest) Truncate_DirtyRanges() {
+	var sr mutable.StatResult
+	var err error
+
+	// Simulate successful writes, truncations, and size requests.
+	ExpectCall(t.rwl, "WriteAt")(Any(), Any()).
+		WillRepeatedly(Invoke(func(p []byte, off int64) (int, error) {
+			return len(p), nil
+		}))
+
+	ExpectCall(t.rwl, "Truncate")(Any()).
+		WillRepeatedly(Return(nil))
+
+	ExpectCall(t.rwl, "Size")().
+		WillRepeatedly(Return(100, nil))
+
+	// Extending the content dirties what it's extended by.
+	_, err = t.mc.WriteAt([]byte("a"), 0)
+	AssertEq(nil, err)
+
+	err = t.mc.Truncate(initialContentSize + 10)
+	AssertEq(nil, err)
+
+	sr, err = t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: 0, Limit: 1},
+			{Start: initialContentSize, Limit: initialContentSize + 10},
+		}))
+
+	// Shrinking the content drops what's beyond the new end.
+	err = t.mc.Truncate(initialContentSize - 1)
+	AssertEq(nil, err)
+
+	sr, err = t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectEq(0, sr.DirtyThreshold)
+	ExpectThat(sr.DirtyRanges, DeepEquals([]lease.ByteRange{
+		{Start: 0, Limit: 1},
+	}))
+
+	// Extending it again dirties everything after that end, even within the
+	// initial size.
+	err = t.mc.Truncate(initialContentSize)
+	AssertEq(nil, err)
+
+	sr, err = t.mc.Stat()
+	AssertEq(nil, err)
+	ExpectThat(
+		sr.DirtyRanges,
+		DeepEquals([]lease.ByteRange{
+			{Start: 0, Limit: 1},
+			{Start: initialContentSize - 1, Limit: initialContentSize},
+		}))
+}
+
 func (t *DirtyTest) Release() {
 	rwl := t.mc.Release()
 	ExpectEq(t.rwl, rwl)
 }
+
+func (t *DirtyTest) SetMtime() {
+	mtime := time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local)
+	t.mc.SetMtime(mtime)
+
+	// Lease
+	ExpectCall(t.rwl, "Size")().
+		WillOnce(Return(17, nil))
+
+	// Stat
+	sr, err := t.mc.Stat()
+
+	AssertEq(nil, err)
+	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(mtime)))
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mutable
+
+import (
+	"fmt"
+
+	"github.com/googlecloudplatform/gcsfuse/lease"
+)
+
+// Add the non-empty range r to a list of sorted, non-overlapping,
+// non-adjacent ranges, merging it with any that it overlaps or abuts. The
+// result is a list of the same form; the input may be modified.
+func addRange(
+	ranges []lease.ByteRange,
+	r lease.ByteRange) (result []lease.ByteRange) {
+	// Find the first range that ends at or after r's start, and the first that
+	// starts after r's end. Those in between touch r and merge with it.
+	i := 0
+	for i < len(ranges) && ranges[i].Limit < r.Start {
+		i++
+	}
+
+	j := i
+	for j < len(ranges) && ranges[j].Start <= r.Limit {
+		r.Start = minInt64(r.Start, ranges[j].Start)
+		r.Limit = maxInt64(r.Limit, ranges[j].Limit)
+		j++
+	}
+
+	result = append(result, ranges[:i]...)
+	result = append(result, r)
+	result = append(result, ranges[j:]...)
+
+	return
+}
+
+// Remove everything at or beyond limit from a list of sorted, non-overlapping
+// ranges. The input may be modified.
+func clipRanges(
+	ranges []lease.ByteRange,
+	limit int64) (result []lease.ByteRange) {
+	result = ranges
+	for len(result) > 0 && result[len(result)-1].Start >= limit {
+		result = result[:len(result)-1]
+	}
+
+	if n := len(result); n > 0 && result[n-1].Limit > limit {
+		result[n-1].Limit = limit
+	}
+
+	return
+}
+
+// Panic unless the supplied ranges are non-empty, sorted, non-overlapping,
+// non-adjacent, and within [0, size).
+func checkRanges(ranges []lease.ByteRange, size int64) {
+	var prevLimit int64 = -1
+	for i, r := range ranges {
+		if r.Start >= r.Limit {
+			panic(fmt.Sprintf("Empty range %d: %v", i, r))
+		}
+
+		if r.Start <= prevLimit {
+			panic(fmt.Sprintf("Range %d (%v) not after its predecessor", i, r))
+		}
+
+		if r.Start < 0 || r.Limit > size {
+			panic(fmt.Sprintf("Range %d (%v) not within size %d", i, r, size))
+		}
+
+		prevLimit = r.Limit
+	}
+}
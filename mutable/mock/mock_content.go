@@ -13,6 +13,7 @@ import (
 	oglemock "github.com/jacobsa/oglemock"
 	context "golang.org/x/net/context"
 	runtime "runtime"
+	time "time"
 	unsafe "unsafe"
 )
 
@@ -43,6 +44,35 @@ func (m *mockContent) Oglemock_Description() string {
 	return m.description
 }
 
+func (m *mockContent) AllocatedBytes(p0 context.Context) (o0 int64, o1 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"AllocatedBytes",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockContent.AllocatedBytes: invalid return values: %v", retVals))
+	}
+
+	// o0 int64
+	if retVals[0] != nil {
+		o0 = retVals[0].(int64)
+	}
+
+	// o1 error
+	if retVals[1] != nil {
+		o1 = retVals[1].(error)
+	}
+
+	return
+}
+
 func (m *mockContent) CheckInvariants() {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -81,6 +111,59 @@ func (m *mockContent) Destroy() {
 	return
 }
 
+func (m *mockContent) Extents(p0 context.Context) (o0 []lease.ByteRange, o1 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Extents",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockContent.Extents: invalid return values: %v", retVals))
+	}
+
+	// o0 []lease.ByteRange
+	if retVals[0] != nil {
+		o0 = retVals[0].([]lease.ByteRange)
+	}
+
+	// o1 error
+	if retVals[1] != nil {
+		o1 = retVals[1].(error)
+	}
+
+	return
+}
+
+func (m *mockContent) Fetch(p0 context.Context) (o0 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Fetch",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockContent.Fetch: invalid return values: %v", retVals))
+	}
+
+	// o0 error
+	if retVals[0] != nil {
+		o0 = retVals[0].(error)
+	}
+
+	return
+}
+
 func (m *mockContent) ReadAt(p0 context.Context, p1 []uint8, p2 int64) (o0 int, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -134,6 +217,97 @@ func (m *mockContent) Release() (o0 lease.ReadWriteLease) {
 	return
 }
 
+func (m *mockContent) Residency() (o0 int64, o1 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"Residency",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 2 {
+		panic(fmt.Sprintf("mockContent.Residency: invalid return values: %v", retVals))
+	}
+
+	// o0 int64
+	if retVals[0] != nil {
+		o0 = retVals[0].(int64)
+	}
+
+	// o1 error
+	if retVals[1] != nil {
+		o1 = retVals[1].(error)
+	}
+
+	return
+}
+
+func (m *mockContent) ResidentRanges() (o0 []lease.ByteRange) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"ResidentRanges",
+		file,
+		line,
+		[]interface{}{})
+
+	if len(retVals) != 1 {
+		panic(fmt.Sprintf("mockContent.ResidentRanges: invalid return values: %v", retVals))
+	}
+
+	// o0 []lease.ByteRange
+	if retVals[0] != nil {
+		o0 = retVals[0].([]lease.ByteRange)
+	}
+
+	return
+}
+
+func (m *mockContent) SetMtime(p0 time.Time) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"SetMtime",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 0 {
+		panic(fmt.Sprintf("mockContent.SetMtime: invalid return values: %v", retVals))
+	}
+
+	return
+}
+
+func (m *mockContent) SetPinned(p0 bool) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"SetPinned",
+		file,
+		line,
+		[]interface{}{p0})
+
+	if len(retVals) != 0 {
+		panic(fmt.Sprintf("mockContent.SetPinned: invalid return values: %v", retVals))
+	}
+
+	return
+}
+
 func (m *mockContent) Stat(p0 context.Context) (o0 mutable.StatResult, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -187,6 +361,40 @@ func (m *mockContent) Truncate(p0 context.Context, p1 int64) (o0 error) {
 	return
 }
 
+func (m *mockContent) TryReadAt(p0 []uint8, p1 int64) (o0 int, o1 *lease.Fault, o2 error) {
+	// Get a file name and line number for the caller.
+	_, file, line, _ := runtime.Caller(1)
+
+	// Hand the call off to the controller, which does most of the work.
+	retVals := m.controller.HandleMethodCall(
+		m,
+		"TryReadAt",
+		file,
+		line,
+		[]interface{}{p0, p1})
+
+	if len(retVals) != 3 {
+		panic(fmt.Sprintf("mockContent.TryReadAt: invalid return values: %v", retVals))
+	}
+
+	// o0 int
+	if retVals[0] != nil {
+		o0 = retVals[0].(int)
+	}
+
+	// o1 *lease.Fault
+	if retVals[1] != nil {
+		o1 = retVals[1].(*lease.Fault)
+	}
+
+	// o2 error
+	if retVals[2] != nil {
+		o2 = retVals[2].(error)
+	}
+
+	return
+}
+
 func (m *mockContent) WriteAt(p0 context.Context, p1 []uint8, p2 int64) (o0 int, o1 error) {
 	// Get a file name and line number for the caller.
 	_, file, line, _ := runtime.Caller(1)
@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/timeutil"
+)
+
+// Writes the profiles requested by --debug_cpu_profile and --debug_mem_profile
+// when gcsfuse receives SIGHUP.
+type profileDumper struct {
+	clock    timeutil.Clock
+	cpu      bool
+	mem      bool
+	duration time.Duration
+
+	// If empty, the CPU and memory profiles are written to fixed names in /tmp,
+	// overwriting those of earlier dumps. Otherwise they are written here with
+	// timestamped names, along with goroutine and block profiles.
+	dir string
+}
+
+// Return the path to which the named profile should be written for a dump
+// that started at the given time.
+func (d *profileDumper) path(name string, t time.Time) string {
+	if d.dir == "" {
+		return fmt.Sprintf("/tmp/%s.pprof", name)
+	}
+
+	return path.Join(
+		d.dir,
+		fmt.Sprintf("%s-%s.pprof", name, t.Format("20060102-150405")))
+}
+
+// Write the named runtime profile to p.
+func writeProfile(name string, p string) (err error) {
+	f, err := os.Create(p)
+	if err != nil {
+		err = fmt.Errorf("Create: %v", err)
+		return
+	}
+
+	err = pprof.Lookup(name).WriteTo(f, 0)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("WriteTo: %v", err)
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		err = fmt.Errorf("Close: %v", err)
+		return
+	}
+
+	return
+}
+
+// Profile for the configured duration, then write the profiles. A failure to
+// write one profile doesn't stop the others being written. Return the paths
+// written, and an error for each profile that wasn't.
+func (d *profileDumper) Dump() (written []string, errs []error) {
+	start := d.clock.Now()
+	record := func(desc string, p string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s profile %s: %v", desc, p, err))
+			return
+		}
+
+		written = append(written, p)
+	}
+
+	// Start CPU profiling.
+	var cpuFile *os.File
+	cpuPath := d.path("cpu", start)
+	if d.cpu {
+		var err error
+		cpuFile, err = os.Create(cpuPath)
+		if err != nil {
+			record("CPU", cpuPath, fmt.Errorf("Create: %v", err))
+		} else if err = pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			cpuFile = nil
+			record("CPU", cpuPath, fmt.Errorf("StartCPUProfile: %v", err))
+		}
+	}
+
+	// Record blocking events only while we're profiling, since it isn't free.
+	if d.dir != "" {
+		runtime.SetBlockProfileRate(1)
+		defer runtime.SetBlockProfileRate(0)
+	}
+
+	time.Sleep(d.duration)
+
+	if cpuFile != nil {
+		pprof.StopCPUProfile()
+		err := cpuFile.Close()
+		if err != nil {
+			err = fmt.Errorf("Close: %v", err)
+		}
+
+		record("CPU", cpuPath, err)
+	}
+
+	if d.mem {
+		p := d.path("mem", start)
+		record("memory", p, writeProfile("heap", p))
+	}
+
+	if d.dir != "" {
+		p := d.path("goroutine", start)
+		record("goroutine", p, writeProfile("goroutine", p))
+
+		p = d.path("block", start)
+		record("block", p, writeProfile("block", p))
+	}
+
+	return
+}
+
+// Log a summary of the mount's work on SIGHUP, and dump profiles if enabled.
+func registerSIGHUPHandler(
+	stats *mountStats,
+	cpu bool,
+	mem bool,
+	dir string) {
+	var desc string
+	switch {
+	case cpu && mem:
+		desc = "CPU and memory profiles"
+
+	case cpu:
+		desc = "CPU profile"
+
+	case mem:
+		desc = "memory profile"
+	}
+
+	d := &profileDumper{
+		clock:    timeutil.RealClock(),
+		cpu:      cpu,
+		mem:      mem,
+		duration: 10 * time.Second,
+		dir:      dir,
+	}
+
+	dest := "/tmp"
+	if dir != "" && desc != "" {
+		desc += " with goroutine and block profiles"
+		dest = dir
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	// Wait for SIGHUP in the background.
+	go func() {
+		for {
+			<-c
+			log.Printf("Received SIGHUP.\n%s", stats.Summary())
+			if desc == "" {
+				continue
+			}
+
+			log.Printf("Dumping %s to %s...", desc, dest)
+
+			written, errs := d.Dump()
+			for _, err := range errs {
+				logger.Errorf("Error profiling: %v", err)
+			}
+
+			for _, p := range written {
+				log.Printf("Wrote %s", p)
+			}
+
+			log.Println("Done profiling.")
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ProfileTest struct {
+	clock timeutil.SimulatedClock
+	dir   string
+	d     profileDumper
+}
+
+var _ SetUpInterface = &ProfileTest{}
+var _ TearDownInterface = &ProfileTest{}
+
+func init() { RegisterTestSuite(&ProfileTest{}) }
+
+func (t *ProfileTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.clock.SetTime(time.Date(2015, 6, 1, 12, 0, 0, 0, time.Local))
+	t.dir, err = ioutil.TempDir("", "profile_test")
+	AssertEq(nil, err)
+
+	t.d = profileDumper{
+		clock:    &t.clock,
+		cpu:      true,
+		mem:      true,
+		duration: time.Millisecond,
+		dir:      t.dir,
+	}
+}
+
+func (t *ProfileTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ProfileTest) DefaultPaths() {
+	t.d.dir = ""
+	ExpectEq("/tmp/cpu.pprof", t.d.path("cpu", t.clock.Now()))
+	ExpectEq("/tmp/mem.pprof", t.d.path("mem", t.clock.Now()))
+}
+
+func (t *ProfileTest) TimestampedPaths() {
+	ExpectEq(
+		path.Join(t.dir, "cpu-20150601-120000.pprof"),
+		t.d.path("cpu", t.clock.Now()))
+}
+
+func (t *ProfileTest) WritesAllProfiles() {
+	written, errs := t.d.Dump()
+	AssertEq(0, len(errs), "%v", errs)
+
+	ExpectThat(
+		written,
+		ElementsAre(
+			path.Join(t.dir, "cpu-20150601-120000.pprof"),
+			path.Join(t.dir, "mem-20150601-120000.pprof"),
+			path.Join(t.dir, "goroutine-20150601-120000.pprof"),
+			path.Join(t.dir, "block-20150601-120000.pprof")))
+
+	for _, p := range written {
+		fi, err := os.Stat(p)
+		AssertEq(nil, err)
+		ExpectGt(fi.Size(), 0, "%s", p)
+	}
+}
+
+func (t *ProfileTest) OnlyRequestedProfiles() {
+	t.d.cpu = false
+
+	written, errs := t.d.Dump()
+	AssertEq(0, len(errs), "%v", errs)
+	ExpectEq(3, len(written))
+	ExpectThat(written[0], HasSubstr("mem-"))
+}
+
+func (t *ProfileTest) FailuresDontStopOtherProfiles() {
+	// Make one of the destinations unwritable.
+	err := os.Mkdir(path.Join(t.dir, "goroutine-20150601-120000.pprof"), 0700)
+	AssertEq(nil, err)
+
+	written, errs := t.d.Dump()
+	AssertEq(1, len(errs))
+	ExpectThat(errs[0], Error(HasSubstr("goroutine profile")))
+	ExpectEq(3, len(written))
+}
+
+func (t *ProfileTest) MissingDirectory() {
+	t.d.dir = path.Join(t.dir, "missing")
+
+	written, errs := t.d.Dump()
+	ExpectEq(0, len(written))
+	ExpectEq(4, len(errs))
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"google.golang.org/api/googleapi"
+)
+
+// Is the supplied error the one with which GCS refuses requests to a
+// requester-pays bucket that don't name a project to bill?
+func isRequesterPaysError(err error) bool {
+	typed, ok := err.(*googleapi.Error)
+	if !ok || typed.Code != http.StatusBadRequest {
+		return false
+	}
+
+	// The message reads "Bucket is a requester pays bucket but no user project
+	// provided." There is no more specific reason code.
+	return strings.Contains(strings.ToLower(typed.Message), "requester pays")
+}
+
+// Find out whether the bucket can be used without a billing project. If it is
+// a requester-pays bucket, return an error telling the user to set
+// --billing-project; the gcs package doesn't report the failure of its own
+// probe when opening the bucket, leaving every later request to fail with a
+// confusing HTTP 400. Other errors are ignored, as when opening the bucket.
+//
+// This makes exactly one request.
+func checkRequesterPays(ctx context.Context, b gcs.Bucket) (err error) {
+	_, err = b.ListObjects(ctx, &gcs.ListObjectsRequest{MaxResults: 1})
+	if !isRequesterPaysError(err) {
+		err = nil
+		return
+	}
+
+	err = fmt.Errorf(
+		"Bucket %q is a requester-pays bucket. Set --billing-project to the "+
+			"project to bill for requests to it.",
+		b.Name())
+
+	return
+}
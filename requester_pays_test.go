@@ -0,0 +1,328 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A fake of the GCS JSON API for a requester-pays bucket, which refuses
+// requests that don't name a project to bill and otherwise serves canned
+// responses good enough for each type of request to succeed.
+type fakeRequesterPaysAPI struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+
+	// The method and path of each request, and the userProject parameter it
+	// carried.
+	//
+	// GUARDED_BY(mu)
+	requests     []string
+	userProjects []string
+}
+
+func newFakeRequesterPaysAPI() (f *fakeRequesterPaysAPI) {
+	f = &fakeRequesterPaysAPI{}
+	f.server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	return
+}
+
+func (f *fakeRequesterPaysAPI) serve(w http.ResponseWriter, r *http.Request) {
+	io.Copy(ioutil.Discard, r.Body)
+
+	userProject := r.URL.Query().Get("userProject")
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.userProjects = append(f.userProjects, userProject)
+	f.mu.Unlock()
+
+	var resource interface{}
+	switch {
+	case userProject == "":
+		const message = "Bucket is a requester pays bucket but no user project " +
+			"provided."
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"message": message,
+				"errors": []interface{}{
+					map[string]interface{}{
+						"domain":  "global",
+						"reason":  "required",
+						"message": message,
+					},
+				},
+			},
+		})
+
+		return
+
+	case strings.HasPrefix(r.URL.Path, "/download/"):
+		io.WriteString(w, "taco")
+		return
+
+	case r.Method == "POST" && r.URL.Query().Get("uploadType") == "resumable":
+		w.Header().Set(
+			"Location",
+			"https://www.googleapis.com/upload/storage/v1/b/some_bucket/o"+
+				"?uploadType=resumable&upload_id=17")
+		return
+
+	case r.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/o"):
+		resource = map[string]interface{}{"kind": "storage#objects"}
+
+	default:
+		resource = fullObjectResource("foo", 1)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resource)
+}
+
+// Open a bucket whose requests go to the fake, naming the supplied project as
+// the one to bill if non-empty.
+func (f *fakeRequesterPaysAPI) openBucket(
+	billingProject string) (b gcs.Bucket, err error) {
+	addr := f.server.Listener.Addr().String()
+	var rt httputil.CancellableRoundTripper = &http.Transport{
+		Dial: func(network string, _ string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	if billingProject != "" {
+		rt = newUserProjectTransport(billingProject, rt)
+	}
+
+	conn, err := gcs.NewConn(&gcs.ConnConfig{
+		Anonymous: true,
+		Transport: rt,
+	})
+
+	if err != nil {
+		return
+	}
+
+	b, err = conn.OpenBucket(context.Background(), "some_bucket")
+	return
+}
+
+// Forget the requests made so far.
+func (f *fakeRequesterPaysAPI) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = nil
+	f.userProjects = nil
+}
+
+type RequesterPaysTest struct {
+	ctx context.Context
+	api *fakeRequesterPaysAPI
+}
+
+var _ SetUpInterface = &RequesterPaysTest{}
+var _ TearDownInterface = &RequesterPaysTest{}
+
+func init() { RegisterTestSuite(&RequesterPaysTest{}) }
+
+func (t *RequesterPaysTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.api = newFakeRequesterPaysAPI()
+}
+
+func (t *RequesterPaysTest) TearDown() {
+	t.api.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RequesterPaysTest) EveryRequestIsBilled() {
+	b, err := t.api.openBucket("some-project")
+	AssertEq(nil, err)
+	t.api.reset()
+
+	ops := []struct {
+		name string
+		f    func() error
+	}{
+		{
+			"ListObjects",
+			func() (err error) {
+				_, err = b.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+				return
+			},
+		},
+
+		{
+			"StatObject",
+			func() (err error) {
+				_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+				return
+			},
+		},
+
+		{
+			"NewReader",
+			func() (err error) {
+				rc, err := b.NewReader(t.ctx, &gcs.ReadObjectRequest{Name: "foo"})
+				if err != nil {
+					return
+				}
+
+				defer rc.Close()
+				_, err = ioutil.ReadAll(rc)
+				return
+			},
+		},
+
+		{
+			"CreateObject",
+			func() (err error) {
+				_, err = b.CreateObject(
+					t.ctx,
+					&gcs.CreateObjectRequest{
+						Name:     "foo",
+						Contents: strings.NewReader("taco"),
+					})
+				return
+			},
+		},
+
+		{
+			"CopyObject",
+			func() (err error) {
+				_, err = b.CopyObject(
+					t.ctx,
+					&gcs.CopyObjectRequest{SrcName: "foo", DstName: "bar"})
+				return
+			},
+		},
+
+		{
+			"ComposeObjects",
+			func() (err error) {
+				_, err = b.ComposeObjects(
+					t.ctx,
+					&gcs.ComposeObjectsRequest{
+						DstName: "bar",
+						Sources: []gcs.ComposeSource{{Name: "foo"}, {Name: "foo"}},
+					})
+				return
+			},
+		},
+
+		{
+			"UpdateObject",
+			func() (err error) {
+				contentType := "text/plain"
+				_, err = b.UpdateObject(
+					t.ctx,
+					&gcs.UpdateObjectRequest{Name: "foo", ContentType: &contentType})
+				return
+			},
+		},
+
+		{
+			"DeleteObject",
+			func() (err error) {
+				err = b.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+				return
+			},
+		},
+	}
+
+	for _, op := range ops {
+		t.api.reset()
+		err := op.f()
+		ExpectEq(nil, err, "%s", op.name)
+
+		t.api.mu.Lock()
+		ExpectNe(0, len(t.api.requests), "%s", op.name)
+		for i, p := range t.api.userProjects {
+			ExpectEq("some-project", p, "%s: %s", op.name, t.api.requests[i])
+		}
+
+		t.api.mu.Unlock()
+	}
+}
+
+func (t *RequesterPaysTest) UnbilledRequestsFail() {
+	b, err := t.api.openBucket("")
+	AssertEq(nil, err)
+
+	_, err = b.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectTrue(isRequesterPaysError(err), "Error: %v", err)
+}
+
+func (t *RequesterPaysTest) CheckWithoutBillingProject() {
+	b, err := t.api.openBucket("")
+	AssertEq(nil, err)
+
+	err = checkRequesterPays(t.ctx, b)
+	ExpectThat(err, Error(HasSubstr("requester-pays")))
+	ExpectThat(err, Error(HasSubstr("--billing-project")))
+	ExpectThat(err, Error(HasSubstr("some_bucket")))
+}
+
+func (t *RequesterPaysTest) CheckWithBillingProject() {
+	b, err := t.api.openBucket("some-project")
+	AssertEq(nil, err)
+
+	ExpectEq(nil, checkRequesterPays(t.ctx, b))
+}
+
+func (t *RequesterPaysTest) OtherErrorsAreNotRequesterPays() {
+	testCases := []error{
+		nil,
+		&googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid argument."},
+		&googleapi.Error{Code: http.StatusForbidden, Message: "Forbidden."},
+		&gcs.NotFoundError{},
+	}
+
+	for _, err := range testCases {
+		ExpectFalse(isRequesterPaysError(err), "Error: %v", err)
+	}
+}
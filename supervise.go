@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/fuse"
+	"golang.org/x/net/context"
+)
+
+// The exit status when the kernel connection dies and the file system isn't
+// remounted, so that whoever supervises us can tell this from an unmount.
+const connectionDiedExitCode = 3
+
+// The number of times --auto-remount remounts before giving up.
+const autoRemountBudget = 5
+
+var errConnectionDied = errors.New("The kernel connection died")
+
+// What mountSupervisor needs of a mount.
+type supervisedMount interface {
+	Dir() string
+
+	// Wait for the kernel connection to end.
+	Join(ctx context.Context) error
+
+	// Write back files with modifications that were never flushed.
+	SyncDirtyFiles(ctx context.Context) (n int, err error)
+
+	// Mount afresh at the same place.
+	Remount() (m supervisedMount, err error)
+}
+
+// Waits for a mount to end, rescuing and optionally remounting it if its
+// kernel connection dies, e.g. because someone aborted it through
+// /sys/fs/fuse/connections.
+type mountSupervisor struct {
+	// The number of times to remount before giving up. Zero disables
+	// remounting.
+	remounts int
+
+	// Report whether the mount at dir is dead, i.e. still mounted but with no
+	// connection behind it.
+	isDead func(dir string) bool
+
+	// Unmount a dead mount.
+	unmount func(dir string) error
+}
+
+func newMountSupervisor(autoRemount bool) (s *mountSupervisor) {
+	s = &mountSupervisor{
+		isDead:  mountIsDead,
+		unmount: fuse.Unmount,
+	}
+
+	if autoRemount {
+		s.remounts = autoRemountBudget
+	}
+
+	return
+}
+
+// An unmount, whether ours or anyone else's, leaves the mount point usable. An
+// aborted connection leaves the mount in place, failing every operation.
+func mountIsDead(dir string) bool {
+	_, err := os.Stat(dir)
+	pe, ok := err.(*os.PathError)
+	return ok && (pe.Err == syscall.ENOTCONN || pe.Err == syscall.ENXIO)
+}
+
+// Join the supplied mount and any that replace it. Return nil when one is
+// unmounted, and errConnectionDied if a connection dies and the budget for
+// remounting is exhausted.
+func (s *mountSupervisor) Supervise(
+	ctx context.Context,
+	m supervisedMount) (err error) {
+	var remounts int
+	for {
+		err = m.Join(ctx)
+		if err != nil || !s.isDead(m.Dir()) {
+			return
+		}
+
+		log.Printf("The kernel connection for %s died.", m.Dir())
+		s.rescue(ctx, m)
+
+		// Try to remount until it works or the budget runs out.
+		for {
+			if remounts >= s.remounts {
+				err = errConnectionDied
+				return
+			}
+
+			remounts++
+
+			var next supervisedMount
+			next, err = m.Remount()
+			if err == nil {
+				log.Printf(
+					"Remounted %s (%d of %d remounts).",
+					m.Dir(),
+					remounts,
+					s.remounts)
+
+				m = next
+				break
+			}
+
+			logger.Errorf("Remounting %s: %v", m.Dir(), err)
+		}
+	}
+}
+
+// Save what we can of a mount whose connection died, and free its mount
+// point. Failures are logged, since there's nothing more to be done.
+func (s *mountSupervisor) rescue(ctx context.Context, m supervisedMount) {
+	n, err := m.SyncDirtyFiles(ctx)
+	if err != nil {
+		logger.Errorf("Writing back unflushed files: %v", err)
+	}
+
+	if n != 0 {
+		log.Printf("Wrote back %d unflushed files.", n)
+	}
+
+	err = s.unmount(m.Dir())
+	if err != nil {
+		logger.Errorf("Unmounting dead mount %s: %v", m.Dir(), err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A supervisedMount whose connection ends as soon as it is joined.
+type fakeMount struct {
+	sup *SuperviseTest
+
+	joinErr error
+	dead    bool
+	synced  int
+	syncErr error
+}
+
+func (m *fakeMount) Dir() string {
+	return "/some/dir"
+}
+
+func (m *fakeMount) Join(ctx context.Context) error {
+	return m.joinErr
+}
+
+func (m *fakeMount) SyncDirtyFiles(ctx context.Context) (n int, err error) {
+	m.synced++
+	n, err = 1, m.syncErr
+	return
+}
+
+func (m *fakeMount) Remount() (next supervisedMount, err error) {
+	t := m.sup
+	t.remountCalls++
+
+	if len(t.remountErrs) != 0 {
+		err = t.remountErrs[0]
+		t.remountErrs = t.remountErrs[1:]
+		if err != nil {
+			return
+		}
+	}
+
+	// Subsequent mounts die too, until told otherwise.
+	nm := &fakeMount{sup: t, dead: t.remountsDie}
+	t.mounts = append(t.mounts, nm)
+	next = nm
+	return
+}
+
+type SuperviseTest struct {
+	ctx context.Context
+	s   mountSupervisor
+
+	mounts       []*fakeMount
+	remountCalls int
+	remountErrs  []error
+	remountsDie  bool
+	unmounted    []string
+}
+
+var _ SetUpInterface = &SuperviseTest{}
+
+func init() { RegisterTestSuite(&SuperviseTest{}) }
+
+func (t *SuperviseTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.s = mountSupervisor{
+		isDead: func(dir string) bool {
+			return t.mounts[len(t.mounts)-1].dead
+		},
+
+		unmount: func(dir string) (err error) {
+			t.unmounted = append(t.unmounted, dir)
+			return
+		},
+	}
+
+	t.mounts = []*fakeMount{{sup: t}}
+}
+
+func (t *SuperviseTest) supervise() error {
+	return t.s.Supervise(t.ctx, t.mounts[0])
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SuperviseTest) Unmounted() {
+	ExpectEq(nil, t.supervise())
+	ExpectEq(0, t.mounts[0].synced)
+	ExpectEq(0, len(t.unmounted))
+	ExpectEq(0, t.remountCalls)
+}
+
+func (t *SuperviseTest) JoinFails() {
+	t.mounts[0].joinErr = errors.New("taco")
+	t.mounts[0].dead = true
+
+	ExpectThat(t.supervise(), Error(Equals("taco")))
+	ExpectEq(0, t.mounts[0].synced)
+	ExpectEq(0, t.remountCalls)
+}
+
+func (t *SuperviseTest) DiesWithoutAutoRemount() {
+	t.mounts[0].dead = true
+
+	ExpectEq(errConnectionDied, t.supervise())
+	ExpectEq(1, t.mounts[0].synced)
+	ExpectThat(t.unmounted, ElementsAre("/some/dir"))
+	ExpectEq(0, t.remountCalls)
+}
+
+func (t *SuperviseTest) RemountsThenUnmounted() {
+	t.s.remounts = 3
+	t.mounts[0].dead = true
+
+	ExpectEq(nil, t.supervise())
+	ExpectEq(1, t.remountCalls)
+	ExpectEq(1, t.mounts[0].synced)
+	ExpectThat(t.unmounted, ElementsAre("/some/dir"))
+
+	AssertEq(2, len(t.mounts))
+	ExpectEq(0, t.mounts[1].synced)
+}
+
+func (t *SuperviseTest) BudgetExhausted() {
+	t.s.remounts = 2
+	t.mounts[0].dead = true
+	t.remountsDie = true
+
+	ExpectEq(errConnectionDied, t.supervise())
+	ExpectEq(2, t.remountCalls)
+
+	// Each dead mount was rescued.
+	AssertEq(3, len(t.mounts))
+	for _, m := range t.mounts {
+		ExpectEq(1, m.synced)
+	}
+
+	ExpectEq(3, len(t.unmounted))
+}
+
+func (t *SuperviseTest) RemountFailuresUseBudget() {
+	t.s.remounts = 3
+	t.mounts[0].dead = true
+	t.remountErrs = []error{
+		errors.New("taco"),
+		errors.New("burrito"),
+		errors.New("enchilada"),
+	}
+
+	ExpectEq(errConnectionDied, t.supervise())
+	ExpectEq(3, t.remountCalls)
+}
+
+func (t *SuperviseTest) RemountSucceedsAfterFailure() {
+	t.s.remounts = 3
+	t.mounts[0].dead = true
+	t.remountErrs = []error{errors.New("taco"), nil}
+
+	ExpectEq(nil, t.supervise())
+	ExpectEq(2, t.remountCalls)
+}
+
+func (t *SuperviseTest) RescueFailureDoesntStopRemount() {
+	t.s.remounts = 1
+	t.mounts[0].dead = true
+	t.mounts[0].syncErr = errors.New("taco")
+
+	ExpectEq(nil, t.supervise())
+	ExpectEq(1, t.remountCalls)
+}
+
+func (t *SuperviseTest) LiveDirectoryIsNotDead() {
+	dir, err := ioutil.TempDir("", "supervise_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	ExpectFalse(mountIsDead(dir))
+	ExpectFalse(mountIsDead(path.Join(dir, "missing")))
+}
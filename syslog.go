@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// An io.Writer for a logger that sends each message to syslog with facility
+// LOG_DAEMON and a fixed severity: LOG_INFO for the writer returned by
+// openSyslog, and LOG_ERR for the one returned by its Errors method. Fatal
+// errors are sent with Crit.
+type syslogWriter struct {
+	w        *syslog.Writer
+	severity syslog.Priority
+}
+
+func openSyslog() (sw *syslogWriter, err error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "gcsfuse")
+	if err != nil {
+		err = fmt.Errorf("syslog.New: %v", err)
+		return
+	}
+
+	sw = &syslogWriter{w: w, severity: syslog.LOG_INFO}
+	return
+}
+
+// Return a writer for the same connection that sends messages with severity
+// LOG_ERR, for use with logger.SetErrorOutput.
+func (sw *syslogWriter) Errors() *syslogWriter {
+	return &syslogWriter{w: sw.w, severity: syslog.LOG_ERR}
+}
+
+func (sw *syslogWriter) Write(p []byte) (n int, err error) {
+	msg := string(p)
+	switch sw.severity {
+	case syslog.LOG_ERR:
+		err = sw.w.Err(msg)
+
+	default:
+		err = sw.w.Info(msg)
+	}
+
+	if err != nil {
+		return
+	}
+
+	n = len(p)
+	return
+}
+
+// Send a message at LOG_CRIT severity.
+func (sw *syslogWriter) Crit(msg string) (err error) {
+	err = sw.w.Crit(msg)
+	return
+}
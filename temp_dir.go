@@ -0,0 +1,123 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/jacobsa/fuse/fsutil"
+	"golang.org/x/sys/unix"
+)
+
+// Create the supplied temporary directory if it doesn't already exist, then
+// make sure that we can write to it.
+func prepareTempDir(dir string) (err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("Creating %q: %v", dir, err)
+		return
+	}
+
+	f, err := fsutil.AnonymousFile(dir)
+	if err != nil {
+		err = fmt.Errorf(
+			"Can't write to %q; does it have the correct permissions? (%v)",
+			dir,
+			err)
+		return
+	}
+
+	f.Close()
+	return
+}
+
+// Check the limits on the temporary directory's usage, with "" meaning the
+// system default directory, against the size of the file system holding it.
+// Cached contents are only evicted when a limit is reached, so a limit the
+// file system can't reach would let it fill up instead. The default byte limit
+// wasn't chosen for this machine, so exceeding it gets only a warning.
+func checkTempDirLimits(
+	dir string,
+	limitBytes int64,
+	limitFiles int) (err error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	var st unix.Statfs_t
+	err = unix.Statfs(dir, &st)
+	if err != nil {
+		err = fmt.Errorf("Statfs(%q): %v", dir, err)
+		return
+	}
+
+	size := int64(st.Blocks) * int64(st.Bsize)
+	switch {
+	case limitBytes <= size:
+
+	case limitBytes == defaultTempDirBytes:
+		log.Printf(
+			"Warning: the default --temp-dir-limit-bytes of %d is more than the "+
+				"%d bytes of the file system holding %q. Consider lowering it.",
+			limitBytes,
+			size,
+			dir)
+
+	default:
+		err = fmt.Errorf(
+			"--temp-dir-limit-bytes of %d is more than the %d bytes of the file "+
+				"system holding %q",
+			limitBytes,
+			size,
+			dir)
+		return
+	}
+
+	// Some file systems don't report a limit on the number of files.
+	if limitFiles > 0 && st.Files > 0 && uint64(limitFiles) > st.Files {
+		err = fmt.Errorf(
+			"--temp-dir-limit-files of %d is more than the %d files the file "+
+				"system holding %q can hold",
+			limitFiles,
+			st.Files,
+			dir)
+		return
+	}
+
+	return
+}
+
+// Serve the usage of the temporary directory, with "" meaning the system
+// default, against its limits.
+func serveTempDirStats(dir string, counters *fs.Counters) http.HandlerFunc {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := counters.Stats()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "dir: %s\n", dir)
+		fmt.Fprintf(w, "files: %d of %d\n", s.TempFiles, s.TempLimitFiles)
+		fmt.Fprintf(w, "bytes: %d of %d\n", s.TempBytes, s.TempLimitBytes)
+		fmt.Fprintf(w, "evictions: %d\n", s.TempEvictions)
+		fmt.Fprintf(w, "eviction misses: %d\n", s.TempEvictionMisses)
+		fmt.Fprintf(w, "other revocations: %d\n", s.TempRevocations)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestTempDir(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TempDirTest struct {
+	dir string
+}
+
+var _ SetUpInterface = &TempDirTest{}
+var _ TearDownInterface = &TempDirTest{}
+
+func init() { RegisterTestSuite(&TempDirTest{}) }
+
+func (t *TempDirTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "temp_dir_test")
+	AssertEq(nil, err)
+}
+
+func (t *TempDirTest) TearDown() {
+	os.Chmod(t.dir, 0700)
+	os.RemoveAll(t.dir)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TempDirTest) Exists() {
+	AssertEq(nil, prepareTempDir(t.dir))
+
+	// Nothing is left behind.
+	entries, err := ioutil.ReadDir(t.dir)
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *TempDirTest) CreatedIfMissing() {
+	dir := path.Join(t.dir, "foo/bar")
+	AssertEq(nil, prepareTempDir(dir))
+
+	fi, err := os.Stat(dir)
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+}
+
+func (t *TempDirTest) NotADirectory() {
+	p := path.Join(t.dir, "foo")
+	AssertEq(nil, ioutil.WriteFile(p, []byte("taco"), 0600))
+
+	err := prepareTempDir(p)
+	ExpectThat(err, Error(HasSubstr("Creating")))
+	ExpectThat(err, Error(HasSubstr(p)))
+}
+
+func (t *TempDirTest) NotWritable() {
+	// Root can write anywhere.
+	if os.Getuid() == 0 {
+		return
+	}
+
+	AssertEq(nil, os.Chmod(t.dir, 0500))
+
+	err := prepareTempDir(t.dir)
+	ExpectThat(err, Error(HasSubstr("Can't write")))
+	ExpectThat(err, Error(HasSubstr(t.dir)))
+}
+
+func (t *TempDirTest) LimitsWithinFileSystem() {
+	ExpectEq(nil, checkTempDirLimits(t.dir, 1<<20, 16))
+}
+
+func (t *TempDirTest) ByteLimitTooLarge() {
+	err := checkTempDirLimits(t.dir, 1<<62, 16)
+	ExpectThat(err, Error(HasSubstr("--temp-dir-limit-bytes")))
+	ExpectThat(err, Error(HasSubstr(t.dir)))
+}
+
+func (t *TempDirTest) FileLimitTooLarge() {
+	err := checkTempDirLimits(t.dir, 1<<20, 1<<62)
+	ExpectThat(err, Error(HasSubstr("--temp-dir-limit-files")))
+}
+
+func (t *TempDirTest) LimitsForMissingDir() {
+	err := checkTempDirLimits(path.Join(t.dir, "foo"), 1<<20, 16)
+	ExpectThat(err, Error(HasSubstr("Statfs")))
+}
+
+func (t *TempDirTest) ServeStats() {
+	var counters fs.Counters
+	w := httptest.NewRecorder()
+	serveTempDirStats("/some/dir", &counters)(w, nil)
+
+	ExpectEq(
+		"dir: /some/dir\n"+
+			"files: 0 of 0\n"+
+			"bytes: 0 of 0\n"+
+			"evictions: 0\n"+
+			"eviction misses: 0\n"+
+			"other revocations: 0\n",
+		w.Body.String())
+}
@@ -0,0 +1,325 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// Settings for the HTTP transport used to talk to GCS. See the flags of the
+// same names.
+type transportConfig struct {
+	TCPKeepAlive          time.Duration
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// If non-nil, send all requests through this proxy rather than whichever
+	// the environment specifies.
+	HTTPProxy *url.URL
+
+	// If non-nil, ask for only these fields of each object resource when
+	// listing and statting objects. See gcsproxy.ObjectFieldTable.
+	ObjectFields []string
+
+	// If non-empty, bill every request to this project, as requester-pays
+	// buckets require.
+	BillingProject string
+}
+
+// Parse the value of --http-proxy, returning nil if it is empty.
+func parseHTTPProxy(s string) (u *url.URL, err error) {
+	if s == "" {
+		return
+	}
+
+	u, err = url.Parse(s)
+	if err != nil {
+		err = fmt.Errorf("Illegal --http-proxy value: %v", err)
+		return
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		err = fmt.Errorf(
+			"Illegal --http-proxy value: %q is not an http or https URL",
+			u.Redacted())
+		u = nil
+		return
+	}
+
+	return
+}
+
+// Create an HTTP transport that doesn't hang on connections that have silently
+// died while idle, as happens when a NAT forgets about them overnight.
+//
+// Three things help. TCP keepalives stop the NAT from forgetting a connection
+// in the first place. Closing pooled connections after a period of idleness
+// means we don't try to reuse one that it forgot anyway. And should that still
+// happen, a response header timeout makes the request fail in reasonable time
+// rather than waiting on the kernel's retransmission timeouts, which can take
+// many minutes.
+//
+// Requests go through the configured proxy if any, otherwise through the one
+// named by $HTTPS_PROXY and friends. Errors from the transport then mention
+// the proxy, since otherwise it is far from obvious that it is to blame.
+//
+// Listings and stats ask for only cfg.ObjectFields, if set, and every request
+// names cfg.BillingProject as the project to bill, if set.
+func newTransport(cfg transportConfig) (rt httputil.CancellableRoundTripper) {
+	// Zero means the default for net.Dialer, which is to enable keepalives.
+	keepAlive := cfg.TCPKeepAlive
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+	}
+
+	// Otherwise start from the defaults, which among other things respect
+	// proxy settings in the environment.
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialer.DialContext
+	t.IdleConnTimeout = cfg.IdleConnTimeout
+	t.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+
+	// Basic auth credentials in the URL are sent to the proxy by the transport.
+	if cfg.HTTPProxy != nil {
+		t.Proxy = http.ProxyURL(cfg.HTTPProxy)
+	}
+
+	rt = &proxyAnnotatingTransport{t}
+	if cfg.ObjectFields != nil {
+		rt = newFieldMaskTransport(cfg.ObjectFields, rt)
+	}
+
+	if cfg.BillingProject != "" {
+		rt = newUserProjectTransport(cfg.BillingProject, rt)
+	}
+
+	return
+}
+
+// A transport that adds the address of the proxy, if any, to the errors that
+// it returns.
+type proxyAnnotatingTransport struct {
+	*http.Transport
+}
+
+func (t *proxyAnnotatingTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	resp, err = t.Transport.RoundTrip(req)
+	if err == nil {
+		return
+	}
+
+	// Network errors already say where they were headed (for the proxy, as
+	// "proxyconnect tcp: dial tcp <addr>"), and wrapping them would hide them
+	// from gcs's retry logic.
+	if _, ok := err.(*net.OpError); ok || t.Proxy == nil {
+		return
+	}
+
+	proxy, proxyErr := t.Proxy(req)
+	if proxyErr != nil || proxy == nil {
+		return
+	}
+
+	err = fmt.Errorf("via proxy %s: %v", proxy.Redacted(), err)
+	return
+}
+
+// A transport that sets query parameters on some of the requests that it
+// sends. The gcs package offers no way to add parameters of its own.
+type queryRewritingTransport struct {
+	// Return the parameters to set on the supplied request, or nil to send it
+	// unchanged.
+	params  func(req *http.Request) url.Values
+	wrapped httputil.CancellableRoundTripper
+
+	mu sync.Mutex
+
+	// The rewritten copy of each request in flight that has one, so that
+	// CancelRequest can pass on the request that the wrapped transport saw.
+	//
+	// GUARDED_BY(mu)
+	rewritten map[*http.Request]*http.Request
+}
+
+func newQueryRewritingTransport(
+	params func(req *http.Request) url.Values,
+	wrapped httputil.CancellableRoundTripper) *queryRewritingTransport {
+	return &queryRewritingTransport{
+		params:    params,
+		wrapped:   wrapped,
+		rewritten: make(map[*http.Request]*http.Request),
+	}
+}
+
+func (t *queryRewritingTransport) RoundTrip(
+	req *http.Request) (resp *http.Response, err error) {
+	params := t.params(req)
+	if params == nil {
+		resp, err = t.wrapped.RoundTrip(req)
+		return
+	}
+
+	// Round trippers mustn't modify the caller's request.
+	rewritten := req.Clone(req.Context())
+	query := rewritten.URL.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+
+	rewritten.URL.RawQuery = query.Encode()
+
+	// The request remains cancellable until its response body is closed.
+	t.mu.Lock()
+	t.rewritten[req] = rewritten
+	t.mu.Unlock()
+
+	forget := func() {
+		t.mu.Lock()
+		delete(t.rewritten, req)
+		t.mu.Unlock()
+	}
+
+	resp, err = t.wrapped.RoundTrip(rewritten)
+	if err != nil {
+		forget()
+		return
+	}
+
+	resp.Body = &onCloseReadCloser{ReadCloser: resp.Body, f: forget}
+	return
+}
+
+func (t *queryRewritingTransport) CancelRequest(req *http.Request) {
+	t.mu.Lock()
+	if rewritten, ok := t.rewritten[req]; ok {
+		req = rewritten
+	}
+	t.mu.Unlock()
+
+	t.wrapped.CancelRequest(req)
+}
+
+// A transport that adds a fields parameter to requests that list or stat
+// objects, so that the responses contain only the object fields that we use.
+// Decoding full object resources, ACLs and all, is a large part of the cost of
+// listing.
+type fieldMaskTransport struct {
+	*queryRewritingTransport
+
+	objectMask  string
+	listingMask string
+}
+
+func newFieldMaskTransport(
+	fields []string,
+	wrapped httputil.CancellableRoundTripper) *fieldMaskTransport {
+	t := &fieldMaskTransport{
+		objectMask:  gcsproxy.ObjectFieldMask(fields),
+		listingMask: gcsproxy.ListingFieldMask(fields),
+	}
+
+	t.queryRewritingTransport = newQueryRewritingTransport(
+		func(req *http.Request) url.Values {
+			mask := t.maskFor(req)
+			if mask == "" {
+				return nil
+			}
+
+			return url.Values{"fields": {mask}}
+		},
+		wrapped)
+
+	return t
+}
+
+// Return the fields parameter to add to the supplied request, or the empty
+// string if it isn't a listing or stat or already has one.
+func (t *fieldMaskTransport) maskFor(req *http.Request) string {
+	if req.Method != "GET" || req.URL.Query().Get("fields") != "" {
+		return ""
+	}
+
+	// Package gcs puts the host in the opaque part of the URL, with segments
+	// escaped (notably slashes in object names).
+	p := req.URL.EscapedPath()
+	if req.URL.Opaque != "" {
+		p = req.URL.Opaque
+		if strings.HasPrefix(p, "//") {
+			p = p[strings.Index(p[2:]+"/", "/")+2:]
+		}
+	}
+
+	const prefix = "/storage/v1/b/"
+	if !strings.HasPrefix(p, prefix) {
+		return ""
+	}
+
+	// Expect "<bucket>/o" for a listing and "<bucket>/o/<object>" for a stat.
+	segments := strings.Split(p[len(prefix):], "/")
+	switch {
+	case len(segments) < 2 || segments[1] != "o":
+		return ""
+
+	case len(segments) == 2:
+		return t.listingMask
+
+	case len(segments) == 3:
+		return t.objectMask
+	}
+
+	return ""
+}
+
+// Return a transport that names the supplied project as the one to bill for
+// every request, as the userProject parameter. Requests to requester-pays
+// buckets fail without it; requests to other buckets are billed to the project
+// too.
+func newUserProjectTransport(
+	project string,
+	wrapped httputil.CancellableRoundTripper) *queryRewritingTransport {
+	params := url.Values{"userProject": {project}}
+	return newQueryRewritingTransport(
+		func(req *http.Request) url.Values { return params },
+		wrapped)
+}
+
+// An io.ReadCloser that calls a function once it has been closed.
+type onCloseReadCloser struct {
+	io.ReadCloser
+	f    func()
+	once sync.Once
+}
+
+func (rc *onCloseReadCloser) Close() (err error) {
+	err = rc.ReadCloser.Close()
+	rc.once.Do(rc.f)
+	return
+}
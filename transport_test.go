@@ -0,0 +1,317 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A TCP proxy that can silently stop forwarding on its existing connections
+// without closing them, as a NAT does when it forgets about an idle
+// connection.
+type blackholeProxy struct {
+	l       net.Listener
+	backend string
+
+	// The number of connections accepted. Accessed atomically.
+	accepted uint64
+
+	mu sync.Mutex
+
+	// A flag for each connection, set when it has been blackholed. Accessed
+	// atomically.
+	//
+	// GUARDED_BY(mu)
+	dropped []*uint32
+}
+
+func newBlackholeProxy(backend string) (p *blackholeProxy, err error) {
+	p = &blackholeProxy{backend: backend}
+	p.l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+
+	go p.serve()
+	return
+}
+
+func (p *blackholeProxy) Addr() string {
+	return p.l.Addr().String()
+}
+
+func (p *blackholeProxy) Close() {
+	p.l.Close()
+}
+
+// Stop forwarding on all existing connections.
+func (p *blackholeProxy) Blackhole() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, d := range p.dropped {
+		atomic.StoreUint32(d, 1)
+	}
+}
+
+func (p *blackholeProxy) serve() {
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+
+		atomic.AddUint64(&p.accepted, 1)
+
+		b, err := net.Dial("tcp", p.backend)
+		if err != nil {
+			c.Close()
+			continue
+		}
+
+		dropped := new(uint32)
+		p.mu.Lock()
+		p.dropped = append(p.dropped, dropped)
+		p.mu.Unlock()
+
+		go forwardUnlessDropped(b, c, dropped)
+		go forwardUnlessDropped(c, b, dropped)
+	}
+}
+
+func forwardUnlessDropped(dst net.Conn, src net.Conn, dropped *uint32) {
+	defer dst.Close()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && atomic.LoadUint32(dropped) == 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+type TransportTest struct {
+	server *httptest.Server
+	proxy  *blackholeProxy
+}
+
+var _ SetUpInterface = &TransportTest{}
+var _ TearDownInterface = &TransportTest{}
+
+func init() { RegisterTestSuite(&TransportTest{}) }
+
+func (t *TransportTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "taco")
+		}))
+
+	t.proxy, err = newBlackholeProxy(t.server.Listener.Addr().String())
+	AssertEq(nil, err)
+}
+
+func (t *TransportTest) TearDown() {
+	t.proxy.Close()
+	t.server.Close()
+}
+
+// Make a request through the proxy, returning the body.
+func (t *TransportTest) get(c *http.Client) (body string, err error) {
+	resp, err := c.Get("http://" + t.proxy.Addr() + "/")
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	body = string(b)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TransportTest) IdleConnectionsAreNotReused() {
+	c := &http.Client{
+		Transport: newTransport(transportConfig{
+			TCPKeepAlive:          30 * time.Second,
+			IdleConnTimeout:       50 * time.Millisecond,
+			ResponseHeaderTimeout: 10 * time.Second,
+		}),
+	}
+
+	// Make a request, leaving a connection in the pool.
+	body, err := t.get(c)
+	AssertEq(nil, err)
+	AssertEq("taco", body)
+
+	// Have the connection die silently while idle.
+	t.proxy.Blackhole()
+	time.Sleep(200 * time.Millisecond)
+
+	// The next request should use a new connection, and succeed quickly.
+	before := time.Now()
+	body, err = t.get(c)
+
+	AssertEq(nil, err)
+	ExpectEq("taco", body)
+	ExpectLt(time.Since(before), time.Second)
+	ExpectEq(2, atomic.LoadUint64(&t.proxy.accepted))
+}
+
+func (t *TransportTest) DeadConnectionFailsFast() {
+	const timeout = 200 * time.Millisecond
+	c := &http.Client{
+		Transport: newTransport(transportConfig{
+			TCPKeepAlive:          30 * time.Second,
+			IdleConnTimeout:       0,
+			ResponseHeaderTimeout: timeout,
+		}),
+	}
+
+	// Make a request, leaving a connection in the pool.
+	body, err := t.get(c)
+	AssertEq(nil, err)
+	AssertEq("taco", body)
+
+	// Have the connection die silently. The next request reuses it, but should
+	// fail after the timeout rather than hanging.
+	t.proxy.Blackhole()
+
+	before := time.Now()
+	_, err = t.get(c)
+
+	ExpectThat(err, Error(HasSubstr("timeout")))
+	ExpectLt(time.Since(before), 10*timeout)
+
+	// A retry should then succeed on a new connection.
+	body, err = t.get(c)
+	AssertEq(nil, err)
+	ExpectEq("taco", body)
+}
+
+func (t *TransportTest) RequestsGoThroughConfiguredProxy() {
+	// A forward proxy that answers on behalf of the origin, recording what it
+	// was asked for.
+	var mu sync.Mutex
+	var requested []string
+	var authorization []string
+
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requested = append(requested, r.URL.String())
+			authorization = append(authorization, r.Header.Get("Proxy-Authorization"))
+			mu.Unlock()
+
+			io.WriteString(w, "burrito")
+		}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	AssertEq(nil, err)
+	proxyURL.User = url.UserPassword("taco", "enchilada")
+
+	c := &http.Client{
+		Transport: newTransport(transportConfig{
+			HTTPProxy: proxyURL,
+		}),
+	}
+
+	// The origin is never contacted directly.
+	resp, err := c.Get("http://gcs.invalid/foo")
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(body))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	ExpectThat(requested, ElementsAre("http://gcs.invalid/foo"))
+	ExpectThat(authorization, ElementsAre("Basic dGFjbzplbmNoaWxhZGE="))
+}
+
+func (t *TransportTest) ProxyErrorsMentionProxy() {
+	// A proxy that refuses to tunnel anything.
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+		}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	AssertEq(nil, err)
+	proxyURL.User = url.UserPassword("taco", "enchilada")
+
+	c := &http.Client{
+		Transport: newTransport(transportConfig{
+			HTTPProxy: proxyURL,
+		}),
+	}
+
+	_, err = c.Get("https://gcs.invalid/foo")
+	ExpectThat(err, Error(HasSubstr("via proxy")))
+	ExpectThat(err, Error(HasSubstr(proxy.Listener.Addr().String())))
+	ExpectThat(err, Error(HasSubstr("Proxy Authentication Required")))
+	ExpectThat(err, Error(Not(HasSubstr("enchilada"))))
+}
+
+func (t *TransportTest) UnreachableProxyIsNamed() {
+	// Find a port with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertEq(nil, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	c := &http.Client{
+		Transport: newTransport(transportConfig{
+			HTTPProxy: &url.URL{Scheme: "http", Host: addr},
+		}),
+	}
+
+	_, err = c.Get("http://gcs.invalid/foo")
+	ExpectThat(err, Error(HasSubstr("proxyconnect")))
+	ExpectThat(err, Error(HasSubstr(addr)))
+}
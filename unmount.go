@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// Something whose dirty files can be written out to GCS ahead of unmounting.
+type dirtyFileSyncer interface {
+	SyncDirtyFiles(ctx context.Context) (n int, err error)
+}
+
+// The status with which we exit if we can't unmount in response to a signal,
+// even lazily.
+const unmountFailedExitCode = 4
+
+// Delays between attempts to unmount a busy mount point.
+const (
+	initialUnmountRetryDelay = 100 * time.Millisecond
+	maxUnmountRetryDelay     = 5 * time.Second
+)
+
+// Unmount on SIGINT or SIGTERM, the latter being what systemd sends on
+// shutdown. Dirty files are synced first, so that their contents aren't lost
+// along with the mount; a second signal while that is happening skips it.
+//
+// If the mount point stays busy for longer than retryTimeout, it is detached
+// lazily. If even that fails, the process exits with unmountFailedExitCode.
+func registerSIGINTHandler(
+	mountPoint string,
+	syncer dirtyFileSyncer,
+	retryTimeout time.Duration) {
+	// Register for the signals.
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+	// Start a goroutine that will unmount when a signal is received.
+	go func() {
+		sig := <-signalChan
+		log.Printf("Received %v, syncing dirty files...", sig)
+		syncBeforeUnmount(syncer, signalChan)
+
+		log.Printf("Attempting to unmount in response to %v...", sig)
+
+		err := newUnmounter(retryTimeout).Unmount(mountPoint)
+		if err != nil {
+			logger.Errorf("Failed to unmount in response to %v: %v", sig, err)
+			os.Exit(unmountFailedExitCode)
+		}
+
+		log.Printf("Successfully unmounted in response to %v.", sig)
+	}()
+}
+
+// Unmounts, retrying with backoff while the mount point is busy and then
+// escalating to a lazy unmount.
+type unmounter struct {
+	timeout time.Duration
+	clock   timeutil.Clock
+
+	// Dependencies, replaceable for testing.
+	unmount     func(dir string) error
+	lazyUnmount func(dir string) error
+	sleep       func(d time.Duration)
+}
+
+func newUnmounter(timeout time.Duration) (u *unmounter) {
+	u = &unmounter{
+		timeout:     timeout,
+		clock:       timeutil.RealClock(),
+		unmount:     fuse.Unmount,
+		lazyUnmount: lazyUnmount,
+		sleep:       time.Sleep,
+	}
+
+	return
+}
+
+// Is the supplied unmount error due to the mount point being in use? On Linux
+// fusermount reports this only in its output.
+func isBusy(err error) bool {
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EBUSY {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "busy")
+}
+
+// Unmount the file system at the given mount point. A clean unmount is a
+// single attempt. While the mount point is busy, retry with exponential
+// backoff until the timeout, then detach it lazily so that the kernel
+// finishes the unmount once it is no longer in use.
+func (u *unmounter) Unmount(dir string) (err error) {
+	// Fast path.
+	err = u.unmount(dir)
+	if err == nil || !isBusy(err) {
+		return
+	}
+
+	deadline := u.clock.Now().Add(u.timeout)
+	delay := initialUnmountRetryDelay
+
+	for u.clock.Now().Add(delay).Before(deadline) {
+		log.Printf("%s is busy; retrying unmount in %v.", dir, delay)
+		u.sleep(delay)
+
+		err = u.unmount(dir)
+		if err == nil || !isBusy(err) {
+			return
+		}
+
+		delay *= 2
+		if delay > maxUnmountRetryDelay {
+			delay = maxUnmountRetryDelay
+		}
+	}
+
+	log.Printf(
+		"%s is still busy after %v (%v); unmounting lazily.",
+		dir,
+		u.timeout,
+		err)
+
+	err = u.lazyUnmount(dir)
+	if err != nil {
+		err = fmt.Errorf("Lazy unmount: %v", err)
+		return
+	}
+
+	log.Printf(
+		"Lazily unmounted %s; it will be released once no longer in use.",
+		dir)
+
+	return
+}
+
+// Sync the supplied file system's dirty files, giving up early if another
+// signal arrives. Failures are logged, per file by the syncer, and otherwise
+// ignored: the caller should unmount regardless.
+func syncBeforeUnmount(
+	syncer dirtyFileSyncer,
+	signals <-chan os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		n, err := syncer.SyncDirtyFiles(ctx)
+		if err != nil {
+			logger.Errorf("Synced %d dirty files; failed to sync others.", n)
+			return
+		}
+
+		log.Printf("Synced %d dirty files.", n)
+	}()
+
+	select {
+	case <-done:
+	case sig := <-signals:
+		log.Printf("Received %v while syncing; unmounting now.", sig)
+	}
+}
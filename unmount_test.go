@@ -0,0 +1,238 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A dirtyFileSyncer that defers to a function.
+type funcSyncer func(ctx context.Context) (int, error)
+
+func (f funcSyncer) SyncDirtyFiles(ctx context.Context) (n int, err error) {
+	n, err = f(ctx)
+	return
+}
+
+type UnmountTest struct {
+	signals chan os.Signal
+
+	clock timeutil.SimulatedClock
+	u     unmounter
+
+	// Errors to be returned by successive unmount attempts, then nil.
+	unmountErrs []error
+	unmounts    int
+
+	lazyErr     error
+	lazyUnmount int
+
+	sleeps []time.Duration
+}
+
+func init() { RegisterTestSuite(&UnmountTest{}) }
+
+func (t *UnmountTest) SetUp(ti *TestInfo) {
+	t.signals = make(chan os.Signal, 1)
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.u = unmounter{
+		timeout: 2 * time.Second,
+		clock:   &t.clock,
+
+		unmount: func(dir string) (err error) {
+			t.unmounts++
+			if len(t.unmountErrs) != 0 {
+				err = t.unmountErrs[0]
+				t.unmountErrs = t.unmountErrs[1:]
+			}
+
+			return
+		},
+
+		lazyUnmount: func(dir string) (err error) {
+			t.lazyUnmount++
+			err = t.lazyErr
+			return
+		},
+
+		sleep: func(d time.Duration) {
+			t.sleeps = append(t.sleeps, d)
+			t.clock.AdvanceTime(d)
+		},
+	}
+}
+
+// The error fusermount gives for a busy mount point.
+var errBusy = errors.New(
+	"exit status 1: fusermount: failed to unmount /some/dir: " +
+		"Device or resource busy")
+
+func (t *UnmountTest) busyTimes(n int) {
+	for i := 0; i < n; i++ {
+		t.unmountErrs = append(t.unmountErrs, errBusy)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UnmountTest) SyncSucceeds() {
+	calls := 0
+	syncer := funcSyncer(func(ctx context.Context) (int, error) {
+		calls++
+		return 2, nil
+	})
+
+	syncBeforeUnmount(syncer, t.signals)
+	ExpectEq(1, calls)
+}
+
+func (t *UnmountTest) SyncFails() {
+	calls := 0
+	syncer := funcSyncer(func(ctx context.Context) (int, error) {
+		calls++
+		return 1, errors.New("taco")
+	})
+
+	// The failure is logged but otherwise doesn't matter.
+	syncBeforeUnmount(syncer, t.signals)
+	ExpectEq(1, calls)
+}
+
+func (t *UnmountTest) SecondSignalSkipsSync() {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	syncer := funcSyncer(func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return 0, ctx.Err()
+	})
+
+	go func() {
+		<-started
+		t.signals <- syscall.SIGTERM
+	}()
+
+	// We should return without the sync finishing of its own accord, and the
+	// sync should be told to give up.
+	syncBeforeUnmount(syncer, t.signals)
+	<-cancelled
+}
+
+func (t *UnmountTest) CleanUnmount() {
+	err := t.u.Unmount("/some/dir")
+	AssertEq(nil, err)
+
+	ExpectEq(1, t.unmounts)
+	ExpectEq(0, len(t.sleeps))
+	ExpectEq(0, t.lazyUnmount)
+}
+
+func (t *UnmountTest) OtherErrorNotRetried() {
+	t.unmountErrs = []error{errors.New("taco")}
+
+	err := t.u.Unmount("/some/dir")
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	ExpectEq(1, t.unmounts)
+	ExpectEq(0, t.lazyUnmount)
+}
+
+func (t *UnmountTest) BusyThenSucceeds() {
+	t.busyTimes(3)
+
+	err := t.u.Unmount("/some/dir")
+	AssertEq(nil, err)
+
+	ExpectEq(4, t.unmounts)
+	ExpectThat(
+		t.sleeps,
+		ElementsAre(
+			100*time.Millisecond,
+			200*time.Millisecond,
+			400*time.Millisecond))
+
+	ExpectEq(0, t.lazyUnmount)
+}
+
+func (t *UnmountTest) BusyPathError() {
+	t.unmountErrs = []error{
+		&os.PathError{Op: "unmount", Path: "/some/dir", Err: syscall.EBUSY},
+	}
+
+	err := t.u.Unmount("/some/dir")
+	AssertEq(nil, err)
+	ExpectEq(2, t.unmounts)
+}
+
+func (t *UnmountTest) PersistentlyBusy() {
+	t.busyTimes(100)
+
+	err := t.u.Unmount("/some/dir")
+	AssertEq(nil, err)
+
+	// We should back off until the timeout would be exceeded, then go lazy.
+	ExpectThat(
+		t.sleeps,
+		ElementsAre(
+			100*time.Millisecond,
+			200*time.Millisecond,
+			400*time.Millisecond,
+			800*time.Millisecond))
+
+	ExpectEq(5, t.unmounts)
+	ExpectEq(1, t.lazyUnmount)
+}
+
+func (t *UnmountTest) BackoffIsCapped() {
+	t.u.timeout = time.Minute
+	t.busyTimes(100)
+
+	err := t.u.Unmount("/some/dir")
+	AssertEq(nil, err)
+
+	AssertLt(0, len(t.sleeps))
+	for _, d := range t.sleeps {
+		ExpectLe(d, maxUnmountRetryDelay)
+	}
+
+	ExpectEq(maxUnmountRetryDelay, t.sleeps[len(t.sleeps)-1])
+	ExpectEq(1, t.lazyUnmount)
+}
+
+func (t *UnmountTest) LazyUnmountFails() {
+	t.busyTimes(100)
+	t.lazyErr = errors.New("taco")
+
+	err := t.u.Unmount("/some/dir")
+	ExpectThat(err, Error(HasSubstr("Lazy unmount")))
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Build information, injected at build time. For example:
+//
+//     go build -ldflags "-X main.gcsfuseVersion=0.12.0 \
+//         -X main.gitCommit=$(git rev-parse --short HEAD)"
+var (
+	gcsfuseVersion = "unknown"
+	gitCommit      = "unknown"
+)
+
+// Return a string identifying this build of gcsfuse: its version, the commit
+// it was built from, and the version of Go it was built with.
+func getVersion() string {
+	return fmt.Sprintf(
+		"%s (commit %s, %s)",
+		gcsfuseVersion,
+		gitCommit,
+		runtime.Version())
+}
+
+// Return the User-Agent sent with requests to GCS. appName, if non-empty, is
+// appended as a comment so that proxies can tell who is using the mount.
+func getUserAgent(appName string) (ua string) {
+	ua = userAgentProduct + "/" + getVersion()
+	if appName != "" {
+		ua = fmt.Sprintf("%s (%s)", ua, appName)
+	}
+
+	return
+}
+
+// Check a --app-name value for inclusion in the User-Agent header. Line breaks
+// would let it inject headers, so they are an error; other characters that
+// aren't printable ASCII are dropped.
+func parseAppName(s string) (name string, err error) {
+	if strings.ContainsAny(s, "\r\n") {
+		err = fmt.Errorf("Illegal --app-name value: %q contains a line break", s)
+		return
+	}
+
+	name = strings.Map(
+		func(r rune) rune {
+			if r < ' ' || r > '~' {
+				return -1
+			}
+
+			return r
+		},
+		s)
+
+	return
+}
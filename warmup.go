@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/fs"
+	"github.com/googlecloudplatform/gcsfuse/gcsproxy"
+	"github.com/googlecloudplatform/gcsfuse/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// How long we wait for a --warmup-from URL to respond.
+const warmupFetchTimeout = 30 * time.Second
+
+// Read a residency snapshot from a path, or from an http or https URL such as
+// another mount's debug endpoint.
+func readResidencySnapshot(src string) (s *fs.ResidencySnapshot, err error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		client := &http.Client{Timeout: warmupFetchTimeout}
+
+		var resp *http.Response
+		resp, err = client.Get(src)
+		if err != nil {
+			err = fmt.Errorf("Get: %v", err)
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("Get: %s", resp.Status)
+			return
+		}
+
+		r = resp.Body
+	} else {
+		r, err = os.Open(src)
+		if err != nil {
+			err = fmt.Errorf("Open: %v", err)
+			return
+		}
+	}
+
+	defer r.Close()
+
+	s, err = fs.DecodeResidencySnapshot(r)
+	if err != nil {
+		err = fmt.Errorf("DecodeResidencySnapshot: %v", err)
+		return
+	}
+
+	return
+}
+
+// Read the snapshot named by --warmup-from and hand it to the prefetcher. See
+// fs.WarmUp. Failures are logged, never fatal.
+func warmUpFrom(
+	src string,
+	chunkSize uint64,
+	bucket gcs.Bucket,
+	prefetcher gcsproxy.PrefetchBucket) {
+	s, err := readResidencySnapshot(src)
+	if err != nil {
+		logger.Errorf("Not warming up from %q: %v", src, err)
+		return
+	}
+
+	fs.WarmUp(context.Background(), s, chunkSize, bucket, prefetcher)
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const warmupTestSnapshot = `{
+	"version": 1,
+	"chunk_size": 4,
+	"objects": [{"name": "foo", "generation": 17, "chunks": [0, 2]}]
+}`
+
+type WarmupTest struct {
+	dir string
+}
+
+var _ SetUpInterface = &WarmupTest{}
+var _ TearDownInterface = &WarmupTest{}
+
+func init() { RegisterTestSuite(&WarmupTest{}) }
+
+func (t *WarmupTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "warmup_test")
+	AssertEq(nil, err)
+}
+
+func (t *WarmupTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+// Serve the supplied body with the supplied status.
+func serveSnapshot(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		}))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *WarmupTest) ReadsFile() {
+	p := path.Join(t.dir, "snapshot.json")
+	err := ioutil.WriteFile(p, []byte(warmupTestSnapshot), 0600)
+	AssertEq(nil, err)
+
+	s, err := readResidencySnapshot(p)
+	AssertEq(nil, err)
+	AssertEq(1, len(s.Objects))
+	ExpectEq("foo", s.Objects[0].Name)
+	ExpectEq(17, s.Objects[0].Generation)
+	ExpectThat(s.Objects[0].Chunks, ElementsAre(0, 2))
+}
+
+func (t *WarmupTest) ReadsURL() {
+	server := serveSnapshot(http.StatusOK, warmupTestSnapshot)
+	defer server.Close()
+
+	s, err := readResidencySnapshot(server.URL + "/residency?format=json")
+	AssertEq(nil, err)
+	ExpectEq(4, s.ChunkSize)
+	ExpectEq(1, len(s.Objects))
+}
+
+func (t *WarmupTest) Errors() {
+	server := serveSnapshot(http.StatusNotFound, "")
+	defer server.Close()
+
+	_, err := readResidencySnapshot(server.URL)
+	ExpectThat(err, Error(HasSubstr("404")))
+
+	_, err = readResidencySnapshot(path.Join(t.dir, "missing"))
+	ExpectThat(err, Error(HasSubstr("Open")))
+
+	p := path.Join(t.dir, "future.json")
+	err = ioutil.WriteFile(p, []byte(`{"version": 99}`), 0600)
+	AssertEq(nil, err)
+
+	_, err = readResidencySnapshot(p)
+	ExpectThat(err, Error(HasSubstr("version 99")))
+}